@@ -1,11 +1,21 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
 	"context"
+	"crypto/x509"
+	"database/sql"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -14,9 +24,16 @@ import (
 	"github.com/fenilsonani/email-server/internal/autodiscover"
 	"github.com/fenilsonani/email-server/internal/config"
 	"github.com/fenilsonani/email-server/internal/dav"
+	"github.com/fenilsonani/email-server/internal/diskmon"
 	"github.com/fenilsonani/email-server/internal/dns"
+	"github.com/fenilsonani/email-server/internal/dnsmon"
 	imapserver "github.com/fenilsonani/email-server/internal/imap"
+	"github.com/fenilsonani/email-server/internal/jmap"
 	"github.com/fenilsonani/email-server/internal/logging"
+	"github.com/fenilsonani/email-server/internal/maintenance"
+	"github.com/fenilsonani/email-server/internal/metrics"
+	"github.com/fenilsonani/email-server/internal/msgid"
+	"github.com/fenilsonani/email-server/internal/provision"
 	"github.com/fenilsonani/email-server/internal/queue"
 	"github.com/fenilsonani/email-server/internal/security"
 	"github.com/fenilsonani/email-server/internal/setup"
@@ -25,7 +42,9 @@ import (
 	"github.com/fenilsonani/email-server/internal/smtp/delivery"
 	"github.com/fenilsonani/email-server/internal/storage/maildir"
 	"github.com/fenilsonani/email-server/internal/storage/metadata"
+	"github.com/fenilsonani/email-server/internal/storage/objectstore"
 	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
 )
 
 var (
@@ -51,8 +70,9 @@ var rootCmd = &cobra.Command{
 - CardDAV for contacts sync
 - Multiple domains with DKIM signing`,
 	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
-		// Skip config loading for help commands
-		if cmd.Name() == "help" || cmd.Name() == "version" {
+		// Skip config loading for help commands; config validate and
+		// upgrade load it themselves
+		if cmd.Name() == "help" || cmd.Name() == "version" || cmd == configValidateCmd || cmd == configUpgradeCmd {
 			return nil
 		}
 
@@ -61,6 +81,7 @@ var rootCmd = &cobra.Command{
 		if err != nil {
 			return fmt.Errorf("failed to load config: %w", err)
 		}
+		printConfigWarnings(os.Stderr, cfgFile, cfg.Warnings)
 
 		return nil
 	},
@@ -83,12 +104,20 @@ var serveCmd = &cobra.Command{
 		// Track resources for cleanup
 		type resourceTracker struct {
 			db             *metadata.DB
-			redisQueue     *queue.RedisQueue
+			store          *maildir.Store
+			queue          queue.Queue
 			deliveryEngine *delivery.Engine
 			imapSrv        *imapserver.Server
 			smtpSrv        *smtpserver.Server
 			davSrv         *dav.Server
+			jmapSrv        *jmap.Server
 			adminSrv       *admin.Server
+			diskMonitor    *diskmon.Monitor
+			maintenance    *maintenance.Scheduler
+			usage          *maildir.UsageRecomputer
+			dnsMonitor     *dnsmon.Monitor
+			authLog        *auth.AuthLog
+			reputation     *smtpserver.Reputation
 			logger         *logging.Logger
 		}
 		resources := &resourceTracker{}
@@ -139,6 +168,20 @@ var serveCmd = &cobra.Command{
 				}
 			}
 
+			// Stop JMAP server
+			if resources.jmapSrv != nil {
+				if resources.logger != nil {
+					resources.logger.Info("Shutting down JMAP server")
+				}
+				if err := resources.jmapSrv.Shutdown(shutdownCtx); err != nil {
+					if resources.logger != nil {
+						resources.logger.Error("JMAP server shutdown error", "error", err.Error())
+					} else {
+						fmt.Fprintf(os.Stderr, "JMAP server shutdown error: %v\n", err)
+					}
+				}
+			}
+
 			// 3. Stop SMTP servers (no new mail)
 			if resources.smtpSrv != nil {
 				if resources.logger != nil {
@@ -158,7 +201,7 @@ var serveCmd = &cobra.Command{
 				if resources.logger != nil {
 					resources.logger.Info("Shutting down IMAP servers")
 				}
-				if err := resources.imapSrv.Close(); err != nil {
+				if err := resources.imapSrv.Shutdown(shutdownCtx); err != nil {
 					if resources.logger != nil {
 						resources.logger.Error("IMAP server shutdown error", "error", err.Error())
 					} else {
@@ -172,24 +215,52 @@ var serveCmd = &cobra.Command{
 				if resources.logger != nil {
 					resources.logger.Info("Stopping delivery engine")
 				}
-				resources.deliveryEngine.Stop()
+				if err := resources.deliveryEngine.Stop(shutdownCtx); err != nil {
+					if resources.logger != nil {
+						resources.logger.Error("Delivery engine shutdown error", "error", err.Error())
+					} else {
+						fmt.Fprintf(os.Stderr, "Delivery engine shutdown error: %v\n", err)
+					}
+				}
+			}
+
+			// 5. Stop disk monitor and scheduled maintenance
+			if resources.diskMonitor != nil {
+				resources.diskMonitor.Stop()
+			}
+			if resources.maintenance != nil {
+				resources.maintenance.Stop()
+			}
+			if resources.usage != nil {
+				resources.usage.Stop()
+			}
+			if resources.dnsMonitor != nil {
+				resources.dnsMonitor.Stop()
+			}
+
+			// Write the login attempts and reputation scores still queued,
+			// and finish deleting released message bodies
+			resources.authLog.Close()
+			resources.reputation.Close()
+			if resources.store != nil {
+				resources.store.Close()
 			}
 
-			// 5. Close Redis queue connection
-			if resources.redisQueue != nil {
+			// 6. Close the queue
+			if resources.queue != nil {
 				if resources.logger != nil {
-					resources.logger.Info("Closing Redis queue connection")
+					resources.logger.Info("Closing queue")
 				}
-				if err := resources.redisQueue.Close(); err != nil {
+				if err := resources.queue.Close(); err != nil {
 					if resources.logger != nil {
-						resources.logger.Error("Redis queue close error", "error", err.Error())
+						resources.logger.Error("Queue close error", "error", err.Error())
 					} else {
-						fmt.Fprintf(os.Stderr, "Redis queue close error: %v\n", err)
+						fmt.Fprintf(os.Stderr, "Queue close error: %v\n", err)
 					}
 				}
 			}
 
-			// 6. Close database last (after all users are done)
+			// 7. Close database last (after all users are done)
 			if resources.db != nil {
 				if resources.logger != nil {
 					resources.logger.Info("Closing database")
@@ -262,69 +333,141 @@ var serveCmd = &cobra.Command{
 
 		// Initialize authenticator
 		authenticator := auth.NewAuthenticator(db.DB)
+		authenticator.SetRoleRoutes(roleRoutes(cfg))
+		resources.authLog = auth.NewAuthLog(db.DB)
+		authenticator.SetAuthLog(resources.authLog)
 
 		// Initialize maildir store
-		store, err := maildir.NewStore(db.DB, cfg.Storage.MaildirPath)
+		store, err := newMessageStore(cfg, db)
 		if err != nil {
 			cleanup()
 			return fmt.Errorf("failed to initialize maildir store: %w", err)
 		}
-		logger.Info("Maildir store initialized", "path", cfg.Storage.MaildirPath)
+		resources.store = store
+		store.SetDefaultMailboxes(provision.DefaultMailboxes(cfg))
+		store.SetMailboxLimits(cfg.Storage.MaxMailboxes, cfg.Storage.MaxMailboxDepth)
+		store.SetQuotaEnforcement(cfg.Storage.EnforceQuota)
+		logger.Info("Maildir store initialized", "path", cfg.Storage.MaildirPath, "body_store", cfg.Storage.BodyStore)
+
+		// Start disk monitor so SMTP can refuse mail before the disk fills
+		diskCheckInterval, _ := time.ParseDuration(cfg.Storage.DiskCheckInterval)
+		diskMonitor := diskmon.New(diskmon.Config{
+			Paths:         []string{cfg.Storage.MaildirPath, filepath.Dir(cfg.Storage.DatabasePath)},
+			MinFreeBytes:  uint64(cfg.Storage.MinFreeBytes),
+			MinFreeInodes: uint64(cfg.Storage.MinFreeInodes),
+			Interval:      diskCheckInterval,
+		}, nil)
+		diskMonitor.OnPoll(func(usage []diskmon.Usage) {
+			for _, u := range usage {
+				metrics.DiskFreeBytes.WithLabelValues(u.Path).Set(float64(u.FreeBytes))
+				metrics.DiskFreeInodes.WithLabelValues(u.Path).Set(float64(u.FreeInodes))
+				if u.Low {
+					logger.Warn("Low disk space", "path", u.Path, "free_bytes", u.FreeBytes, "free_inodes", u.FreeInodes)
+				}
+			}
+		})
+		diskMonitor.Start()
+		resources.diskMonitor = diskMonitor
+
+		// Vacuum the database and prune maildir tmp, if scheduled
+		if cfg.Storage.MaintenanceInterval != "" {
+			interval, _ := time.ParseDuration(cfg.Storage.MaintenanceInterval)
+			scheduler := maintenance.NewScheduler(db, store, interval, func(report *maintenance.Report, err error) {
+				if err != nil {
+					logger.Error("Scheduled maintenance failed", "error", err.Error())
+					return
+				}
+				logger.Info("Scheduled maintenance complete",
+					"database_reclaimed_bytes", report.DatabaseReclaimed,
+					"tmp_files_removed", report.TmpFiles,
+					"tmp_reclaimed_bytes", report.TmpReclaimed,
+					"sent_emails_pruned", report.SentEmailsPruned,
+					"delivery_attempts_pruned", report.AttemptsPruned,
+					"auth_log_pruned", report.AuthLogPruned,
+					"duration", report.Duration.String(),
+				)
+			})
+			scheduler.Start()
+			resources.maintenance = scheduler
+			logger.Info("Scheduled maintenance enabled", "interval", interval.String())
+		}
+
+		// Correct quota usage drift from the messages actually stored
+		if cfg.Storage.QuotaRecomputeInterval != "" {
+			interval, _ := time.ParseDuration(cfg.Storage.QuotaRecomputeInterval)
+			recomputer := maildir.NewUsageRecomputer(store, interval, func(corrected int, err error) {
+				if err != nil {
+					logger.Error("Quota usage recompute failed", "error", err.Error())
+					return
+				}
+				if corrected > 0 {
+					logger.Info("Corrected quota usage", "users", corrected)
+				}
+			})
+			recomputer.Start()
+			resources.usage = recomputer
+		}
 
-		// Initialize Redis queue with connection validation
-		retryMaxAge, _ := time.ParseDuration(cfg.Queue.RetryMaxAge)
-		if retryMaxAge == 0 {
-			retryMaxAge = 7 * 24 * time.Hour
+		// Re-check the domains' DNS records, alerting when one stops passing
+		if cfg.DNSCheck.Interval != "" {
+			interval, _ := time.ParseDuration(cfg.DNSCheck.Interval)
+			domains := make([]string, 0, len(cfg.Domains))
+			for _, d := range cfg.Domains {
+				domains = append(domains, d.Name)
+			}
+			dnsMonitor := dnsmon.New(dnsmon.Config{
+				Domains:    domains,
+				MailServer: cfg.Server.Hostname,
+				Interval:   interval,
+			}, nil)
+			dnsMonitor.OnCheck(func(result dnsmon.DomainResult) {
+				for _, r := range result.Results {
+					passing := 0.0
+					if r.Status == dns.StatusPass {
+						passing = 1
+					}
+					metrics.DNSRecordPassing.WithLabelValues(result.Domain, r.RecordType).Set(passing)
+				}
+			})
+			var webhook func(dnsmon.Alert) error
+			if cfg.DNSCheck.WebhookURL != "" {
+				webhook = dnsmon.Webhook(cfg.DNSCheck.WebhookURL)
+			}
+			dnsMonitor.OnAlert(func(alert dnsmon.Alert) {
+				metrics.DNSAlerts.WithLabelValues(alert.Domain, alert.RecordType).Inc()
+				logger.Error("DNS record stopped passing",
+					"domain", alert.Domain,
+					"record", alert.RecordType,
+					"status", alert.Current,
+					"message", alert.Message,
+				)
+				if webhook != nil {
+					if err := webhook(alert); err != nil {
+						logger.Warn("Failed to send DNS alert webhook", "error", err.Error())
+					}
+				}
+			})
+			dnsMonitor.Start()
+			resources.dnsMonitor = dnsMonitor
+			logger.Info("Scheduled DNS checks enabled", "interval", interval.String(), "domains", len(domains))
 		}
-		redisQueue, err := queue.NewRedisQueue(queue.Config{
-			RedisURL:    cfg.Queue.RedisURL,
-			Prefix:      cfg.Queue.Prefix,
-			MaxRetries:  cfg.Queue.MaxRetries,
-			RetryMaxAge: retryMaxAge,
-		})
+
+		// Initialize the queue and re-enqueue mail a restart dropped from it
+		mailQueue, err := openQueue(cfg, logger)
 		if err != nil {
 			cleanup()
-			return fmt.Errorf("failed to initialize Redis queue: %w", err)
+			return err
 		}
-		resources.redisQueue = redisQueue
-		logger.Info("Redis queue connected", "url", cfg.Queue.RedisURL)
+		resources.queue = mailQueue
 
 		// Initialize DKIM signer pool
-		dkimPool := security.NewDKIMSignerPool()
-		for _, domain := range cfg.Domains {
-			if domain.DKIMKeyFile != "" {
-				if err := dkimPool.AddSigner(domain.Name, domain.DKIMSelector, domain.DKIMKeyFile); err != nil {
-					logger.Warn("Failed to load DKIM key for domain",
-						"domain", domain.Name,
-						"error", err.Error())
-				} else {
-					logger.Info("Loaded DKIM key", "domain", domain.Name, "selector", domain.DKIMSelector)
-				}
-			}
-		}
+		dkimPool := dkimSigners(cfg, logger)
 
 		// Initialize delivery engine
-		connectTimeout, _ := time.ParseDuration(cfg.Delivery.ConnectTimeout)
-		if connectTimeout == 0 {
-			connectTimeout = 30 * time.Second
-		}
-		commandTimeout, _ := time.ParseDuration(cfg.Delivery.CommandTimeout)
-		if commandTimeout == 0 {
-			commandTimeout = 5 * time.Minute
-		}
-		// QueuePath for bounce messages - same as SMTP backend queue path
-		queuePath := filepath.Join(cfg.Storage.DataDir, "queue")
-		deliveryEngine := delivery.NewEngine(delivery.Config{
-			Workers:        cfg.Delivery.Workers,
-			Hostname:       cfg.Server.Hostname,
-			ConnectTimeout: connectTimeout,
-			CommandTimeout: commandTimeout,
-			MaxMessageSize: int64(cfg.Security.MaxMessageSize),
-			RequireTLS:     cfg.Delivery.RequireTLS,
-			VerifyTLS:      cfg.Delivery.VerifyTLS,
-			RelayHost:      cfg.Delivery.RelayHost,
-			QueuePath:      queuePath,
-		}, redisQueue, dkimPool, logger)
+		deliveryEngine := delivery.NewEngine(deliveryConfig(cfg), mailQueue, dkimPool, logger)
+		deliveryEngine.SetAttemptLog(delivery.NewAttemptLog(db.DB))
+		sentLog := delivery.NewSentLog(db.DB)
+		deliveryEngine.SetSentLog(sentLog)
 		resources.deliveryEngine = deliveryEngine
 		deliveryEngine.Start()
 		logger.Info("Delivery engine started", "workers", cfg.Delivery.Workers)
@@ -332,8 +475,69 @@ var serveCmd = &cobra.Command{
 		// Create IMAP server
 		imapAddr := fmt.Sprintf(":%d", cfg.Server.IMAPPort)
 		imapsAddr := fmt.Sprintf(":%d", cfg.Server.IMAPSPort)
+
+		// Log the protocol exchange of the clients being debugged
+		traceDuration, _ := time.ParseDuration(cfg.Logging.Trace.Duration)
+		traceUntil := time.Now().Add(traceDuration)
+		tracer, err := logging.NewTracer(logger, cfg.Logging.Trace.IPs, cfg.Logging.Trace.Users, traceUntil)
+		if err != nil {
+			return fmt.Errorf("failed to set up protocol tracing: %w", err)
+		}
+		if tracer != nil {
+			logger.Info("Protocol tracing enabled", "until", traceUntil.Format(time.RFC3339))
+			if cfg.Logging.Level != "debug" {
+				logger.Warn("Protocol traces are logged at debug level, which logging.level hides")
+			}
+		}
+		// Refuse clients that keep failing logins or sending spam
+		var reputation *smtpserver.Reputation
+		if rc := cfg.Security.Reputation; rc.Enabled {
+			var reputationDB *sql.DB
+			if rc.Persist {
+				reputationDB = db.DB
+			}
+			halfLife, _ := time.ParseDuration(rc.HalfLife)
+			reputation, err = smtpserver.NewReputation(reputationDB, rc.Threshold, halfLife, logger)
+			if err != nil {
+				cleanup()
+				return fmt.Errorf("failed to set up IP reputation: %w", err)
+			}
+			resources.reputation = reputation
+			logger.Info("IP reputation enabled", "threshold", rc.Threshold, "half_life", rc.HalfLife)
+		} else if len(cfg.SMTP.Honeypot.Addresses) > 0 {
+			logger.Warn("Spam traps discard mail but don't throttle its senders while security.reputation is off")
+		}
+
 		imapSrv := imapserver.NewServer(authenticator, store, imapAddr, imapsAddr, tlsManager.TLSConfig())
 		resources.imapSrv = imapSrv
+		imapSrv.SetRequireTLSForAuth(cfg.IMAP.RequireTLSForAuth)
+		imapSrv.SetClientCertAuth(cfg.IMAP.ClientCertAuth)
+		imapSrv.SetSharedPrefix(cfg.IMAP.SharedPrefix)
+		imapSrv.SetTracer(tracer)
+		if reputation != nil {
+			imapSrv.SetReputation(reputation)
+		}
+
+		if cfg.Submission.SaveToSent {
+			sentDedupeWindow, _ := time.ParseDuration(cfg.Submission.SentDedupeWindow)
+			imapSrv.SetSentDedupeWindow(sentDedupeWindow)
+		}
+
+		if cfg.Push.Enabled {
+			notifier, err := imapserver.NewAPNsNotifier(imapserver.APNsConfig{
+				KeyFile: cfg.Push.KeyFile,
+				KeyID:   cfg.Push.KeyID,
+				TeamID:  cfg.Push.TeamID,
+				Topic:   cfg.Push.Topic,
+				Sandbox: cfg.Push.Sandbox,
+			})
+			if err != nil {
+				cleanup()
+				return fmt.Errorf("failed to initialize APNs: %w", err)
+			}
+			imapSrv.SetPushNotifier(imapserver.NewPushStore(db.DB), notifier, cfg.Push.Topic)
+			logger.Info("APNs push notifications enabled", "topic", cfg.Push.Topic)
+		}
 
 		// Create SMTP backend and server
 		smtpBackend, err := smtpserver.NewBackend(cfg, authenticator, store, deliveryEngine, logger)
@@ -346,6 +550,18 @@ var serveCmd = &cobra.Command{
 		smtpBackend.SetLocalDeliveryNotifier(func(username, mailbox string) {
 			imapSrv.NotifyMailboxUpdateByName(username, mailbox)
 		})
+		smtpBackend.SetDiskMonitor(diskMonitor)
+		smtpBackend.SetSentLog(sentLog)
+		smtpBackend.SetReputation(reputation)
+		smtpBackend.SetAccessRules(smtpserver.NewAccessRules(db.DB))
+		smtpBackend.SetTracer(tracer)
+
+		// Warn loudly if a misconfiguration lets anyone relay through us
+		if err := smtpBackend.CheckOpenRelay(); errors.Is(err, smtpserver.ErrRelayCheckInconclusive) {
+			logger.Warn("Open relay self-test inconclusive", "error", err.Error())
+		} else if err != nil {
+			logger.Error("Open relay self-test failed", "error", err.Error())
+		}
 
 		// Initialize Sieve executor if enabled
 		var sieveStore *sieve.Store
@@ -365,41 +581,27 @@ var serveCmd = &cobra.Command{
 			cfg.Server.SMTPPort, cfg.Server.SubmissionPort, cfg.Server.SMTPSPort)
 		fmt.Printf("  IMAP:  %d, %d (TLS)\n", cfg.Server.IMAPPort, cfg.Server.IMAPSPort)
 
-		// Start IMAP servers
-		if err := imapSrv.ListenAndServe(); err != nil {
-			cleanup()
-			return fmt.Errorf("failed to start IMAP server: %w", err)
+		// Start IMAP and SMTP listeners. A port that fails to bind is
+		// logged and skipped so the remaining services still come up.
+		mailListeners := []mailListener{
+			{name: "IMAP", port: cfg.Server.IMAPPort, start: imapSrv.ListenAndServe},
+			{name: "SMTP MX", port: cfg.Server.SMTPPort, start: smtpSrv.ListenAndServe},
+			{name: "SMTP submission", port: cfg.Server.SubmissionPort, start: smtpSrv.ListenAndServeSubmission},
 		}
-		logger.Info("IMAP server started", "port", cfg.Server.IMAPPort)
-
 		if tlsManager.HasTLS() {
-			if err := imapSrv.ListenAndServeTLS(tlsManager.TLSConfig()); err != nil {
-				cleanup()
-				return fmt.Errorf("failed to start IMAPS server: %w", err)
-			}
-			logger.Info("IMAPS server started", "port", cfg.Server.IMAPSPort)
-		}
-
-		// Start SMTP servers
-		if err := smtpSrv.ListenAndServe(); err != nil {
-			cleanup()
-			return fmt.Errorf("failed to start SMTP server: %w", err)
+			mailListeners = append(mailListeners,
+				mailListener{name: "IMAPS", port: cfg.Server.IMAPSPort, start: func() error {
+					return imapSrv.ListenAndServeTLS(tlsManager.TLSConfig())
+				}},
+				mailListener{name: "SMTPS", port: cfg.Server.SMTPSPort, start: smtpSrv.ListenAndServeTLS},
+			)
 		}
-		logger.Info("SMTP MX server started", "port", cfg.Server.SMTPPort)
-
-		if err := smtpSrv.ListenAndServeSubmission(); err != nil {
+		live, err := startMailListeners(logger, mailListeners)
+		if err != nil {
 			cleanup()
-			return fmt.Errorf("failed to start SMTP submission server: %w", err)
-		}
-		logger.Info("SMTP submission server started", "port", cfg.Server.SubmissionPort)
-
-		if tlsManager.HasTLS() {
-			if err := smtpSrv.ListenAndServeTLS(); err != nil {
-				cleanup()
-				return fmt.Errorf("failed to start SMTPS server: %w", err)
-			}
-			logger.Info("SMTPS server started", "port", cfg.Server.SMTPSPort)
+			return err
 		}
+		fmt.Printf("  Live:  %s\n", strings.Join(live, ", "))
 
 		// Start DAV server (CalDAV/CardDAV)
 		if cfg.Server.DAVPort > 0 {
@@ -419,12 +621,34 @@ var serveCmd = &cobra.Command{
 			}
 		}
 
+		// Start JMAP server if enabled
+		if cfg.JMAP.Enabled {
+			jmapSrv, err := jmap.NewServer(authenticator, store)
+			if err != nil {
+				logger.Warn("Failed to initialize JMAP server", "error", err.Error())
+			} else {
+				resources.jmapSrv = jmapSrv
+				jmapAddr := fmt.Sprintf("%s:%d", cfg.JMAP.Listen, cfg.JMAP.Port)
+				go func() {
+					if err := jmapSrv.Start(jmapAddr, tlsManager.TLSConfig()); err != nil {
+						logger.Error("JMAP server error", "error", err.Error())
+					}
+				}()
+				fmt.Printf("  JMAP:  %d (read-only)\n", cfg.JMAP.Port)
+				logger.Info("JMAP server started", "addr", jmapAddr)
+			}
+		}
+
 		// Start admin server if enabled
 		if cfg.Admin.Enabled {
-			adminSrv, err := admin.NewServer(cfg, db.DB, authenticator, store, sieveStore, redisQueue, logger)
+			adminSrv, err := admin.NewServer(cfg, db.DB, authenticator, store, sieveStore, mailQueue, logger)
 			if err != nil {
 				logger.Warn("Failed to initialize admin server", "error", err.Error())
 			} else {
+				adminSrv.SetDiskMonitor(diskMonitor)
+				adminSrv.SetDNSMonitor(resources.dnsMonitor)
+				adminSrv.SetDKIMSigners(dkimPool)
+				adminSrv.SetReputation(reputation)
 				resources.adminSrv = adminSrv
 				adminAddr := fmt.Sprintf("%s:%d", cfg.Admin.Listen, cfg.Admin.Port)
 				go func() {
@@ -461,7 +685,13 @@ var serveCmd = &cobra.Command{
 		}
 
 		fmt.Println("\nServer is running. Press Ctrl+C to stop.")
-		logger.Info("All services started successfully")
+		if len(live) == len(mailListeners) {
+			logger.Info("All services started successfully")
+		} else {
+			logger.Warn("Server started with some listeners down",
+				"live", strings.Join(live, ", "),
+			)
+		}
 
 		// Setup signal handling for graceful shutdown
 		sigCh := make(chan os.Signal, 1)
@@ -504,6 +734,128 @@ var migrateCmd = &cobra.Command{
 	},
 }
 
+// Config commands
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Inspect and upgrade the configuration file",
+}
+
+var configValidateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Check the configuration file without starting the server",
+	Long:  `Loads the configuration and reports every problem found. Exits non-zero if there are any; the database and ports are not touched.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if code := runConfigValidate(cfgFile, os.Stdout); code != 0 {
+			os.Exit(code)
+		}
+	},
+}
+
+var configPrintCmd = &cobra.Command{
+	Use:   "print",
+	Short: "Print the effective configuration with secrets redacted",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		out, err := yaml.Marshal(cfg.Redacted())
+		if err != nil {
+			return fmt.Errorf("failed to encode config: %w", err)
+		}
+		fmt.Print(string(out))
+		return nil
+	},
+}
+
+var configUpgradeDryRun bool
+
+var configUpgradeCmd = &cobra.Command{
+	Use:   "upgrade",
+	Short: "Rewrite the configuration file in the current config_version",
+	Long: `Migrates a configuration file written for an older release to the current
+layout: renamed keys are moved, removed keys dropped and changed defaults
+pinned to their old values. Comments are kept; the original file is saved
+with a .bak suffix.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runConfigUpgrade(cfgFile, configUpgradeDryRun, os.Stdout)
+	},
+}
+
+// runConfigUpgrade upgrades the config file at path, or with dryRun writes
+// the upgraded file to w instead
+func runConfigUpgrade(path string, dryRun bool, w io.Writer) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	upgraded, notes, err := config.Upgrade(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if bytes.Equal(upgraded, data) {
+		fmt.Fprintf(w, "%s: already at config_version %d\n", path, config.CurrentVersion)
+		return nil
+	}
+	if dryRun {
+		_, err := w.Write(upgraded)
+		return err
+	}
+
+	if err := os.WriteFile(path+".bak", data, info.Mode().Perm()); err != nil {
+		return fmt.Errorf("failed to back up config: %w", err)
+	}
+	if err := os.WriteFile(path, upgraded, info.Mode().Perm()); err != nil {
+		return fmt.Errorf("failed to write config: %w", err)
+	}
+	fmt.Fprintf(w, "%s: upgraded to config_version %d (original saved as %s.bak)\n", path, config.CurrentVersion, path)
+	for _, note := range notes {
+		fmt.Fprintf(w, "  - %s\n", note)
+	}
+	return nil
+}
+
+// printConfigWarnings reports the problems found loading a config file
+func printConfigWarnings(w io.Writer, path string, warnings []string) {
+	for _, warning := range warnings {
+		fmt.Fprintf(w, "warning: %s: %s\n", path, warning)
+	}
+}
+
+// runConfigValidate validates the config file at path, writing one line per
+// problem to w, and returns the process exit code
+func runConfigValidate(path string, w io.Writer) int {
+	if _, err := os.Stat(path); err != nil {
+		fmt.Fprintf(w, "%s: %v\n", path, err)
+		return 1
+	}
+
+	c, err := config.Load(path)
+	if err != nil {
+		fmt.Fprintf(w, "%s: %v\n", path, err)
+		return 1
+	}
+	printConfigWarnings(w, path, c.Warnings)
+
+	err = c.Validate()
+	if err == nil {
+		fmt.Fprintf(w, "%s: configuration is valid\n", path)
+		return 0
+	}
+
+	var verr *config.ValidationError
+	if !errors.As(err, &verr) {
+		fmt.Fprintf(w, "%s: %v\n", path, err)
+		return 1
+	}
+	fmt.Fprintf(w, "%s: %d problem(s) found\n", path, len(verr.Problems))
+	for _, p := range verr.Problems {
+		fmt.Fprintf(w, "  - %v\n", p)
+	}
+	return 1
+}
+
 // Domain management commands
 var domainCmd = &cobra.Command{
 	Use:   "domain",
@@ -532,16 +884,10 @@ var domainAddCmd = &cobra.Command{
 			return fmt.Errorf("failed to run migrations: %w", err)
 		}
 
-		// Insert domain
-		result, err := db.ExecContext(context.Background(),
-			"INSERT INTO domains (name, dkim_selector) VALUES (?, ?)",
-			domainName, "mail",
-		)
+		id, err := auth.NewAuthenticator(db.DB).CreateDomain(context.Background(), domainName)
 		if err != nil {
-			return fmt.Errorf("failed to add domain: %w", err)
+			return err
 		}
-
-		id, _ := result.LastInsertId()
 		fmt.Printf("Domain '%s' added with ID %d\n", domainName, id)
 		return nil
 	},
@@ -620,62 +966,27 @@ var userAddCmd = &cobra.Command{
 			return fmt.Errorf("failed to run migrations: %w", err)
 		}
 
-		// Parse email
-		authenticator := auth.NewAuthenticator(db.DB)
-		parts := splitEmail(email)
-		if len(parts) != 2 {
-			return fmt.Errorf("invalid email format: %s", email)
-		}
-		username, domain := parts[0], parts[1]
-
-		// Get domain ID
-		domainID, err := authenticator.GetDomainID(context.Background(), domain)
+		store, err := newMessageStore(cfg, db)
 		if err != nil {
-			return fmt.Errorf("domain '%s' not found. Add it first with: mailserver domain add %s", domain, domain)
+			return fmt.Errorf("failed to initialize maildir store: %w", err)
 		}
+		mailboxes := provision.DefaultMailboxes(cfg)
+		store.SetDefaultMailboxes(mailboxes)
 
-		// Hash password
-		hash, err := auth.HashPassword(password)
-		if err != nil {
-			return fmt.Errorf("failed to hash password: %w", err)
+		user, err := provision.CreateUser(context.Background(), cfg, auth.NewAuthenticator(db.DB), store, email, password)
+		if user == nil {
+			return err
 		}
-
-		// Insert user
-		result, err := db.ExecContext(context.Background(),
-			"INSERT INTO users (domain_id, username, password_hash) VALUES (?, ?, ?)",
-			domainID, username, hash,
-		)
 		if err != nil {
-			return fmt.Errorf("failed to add user: %w", err)
+			fmt.Printf("Warning: %v\n", err)
 		}
 
-		userID, _ := result.LastInsertId()
-
-		// Create default mailboxes
-		defaultMailboxes := []struct {
-			name       string
-			specialUse string
-		}{
-			{"INBOX", ""},
-			{"Drafts", `\Drafts`},
-			{"Sent", `\Sent`},
-			{"Trash", `\Trash`},
-			{"Junk", `\Junk`},
-			{"Archive", `\Archive`},
-		}
-
-		for _, mb := range defaultMailboxes {
-			_, err = db.ExecContext(context.Background(),
-				"INSERT INTO mailboxes (user_id, name, uidvalidity, uidnext, special_use) VALUES (?, ?, ?, 1, ?)",
-				userID, mb.name, generateUIDValidity(), mb.specialUse,
-			)
-			if err != nil {
-				fmt.Printf("Warning: failed to create mailbox %s: %v\n", mb.name, err)
-			}
+		names := make([]string, len(mailboxes))
+		for i, mb := range mailboxes {
+			names[i] = mb.Name
 		}
-
-		fmt.Printf("User '%s' added with ID %d\n", email, userID)
-		fmt.Println("Default mailboxes created: INBOX, Drafts, Sent, Trash, Junk, Archive")
+		fmt.Printf("User '%s' added with ID %d\n", user.Email, user.ID)
+		fmt.Printf("Default mailboxes created: %s\n", strings.Join(names, ", "))
 		return nil
 	},
 }
@@ -783,108 +1094,725 @@ var userPasswdCmd = &cobra.Command{
 	},
 }
 
-// DNS management commands
-var dnsCmd = &cobra.Command{
-	Use:   "dns",
-	Short: "DNS record checking and generation",
-}
+var (
+	userCanSend    bool
+	userCanReceive bool
+)
 
-var dnsCheckCmd = &cobra.Command{
-	Use:   "check <domain>",
-	Short: "Check DNS configuration for a domain",
-	Args:  cobra.ExactArgs(1),
+var userAccessCmd = &cobra.Command{
+	Use:   "access <email>",
+	Short: "Show or change whether a user can send and receive mail",
+	Long: `Show or change whether a user can send and receive mail.
+
+A user with sending disabled can still log in over IMAP but submissions
+are refused with 550. A user with receiving disabled has inbound mail
+rejected at RCPT TO.
+
+Examples:
+  mailserver user access shared@example.com --send=false
+  mailserver user access spammer@example.com --send=false --receive=false`,
+	Args: cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
-		domain := args[0]
-		mailServer := cfg.Server.Hostname
+		email := args[0]
 
-		checker, err := dns.NewChecker(domain, mailServer)
+		if err := cfg.EnsureDirectories(); err != nil {
+			return err
+		}
+
+		var err error
+		db, err = metadata.Open(cfg.Storage.DatabasePath)
 		if err != nil {
-			return fmt.Errorf("failed to create DNS checker: %w", err)
+			return fmt.Errorf("failed to open database: %w", err)
 		}
-		results := checker.CheckAll(context.Background())
+		defer db.Close()
 
-		fmt.Printf("DNS Check for %s (mail server: %s)\n", domain, mailServer)
-		fmt.Println("=" + "========================================")
+		if err := db.Migrate(context.Background()); err != nil {
+			return fmt.Errorf("failed to run migrations: %w", err)
+		}
 
-		for _, r := range results {
-			var icon string
-			switch r.Status {
-			case dns.StatusPass:
-				icon = "✓"
-			case dns.StatusFail:
-				icon = "✗"
-			case dns.StatusWarning:
-				icon = "!"
-			case dns.StatusMissing:
-				icon = "?"
-			}
+		authenticator := auth.NewAuthenticator(db.DB)
+		user, err := authenticator.LookupUser(context.Background(), email)
+		if err != nil {
+			return fmt.Errorf("user not found: %s", email)
+		}
 
-			fmt.Printf("[%s] %-8s %s\n", icon, r.RecordType, r.Status)
-			if r.Actual != "" {
-				fmt.Printf("    Found:    %s\n", r.Actual)
-			}
-			if r.Expected != "" && r.Status != dns.StatusPass {
-				fmt.Printf("    Expected: %s\n", r.Expected)
+		canSend, canReceive := user.CanSend, user.CanReceive
+		if cmd.Flags().Changed("send") {
+			canSend = userCanSend
+		}
+		if cmd.Flags().Changed("receive") {
+			canReceive = userCanReceive
+		}
+		if canSend != user.CanSend || canReceive != user.CanReceive {
+			if err := authenticator.SetPermissions(context.Background(), user.ID, canSend, canReceive); err != nil {
+				return err
 			}
-			fmt.Printf("    %s\n\n", r.Message)
 		}
 
+		fmt.Printf("%s: send=%t receive=%t\n", user.Email, canSend, canReceive)
 		return nil
 	},
 }
 
-var dnsGenerateCmd = &cobra.Command{
-	Use:   "generate <domain> [server-ip]",
-	Short: "Generate required DNS records for a domain",
-	Args:  cobra.RangeArgs(1, 2),
+var userCertCmd = &cobra.Command{
+	Use:   "cert <email> <cert.pem>",
+	Short: "Map a TLS client certificate to a user",
+	Long: `Map a TLS client certificate to a user.
+
+With imap.client_cert_auth enabled, an IMAP client presenting the
+certificate can log in as the user with AUTHENTICATE EXTERNAL. The
+certificate is matched by its SHA-256 fingerprint.
+
+Example:
+  mailserver user cert alice@example.com alice.crt`,
+	Args: cobra.ExactArgs(2),
 	RunE: func(cmd *cobra.Command, args []string) error {
-		domain := args[0]
-		mailServer := cfg.Server.Hostname
-		serverIP := ""
-		if len(args) > 1 {
-			serverIP = args[1]
-		}
+		email, certFile := args[0], args[1]
 
-		generator, err := dns.NewGenerator(domain, mailServer, serverIP)
+		data, err := os.ReadFile(certFile)
 		if err != nil {
-			return fmt.Errorf("failed to create DNS generator: %w", err)
+			return fmt.Errorf("failed to read certificate: %w", err)
+		}
+		block, _ := pem.Decode(data)
+		if block == nil || block.Type != "CERTIFICATE" {
+			return fmt.Errorf("%s does not contain a PEM certificate", certFile)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("failed to parse certificate: %w", err)
 		}
 
-		// Try to load DKIM key if configured
-		for _, d := range cfg.Domains {
-			if d.Name == domain && d.DKIMKeyFile != "" {
-				// Read public key
-				fmt.Printf("Using DKIM key from %s\n\n", d.DKIMKeyFile)
-			}
+		if err := cfg.EnsureDirectories(); err != nil {
+			return err
 		}
 
-		records := generator.GenerateAll()
+		db, err = metadata.Open(cfg.Storage.DatabasePath)
+		if err != nil {
+			return fmt.Errorf("failed to open database: %w", err)
+		}
+		defer db.Close()
 
-		fmt.Println(dns.FormatForProvider(records, domain))
+		if err := db.Migrate(context.Background()); err != nil {
+			return fmt.Errorf("failed to run migrations: %w", err)
+		}
 
-		fmt.Println("\nZone file format:")
-		fmt.Println("-----------------")
-		fmt.Println(dns.FormatAsZone(records, domain))
+		authenticator := auth.NewAuthenticator(db.DB)
+		user, err := authenticator.LookupUser(context.Background(), email)
+		if err != nil {
+			return fmt.Errorf("user not found: %s", email)
+		}
+		if err := authenticator.AddClientCertificate(context.Background(), user.ID, cert); err != nil {
+			return err
+		}
 
+		fmt.Printf("Certificate %s (%s, expires %s) mapped to '%s'\n",
+			auth.CertificateFingerprint(cert), cert.Subject, cert.NotAfter.Format("2006-01-02"), user.Email)
+		if !cfg.IMAP.ClientCertAuth {
+			fmt.Println("Note: set imap.client_cert_auth: true to accept it")
+		}
 		return nil
 	},
 }
 
-var versionCmd = &cobra.Command{
-	Use:   "version",
-	Short: "Print version information",
+var userAppPasswordCmd = &cobra.Command{
+	Use:   "app-password",
+	Short: "Manage per-device application passwords",
+	Long: `Manage per-device application passwords.
+
+An application password logs in to IMAP, SMTP and DAV like the main
+password but is refused by the admin panel, and can be revoked on its
+own when a device is lost.`,
+}
+
+var userAppPasswordAddCmd = &cobra.Command{
+	Use:   "add <email> <name>",
+	Short: "Generate an application password",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		authenticator, user, err := openUserAuthenticator(args[0])
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		password, appPassword, err := authenticator.CreateAppPassword(context.Background(), user.ID, args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("App password %d (%s) for '%s': %s\n", appPassword.ID, appPassword.Name, user.Email, password)
+		fmt.Println("It will not be shown again.")
+		return nil
+	},
+}
+
+var userAppPasswordListCmd = &cobra.Command{
+	Use:   "list <email>",
+	Short: "List a user's application passwords",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		authenticator, user, err := openUserAuthenticator(args[0])
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		passwords, err := authenticator.ListAppPasswords(context.Background(), user.ID)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%-5s %-30s %-20s %s\n", "ID", "NAME", "CREATED", "LAST USED")
+		for _, p := range passwords {
+			lastUsed := "never"
+			if p.LastUsedAt != nil {
+				lastUsed = p.LastUsedAt.Format("2006-01-02 15:04")
+			}
+			fmt.Printf("%-5d %-30s %-20s %s\n", p.ID, p.Name, p.CreatedAt.Format("2006-01-02 15:04"), lastUsed)
+		}
+		return nil
+	},
+}
+
+var userAppPasswordRevokeCmd = &cobra.Command{
+	Use:   "revoke <email> <id>",
+	Short: "Revoke an application password",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		id, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid app password id: %s", args[1])
+		}
+		authenticator, user, err := openUserAuthenticator(args[0])
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		if err := authenticator.RevokeAppPassword(context.Background(), user.ID, id); err != nil {
+			return err
+		}
+		fmt.Printf("App password %d revoked for '%s'\n", id, user.Email)
+		return nil
+	},
+}
+
+// openUserAuthenticator opens and migrates the database and looks up the
+// user, for commands that manage one user's credentials. The caller closes db.
+func openUserAuthenticator(email string) (*auth.Authenticator, *auth.User, error) {
+	if err := cfg.EnsureDirectories(); err != nil {
+		return nil, nil, err
+	}
+
+	var err error
+	db, err = metadata.Open(cfg.Storage.DatabasePath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	if err := db.Migrate(context.Background()); err != nil {
+		db.Close()
+		return nil, nil, fmt.Errorf("failed to run migrations: %w", err)
+	}
+
+	authenticator := auth.NewAuthenticator(db.DB)
+	user, err := authenticator.LookupUser(context.Background(), email)
+	if err != nil {
+		db.Close()
+		return nil, nil, fmt.Errorf("user not found: %s", email)
+	}
+	return authenticator, user, nil
+}
+
+// Maildir maintenance commands
+var maildirCmd = &cobra.Command{
+	Use:   "maildir",
+	Short: "Maintain message storage",
+}
+
+var maildirRepairApply bool
+
+var maildirRepairCmd = &cobra.Command{
+	Use:   "repair [email]",
+	Short: "Reconcile the message database with the maildir files on disk",
+	Long: `Reconcile the message database with the maildir files on disk.
+
+Message files with no database row (left by a crash or copied in by an
+external tool) are indexed from their headers and given new UIDs. Rows
+whose file is missing are removed. Without an email every user is checked.
+
+Nothing is changed unless --apply is given; stop the server first.
+
+Examples:
+  mailserver maildir repair
+  mailserver maildir repair user@example.com --apply`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := cfg.EnsureDirectories(); err != nil {
+			return err
+		}
+
+		var err error
+		db, err = metadata.Open(cfg.Storage.DatabasePath)
+		if err != nil {
+			return fmt.Errorf("failed to open database: %w", err)
+		}
+		defer db.Close()
+
+		ctx := context.Background()
+		targets, err := mailboxOwners(ctx, args)
+		if err != nil {
+			return err
+		}
+
+		store, err := newMessageStore(cfg, db)
+		if err != nil {
+			return fmt.Errorf("failed to initialize maildir store: %w", err)
+		}
+		defer store.Close()
+
+		var orphans, dangling int
+		for _, t := range targets {
+			report, err := store.Repair(ctx, t.id, maildirRepairApply)
+			if err != nil {
+				return fmt.Errorf("%s: %w", t.email, err)
+			}
+			for _, o := range report.Orphans {
+				fmt.Printf("%s: file without a row: %s\n", t.email, o)
+			}
+			for _, d := range report.Dangling {
+				fmt.Printf("%s: row without a file: %s\n", t.email, d)
+			}
+			orphans += len(report.Orphans)
+			dangling += len(report.Dangling)
+		}
+
+		fmt.Printf("Checked %d users: %d files without rows, %d rows without files\n", len(targets), orphans, dangling)
+		if orphans+dangling > 0 {
+			if maildirRepairApply {
+				fmt.Println("Indexed the files and removed the rows")
+			} else {
+				fmt.Println("Dry run, nothing changed. Run again with --apply to fix")
+			}
+		}
+		return nil
+	},
+}
+
+// mailboxTarget is a user whose mail a maintenance command works through
+type mailboxTarget struct {
+	id    int64
+	email string
+}
+
+// mailboxOwners returns the user named in args, or every user when there
+// is none
+func mailboxOwners(ctx context.Context, args []string) ([]mailboxTarget, error) {
+	if len(args) == 1 {
+		user, err := auth.NewAuthenticator(db.DB).LookupUser(ctx, args[0])
+		if err != nil {
+			return nil, fmt.Errorf("user not found: %s", args[0])
+		}
+		return []mailboxTarget{{user.ID, user.Email}}, nil
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT u.id, u.username || '@' || d.name
+		FROM users u
+		JOIN domains d ON u.domain_id = d.id
+		ORDER BY d.name, u.username
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query users: %w", err)
+	}
+	defer rows.Close()
+
+	var targets []mailboxTarget
+	for rows.Next() {
+		var t mailboxTarget
+		if err := rows.Scan(&t.id, &t.email); err != nil {
+			return nil, err
+		}
+		targets = append(targets, t)
+	}
+	return targets, rows.Err()
+}
+
+var reindexCmd = &cobra.Command{
+	Use:   "reindex [email]",
+	Short: "Fill in missing message metadata from the stored messages",
+	Long: `Fill in missing message metadata from the stored messages.
+
+Messages stored without a Message-ID, subject, sender or recipients in the
+database, such as those appended by old versions, don't show them in the
+admin panel or match searches on them. This parses the headers of each such
+message again and saves them. Messages whose file is missing are reported
+and skipped. Without an email every user is reindexed.
+
+Examples:
+  mailserver reindex
+  mailserver reindex user@example.com`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := cfg.EnsureDirectories(); err != nil {
+			return err
+		}
+
+		var err error
+		db, err = metadata.Open(cfg.Storage.DatabasePath)
+		if err != nil {
+			return fmt.Errorf("failed to open database: %w", err)
+		}
+		defer db.Close()
+
+		ctx := context.Background()
+		targets, err := mailboxOwners(ctx, args)
+		if err != nil {
+			return err
+		}
+
+		store, err := newMessageStore(cfg, db)
+		if err != nil {
+			return fmt.Errorf("failed to initialize maildir store: %w", err)
+		}
+
+		var checked, updated, missing int
+		for _, t := range targets {
+			report, err := store.ReindexMetadata(ctx, t.id)
+			if err != nil {
+				return fmt.Errorf("%s: %w", t.email, err)
+			}
+			for _, m := range report.Missing {
+				fmt.Printf("%s: message not found: %s\n", t.email, m)
+			}
+			checked += report.Checked
+			updated += report.Updated
+			missing += len(report.Missing)
+		}
+
+		fmt.Printf("Reindexed %d users: %d messages without metadata, %d filled in, %d not found\n",
+			len(targets), checked, updated, missing)
+		return nil
+	},
+}
+
+// Maintenance commands
+var maintenanceCmd = &cobra.Command{
+	Use:   "maintenance",
+	Short: "Reclaim space in the database and maildirs",
+}
+
+var maintenanceVacuumCmd = &cobra.Command{
+	Use:   "vacuum",
+	Short: "Vacuum the database and prune stale maildir tmp files",
+	Long: `Vacuum the database and prune stale maildir tmp files.
+
+Files older than a day in a maildir's tmp directory are left over from
+appends that never finished and are removed, as are sent email records
+kept for bounce matching once they are 30 days old. The database is then
+analyzed and rebuilt with VACUUM, which returns the space of deleted rows
+to the filesystem.
+
+VACUUM blocks writes to the database while it runs, so run this when the
+server is quiet, or set storage.maintenance_interval to have the server
+run it on a schedule.
+
+Examples:
+  mailserver maintenance vacuum`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := cfg.EnsureDirectories(); err != nil {
+			return err
+		}
+
+		var err error
+		db, err = metadata.Open(cfg.Storage.DatabasePath)
+		if err != nil {
+			return fmt.Errorf("failed to open database: %w", err)
+		}
+		defer db.Close()
+
+		store, err := newMessageStore(cfg, db)
+		if err != nil {
+			return fmt.Errorf("failed to initialize maildir store: %w", err)
+		}
+		defer store.Close()
+
+		report, err := maintenance.Run(context.Background(), db, store)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Removed %d stale tmp files (%d bytes)\n", report.TmpFiles, report.TmpReclaimed)
+		fmt.Printf("Removed %d sent email records older than %d days\n", report.SentEmailsPruned, int(maintenance.SentEmailRetention.Hours()/24))
+		fmt.Printf("Removed %d delivery attempts older than %d days\n", report.AttemptsPruned, int(maintenance.DeliveryAttemptRetention.Hours()/24))
+		fmt.Printf("Removed %d login attempts older than %d days\n", report.AuthLogPruned, int(maintenance.AuthLogRetention.Hours()/24))
+		fmt.Printf("Vacuumed the database, reclaiming %d bytes\n", report.DatabaseReclaimed)
+		fmt.Printf("Done in %s\n", report.Duration.Round(time.Millisecond))
+		return nil
+	},
+}
+
+// Access rule commands
+var aclCmd = &cobra.Command{
+	Use:   "acl",
+	Short: "Allow or deny inbound senders and client networks",
+	Long: `Allow or deny inbound mail by sender or client IP.
+
+A pattern is an email address, a domain, *.domain for its subdomains, or an
+IP address or CIDR. Allowed senders and networks skip greylisting, DNS
+blocklists and the HELO and reputation checks; denied ones are rejected.`,
+}
+
+var aclComment string
+
+// aclSetCmd returns the command that adds rules with action
+func aclSetCmd(action, short string) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   action + " <addr-or-cidr>",
+		Short: short,
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			rules, err := openAccessRules()
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+
+			pattern, err := rules.Set(context.Background(), args[0], action, aclComment)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s: %s\n", action, pattern)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&aclComment, "comment", "", "Note why the rule was added")
+	return cmd
+}
+
+var aclRemoveCmd = &cobra.Command{
+	Use:   "remove <addr-or-cidr>",
+	Short: "Remove the rule for a sender or network",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		rules, err := openAccessRules()
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		removed, err := rules.Remove(context.Background(), args[0])
+		if err != nil {
+			return err
+		}
+		if !removed {
+			return fmt.Errorf("no rule for %s", args[0])
+		}
+		fmt.Printf("Removed the rule for %s\n", args[0])
+		return nil
+	},
+}
+
+var aclListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the allowed and denied senders and networks",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		rules, err := openAccessRules()
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		list, err := rules.List(context.Background())
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%-6s %-40s %-20s %s\n", "ACTION", "PATTERN", "CREATED", "COMMENT")
+		fmt.Println("-------------------------------------------------------------------")
+		for _, r := range list {
+			fmt.Printf("%-6s %-40s %-20s %s\n", r.Action, r.Pattern, r.CreatedAt.Format("2006-01-02 15:04:05"), r.Comment)
+		}
+		return nil
+	},
+}
+
+// openAccessRules opens the database into db and returns its access rules
+func openAccessRules() (*smtpserver.AccessRules, error) {
+	if err := cfg.EnsureDirectories(); err != nil {
+		return nil, err
+	}
+
+	var err error
+	db, err = metadata.Open(cfg.Storage.DatabasePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	if err := db.Migrate(context.Background()); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to run migrations: %w", err)
+	}
+	return smtpserver.NewAccessRules(db.DB), nil
+}
+
+// DNS management commands
+var dnsCmd = &cobra.Command{
+	Use:   "dns",
+	Short: "DNS record checking and generation",
+}
+
+var dnsCheckCmd = &cobra.Command{
+	Use:   "check <domain>",
+	Short: "Check DNS configuration for a domain",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		domain := args[0]
+		mailServer := cfg.Server.Hostname
+
+		checker, err := dns.NewChecker(domain, mailServer)
+		if err != nil {
+			return fmt.Errorf("failed to create DNS checker: %w", err)
+		}
+		results := checker.CheckAll(context.Background())
+
+		fmt.Printf("DNS Check for %s (mail server: %s)\n", domain, mailServer)
+		fmt.Println("=" + "========================================")
+
+		for _, r := range results {
+			var icon string
+			switch r.Status {
+			case dns.StatusPass:
+				icon = "✓"
+			case dns.StatusFail:
+				icon = "✗"
+			case dns.StatusWarning:
+				icon = "!"
+			case dns.StatusMissing:
+				icon = "?"
+			}
+
+			fmt.Printf("[%s] %-8s %s\n", icon, r.RecordType, r.Status)
+			if r.Actual != "" {
+				fmt.Printf("    Found:    %s\n", r.Actual)
+			}
+			if r.Expected != "" && r.Status != dns.StatusPass {
+				fmt.Printf("    Expected: %s\n", r.Expected)
+			}
+			fmt.Printf("    %s\n\n", r.Message)
+		}
+
+		return nil
+	},
+}
+
+var dnsGenerateCmd = &cobra.Command{
+	Use:   "generate <domain> [server-ip]",
+	Short: "Generate required DNS records for a domain",
+	Args:  cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		domain := args[0]
+		mailServer := cfg.Server.Hostname
+		serverIP := ""
+		if len(args) > 1 {
+			serverIP = args[1]
+		}
+
+		generator, err := dns.NewGenerator(domain, mailServer, serverIP)
+		if err != nil {
+			return fmt.Errorf("failed to create DNS generator: %w", err)
+		}
+
+		// Publish every configured DKIM key, not just the active one, so
+		// a new selector is in DNS before it starts signing
+		if d := cfg.GetDomain(domain); d != nil {
+			for _, key := range d.AllDKIMKeys() {
+				signer, err := security.NewDKIMSigner(domain, key.Selector, key.KeyFile)
+				if err == nil {
+					err = generator.AddDKIMKey(key.Selector, signer.PublicKey())
+				}
+				if err != nil {
+					return fmt.Errorf("failed to load DKIM key %s: %w", key.KeyFile, err)
+				}
+				fmt.Printf("Using DKIM key from %s for selector %s\n", key.KeyFile, key.Selector)
+			}
+			if len(d.AllDKIMKeys()) > 0 {
+				fmt.Println()
+			}
+		}
+
+		records := generator.GenerateAll()
+
+		fmt.Println(dns.FormatForProvider(records, domain))
+
+		fmt.Println("\nZone file format:")
+		fmt.Println("-----------------")
+		fmt.Println(dns.FormatAsZone(records, domain))
+
+		return nil
+	},
+}
+
+var versionCmd = &cobra.Command{
+	Use:   "version",
+	Short: "Print version information",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Fprintln(cmd.OutOrStdout(), versionString())
+	},
+}
+
+var testDeliveryCmd = &cobra.Command{
+	Use:   "test-delivery <from> <to>",
+	Short: "Send a test message directly and trace each step",
+	Long: `Composes a test message and delivers it synchronously, bypassing the queue.
+Prints the MX hosts chosen, the TLS session negotiated, every SMTP command and
+reply, and the final result. Nothing is stored or queued. The configured
+timeouts, relay host and TLS policies apply as for queued delivery.`,
+	Args: cobra.ExactArgs(2),
 	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("mailserver v0.1.0")
+		if code := runTestDelivery(cfg, args[0], args[1], cmd.OutOrStdout()); code != 0 {
+			os.Exit(code)
+		}
 	},
 }
 
+// runTestDelivery traces one delivery from -> to and returns the exit code
+func runTestDelivery(cfg *config.Config, from, to string, w io.Writer) int {
+	logger, err := logging.New(logging.Config{Level: "warn", Format: "text", Output: "stderr"})
+	if err != nil {
+		fmt.Fprintf(w, "Failed to initialize logger: %v\n", err)
+		return 1
+	}
+
+	engine := delivery.NewEngine(deliveryConfig(cfg), nil, dkimSigners(cfg, logger), logger)
+
+	now := time.Now()
+	msg := "From: <" + from + ">\r\n" +
+		"To: <" + to + ">\r\n" +
+		"Subject: Test delivery from " + cfg.Server.Hostname + "\r\n" +
+		"Date: " + now.Format(time.RFC1123Z) + "\r\n" +
+		"Message-ID: <" + msgid.New(cfg.Server.Hostname) + ">\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" +
+		"This is a test message sent by mailserver test-delivery.\r\n"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	fmt.Fprintf(w, "Test delivery %s -> %s\n", from, to)
+	if err := engine.Trace(ctx, from, to, []byte(msg), w); err != nil {
+		fmt.Fprintf(w, "Result: FAILED: %v\n", err)
+		return 1
+	}
+	fmt.Fprintln(w, "Result: delivered")
+	return 0
+}
+
 // Setup commands
 var forceSetup bool
 
 var preflightCmd = &cobra.Command{
 	Use:   "preflight",
 	Short: "Check if server is ready for mail server setup",
-	Long:  `Runs preflight checks to verify the server meets all requirements before installation.`,
+	Long: `Runs preflight checks to verify the server meets all requirements before installation:
+root access, permission to bind ports below 1024, writable install directories,
+SQLite support, required ports, Redis and systemd. Each failure prints how to fix it,
+and the command exits non-zero if any hard requirement is missing.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		results := setup.RunPreflightWithOptions(forceSetup)
 		results.Print()
@@ -923,12 +1851,27 @@ var doctorCmd = &cobra.Command{
 }
 
 func init() {
-	rootCmd.PersistentFlags().StringVarP(&cfgFile, "config", "c", "config.yaml", "config file path")
+	defaultConfig := "config.yaml"
+	if path := os.Getenv("MAILSERVER_CONFIG"); path != "" {
+		defaultConfig = path
+	}
+	rootCmd.PersistentFlags().StringVarP(&cfgFile, "config", "c", defaultConfig, "config file path (default from MAILSERVER_CONFIG)")
+
+	// cobra handles --version before PersistentPreRunE, so it never loads config
+	rootCmd.Version = versionString()
+	rootCmd.SetVersionTemplate("{{.Version}}\n")
 
 	rootCmd.AddCommand(serveCmd)
 	rootCmd.AddCommand(migrateCmd)
 	rootCmd.AddCommand(versionCmd)
 
+	// Config commands
+	configCmd.AddCommand(configValidateCmd)
+	configCmd.AddCommand(configPrintCmd)
+	configUpgradeCmd.Flags().BoolVar(&configUpgradeDryRun, "dry-run", false, "Print the upgraded file instead of writing it")
+	configCmd.AddCommand(configUpgradeCmd)
+	rootCmd.AddCommand(configCmd)
+
 	// Domain commands
 	domainCmd.AddCommand(domainAddCmd)
 	domainCmd.AddCommand(domainListCmd)
@@ -938,8 +1881,33 @@ func init() {
 	userCmd.AddCommand(userAddCmd)
 	userCmd.AddCommand(userListCmd)
 	userCmd.AddCommand(userPasswdCmd)
+	userAccessCmd.Flags().BoolVar(&userCanSend, "send", true, "Allow the user to send mail")
+	userAccessCmd.Flags().BoolVar(&userCanReceive, "receive", true, "Allow the user to receive mail")
+	userCmd.AddCommand(userAccessCmd)
+	userCmd.AddCommand(userCertCmd)
+	userAppPasswordCmd.AddCommand(userAppPasswordAddCmd)
+	userAppPasswordCmd.AddCommand(userAppPasswordListCmd)
+	userAppPasswordCmd.AddCommand(userAppPasswordRevokeCmd)
+	userCmd.AddCommand(userAppPasswordCmd)
 	rootCmd.AddCommand(userCmd)
 
+	// Maildir commands
+	maildirRepairCmd.Flags().BoolVar(&maildirRepairApply, "apply", false, "Fix the differences instead of only reporting them")
+	maildirCmd.AddCommand(maildirRepairCmd)
+	rootCmd.AddCommand(maildirCmd)
+	rootCmd.AddCommand(reindexCmd)
+
+	// Maintenance commands
+	maintenanceCmd.AddCommand(maintenanceVacuumCmd)
+	rootCmd.AddCommand(maintenanceCmd)
+
+	// Access rule commands
+	aclCmd.AddCommand(aclSetCmd(smtpserver.AccessAllow, "Allow a sender or network past the spam checks"))
+	aclCmd.AddCommand(aclSetCmd(smtpserver.AccessDeny, "Reject mail from a sender or network"))
+	aclCmd.AddCommand(aclRemoveCmd)
+	aclCmd.AddCommand(aclListCmd)
+	rootCmd.AddCommand(aclCmd)
+
 	// DNS commands
 	dnsCmd.AddCommand(dnsCheckCmd)
 	dnsCmd.AddCommand(dnsGenerateCmd)
@@ -951,6 +1919,7 @@ func init() {
 	rootCmd.AddCommand(preflightCmd)
 	rootCmd.AddCommand(setupCmd)
 	rootCmd.AddCommand(doctorCmd)
+	rootCmd.AddCommand(testDeliveryCmd)
 }
 
 func splitEmail(email string) []string {
@@ -962,7 +1931,235 @@ func splitEmail(email string) []string {
 	return nil
 }
 
-func generateUIDValidity() uint32 {
-	// Use current unix timestamp as UID validity
-	return uint32(os.Getpid()) ^ uint32(0x12345678)
+// mailListener is an IMAP or SMTP listener started by serve
+type mailListener struct {
+	name  string
+	port  int
+	start func() error // Binds the port and serves in the background
+}
+
+// startMailListeners starts every listener, logging the ones that fail to
+// bind instead of aborting, and returns the names of those that came up.
+// It only fails when none of them could start.
+func startMailListeners(logger *logging.Logger, listeners []mailListener) ([]string, error) {
+	var live []string
+	var errs []error
+	for _, l := range listeners {
+		if err := l.start(); err != nil {
+			logger.Error("Failed to start listener, continuing without it",
+				"listener", l.name,
+				"port", l.port,
+				"error", err.Error(),
+			)
+			errs = append(errs, fmt.Errorf("%s (port %d): %w", l.name, l.port, err))
+			continue
+		}
+		logger.Info("Listener started", "listener", l.name, "port", l.port)
+		live = append(live, fmt.Sprintf("%s:%d", l.name, l.port))
+	}
+	if len(live) == 0 && len(listeners) > 0 {
+		return nil, fmt.Errorf("no mail listeners could start: %w", errors.Join(errs...))
+	}
+	return live, nil
+}
+
+// openQueue opens the configured queue backend, validating the Redis
+// connection if used, and re-enqueues spooled messages the queue no longer
+// holds, such as everything in the in-memory queue before a restart.
+func openQueue(cfg *config.Config, logger *logging.Logger) (queue.Queue, error) {
+	retryMaxAge, _ := time.ParseDuration(cfg.Queue.RetryMaxAge)
+	if retryMaxAge == 0 {
+		retryMaxAge = 7 * 24 * time.Hour
+	}
+	queueCfg := queue.Config{
+		RedisURL:      cfg.Queue.RedisURL,
+		RedisPassword: cfg.Queue.RedisPassword,
+		Prefix:        cfg.Queue.Prefix,
+		MaxRetries:    cfg.Queue.MaxRetries,
+		RetryMaxAge:   retryMaxAge,
+		Retry:         retrySchedule(cfg),
+	}
+
+	var backend queue.Queue
+	if cfg.Queue.Backend == "memory" {
+		backend = queue.NewMemoryQueue(queueCfg)
+		logger.Info("Using in-memory queue")
+	} else {
+		redisQueue, err := queue.NewRedisQueue(queueCfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize Redis queue: %w", err)
+		}
+		backend = redisQueue
+		logger.Info("Redis queue connected", "url", cfg.Queue.RedisURL)
+	}
+
+	spooled, err := queue.NewSpooledQueue(backend, filepath.Join(cfg.Storage.DataDir, "queue", "envelopes"))
+	if err != nil {
+		backend.Close()
+		return nil, err
+	}
+	recovered, err := spooled.Recover(context.Background())
+	if err != nil {
+		backend.Close()
+		return nil, fmt.Errorf("failed to recover spooled messages: %w", err)
+	}
+	if recovered > 0 {
+		logger.Info("Re-enqueued spooled messages", "count", recovered)
+	}
+	return spooled, nil
+}
+
+// retrySchedule builds the queue retry schedule from cfg
+func retrySchedule(cfg *config.Config) queue.RetrySchedule {
+	initialDelay, _ := time.ParseDuration(cfg.Queue.RetryInitialDelay)
+	maxInterval, _ := time.ParseDuration(cfg.Queue.RetryMaxInterval)
+	quickRetry, _ := time.ParseDuration(cfg.Queue.QuickFirstRetry)
+	return queue.RetrySchedule{
+		InitialDelay: initialDelay,
+		Multiplier:   cfg.Queue.RetryMultiplier,
+		MaxInterval:  maxInterval,
+		QuickRetry:   quickRetry,
+	}
+}
+
+// deliveryConfig builds the outbound delivery settings from cfg
+func deliveryConfig(cfg *config.Config) delivery.Config {
+	connectTimeout, _ := time.ParseDuration(cfg.Delivery.ConnectTimeout)
+	if connectTimeout == 0 {
+		connectTimeout = 30 * time.Second
+	}
+	commandTimeout, _ := time.ParseDuration(cfg.Delivery.CommandTimeout)
+	if commandTimeout == 0 {
+		commandTimeout = 5 * time.Minute
+	}
+	return delivery.Config{
+		Workers:        cfg.Delivery.Workers,
+		Hostname:       cfg.Server.Hostname,
+		ConnectTimeout: connectTimeout,
+		CommandTimeout: commandTimeout,
+		MaxMessageSize: int64(cfg.Security.MaxMessageSize),
+		RequireTLS:     cfg.Delivery.RequireTLS,
+		VerifyTLS:      cfg.Delivery.VerifyTLS,
+		RelayHost:      cfg.Delivery.RelayHost,
+		HeloName:       cfg.Delivery.HeloName,
+		SourceIP:       net.ParseIP(cfg.Delivery.SourceIP),
+		// QueuePath for bounce messages - same as SMTP backend queue path
+		QueuePath:   filepath.Join(cfg.Storage.DataDir, "queue"),
+		Throttle:    deliveryThrottle(cfg),
+		TLSPolicies: deliveryTLSPolicies(cfg),
+		Hold: delivery.HoldRules{
+			MaxRecipients: cfg.Delivery.Hold.MaxRecipients,
+			Senders:       cfg.Delivery.Hold.Senders,
+		},
+		VERP: cfg.Delivery.VERP,
+	}
+}
+
+// dkimSigners loads the DKIM keys of every domain that has any and makes
+// each domain's configured selector the one that signs
+func dkimSigners(cfg *config.Config, logger *logging.Logger) *security.DKIMSignerPool {
+	pool := security.NewDKIMSignerPool()
+	for _, domain := range cfg.Domains {
+		for _, key := range domain.AllDKIMKeys() {
+			if err := pool.AddSigner(domain.Name, key.Selector, key.KeyFile); err != nil {
+				logger.Warn("Failed to load DKIM key for domain",
+					"domain", domain.Name,
+					"selector", key.Selector,
+					"error", err.Error())
+			} else {
+				logger.Info("Loaded DKIM key", "domain", domain.Name, "selector", key.Selector)
+			}
+		}
+		if pool.GetSigner(domain.Name) == nil {
+			continue
+		}
+		if err := pool.SetActive(domain.Name, domain.ActiveDKIMSelector()); err != nil {
+			logger.Warn("Active DKIM key not loaded, signing with another selector",
+				"domain", domain.Name,
+				"selector", pool.GetSigner(domain.Name).Selector(),
+				"error", err.Error())
+		}
+	}
+	return pool
+}
+
+// deliveryThrottle converts the configured per-domain outbound limits
+func deliveryThrottle(cfg *config.Config) delivery.ThrottleConfig {
+	backoff, _ := time.ParseDuration(cfg.Delivery.RateLimitBackoff)
+	tc := delivery.ThrottleConfig{
+		Default: delivery.DomainLimit{
+			MaxConcurrent: cfg.Delivery.MaxConcurrentPerDomain,
+			MaxPerMinute:  cfg.Delivery.MaxPerMinutePerDomain,
+		},
+		Domains:          make(map[string]delivery.DomainLimit, len(cfg.Delivery.DomainLimits)),
+		RateLimitBackoff: backoff,
+	}
+	for _, dl := range cfg.Delivery.DomainLimits {
+		tc.Domains[dl.Domain] = delivery.DomainLimit{
+			MaxConcurrent: dl.MaxConcurrent,
+			MaxPerMinute:  dl.MaxPerMinute,
+		}
+	}
+	return tc
+}
+
+// deliveryTLSPolicies converts the configured per-domain TLS policies.
+// Load has already validated the policy names.
+func deliveryTLSPolicies(cfg *config.Config) map[string]delivery.TLSPolicy {
+	policies := make(map[string]delivery.TLSPolicy, len(cfg.Delivery.TLSPolicies))
+	for _, tp := range cfg.Delivery.TLSPolicies {
+		policy, err := delivery.ParseTLSPolicy(tp.Policy)
+		if err != nil {
+			continue
+		}
+		policies[strings.ToLower(tp.Domain)] = policy
+	}
+	return policies
+}
+
+// roleRoutes converts the configured postmaster@ and abuse@ destinations.
+// abuse@ falls back to the postmaster destination at each level.
+func roleRoutes(cfg *config.Config) auth.RoleRoutes {
+	routes := auth.RoleRoutes{
+		Default: map[string]string{
+			auth.RolePostmaster: cfg.Server.Postmaster,
+			auth.RoleAbuse:      cmp.Or(cfg.Server.Abuse, cfg.Server.Postmaster),
+		},
+		Domains: make(map[string]map[string]string),
+	}
+	for _, d := range cfg.Domains {
+		if d.Postmaster == "" && d.Abuse == "" {
+			continue
+		}
+		routes.Domains[d.Name] = map[string]string{
+			auth.RolePostmaster: d.Postmaster,
+			auth.RoleAbuse:      cmp.Or(d.Abuse, d.Postmaster),
+		}
+	}
+	return routes
+}
+
+// newMessageStore opens the maildir store, keeping message bodies in the
+// configured bucket when storage.body_store is s3
+func newMessageStore(cfg *config.Config, db *metadata.DB) (*maildir.Store, error) {
+	store, err := maildir.NewStore(db.DB, cfg.Storage.MaildirPath)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Storage.BodyStore == "s3" {
+		bodies, err := objectstore.New(objectstore.Config{
+			Endpoint:        cfg.Storage.S3.Endpoint,
+			Region:          cfg.Storage.S3.Region,
+			Bucket:          cfg.Storage.S3.Bucket,
+			Prefix:          cfg.Storage.S3.Prefix,
+			AccessKeyID:     cfg.Storage.S3.AccessKeyID,
+			SecretAccessKey: cfg.Storage.S3.SecretAccessKey,
+			PathStyle:       cfg.Storage.S3.PathStyle,
+		})
+		if err != nil {
+			return nil, err
+		}
+		store.SetBodyStore(bodies)
+	}
+	return store, nil
 }
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fenilsonani/email-server/internal/config"
+	"github.com/fenilsonani/email-server/internal/logging"
+	"github.com/fenilsonani/email-server/internal/queue"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	return path
+}
+
+func TestRunConfigValidateListsEveryProblem(t *testing.T) {
+	dir := t.TempDir()
+	path := writeConfig(t, `
+server:
+  hostname: ""
+  smtp_port: 0
+storage:
+  data_dir: relative/data
+  database_path: `+filepath.Join(dir, "mail.db")+`
+  maildir_path: `+filepath.Join(dir, "maildir")+`
+domains:
+  - name: example.com
+security:
+  sign_outbound: false
+  max_message_size: 10
+logging:
+  level: loud
+`)
+
+	var out bytes.Buffer
+	if code := runConfigValidate(path, &out); code == 0 {
+		t.Fatalf("runConfigValidate() = 0, want non-zero\n%s", out.String())
+	}
+
+	for _, want := range []string{
+		"server.hostname is required",
+		"server.smtp_port must be between 1 and 65535",
+		"storage.data_dir must be an absolute path",
+		"security.max_message_size must be at least 1024 bytes",
+		"logging.level must be one of",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output missing %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestRunConfigValidateAcceptsValidConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := writeConfig(t, `
+server:
+  hostname: mail.example.com
+storage:
+  data_dir: `+dir+`
+  database_path: `+filepath.Join(dir, "mail.db")+`
+  maildir_path: `+filepath.Join(dir, "maildir")+`
+domains:
+  - name: example.com
+security:
+  sign_outbound: false
+tls:
+  auto_tls: false
+`)
+
+	var out bytes.Buffer
+	if code := runConfigValidate(path, &out); code != 0 {
+		t.Fatalf("runConfigValidate() = %d, want 0\n%s", code, out.String())
+	}
+}
+
+func TestRunConfigValidateMissingFile(t *testing.T) {
+	var out bytes.Buffer
+	if code := runConfigValidate(filepath.Join(t.TempDir(), "missing.yaml"), &out); code == 0 {
+		t.Errorf("runConfigValidate() = 0 for a missing file, want non-zero")
+	}
+}
+
+// listenOn returns a mailListener start function that binds addr
+func listenOn(t *testing.T, addr string) func() error {
+	return func() error {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		t.Cleanup(func() { ln.Close() })
+		return nil
+	}
+}
+
+func TestStartMailListenersIsolatesBindFailure(t *testing.T) {
+	// Hold a port so the SMTPS listener can't bind it
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer taken.Close()
+	port := taken.Addr().(*net.TCPAddr).Port
+
+	live, err := startMailListeners(logging.Default(), []mailListener{
+		{name: "IMAP", port: 0, start: listenOn(t, "127.0.0.1:0")},
+		{name: "SMTPS", port: port, start: listenOn(t, taken.Addr().String())},
+		{name: "SMTP MX", port: 0, start: listenOn(t, "127.0.0.1:0")},
+	})
+	if err != nil {
+		t.Fatalf("startMailListeners() error = %v, want the free ports to start", err)
+	}
+	if len(live) != 2 || !strings.HasPrefix(live[0], "IMAP:") || !strings.HasPrefix(live[1], "SMTP MX:") {
+		t.Errorf("live = %v, want IMAP and SMTP MX", live)
+	}
+
+	if _, err := startMailListeners(logging.Default(), []mailListener{
+		{name: "SMTPS", port: port, start: listenOn(t, taken.Addr().String())},
+	}); err == nil || !strings.Contains(err.Error(), "SMTPS") {
+		t.Errorf("startMailListeners() error = %v, want failure naming SMTPS when nothing starts", err)
+	}
+}
+
+func TestVersionCommandAndFlagPrintBuildInfo(t *testing.T) {
+	oldVersion, oldCommit := version, commit
+	oldRootVersion := rootCmd.Version
+	t.Cleanup(func() {
+		version, commit = oldVersion, oldCommit
+		rootCmd.Version = oldRootVersion
+		rootCmd.SetArgs(nil)
+		rootCmd.SetOut(nil)
+	})
+	version, commit = "v9.8.7-test", "abc1234"
+	rootCmd.Version = versionString()
+
+	run := func(args ...string) string {
+		var out bytes.Buffer
+		rootCmd.SetOut(&out)
+		// No config file exists here, so this fails if either path loads it
+		rootCmd.SetArgs(append([]string{"--config", filepath.Join(t.TempDir(), "missing.yaml")}, args...))
+		if err := rootCmd.Execute(); err != nil {
+			t.Fatalf("Execute(%v) error = %v", args, err)
+		}
+		return out.String()
+	}
+
+	cmdOut := run("version")
+	if !strings.Contains(cmdOut, "mailserver v9.8.7-test (commit abc1234") {
+		t.Errorf("version output = %q, want injected version and commit", cmdOut)
+	}
+	if flagOut := run("--version"); flagOut != cmdOut {
+		t.Errorf("--version output = %q, want %q", flagOut, cmdOut)
+	}
+}
+
+// mockSMTPPeer serves one SMTP session on a loopback listener, answering
+// RCPT TO with rcptReply, and returns its address
+func mockSMTPPeer(t *testing.T, rcptReply string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		write := func(s string) { conn.Write([]byte(s + "\r\n")) }
+		write("220 mx.example.org ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch verb := strings.ToUpper(strings.Fields(line)[0]); verb {
+			case "EHLO":
+				write("250-mx.example.org")
+				write("250 SIZE 1000000")
+			case "RCPT":
+				write(rcptReply)
+			case "DATA":
+				write("354 go ahead")
+				for {
+					l, err := r.ReadString('\n')
+					if err != nil || l == ".\r\n" {
+						break
+					}
+				}
+				write("250 2.0.0 Ok: queued as ABC123")
+			case "QUIT":
+				write("221 2.0.0 Bye")
+				return
+			default:
+				write("250 2.1.0 Ok")
+			}
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestRunTestDeliveryReportsAcceptance(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.Server.Hostname = "mail.example.com"
+	cfg.Delivery.RelayHost = mockSMTPPeer(t, "250 2.1.5 Ok")
+
+	var out bytes.Buffer
+	if code := runTestDelivery(cfg, "alice@example.com", "bob@example.org", &out); code != 0 {
+		t.Fatalf("runTestDelivery() = %d, want 0\n%s", code, out.String())
+	}
+	for _, want := range []string{
+		"C: EHLO mail.example.com",
+		"C: RCPT TO:<bob@example.org>",
+		"S: 250 2.0.0 Ok: queued as ABC123",
+		"Result: delivered",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output missing %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestRunTestDeliveryReportsRejection(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.Server.Hostname = "mail.example.com"
+	cfg.Delivery.RelayHost = mockSMTPPeer(t, "550 5.1.1 <bob@example.org>: Recipient address rejected")
+
+	var out bytes.Buffer
+	if code := runTestDelivery(cfg, "alice@example.com", "bob@example.org", &out); code == 0 {
+		t.Fatalf("runTestDelivery() = 0, want non-zero\n%s", out.String())
+	}
+	for _, want := range []string{
+		"S: 550 5.1.1 <bob@example.org>: Recipient address rejected",
+		"Result: FAILED",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output missing %q:\n%s", want, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "C: DATA") {
+		t.Errorf("output = %s, want no DATA after the rejection", out.String())
+	}
+}
+
+func TestOpenQueueRecoversSpooledMessages(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.Queue.Backend = "memory"
+	cfg.Storage.DataDir = t.TempDir()
+	ctx := context.Background()
+
+	q, err := openQueue(cfg, logging.Default())
+	if err != nil {
+		t.Fatalf("openQueue() error = %v", err)
+	}
+	path := filepath.Join(cfg.Storage.DataDir, "queue", "1-abc.eml")
+	if err := os.WriteFile(path, []byte("Subject: hi\r\n\r\nhello\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	msg := &queue.Message{Sender: "alice@example.com", Recipients: []string{"bob@example.org"}, MessagePath: path, Domain: "example.org"}
+	if err := q.Enqueue(ctx, msg); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+	q.Close()
+
+	// The in-memory queue starts empty; the spooled message comes back
+	q, err = openQueue(cfg, logging.Default())
+	if err != nil {
+		t.Fatalf("openQueue() after restart error = %v", err)
+	}
+	defer q.Close()
+	got, err := q.GetMessage(ctx, msg.ID)
+	if err != nil {
+		t.Fatalf("GetMessage() after restart error = %v", err)
+	}
+	if got.Status != queue.StatusPending || got.MessagePath != path {
+		t.Errorf("recovered message = %+v", got)
+	}
+}
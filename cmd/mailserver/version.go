@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// Build information, set at link time with
+//
+//	go build -ldflags "-X main.version=v1.2.3 -X main.commit=abc1234 -X main.buildDate=2024-01-01T00:00:00Z"
+//
+// Anything left empty is filled in from the module and VCS information the
+// Go toolchain embeds in the binary.
+var (
+	version   string
+	commit    string
+	buildDate string
+)
+
+// buildInfo returns the version, commit and build date of this binary
+func buildInfo() (v, c, d string) {
+	v, c, d = version, commit, buildDate
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if v == "" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+			v = info.Main.Version
+		}
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if c == "" {
+					c = s.Value
+					if len(c) > 12 {
+						c = c[:12]
+					}
+				}
+			case "vcs.time":
+				if d == "" {
+					d = s.Value
+				}
+			}
+		}
+	}
+	if v == "" {
+		v = "dev"
+	}
+	if c == "" {
+		c = "unknown"
+	}
+	if d == "" {
+		d = "unknown"
+	}
+	return v, c, d
+}
+
+// versionString is printed by both `mailserver version` and `mailserver --version`
+func versionString() string {
+	v, c, d := buildInfo()
+	return fmt.Sprintf("mailserver %s (commit %s, built %s)", v, c, d)
+}
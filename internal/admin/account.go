@@ -0,0 +1,265 @@
+package admin
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fenilsonani/email-server/internal/auth"
+	"github.com/fenilsonani/email-server/internal/sieve"
+	"github.com/fenilsonani/email-server/internal/validation"
+)
+
+// The account portal under /account/ lets any user manage their own
+// password, app passwords, Sieve filters and vacation reply. It has its own
+// session scope and cookie, and every handler acts on the logged-in user
+// passed in by withAccount, never on an ID taken from the request.
+
+// accountHandler handles a request for the logged-in portal user
+type accountHandler func(w http.ResponseWriter, r *http.Request, user *auth.User)
+
+// withAccount wraps a handler with the account portal's authentication check
+func (s *Server) withAccount(next accountHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie("account_session")
+		if err != nil {
+			http.Redirect(w, r, "/account/login", http.StatusSeeOther)
+			return
+		}
+
+		userID, valid := s.validateSession(cookie.Value, scopeAccount)
+		if !valid {
+			http.Redirect(w, r, "/account/login", http.StatusSeeOther)
+			return
+		}
+
+		user, err := s.authenticator.LookupUserByID(r.Context(), userID)
+		if err != nil || !user.IsActive {
+			http.Redirect(w, r, "/account/login", http.StatusSeeOther)
+			return
+		}
+
+		next(w, r, user)
+	}
+}
+
+// handleAccountLogin handles account portal login. Only the main password
+// is accepted, as for the admin panel.
+func (s *Server) handleAccountLogin(w http.ResponseWriter, r *http.Request) {
+	clientIP := getIP(r)
+	data := map[string]interface{}{
+		"Title":   "Login",
+		"Account": true,
+	}
+
+	if s.rateLimiter.IsBlocked(clientIP) {
+		remaining := time.Until(s.rateLimiter.BlockedUntil(clientIP)).Round(time.Minute)
+		data["Error"] = "Too many failed attempts. Please try again in " + remaining.String()
+		s.renderTemplate(w, "login.html", data)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		s.renderTemplate(w, "login.html", data)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	username := r.FormValue("username")
+
+	user, err := s.authenticator.Authenticate(r.Context(), username, r.FormValue("password"))
+	s.authenticator.RecordAuth("web", username, clientIP, user, err)
+	if err != nil {
+		s.rateLimiter.RecordFailure(clientIP)
+		s.logger.Warn("Failed account login attempt", "ip", clientIP, "username", username)
+		data["Error"] = "Invalid credentials"
+		s.renderTemplate(w, "login.html", data)
+		return
+	}
+	s.rateLimiter.RecordSuccess(clientIP)
+
+	token := s.createSession(user.ID, scopeAccount)
+	http.SetCookie(w, &http.Cookie{
+		Name:     "account_session",
+		Value:    token,
+		Path:     "/account",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+		MaxAge:   604800, // 7 days
+	})
+
+	s.logger.Info("Account login successful", "ip", clientIP, "username", user.Email)
+	http.Redirect(w, r, "/account/", http.StatusSeeOther)
+}
+
+// handleAccountLogout ends the account portal session
+func (s *Server) handleAccountLogout(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie("account_session"); err == nil {
+		sessionsMu.Lock()
+		delete(sessions, cookie.Value)
+		sessionsMu.Unlock()
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     "account_session",
+		Value:    "",
+		Path:     "/account",
+		HttpOnly: true,
+		MaxAge:   -1,
+	})
+	http.Redirect(w, r, "/account/login", http.StatusSeeOther)
+}
+
+// handleAccount shows the user's account page
+func (s *Server) handleAccount(w http.ResponseWriter, r *http.Request, user *auth.User) {
+	if r.URL.Path != "/account/" {
+		http.NotFound(w, r)
+		return
+	}
+	s.renderAccount(w, r, user, map[string]interface{}{})
+}
+
+// renderAccount renders the account page with data added to the defaults
+func (s *Server) renderAccount(w http.ResponseWriter, r *http.Request, user *auth.User, data map[string]interface{}) {
+	appPasswords, err := s.authenticator.ListAppPasswords(r.Context(), user.ID)
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "Failed to list app passwords", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	data["Title"] = "Account"
+	data["Account"] = true
+	data["Email"] = user.Email
+	data["AppPasswords"] = appPasswords
+	s.renderTemplate(w, "account.html", data)
+}
+
+// handleAccountPassword changes the user's own password
+func (s *Server) handleAccountPassword(w http.ResponseWriter, r *http.Request, user *auth.User) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := s.authenticator.Authenticate(r.Context(), user.Email, r.FormValue("current_password")); err != nil {
+		s.renderAccount(w, r, user, map[string]interface{}{"Error": "Current password is incorrect"})
+		return
+	}
+	password := r.FormValue("new_password")
+	if err := validation.Password(password); err != nil {
+		s.renderAccount(w, r, user, map[string]interface{}{"Error": err.Error()})
+		return
+	}
+	if err := s.authenticator.UpdatePassword(r.Context(), user.ID, password); err != nil {
+		http.Error(w, "Failed to update password", http.StatusInternalServerError)
+		return
+	}
+
+	s.logger.Info("Account password changed", "username", user.Email, "ip", getIP(r))
+	s.renderAccount(w, r, user, map[string]interface{}{"Success": "Password changed"})
+}
+
+// handleAccountAppPasswordAdd generates an app password for the user
+func (s *Server) handleAccountAppPasswordAdd(w http.ResponseWriter, r *http.Request, user *auth.User) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	name := validation.Truncate(r.FormValue("name"), validation.MaxExternalStringLength)
+	password, _, err := s.authenticator.CreateAppPassword(r.Context(), user.ID, name)
+	if err != nil {
+		s.renderAccount(w, r, user, map[string]interface{}{"Error": err.Error()})
+		return
+	}
+	s.renderAccount(w, r, user, map[string]interface{}{"NewAppPassword": password})
+}
+
+// handleAccountAppPasswordRevoke revokes one of the user's app passwords
+func (s *Server) handleAccountAppPasswordRevoke(w http.ResponseWriter, r *http.Request, user *auth.User) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Extract ID from path: /account/app-passwords/revoke/{id}
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/account/app-passwords/revoke/"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid app password ID format", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.authenticator.RevokeAppPassword(r.Context(), user.ID, id); err != nil {
+		if errors.Is(err, auth.ErrAppPasswordNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		http.Error(w, "Failed to revoke app password", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/account/", http.StatusSeeOther)
+}
+
+// handleAccountSieve lets the user manage their own Sieve scripts
+func (s *Server) handleAccountSieve(w http.ResponseWriter, r *http.Request, user *auth.User) {
+	s.serveSieve(w, r, user.ID, true)
+}
+
+// handleAccountVacation shows and sets the user's vacation auto-reply
+func (s *Server) handleAccountVacation(w http.ResponseWriter, r *http.Request, user *auth.User) {
+	if s.sieveStore == nil {
+		http.Error(w, "Sieve not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Title":   "Vacation",
+		"Account": true,
+	}
+
+	if r.Method == http.MethodPost {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		days, err := strconv.Atoi(r.FormValue("days"))
+		if err != nil {
+			days = 0
+		}
+		settings := sieve.VacationSettings{
+			Enabled: r.FormValue("enabled") == "on",
+			Subject: r.FormValue("subject"),
+			Body:    r.FormValue("body"),
+			Days:    days,
+		}
+		if err := s.sieveStore.SetVacation(r.Context(), user.ID, settings); err != nil {
+			data["Error"] = err.Error()
+			data["Vacation"] = settings
+			s.renderTemplate(w, "account_vacation.html", data)
+			return
+		}
+		data["Success"] = "Vacation reply saved"
+	}
+
+	settings, err := s.sieveStore.GetVacation(r.Context(), user.ID)
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "Failed to get vacation settings", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	data["Vacation"] = settings
+	s.renderTemplate(w, "account_vacation.html", data)
+}
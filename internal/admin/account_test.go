@@ -0,0 +1,191 @@
+package admin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/fenilsonani/email-server/internal/auth"
+	"github.com/fenilsonani/email-server/internal/sieve"
+)
+
+// setupAccountServer creates an admin server with users alice and bob,
+// neither of them an admin
+func setupAccountServer(t *testing.T) (*Server, *auth.User, *auth.User) {
+	t.Helper()
+	s, db := setupTestServer(t)
+	s.authenticator = auth.NewAuthenticator(db.DB)
+	s.sieveStore = sieve.NewStore(db.DB)
+	ctx := context.Background()
+
+	if _, err := db.Exec("INSERT INTO domains (name) VALUES ('example.com')"); err != nil {
+		t.Fatalf("Failed to insert domain: %v", err)
+	}
+	alice, err := s.authenticator.CreateUser(ctx, "alice", "password123", 1)
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	bob, err := s.authenticator.CreateUser(ctx, "bob", "password456", 1)
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	return s, alice, bob
+}
+
+// accountLogin logs in to the account portal and returns the response
+func accountLogin(s *Server, email, password string) *httptest.ResponseRecorder {
+	form := url.Values{"username": {email}, "password": {password}}
+	req := httptest.NewRequest(http.MethodPost, "/account/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	s.handleAccountLogin(rec, req)
+	return rec
+}
+
+// accountRequest sends a request through withAccount with the session cookie
+func accountRequest(s *Server, handler accountHandler, method, path, token string, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{Name: "account_session", Value: token})
+	rec := httptest.NewRecorder()
+	s.withAccount(handler)(rec, req)
+	return rec
+}
+
+func TestAccountPortalIsScopedToOwnUser(t *testing.T) {
+	s, alice, bob := setupAccountServer(t)
+	ctx := context.Background()
+
+	_, bobPassword, err := s.authenticator.CreateAppPassword(ctx, bob.ID, "Bob's phone")
+	if err != nil {
+		t.Fatalf("CreateAppPassword() error = %v", err)
+	}
+
+	rec := accountLogin(s, "alice@example.com", "password123")
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("account login status = %d, want 303", rec.Code)
+	}
+	var token string
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == "account_session" {
+			token = c.Value
+		}
+	}
+	if token == "" {
+		t.Fatal("account login set no account_session cookie")
+	}
+
+	t.Run("account page shows only own data", func(t *testing.T) {
+		rec := accountRequest(s, s.handleAccount, http.MethodGet, "/account/", token, nil)
+		body := rec.Body.String()
+		if rec.Code != http.StatusOK || !strings.Contains(body, "alice@example.com") {
+			t.Fatalf("account page status = %d, want alice's page", rec.Code)
+		}
+		if strings.Contains(body, "Bob&#39;s phone") || strings.Contains(body, "bob@example.com") {
+			t.Error("account page shows bob's data")
+		}
+	})
+
+	t.Run("cannot revoke another user's app password", func(t *testing.T) {
+		path := "/account/app-passwords/revoke/" + strconv.FormatInt(bobPassword.ID, 10)
+		rec := accountRequest(s, s.handleAccountAppPasswordRevoke, http.MethodPost, path, token, nil)
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("revoking bob's app password: status = %d, want 404", rec.Code)
+		}
+		if passwords, _ := s.authenticator.ListAppPasswords(ctx, bob.ID); len(passwords) != 1 {
+			t.Errorf("bob has %d app passwords, want 1", len(passwords))
+		}
+	})
+
+	t.Run("sieve scripts are saved for the logged-in user", func(t *testing.T) {
+		form := url.Values{"action": {"create"}, "name": {"filters"}, "content": {`if true { keep; }`}}
+		rec := accountRequest(s, s.handleAccountSieve, http.MethodPost, "/account/sieve", token, form)
+		if rec.Code != http.StatusSeeOther {
+			t.Fatalf("create script status = %d: %s", rec.Code, rec.Body.String())
+		}
+		if scripts, _ := s.sieveStore.ListScripts(ctx, alice.ID); len(scripts) != 1 {
+			t.Errorf("alice has %d scripts, want 1", len(scripts))
+		}
+		if scripts, _ := s.sieveStore.ListScripts(ctx, bob.ID); len(scripts) != 0 {
+			t.Errorf("bob has %d scripts, want none", len(scripts))
+		}
+	})
+
+	t.Run("vacation reply", func(t *testing.T) {
+		form := url.Values{"enabled": {"on"}, "body": {"Away"}, "days": {"5"}}
+		rec := accountRequest(s, s.handleAccountVacation, http.MethodPost, "/account/vacation", token, form)
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "Vacation reply saved") {
+			t.Fatalf("vacation status = %d: %s", rec.Code, rec.Body.String())
+		}
+		if v, _ := s.sieveStore.GetVacation(ctx, alice.ID); !v.Enabled || v.Days != 5 {
+			t.Errorf("alice's vacation = %+v", v)
+		}
+		if v, _ := s.sieveStore.GetVacation(ctx, bob.ID); v.Enabled {
+			t.Error("bob's vacation was enabled")
+		}
+	})
+
+	t.Run("junk filter asks before replacing the active script", func(t *testing.T) {
+		form := url.Values{"action": {"install-junk"}, "level": {"5"}}
+		rec := accountRequest(s, s.handleAccountSieve, http.MethodPost, "/account/sieve", token, form)
+		if rec.Code != http.StatusConflict {
+			t.Fatalf("install over the vacation script: status = %d, want 409", rec.Code)
+		}
+
+		form.Set("replace", "on")
+		rec = accountRequest(s, s.handleAccountSieve, http.MethodPost, "/account/sieve", token, form)
+		if rec.Code != http.StatusSeeOther {
+			t.Fatalf("install with replace: status = %d: %s", rec.Code, rec.Body.String())
+		}
+		active, _ := s.sieveStore.GetActiveScript(ctx, alice.ID)
+		if active == nil || active.Name != sieve.JunkScriptName || !strings.Contains(active.Content, `fileinto "Junk"`) {
+			t.Errorf("alice's active script = %+v, want the junk filter", active)
+		}
+	})
+
+	t.Run("change own password", func(t *testing.T) {
+		form := url.Values{"current_password": {"password123"}, "new_password": {"newpassword789"}}
+		rec := accountRequest(s, s.handleAccountPassword, http.MethodPost, "/account/password", token, form)
+		if !strings.Contains(rec.Body.String(), "Password changed") {
+			t.Fatalf("password change status = %d: %s", rec.Code, rec.Body.String())
+		}
+		if _, err := s.authenticator.Authenticate(ctx, "alice@example.com", "newpassword789"); err != nil {
+			t.Errorf("Authenticate() with new password error = %v", err)
+		}
+		if _, err := s.authenticator.Authenticate(ctx, "bob@example.com", "password456"); err != nil {
+			t.Errorf("bob's password changed: %v", err)
+		}
+	})
+
+	t.Run("account session does not reach the admin panel", func(t *testing.T) {
+		for _, name := range []string{"admin_session", "account_session"} {
+			req := httptest.NewRequest(http.MethodGet, "/admin/users", nil)
+			req.AddCookie(&http.Cookie{Name: name, Value: token})
+			rec := httptest.NewRecorder()
+			s.withAuth(s.handleUsers)(rec, req)
+			if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/admin/login" {
+				t.Errorf("/admin/users with the account token as %s: status = %d, want redirect to login", name, rec.Code)
+			}
+		}
+	})
+}
+
+func TestAccountLoginRejectsAppPassword(t *testing.T) {
+	s, alice, _ := setupAccountServer(t)
+	password, _, err := s.authenticator.CreateAppPassword(context.Background(), alice.ID, "Phone")
+	if err != nil {
+		t.Fatalf("CreateAppPassword() error = %v", err)
+	}
+
+	if rec := accountLogin(s, "alice@example.com", password); rec.Code == http.StatusSeeOther {
+		t.Error("account login with an app password succeeded")
+	}
+	rec := accountRequest(s, s.handleAccount, http.MethodGet, "/account/", "not-a-session", nil)
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/account/login" {
+		t.Errorf("account page without a session: status = %d, want redirect to login", rec.Code)
+	}
+}
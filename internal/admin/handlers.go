@@ -2,16 +2,31 @@ package admin
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/fenilsonani/email-server/internal/audit"
+	"github.com/fenilsonani/email-server/internal/auth"
+	"github.com/fenilsonani/email-server/internal/diskmon"
+	"github.com/fenilsonani/email-server/internal/msgid"
+	"github.com/fenilsonani/email-server/internal/provision"
 	"github.com/fenilsonani/email-server/internal/queue"
+	"github.com/fenilsonani/email-server/internal/sieve"
+	smtpserver "github.com/fenilsonani/email-server/internal/smtp"
+	"github.com/fenilsonani/email-server/internal/smtp/delivery"
+	"github.com/fenilsonani/email-server/internal/storage"
+	"github.com/fenilsonani/email-server/internal/storage/metadata"
 	"github.com/fenilsonani/email-server/internal/validation"
 )
 
@@ -70,6 +85,7 @@ func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 	password := r.FormValue("password")
 
 	user, err := s.authenticator.Authenticate(r.Context(), username, password)
+	s.authenticator.RecordAuth("web", username, clientIP, user, err)
 	if err != nil {
 		// Record failed attempt
 		blocked := s.rateLimiter.RecordFailure(clientIP)
@@ -117,7 +133,7 @@ func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 	s.rateLimiter.RecordSuccess(clientIP)
 
 	// Create session
-	token := s.createSession(user.ID)
+	token := s.createSession(user.ID, scopeAdmin)
 	http.SetCookie(w, &http.Cookie{
 		Name:     "admin_session",
 		Value:    token,
@@ -257,21 +273,30 @@ func (s *Server) handleUserAdd(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := s.authenticator.CreateUser(r.Context(), username, password, domainID)
+	var domain string
+	err = s.db.QueryRowContext(r.Context(), "SELECT name FROM domains WHERE id = ?", domainID).Scan(&domain)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Domain not found", http.StatusBadRequest)
+		return
+	}
 	if err != nil {
-		s.logger.ErrorContext(r.Context(), "Failed to create user", err)
-		http.Error(w, "Failed to create user: "+err.Error(), http.StatusInternalServerError)
+		s.logger.ErrorContext(r.Context(), "Failed to query domain", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	// Initialize default mailboxes for the new user
-	if err := s.store.InitializeUserMailboxes(r.Context(), user.ID); err != nil {
-		s.logger.ErrorContext(r.Context(), "Failed to initialize mailboxes", err)
-		// User was created but mailboxes failed - log but don't fail the request
+	user, err := provision.CreateUser(r.Context(), s.config, s.authenticator, s.store, username+"@"+domain, password)
+	if errors.Is(err, auth.ErrUserExists) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if user == nil {
+		s.logger.ErrorContext(r.Context(), "Failed to create user", err)
+		http.Error(w, "Failed to create user: "+err.Error(), http.StatusInternalServerError)
+		return
 	}
-
 	if isAdmin {
-		s.db.ExecContext(r.Context(), "UPDATE users SET is_admin = TRUE WHERE id = ?", user.ID)
+		err = errors.Join(err, s.authenticator.SetAdmin(r.Context(), user.ID, true))
 	}
 
 	// Audit log
@@ -281,6 +306,13 @@ func (s *Server) handleUserAdd(w http.ResponseWriter, r *http.Request) {
 		"is_admin":  isAdmin,
 	}, getIP(r))
 
+	// The user exists, but isn't set up as asked
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "Failed to set up user", err)
+		http.Error(w, "User created, but: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
 }
 
@@ -299,24 +331,7 @@ func (s *Server) handleUserEdit(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if r.Method == http.MethodGet {
-		var username, domain string
-		var isAdmin bool
-		err := s.db.QueryRowContext(r.Context(),
-			`SELECT u.username, d.name, u.is_admin FROM users u
-			 JOIN domains d ON u.domain_id = d.id WHERE u.id = ?`, userID).
-			Scan(&username, &domain, &isAdmin)
-		if err != nil {
-			http.NotFound(w, r)
-			return
-		}
-
-		s.renderTemplate(w, "user_edit.html", map[string]interface{}{
-			"Title":    "Edit User",
-			"UserID":   userID,
-			"Username": username,
-			"Email":    username + "@" + domain,
-			"IsAdmin":  isAdmin,
-		})
+		s.renderUserEdit(w, r, userID, "")
 		return
 	}
 
@@ -328,10 +343,14 @@ func (s *Server) handleUserEdit(w http.ResponseWriter, r *http.Request) {
 
 	password := r.FormValue("password")
 	isAdmin := r.FormValue("is_admin") == "on"
+	canSend := r.FormValue("can_send") == "on"
+	canReceive := r.FormValue("can_receive") == "on"
 
-	// Update admin status
+	// Update admin status and permissions
 	var updateErr error
-	_, updateErr = s.db.ExecContext(r.Context(), "UPDATE users SET is_admin = ? WHERE id = ?", isAdmin, userID)
+	_, updateErr = s.db.ExecContext(r.Context(),
+		"UPDATE users SET is_admin = ?, can_send = ?, can_receive = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?",
+		isAdmin, canSend, canReceive, userID)
 	if updateErr != nil {
 		http.Error(w, "Failed to update user", http.StatusInternalServerError)
 		return
@@ -356,12 +375,182 @@ func (s *Server) handleUserEdit(w http.ResponseWriter, r *http.Request) {
 	// Audit log user update
 	adminUser := getSessionUser(r)
 	s.auditLogger.Log(r.Context(), adminUser, audit.EventUserUpdate, strconv.FormatInt(userID, 10), map[string]interface{}{
-		"is_admin": isAdmin,
+		"is_admin":    isAdmin,
+		"can_send":    canSend,
+		"can_receive": canReceive,
 	}, getIP(r))
 
 	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
 }
 
+// renderUserEdit shows the edit form for a user, with a newly generated
+// app password when there is one to show
+func (s *Server) renderUserEdit(w http.ResponseWriter, r *http.Request, userID int64, newAppPassword string) {
+	var username, domain string
+	var isAdmin, canSend, canReceive bool
+	err := s.db.QueryRowContext(r.Context(),
+		`SELECT u.username, d.name, u.is_admin, u.can_send, u.can_receive FROM users u
+		 JOIN domains d ON u.domain_id = d.id WHERE u.id = ?`, userID).
+		Scan(&username, &domain, &isAdmin, &canSend, &canReceive)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	appPasswords, err := s.authenticator.ListAppPasswords(r.Context(), userID)
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "Failed to list app passwords", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	s.renderTemplate(w, "user_edit.html", map[string]interface{}{
+		"Title":          "Edit User",
+		"UserID":         userID,
+		"Username":       username,
+		"Email":          username + "@" + domain,
+		"IsAdmin":        isAdmin,
+		"CanSend":        canSend,
+		"CanReceive":     canReceive,
+		"AppPasswords":   appPasswords,
+		"NewAppPassword": newAppPassword,
+		"Success":        reindexSummary(r.URL.Query()),
+	})
+}
+
+// handleUserReindex fills in the missing metadata of a user's messages
+// from the stored messages
+func (s *Server) handleUserReindex(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Extract user ID from path: /admin/users/reindex/{userID}
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) < 5 {
+		http.NotFound(w, r)
+		return
+	}
+	userID, err := strconv.ParseInt(parts[4], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid user ID format", http.StatusBadRequest)
+		return
+	}
+
+	report, err := s.store.ReindexMetadata(r.Context(), userID)
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "Reindex failed", err, "user_id", userID)
+		http.Error(w, "Failed to reindex messages", http.StatusInternalServerError)
+		return
+	}
+
+	s.auditLogger.Log(r.Context(), getSessionUser(r), audit.EventMessagesReindex, strconv.FormatInt(userID, 10), map[string]interface{}{
+		"checked": report.Checked,
+		"updated": report.Updated,
+		"missing": len(report.Missing),
+	}, getIP(r))
+
+	params := url.Values{
+		"reindexed": {strconv.Itoa(report.Updated)},
+		"missing":   {strconv.Itoa(len(report.Missing))},
+	}
+	http.Redirect(w, r, "/admin/users/edit/"+strconv.FormatInt(userID, 10)+"?"+params.Encode(), http.StatusSeeOther)
+}
+
+// reindexSummary describes the result of a reindex from the redirect query
+// parameters, or returns "" when there is none
+func reindexSummary(q url.Values) string {
+	if !q.Has("reindexed") {
+		return ""
+	}
+	reindexed, _ := strconv.Atoi(q.Get("reindexed"))
+	summary := fmt.Sprintf("Filled in the metadata of %d message(s)", reindexed)
+	if missing, _ := strconv.Atoi(q.Get("missing")); missing > 0 {
+		summary += fmt.Sprintf("; %d message file(s) could not be found", missing)
+	}
+	return summary
+}
+
+// handleAppPasswordAdd generates an app password for a user and shows it
+// once on the edit page
+func (s *Server) handleAppPasswordAdd(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Extract user ID from path: /admin/users/app-passwords/add/{userID}
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) < 6 {
+		http.NotFound(w, r)
+		return
+	}
+	userID, err := strconv.ParseInt(parts[5], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid user ID format", http.StatusBadRequest)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	name := validation.Truncate(r.FormValue("name"), validation.MaxExternalStringLength)
+	password, appPassword, err := s.authenticator.CreateAppPassword(r.Context(), userID, name)
+	if err != nil {
+		http.Error(w, "Failed to create app password: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.auditLogger.Log(r.Context(), getSessionUser(r), audit.EventAppPasswordCreate, strconv.FormatInt(userID, 10), map[string]interface{}{
+		"id":   appPassword.ID,
+		"name": appPassword.Name,
+	}, getIP(r))
+
+	s.renderUserEdit(w, r, userID, password)
+}
+
+// handleAppPasswordRevoke revokes one of a user's app passwords
+func (s *Server) handleAppPasswordRevoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Extract IDs from path: /admin/users/app-passwords/revoke/{userID}/{id}
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) < 7 {
+		http.NotFound(w, r)
+		return
+	}
+	userID, err := strconv.ParseInt(parts[5], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid user ID format", http.StatusBadRequest)
+		return
+	}
+	id, err := strconv.ParseInt(parts[6], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid app password ID format", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.authenticator.RevokeAppPassword(r.Context(), userID, id); err != nil {
+		if errors.Is(err, auth.ErrAppPasswordNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		http.Error(w, "Failed to revoke app password", http.StatusInternalServerError)
+		return
+	}
+
+	s.auditLogger.Log(r.Context(), getSessionUser(r), audit.EventAppPasswordRevoke, strconv.FormatInt(userID, 10), map[string]interface{}{
+		"id": id,
+	}, getIP(r))
+
+	http.Redirect(w, r, "/admin/users/edit/"+strconv.FormatInt(userID, 10), http.StatusSeeOther)
+}
+
 // handleUserDelete handles deleting a user
 func (s *Server) handleUserDelete(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -381,9 +570,9 @@ func (s *Server) handleUserDelete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var deleteErr error
-	_, deleteErr = s.db.ExecContext(r.Context(), "DELETE FROM users WHERE id = ?", userID)
-	if deleteErr != nil {
+	// The store removes the user's messages, maildir and stored bodies too
+	if err := s.store.DeleteUser(r.Context(), userID); err != nil {
+		s.logger.ErrorContext(r.Context(), "Failed to delete user", err)
 		http.Error(w, "Failed to delete user", http.StatusInternalServerError)
 		return
 	}
@@ -447,6 +636,12 @@ func (s *Server) handleSieve(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	s.serveSieve(w, r, userID, false)
+}
+
+// serveSieve lists and edits a user's Sieve scripts, for the admin panel or
+// for the user's own account page
+func (s *Server) serveSieve(w http.ResponseWriter, r *http.Request, userID int64, account bool) {
 	if s.sieveStore == nil {
 		http.Error(w, "Sieve not configured", http.StatusServiceUnavailable)
 		return
@@ -454,11 +649,21 @@ func (s *Server) handleSieve(w http.ResponseWriter, r *http.Request) {
 
 	if r.Method == http.MethodGet {
 		scripts, _ := s.sieveStore.ListScripts(r.Context(), userID)
+		activeScript := ""
+		for _, script := range scripts {
+			if script.IsActive {
+				activeScript = script.Name
+			}
+		}
 
 		s.renderTemplate(w, "sieve.html", map[string]interface{}{
-			"Title":   "Sieve Scripts",
-			"UserID":  userID,
-			"Scripts": scripts,
+			"Title":          "Sieve Scripts",
+			"Account":        account,
+			"UserID":         userID,
+			"Scripts":        scripts,
+			"ActiveScript":   activeScript,
+			"JunkScriptName": sieve.JunkScriptName,
+			"JunkMailbox":    s.junkMailbox(r.Context(), userID),
 		})
 		return
 	}
@@ -498,11 +703,36 @@ func (s *Server) handleSieve(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Failed to activate script", http.StatusInternalServerError)
 			return
 		}
+	case "install-junk":
+		level, _ := strconv.Atoi(r.FormValue("level"))
+		err := s.sieveStore.InstallJunkScript(r.Context(), userID, s.junkMailbox(r.Context(), userID), level, r.FormValue("replace") == "on")
+		if errors.Is(err, sieve.ErrActiveScriptExists) {
+			http.Error(w, "Failed to install junk filter: "+err.Error()+"; tick the box to replace it", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to install junk filter: "+err.Error(), http.StatusBadRequest)
+			return
+		}
 	}
 
 	http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
 }
 
+// junkMailbox returns the name of the user's \Junk mailbox, which may be
+// localized, or Junk when they have none
+func (s *Server) junkMailbox(ctx context.Context, userID int64) string {
+	if s.store != nil {
+		mailboxes, _ := s.store.ListMailboxes(ctx, userID)
+		for _, mb := range mailboxes {
+			if mb.SpecialUse == storage.SpecialUseJunk {
+				return mb.Name
+			}
+		}
+	}
+	return "Junk"
+}
+
 // handleAuthLogs shows authentication logs
 func (s *Server) handleAuthLogs(w http.ResponseWriter, r *http.Request) {
 	rows, err := s.db.QueryContext(r.Context(), `
@@ -616,10 +846,7 @@ func (s *Server) handleDomainAdd(w http.ResponseWriter, r *http.Request) {
 	var exists int
 	err := s.db.QueryRowContext(r.Context(), "SELECT COUNT(*) FROM domains WHERE name = ?", name).Scan(&exists)
 	if err == nil && exists > 0 {
-		s.renderTemplate(w, "domain_form.html", map[string]interface{}{
-			"Title": "Add Domain",
-			"Error": "Domain already exists",
-		})
+		s.renderDomainExists(w, name)
 		return
 	}
 
@@ -628,6 +855,11 @@ func (s *Server) handleDomainAdd(w http.ResponseWriter, r *http.Request) {
 		"INSERT INTO domains (name, dkim_selector) VALUES (?, ?)",
 		name, "mail",
 	)
+	if metadata.IsUniqueViolation(err) {
+		// Lost a race with a concurrent insert of the same name
+		s.renderDomainExists(w, name)
+		return
+	}
 	if err != nil {
 		s.logger.ErrorContext(r.Context(), "Failed to create domain", err)
 		s.renderTemplate(w, "domain_form.html", map[string]interface{}{
@@ -644,6 +876,15 @@ func (s *Server) handleDomainAdd(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/admin/domains", http.StatusSeeOther)
 }
 
+// renderDomainExists re-renders the domain form with a 409 for a duplicate name
+func (s *Server) renderDomainExists(w http.ResponseWriter, name string) {
+	w.WriteHeader(http.StatusConflict)
+	s.renderTemplate(w, "domain_form.html", map[string]interface{}{
+		"Title": "Add Domain",
+		"Error": fmt.Sprintf("%s: %s", auth.ErrDomainExists, name),
+	})
+}
+
 // handleDomainDelete handles deleting a domain
 func (s *Server) handleDomainDelete(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -703,6 +944,7 @@ type QueueMessage struct {
 	Attempts    int
 	MaxAttempts int
 	LastError   string
+	HoldReason  string
 	NextAttempt time.Time
 	CreatedAt   time.Time
 }
@@ -731,6 +973,18 @@ func (s *Server) handleQueue(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if search := newQueueSearch(r.URL.Query()); search != nil {
+		s.renderQueueSearch(w, r, ctx, stats, search)
+		return
+	}
+
+	// Get messages held for review
+	heldMsgs, err := s.queue.ListHeld(ctx, 50)
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "Failed to get held messages", err)
+	}
+	heldMessages := convertQueueMessages(heldMsgs)
+
 	// Get pending messages
 	pendingMsgs, err := s.queue.ListPending(ctx, 50)
 	if err != nil {
@@ -755,12 +1009,115 @@ func (s *Server) handleQueue(w http.ResponseWriter, r *http.Request) {
 	s.renderTemplate(w, "queue.html", map[string]interface{}{
 		"Title":           "Email Queue",
 		"Stats":           stats,
+		"HeldMessages":    heldMessages,
 		"PendingMessages": pendingMessages,
 		"FailedMessages":  failedMessages,
 		"SentMessages":    sentMessages,
+		"Success":         bulkRetrySummary(r.URL.Query()),
 	})
 }
 
+// queueSearchPageSize is the number of search results per page
+const queueSearchPageSize = 50
+
+// queueSearch holds the filter and page of a queue search
+type queueSearch struct {
+	Filter queue.SearchFilter
+	Status string // pending, held, failed or sent
+	Page   int
+}
+
+// newQueueSearch parses search parameters, returning nil when no filter is set
+func newQueueSearch(q url.Values) *queueSearch {
+	search := &queueSearch{
+		Filter: queue.SearchFilter{
+			Sender:    strings.TrimSpace(q.Get("sender")),
+			Recipient: strings.TrimSpace(q.Get("recipient")),
+			MessageID: strings.TrimSpace(q.Get("id")),
+		},
+		Status: q.Get("status"),
+		Page:   1,
+	}
+	if search.Filter.IsEmpty() {
+		return nil
+	}
+	switch search.Status {
+	case "pending", "held", "failed", "sent":
+	default:
+		search.Status = "pending"
+	}
+	if page, err := strconv.Atoi(q.Get("page")); err == nil && page > 1 {
+		search.Page = page
+	}
+	return search
+}
+
+// pageURL links to another page of the same search
+func (q *queueSearch) pageURL(page int) string {
+	params := url.Values{"status": {q.Status}, "page": {strconv.Itoa(page)}}
+	if q.Filter.Sender != "" {
+		params.Set("sender", q.Filter.Sender)
+	}
+	if q.Filter.Recipient != "" {
+		params.Set("recipient", q.Filter.Recipient)
+	}
+	if q.Filter.MessageID != "" {
+		params.Set("id", q.Filter.MessageID)
+	}
+	return "/admin/queue?" + params.Encode()
+}
+
+// renderQueueSearch shows one page of messages matching a search
+func (s *Server) renderQueueSearch(w http.ResponseWriter, r *http.Request, ctx context.Context, stats *queue.QueueStats, search *queueSearch) {
+	data := map[string]interface{}{
+		"Title":  "Email Queue",
+		"Stats":  stats,
+		"Search": search,
+	}
+
+	msgs, more, err := s.queue.Search(ctx, queue.Status(search.Status), search.Filter,
+		(search.Page-1)*queueSearchPageSize, queueSearchPageSize)
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "Failed to search queue", err)
+		data["SearchError"] = "Search failed: " + err.Error()
+	}
+
+	results := convertQueueMessages(msgs)
+	switch search.Status {
+	case "held":
+		data["HeldMessages"] = results
+	case "failed":
+		data["FailedMessages"] = results
+	case "sent":
+		data["SentMessages"] = results
+	default:
+		data["PendingMessages"] = results
+	}
+	if search.Page > 1 {
+		data["PrevPage"] = search.pageURL(search.Page - 1)
+	}
+	if more {
+		data["NextPage"] = search.pageURL(search.Page + 1)
+	}
+
+	s.renderTemplate(w, "queue.html", data)
+}
+
+// bulkRetrySummary describes the result of a bulk retry from the redirect
+// query parameters, or returns "" when there is none
+func bulkRetrySummary(q url.Values) string {
+	set := q.Get("retried_set")
+	if set != "deferred" && set != "failed" {
+		return ""
+	}
+	retried, _ := strconv.Atoi(q.Get("retried"))
+	summary := fmt.Sprintf("Rescheduled %d %s message(s) for immediate delivery", retried, set)
+	if skipped, _ := strconv.Atoi(q.Get("skipped")); skipped > 0 {
+		summary += fmt.Sprintf("; %d could not be rescheduled", skipped)
+	}
+	return summary
+}
+
 // convertQueueMessages converts queue.Message to QueueMessage for display
 func convertQueueMessages(msgs []*queue.Message) []QueueMessage {
 	if msgs == nil {
@@ -779,6 +1136,7 @@ func convertQueueMessages(msgs []*queue.Message) []QueueMessage {
 			Attempts:    msg.Attempts,
 			MaxAttempts: msg.MaxAttempts,
 			LastError:   msg.LastError,
+			HoldReason:  msg.HoldReason,
 			NextAttempt: msg.NextAttempt,
 			CreatedAt:   msg.CreatedAt,
 		})
@@ -829,6 +1187,88 @@ func (s *Server) handleQueueRetry(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/admin/queue", http.StatusSeeOther)
 }
 
+// bulkRetryBatchSize is how many message IDs a bulk retry fetches at once
+const bulkRetryBatchSize = 100
+
+// handleQueueRetryAll reschedules every deferred or failed message for
+// immediate delivery, e.g. after recovering from an outage
+func (s *Server) handleQueueRetryAll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if s.queue == nil {
+		http.Error(w, "Queue not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	set := r.FormValue("set")
+	if set != "deferred" && set != "failed" {
+		http.Error(w, "set must be deferred or failed", http.StatusBadRequest)
+		return
+	}
+
+	// A double-clicked submit must not start a second pass over the queue
+	if !s.bulkRetryMu.TryLock() {
+		http.Error(w, "A bulk retry is already running", http.StatusConflict)
+		return
+	}
+	defer s.bulkRetryMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Minute)
+	defer cancel()
+
+	retried, skipped, err := s.retryAll(ctx, set)
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "Bulk retry failed", err, "set", set, "retried", retried)
+		http.Error(w, fmt.Sprintf("Bulk retry stopped after %d message(s): %v", retried, err), http.StatusInternalServerError)
+		return
+	}
+
+	s.auditLogger.Log(r.Context(), getSessionUser(r), audit.EventQueueRetry, set, map[string]interface{}{
+		"bulk":    true,
+		"retried": retried,
+		"skipped": skipped,
+	}, getIP(r))
+
+	params := url.Values{
+		"retried_set": {set},
+		"retried":     {strconv.Itoa(retried)},
+		"skipped":     {strconv.Itoa(skipped)},
+	}
+	http.Redirect(w, r, "/admin/queue?"+params.Encode(), http.StatusSeeOther)
+}
+
+// retryAll reschedules every message in set ("deferred" or "failed") to be
+// delivered now, in batches. Messages that can't be rescheduled are skipped
+// and counted.
+func (s *Server) retryAll(ctx context.Context, set string) (retried, skipped int, err error) {
+	// Rescheduled messages are due at now, so they drop out of the deferred
+	// range (due after now) and the failed set as each batch is processed
+	now := time.Now()
+	for {
+		var ids []string
+		if set == "deferred" {
+			ids, err = s.queue.DeferredIDs(ctx, now, int64(skipped), bulkRetryBatchSize)
+		} else {
+			ids, err = s.queue.FailedIDs(ctx, int64(skipped), bulkRetryBatchSize)
+		}
+		if err != nil || len(ids) == 0 {
+			return retried, skipped, err
+		}
+
+		for _, id := range ids {
+			if err := s.queue.Reschedule(ctx, id, now); err != nil {
+				s.logger.WarnContext(ctx, "Failed to reschedule message", "id", id, "error", err.Error())
+				skipped++
+				continue
+			}
+			retried++
+		}
+	}
+}
+
 // handleQueueDelete deletes a message from the queue
 func (s *Server) handleQueueDelete(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -861,12 +1301,263 @@ func (s *Server) handleQueueDelete(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/admin/queue", http.StatusSeeOther)
 }
 
+// heldMessage looks up the message named by a release or reject path and
+// checks that it is held, writing an error response if not
+func (s *Server) heldMessage(ctx context.Context, w http.ResponseWriter, r *http.Request) (*queue.Message, bool) {
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) < 5 || parts[4] == "" {
+		http.NotFound(w, r)
+		return nil, false
+	}
+
+	msg, err := s.queue.GetMessage(ctx, parts[4])
+	if err != nil {
+		http.Error(w, "Message not found: "+err.Error(), http.StatusNotFound)
+		return nil, false
+	}
+	if msg.Status != queue.StatusHeld {
+		http.Error(w, "Message is not held for review", http.StatusConflict)
+		return nil, false
+	}
+	return msg, true
+}
+
+// handleQueueRelease sends a held message on for delivery
+func (s *Server) handleQueueRelease(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if s.queue == nil {
+		http.Error(w, "Queue not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	msg, ok := s.heldMessage(ctx, w, r)
+	if !ok {
+		return
+	}
+	msgID := msg.ID
+	if err := s.queue.Release(ctx, msgID); err != nil {
+		http.Error(w, "Failed to release message: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.auditLogger.Log(r.Context(), getSessionUser(r), audit.EventQueueRelease, msgID, nil, getIP(r))
+
+	http.Redirect(w, r, "/admin/queue", http.StatusSeeOther)
+}
+
+// handleQueueReject fails a held message without delivering it
+func (s *Server) handleQueueReject(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if s.queue == nil {
+		http.Error(w, "Queue not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	msg, ok := s.heldMessage(ctx, w, r)
+	if !ok {
+		return
+	}
+	msgID := msg.ID
+
+	reason := "Rejected by admin"
+	if note := strings.TrimSpace(r.FormValue("reason")); note != "" {
+		reason += ": " + note
+	}
+	if err := s.queue.Fail(ctx, msgID, reason); err != nil {
+		http.Error(w, "Failed to reject message: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The message will never be sent, so its spooled copy can go. Only
+	// files in the queue directory are deleted, as the delivery engine does.
+	queueDir := filepath.Join(s.config.Storage.DataDir, "queue") + string(filepath.Separator)
+	if strings.HasPrefix(msg.MessagePath, queueDir) {
+		if err := os.Remove(msg.MessagePath); err != nil && !os.IsNotExist(err) {
+			s.logger.WarnContext(r.Context(), "Failed to remove rejected message file",
+				"path", msg.MessagePath, "error", err.Error())
+		}
+	}
+
+	s.auditLogger.Log(r.Context(), getSessionUser(r), audit.EventQueueReject, msgID, map[string]interface{}{
+		"reason": reason,
+	}, getIP(r))
+
+	http.Redirect(w, r, "/admin/queue", http.StatusSeeOther)
+}
+
+// handleReputation lists the client IPs with a reputation score
+func (s *Server) handleReputation(w http.ResponseWriter, r *http.Request) {
+	s.renderTemplate(w, "reputation.html", map[string]interface{}{
+		"Title":     "IP Reputation",
+		"Enabled":   s.reputation != nil,
+		"Threshold": s.config.Security.Reputation.Threshold,
+		"Entries":   s.reputation.Entries(),
+	})
+}
+
+// handleReputationClear forgets an IP's score, which unblocks it
+func (s *Server) handleReputationClear(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if s.reputation == nil {
+		http.Error(w, "IP reputation not enabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	ip := strings.TrimPrefix(r.URL.Path, "/admin/reputation/clear/")
+	if net.ParseIP(ip) == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	if err := s.reputation.Clear(ctx, ip); err != nil {
+		http.Error(w, "Failed to clear reputation: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.auditLogger.Log(r.Context(), getSessionUser(r), audit.EventReputationClear, ip, nil, getIP(r))
+
+	http.Redirect(w, r, "/admin/reputation", http.StatusSeeOther)
+}
+
+// handleAccess lists the allowed and denied senders and client networks,
+// and adds a rule on POST
+func (s *Server) handleAccess(w http.ResponseWriter, r *http.Request) {
+	rules := smtpserver.NewAccessRules(s.db)
+	data := map[string]interface{}{
+		"Title": "Access Rules",
+	}
+
+	if r.Method == http.MethodPost {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		action := r.FormValue("action")
+		comment := strings.TrimSpace(r.FormValue("comment"))
+		pattern, err := rules.Set(r.Context(), r.FormValue("pattern"), action, comment)
+		if err == nil {
+			s.auditLogger.Log(r.Context(), getSessionUser(r), audit.EventAccessRuleSet, pattern, map[string]interface{}{
+				"action":  action,
+				"comment": comment,
+			}, getIP(r))
+			http.Redirect(w, r, "/admin/access", http.StatusSeeOther)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		data["Error"] = err.Error()
+	}
+
+	list, err := rules.List(r.Context())
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "Failed to list access rules", err)
+		data["Error"] = err.Error()
+	}
+	data["Rules"] = list
+	s.renderTemplate(w, "access.html", data)
+}
+
+// handleAccessRemove deletes the rule for a sender or network
+func (s *Server) handleAccessRemove(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	pattern := r.FormValue("pattern")
+	removed, err := smtpserver.NewAccessRules(s.db).Remove(r.Context(), pattern)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if removed {
+		s.auditLogger.Log(r.Context(), getSessionUser(r), audit.EventAccessRuleRemove, pattern, nil, getIP(r))
+	}
+
+	http.Redirect(w, r, "/admin/access", http.StatusSeeOther)
+}
+
+// handleQueueAttempts shows the delivery attempt timeline for a message
+func (s *Server) handleQueueAttempts(w http.ResponseWriter, r *http.Request) {
+	// Extract message ID from path
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) < 5 || parts[4] == "" {
+		http.NotFound(w, r)
+		return
+	}
+	msgID := parts[4]
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	attempts, err := delivery.NewAttemptLog(s.db).List(ctx, msgID)
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "Failed to get delivery attempts", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	type AttemptEntry struct {
+		Attempt   int
+		Host      string
+		Address   string
+		SMTPCode  int
+		Latency   time.Duration
+		Error     string
+		CreatedAt time.Time
+	}
+
+	entries := make([]AttemptEntry, 0, len(attempts))
+	for _, a := range attempts {
+		entries = append(entries, AttemptEntry{
+			Attempt:   a.Attempt,
+			Host:      validation.Truncate(a.Host, validation.MaxExternalStringLength),
+			Address:   validation.Truncate(a.Address, validation.MaxExternalStringLength),
+			SMTPCode:  a.SMTPCode,
+			Latency:   a.Latency,
+			Error:     validation.Truncate(a.Error, validation.MaxExternalStringLength),
+			CreatedAt: a.CreatedAt,
+		})
+	}
+
+	s.renderTemplate(w, "delivery_attempts.html", map[string]interface{}{
+		"Title":     "Delivery Attempts",
+		"MessageID": msgID,
+		"Attempts":  entries,
+	})
+}
+
 // HealthStatus represents the health check response
 type HealthStatus struct {
 	Status    string            `json:"status"`
 	Timestamp string            `json:"timestamp"`
 	Uptime    string            `json:"uptime"`
 	Services  map[string]string `json:"services"`
+	Disk      []diskmon.Usage   `json:"disk,omitempty"`
 }
 
 // handleHealth returns basic health status
@@ -901,6 +1592,17 @@ func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 		status.Services["queue"] = "not configured"
 	}
 
+	// Report free space on monitored storage paths
+	if s.diskMonitor != nil {
+		status.Disk = s.diskMonitor.Usage()
+		if s.diskMonitor.Low() {
+			status.Status = "degraded"
+			status.Services["disk"] = "low free space"
+		} else {
+			status.Services["disk"] = "ok"
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	if status.Status != "ok" {
 		w.WriteHeader(http.StatusServiceUnavailable)
@@ -938,9 +1640,10 @@ type DNSCheckResult struct {
 func (s *Server) handleDNSCheck(w http.ResponseWriter, r *http.Request) {
 	domain := r.URL.Query().Get("domain")
 	if domain == "" {
-		// Show form
+		// Show form, with the latest scheduled checks if any
 		s.renderTemplate(w, "dns_check.html", map[string]interface{}{
-			"Title": "DNS Check",
+			"Title":     "DNS Check",
+			"Monitored": s.dnsMonitor.Results(),
 		})
 		return
 	}
@@ -1120,12 +1823,17 @@ func (s *Server) handleDNSCheck(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// handleTestEmail sends a test email
+// handleTestEmail sends a test email from postmaster at a chosen domain
+// through the queue, so the delivery engine DKIM-signs it as it would any
+// outbound message. Sent to a scoring service like mail-tester.com, it
+// checks signing, SPF, DMARC and delivery end to end.
 func (s *Server) handleTestEmail(w http.ResponseWriter, r *http.Request) {
+	data := map[string]interface{}{
+		"Title":   "Send Test Email",
+		"Domains": s.testEmailDomains(),
+	}
 	if r.Method == http.MethodGet {
-		s.renderTemplate(w, "test_email.html", map[string]interface{}{
-			"Title": "Send Test Email",
-		})
+		s.renderTemplate(w, "test_email.html", data)
 		return
 	}
 
@@ -1135,95 +1843,128 @@ func (s *Server) handleTestEmail(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	recipient := r.FormValue("recipient")
+	recipient := strings.TrimSpace(r.FormValue("recipient"))
 	if recipient == "" {
-		s.renderTemplate(w, "test_email.html", map[string]interface{}{
-			"Title": "Send Test Email",
-			"Error": "Recipient email is required",
-		})
+		data["Error"] = "Recipient email is required"
+		s.renderTemplate(w, "test_email.html", data)
 		return
 	}
+	// The recipient lands in the To header; a line break would let it add headers
+	if strings.ContainsAny(recipient, "\r\n") {
+		data["Error"] = "Invalid recipient email"
+		s.renderTemplate(w, "test_email.html", data)
+		return
+	}
+	domain := strings.ToLower(strings.TrimSpace(r.FormValue("domain")))
+	if domain == "" {
+		domain = s.config.Server.Domain
+	}
+	if !slices.Contains(s.testEmailDomains(), domain) {
+		data["Error"] = "Unknown domain: " + domain
+		s.renderTemplate(w, "test_email.html", data)
+		return
+	}
+	data["Domain"] = domain
 
-	// Create a simple test message
-	from := "postmaster@" + s.config.Server.Domain
-	subject := "Test Email from " + s.config.Server.Hostname
-	body := "This is a test email sent from the mail server admin panel.\n\n" +
-		"Server: " + s.config.Server.Hostname + "\n" +
-		"Time: " + time.Now().Format(time.RFC1123) + "\n\n" +
-		"If you received this email, your mail server is working correctly!"
+	if s.queue == nil {
+		data["Error"] = "Queue not configured - cannot send email"
+		s.renderTemplate(w, "test_email.html", data)
+		return
+	}
 
-	messageID := generateMessageID(s.config.Server.Domain)
-	msg := "From: " + from + "\r\n" +
-		"To: " + recipient + "\r\n" +
-		"Subject: " + subject + "\r\n" +
-		"Message-ID: <" + messageID + ">\r\n" +
-		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
-		"MIME-Version: 1.0\r\n" +
-		"Content-Type: text/plain; charset=utf-8\r\n" +
-		"\r\n" +
-		body
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
 
-	// Queue the message if queue is available
-	if s.queue != nil {
-		ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
-		defer cancel()
+	from := "postmaster@" + domain
+	msg := composeTestEmail(from, recipient, s.config.Server.Hostname, time.Now())
 
-		// Write message to temp file in maildir
-		tmpDir := s.config.Storage.MaildirPath
-		if tmpDir == "" {
-			tmpDir = "/tmp"
-		}
-		tmpFile, err := os.CreateTemp(tmpDir, "test-email-*.eml")
-		if err != nil {
-			s.renderTemplate(w, "test_email.html", map[string]interface{}{
-				"Title": "Send Test Email",
-				"Error": "Failed to create message file: " + err.Error(),
-			})
-			return
-		}
-		tmpFile.WriteString(msg)
-		tmpFile.Close()
-
-		// Extract domain from recipient
-		parts := strings.Split(recipient, "@")
-		recipientDomain := ""
-		if len(parts) == 2 {
-			recipientDomain = parts[1]
-		}
+	// Write message to temp file in maildir
+	tmpDir := s.config.Storage.MaildirPath
+	if tmpDir == "" {
+		tmpDir = "/tmp"
+	}
+	tmpFile, err := os.CreateTemp(tmpDir, "test-email-*.eml")
+	if err != nil {
+		data["Error"] = "Failed to create message file: " + err.Error()
+		s.renderTemplate(w, "test_email.html", data)
+		return
+	}
+	tmpFile.Write(msg)
+	tmpFile.Close()
 
-		// Queue the message
-		queueMsg := &queue.Message{
-			Sender:      from,
-			Recipients:  []string{recipient},
-			MessagePath: tmpFile.Name(),
-			Size:        int64(len(msg)),
-			Domain:      recipientDomain,
-		}
+	// Extract domain from recipient
+	parts := strings.Split(recipient, "@")
+	recipientDomain := ""
+	if len(parts) == 2 {
+		recipientDomain = parts[1]
+	}
 
-		if err := s.queue.Enqueue(ctx, queueMsg); err != nil {
-			os.Remove(tmpFile.Name())
-			s.renderTemplate(w, "test_email.html", map[string]interface{}{
-				"Title": "Send Test Email",
-				"Error": "Failed to queue message: " + err.Error(),
-			})
-			return
-		}
+	// Queue the message
+	queueMsg := &queue.Message{
+		Sender:      from,
+		Recipients:  []string{recipient},
+		MessagePath: tmpFile.Name(),
+		Size:        int64(len(msg)),
+		Domain:      recipientDomain,
+	}
 
-		s.renderTemplate(w, "test_email.html", map[string]interface{}{
-			"Title":   "Send Test Email",
-			"Success": "Test email queued for delivery to " + recipient,
-		})
-	} else {
-		s.renderTemplate(w, "test_email.html", map[string]interface{}{
-			"Title": "Send Test Email",
-			"Error": "Queue not configured - cannot send email",
-		})
+	if err := s.queue.Enqueue(ctx, queueMsg); err != nil {
+		os.Remove(tmpFile.Name())
+		data["Error"] = "Failed to queue message: " + err.Error()
+		s.renderTemplate(w, "test_email.html", data)
+		return
 	}
+
+	data["Success"] = "Test email from " + from + " queued for delivery to " + recipient
+	if s.dkimPool == nil || s.dkimPool.GetSigner(domain) == nil {
+		data["Warning"] = "No DKIM key is loaded for " + domain + ", so the message is sent unsigned and will fail DKIM checks"
+	}
+	data["ResultURL"] = scoreURL(recipient)
+	s.renderTemplate(w, "test_email.html", data)
 }
 
-// generateMessageID creates a unique message ID
-func generateMessageID(domain string) string {
-	return time.Now().Format("20060102150405") + "." + strconv.FormatInt(time.Now().UnixNano(), 36) + "@" + domain
+// testEmailDomains returns the domains test email can be sent from: the
+// server's own and every configured one
+func (s *Server) testEmailDomains() []string {
+	domains := []string{strings.ToLower(s.config.Server.Domain)}
+	for _, d := range s.config.Domains {
+		if name := strings.ToLower(d.Name); !slices.Contains(domains, name) {
+			domains = append(domains, name)
+		}
+	}
+	return domains
+}
+
+// composeTestEmail builds the test message sent from the admin panel
+func composeTestEmail(from, recipient, hostname string, now time.Time) []byte {
+	body := "This is a test email sent from the mail server admin panel.\r\n\r\n" +
+		"Server: " + hostname + "\r\n" +
+		"Time: " + now.Format(time.RFC1123) + "\r\n\r\n" +
+		"If you received this email, your mail server is working correctly!\r\n"
+
+	_, domain, _ := strings.Cut(from, "@")
+	return []byte("From: " + from + "\r\n" +
+		"To: " + recipient + "\r\n" +
+		"Subject: Test Email from " + hostname + "\r\n" +
+		"Message-ID: <" + msgid.New(domain) + ">\r\n" +
+		"Date: " + now.Format(time.RFC1123Z) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" +
+		body)
+}
+
+// scoreURL returns where to read the report for a test sent to a scoring
+// service's address, or "" when recipient isn't one
+func scoreURL(recipient string) string {
+	local, domain, ok := strings.Cut(strings.ToLower(recipient), "@")
+	if !ok || local == "" {
+		return ""
+	}
+	if domain == "mail-tester.com" || strings.HasSuffix(domain, ".mail-tester.com") {
+		return "https://www.mail-tester.com/" + url.PathEscape(local)
+	}
+	return ""
 }
 
 // min returns the minimum of two integers
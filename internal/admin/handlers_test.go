@@ -0,0 +1,768 @@
+package admin
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/fenilsonani/email-server/internal/auth"
+	"github.com/fenilsonani/email-server/internal/config"
+	"github.com/fenilsonani/email-server/internal/logging"
+	"github.com/fenilsonani/email-server/internal/queue"
+	"github.com/fenilsonani/email-server/internal/security"
+	"github.com/fenilsonani/email-server/internal/smtp/delivery"
+	"github.com/fenilsonani/email-server/internal/storage/maildir"
+	"github.com/fenilsonani/email-server/internal/storage/metadata"
+)
+
+// setupTestServer creates an admin server backed by a migrated temporary database
+func setupTestServer(t *testing.T) (*Server, *metadata.DB) {
+	t.Helper()
+
+	db, err := metadata.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if err := db.Migrate(context.Background()); err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+
+	s, err := NewServer(config.DefaultConfig(), db.DB, nil, nil, nil, nil, logging.Default())
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	return s, db
+}
+
+func TestHandleQueueAttemptsChronological(t *testing.T) {
+	s, db := setupTestServer(t)
+	ctx := context.Background()
+	log := delivery.NewAttemptLog(db.DB)
+
+	base := time.Now().Add(-time.Hour)
+	// Record out of order to make sure the view sorts by time
+	attempts := []*delivery.Attempt{
+		{MessageID: "msg-1", Attempt: 2, Host: "mx2.example.net", SMTPCode: 250, CreatedAt: base.Add(20 * time.Minute)},
+		{MessageID: "msg-1", Attempt: 0, Host: "mx0.example.net", SMTPCode: 421, Error: "421 try later", CreatedAt: base},
+		{MessageID: "msg-1", Attempt: 1, Host: "mx1.example.net", Error: "connection failed: i/o timeout", CreatedAt: base.Add(10 * time.Minute)},
+		{MessageID: "msg-2", Attempt: 0, Host: "other.example.net", CreatedAt: base},
+	}
+	for _, a := range attempts {
+		if err := log.Record(ctx, a); err != nil {
+			t.Fatalf("Record() error = %v", err)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/queue/attempts/msg-1", nil)
+	rec := httptest.NewRecorder()
+	s.handleQueueAttempts(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+
+	body := rec.Body.String()
+	i0 := strings.Index(body, "mx0.example.net")
+	i1 := strings.Index(body, "mx1.example.net")
+	i2 := strings.Index(body, "mx2.example.net")
+	if i0 < 0 || i1 < 0 || i2 < 0 {
+		t.Fatalf("expected all three attempts in output")
+	}
+	if !(i0 < i1 && i1 < i2) {
+		t.Errorf("attempts not in chronological order: mx0@%d mx1@%d mx2@%d", i0, i1, i2)
+	}
+	if strings.Contains(body, "other.example.net") {
+		t.Error("attempts for another message should not be shown")
+	}
+	if !strings.Contains(body, "421 try later") {
+		t.Error("expected error text in output")
+	}
+}
+
+func TestHandleQueueAttemptsTruncatesRemoteStrings(t *testing.T) {
+	s, db := setupTestServer(t)
+
+	longErr := strings.Repeat("x", 5000)
+	if err := delivery.NewAttemptLog(db.DB).Record(context.Background(), &delivery.Attempt{
+		MessageID: "msg-long",
+		Host:      "mx.example.net",
+		Error:     longErr,
+	}); err != nil {
+		t.Fatalf("Record() error = %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/queue/attempts/msg-long", nil)
+	rec := httptest.NewRecorder()
+	s.handleQueueAttempts(rec, req)
+
+	if strings.Contains(rec.Body.String(), strings.Repeat("x", 1025)) {
+		t.Error("error message should be truncated to 1024 bytes")
+	}
+	if !strings.Contains(rec.Body.String(), strings.Repeat("x", 1024)) {
+		t.Error("truncated error message should keep the first 1024 bytes")
+	}
+}
+
+func TestHandleQueueAttemptsMissingID(t *testing.T) {
+	s, _ := setupTestServer(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/queue/attempts/", nil)
+	rec := httptest.NewRecorder()
+	s.handleQueueAttempts(rec, req)
+
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want 404", rec.Code)
+	}
+}
+
+func TestHandleUserAddDuplicateConflict(t *testing.T) {
+	s, db := setupTestServer(t)
+	s.authenticator = auth.NewAuthenticator(db.DB)
+
+	if _, err := db.Exec("INSERT INTO domains (name) VALUES ('example.com')"); err != nil {
+		t.Fatalf("Failed to insert domain: %v", err)
+	}
+	if _, err := s.authenticator.CreateUser(context.Background(), "alice", "password123", 1); err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+
+	form := url.Values{"username": {"alice"}, "password": {"password123"}, "domain_id": {"1"}}
+	req := httptest.NewRequest(http.MethodPost, "/admin/users/add", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	s.handleUserAdd(rec, req)
+
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("status = %d, want 409", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), "user already exists: alice@example.com") {
+		t.Errorf("body = %q, want the duplicate address", rec.Body.String())
+	}
+}
+
+func TestHandleUserAddGrantsAdmin(t *testing.T) {
+	s, db := setupTestServer(t)
+	s.authenticator = auth.NewAuthenticator(db.DB)
+	store, err := maildir.NewStore(db.DB, filepath.Join(t.TempDir(), "maildir"))
+	if err != nil {
+		t.Fatalf("NewStore() error = %v", err)
+	}
+	s.store = store
+
+	if _, err := db.Exec("INSERT INTO domains (name) VALUES ('example.com')"); err != nil {
+		t.Fatalf("Failed to insert domain: %v", err)
+	}
+
+	form := url.Values{"username": {"alice"}, "password": {"password123"}, "domain_id": {"2"}}
+	req := httptest.NewRequest(http.MethodPost, "/admin/users/add", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	s.handleUserAdd(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status for an unknown domain = %d, want 400", rec.Code)
+	}
+
+	form.Set("domain_id", "1")
+	form.Set("is_admin", "on")
+	req = httptest.NewRequest(http.MethodPost, "/admin/users/add", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec = httptest.NewRecorder()
+	s.handleUserAdd(rec, req)
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("status = %d, want 303: %s", rec.Code, rec.Body.String())
+	}
+
+	var isAdmin bool
+	if err := db.QueryRow("SELECT is_admin FROM users WHERE username = 'alice'").Scan(&isAdmin); err != nil {
+		t.Fatalf("Failed to query user: %v", err)
+	}
+	if !isAdmin {
+		t.Error("user was not made an admin")
+	}
+}
+
+func TestHandleDomainAddDuplicateConflict(t *testing.T) {
+	s, db := setupTestServer(t)
+
+	if _, err := db.Exec("INSERT INTO domains (name) VALUES ('example.com')"); err != nil {
+		t.Fatalf("Failed to insert domain: %v", err)
+	}
+
+	form := url.Values{"name": {"example.com"}}
+	req := httptest.NewRequest(http.MethodPost, "/admin/domains/add", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	s.handleDomainAdd(rec, req)
+
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("status = %d, want 409", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), "domain already exists: example.com") {
+		t.Errorf("body does not name the duplicate domain")
+	}
+}
+
+// fakeQueue is an in-memory queueBackend. Methods the tests don't need
+// panic through the nil embedded interface.
+type fakeQueue struct {
+	queueBackend
+	msgs map[string]*queue.Message
+}
+
+func newFakeQueue(msgs ...*queue.Message) *fakeQueue {
+	q := &fakeQueue{msgs: make(map[string]*queue.Message)}
+	for _, m := range msgs {
+		q.msgs[m.ID] = m
+	}
+	return q
+}
+
+// ids returns the IDs of messages matching keep, ordered by next attempt
+func (q *fakeQueue) ids(keep func(*queue.Message) bool, offset, limit int64) []string {
+	var matched []*queue.Message
+	for _, m := range q.msgs {
+		if keep(m) {
+			matched = append(matched, m)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		if !matched[i].NextAttempt.Equal(matched[j].NextAttempt) {
+			return matched[i].NextAttempt.Before(matched[j].NextAttempt)
+		}
+		return matched[i].ID < matched[j].ID
+	})
+
+	var ids []string
+	for i := offset; i < int64(len(matched)) && i < offset+limit; i++ {
+		ids = append(ids, matched[i].ID)
+	}
+	return ids
+}
+
+func (q *fakeQueue) DeferredIDs(ctx context.Context, after time.Time, offset, limit int64) ([]string, error) {
+	return q.ids(func(m *queue.Message) bool {
+		return (m.Status == queue.StatusPending || m.Status == queue.StatusDeferred) && m.NextAttempt.After(after)
+	}, offset, limit), nil
+}
+
+func (q *fakeQueue) FailedIDs(ctx context.Context, offset, limit int64) ([]string, error) {
+	return q.ids(func(m *queue.Message) bool { return m.Status == queue.StatusFailed }, offset, limit), nil
+}
+
+func (q *fakeQueue) Reschedule(ctx context.Context, msgID string, at time.Time) error {
+	m, ok := q.msgs[msgID]
+	if !ok {
+		return queue.ErrMessageNotFound
+	}
+	m.Status, m.Attempts, m.NextAttempt = queue.StatusPending, 0, at
+	return nil
+}
+
+func (q *fakeQueue) Stats(ctx context.Context) (*queue.QueueStats, error) {
+	return &queue.QueueStats{}, nil
+}
+
+func (q *fakeQueue) Search(ctx context.Context, status queue.Status, f queue.SearchFilter, offset, limit int) ([]*queue.Message, bool, error) {
+	ids := q.ids(func(m *queue.Message) bool { return m.Status == status && f.Matches(m) }, int64(offset), int64(limit)+1)
+	more := len(ids) > limit
+	if more {
+		ids = ids[:limit]
+	}
+	var msgs []*queue.Message
+	for _, id := range ids {
+		msgs = append(msgs, q.msgs[id])
+	}
+	return msgs, more, nil
+}
+
+func postRetryAll(s *Server, set string) *httptest.ResponseRecorder {
+	form := url.Values{"set": {set}}
+	req := httptest.NewRequest(http.MethodPost, "/admin/queue/retry-all", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	s.handleQueueRetryAll(rec, req)
+	return rec
+}
+
+func TestHandleQueueRetryAllDeferred(t *testing.T) {
+	s, _ := setupTestServer(t)
+
+	// More than one batch of deferred messages, plus one that is already due
+	later := time.Now().Add(time.Hour)
+	var msgs []*queue.Message
+	for i := 0; i < bulkRetryBatchSize*2+5; i++ {
+		msgs = append(msgs, &queue.Message{
+			ID:          fmt.Sprintf("deferred-%03d", i),
+			Status:      queue.StatusDeferred,
+			Attempts:    3,
+			NextAttempt: later.Add(time.Duration(i) * time.Second),
+		})
+	}
+	msgs = append(msgs, &queue.Message{ID: "due", Status: queue.StatusPending, NextAttempt: time.Now().Add(-time.Minute)})
+	q := newFakeQueue(msgs...)
+	s.queue = q
+
+	start := time.Now()
+	rec := postRetryAll(s, "deferred")
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	loc, _ := url.Parse(rec.Header().Get("Location"))
+	if got := loc.Query().Get("retried"); got != strconv.Itoa(bulkRetryBatchSize*2+5) {
+		t.Errorf("retried = %s, want %d", got, bulkRetryBatchSize*2+5)
+	}
+	if summary := bulkRetrySummary(loc.Query()); !strings.Contains(summary, "Rescheduled 205 deferred") {
+		t.Errorf("summary = %q", summary)
+	}
+
+	for id, m := range q.msgs {
+		if m.NextAttempt.After(start.Add(time.Second)) {
+			t.Errorf("%s next attempt = %v, want now", id, m.NextAttempt)
+		}
+		if id != "due" && m.Attempts != 0 {
+			t.Errorf("%s attempts = %d, want reset to 0", id, m.Attempts)
+		}
+	}
+}
+
+func TestHandleQueueRetryAllFailed(t *testing.T) {
+	s, _ := setupTestServer(t)
+	q := newFakeQueue(
+		&queue.Message{ID: "f1", Status: queue.StatusFailed, Attempts: 15},
+		&queue.Message{ID: "f2", Status: queue.StatusFailed, Attempts: 15},
+		&queue.Message{ID: "sent", Status: queue.StatusSent},
+	)
+	s.queue = q
+
+	rec := postRetryAll(s, "failed")
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	loc, _ := url.Parse(rec.Header().Get("Location"))
+	if got := loc.Query().Get("retried"); got != "2" {
+		t.Errorf("retried = %s, want 2", got)
+	}
+	for _, id := range []string{"f1", "f2"} {
+		if q.msgs[id].Status != queue.StatusPending {
+			t.Errorf("%s status = %s, want pending", id, q.msgs[id].Status)
+		}
+	}
+	if q.msgs["sent"].Status != queue.StatusSent {
+		t.Error("sent message should not be touched")
+	}
+}
+
+func TestHandleQueueRetryAllRejectsConcurrentRun(t *testing.T) {
+	s, _ := setupTestServer(t)
+	s.queue = newFakeQueue()
+
+	s.bulkRetryMu.Lock()
+	rec := postRetryAll(s, "failed")
+	s.bulkRetryMu.Unlock()
+	if rec.Code != http.StatusConflict {
+		t.Errorf("status while running = %d, want 409", rec.Code)
+	}
+
+	if rec := postRetryAll(s, "everything"); rec.Code != http.StatusBadRequest {
+		t.Errorf("status for unknown set = %d, want 400", rec.Code)
+	}
+}
+
+func TestHandleQueueSearchByRecipient(t *testing.T) {
+	s, _ := setupTestServer(t)
+	s.queue = newFakeQueue(
+		&queue.Message{ID: "match", Status: queue.StatusPending, Sender: "a@example.com", Recipients: []string{"Bob@Example.org"}},
+		&queue.Message{ID: "other", Status: queue.StatusPending, Sender: "a@example.com", Recipients: []string{"carol@example.net"}},
+		&queue.Message{ID: "failed-match", Status: queue.StatusFailed, Sender: "a@example.com", Recipients: []string{"bob@example.org"}},
+	)
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/queue?recipient=bob@example.org", nil)
+	rec := httptest.NewRecorder()
+	s.handleQueue(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+
+	body := rec.Body.String()
+	if !strings.Contains(body, "Bob@Example.org") {
+		t.Error("matching pending message missing from results")
+	}
+	if strings.Contains(body, "carol@example.net") {
+		t.Error("non-matching message shown in results")
+	}
+	if strings.Contains(body, "failed-match") {
+		t.Error("failed message shown when searching pending")
+	}
+}
+
+func TestHandleQueueSearchPaginates(t *testing.T) {
+	s, _ := setupTestServer(t)
+	var msgs []*queue.Message
+	for i := 0; i < queueSearchPageSize+3; i++ {
+		msgs = append(msgs, &queue.Message{
+			ID:         fmt.Sprintf("m%03d", i),
+			Status:     queue.StatusFailed,
+			Recipients: []string{"bob@example.org"},
+		})
+	}
+	s.queue = newFakeQueue(msgs...)
+
+	search := newQueueSearch(url.Values{"recipient": {"bob@"}, "status": {"failed"}, "page": {"2"}})
+	got, more, err := s.queue.Search(context.Background(), queue.StatusFailed, search.Filter,
+		(search.Page-1)*queueSearchPageSize, queueSearchPageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 || more {
+		t.Errorf("page 2 = %d results, more = %v, want 3, false", len(got), more)
+	}
+	if u := search.pageURL(1); !strings.Contains(u, "page=1") || !strings.Contains(u, "recipient=bob%40") {
+		t.Errorf("pageURL(1) = %q", u)
+	}
+
+	if newQueueSearch(url.Values{"page": {"2"}}) != nil {
+		t.Error("newQueueSearch without a filter should be nil")
+	}
+}
+
+func TestHandleQueueReleaseAndReject(t *testing.T) {
+	s, _ := setupTestServer(t)
+	ctx := context.Background()
+	q := queue.NewMemoryQueue(queue.DefaultConfig())
+	defer q.Close()
+	s.queue = q
+	s.config.Storage.DataDir = t.TempDir()
+	spoolDir := filepath.Join(s.config.Storage.DataDir, "queue")
+	if err := os.MkdirAll(spoolDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"release-me", "reject-me"} {
+		path := filepath.Join(spoolDir, id+".eml")
+		if err := os.WriteFile(path, []byte("Subject: test\r\n\r\nbody\r\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		q.Enqueue(ctx, &queue.Message{ID: id, Status: queue.StatusHeld, HoldReason: "3 recipients exceeds the limit of 2", MessagePath: path})
+	}
+
+	rec := httptest.NewRecorder()
+	s.handleQueue(rec, httptest.NewRequest(http.MethodGet, "/admin/queue", nil))
+	if body := rec.Body.String(); !strings.Contains(body, "Held for Review") || !strings.Contains(body, "exceeds the limit") {
+		t.Error("held messages missing from queue page")
+	}
+
+	rec = httptest.NewRecorder()
+	s.handleQueueRelease(rec, httptest.NewRequest(http.MethodPost, "/admin/queue/release/release-me", nil))
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("release status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	if msg, _ := q.Dequeue(ctx); msg == nil || msg.ID != "release-me" {
+		t.Errorf("Dequeue() after release = %+v", msg)
+	}
+
+	form := url.Values{"reason": {"phishing"}}
+	req := httptest.NewRequest(http.MethodPost, "/admin/queue/reject/reject-me", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec = httptest.NewRecorder()
+	s.handleQueueReject(rec, req)
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("reject status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	if msg, _ := q.GetMessage(ctx, "reject-me"); msg.Status != queue.StatusFailed || msg.LastError != "Rejected by admin: phishing" {
+		t.Errorf("rejected message = %+v", msg)
+	}
+	if _, err := os.Stat(filepath.Join(spoolDir, "reject-me.eml")); !os.IsNotExist(err) {
+		t.Errorf("rejected message file left behind: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(spoolDir, "release-me.eml")); err != nil {
+		t.Errorf("released message file: %v", err)
+	}
+
+	// Only held messages can be released or rejected
+	rec = httptest.NewRecorder()
+	s.handleQueueReject(rec, httptest.NewRequest(http.MethodPost, "/admin/queue/reject/release-me", nil))
+	if rec.Code != http.StatusConflict {
+		t.Errorf("reject of a message being delivered = %d, want 409", rec.Code)
+	}
+}
+
+func TestHandleUserAddDeliversWelcomeMessage(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		t.Run(fmt.Sprintf("enabled=%v", enabled), func(t *testing.T) {
+			s, db := setupTestServer(t)
+			s.authenticator = auth.NewAuthenticator(db.DB)
+			store, err := maildir.NewStore(db.DB, filepath.Join(t.TempDir(), "maildir"))
+			if err != nil {
+				t.Fatalf("NewStore() error = %v", err)
+			}
+			s.store = store
+			s.config.Server.Hostname = "mail.example.com"
+			s.config.Welcome.Enabled = enabled
+
+			if _, err := db.Exec("INSERT INTO domains (name) VALUES ('example.com')"); err != nil {
+				t.Fatalf("Failed to insert domain: %v", err)
+			}
+			form := url.Values{"username": {"alice"}, "password": {"password123"}, "domain_id": {"1"}}
+			req := httptest.NewRequest(http.MethodPost, "/admin/users/add", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rec := httptest.NewRecorder()
+			s.handleUserAdd(rec, req)
+			if rec.Code != http.StatusSeeOther {
+				t.Fatalf("status = %d, want 303: %s", rec.Code, rec.Body.String())
+			}
+
+			ctx := context.Background()
+			user, err := s.authenticator.LookupUser(ctx, "alice@example.com")
+			if err != nil {
+				t.Fatalf("LookupUser() error = %v", err)
+			}
+			inbox, err := store.GetMailbox(ctx, user.ID, "INBOX")
+			if err != nil {
+				t.Fatalf("GetMailbox() error = %v", err)
+			}
+			msgs, err := store.ListMessages(ctx, inbox.ID, 0, 0)
+			if err != nil {
+				t.Fatalf("ListMessages() error = %v", err)
+			}
+
+			if !enabled {
+				if len(msgs) != 0 {
+					t.Errorf("INBOX has %d messages, want none with the welcome message disabled", len(msgs))
+				}
+				return
+			}
+			if len(msgs) != 1 {
+				t.Fatalf("INBOX has %d messages, want the welcome message", len(msgs))
+			}
+			if msgs[0].Subject != "Welcome to example.com" {
+				t.Errorf("Subject = %q", msgs[0].Subject)
+			}
+		})
+	}
+}
+
+func TestHandleLoginRejectsAppPassword(t *testing.T) {
+	s, db := setupTestServer(t)
+	s.authenticator = auth.NewAuthenticator(db.DB)
+	ctx := context.Background()
+
+	if _, err := db.Exec("INSERT INTO domains (name) VALUES ('example.com')"); err != nil {
+		t.Fatalf("Failed to insert domain: %v", err)
+	}
+	user, err := s.authenticator.CreateUser(ctx, "admin", "password123", 1)
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	if _, err := db.Exec("UPDATE users SET is_admin = TRUE WHERE id = ?", user.ID); err != nil {
+		t.Fatalf("Failed to make user admin: %v", err)
+	}
+	appPassword, _, err := s.authenticator.CreateAppPassword(ctx, user.ID, "Phone")
+	if err != nil {
+		t.Fatalf("CreateAppPassword() error = %v", err)
+	}
+
+	login := func(password string) *httptest.ResponseRecorder {
+		form := url.Values{"username": {"admin@example.com"}, "password": {password}}
+		req := httptest.NewRequest(http.MethodPost, "/admin/login", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		s.handleLogin(rec, req)
+		return rec
+	}
+
+	if rec := login(appPassword); rec.Code == http.StatusSeeOther || !strings.Contains(rec.Body.String(), "Invalid credentials") {
+		t.Errorf("login with app password: status = %d, want the login form with an error", rec.Code)
+	}
+	if rec := login("password123"); rec.Code != http.StatusSeeOther {
+		t.Errorf("login with main password: status = %d, want 303", rec.Code)
+	}
+}
+
+func TestGetStatsDeliveryTrend(t *testing.T) {
+	s, db := setupTestServer(t)
+
+	now := time.Now().UTC()
+	attempts := delivery.NewAttemptLog(db.DB)
+	attemptAt := func(msgID string, code int, errMsg string, at time.Time) {
+		t.Helper()
+		a := &delivery.Attempt{MessageID: msgID, Host: "mx.example.org", SMTPCode: code, Error: errMsg, CreatedAt: at}
+		if err := attempts.Record(context.Background(), a); err != nil {
+			t.Fatalf("Record() error = %v", err)
+		}
+	}
+	hourAgo2 := now.Add(-2 * time.Hour).Truncate(time.Hour)
+	attemptAt("m1", 250, "", hourAgo2)
+	// A message counts once an hour, by its last attempt
+	attemptAt("m2", 0, "connection refused", hourAgo2)
+	attemptAt("m2", 250, "", hourAgo2.Add(time.Minute))
+	attemptAt("m3", 451, "try again later", hourAgo2)
+	attemptAt("m4", 550, "no such user", hourAgo2)
+	attemptAt("m3", 0, "connection refused", now.Add(-5*time.Hour))
+	attemptAt("m5", 250, "", now.Add(-48*time.Hour)) // outside the window
+	attemptAt("m6", 250, "", time.Time{})
+
+	stats, err := s.getStats(context.Background())
+	if err != nil {
+		t.Fatalf("getStats() error = %v", err)
+	}
+	if len(stats.DeliveryTrend) != deliveryTrendHours {
+		t.Fatalf("len(DeliveryTrend) = %d, want %d", len(stats.DeliveryTrend), deliveryTrendHours)
+	}
+
+	want := map[time.Time]DeliveryBucket{
+		hourAgo2: {Delivered: 2, Deferred: 1, Bounced: 1},
+		now.Add(-5 * time.Hour).Truncate(time.Hour): {Deferred: 1},
+	}
+	last := stats.DeliveryTrend[len(stats.DeliveryTrend)-1]
+	want[last.Hour] = DeliveryBucket{Delivered: 1}
+	for i, b := range stats.DeliveryTrend {
+		if i > 0 && !b.Hour.Equal(stats.DeliveryTrend[i-1].Hour.Add(time.Hour)) {
+			t.Errorf("bucket %d hour = %v, want an hour after %v", i, b.Hour, stats.DeliveryTrend[i-1].Hour)
+		}
+		w := want[b.Hour]
+		if b.Delivered != w.Delivered || b.Deferred != w.Deferred || b.Bounced != w.Bounced {
+			t.Errorf("bucket %v = %d/%d/%d delivered/deferred/bounced, want %d/%d/%d",
+				b.Hour, b.Delivered, b.Deferred, b.Bounced, w.Delivered, w.Deferred, w.Bounced)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	s.handleDashboard(rec, httptest.NewRequest(http.MethodGet, "/admin/", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"deferred":1`) {
+		t.Errorf("dashboard: status = %d, want the delivery trend JSON in the page", rec.Code)
+	}
+}
+
+// Enqueue records msg under a generated ID
+func (q *fakeQueue) Enqueue(ctx context.Context, msg *queue.Message) error {
+	msg.ID = strconv.Itoa(len(q.msgs) + 1)
+	q.msgs[msg.ID] = msg
+	return nil
+}
+
+func TestHandleTestEmailSendsSignableMessage(t *testing.T) {
+	s, _ := setupTestServer(t)
+	q := newFakeQueue()
+	s.queue = q
+	s.config.Storage.MaildirPath = t.TempDir()
+	s.config.Domains = append(s.config.Domains, config.DomainConfig{Name: "example.org"})
+
+	// The delivery engine signs with the same pool, by sender domain
+	key, err := security.GenerateDKIMKey(2048)
+	if err != nil {
+		t.Fatalf("GenerateDKIMKey() error = %v", err)
+	}
+	keyPath := filepath.Join(t.TempDir(), "example.org.key")
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	pool := security.NewDKIMSignerPool()
+	if err := pool.AddSigner("example.org", "2026", keyPath); err != nil {
+		t.Fatalf("AddSigner() error = %v", err)
+	}
+	s.SetDKIMSigners(pool)
+
+	form := url.Values{"domain": {"example.org"}, "recipient": {"test-abc123@srv1.mail-tester.com"}}
+	req := httptest.NewRequest(http.MethodPost, "/admin/tools/test-email", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	s.handleTestEmail(rec, req)
+
+	body := rec.Body.String()
+	if !strings.Contains(body, "https://www.mail-tester.com/test-abc123") {
+		t.Errorf("response has no link to the score:\n%s", body)
+	}
+	if strings.Contains(body, "No DKIM key is loaded") {
+		t.Errorf("response warns about signing with a key loaded:\n%s", body)
+	}
+	if len(q.msgs) != 1 {
+		t.Fatalf("queued %d messages, want 1", len(q.msgs))
+	}
+	msg := q.msgs["1"]
+	if msg.Sender != "postmaster@example.org" {
+		t.Errorf("Sender = %q, want postmaster@example.org", msg.Sender)
+	}
+
+	data, err := os.ReadFile(msg.MessagePath)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	var signed bytes.Buffer
+	if err := pool.Sign("example.org", &signed, bytes.NewReader(data)); err != nil {
+		t.Fatalf("Sign() error = %v", err)
+	}
+
+	record, err := security.FormatDKIMPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifications, err := dkim.VerifyWithOptions(&signed, &dkim.VerifyOptions{
+		LookupTXT: func(name string) ([]string, error) {
+			if name != "2026._domainkey.example.org" {
+				return nil, fmt.Errorf("unexpected lookup of %s", name)
+			}
+			return []string{record}, nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+	if len(verifications) != 1 || verifications[0].Err != nil || verifications[0].Domain != "example.org" {
+		t.Fatalf("verifications = %+v, want one valid signature for example.org", verifications)
+	}
+}
+
+func TestHandleTestEmailWarnsWithoutDKIMKey(t *testing.T) {
+	s, _ := setupTestServer(t)
+	s.queue = newFakeQueue()
+	s.config.Storage.MaildirPath = t.TempDir()
+
+	for domain, want := range map[string]string{
+		s.config.Server.Domain: "No DKIM key is loaded for " + s.config.Server.Domain,
+		"unknown.example":      "Unknown domain: unknown.example",
+	} {
+		form := url.Values{"domain": {domain}, "recipient": {"someone@example.net"}}
+		req := httptest.NewRequest(http.MethodPost, "/admin/tools/test-email", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		s.handleTestEmail(rec, req)
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("domain %s: response missing %q", domain, want)
+		}
+	}
+}
+
+func TestHandleTestEmailRefusesLineBreakInRecipient(t *testing.T) {
+	s, _ := setupTestServer(t)
+	q := newFakeQueue()
+	s.queue = q
+	s.config.Storage.MaildirPath = t.TempDir()
+
+	form := url.Values{"recipient": {"someone@example.net\r\nBcc: victim@example.com"}}
+	req := httptest.NewRequest(http.MethodPost, "/admin/tools/test-email", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	s.handleTestEmail(rec, req)
+
+	if !strings.Contains(rec.Body.String(), "Invalid recipient email") {
+		t.Errorf("response does not refuse the recipient:\n%s", rec.Body.String())
+	}
+	if len(q.msgs) != 0 {
+		t.Errorf("queued %d messages, want 0", len(q.msgs))
+	}
+}
@@ -11,9 +11,18 @@ import (
 	"time"
 )
 
-// Session represents an admin session
+// sessionScope says which part of the server a session was created for
+type sessionScope int
+
+const (
+	scopeAdmin   sessionScope = iota // Admin panel, admins only
+	scopeAccount                     // Account portal, any user
+)
+
+// Session represents a logged-in admin or account portal user
 type session struct {
 	userID    int64
+	scope     sessionScope
 	createdAt time.Time
 	expiresAt time.Time
 }
@@ -24,12 +33,13 @@ var (
 )
 
 // createSession creates a new session and returns the token
-func (s *Server) createSession(userID int64) string {
+func (s *Server) createSession(userID int64, scope sessionScope) string {
 	token := generateToken()
 
 	sessionsMu.Lock()
 	sessions[token] = &session{
 		userID:    userID,
+		scope:     scope,
 		createdAt: time.Now(),
 		expiresAt: time.Now().Add(7 * 24 * time.Hour), // 7 days session
 	}
@@ -38,8 +48,8 @@ func (s *Server) createSession(userID int64) string {
 	return token
 }
 
-// validateSession checks if a session token is valid
-func (s *Server) validateSession(token string) (int64, bool) {
+// validateSession checks if a session token is valid for scope
+func (s *Server) validateSession(token string, scope sessionScope) (int64, bool) {
 	// Validate token format: must be valid hex and minimum length
 	if !isValidToken(token) {
 		return 0, false
@@ -49,7 +59,7 @@ func (s *Server) validateSession(token string) (int64, bool) {
 	sess, exists := sessions[token]
 	sessionsMu.RUnlock()
 
-	if !exists {
+	if !exists || sess.scope != scope {
 		return 0, false
 	}
 
@@ -77,7 +87,7 @@ func (s *Server) withAuth(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
-		userID, valid := s.validateSession(cookie.Value)
+		userID, valid := s.validateSession(cookie.Value, scopeAdmin)
 		if !valid {
 			http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
 			return
@@ -370,7 +380,7 @@ func getSessionUser(r *http.Request) string {
 	sess, exists := sessions[cookie.Value]
 	sessionsMu.RUnlock()
 
-	if !exists || time.Now().After(sess.expiresAt) {
+	if !exists || sess.scope != scopeAdmin || time.Now().After(sess.expiresAt) {
 		return "unknown"
 	}
 
@@ -18,9 +18,13 @@ import (
 	"github.com/fenilsonani/email-server/internal/audit"
 	"github.com/fenilsonani/email-server/internal/auth"
 	"github.com/fenilsonani/email-server/internal/config"
+	"github.com/fenilsonani/email-server/internal/diskmon"
+	"github.com/fenilsonani/email-server/internal/dnsmon"
 	"github.com/fenilsonani/email-server/internal/logging"
 	"github.com/fenilsonani/email-server/internal/queue"
+	"github.com/fenilsonani/email-server/internal/security"
 	"github.com/fenilsonani/email-server/internal/sieve"
+	smtpserver "github.com/fenilsonani/email-server/internal/smtp"
 	"github.com/fenilsonani/email-server/internal/storage/maildir"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
@@ -35,7 +39,7 @@ type Server struct {
 	authenticator *auth.Authenticator
 	store         *maildir.Store
 	sieveStore    *sieve.Store
-	queue         *queue.RedisQueue
+	queue         queueBackend
 	logger        *logging.Logger
 	auditLogger   *audit.Logger
 	templates     map[string]*template.Template
@@ -43,10 +47,34 @@ type Server struct {
 	shutdownOnce  sync.Once
 	rateLimiter   *RateLimiter
 	startTime     time.Time
+	diskMonitor   *diskmon.Monitor
+	dnsMonitor    *dnsmon.Monitor
+	dkimPool      *security.DKIMSignerPool
+	reputation    *smtpserver.Reputation
+
+	// bulkRetryMu lets only one bulk retry run at a time
+	bulkRetryMu sync.Mutex
+}
+
+// queueBackend is the part of the message queue the admin panel uses
+type queueBackend interface {
+	Stats(ctx context.Context) (*queue.QueueStats, error)
+	ListPending(ctx context.Context, limit int64) ([]*queue.Message, error)
+	ListHeld(ctx context.Context, limit int64) ([]*queue.Message, error)
+	ListFailed(ctx context.Context, limit int64) ([]*queue.Message, error)
+	ListSent(ctx context.Context, limit int64) ([]*queue.Message, error)
+	GetMessage(ctx context.Context, msgID string) (*queue.Message, error)
+	Enqueue(ctx context.Context, msg *queue.Message) error
+	Fail(ctx context.Context, msgID string, reason string) error
+	Release(ctx context.Context, msgID string) error
+	Reschedule(ctx context.Context, msgID string, at time.Time) error
+	DeferredIDs(ctx context.Context, after time.Time, offset, limit int64) ([]string, error)
+	FailedIDs(ctx context.Context, offset, limit int64) ([]string, error)
+	Search(ctx context.Context, status queue.Status, f queue.SearchFilter, offset, limit int) ([]*queue.Message, bool, error)
 }
 
 // NewServer creates a new admin server
-func NewServer(cfg *config.Config, db *sql.DB, authenticator *auth.Authenticator, store *maildir.Store, sieveStore *sieve.Store, q *queue.RedisQueue, logger *logging.Logger) (*Server, error) {
+func NewServer(cfg *config.Config, db *sql.DB, authenticator *auth.Authenticator, store *maildir.Store, sieveStore *sieve.Store, q queue.Queue, logger *logging.Logger) (*Server, error) {
 	// Read base template content
 	baseContent, err := templatesFS.ReadFile("templates/base.html")
 	if err != nil {
@@ -70,8 +98,13 @@ func NewServer(cfg *config.Config, db *sql.DB, authenticator *auth.Authenticator
 		"delivery_logs.html",
 		"audit_logs.html",
 		"queue.html",
+		"delivery_attempts.html",
 		"dns_check.html",
 		"test_email.html",
+		"reputation.html",
+		"access.html",
+		"account.html",
+		"account_vacation.html",
 	}
 
 	for _, page := range pages {
@@ -127,6 +160,29 @@ func NewServer(cfg *config.Config, db *sql.DB, authenticator *auth.Authenticator
 	return s, nil
 }
 
+// SetDiskMonitor sets the disk monitor reported by the health endpoint
+func (s *Server) SetDiskMonitor(m *diskmon.Monitor) {
+	s.diskMonitor = m
+}
+
+// SetDNSMonitor sets the DNS monitor whose latest results the DNS check
+// page shows
+func (s *Server) SetDNSMonitor(m *dnsmon.Monitor) {
+	s.dnsMonitor = m
+}
+
+// SetDKIMSigners sets the DKIM signers the delivery engine signs with, so
+// the test email page can warn when a domain's mail goes out unsigned
+func (s *Server) SetDKIMSigners(p *security.DKIMSignerPool) {
+	s.dkimPool = p
+}
+
+// SetReputation sets the IP reputation the reputation page lists and
+// clears
+func (s *Server) SetReputation(r *smtpserver.Reputation) {
+	s.reputation = r
+}
+
 // Start starts the admin server
 func (s *Server) Start(listen string) error {
 	mux := http.NewServeMux()
@@ -147,6 +203,9 @@ func (s *Server) Start(listen string) error {
 	mux.HandleFunc("/admin/users/add", s.withAuth(s.handleUserAdd))
 	mux.HandleFunc("/admin/users/edit/", s.withAuth(s.handleUserEdit))
 	mux.HandleFunc("/admin/users/delete/", s.withAuth(s.handleUserDelete))
+	mux.HandleFunc("/admin/users/app-passwords/add/", s.withAuth(s.handleAppPasswordAdd))
+	mux.HandleFunc("/admin/users/app-passwords/revoke/", s.withAuth(s.handleAppPasswordRevoke))
+	mux.HandleFunc("/admin/users/reindex/", s.withAuth(s.handleUserReindex))
 	mux.HandleFunc("/admin/domains", s.withAuth(s.handleDomains))
 	mux.HandleFunc("/admin/domains/add", s.withAuth(s.handleDomainAdd))
 	mux.HandleFunc("/admin/domains/delete/", s.withAuth(s.handleDomainDelete))
@@ -156,11 +215,29 @@ func (s *Server) Start(listen string) error {
 	mux.HandleFunc("/admin/logs/audit", s.withAuth(s.handleAuditLogs))
 	mux.HandleFunc("/admin/queue", s.withAuth(s.handleQueue))
 	mux.HandleFunc("/admin/queue/retry/", s.withAuth(s.handleQueueRetry))
+	mux.HandleFunc("/admin/queue/retry-all", s.withAuth(s.handleQueueRetryAll))
 	mux.HandleFunc("/admin/queue/delete/", s.withAuth(s.handleQueueDelete))
+	mux.HandleFunc("/admin/queue/release/", s.withAuth(s.handleQueueRelease))
+	mux.HandleFunc("/admin/queue/reject/", s.withAuth(s.handleQueueReject))
+	mux.HandleFunc("/admin/queue/attempts/", s.withAuth(s.handleQueueAttempts))
+	mux.HandleFunc("/admin/reputation", s.withAuth(s.handleReputation))
+	mux.HandleFunc("/admin/reputation/clear/", s.withAuth(s.handleReputationClear))
+	mux.HandleFunc("/admin/access", s.withAuth(s.handleAccess))
+	mux.HandleFunc("/admin/access/remove", s.withAuth(s.handleAccessRemove))
 	mux.HandleFunc("/admin/api/stats", s.withAuth(s.handleAPIStats))
 	mux.HandleFunc("/admin/tools/dns", s.withAuth(s.handleDNSCheck))
 	mux.HandleFunc("/admin/tools/test-email", s.withAuth(s.handleTestEmail))
 
+	// Account portal routes, for any user's own account
+	mux.HandleFunc("/account/", s.withAccount(s.handleAccount))
+	mux.HandleFunc("/account/login", s.handleAccountLogin)
+	mux.HandleFunc("/account/logout", s.handleAccountLogout)
+	mux.HandleFunc("/account/password", s.withAccount(s.handleAccountPassword))
+	mux.HandleFunc("/account/app-passwords/add", s.withAccount(s.handleAccountAppPasswordAdd))
+	mux.HandleFunc("/account/app-passwords/revoke/", s.withAccount(s.handleAccountAppPasswordRevoke))
+	mux.HandleFunc("/account/sieve", s.withAccount(s.handleAccountSieve))
+	mux.HandleFunc("/account/vacation", s.withAccount(s.handleAccountVacation))
+
 	// Build middleware chain (order matters: innermost first, then wrapping outward)
 	// The execution order will be: logging -> security headers -> panic recovery -> CSRF -> routes
 	handler := s.withCSRF(mux)
@@ -259,8 +336,20 @@ type Stats struct {
 	QueueFailed    int
 	ServerUptime   string
 	RecentActivity []ActivityItem
+	DeliveryTrend  []DeliveryBucket
+}
+
+// DeliveryBucket counts the delivery attempts made in one hour
+type DeliveryBucket struct {
+	Hour      time.Time `json:"hour"`
+	Delivered int       `json:"delivered"`
+	Deferred  int       `json:"deferred"`
+	Bounced   int       `json:"bounced"`
 }
 
+// deliveryTrendHours is how many hourly buckets the dashboard shows
+const deliveryTrendHours = 24
+
 // ActivityItem represents a recent activity entry
 type ActivityItem struct {
 	Time        time.Time
@@ -323,9 +412,79 @@ func (s *Server) getStats(ctx context.Context) (*Stats, error) {
 		}
 	}
 
+	stats.DeliveryTrend, err = s.deliveryTrend(ctx, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
 	return stats, nil
 }
 
+// deliveryTrend counts the messages the delivery engine tried by outcome in
+// hourly buckets, oldest first, ending with the hour containing now. A
+// message counts once an hour, by the last attempt it had in that hour: one
+// without an error delivered, one refused with a 5xx reply bounced and any
+// other failure deferred.
+func (s *Server) deliveryTrend(ctx context.Context, now time.Time) ([]DeliveryBucket, error) {
+	end := now.UTC().Truncate(time.Hour)
+	since := end.Add(-(deliveryTrendHours - 1) * time.Hour)
+	buckets := make([]DeliveryBucket, deliveryTrendHours)
+	for i := range buckets {
+		buckets[i].Hour = since.Add(time.Duration(i) * time.Hour)
+	}
+
+	// created_at is compared as text, in the layout SQLite and the driver
+	// both write, so the index on it can be used
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT hour, status, COUNT(*)
+		FROM (
+			SELECT strftime('%Y-%m-%d %H', created_at) AS hour,
+			       CASE
+			           WHEN error_message IS NULL THEN 'delivered'
+			           WHEN smtp_code >= 500 THEN 'bounced'
+			           ELSE 'deferred'
+			       END AS status,
+			       ROW_NUMBER() OVER (
+			           PARTITION BY message_id, strftime('%Y-%m-%d %H', created_at)
+			           ORDER BY created_at DESC, id DESC
+			       ) AS latest
+			FROM delivery_attempts
+			WHERE created_at >= ?
+		)
+		WHERE latest = 1
+		GROUP BY hour, status
+	`, since.Format("2006-01-02 15:04:05"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query delivery trend: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var hour, status string
+		var count int
+		if err := rows.Scan(&hour, &status, &count); err != nil {
+			return nil, fmt.Errorf("failed to scan delivery trend: %w", err)
+		}
+		t, err := time.Parse("2006-01-02 15", hour)
+		if err != nil {
+			continue
+		}
+		i := int(t.Sub(since) / time.Hour)
+		if i < 0 || i >= len(buckets) {
+			continue
+		}
+		switch status {
+		case "delivered":
+			buckets[i].Delivered += count
+		case "deferred":
+			buckets[i].Deferred += count
+		case "bounced":
+			buckets[i].Bounced += count
+		}
+	}
+	return buckets, rows.Err()
+}
+
 // renderTemplate renders a template with the given data
 func (s *Server) renderTemplate(w http.ResponseWriter, name string, data map[string]interface{}) {
 	if data == nil {
@@ -11,18 +11,26 @@ import (
 type EventType string
 
 const (
-	EventUserCreate       EventType = "user.create"
-	EventUserDelete       EventType = "user.delete"
-	EventUserUpdate       EventType = "user.update"
-	EventPasswordChange   EventType = "password.change"
-	EventDomainCreate     EventType = "domain.create"
-	EventDomainDelete     EventType = "domain.delete"
-	EventLoginSuccess     EventType = "login.success"
-	EventLoginFailure     EventType = "login.failure"
-	EventSieveUpdate      EventType = "sieve.update"
-	EventQueueRetry       EventType = "queue.retry"
-	EventQueueDelete      EventType = "queue.delete"
-	EventConfigChange     EventType = "config.change"
+	EventUserCreate        EventType = "user.create"
+	EventUserDelete        EventType = "user.delete"
+	EventUserUpdate        EventType = "user.update"
+	EventPasswordChange    EventType = "password.change"
+	EventAppPasswordCreate EventType = "app_password.create"
+	EventAppPasswordRevoke EventType = "app_password.revoke"
+	EventMessagesReindex   EventType = "messages.reindex"
+	EventDomainCreate      EventType = "domain.create"
+	EventDomainDelete      EventType = "domain.delete"
+	EventLoginSuccess      EventType = "login.success"
+	EventLoginFailure      EventType = "login.failure"
+	EventSieveUpdate       EventType = "sieve.update"
+	EventQueueRetry        EventType = "queue.retry"
+	EventQueueDelete       EventType = "queue.delete"
+	EventQueueRelease      EventType = "queue.release"
+	EventQueueReject       EventType = "queue.reject"
+	EventReputationClear   EventType = "reputation.clear"
+	EventAccessRuleSet     EventType = "access.set"
+	EventAccessRuleRemove  EventType = "access.remove"
+	EventConfigChange      EventType = "config.change"
 )
 
 // Event represents an audit log entry
@@ -8,6 +8,11 @@ import (
 	"regexp"
 	"strings"
 	"time"
+
+	"github.com/fenilsonani/email-server/internal/storage/metadata"
+	"github.com/fenilsonani/email-server/internal/validation"
+	"golang.org/x/net/idna"
+	"golang.org/x/text/unicode/norm"
 )
 
 var (
@@ -25,6 +30,10 @@ var (
 	ErrInvalidPassword = errors.New("invalid password: must be 8-128 characters")
 	// ErrInvalidDomain is returned when domain name is invalid
 	ErrInvalidDomain = errors.New("invalid domain: must be valid domain name")
+	// ErrUserExists is returned when creating a user whose address is taken
+	ErrUserExists = errors.New("user already exists")
+	// ErrDomainExists is returned when creating a domain that is already managed
+	ErrDomainExists = errors.New("domain already exists")
 )
 
 const (
@@ -41,10 +50,10 @@ const (
 )
 
 var (
-	// RFC 5321 compliant local-part pattern (simplified for common use cases)
-	// Allows: alphanumeric, dot, hyphen, underscore, plus
+	// RFC 5321/6531 compliant local-part pattern (simplified for common use cases)
+	// Allows: letters and digits in any script, combining marks, dot, hyphen, underscore, plus
 	// Does not allow: leading/trailing dots, consecutive dots
-	usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9._+-]*[a-zA-Z0-9])?$`)
+	usernamePattern = regexp.MustCompile(`^[\p{L}\p{N}]([\p{L}\p{N}\p{M}._+-]*[\p{L}\p{N}\p{M}])?$`)
 
 	// RFC 1035 compliant domain name pattern
 	// Labels: 1-63 chars, alphanumeric and hyphen, not starting/ending with hyphen
@@ -62,13 +71,17 @@ type User struct {
 	QuotaBytes  int64
 	UsedBytes   int64
 	IsActive    bool
+	CanSend     bool // May submit outbound mail
+	CanReceive  bool // Accepts inbound mail
 	CreatedAt   time.Time
 	UpdatedAt   time.Time
 }
 
 // Authenticator provides user authentication and lookup
 type Authenticator struct {
-	db *sql.DB
+	db      *sql.DB
+	roles   RoleRoutes
+	authLog *AuthLog
 }
 
 // NewAuthenticator creates a new Authenticator with the given database
@@ -76,12 +89,20 @@ func NewAuthenticator(db *sql.DB) *Authenticator {
 	return &Authenticator{db: db}
 }
 
-// Authenticate validates credentials and returns user info
+// Authenticate validates credentials and returns user info. Only the main
+// password is accepted; mail clients log in through AuthenticateClient,
+// which also accepts application passwords.
 // NOTE: Rate limiting should be implemented at the HTTP/SMTP layer to prevent brute force attacks.
 // Recommended approach: Use middleware with token bucket or sliding window algorithm.
 // Example: Limit to 5 failed attempts per IP per 15 minutes, with exponential backoff.
 // Consider implementing account lockout after 10 failed attempts within 1 hour.
 func (a *Authenticator) Authenticate(ctx context.Context, email, password string) (*User, error) {
+	return a.authenticate(ctx, email, password, false)
+}
+
+// authenticate validates credentials against the main password and, when
+// appPasswords is set, the user's application passwords
+func (a *Authenticator) authenticate(ctx context.Context, email, password string, appPasswords bool) (*User, error) {
 	// Basic email parsing (no password validation yet to avoid timing attacks)
 	username, domain, err := parseEmail(email)
 	if err != nil {
@@ -103,6 +124,17 @@ func (a *Authenticator) Authenticate(ctx context.Context, email, password string
 		return nil, ErrUserDisabled
 	}
 
+	// App passwords are a cheap indexed lookup, so try them before argon2
+	if appPasswords {
+		ok, err := a.checkAppPassword(ctx, user.ID, password)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return user, nil
+		}
+	}
+
 	// Now validate password length (do this before expensive hash verification)
 	if err := ValidatePassword(password); err != nil {
 		return nil, ErrInvalidCredentials // Don't leak validation details
@@ -138,7 +170,8 @@ func (a *Authenticator) LookupUser(ctx context.Context, email string) (*User, er
 func (a *Authenticator) LookupUserByID(ctx context.Context, id int64) (*User, error) {
 	query := `
 		SELECT u.id, u.domain_id, u.username, d.name, u.display_name,
-		       u.quota_bytes, u.used_bytes, u.is_active, u.created_at, u.updated_at
+		       u.quota_bytes, u.used_bytes, u.is_active, u.can_send, u.can_receive,
+		       u.created_at, u.updated_at
 		FROM users u
 		JOIN domains d ON u.domain_id = d.id
 		WHERE u.id = ?
@@ -149,7 +182,7 @@ func (a *Authenticator) LookupUserByID(ctx context.Context, id int64) (*User, er
 	err := a.db.QueryRowContext(ctx, query, id).Scan(
 		&user.ID, &user.DomainID, &user.Username, &user.Domain,
 		&displayName, &user.QuotaBytes, &user.UsedBytes,
-		&user.IsActive, &user.CreatedAt, &user.UpdatedAt,
+		&user.IsActive, &user.CanSend, &user.CanReceive, &user.CreatedAt, &user.UpdatedAt,
 	)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -206,7 +239,8 @@ func (a *Authenticator) ValidateAddress(ctx context.Context, email string) (bool
 		return true, nil
 	}
 	if errors.Is(err, sql.ErrNoRows) {
-		return false, nil
+		// postmaster@ and abuse@ accept mail even without a user or alias
+		return a.roleDestination(username, domain) != "", nil
 	}
 	return false, fmt.Errorf("failed to query alias %s@%s: %w", username, domain, err)
 }
@@ -219,6 +253,16 @@ func (a *Authenticator) ResolveAlias(ctx context.Context, email string) (userID
 		return nil, nil, fmt.Errorf("invalid email format: %w", err)
 	}
 
+	userID, external, err = a.lookupAlias(ctx, username, domain)
+	if err != nil || userID != nil || external != nil {
+		return userID, external, err
+	}
+	return a.resolveRole(ctx, username, domain)
+}
+
+// lookupAlias returns the destination of an active alias, or nil for both
+// when there is none
+func (a *Authenticator) lookupAlias(ctx context.Context, username, domain string) (userID *int64, external *string, err error) {
 	query := `
 		SELECT a.destination_user_id, a.destination_external
 		FROM aliases a
@@ -248,12 +292,16 @@ func (a *Authenticator) ResolveAlias(ctx context.Context, email string) (userID
 // GetDomainID returns the ID for a domain name
 func (a *Authenticator) GetDomainID(ctx context.Context, name string) (int64, error) {
 	// Validate domain name format
+	name, err := NormalizeDomain(name)
+	if err != nil {
+		return 0, err
+	}
 	if err := ValidateDomain(name); err != nil {
 		return 0, err
 	}
 
 	var id int64
-	err := a.db.QueryRowContext(ctx,
+	err = a.db.QueryRowContext(ctx,
 		"SELECT id FROM domains WHERE name = ? AND is_active = TRUE",
 		name,
 	).Scan(&id)
@@ -266,6 +314,30 @@ func (a *Authenticator) GetDomainID(ctx context.Context, name string) (int64, er
 	return id, nil
 }
 
+// CreateDomain adds a domain to those mail is accepted for, signed with
+// the DKIM selector "mail", and returns its ID
+func (a *Authenticator) CreateDomain(ctx context.Context, name string) (int64, error) {
+	name, err := NormalizeDomain(name)
+	if err != nil {
+		return 0, err
+	}
+	if err := ValidateDomain(name); err != nil {
+		return 0, err
+	}
+
+	result, err := a.db.ExecContext(ctx,
+		"INSERT INTO domains (name, dkim_selector) VALUES (?, ?)",
+		name, "mail",
+	)
+	if metadata.IsUniqueViolation(err) {
+		return 0, fmt.Errorf("%w: %s", ErrDomainExists, name)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to add domain %s: %w", name, err)
+	}
+	return result.LastInsertId()
+}
+
 // CreateUser creates a new user account with full validation and transaction support
 func (a *Authenticator) CreateUser(ctx context.Context, username, password string, domainID int64) (*User, error) {
 	// Validate username format
@@ -278,8 +350,8 @@ func (a *Authenticator) CreateUser(ctx context.Context, username, password strin
 		return nil, err
 	}
 
-	// Normalize username to lowercase for consistency
-	username = strings.ToLower(strings.TrimSpace(username))
+	// Normalize username so UTF-8 local parts compare consistently
+	username = NormalizeLocalPart(username)
 
 	// Begin transaction for atomicity
 	tx, err := a.db.BeginTx(ctx, nil)
@@ -310,6 +382,9 @@ func (a *Authenticator) CreateUser(ctx context.Context, username, password strin
 		VALUES (?, ?, ?, TRUE, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
 	`, domainID, username, passwordHash)
 	if err != nil {
+		if metadata.IsUniqueViolation(err) {
+			return nil, fmt.Errorf("%w: %s@%s", ErrUserExists, username, domainName)
+		}
 		return nil, fmt.Errorf("failed to create user %s@%s: %w", username, domainName, err)
 	}
 
@@ -324,12 +399,14 @@ func (a *Authenticator) CreateUser(ctx context.Context, username, password strin
 	}
 
 	return &User{
-		ID:       id,
-		DomainID: domainID,
-		Username: username,
-		Domain:   domainName,
-		Email:    fmt.Sprintf("%s@%s", username, domainName),
-		IsActive: true,
+		ID:         id,
+		DomainID:   domainID,
+		Username:   username,
+		Domain:     domainName,
+		Email:      fmt.Sprintf("%s@%s", username, domainName),
+		IsActive:   true,
+		CanSend:    true,
+		CanReceive: true,
 	}, nil
 }
 
@@ -363,11 +440,76 @@ func (a *Authenticator) UpdatePassword(ctx context.Context, userID int64, passwo
 	return nil
 }
 
+// SetPermissions enables or disables sending and receiving for a user
+func (a *Authenticator) SetPermissions(ctx context.Context, userID int64, canSend, canReceive bool) error {
+	result, err := a.db.ExecContext(ctx, `
+		UPDATE users SET can_send = ?, can_receive = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?
+	`, canSend, canReceive, userID)
+	if err != nil {
+		return fmt.Errorf("failed to update permissions for user id %d: %w", userID, err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if affected == 0 {
+		return ErrUserNotFound
+	}
+
+	return nil
+}
+
+// SetAdmin grants or revokes a user's access to the admin interface
+func (a *Authenticator) SetAdmin(ctx context.Context, userID int64, admin bool) error {
+	result, err := a.db.ExecContext(ctx, `
+		UPDATE users SET is_admin = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?
+	`, admin, userID)
+	if err != nil {
+		return fmt.Errorf("failed to update admin access for user id %d: %w", userID, err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if affected == 0 {
+		return ErrUserNotFound
+	}
+
+	return nil
+}
+
+// CanReceive reports whether mail for a local address may be delivered.
+// Aliases and role addresses are followed to their destination user;
+// external forwards are always accepted.
+func (a *Authenticator) CanReceive(ctx context.Context, email string) (bool, error) {
+	userID, external, err := a.ResolveAlias(ctx, email)
+	if err != nil {
+		return false, err
+	}
+	if external != nil {
+		return true, nil
+	}
+
+	var user *User
+	if userID != nil {
+		user, err = a.LookupUserByID(ctx, *userID)
+	} else {
+		user, err = a.LookupUser(ctx, email)
+	}
+	if err != nil {
+		return false, err
+	}
+	return user.CanReceive, nil
+}
+
 // lookupUserWithPassword retrieves user info including password hash
 func (a *Authenticator) lookupUserWithPassword(ctx context.Context, username, domain string) (*User, string, error) {
 	query := `
 		SELECT u.id, u.domain_id, u.username, d.name, u.password_hash, u.display_name,
-		       u.quota_bytes, u.used_bytes, u.is_active, u.created_at, u.updated_at
+		       u.quota_bytes, u.used_bytes, u.is_active, u.can_send, u.can_receive,
+		       u.created_at, u.updated_at
 		FROM users u
 		JOIN domains d ON u.domain_id = d.id
 		WHERE d.name = ? AND u.username = ?
@@ -380,7 +522,7 @@ func (a *Authenticator) lookupUserWithPassword(ctx context.Context, username, do
 	err := a.db.QueryRowContext(ctx, query, domain, username).Scan(
 		&user.ID, &user.DomainID, &user.Username, &user.Domain,
 		&passwordHash, &displayName, &user.QuotaBytes, &user.UsedBytes,
-		&user.IsActive, &user.CreatedAt, &user.UpdatedAt,
+		&user.IsActive, &user.CanSend, &user.CanReceive, &user.CreatedAt, &user.UpdatedAt,
 	)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -402,8 +544,11 @@ func parseEmail(email string) (username, domain string, err error) {
 		return "", "", fmt.Errorf("invalid email address: %s", email)
 	}
 
-	username = parts[0]
-	domain = parts[1]
+	username = NormalizeLocalPart(parts[0])
+	domain, err = NormalizeDomain(parts[1])
+	if err != nil {
+		return "", "", fmt.Errorf("invalid email address: %w", err)
+	}
 
 	// Validate components
 	if err := ValidateUsername(username); err != nil {
@@ -416,6 +561,27 @@ func parseEmail(email string) (username, domain string, err error) {
 	return username, domain, nil
 }
 
+// NormalizeLocalPart lowercases a local part and puts it in Unicode NFC form,
+// so SMTPUTF8 addresses match however the client composed them
+func NormalizeLocalPart(username string) string {
+	return norm.NFC.String(strings.ToLower(strings.TrimSpace(username)))
+}
+
+// NormalizeDomain converts a domain to its lowercase ASCII (A-label) form.
+// Domains are stored as A-labels, so both "exämple.de" and "xn--exmple-cua.de"
+// resolve to the same domain.
+func NormalizeDomain(domain string) (string, error) {
+	domain = strings.TrimSpace(strings.ToLower(domain))
+	if validation.IsASCII(domain) {
+		return domain, nil
+	}
+	ascii, err := idna.Lookup.ToASCII(domain)
+	if err != nil {
+		return "", ErrInvalidDomain
+	}
+	return ascii, nil
+}
+
 // validateUsername is an internal helper for validation
 func validateUsername(username string) error {
 	return ValidateUsername(username)
@@ -484,16 +650,6 @@ func ValidateDomain(domain string) error {
 	return nil
 }
 
-// UpdateUsedBytes updates the used_bytes value for a user
-// delta can be positive (increase) or negative (decrease)
-func (a *Authenticator) UpdateUsedBytes(ctx context.Context, userID int64, delta int64) error {
-	_, err := a.db.ExecContext(ctx,
-		"UPDATE users SET used_bytes = MAX(0, used_bytes + ?) WHERE id = ?",
-		delta, userID,
-	)
-	return err
-}
-
 // GetQuotaStatus returns the user's quota and used bytes
 func (a *Authenticator) GetQuotaStatus(ctx context.Context, userID int64) (quotaBytes, usedBytes int64, err error) {
 	err = a.db.QueryRowContext(ctx,
@@ -3,7 +3,9 @@ package auth
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"os"
+	"strings"
 	"testing"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -43,6 +45,8 @@ func setupTestDB(t *testing.T) (*sql.DB, func()) {
 			quota_bytes INTEGER DEFAULT 1073741824,
 			used_bytes INTEGER DEFAULT 0,
 			is_active BOOLEAN DEFAULT TRUE,
+			can_send BOOLEAN NOT NULL DEFAULT TRUE,
+			can_receive BOOLEAN NOT NULL DEFAULT TRUE,
 			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 			UNIQUE(domain_id, username)
@@ -58,6 +62,15 @@ func setupTestDB(t *testing.T) (*sql.DB, func()) {
 			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 			UNIQUE(domain_id, source_address)
 		);
+
+		CREATE TABLE app_passwords (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			name TEXT NOT NULL,
+			password_hash TEXT NOT NULL UNIQUE,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			last_used_at DATETIME
+		);
 	`
 
 	if _, err := db.Exec(schema); err != nil {
@@ -275,6 +288,40 @@ func TestAuthenticator_LookupUser(t *testing.T) {
 	}
 }
 
+func TestAuthenticator_InternationalizedAddress(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	auth := NewAuthenticator(db)
+	ctx := context.Background()
+
+	_, err := db.Exec("INSERT INTO domains (name) VALUES (?)", "xn--exmple-cua.de")
+	if err != nil {
+		t.Fatalf("Failed to create domain: %v", err)
+	}
+
+	domainID, err := auth.GetDomainID(ctx, "exämple.de")
+	if err != nil {
+		t.Fatalf("GetDomainID with U-label failed: %v", err)
+	}
+
+	// Decomposed input is stored in NFC form
+	if _, err := auth.CreateUser(ctx, "Mu\u0308ller", "password123", domainID); err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+
+	for _, addr := range []string{"müller@exämple.de", "MÜLLER@xn--exmple-cua.de", "mu\u0308ller@exämple.de"} {
+		user, err := auth.LookupUser(ctx, addr)
+		if err != nil {
+			t.Errorf("LookupUser(%q) failed: %v", addr, err)
+			continue
+		}
+		if user.Username != "müller" {
+			t.Errorf("LookupUser(%q) username = %q, want müller", addr, user.Username)
+		}
+	}
+}
+
 func TestAuthenticator_DisabledUser(t *testing.T) {
 	db, cleanup := setupTestDB(t)
 	defer cleanup()
@@ -380,88 +427,6 @@ func TestAuthenticator_Aliases(t *testing.T) {
 	}
 }
 
-func TestAuthenticator_UpdateUsedBytes(t *testing.T) {
-	db, cleanup := setupTestDB(t)
-	defer cleanup()
-
-	auth := NewAuthenticator(db)
-	ctx := context.Background()
-
-	// Create test domain and user
-	_, err := db.Exec("INSERT INTO domains (name) VALUES (?)", "example.com")
-	if err != nil {
-		t.Fatalf("Failed to create domain: %v", err)
-	}
-
-	hash, _ := HashPassword("test")
-	result, err := db.Exec(
-		"INSERT INTO users (domain_id, username, password_hash, quota_bytes, used_bytes) VALUES (1, ?, ?, 1073741824, 0)",
-		"testuser", hash,
-	)
-	if err != nil {
-		t.Fatalf("Failed to create user: %v", err)
-	}
-	userID, _ := result.LastInsertId()
-
-	// Test increasing used bytes
-	err = auth.UpdateUsedBytes(ctx, userID, 1000)
-	if err != nil {
-		t.Fatalf("UpdateUsedBytes failed: %v", err)
-	}
-
-	// Verify the change
-	var usedBytes int64
-	err = db.QueryRow("SELECT used_bytes FROM users WHERE id = ?", userID).Scan(&usedBytes)
-	if err != nil {
-		t.Fatalf("Failed to query used_bytes: %v", err)
-	}
-	if usedBytes != 1000 {
-		t.Errorf("Expected used_bytes=1000, got %d", usedBytes)
-	}
-
-	// Test adding more
-	err = auth.UpdateUsedBytes(ctx, userID, 500)
-	if err != nil {
-		t.Fatalf("UpdateUsedBytes (add more) failed: %v", err)
-	}
-
-	err = db.QueryRow("SELECT used_bytes FROM users WHERE id = ?", userID).Scan(&usedBytes)
-	if err != nil {
-		t.Fatalf("Failed to query used_bytes: %v", err)
-	}
-	if usedBytes != 1500 {
-		t.Errorf("Expected used_bytes=1500, got %d", usedBytes)
-	}
-
-	// Test decreasing used bytes
-	err = auth.UpdateUsedBytes(ctx, userID, -500)
-	if err != nil {
-		t.Fatalf("UpdateUsedBytes (decrease) failed: %v", err)
-	}
-
-	err = db.QueryRow("SELECT used_bytes FROM users WHERE id = ?", userID).Scan(&usedBytes)
-	if err != nil {
-		t.Fatalf("Failed to query used_bytes: %v", err)
-	}
-	if usedBytes != 1000 {
-		t.Errorf("Expected used_bytes=1000 after decrease, got %d", usedBytes)
-	}
-
-	// Test that used_bytes can't go negative
-	err = auth.UpdateUsedBytes(ctx, userID, -5000)
-	if err != nil {
-		t.Fatalf("UpdateUsedBytes (large decrease) failed: %v", err)
-	}
-
-	err = db.QueryRow("SELECT used_bytes FROM users WHERE id = ?", userID).Scan(&usedBytes)
-	if err != nil {
-		t.Fatalf("Failed to query used_bytes: %v", err)
-	}
-	if usedBytes != 0 {
-		t.Errorf("Expected used_bytes=0 (not negative), got %d", usedBytes)
-	}
-}
-
 func TestAuthenticator_GetQuotaStatus(t *testing.T) {
 	db, cleanup := setupTestDB(t)
 	defer cleanup()
@@ -596,3 +561,105 @@ func TestAuthenticator_QuotaFieldsInUser(t *testing.T) {
 		t.Errorf("LookupUser: Expected UsedBytes=1073741824, got %d", user.UsedBytes)
 	}
 }
+
+func TestAuthenticator_CreateUserDuplicate(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	auth := NewAuthenticator(db)
+	ctx := context.Background()
+
+	if _, err := db.Exec("INSERT INTO domains (name) VALUES (?)", "example.com"); err != nil {
+		t.Fatalf("Failed to create domain: %v", err)
+	}
+	if _, err := auth.CreateUser(ctx, "alice", "password123", 1); err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+
+	_, err := auth.CreateUser(ctx, "alice", "password456", 1)
+	if !errors.Is(err, ErrUserExists) {
+		t.Fatalf("CreateUser() duplicate error = %v, want ErrUserExists", err)
+	}
+	if err.Error() != "user already exists: alice@example.com" {
+		t.Errorf("error = %q, want the offending address", err.Error())
+	}
+}
+
+func TestAuthenticator_AppPasswords(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	a := NewAuthenticator(db)
+	ctx := context.Background()
+
+	if _, err := db.Exec("INSERT INTO domains (name) VALUES ('example.com')"); err != nil {
+		t.Fatalf("Failed to create domain: %v", err)
+	}
+	user, err := a.CreateUser(ctx, "alice", "password123", 1)
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+
+	password, appPassword, err := a.CreateAppPassword(ctx, user.ID, "Phone")
+	if err != nil {
+		t.Fatalf("CreateAppPassword() error = %v", err)
+	}
+	if len(password) != 19 || strings.Count(password, "-") != 3 {
+		t.Errorf("app password = %q, want xxxx-xxxx-xxxx-xxxx", password)
+	}
+
+	if _, err := a.AuthenticateClient(ctx, "alice@example.com", password); err != nil {
+		t.Errorf("AuthenticateClient() with app password error = %v", err)
+	}
+	compact := strings.ToUpper(strings.ReplaceAll(password, "-", ""))
+	if _, err := a.AuthenticateClient(ctx, "alice@example.com", compact); err != nil {
+		t.Errorf("AuthenticateClient() with %q error = %v", compact, err)
+	}
+	if _, err := a.AuthenticateClient(ctx, "alice@example.com", "password123"); err != nil {
+		t.Errorf("AuthenticateClient() with main password error = %v", err)
+	}
+	if _, err := a.Authenticate(ctx, "alice@example.com", password); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("Authenticate() with app password error = %v, want ErrInvalidCredentials", err)
+	}
+
+	// A recent last-used time isn't rewritten on every login, a stale one is
+	lastUsed := func() string {
+		var s string
+		db.QueryRow("SELECT last_used_at FROM app_passwords WHERE id = ?", appPassword.ID).Scan(&s)
+		return s
+	}
+	for _, tc := range []struct {
+		set     string
+		changed bool
+	}{
+		{"datetime('now', '-1 minute')", false},
+		{"'2000-01-01 00:00:00'", true},
+	} {
+		db.Exec("UPDATE app_passwords SET last_used_at = "+tc.set+" WHERE id = ?", appPassword.ID)
+		before := lastUsed()
+		if _, err := a.AuthenticateClient(ctx, "alice@example.com", password); err != nil {
+			t.Fatalf("AuthenticateClient() error = %v", err)
+		}
+		if after := lastUsed(); (after != before) != tc.changed {
+			t.Errorf("last_used_at %s became %s, want changed = %v", before, after, tc.changed)
+		}
+	}
+
+	passwords, err := a.ListAppPasswords(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("ListAppPasswords() error = %v", err)
+	}
+	if len(passwords) != 1 || passwords[0].Name != "Phone" || passwords[0].LastUsedAt == nil {
+		t.Fatalf("ListAppPasswords() = %+v, want Phone with a last-used time", passwords)
+	}
+
+	if err := a.RevokeAppPassword(ctx, user.ID, appPassword.ID); err != nil {
+		t.Fatalf("RevokeAppPassword() error = %v", err)
+	}
+	if _, err := a.AuthenticateClient(ctx, "alice@example.com", password); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("AuthenticateClient() after revoke error = %v, want ErrInvalidCredentials", err)
+	}
+	if err := a.RevokeAppPassword(ctx, user.ID, appPassword.ID); !errors.Is(err, ErrAppPasswordNotFound) {
+		t.Errorf("RevokeAppPassword() twice error = %v, want ErrAppPasswordNotFound", err)
+	}
+}
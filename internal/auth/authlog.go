@@ -0,0 +1,240 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fenilsonani/email-server/internal/validation"
+)
+
+// Every protocol records its login attempts in auth_log through AuthLog, so
+// the admin panel sees SMTP, IMAP, DAV, JMAP and web logins alike. Writing a
+// row per attempt inside the login would put a database write on the hot
+// path, and a password-guessing client could turn that into a write storm,
+// so attempts are queued and written in batches by a single goroutine.
+//
+// DAV and JMAP clients authenticate every request, so a success is only
+// written the first time the user logs in over a protocol from an address
+// in authLogSuccessInterval. Every failure is written.
+
+const (
+	authLogQueueSize = 1024 // Attempts waiting to be written before new ones are dropped
+	authLogBatchSize = 100  // Most attempts written in one transaction
+
+	authLogSuccessInterval = time.Hour // Repeat successes within this are not written
+	authLogSeenLimit       = 10000     // Successes remembered before expired ones are forgotten
+)
+
+// AuthEvent is one login attempt
+type AuthEvent struct {
+	UserID     int64  // 0 when the attempt matched no user
+	Username   string // As the client gave it
+	RemoteAddr string
+	Protocol   string // smtp, imap, dav, jmap or web
+	Success    bool
+	Reason     string // Why a failed attempt failed
+}
+
+// AuthLog writes login attempts to the auth_log table in the background
+type AuthLog struct {
+	db      *sql.DB
+	events  chan AuthEvent
+	dropped atomic.Int64
+	batches atomic.Int64 // Transactions written, for tests
+
+	mu     sync.RWMutex
+	closed bool
+	done   chan struct{}
+
+	seenMu sync.Mutex
+	seen   map[string]time.Time // Last success written by user, protocol and host
+}
+
+// NewAuthLog creates an AuthLog and starts its writer. Close flushes it.
+func NewAuthLog(db *sql.DB) *AuthLog {
+	l := newAuthLog(db)
+	go l.run()
+	return l
+}
+
+func newAuthLog(db *sql.DB) *AuthLog {
+	return &AuthLog{
+		db:     db,
+		events: make(chan AuthEvent, authLogQueueSize),
+		done:   make(chan struct{}),
+		seen:   make(map[string]time.Time),
+	}
+}
+
+// Record queues a login attempt to be written. It never blocks: when the
+// queue is full the attempt is dropped, and the number dropped is logged
+// with the next batch. A success repeating one written recently is skipped.
+func (l *AuthLog) Record(ev AuthEvent) {
+	if l == nil {
+		return
+	}
+	if ev.Success && l.seenRecently(ev, time.Now()) {
+		return
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return
+	}
+	select {
+	case l.events <- ev:
+	default:
+		l.dropped.Add(1)
+	}
+}
+
+// seenRecently reports whether a success like ev was recorded within
+// authLogSuccessInterval of now, and notes ev as recorded when it wasn't
+func (l *AuthLog) seenRecently(ev AuthEvent, now time.Time) bool {
+	host := ev.RemoteAddr
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	key := fmt.Sprintf("%d|%s|%s|%s", ev.UserID, ev.Username, ev.Protocol, host)
+
+	l.seenMu.Lock()
+	defer l.seenMu.Unlock()
+	if last, ok := l.seen[key]; ok && now.Sub(last) < authLogSuccessInterval {
+		return true
+	}
+	if len(l.seen) >= authLogSeenLimit {
+		for k, last := range l.seen {
+			if now.Sub(last) >= authLogSuccessInterval {
+				delete(l.seen, k)
+			}
+		}
+		if len(l.seen) >= authLogSeenLimit {
+			clear(l.seen)
+		}
+	}
+	l.seen[key] = now
+	return false
+}
+
+// Close writes the attempts still queued and stops the writer
+func (l *AuthLog) Close() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	if !l.closed {
+		l.closed = true
+		close(l.events)
+	}
+	l.mu.Unlock()
+	<-l.done
+}
+
+// run writes queued attempts until the queue is closed. Whatever is queued
+// when it wakes goes into the same transaction, so batches grow with load.
+func (l *AuthLog) run() {
+	defer close(l.done)
+
+	batch := make([]AuthEvent, 0, authLogBatchSize)
+	for ev := range l.events {
+		batch = append(batch[:0], ev)
+	drain:
+		for len(batch) < authLogBatchSize {
+			select {
+			case ev, ok := <-l.events:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, ev)
+			default:
+				break drain
+			}
+		}
+
+		if err := l.write(batch); err != nil {
+			log.Printf("auth: failed to write %d auth log entries: %v", len(batch), err)
+		}
+		if n := l.dropped.Swap(0); n > 0 {
+			log.Printf("auth: auth log queue full, dropped %d entries", n)
+		}
+	}
+}
+
+// PruneAuthLog deletes the login attempts recorded before t, returning how
+// many went
+func PruneAuthLog(ctx context.Context, db *sql.DB, t time.Time) (int64, error) {
+	result, err := db.ExecContext(ctx, "DELETE FROM auth_log WHERE created_at < ?", t.UTC().Format(time.DateTime))
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune auth log: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// write inserts a batch of attempts in one transaction
+func (l *AuthLog) write(batch []AuthEvent) error {
+	tx, err := l.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(
+		`INSERT INTO auth_log (user_id, username, remote_addr, protocol, success, failure_reason)
+		 VALUES (?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, ev := range batch {
+		var userID, reason any
+		if ev.UserID != 0 {
+			userID = ev.UserID
+		}
+		if !ev.Success && ev.Reason != "" {
+			reason = validation.Truncate(ev.Reason, validation.MaxExternalStringLength)
+		}
+		if _, err := stmt.Exec(userID,
+			validation.Truncate(ev.Username, validation.MaxExternalStringLength),
+			ev.RemoteAddr, ev.Protocol, ev.Success, reason,
+		); err != nil {
+			return fmt.Errorf("failed to insert: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	l.batches.Add(1)
+	return nil
+}
+
+// SetAuthLog makes RecordAuth write login attempts to l
+func (a *Authenticator) SetAuthLog(l *AuthLog) {
+	a.authLog = l
+}
+
+// RecordAuth records the outcome of a login attempt in the auth log, if one
+// is set: user on success, or the error that refused it
+func (a *Authenticator) RecordAuth(protocol, username, remoteAddr string, user *User, err error) {
+	if a == nil || a.authLog == nil {
+		return
+	}
+	ev := AuthEvent{
+		Username:   username,
+		RemoteAddr: remoteAddr,
+		Protocol:   protocol,
+		Success:    err == nil,
+	}
+	if err != nil {
+		ev.Reason = err.Error()
+	} else if user != nil {
+		ev.UserID = user.ID
+	}
+	a.authLog.Record(ev)
+}
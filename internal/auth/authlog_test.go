@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAuthLog_BatchesUnderLoad(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+	if _, err := db.Exec(`CREATE TABLE auth_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+		username TEXT NOT NULL,
+		remote_addr TEXT,
+		protocol TEXT NOT NULL,
+		success BOOLEAN NOT NULL,
+		failure_reason TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`); err != nil {
+		t.Fatalf("Failed to create auth_log: %v", err)
+	}
+
+	// Queue more attempts than fit before the writer starts, as a burst
+	// arriving faster than it can write would
+	l := newAuthLog(db)
+	for i := 0; i < authLogQueueSize+50; i++ {
+		l.Record(AuthEvent{Username: "mallory@example.com", RemoteAddr: "192.0.2.1:4000", Protocol: "smtp", Reason: "invalid credentials"})
+	}
+	if got := l.dropped.Load(); got != 50 {
+		t.Errorf("dropped = %d, want 50", got)
+	}
+	go l.run()
+	l.Close()
+	l.Record(AuthEvent{Username: "late@example.com", Protocol: "imap"}) // ignored after Close
+
+	var rows int
+	if err := db.QueryRow("SELECT COUNT(*) FROM auth_log WHERE protocol = 'smtp' AND NOT success").Scan(&rows); err != nil {
+		t.Fatalf("Failed to count auth_log: %v", err)
+	}
+	if rows != authLogQueueSize {
+		t.Errorf("auth_log rows = %d, want %d", rows, authLogQueueSize)
+	}
+	if got, want := l.batches.Load(), int64((authLogQueueSize+authLogBatchSize-1)/authLogBatchSize); got != want {
+		t.Errorf("batches = %d, want %d", got, want)
+	}
+}
+
+func TestAuthenticator_RecordAuth(t *testing.T) {
+	var a *Authenticator
+	a.RecordAuth("imap", "alice@example.com", "", nil, errors.New("refused")) // no auth log: ignored
+
+	l := newAuthLog(nil)
+	a = &Authenticator{authLog: l}
+	a.RecordAuth("imap", "alice@example.com", "192.0.2.1:4000", nil, errors.New("invalid credentials"))
+	a.RecordAuth("dav", "alice@example.com", "192.0.2.1:4001", &User{ID: 7}, nil)
+	a.RecordAuth("dav", "alice@example.com", "192.0.2.1:4002", &User{ID: 7}, nil) // same client again: skipped
+	a.RecordAuth("dav", "alice@example.com", "192.0.2.1:4003", nil, errors.New("invalid credentials"))
+	close(l.events)
+
+	want := []AuthEvent{
+		{Username: "alice@example.com", RemoteAddr: "192.0.2.1:4000", Protocol: "imap", Reason: "invalid credentials"},
+		{UserID: 7, Username: "alice@example.com", RemoteAddr: "192.0.2.1:4001", Protocol: "dav", Success: true},
+		{Username: "alice@example.com", RemoteAddr: "192.0.2.1:4003", Protocol: "dav", Reason: "invalid credentials"},
+	}
+	var got []AuthEvent
+	for ev := range l.events {
+		got = append(got, ev)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("recorded %d events, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("event %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestAuthLog_SuccessOncePerInterval(t *testing.T) {
+	l := newAuthLog(nil)
+	now := time.Now()
+	ev := AuthEvent{UserID: 7, Username: "alice@example.com", RemoteAddr: "192.0.2.1:4000", Protocol: "jmap", Success: true}
+
+	if l.seenRecently(ev, now) {
+		t.Error("first success seen recently")
+	}
+	ev.RemoteAddr = "192.0.2.1:5000"
+	if !l.seenRecently(ev, now.Add(time.Minute)) {
+		t.Error("repeat success from the same host not seen recently")
+	}
+	if l.seenRecently(AuthEvent{UserID: 7, Username: "alice@example.com", RemoteAddr: "192.0.2.2:4000", Protocol: "jmap", Success: true}, now) {
+		t.Error("success from another host seen recently")
+	}
+	if l.seenRecently(ev, now.Add(authLogSuccessInterval)) {
+		t.Error("success after the interval seen recently")
+	}
+}
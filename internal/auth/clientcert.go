@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Client certificates are pinned by fingerprint rather than verified against
+// a CA, so a mapping names exactly one certificate and revoking it is a
+// matter of deleting the row.
+
+// CertificateFingerprint returns the hex SHA-256 fingerprint of cert
+func CertificateFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// AddClientCertificate maps cert to the user, so presenting it over TLS
+// authenticates as them with SASL EXTERNAL
+func (a *Authenticator) AddClientCertificate(ctx context.Context, userID int64, cert *x509.Certificate) error {
+	_, err := a.db.ExecContext(ctx,
+		"INSERT INTO client_certificates (user_id, fingerprint, subject, not_after) VALUES (?, ?, ?, ?)",
+		userID, CertificateFingerprint(cert), cert.Subject.String(), cert.NotAfter,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to add client certificate: %w", err)
+	}
+	return nil
+}
+
+// AuthenticateCertificate returns the user a client certificate is mapped
+// to. It fails with ErrInvalidCredentials if the certificate is unknown or
+// outside its validity period, and ErrUserDisabled if the user is disabled.
+func (a *Authenticator) AuthenticateCertificate(ctx context.Context, cert *x509.Certificate) (*User, error) {
+	if cert == nil {
+		return nil, ErrInvalidCredentials
+	}
+	if now := time.Now(); now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return nil, ErrInvalidCredentials
+	}
+
+	var userID int64
+	err := a.db.QueryRowContext(ctx,
+		"SELECT user_id FROM client_certificates WHERE fingerprint = ?",
+		CertificateFingerprint(cert),
+	).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, fmt.Errorf("client certificate lookup failed: %w", err)
+	}
+
+	user, err := a.LookupUserByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !user.IsActive {
+		return nil, ErrUserDisabled
+	}
+	return user, nil
+}
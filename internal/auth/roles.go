@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// RFC 2142 role mailboxes that every managed domain must accept mail for
+const (
+	RolePostmaster = "postmaster"
+	RoleAbuse      = "abuse"
+)
+
+// RoleRoutes maps role mailboxes to the address that receives their mail
+// when no user or alias with that name exists in the domain
+type RoleRoutes struct {
+	Default map[string]string            // role -> destination, for every managed domain
+	Domains map[string]map[string]string // domain -> role -> destination, overrides Default
+}
+
+// SetRoleRoutes configures where postmaster@ and abuse@ are delivered.
+// Destinations may be local users, local aliases or external addresses.
+func (a *Authenticator) SetRoleRoutes(routes RoleRoutes) {
+	normalized := RoleRoutes{
+		Default: make(map[string]string, len(routes.Default)),
+		Domains: make(map[string]map[string]string, len(routes.Domains)),
+	}
+	for role, dest := range routes.Default {
+		if dest != "" {
+			normalized.Default[strings.ToLower(role)] = dest
+		}
+	}
+	for domain, roles := range routes.Domains {
+		name, err := NormalizeDomain(domain)
+		if err != nil {
+			continue
+		}
+		m := make(map[string]string, len(roles))
+		for role, dest := range roles {
+			if dest != "" {
+				m[strings.ToLower(role)] = dest
+			}
+		}
+		normalized.Domains[name] = m
+	}
+	a.roles = normalized
+}
+
+// roleDestination returns the configured destination for a role mailbox,
+// or "" when username is not a role or has no destination
+func (a *Authenticator) roleDestination(username, domain string) string {
+	if username != RolePostmaster && username != RoleAbuse {
+		return ""
+	}
+	if dest := a.roles.Domains[domain][username]; dest != "" {
+		return dest
+	}
+	return a.roles.Default[username]
+}
+
+// resolveRole routes mail for a role mailbox that has no alias. An existing
+// user of the same name keeps receiving its own mail.
+func (a *Authenticator) resolveRole(ctx context.Context, username, domain string) (userID *int64, external *string, err error) {
+	dest := a.roleDestination(username, domain)
+	if dest == "" {
+		return nil, nil, nil
+	}
+
+	var exists int
+	err = a.db.QueryRowContext(ctx,
+		`SELECT 1 FROM users u JOIN domains d ON u.domain_id = d.id
+		 WHERE d.name = ? AND u.username = ? AND u.is_active = TRUE`,
+		domain, username,
+	).Scan(&exists)
+	if err == nil {
+		return nil, nil, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, fmt.Errorf("failed to query user %s@%s: %w", username, domain, err)
+	}
+
+	user, err := a.LookupUser(ctx, dest)
+	if err == nil {
+		return &user.ID, nil, nil
+	}
+	if !errors.Is(err, ErrUserNotFound) {
+		return nil, nil, fmt.Errorf("failed to resolve %s@%s destination %s: %w", username, domain, dest, err)
+	}
+
+	destUser, destDomain, err := parseEmail(dest)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid %s@%s destination %s: %w", username, domain, dest, err)
+	}
+	userID, external, err = a.lookupAlias(ctx, destUser, destDomain)
+	if err != nil || userID != nil || external != nil {
+		return userID, external, err
+	}
+
+	// A local destination that doesn't exist would forward the message back
+	// to us, so treat it as misconfiguration rather than an external address
+	_, err = a.GetDomainID(ctx, destDomain)
+	if err == nil {
+		return nil, nil, fmt.Errorf("%s@%s destination %s: %w", username, domain, dest, ErrUserNotFound)
+	}
+	if !errors.Is(err, ErrDomainNotFound) {
+		return nil, nil, err
+	}
+	return nil, &dest, nil
+}
@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestAuthenticator_RoleRoutes(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	auth := NewAuthenticator(db)
+	ctx := context.Background()
+
+	for _, name := range []string{"example.com", "example.org"} {
+		if _, err := db.Exec("INSERT INTO domains (name) VALUES (?)", name); err != nil {
+			t.Fatalf("Failed to create domain: %v", err)
+		}
+	}
+	hash, _ := HashPassword("test")
+	result, err := db.Exec("INSERT INTO users (domain_id, username, password_hash) VALUES (1, 'admin', ?)", hash)
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	adminID, _ := result.LastInsertId()
+
+	// Without routes role addresses are ordinary unknown recipients
+	if valid, _ := auth.ValidateAddress(ctx, "postmaster@example.com"); valid {
+		t.Error("postmaster@ should be unknown without a configured destination")
+	}
+
+	auth.SetRoleRoutes(RoleRoutes{
+		Default: map[string]string{RolePostmaster: "admin@example.com", RoleAbuse: "admin@example.com"},
+		Domains: map[string]map[string]string{
+			"Example.ORG": {RoleAbuse: "abuse-desk@provider.example"},
+		},
+	})
+
+	for _, addr := range []string{"postmaster@example.com", "abuse@example.com", "postmaster@example.org"} {
+		valid, err := auth.ValidateAddress(ctx, addr)
+		if err != nil || !valid {
+			t.Errorf("ValidateAddress(%s) = %v, %v, want true", addr, valid, err)
+		}
+		userID, external, err := auth.ResolveAlias(ctx, addr)
+		if err != nil || userID == nil || *userID != adminID || external != nil {
+			t.Errorf("ResolveAlias(%s) = %v, %v, %v, want user %d", addr, userID, external, err, adminID)
+		}
+	}
+
+	// Per-domain override to an external address
+	_, external, err := auth.ResolveAlias(ctx, "abuse@example.org")
+	if err != nil || external == nil || *external != "abuse-desk@provider.example" {
+		t.Errorf("ResolveAlias(abuse@example.org) = %v, %v, want external override", external, err)
+	}
+
+	// Only role mailboxes and managed domains are affected
+	if valid, _ := auth.ValidateAddress(ctx, "webmaster@example.com"); valid {
+		t.Error("webmaster@ is not a role address")
+	}
+	if valid, _ := auth.ValidateAddress(ctx, "postmaster@unmanaged.example"); valid {
+		t.Error("postmaster@ of an unmanaged domain should be rejected")
+	}
+
+	// A real postmaster user keeps its own mail
+	result, err = db.Exec("INSERT INTO users (domain_id, username, password_hash) VALUES (2, 'postmaster', ?)", hash)
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	if userID, external, err := auth.ResolveAlias(ctx, "postmaster@example.org"); userID != nil || external != nil || err != nil {
+		t.Errorf("ResolveAlias(postmaster@example.org) = %v, %v, %v, want direct delivery", userID, external, err)
+	}
+
+	// A destination in a managed domain that doesn't exist is an error, not a forward
+	auth.SetRoleRoutes(RoleRoutes{Default: map[string]string{RolePostmaster: "nobody@example.com"}})
+	if _, _, err := auth.ResolveAlias(ctx, "postmaster@example.com"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("ResolveAlias with missing local destination error = %v, want ErrUserNotFound", err)
+	}
+}
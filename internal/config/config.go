@@ -1,18 +1,28 @@
 package config
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
 	"time"
 
+	"github.com/fenilsonani/email-server/internal/validation"
 	"github.com/knadh/koanf/parsers/yaml"
-	"github.com/knadh/koanf/providers/file"
 	"github.com/knadh/koanf/v2"
 )
 
 // Config holds all configuration for the mail server
 type Config struct {
+	ConfigVersion int `koanf:"config_version"` // Layout the file is written in; older files are upgraded when read
+
 	Server      ServerConfig      `koanf:"server"`
 	TLS         TLSConfig         `koanf:"tls"`
 	Storage     StorageConfig     `koanf:"storage"`
@@ -24,6 +34,15 @@ type Config struct {
 	Admin       AdminConfig       `koanf:"admin"`
 	Sieve       SieveConfig       `koanf:"sieve"`
 	Autodiscover AutodiscoverConfig `koanf:"autodiscover"`
+	JMAP         JMAPConfig         `koanf:"jmap"`
+	Push         PushConfig         `koanf:"push"`
+	Submission   SubmissionConfig   `koanf:"submission"`
+	IMAP         IMAPConfig         `koanf:"imap"`
+	SMTP         SMTPConfig         `koanf:"smtp"`
+	Welcome      WelcomeConfig      `koanf:"welcome"`
+	DNSCheck     DNSCheckConfig     `koanf:"dns_check"`
+
+	Warnings []string `koanf:"-"` // Changes made reading an older file, and insecure secret files
 }
 
 // ServerConfig holds server-related configuration
@@ -37,6 +56,9 @@ type ServerConfig struct {
 	IMAPSPort       int    `koanf:"imaps_port"`       // 993 for implicit TLS
 	DAVPort         int    `koanf:"dav_port"`         // 443 for CalDAV/CardDAV
 	ShutdownTimeout string `koanf:"shutdown_timeout"` // Graceful shutdown timeout
+
+	Postmaster string `koanf:"postmaster"` // Receives postmaster@ (and abuse@ unless set) for every domain
+	Abuse      string `koanf:"abuse"`      // Receives abuse@ for every domain
 }
 
 // TLSConfig holds TLS/ACME configuration
@@ -45,7 +67,75 @@ type TLSConfig struct {
 	Email    string `koanf:"email"`      // ACME account email
 	CertFile string `koanf:"cert_file"`  // Manual cert path
 	KeyFile  string `koanf:"key_file"`   // Manual key path
+	CertDir  string `koanf:"cert_dir"`   // Per-hostname certs chosen by SNI: <cert_dir>/<hostname>/{fullchain,privkey}.pem
 	CacheDir string `koanf:"cache_dir"`  // ACME cache directory
+
+	MinVersion   string   `koanf:"min_version"`   // Lowest protocol version accepted: 1.0, 1.1, 1.2 or 1.3
+	CipherSuites []string `koanf:"cipher_suites"` // TLS 1.2 suites by Go name; empty uses the modern defaults
+}
+
+// tlsVersions maps min_version values to protocol versions
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// modernCipherSuites are the TLS 1.2 suites used when none are configured:
+// forward secret AEAD suites only
+var modernCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+}
+
+// Version returns the minimum protocol version, TLS 1.2 when none is set
+func (t TLSConfig) Version() (uint16, error) {
+	if t.MinVersion == "" {
+		return tls.VersionTLS12, nil
+	}
+	v, ok := tlsVersions[t.MinVersion]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q (want 1.0, 1.1, 1.2 or 1.3)", t.MinVersion)
+	}
+	return v, nil
+}
+
+// Suites returns the IDs of the configured cipher suites, or the modern
+// defaults when none are set. Suites Go considers insecure are refused.
+// TLS 1.3 suites are not configurable and always enabled.
+func (t TLSConfig) Suites() ([]uint16, error) {
+	if len(t.CipherSuites) == 0 {
+		return append([]uint16(nil), modernCipherSuites...), nil
+	}
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+	ids := make([]uint16, 0, len(t.CipherSuites))
+	for _, name := range t.CipherSuites {
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// suitesBeforeTLS12 reports whether any of the suites can be negotiated
+// over TLS 1.0 or 1.1. The AEAD suites need TLS 1.2.
+func suitesBeforeTLS12(ids []uint16) bool {
+	for _, suite := range tls.CipherSuites() {
+		if slices.Contains(ids, suite.ID) && slices.Contains(suite.SupportedVersions, tls.VersionTLS11) {
+			return true
+		}
+	}
+	return false
 }
 
 // StorageConfig holds storage paths configuration
@@ -53,13 +143,93 @@ type StorageConfig struct {
 	DataDir      string `koanf:"data_dir"`      // Base data directory
 	DatabasePath string `koanf:"database_path"` // SQLite database path
 	MaildirPath  string `koanf:"maildir_path"`  // Maildir storage path
+
+	MinFreeBytes      int64  `koanf:"min_free_bytes"`      // Reject new mail (452) below this much free space
+	MinFreeInodes     int64  `koanf:"min_free_inodes"`     // Reject new mail (452) below this many free inodes
+	DiskCheckInterval string `koanf:"disk_check_interval"` // How often to poll free space
+
+	MaintenanceInterval    string `koanf:"maintenance_interval"`     // How often to vacuum the database and prune maildir tmp (empty = never)
+	QuotaRecomputeInterval string `koanf:"quota_recompute_interval"` // How often to correct used quota from message sizes (empty = never)
+
+	DefaultMailboxes []MailboxConfig `koanf:"default_mailboxes"` // Mailboxes created for every new user
+	MaxMailboxes     int             `koanf:"max_mailboxes"`     // Mailboxes per user (0 = unlimited)
+	MaxMailboxDepth  int             `koanf:"max_mailbox_depth"` // Levels in a mailbox name, e.g. 3 for a/b/c (0 = unlimited)
+	EnforceQuota     bool            `koanf:"enforce_quota"`     // Refuse IMAP APPEND past the user's quota with NO [OVERQUOTA]
+
+	BodyStore string   `koanf:"body_store"` // Where message bodies are kept: maildir or s3
+	S3        S3Config `koanf:"s3"`         // Bucket for body_store: s3
+}
+
+// S3Config describes an S3-compatible bucket for message bodies
+type S3Config struct {
+	Endpoint        string `koanf:"endpoint"`          // e.g. https://s3.eu-central-1.amazonaws.com
+	Region          string `koanf:"region"`            // Signing region
+	Bucket          string `koanf:"bucket"`            // Bucket name
+	Prefix          string `koanf:"prefix"`            // Prepended to every object key
+	AccessKeyID     string `koanf:"access_key_id"`     // Access key
+	SecretAccessKey string `koanf:"secret_access_key"` // Secret key
+	PathStyle       bool   `koanf:"path_style"`        // endpoint/bucket URLs, as MinIO needs
+
+	SecretAccessKeyFile string `koanf:"secret_access_key_file"` // File holding secret_access_key, e.g. a mounted secret
+}
+
+// MailboxConfig describes one mailbox in the default set
+type MailboxConfig struct {
+	Name       string `koanf:"name"`        // Display name, e.g. "Gesendet"
+	SpecialUse string `koanf:"special_use"` // RFC 6154 attribute, e.g. \Sent (optional)
+}
+
+// specialUseAttrs are the RFC 6154 attributes a default mailbox may carry
+var specialUseAttrs = []string{`\Drafts`, `\Sent`, `\Trash`, `\Junk`, `\Archive`, `\All`}
+
+// SpecialUseAttr returns the canonical special-use attribute, accepting
+// "sent", "Sent" or "\Sent". It returns "" when none is set or unknown.
+func (m MailboxConfig) SpecialUseAttr() string {
+	want := strings.TrimPrefix(m.SpecialUse, `\`)
+	for _, attr := range specialUseAttrs {
+		if strings.EqualFold(attr[1:], want) {
+			return attr
+		}
+	}
+	return ""
 }
 
 // DomainConfig holds per-domain configuration
 type DomainConfig struct {
-	Name         string `koanf:"name"`           // example.com
-	DKIMSelector string `koanf:"dkim_selector"`  // mail
-	DKIMKeyFile  string `koanf:"dkim_key_file"`  // Path to DKIM private key
+	Name         string          `koanf:"name"`          // example.com
+	DKIMSelector string          `koanf:"dkim_selector"` // mail; the selector that signs when dkim_keys lists several
+	DKIMKeyFile  string          `koanf:"dkim_key_file"` // Path to DKIM private key
+	DKIMKeys     []DKIMKeyConfig `koanf:"dkim_keys"`     // Further selectors, published but only signing when active
+	Postmaster   string          `koanf:"postmaster"`    // Overrides server.postmaster for this domain
+	Abuse        string          `koanf:"abuse"`         // Overrides server.abuse for this domain
+}
+
+// DKIMKeyConfig is one DKIM selector and its private key
+type DKIMKeyConfig struct {
+	Selector string `koanf:"selector"` // 2026
+	KeyFile  string `koanf:"key_file"` // Path to DKIM private key
+}
+
+// AllDKIMKeys returns every DKIM key of the domain: the dkim_selector and
+// dkim_key_file pair, if set, followed by dkim_keys
+func (d DomainConfig) AllDKIMKeys() []DKIMKeyConfig {
+	var keys []DKIMKeyConfig
+	if d.DKIMKeyFile != "" {
+		keys = append(keys, DKIMKeyConfig{Selector: d.DKIMSelector, KeyFile: d.DKIMKeyFile})
+	}
+	return append(keys, d.DKIMKeys...)
+}
+
+// ActiveDKIMSelector returns the selector that signs the domain's mail:
+// dkim_selector, or the first key's when it is unset
+func (d DomainConfig) ActiveDKIMSelector() string {
+	if d.DKIMSelector != "" {
+		return d.DKIMSelector
+	}
+	if keys := d.AllDKIMKeys(); len(keys) > 0 {
+		return keys[0].Selector
+	}
+	return ""
 }
 
 // SecurityConfig holds security-related configuration
@@ -70,6 +240,41 @@ type SecurityConfig struct {
 	VerifyDMARC    bool `koanf:"verify_dmarc"`     // Verify DMARC on inbound
 	SignOutbound   bool `koanf:"sign_outbound"`    // DKIM sign outbound
 	MaxMessageSize int  `koanf:"max_message_size"` // Max message size in bytes
+
+	MaxReceivedHeaders int `koanf:"max_received_headers"` // Hop limit before a message is treated as looping
+
+	HELOCheck  string `koanf:"helo_check"`  // off, log or reject forged and malformed HELO names on port 25
+	SMTPBanner string `koanf:"smtp_banner"` // Greeting text after the hostname (default "ESMTP Service Ready")
+
+	Reputation ReputationConfig `koanf:"reputation"` // Refuse client IPs that keep failing logins or sending spam
+	DNSBL      DNSBLConfig      `koanf:"dnsbl"`      // DNS blocklists the IPs of clients on port 25 are checked against
+}
+
+// DNSBLConfig checks the IP of each client sending mail on port 25 against
+// DNS blocklists. The weights of the lists it is on are added up: at the
+// threshold its mail is rejected, below it the lists are named in an
+// X-DNSBL header for filters to act on.
+type DNSBLConfig struct {
+	Lists     []DNSBLListConfig `koanf:"lists"`
+	Threshold float64           `koanf:"threshold"` // Total weight at which mail is rejected
+	Timeout   string            `koanf:"timeout"`   // Time allowed for the lookups (e.g., "2s")
+	CacheTTL  string            `koanf:"cache_ttl"` // How long an IP's result is cached
+}
+
+// DNSBLListConfig is one DNS blocklist
+type DNSBLListConfig struct {
+	Zone   string  `koanf:"zone"`   // zen.spamhaus.org
+	Weight float64 `koanf:"weight"` // Added to the score of a listed IP (default 1)
+}
+
+// ReputationConfig scores client IPs by the failed logins, greylist
+// violations and spam trap hits they cause. An IP whose score reaches the
+// threshold is refused by the SMTP and IMAP servers until its score decays.
+type ReputationConfig struct {
+	Enabled   bool    `koanf:"enabled"`
+	Threshold float64 `koanf:"threshold"` // Score at which an IP is refused
+	HalfLife  string  `koanf:"half_life"` // Time for a score to halve (e.g., "1h")
+	Persist   bool    `koanf:"persist"`   // Keep scores in the database across restarts
 }
 
 // LoggingConfig holds logging configuration
@@ -77,14 +282,34 @@ type LoggingConfig struct {
 	Level  string `koanf:"level"`  // debug, info, warn, error
 	Format string `koanf:"format"` // json, text
 	Output string `koanf:"output"` // stdout, stderr, or file path
+
+	Trace TraceConfig `koanf:"trace"` // Protocol traces of selected IMAP and SMTP clients
+}
+
+// TraceConfig logs the command and response lines of matching IMAP and
+// SMTP connections at debug level, for debugging a client
+type TraceConfig struct {
+	IPs      []string `koanf:"ips"`      // Client addresses or CIDRs to trace
+	Users    []string `koanf:"users"`    // Users whose IMAP and SMTP sessions are traced once they log in
+	Duration string   `koanf:"duration"` // Tracing stops this long after startup
 }
 
-// QueueConfig holds Redis queue configuration
+// QueueConfig holds delivery queue configuration
 type QueueConfig struct {
+	Backend     string `koanf:"backend"`       // redis, or memory for single-node setups without Redis
 	RedisURL    string `koanf:"redis_url"`     // Redis connection URL
 	Prefix      string `koanf:"prefix"`        // Key prefix for queue entries
 	MaxRetries  int    `koanf:"max_retries"`   // Maximum delivery attempts
 	RetryMaxAge string `koanf:"retry_max_age"` // Max time to retry (e.g., "168h")
+
+	RedisPassword     string `koanf:"redis_password"`      // Overrides the password in redis_url
+	RedisPasswordFile string `koanf:"redis_password_file"` // File holding redis_password, e.g. a mounted secret
+
+	// Retry schedule; leave unset for the built-in 5m, 15m, 30m ... 24h curve
+	RetryInitialDelay string  `koanf:"retry_initial_delay"` // Delay after the first failure
+	RetryMultiplier   float64 `koanf:"retry_multiplier"`    // Growth of the delay per further failure
+	RetryMaxInterval  string  `koanf:"retry_max_interval"`  // Longest delay between attempts
+	QuickFirstRetry   string  `koanf:"quick_first_retry"`   // Retry the first temporary failure after this (e.g. "60s"), then back off
 }
 
 // DeliveryConfig holds outbound delivery configuration
@@ -95,6 +320,60 @@ type DeliveryConfig struct {
 	RequireTLS     bool   `koanf:"require_tls"`     // Require TLS for outbound
 	VerifyTLS      bool   `koanf:"verify_tls"`      // Verify TLS certificates
 	RelayHost      string `koanf:"relay_host"`      // Optional smarthost (host:port)
+	HeloName       string `koanf:"helo_name"`       // HELO/EHLO name (default: server.hostname)
+	SourceIP       string `koanf:"source_ip"`       // Local address to connect from (default: system choice)
+
+	MaxConcurrentPerDomain int                 `koanf:"max_concurrent_per_domain"` // Simultaneous deliveries to one domain (0 = unlimited)
+	MaxPerMinutePerDomain  int                 `koanf:"max_per_minute_per_domain"` // Deliveries started per minute to one domain (0 = unlimited)
+	RateLimitBackoff       string              `koanf:"rate_limit_backoff"`        // Pause for a domain after a 4.7.x reply
+	DomainLimits           []DomainLimitConfig `koanf:"domain_limits"`             // Per-domain overrides
+
+	TLSPolicies []TLSPolicyConfig `koanf:"tls_policies"` // Per-domain TLS requirements
+
+	Hold HoldConfig `koanf:"hold"` // Hold matching messages for admin review
+
+	VERP          bool   `koanf:"verp"`           // Send each recipient a VERP envelope sender to match bounces
+	BounceMailbox string `koanf:"bounce_mailbox"` // Local address bounces are filed to (default: the sender's INBOX)
+}
+
+// HoldConfig selects outbound messages that wait in the queue until an
+// admin releases or rejects them
+type HoldConfig struct {
+	MaxRecipients int      `koanf:"max_recipients"` // Hold messages with more recipients (0 = off)
+	Senders       []string `koanf:"senders"`        // Hold messages from these addresses or @domains
+}
+
+// DomainLimitConfig overrides the outbound limits for one recipient domain
+type DomainLimitConfig struct {
+	Domain        string `koanf:"domain"`         // gmail.com
+	MaxConcurrent int    `koanf:"max_concurrent"` // 0 = unlimited
+	MaxPerMinute  int    `koanf:"max_per_minute"` // 0 = unlimited
+}
+
+// TLSPolicyConfig sets the outbound TLS policy for one recipient domain
+type TLSPolicyConfig struct {
+	Domain string `koanf:"domain"` // partner.example
+	Policy string `koanf:"policy"` // none, may, encrypt, dane or secure
+}
+
+// validTLSPolicies lists the accepted delivery.tls_policies[].policy values
+var validTLSPolicies = map[string]bool{
+	"none": true, "may": true, "encrypt": true, "dane": true, "secure": true,
+}
+
+// isLocalAddress reports whether ip is assigned to one of this host's
+// interfaces, so outbound connections can be bound to it
+func isLocalAddress(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
 }
 
 // AdminConfig holds admin web panel configuration
@@ -119,9 +398,151 @@ type AutodiscoverConfig struct {
 	DisplayName string `koanf:"display_name"` // Display name for email service
 }
 
+// JMAPConfig holds JMAP (RFC 8620/8621) settings
+type JMAPConfig struct {
+	Enabled bool   `koanf:"enabled"` // Enable the read-only JMAP endpoint
+	Port    int    `koanf:"port"`    // JMAP port (default 8443)
+	Listen  string `koanf:"listen"`  // Listen address (default 0.0.0.0)
+}
+
+// PushConfig holds Apple Push Notification service (APNs) settings used to
+// wake iOS Mail when new mail arrives
+type PushConfig struct {
+	Enabled bool   `koanf:"enabled"`  // Advertise XAPPLEPUSHSERVICE over IMAP
+	KeyFile string `koanf:"key_file"` // APNs .p8 signing key
+	KeyID   string `koanf:"key_id"`   // Key identifier for key_file
+	TeamID  string `koanf:"team_id"`  // Apple developer team identifier
+	Topic   string `koanf:"topic"`    // apns-topic, e.g. com.apple.mail.XServer.<uuid>
+	Sandbox bool   `koanf:"sandbox"`  // Use the APNs development environment
+}
+
+// SubmissionConfig holds settings for mail sent by authenticated clients
+type SubmissionConfig struct {
+	SaveToSent       bool   `koanf:"save_to_sent"`       // File a \Seen copy of submitted mail in the sender's \Sent mailbox
+	SentDedupeWindow string `koanf:"sent_dedupe_window"` // Ignore a client APPEND to \Sent of the same Message-ID within this window
+
+	AddMessageID    bool   `koanf:"add_message_id"`    // Insert a Message-ID header when a submitted message has none
+	AddDate         bool   `koanf:"add_date"`          // Insert a Date header when a submitted message has none
+	MessageIDDomain string `koanf:"message_id_domain"` // Domain for generated Message-IDs (default: the sender's domain)
+
+	Footer FooterConfig `koanf:"footer"` // Footer, such as a disclaimer, appended to submitted mail
+}
+
+// FooterConfig appends a footer to the text of submitted mail, before it
+// is DKIM signed
+type FooterConfig struct {
+	Text       string               `koanf:"text"`        // Plain-text footer for domains without their own (empty = off)
+	HTML       string               `koanf:"html"`        // Footer for HTML parts (default: the text footer, escaped)
+	SkipHeader string               `koanf:"skip_header"` // A message with this header field gets no footer; the field is removed
+	Domains    []FooterDomainConfig `koanf:"domains"`     // Per-domain footers
+}
+
+// FooterDomainConfig sets the footer of one sender domain's mail
+type FooterDomainConfig struct {
+	Domain string `koanf:"domain"` // example.com
+	Text   string `koanf:"text"`   // Plain-text footer, or empty for no footer
+	HTML   string `koanf:"html"`   // Footer for HTML parts (default: the text footer, escaped)
+}
+
+// ForDomain returns the footers for mail sent from domain; text is empty
+// when its mail gets no footer
+func (f FooterConfig) ForDomain(domain string) (text, html string) {
+	for _, d := range f.Domains {
+		if strings.EqualFold(d.Domain, domain) {
+			return d.Text, d.HTML
+		}
+	}
+	return f.Text, f.HTML
+}
+
+// IMAPConfig holds IMAP client access settings
+type IMAPConfig struct {
+	RequireTLSForAuth bool   `koanf:"require_tls_for_auth"` // Advertise LOGINDISABLED and refuse LOGIN on port 143 until STARTTLS
+	ClientCertAuth    bool   `koanf:"client_cert_auth"`     // Ask TLS clients for a certificate and offer AUTHENTICATE EXTERNAL
+	SharedPrefix      string `koanf:"shared_prefix"`        // Namespace mailboxes other users share appear under, as <prefix>/<owner>/<mailbox>
+}
+
+// SMTPConfig holds SMTP client access settings
+type SMTPConfig struct {
+	RequireTLSForAuth bool     `koanf:"require_tls_for_auth"` // Offer and accept AUTH on port 587 only after STARTTLS (implied by security.require_tls)
+	RelayNetworks     []string `koanf:"relay_networks"`       // CIDRs of trusted hosts that may relay to remote domains without AUTH
+
+	Headers HeadersConfig `koanf:"headers"` // Header fields removed from and added to received mail
+	Journal JournalConfig `koanf:"journal"` // Archive copies of mail kept for compliance
+
+	Honeypot HoneypotConfig `koanf:"honeypot"` // Spam trap addresses that penalize the senders writing to them
+}
+
+// HoneypotConfig designates spam trap addresses. Mail to a trap is accepted
+// and discarded, and with security.reputation on the sending IP is refused
+// for a while.
+type HoneypotConfig struct {
+	Addresses []string `koanf:"addresses"` // trap@example.com, or @trap.example.com for every address at a domain
+	Penalty   string   `koanf:"penalty"`   // How long the sender's IP is refused (e.g., "1h")
+}
+
+// JournalConfig sends a copy of every submitted message, and optionally of
+// every message delivered to a local mailbox, to an archive address
+type JournalConfig struct {
+	Address   string                `koanf:"address"`   // Archive address for domains without their own (empty = off)
+	Delivered bool                  `koanf:"delivered"` // Also journal mail from other servers delivered to local users
+	Domains   []JournalDomainConfig `koanf:"domains"`   // Per-domain archive addresses
+}
+
+// JournalDomainConfig sets the archive address for one domain's mail
+type JournalDomainConfig struct {
+	Domain  string `koanf:"domain"`  // example.com
+	Address string `koanf:"address"` // compliance@example.com, or empty to journal nothing for the domain
+}
+
+// ArchiveAddress returns the address mail sent from or delivered to domain
+// is journaled to, or "" when it isn't journaled
+func (j JournalConfig) ArchiveAddress(domain string) string {
+	for _, d := range j.Domains {
+		if strings.EqualFold(d.Domain, domain) {
+			return d.Address
+		}
+	}
+	return j.Address
+}
+
+// HeadersConfig holds the header rewrites applied to mail as it is received
+type HeadersConfig struct {
+	Inbound    HeaderRewriteConfig `koanf:"inbound"`    // Mail for local delivery from other servers
+	Submission HeaderRewriteConfig `koanf:"submission"` // Mail from users and relay networks, rewritten before DKIM signing
+}
+
+// HeaderRewriteConfig lists header fields to remove and fields to add
+type HeaderRewriteConfig struct {
+	Remove []string      `koanf:"remove"` // Field names, case-insensitive, e.g. X-Originating-IP
+	Add    []HeaderField `koanf:"add"`    // Fields added to every message
+}
+
+// HeaderField is a header field with a static value
+type HeaderField struct {
+	Name  string `koanf:"name"`
+	Value string `koanf:"value"`
+}
+
+// WelcomeConfig holds the message delivered to the INBOX of new users
+type WelcomeConfig struct {
+	Enabled      bool   `koanf:"enabled"`       // Deliver a welcome message when a user is created
+	From         string `koanf:"from"`          // Sender address (default: postmaster@ the user's domain)
+	Subject      string `koanf:"subject"`       // Subject line, a text/template like the body
+	TemplateFile string `koanf:"template_file"` // text/template file for the body (default: built in)
+}
+
+// DNSCheckConfig holds settings for re-checking the domains' DNS records
+// while the server runs
+type DNSCheckConfig struct {
+	Interval   string `koanf:"interval"`    // How often to check (empty = never)
+	WebhookURL string `koanf:"webhook_url"` // POSTed a JSON alert when a passing record starts failing
+}
+
 // DefaultConfig returns a configuration with sensible defaults
 func DefaultConfig() *Config {
 	return &Config{
+		ConfigVersion: CurrentVersion,
 		Server: ServerConfig{
 			Hostname:        "localhost",
 			Domain:          "localhost",
@@ -134,13 +555,37 @@ func DefaultConfig() *Config {
 			ShutdownTimeout: "30s",
 		},
 		TLS: TLSConfig{
-			AutoTLS:  false,
-			CacheDir: "/var/lib/mailserver/acme",
+			AutoTLS:    false,
+			CacheDir:   "/var/lib/mailserver/acme",
+			MinVersion: "1.2",
 		},
 		Storage: StorageConfig{
 			DataDir:      "/var/lib/mailserver",
 			DatabasePath: "/var/lib/mailserver/mail.db",
 			MaildirPath:  "/var/lib/mailserver/maildir",
+
+			MinFreeBytes:      512 * 1024 * 1024, // 512MB
+			MinFreeInodes:     10000,
+			DiskCheckInterval: "30s",
+
+			QuotaRecomputeInterval: "15m",
+
+			BodyStore: "maildir",
+			S3: S3Config{
+				Region: "us-east-1",
+				Prefix: "messages/",
+			},
+
+			DefaultMailboxes: []MailboxConfig{
+				{Name: "INBOX"},
+				{Name: "Drafts", SpecialUse: `\Drafts`},
+				{Name: "Sent", SpecialUse: `\Sent`},
+				{Name: "Junk", SpecialUse: `\Junk`},
+				{Name: "Trash", SpecialUse: `\Trash`},
+				{Name: "Archive", SpecialUse: `\Archive`},
+			},
+			MaxMailboxes:    1000,
+			MaxMailboxDepth: 16,
 		},
 		Security: SecurityConfig{
 			RequireTLS:     true,
@@ -149,13 +594,34 @@ func DefaultConfig() *Config {
 			VerifyDMARC:    true,
 			SignOutbound:   true,
 			MaxMessageSize: 26214400, // 25MB
+
+			MaxReceivedHeaders: 30,
+			HELOCheck:          "log",
+			Reputation: ReputationConfig{
+				Threshold: 10,
+				HalfLife:  "1h",
+			},
+			DNSBL: DNSBLConfig{
+				Threshold: 1,
+				Timeout:   "2s",
+				CacheTTL:  "15m",
+			},
+		},
+		SMTP: SMTPConfig{
+			Honeypot: HoneypotConfig{
+				Penalty: "1h",
+			},
 		},
 		Logging: LoggingConfig{
 			Level:  "info",
 			Format: "json",
 			Output: "stdout",
+			Trace: TraceConfig{
+				Duration: "1h",
+			},
 		},
 		Queue: QueueConfig{
+			Backend:     "redis",
 			RedisURL:    "redis://localhost:6379/0",
 			Prefix:      "mail",
 			MaxRetries:  15,
@@ -167,6 +633,9 @@ func DefaultConfig() *Config {
 			CommandTimeout: "5m",
 			RequireTLS:     false,
 			VerifyTLS:      true,
+
+			MaxConcurrentPerDomain: 5,
+			RateLimitBackoff:       "5m",
 		},
 		Admin: AdminConfig{
 			Enabled: true,
@@ -183,6 +652,26 @@ func DefaultConfig() *Config {
 			Port:    8081,
 			Listen:  "0.0.0.0",
 		},
+		JMAP: JMAPConfig{
+			Enabled: false,
+			Port:    8443,
+			Listen:  "0.0.0.0",
+		},
+		Submission: SubmissionConfig{
+			SaveToSent:       true,
+			SentDedupeWindow: "5m",
+			AddMessageID:     true,
+			AddDate:          true,
+			Footer: FooterConfig{
+				SkipHeader: "X-No-Footer",
+			},
+		},
+		IMAP: IMAPConfig{
+			SharedPrefix: "#shared",
+		},
+		Welcome: WelcomeConfig{
+			Subject: "Welcome to {{.Domain}}",
+		},
 	}
 }
 
@@ -193,117 +682,397 @@ func Load(path string) (*Config, error) {
 	// Load defaults first
 	cfg := DefaultConfig()
 
-	// Check if config file exists
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		return cfg, nil // Return defaults if no config file
+	// Check if config file exists; without one the defaults apply
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to load config file: %w", err)
 	}
 
-	// Load YAML config file
-	if err := k.Load(file.Provider(path), yaml.Parser()); err != nil {
-		return nil, fmt.Errorf("failed to load config file: %w", err)
+	var notes []string
+	if err == nil {
+		// Files written for older releases are read as if upgraded
+		data, notes, err = Upgrade(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load config file: %w", err)
+		}
+
+		// Load YAML config file
+		if err := k.Load(rawBytes(data), yaml.Parser()); err != nil {
+			return nil, fmt.Errorf("failed to load config file: %w", err)
+		}
+	}
+
+	// Environment variables override the file
+	if err := applyEnv(k, os.Environ()); err != nil {
+		return nil, fmt.Errorf("invalid environment variable: %w", err)
+	}
+
+	// Lists replace the defaults rather than merging element by element
+	if k.Exists("storage.default_mailboxes") {
+		cfg.Storage.DefaultMailboxes = nil
 	}
 
 	// Unmarshal into config struct
 	if err := k.Unmarshal("", cfg); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
 	}
+	if len(notes) > 0 {
+		notes = append(notes, "the file is written for an older config_version; run 'mailserver config upgrade' to update it")
+	}
+	cfg.Warnings = notes
+
+	// Secrets can be kept in files of their own
+	if err := cfg.loadSecretFiles(); err != nil {
+		return nil, err
+	}
 
 	return cfg, nil
 }
 
-// Validate checks if the configuration is valid
+// rawBytes is a koanf provider of config file data already read
+type rawBytes []byte
+
+func (b rawBytes) ReadBytes() ([]byte, error) {
+	return b, nil
+}
+
+func (b rawBytes) Read() (map[string]interface{}, error) {
+	return nil, errors.New("rawBytes provider does not support Read()")
+}
+
+// ValidationError lists every problem Validate found
+type ValidationError struct {
+	Problems []error
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		msgs[i] = p.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// problems collects validation failures
+type problems []error
+
+func (p *problems) addf(format string, args ...any) {
+	*p = append(*p, fmt.Errorf(format, args...))
+}
+
+// Validate checks if the configuration is valid. Every problem is reported,
+// in a *ValidationError, not just the first.
 func (c *Config) Validate() error {
+	var p problems
+
 	// Server validation
 	if c.Server.Hostname == "" {
-		return fmt.Errorf("server.hostname is required")
+		p.addf("server.hostname is required")
 	}
 
 	// Port validation
-	if err := c.validatePorts(); err != nil {
-		return err
-	}
+	c.validatePorts(&p)
 
 	// Storage validation
-	if err := c.validateStorage(); err != nil {
-		return err
-	}
+	c.validateStorage(&p)
 
 	// Timeout validation
-	if err := c.validateTimeouts(); err != nil {
-		return err
-	}
+	c.validateTimeouts(&p)
 
 	// Domain validation
 	if len(c.Domains) == 0 {
-		return fmt.Errorf("at least one domain must be configured")
+		p.addf("at least one domain must be configured")
 	}
 
 	for i, domain := range c.Domains {
 		if domain.Name == "" {
-			return fmt.Errorf("domains[%d].name is required", i)
+			p.addf("domains[%d].name is required", i)
 		}
-		if c.Security.SignOutbound && domain.DKIMKeyFile == "" {
-			return fmt.Errorf("domains[%d].dkim_key_file is required when sign_outbound is enabled", i)
+		if c.Security.SignOutbound && domain.DKIMKeyFile == "" && len(domain.DKIMKeys) == 0 {
+			p.addf("domains[%d].dkim_key_file is required when sign_outbound is enabled", i)
 		}
 		if domain.DKIMKeyFile != "" {
 			if err := validateFileReadable(domain.DKIMKeyFile); err != nil {
-				return fmt.Errorf("domains[%d].dkim_key_file: %w", i, err)
+				p.addf("domains[%d].dkim_key_file: %w", i, err)
 			}
 		}
+		c.validateDKIMKeys(&p, i, domain)
+		if domain.Postmaster != "" && !strings.Contains(domain.Postmaster, "@") {
+			p.addf("domains[%d].postmaster must be an email address", i)
+		}
+		if domain.Abuse != "" && !strings.Contains(domain.Abuse, "@") {
+			p.addf("domains[%d].abuse must be an email address", i)
+		}
+	}
+	if c.Server.Postmaster != "" && !strings.Contains(c.Server.Postmaster, "@") {
+		p.addf("server.postmaster must be an email address")
+	}
+	if c.Server.Abuse != "" && !strings.Contains(c.Server.Abuse, "@") {
+		p.addf("server.abuse must be an email address")
 	}
 
 	// TLS validation
 	if c.TLS.AutoTLS {
 		if c.TLS.Email == "" {
-			return fmt.Errorf("tls.email is required when auto_tls is enabled")
+			p.addf("tls.email is required when auto_tls is enabled")
 		}
 		if c.TLS.CacheDir == "" {
-			return fmt.Errorf("tls.cache_dir is required when auto_tls is enabled")
+			p.addf("tls.cache_dir is required when auto_tls is enabled")
 		}
 	} else {
 		if c.TLS.CertFile != "" && c.TLS.KeyFile == "" {
-			return fmt.Errorf("tls.key_file is required when tls.cert_file is set")
+			p.addf("tls.key_file is required when tls.cert_file is set")
 		}
 		if c.TLS.KeyFile != "" && c.TLS.CertFile == "" {
-			return fmt.Errorf("tls.cert_file is required when tls.key_file is set")
+			p.addf("tls.cert_file is required when tls.key_file is set")
 		}
 		if c.TLS.CertFile != "" {
 			if err := validateFileReadable(c.TLS.CertFile); err != nil {
-				return fmt.Errorf("tls.cert_file: %w", err)
+				p.addf("tls.cert_file: %w", err)
 			}
 		}
 		if c.TLS.KeyFile != "" {
 			if err := validateFileReadable(c.TLS.KeyFile); err != nil {
-				return fmt.Errorf("tls.key_file: %w", err)
+				p.addf("tls.key_file: %w", err)
+			}
+		}
+		if c.TLS.CertDir != "" {
+			if c.TLS.CertFile == "" {
+				p.addf("tls.cert_file is required when tls.cert_dir is set, as the default certificate")
+			}
+			if info, err := os.Stat(c.TLS.CertDir); err != nil {
+				p.addf("tls.cert_dir: %w", err)
+			} else if !info.IsDir() {
+				p.addf("tls.cert_dir %s is not a directory", c.TLS.CertDir)
 			}
 		}
 	}
+	version, err := c.TLS.Version()
+	if err != nil {
+		p.addf("tls.min_version: %w", err)
+	}
+	suites, err := c.TLS.Suites()
+	if err != nil {
+		p.addf("tls.cipher_suites: %w", err)
+	} else if version != 0 && version < tls.VersionTLS12 && !suitesBeforeTLS12(suites) {
+		// TLS 1.0 and 1.1 clients would find no suite in common
+		p.addf("tls.min_version %s needs a cipher suite TLS 1.0 and 1.1 support, such as TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA, in tls.cipher_suites", c.TLS.MinVersion)
+	}
 
 	// Security validation
 	if c.Security.MaxMessageSize < 1024 {
-		return fmt.Errorf("security.max_message_size must be at least 1024 bytes")
+		p.addf("security.max_message_size must be at least 1024 bytes")
 	}
 	if c.Security.MaxMessageSize > 100*1024*1024 {
-		return fmt.Errorf("security.max_message_size cannot exceed 100MB (104857600 bytes)")
+		p.addf("security.max_message_size cannot exceed 100MB (104857600 bytes)")
+	}
+	if c.Security.MaxReceivedHeaders < 1 {
+		p.addf("security.max_received_headers must be at least 1")
+	}
+	switch c.Security.HELOCheck {
+	case "", "off", "log", "reject":
+	default:
+		p.addf("security.helo_check must be off, log or reject")
+	}
+	if strings.ContainsAny(c.Security.SMTPBanner, "\r\n") {
+		p.addf("security.smtp_banner must be a single line")
+	}
+	if c.Security.Reputation.Enabled && c.Security.Reputation.Threshold <= 0 {
+		p.addf("security.reputation.threshold must be positive")
+	}
+	if len(c.Security.DNSBL.Lists) > 0 && c.Security.DNSBL.Threshold <= 0 {
+		p.addf("security.dnsbl.threshold must be positive")
+	}
+	seenDNSBL := make(map[string]bool)
+	for i, l := range c.Security.DNSBL.Lists {
+		zone := strings.ToLower(strings.Trim(l.Zone, "."))
+		if zone == "" || strings.ContainsAny(zone, " \t/@") {
+			p.addf("security.dnsbl.lists[%d].zone must be a domain (got: %q)", i, l.Zone)
+		} else if seenDNSBL[zone] {
+			p.addf("security.dnsbl.lists[%d]: duplicate zone %s", i, l.Zone)
+		}
+		seenDNSBL[zone] = true
+		if l.Weight < 0 {
+			p.addf("security.dnsbl.lists[%d].weight cannot be negative", i)
+		}
+	}
+
+	// Submission validation
+	if strings.ContainsAny(c.Submission.MessageIDDomain, "@<> \t\r\n") {
+		p.addf("submission.message_id_domain must be a bare domain")
+	}
+	if h := c.Submission.Footer.SkipHeader; h != "" && !validHeaderName(h) {
+		p.addf("submission.footer.skip_header must be a header field name (got: %q)", h)
+	}
+	if c.Submission.Footer.HTML != "" && c.Submission.Footer.Text == "" {
+		p.addf("submission.footer.html requires submission.footer.text")
+	}
+	seenFooters := make(map[string]bool)
+	for i, d := range c.Submission.Footer.Domains {
+		domain := strings.ToLower(d.Domain)
+		if domain == "" {
+			p.addf("submission.footer.domains[%d].domain is required", i)
+		} else if seenFooters[domain] {
+			p.addf("submission.footer.domains[%d]: duplicate domain %s", i, d.Domain)
+		}
+		seenFooters[domain] = true
+		if d.HTML != "" && d.Text == "" {
+			p.addf("submission.footer.domains[%d].html requires a text footer", i)
+		}
+	}
+
+	// DNS check validation
+	if c.DNSCheck.WebhookURL != "" {
+		if u, err := url.Parse(c.DNSCheck.WebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			p.addf("dns_check.webhook_url must be an http or https URL")
+		}
+	}
+
+	// Trace validation
+	for i, addr := range c.Logging.Trace.IPs {
+		if _, _, err := net.ParseCIDR(addr); err != nil && net.ParseIP(addr) == nil {
+			p.addf("logging.trace.ips[%d] must be a CIDR or IP address (got: %s)", i, addr)
+		}
+	}
+	for i, user := range c.Logging.Trace.Users {
+		if !strings.Contains(user, "@") {
+			p.addf("logging.trace.users[%d] must be an email address (got: %s)", i, user)
+		}
+	}
+	if (len(c.Logging.Trace.IPs) > 0 || len(c.Logging.Trace.Users) > 0) && c.Logging.Trace.Duration == "" {
+		p.addf("logging.trace.duration is required when tracing clients")
+	}
+
+	// IMAP validation
+	if prefix := strings.Trim(c.IMAP.SharedPrefix, "/"); prefix == "" || strings.EqualFold(prefix, "INBOX") ||
+		strings.ContainsAny(prefix, "*%\"\r\n") {
+		p.addf("imap.shared_prefix must be a mailbox name other than INBOX (got: %q)", c.IMAP.SharedPrefix)
+	}
+
+	// SMTP validation
+	for i, cidr := range c.SMTP.RelayNetworks {
+		if _, _, err := net.ParseCIDR(cidr); err != nil && net.ParseIP(cidr) == nil {
+			p.addf("smtp.relay_networks[%d] must be a CIDR or IP address (got: %s)", i, cidr)
+		}
+	}
+
+	c.validateHeaderRewrite(&p, "smtp.headers.inbound", c.SMTP.Headers.Inbound)
+	c.validateHeaderRewrite(&p, "smtp.headers.submission", c.SMTP.Headers.Submission)
+	if a := c.SMTP.Journal.Address; a != "" && !strings.Contains(a, "@") {
+		p.addf("smtp.journal.address must be an email address (got: %s)", a)
+	}
+	seenJournal := make(map[string]bool)
+	for i, d := range c.SMTP.Journal.Domains {
+		domain := strings.ToLower(d.Domain)
+		if domain == "" {
+			p.addf("smtp.journal.domains[%d].domain is required", i)
+		} else if seenJournal[domain] {
+			p.addf("smtp.journal.domains[%d]: duplicate domain %s", i, d.Domain)
+		}
+		seenJournal[domain] = true
+		if d.Address != "" && !strings.Contains(d.Address, "@") {
+			p.addf("smtp.journal.domains[%d].address must be an email address (got: %s)", i, d.Address)
+		}
+	}
+	for i, a := range c.SMTP.Honeypot.Addresses {
+		_, domain, ok := strings.Cut(a, "@")
+		if !ok || domain == "" || strings.ContainsAny(a, " \t<>") || strings.Contains(domain, "@") {
+			p.addf("smtp.honeypot.addresses[%d] must be an email address or @domain (got: %s)", i, a)
+		}
+	}
+
+	// Welcome message validation
+	if c.Welcome.From != "" && !strings.Contains(c.Welcome.From, "@") {
+		p.addf("welcome.from must be an email address")
+	}
+	if c.Welcome.Enabled && c.Welcome.TemplateFile != "" {
+		if err := validateFileReadable(c.Welcome.TemplateFile); err != nil {
+			p.addf("welcome.template_file: %w", err)
+		}
 	}
 
 	// Queue validation
 	if c.Queue.MaxRetries < 1 {
-		return fmt.Errorf("queue.max_retries must be at least 1")
+		p.addf("queue.max_retries must be at least 1")
 	}
 	if c.Queue.MaxRetries > 100 {
-		return fmt.Errorf("queue.max_retries cannot exceed 100")
+		p.addf("queue.max_retries cannot exceed 100")
+	}
+	switch c.Queue.Backend {
+	case "redis":
+		if c.Queue.RedisURL == "" {
+			p.addf("queue.redis_url is required")
+		}
+	case "memory":
+	default:
+		p.addf("queue.backend must be redis or memory")
 	}
-	if c.Queue.RedisURL == "" {
-		return fmt.Errorf("queue.redis_url is required")
+	if c.Queue.RetryMultiplier != 0 && c.Queue.RetryMultiplier < 1 {
+		p.addf("queue.retry_multiplier must be at least 1")
 	}
 
 	// Delivery validation
 	if c.Delivery.Workers < 1 {
-		return fmt.Errorf("delivery.workers must be at least 1")
+		p.addf("delivery.workers must be at least 1")
 	}
 	if c.Delivery.Workers > 100 {
-		return fmt.Errorf("delivery.workers cannot exceed 100")
+		p.addf("delivery.workers cannot exceed 100")
+	}
+	if c.Delivery.MaxConcurrentPerDomain < 0 {
+		p.addf("delivery.max_concurrent_per_domain cannot be negative")
+	}
+	if c.Delivery.MaxPerMinutePerDomain < 0 {
+		p.addf("delivery.max_per_minute_per_domain cannot be negative")
+	}
+	if c.Delivery.HeloName != "" {
+		if err := validation.Domain(c.Delivery.HeloName); err != nil {
+			p.addf("delivery.helo_name must be a hostname (got: %s)", c.Delivery.HeloName)
+		}
+	}
+	if c.Delivery.SourceIP != "" {
+		if ip := net.ParseIP(c.Delivery.SourceIP); ip == nil {
+			p.addf("delivery.source_ip must be an IP address (got: %s)", c.Delivery.SourceIP)
+		} else if !isLocalAddress(ip) {
+			p.addf("delivery.source_ip %s is not an address of this host", c.Delivery.SourceIP)
+		}
+	}
+	seenLimits := make(map[string]bool)
+	for i, dl := range c.Delivery.DomainLimits {
+		domain := strings.ToLower(dl.Domain)
+		if domain == "" {
+			p.addf("delivery.domain_limits[%d].domain is required", i)
+		} else if seenLimits[domain] {
+			p.addf("delivery.domain_limits[%d]: duplicate domain %s", i, dl.Domain)
+		}
+		seenLimits[domain] = true
+		if dl.MaxConcurrent < 0 || dl.MaxPerMinute < 0 {
+			p.addf("delivery.domain_limits[%d]: limits cannot be negative", i)
+		}
+	}
+	seenPolicies := make(map[string]bool)
+	for i, tp := range c.Delivery.TLSPolicies {
+		domain := strings.ToLower(tp.Domain)
+		if domain == "" {
+			p.addf("delivery.tls_policies[%d].domain is required", i)
+		} else if seenPolicies[domain] {
+			p.addf("delivery.tls_policies[%d]: duplicate domain %s", i, tp.Domain)
+		}
+		seenPolicies[domain] = true
+		if !validTLSPolicies[strings.ToLower(tp.Policy)] {
+			p.addf("delivery.tls_policies[%d].policy must be one of: none, may, encrypt, dane, secure (got: %s)", i, tp.Policy)
+		}
+	}
+
+	if c.Delivery.Hold.MaxRecipients < 0 {
+		p.addf("delivery.hold.max_recipients cannot be negative")
+	}
+	for i, sender := range c.Delivery.Hold.Senders {
+		if !strings.Contains(sender, "@") {
+			p.addf("delivery.hold.senders[%d] must be an address or @domain (got: %s)", i, sender)
+		}
+	}
+	if c.Delivery.BounceMailbox != "" && !strings.Contains(c.Delivery.BounceMailbox, "@") {
+		p.addf("delivery.bounce_mailbox must be an email address")
 	}
 
 	// Logging validation
@@ -312,42 +1081,101 @@ func (c *Config) Validate() error {
 			"debug": true, "info": true, "warn": true, "error": true,
 		}
 		if !validLevels[c.Logging.Level] {
-			return fmt.Errorf("logging.level must be one of: debug, info, warn, error (got: %s)", c.Logging.Level)
+			p.addf("logging.level must be one of: debug, info, warn, error (got: %s)", c.Logging.Level)
 		}
 	}
 
 	if c.Logging.Format != "" {
 		validFormats := map[string]bool{"json": true, "text": true}
 		if !validFormats[c.Logging.Format] {
-			return fmt.Errorf("logging.format must be one of: json, text (got: %s)", c.Logging.Format)
+			p.addf("logging.format must be one of: json, text (got: %s)", c.Logging.Format)
 		}
 	}
 
 	// Admin validation
 	if c.Admin.Enabled {
 		if c.Admin.Port < 1 || c.Admin.Port > 65535 {
-			return fmt.Errorf("admin.port must be between 1 and 65535 (got: %d)", c.Admin.Port)
+			p.addf("admin.port must be between 1 and 65535 (got: %d)", c.Admin.Port)
 		}
 		if c.Admin.Listen == "" {
-			return fmt.Errorf("admin.listen is required when admin is enabled")
+			p.addf("admin.listen is required when admin is enabled")
+		}
+	}
+
+	// JMAP validation
+	if c.JMAP.Enabled {
+		if c.JMAP.Port < 1 || c.JMAP.Port > 65535 {
+			p.addf("jmap.port must be between 1 and 65535 (got: %d)", c.JMAP.Port)
+		}
+		if c.JMAP.Port == c.Server.DAVPort {
+			p.addf("port conflict: jmap.port and server.dav_port both use port %d", c.JMAP.Port)
+		}
+	}
+
+	// Push validation
+	if c.Push.Enabled {
+		if c.Push.KeyFile == "" {
+			p.addf("push.key_file is required when push is enabled")
+		}
+		if c.Push.KeyID == "" {
+			p.addf("push.key_id is required when push is enabled")
+		}
+		if c.Push.TeamID == "" {
+			p.addf("push.team_id is required when push is enabled")
+		}
+		if c.Push.Topic == "" {
+			p.addf("push.topic is required when push is enabled")
 		}
 	}
 
 	// Sieve validation
 	if c.Sieve.Enabled {
 		if c.Sieve.MaxScriptSize < 1024 {
-			return fmt.Errorf("sieve.max_script_size must be at least 1024 bytes")
+			p.addf("sieve.max_script_size must be at least 1024 bytes")
 		}
 		if c.Sieve.MaxScriptsPerUser < 1 {
-			return fmt.Errorf("sieve.max_scripts_per_user must be at least 1")
+			p.addf("sieve.max_scripts_per_user must be at least 1")
 		}
 	}
 
+	if len(p) > 0 {
+		return &ValidationError{Problems: p}
+	}
 	return nil
 }
 
+// validateDKIMKeys checks the dkim_keys of domains[i]: each needs a selector
+// and a readable key, no selector may appear twice, and dkim_selector must
+// name one of them
+func (c *Config) validateDKIMKeys(p *problems, i int, domain DomainConfig) {
+	if len(domain.DKIMKeys) == 0 {
+		return
+	}
+	for j, key := range domain.DKIMKeys {
+		if key.Selector == "" {
+			p.addf("domains[%d].dkim_keys[%d].selector is required", i, j)
+		}
+		if key.KeyFile == "" {
+			p.addf("domains[%d].dkim_keys[%d].key_file is required", i, j)
+		} else if err := validateFileReadable(key.KeyFile); err != nil {
+			p.addf("domains[%d].dkim_keys[%d].key_file: %w", i, j, err)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, key := range domain.AllDKIMKeys() {
+		if key.Selector != "" && seen[key.Selector] {
+			p.addf("domains[%d]: DKIM selector %q is configured more than once", i, key.Selector)
+		}
+		seen[key.Selector] = true
+	}
+	if active := domain.ActiveDKIMSelector(); active != "" && !seen[active] {
+		p.addf("domains[%d].dkim_selector %q does not match any of dkim_keys", i, active)
+	}
+}
+
 // validatePorts ensures all port configurations are valid
-func (c *Config) validatePorts() error {
+func (c *Config) validatePorts(p *problems) {
 	ports := map[string]int{
 		"server.smtp_port":       c.Server.SMTPPort,
 		"server.submission_port": c.Server.SubmissionPort,
@@ -357,96 +1185,243 @@ func (c *Config) validatePorts() error {
 		"server.dav_port":        c.Server.DAVPort,
 	}
 
-	for name, port := range ports {
+	for _, name := range sortedKeys(ports) {
+		port := ports[name]
 		if port < 1 || port > 65535 {
-			return fmt.Errorf("%s must be between 1 and 65535 (got: %d)", name, port)
+			p.addf("%s must be between 1 and 65535 (got: %d)", name, port)
 		}
 	}
 
 	// Check for port conflicts
 	usedPorts := make(map[int]string)
-	for name, port := range ports {
+	for _, name := range sortedKeys(ports) {
+		port := ports[name]
 		if existing, ok := usedPorts[port]; ok {
-			return fmt.Errorf("port conflict: %s and %s both use port %d", name, existing, port)
+			p.addf("port conflict: %s and %s both use port %d", name, existing, port)
 		}
 		usedPorts[port] = name
 	}
-
-	return nil
 }
 
 // validateStorage ensures all storage paths are valid
-func (c *Config) validateStorage() error {
+func (c *Config) validateStorage(p *problems) {
 	if c.Storage.DataDir == "" {
-		return fmt.Errorf("storage.data_dir is required")
+		p.addf("storage.data_dir is required")
 	}
 	if c.Storage.DatabasePath == "" {
-		return fmt.Errorf("storage.database_path is required")
+		p.addf("storage.database_path is required")
 	}
 	if c.Storage.MaildirPath == "" {
-		return fmt.Errorf("storage.maildir_path is required")
+		p.addf("storage.maildir_path is required")
 	}
 
 	// Validate paths are absolute for safety
-	if !filepath.IsAbs(c.Storage.DataDir) {
-		return fmt.Errorf("storage.data_dir must be an absolute path (got: %s)", c.Storage.DataDir)
+	if c.Storage.DataDir != "" && !filepath.IsAbs(c.Storage.DataDir) {
+		p.addf("storage.data_dir must be an absolute path (got: %s)", c.Storage.DataDir)
 	}
-	if !filepath.IsAbs(c.Storage.DatabasePath) {
-		return fmt.Errorf("storage.database_path must be an absolute path (got: %s)", c.Storage.DatabasePath)
+	if c.Storage.DatabasePath != "" && !filepath.IsAbs(c.Storage.DatabasePath) {
+		p.addf("storage.database_path must be an absolute path (got: %s)", c.Storage.DatabasePath)
 	}
-	if !filepath.IsAbs(c.Storage.MaildirPath) {
-		return fmt.Errorf("storage.maildir_path must be an absolute path (got: %s)", c.Storage.MaildirPath)
+	if c.Storage.MaildirPath != "" && !filepath.IsAbs(c.Storage.MaildirPath) {
+		p.addf("storage.maildir_path must be an absolute path (got: %s)", c.Storage.MaildirPath)
 	}
 
-	return nil
+	if c.Storage.MinFreeBytes < 0 {
+		p.addf("storage.min_free_bytes cannot be negative (got: %d)", c.Storage.MinFreeBytes)
+	}
+	if c.Storage.MinFreeInodes < 0 {
+		p.addf("storage.min_free_inodes cannot be negative (got: %d)", c.Storage.MinFreeInodes)
+	}
+	if c.Storage.MaxMailboxes < 0 {
+		p.addf("storage.max_mailboxes cannot be negative (got: %d)", c.Storage.MaxMailboxes)
+	} else if c.Storage.MaxMailboxes > 0 && c.Storage.MaxMailboxes < len(c.Storage.DefaultMailboxes) {
+		p.addf("storage.max_mailboxes (%d) is less than the %d default mailboxes", c.Storage.MaxMailboxes, len(c.Storage.DefaultMailboxes))
+	}
+	if c.Storage.MaxMailboxDepth < 0 {
+		p.addf("storage.max_mailbox_depth cannot be negative (got: %d)", c.Storage.MaxMailboxDepth)
+	}
+
+	switch c.Storage.BodyStore {
+	case "", "maildir":
+	case "s3":
+		s3 := c.Storage.S3
+		if u, err := url.Parse(s3.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			p.addf("storage.s3.endpoint must be an http or https URL")
+		}
+		if s3.Region == "" {
+			p.addf("storage.s3.region is required")
+		}
+		if s3.Bucket == "" {
+			p.addf("storage.s3.bucket is required")
+		}
+		if s3.AccessKeyID == "" || s3.SecretAccessKey == "" {
+			p.addf("storage.s3.access_key_id and storage.s3.secret_access_key are required")
+		}
+	default:
+		p.addf("storage.body_store must be maildir or s3 (got: %s)", c.Storage.BodyStore)
+	}
+
+	c.validateDefaultMailboxes(p)
 }
 
-// validateTimeouts ensures all timeout configurations are valid
-func (c *Config) validateTimeouts() error {
-	timeouts := map[string]string{
-		"server.shutdown_timeout":  c.Server.ShutdownTimeout,
-		"delivery.connect_timeout": c.Delivery.ConnectTimeout,
-		"delivery.command_timeout": c.Delivery.CommandTimeout,
-		"queue.retry_max_age":      c.Queue.RetryMaxAge,
+// validateDefaultMailboxes ensures the default set has INBOX, unique names
+// and at most one mailbox per special-use attribute
+func (c *Config) validateDefaultMailboxes(p *problems) {
+	hasInbox := false
+	names := make(map[string]bool)
+	uses := make(map[string]string)
+	for i, mb := range c.Storage.DefaultMailboxes {
+		field := fmt.Sprintf("storage.default_mailboxes[%d]", i)
+		if strings.TrimSpace(mb.Name) == "" {
+			p.addf("%s.name is required", field)
+			continue
+		}
+
+		key := mb.Name
+		if strings.EqualFold(mb.Name, "INBOX") {
+			hasInbox = true
+			key = "INBOX"
+			if mb.SpecialUse != "" {
+				p.addf("%s: INBOX cannot have a special_use", field)
+			}
+		}
+		if names[key] {
+			p.addf("%s: duplicate mailbox name %q", field, mb.Name)
+		}
+		names[key] = true
+
+		if mb.SpecialUse == "" {
+			continue
+		}
+		attr := mb.SpecialUseAttr()
+		if attr == "" {
+			p.addf("%s.special_use must be one of %s (got: %s)", field, strings.Join(specialUseAttrs, ", "), mb.SpecialUse)
+			continue
+		}
+		if prev, ok := uses[attr]; ok {
+			p.addf("%s: special_use %s is already used by %q", field, attr, prev)
+			continue
+		}
+		uses[attr] = mb.Name
+	}
+	if !hasInbox {
+		p.addf("storage.default_mailboxes must include INBOX")
 	}
+}
+
+// validateHeaderRewrite checks that a header rewrite names valid fields and
+// that added values fit on one line
+func (c *Config) validateHeaderRewrite(p *problems, prefix string, rw HeaderRewriteConfig) {
+	for i, name := range rw.Remove {
+		if !validHeaderName(name) {
+			p.addf("%s.remove[%d] must be a header field name (got: %q)", prefix, i, name)
+		}
+	}
+	for i, field := range rw.Add {
+		if !validHeaderName(field.Name) {
+			p.addf("%s.add[%d].name must be a header field name (got: %q)", prefix, i, field.Name)
+		}
+		if strings.ContainsAny(field.Value, "\r\n") {
+			p.addf("%s.add[%d].value cannot contain line breaks", prefix, i)
+		}
+	}
+}
 
-	for name, timeout := range timeouts {
+// validHeaderName reports whether name is a header field name: printable
+// ASCII other than space and colon (RFC 5322 section 3.6.8)
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if name[i] < 33 || name[i] > 126 || name[i] == ':' {
+			return false
+		}
+	}
+	return true
+}
+
+// durations returns the settings holding a duration, keyed like the YAML file
+func (c *Config) durations() map[string]string {
+	return map[string]string{
+		"server.shutdown_timeout":          c.Server.ShutdownTimeout,
+		"delivery.connect_timeout":         c.Delivery.ConnectTimeout,
+		"delivery.command_timeout":         c.Delivery.CommandTimeout,
+		"delivery.rate_limit_backoff":      c.Delivery.RateLimitBackoff,
+		"queue.retry_max_age":              c.Queue.RetryMaxAge,
+		"queue.retry_initial_delay":        c.Queue.RetryInitialDelay,
+		"queue.retry_max_interval":         c.Queue.RetryMaxInterval,
+		"queue.quick_first_retry":          c.Queue.QuickFirstRetry,
+		"storage.disk_check_interval":      c.Storage.DiskCheckInterval,
+		"storage.maintenance_interval":     c.Storage.MaintenanceInterval,
+		"storage.quota_recompute_interval": c.Storage.QuotaRecomputeInterval,
+		"dns_check.interval":               c.DNSCheck.Interval,
+		"logging.trace.duration":           c.Logging.Trace.Duration,
+		"smtp.honeypot.penalty":            c.SMTP.Honeypot.Penalty,
+		"security.reputation.half_life":    c.Security.Reputation.HalfLife,
+		"security.dnsbl.timeout":           c.Security.DNSBL.Timeout,
+		"security.dnsbl.cache_ttl":         c.Security.DNSBL.CacheTTL,
+
+		"submission.sent_dedupe_window": c.Submission.SentDedupeWindow,
+	}
+}
+
+// validateTimeouts ensures all timeout configurations are valid
+func (c *Config) validateTimeouts(p *problems) {
+	timeouts := c.durations()
+	for _, name := range sortedKeys(timeouts) {
+		timeout := timeouts[name]
 		if timeout == "" {
 			continue // Optional
 		}
 		duration, err := time.ParseDuration(timeout)
 		if err != nil {
-			return fmt.Errorf("%s is invalid: %w", name, err)
+			p.addf("%s is invalid: %w", name, err)
+			continue
 		}
 		if duration < 0 {
-			return fmt.Errorf("%s cannot be negative (got: %s)", name, timeout)
+			p.addf("%s cannot be negative (got: %s)", name, timeout)
+			continue
 		}
 		if duration == 0 {
-			return fmt.Errorf("%s cannot be zero (got: %s)", name, timeout)
+			p.addf("%s cannot be zero (got: %s)", name, timeout)
+			continue
 		}
 
 		// Sanity checks for specific timeouts
 		switch name {
 		case "server.shutdown_timeout":
 			if duration > 5*time.Minute {
-				return fmt.Errorf("%s is too long, maximum is 5m (got: %s)", name, timeout)
+				p.addf("%s is too long, maximum is 5m (got: %s)", name, timeout)
 			}
 		case "delivery.connect_timeout":
 			if duration > 2*time.Minute {
-				return fmt.Errorf("%s is too long, maximum is 2m (got: %s)", name, timeout)
+				p.addf("%s is too long, maximum is 2m (got: %s)", name, timeout)
 			}
 		case "delivery.command_timeout":
 			if duration > 10*time.Minute {
-				return fmt.Errorf("%s is too long, maximum is 10m (got: %s)", name, timeout)
+				p.addf("%s is too long, maximum is 10m (got: %s)", name, timeout)
 			}
 		case "queue.retry_max_age":
 			if duration > 30*24*time.Hour {
-				return fmt.Errorf("%s is too long, maximum is 30d (got: %s)", name, timeout)
+				p.addf("%s is too long, maximum is 30d (got: %s)", name, timeout)
+			}
+		case "logging.trace.duration":
+			if duration > 24*time.Hour {
+				p.addf("%s is too long, maximum is 24h (got: %s)", name, timeout)
 			}
 		}
 	}
+}
 
-	return nil
+// sortedKeys returns m's keys in order, so problems are reported stably
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
 }
 
 // validateFileReadable checks if a file exists and is readable
@@ -477,6 +1452,49 @@ func validateFileReadable(path string) error {
 	return nil
 }
 
+// secretFile is a setting that can be read from a file instead, as Docker
+// and Kubernetes mount secrets
+type secretFile struct {
+	key   string  // The setting, e.g. queue.redis_password; the file is key_file
+	value *string // Set from the file
+	path  string
+}
+
+// secretFiles returns the settings that have a _file variant
+func (c *Config) secretFiles() []secretFile {
+	return []secretFile{
+		{"queue.redis_password", &c.Queue.RedisPassword, c.Queue.RedisPasswordFile},
+		{"storage.s3.secret_access_key", &c.Storage.S3.SecretAccessKey, c.Storage.S3.SecretAccessKeyFile},
+	}
+}
+
+// loadSecretFiles sets each secret whose _file variant is given from the
+// file, less a trailing newline. Files other users can read are warned
+// about rather than refused, as orchestrators often mount secrets so.
+func (c *Config) loadSecretFiles() error {
+	for _, s := range c.secretFiles() {
+		if s.path == "" {
+			continue
+		}
+		if *s.value != "" {
+			return fmt.Errorf("%s and %s_file are both set; use one", s.key, s.key)
+		}
+		if err := validateFileReadable(s.path); err != nil {
+			return fmt.Errorf("%s_file: %w", s.key, err)
+		}
+		data, err := os.ReadFile(s.path)
+		if err != nil {
+			return fmt.Errorf("%s_file: file is not readable: %w", s.key, err)
+		}
+		*s.value = strings.TrimRight(string(data), "\r\n")
+
+		if info, err := os.Stat(s.path); err == nil && info.Mode().Perm()&0o004 != 0 {
+			c.Warnings = append(c.Warnings, fmt.Sprintf("%s_file %s can be read by every user; restrict it with chmod o-r", s.key, s.path))
+		}
+	}
+	return nil
+}
+
 // EnsureDirectories creates necessary directories
 func (c *Config) EnsureDirectories() error {
 	dirs := []string{
@@ -512,3 +1530,69 @@ func (c *Config) GetDomain(name string) *DomainConfig {
 func (c *Config) IsManagedDomain(name string) bool {
 	return c.GetDomain(name) != nil
 }
+
+// redactedValue replaces secrets in Redacted output
+const redactedValue = "<redacted>"
+
+// Redacted returns the configuration as a map keyed like the YAML file, with
+// passwords, secrets and tokens replaced so it can be printed or logged
+func (c *Config) Redacted() map[string]any {
+	return redactStruct(reflect.ValueOf(*c))
+}
+
+func redactStruct(v reflect.Value) map[string]any {
+	out := make(map[string]any, v.NumField())
+	for i := 0; i < v.NumField(); i++ {
+		key := v.Type().Field(i).Tag.Get("koanf")
+		if key == "" || key == "-" {
+			continue
+		}
+		out[key] = redactValue(key, v.Field(i))
+	}
+	return out
+}
+
+func redactValue(key string, v reflect.Value) any {
+	switch v.Kind() {
+	case reflect.Struct:
+		return redactStruct(v)
+	case reflect.Slice:
+		items := make([]any, v.Len())
+		for i := range items {
+			items[i] = redactValue(key, v.Index(i))
+		}
+		return items
+	case reflect.String:
+		s := v.String()
+		if s == "" {
+			return s
+		}
+		if isSecretKey(key) {
+			return redactedValue
+		}
+		if strings.HasSuffix(key, "_url") {
+			return redactURL(s)
+		}
+		return s
+	}
+	return v.Interface()
+}
+
+func isSecretKey(key string) bool {
+	// Webhook URLs usually carry their credential in the path
+	for _, word := range []string{"password", "secret", "token", "webhook"} {
+		if strings.Contains(key, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactURL hides the password in a URL such as redis://:pass@host:6379
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return s
+	}
+	return u.Redacted()
+}
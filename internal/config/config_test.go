@@ -0,0 +1,452 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Server.Hostname = ""
+	cfg.Delivery.Workers = 0
+	cfg.Logging.Format = "xml"
+
+	err := cfg.Validate()
+	var verr *ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("Validate() error = %v, want *ValidationError", err)
+	}
+
+	msg := err.Error()
+	for _, want := range []string{"server.hostname is required", "delivery.workers must be at least 1", "logging.format must be one of"} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("Validate() = %q, missing %q", msg, want)
+		}
+	}
+}
+
+func TestRedactedHidesSecrets(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Queue.RedisURL = "redis://:hunter2@localhost:6379/0"
+
+	out := cfg.Redacted()
+	queue := out["queue"].(map[string]any)
+	if url := queue["redis_url"].(string); strings.Contains(url, "hunter2") {
+		t.Errorf("redis_url = %q, password not redacted", url)
+	}
+	server := out["server"].(map[string]any)
+	if server["hostname"] != cfg.Server.Hostname {
+		t.Errorf("server.hostname = %v, want %q", server["hostname"], cfg.Server.Hostname)
+	}
+}
+
+func TestValidateDNSCheck(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.DNSCheck.Interval = "often"
+	cfg.DNSCheck.WebhookURL = "hooks.example.com/abc"
+	err := cfg.Validate()
+	for _, want := range []string{"dns_check.interval", "dns_check.webhook_url must be an http or https URL"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Validate() = %v, missing %q", err, want)
+		}
+	}
+
+	cfg.DNSCheck.WebhookURL = "https://hooks.example.com/services/T000/B000/abc"
+	dnsCheck := cfg.Redacted()["dns_check"].(map[string]any)
+	if url := dnsCheck["webhook_url"].(string); strings.Contains(url, "abc") {
+		t.Errorf("webhook_url = %q, not redacted", url)
+	}
+}
+
+func TestValidateQueue(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Queue.Backend = "memory"
+	cfg.Queue.RedisURL = ""
+	if err := cfg.Validate(); err != nil && strings.Contains(err.Error(), "queue.") {
+		t.Errorf("Validate() with memory backend = %v, want no queue errors", err)
+	}
+
+	cfg.Queue.Backend = "kafka"
+	cfg.Queue.RetryMultiplier = 0.5
+	cfg.Queue.QuickFirstRetry = "soon"
+	err := cfg.Validate()
+	for _, want := range []string{
+		"queue.backend must be redis or memory",
+		"queue.retry_multiplier must be at least 1",
+		"queue.quick_first_retry",
+	} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Validate() = %v, missing %q", err, want)
+		}
+	}
+}
+
+func TestValidateTLSVersionAndSuites(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.TLS.MinVersion = "1.0"
+	cfg.TLS.CipherSuites = []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA"}
+	if err := cfg.Validate(); err != nil && strings.Contains(err.Error(), "tls.") {
+		t.Errorf("Validate() with a CBC suite for TLS 1.0 = %v, want no tls errors", err)
+	}
+
+	// The AEAD suites, which are the default, need TLS 1.2
+	for _, suites := range [][]string{nil, {"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}} {
+		cfg.TLS.CipherSuites = suites
+		if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "tls.min_version 1.0 needs a cipher suite") {
+			t.Errorf("Validate() with suites %v = %v, want the TLS 1.0 suites refused", suites, err)
+		}
+	}
+}
+
+func TestValidateDeliverySource(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Delivery.HeloName = "out1.example.com"
+	cfg.Delivery.SourceIP = "127.0.0.1"
+	if err := cfg.Validate(); err != nil && strings.Contains(err.Error(), "delivery.") {
+		t.Errorf("Validate() with a loopback source_ip = %v, want no delivery errors", err)
+	}
+
+	cfg.Delivery.HeloName = "not a hostname"
+	cfg.Delivery.SourceIP = "192.0.2.1"
+	err := cfg.Validate()
+	for _, want := range []string{
+		"delivery.helo_name must be a hostname",
+		"delivery.source_ip 192.0.2.1 is not an address of this host",
+	} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Validate() = %v, missing %q", err, want)
+		}
+	}
+}
+
+func TestValidateDefaultMailboxes(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Storage.DefaultMailboxes = []MailboxConfig{
+		{Name: "Gesendet", SpecialUse: `\Sent`},
+		{Name: "Postausgang", SpecialUse: "sent"},
+		{Name: "Vorlagen", SpecialUse: `\Templates`},
+	}
+
+	msg := cfg.Validate().Error()
+	for _, want := range []string{
+		"storage.default_mailboxes must include INBOX",
+		`storage.default_mailboxes[1]: special_use \Sent is already used by "Gesendet"`,
+		"storage.default_mailboxes[2].special_use must be one of",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("Validate() = %q, missing %q", msg, want)
+		}
+	}
+}
+
+func TestLoadReplacesDefaultMailboxes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	yaml := "storage:\n  default_mailboxes:\n    - name: INBOX\n    - name: Gesendet\n      special_use: '\\Sent'\n"
+	if err := os.WriteFile(path, []byte(yaml), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	got := cfg.Storage.DefaultMailboxes
+	if len(got) != 2 || got[1].Name != "Gesendet" || got[1].SpecialUseAttr() != `\Sent` {
+		t.Errorf("default_mailboxes = %+v, want INBOX and Gesendet only", got)
+	}
+}
+
+func TestValidateDKIMKeys(t *testing.T) {
+	dir := t.TempDir()
+	oldKey := filepath.Join(dir, "mail.pem")
+	newKey := filepath.Join(dir, "2026.pem")
+	for _, path := range []string{oldKey, newKey} {
+		if err := os.WriteFile(path, []byte("key"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := DefaultConfig()
+	cfg.Domains = []DomainConfig{{
+		Name:         "example.com",
+		DKIMSelector: "2026",
+		DKIMKeys: []DKIMKeyConfig{
+			{Selector: "mail", KeyFile: oldKey},
+			{Selector: "2026", KeyFile: newKey},
+		},
+	}}
+	if err := cfg.Validate(); err != nil && strings.Contains(err.Error(), "dkim") {
+		t.Errorf("Validate() with two selectors = %v, want no DKIM errors", err)
+	}
+	if got := cfg.Domains[0].ActiveDKIMSelector(); got != "2026" {
+		t.Errorf("ActiveDKIMSelector() = %q, want 2026", got)
+	}
+
+	cfg.Domains[0].DKIMSelector = "2027"
+	cfg.Domains[0].DKIMKeys = append(cfg.Domains[0].DKIMKeys,
+		DKIMKeyConfig{Selector: "mail", KeyFile: filepath.Join(dir, "missing.pem")})
+	err := cfg.Validate()
+	for _, want := range []string{
+		"domains[0].dkim_keys[2].key_file",
+		`DKIM selector "mail" is configured more than once`,
+		`domains[0].dkim_selector "2027" does not match any of dkim_keys`,
+	} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Validate() = %v, missing %q", err, want)
+		}
+	}
+}
+
+func TestValidateHeaderRewrite(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SMTP.Headers.Submission = HeaderRewriteConfig{
+		Remove: []string{"X-Originating-IP", "Bad Name"},
+		Add:    []HeaderField{{Name: "X-Policy", Value: "a\r\nBcc: evil@example.net"}, {Name: "X:Colon", Value: "v"}},
+	}
+	err := cfg.Validate()
+	for _, want := range []string{
+		`smtp.headers.submission.remove[1] must be a header field name (got: "Bad Name")`,
+		"smtp.headers.submission.add[0].value cannot contain line breaks",
+		`smtp.headers.submission.add[1].name must be a header field name (got: "X:Colon")`,
+	} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Validate() = %v, missing %q", err, want)
+		}
+	}
+	if err != nil && strings.Contains(err.Error(), "remove[0]") {
+		t.Errorf("Validate() rejected X-Originating-IP: %v", err)
+	}
+}
+
+func TestValidateBodyStore(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Storage.BodyStore = "s3"
+	cfg.Storage.S3.Endpoint = "minio:9000"
+	err := cfg.Validate()
+	for _, want := range []string{
+		"storage.s3.endpoint must be an http or https URL",
+		"storage.s3.bucket is required",
+		"storage.s3.access_key_id and storage.s3.secret_access_key are required",
+	} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Validate() = %v, missing %q", err, want)
+		}
+	}
+
+	cfg.Storage.S3 = S3Config{
+		Endpoint:        "http://minio:9000",
+		Region:          "us-east-1",
+		Bucket:          "mail",
+		AccessKeyID:     "minio",
+		SecretAccessKey: "minio-secret",
+	}
+	if err := cfg.Validate(); err != nil && strings.Contains(err.Error(), "storage.s3") {
+		t.Errorf("Validate() rejected a complete bucket: %v", err)
+	}
+
+	cfg.Storage.BodyStore = "gcs"
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "storage.body_store must be maildir or s3") {
+		t.Errorf("Validate() = %v, want body_store rejected", err)
+	}
+}
+
+func TestLoadUpgradesOlderConfig(t *testing.T) {
+	saved := configMigrations
+	t.Cleanup(func() { configMigrations = saved })
+	configMigrations = []configMigration{{
+		renamed:  map[string]string{"relay.networks": "smtp.relay_networks"},
+		removed:  map[string]string{"security.verify_arc": "ARC results are in Authentication-Results"},
+		defaults: map[string]any{"security.helo_check": "reject", "security.smtp_banner": "Old banner"},
+	}}
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	old := `server:
+  hostname: mail.example.com
+relay:
+  networks:
+    - 192.0.2.0/24 # The office
+security:
+  verify_arc: true
+  smtp_banner: Welcome
+`
+	if err := os.WriteFile(path, []byte(old), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cfg.ConfigVersion != CurrentVersion {
+		t.Errorf("ConfigVersion = %d, want %d", cfg.ConfigVersion, CurrentVersion)
+	}
+	if len(cfg.SMTP.RelayNetworks) != 1 || cfg.SMTP.RelayNetworks[0] != "192.0.2.0/24" {
+		t.Errorf("smtp.relay_networks = %v, want the renamed relay.networks", cfg.SMTP.RelayNetworks)
+	}
+	if cfg.Security.HELOCheck != "reject" || cfg.Security.SMTPBanner != "Welcome" {
+		t.Errorf("helo_check = %q, smtp_banner = %q, want the old default and the file's banner", cfg.Security.HELOCheck, cfg.Security.SMTPBanner)
+	}
+	if cfg.Server.Hostname != "mail.example.com" {
+		t.Errorf("server.hostname = %q, want it kept", cfg.Server.Hostname)
+	}
+	want := []string{
+		"relay.networks was renamed to smtp.relay_networks in version 2",
+		"security.verify_arc was removed in version 2 and is ignored: ARC results are in Authentication-Results",
+		"security.helo_check is set to reject, the default before version 2",
+		"the file is written for an older config_version; run 'mailserver config upgrade' to update it",
+	}
+	if strings.Join(cfg.Warnings, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Warnings = %q, want %q", cfg.Warnings, want)
+	}
+
+	// The upgraded file keeps its comments and reads the same
+	data, _ := os.ReadFile(path)
+	upgraded, _, err := Upgrade(data)
+	if err != nil {
+		t.Fatalf("Upgrade() error = %v", err)
+	}
+	for _, s := range []string{"config_version: 2\n", "# The office", "relay_networks:", "helo_check: reject"} {
+		if !strings.Contains(string(upgraded), s) {
+			t.Errorf("upgraded file lacks %q:\n%s", s, upgraded)
+		}
+	}
+	if strings.Contains(string(upgraded), "relay:") || strings.Contains(string(upgraded), "verify_arc") {
+		t.Errorf("upgraded file still has the old keys:\n%s", upgraded)
+	}
+	again, notes, err := Upgrade(upgraded)
+	if err != nil || string(again) != string(upgraded) || len(notes) != 0 {
+		t.Errorf("Upgrade() of an upgraded file = %q, %v, %v; want it unchanged", again, notes, err)
+	}
+}
+
+func TestLoadRejectsNewerConfigVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("config_version: 99\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("Load() error = %v, want config_version 99 refused", err)
+	}
+
+	// A file from before config_version reads the same as before
+	if err := os.WriteFile(path, []byte("server:\n  hostname: mail.example.com\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cfg.Server.Hostname != "mail.example.com" || len(cfg.Warnings) != 0 {
+		t.Errorf("hostname = %q, warnings = %q; want the file's hostname and no warnings", cfg.Server.Hostname, cfg.Warnings)
+	}
+}
+
+func TestEnvOverridesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	yaml := "server:\n  hostname: file.example.com\n  smtp_port: 2525\nqueue:\n  redis_url: redis://localhost:6379\n"
+	if err := os.WriteFile(path, []byte(yaml), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("MAILSERVER_SERVER_HOSTNAME", "env.example.com")
+	t.Setenv("MAILSERVER_QUEUE_REDIS_URL", "redis://:s3cret@redis:6379")
+	t.Setenv("MAILSERVER_SECURITY_REQUIRE_TLS", "false")
+	t.Setenv("MAILSERVER_SECURITY_DNSBL_THRESHOLD", "1.5")
+	t.Setenv("MAILSERVER_SMTP_RELAY_NETWORKS", "10.0.0.0/8, 192.0.2.0/24")
+	t.Setenv("MAILSERVER_DELIVERY_CONNECT_TIMEOUT", "45s")
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cfg.Server.Hostname != "env.example.com" {
+		t.Errorf("server.hostname = %q, want the environment's", cfg.Server.Hostname)
+	}
+	if cfg.Server.SMTPPort != 2525 || cfg.Server.IMAPPort != 143 {
+		t.Errorf("ports = %d, %d; want the file's and the default", cfg.Server.SMTPPort, cfg.Server.IMAPPort)
+	}
+	if cfg.Queue.RedisURL != "redis://:s3cret@redis:6379" {
+		t.Errorf("queue.redis_url = %q, want the environment's", cfg.Queue.RedisURL)
+	}
+	if cfg.Security.RequireTLS || cfg.Security.DNSBL.Threshold != 1.5 || cfg.Delivery.ConnectTimeout != "45s" {
+		t.Errorf("require_tls = %v, dnsbl.threshold = %v, connect_timeout = %q; want false, 1.5, 45s",
+			cfg.Security.RequireTLS, cfg.Security.DNSBL.Threshold, cfg.Delivery.ConnectTimeout)
+	}
+	if got := cfg.SMTP.RelayNetworks; len(got) != 2 || got[1] != "192.0.2.0/24" {
+		t.Errorf("smtp.relay_networks = %v, want both networks", got)
+	}
+
+	// Without a file the environment still applies
+	cfg, err = Load(filepath.Join(t.TempDir(), "missing.yaml"))
+	if err != nil || cfg.Server.Hostname != "env.example.com" {
+		t.Errorf("Load() without a file = %q, %v; want the environment's hostname", cfg.Server.Hostname, err)
+	}
+}
+
+func TestEnvReportsInvalidValues(t *testing.T) {
+	t.Setenv("MAILSERVER_SERVER_SMTP_PORT", "twenty-five")
+	t.Setenv("MAILSERVER_SECURITY_VERIFY_SPF", "maybe")
+	t.Setenv("MAILSERVER_QUEUE_RETRY_MAX_AGE", "a week")
+
+	_, err := Load(filepath.Join(t.TempDir(), "config.yaml"))
+	if err == nil {
+		t.Fatal("Load() error = nil, want the invalid variables reported")
+	}
+	for _, want := range []string{
+		`MAILSERVER_SERVER_SMTP_PORT="twenty-five" is invalid for server.smtp_port: want a whole number`,
+		`MAILSERVER_SECURITY_VERIFY_SPF="maybe" is invalid for security.verify_spf: want true or false`,
+		`MAILSERVER_QUEUE_RETRY_MAX_AGE="a week" is invalid for queue.retry_max_age: want a duration`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Load() error = %v, want it to contain %q", err, want)
+		}
+	}
+}
+
+func TestLoadReadsSecretFiles(t *testing.T) {
+	dir := t.TempDir()
+	secret := filepath.Join(dir, "redis_password")
+	if err := os.WriteFile(secret, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(path, []byte("queue:\n  redis_password_file: "+secret+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cfg.Queue.RedisPassword != "s3cret" {
+		t.Errorf("queue.redis_password = %q, want the file's contents without the newline", cfg.Queue.RedisPassword)
+	}
+	if len(cfg.Warnings) != 0 {
+		t.Errorf("Warnings = %q, want none for a private file", cfg.Warnings)
+	}
+
+	// A file every user can read is loaded with a warning
+	if err := os.Chmod(secret, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err = Load(path)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if len(cfg.Warnings) != 1 || !strings.Contains(cfg.Warnings[0], "queue.redis_password_file "+secret+" can be read by every user") {
+		t.Errorf("Warnings = %q, want the world-readable file named", cfg.Warnings)
+	}
+
+	// A missing file, or a secret given twice, is an error
+	t.Setenv("MAILSERVER_QUEUE_REDIS_PASSWORD_FILE", filepath.Join(dir, "missing"))
+	if _, err := Load(path); err == nil || !strings.Contains(err.Error(), "queue.redis_password_file: file does not exist") {
+		t.Errorf("Load() error = %v, want the missing file reported", err)
+	}
+	t.Setenv("MAILSERVER_QUEUE_REDIS_PASSWORD_FILE", secret)
+	t.Setenv("MAILSERVER_QUEUE_REDIS_PASSWORD", "inline")
+	if _, err := Load(path); err == nil || !strings.Contains(err.Error(), "both set") {
+		t.Errorf("Load() error = %v, want the conflict reported", err)
+	}
+}
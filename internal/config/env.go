@@ -0,0 +1,119 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/knadh/koanf/v2"
+)
+
+// EnvPrefix starts the environment variables that override config values.
+// The rest of the name is the key in capitals with dots as underscores, so
+// MAILSERVER_QUEUE_REDIS_URL sets queue.redis_url.
+const EnvPrefix = "MAILSERVER_"
+
+// envSetting is a config value an environment variable can set
+type envSetting struct {
+	key string
+	typ reflect.Type
+}
+
+// envSettings returns the settings of t by environment variable name.
+// Lists of strings are included, lists of sections such as domains aren't.
+func envSettings(t reflect.Type, prefix string, out map[string]envSetting) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("koanf")
+		if tag == "" || tag == "-" || tag == "config_version" {
+			continue
+		}
+		key := prefix + tag
+		switch {
+		case f.Type.Kind() == reflect.Struct:
+			envSettings(f.Type, key+".", out)
+		case f.Type.Kind() == reflect.Slice && f.Type.Elem().Kind() != reflect.String:
+			continue
+		default:
+			name := EnvPrefix + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+			out[name] = envSetting{key: key, typ: f.Type}
+		}
+	}
+}
+
+// applyEnv sets the values given in environ, as from os.Environ, in k over
+// those of the file. Every invalid value is reported.
+func applyEnv(k *koanf.Koanf, environ []string) error {
+	settings := make(map[string]envSetting)
+	envSettings(reflect.TypeOf(Config{}), "", settings)
+	durations := DefaultConfig().durations()
+
+	environ = append([]string(nil), environ...)
+	sort.Strings(environ)
+	var problems []string
+	for _, kv := range environ {
+		name, value, _ := strings.Cut(kv, "=")
+		s, ok := settings[name]
+		if !ok {
+			continue
+		}
+		v, err := parseEnvValue(s.typ, value)
+		if _, ok := durations[s.key]; ok && err == nil && value != "" {
+			if _, perr := time.ParseDuration(value); perr != nil {
+				err = errors.New("want a duration such as 30s or 1h")
+			}
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s=%q is invalid for %s: %v", name, value, s.key, err))
+			continue
+		}
+		k.Set(s.key, v)
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// parseEnvValue converts value to the type of a setting. Lists are
+// separated by commas.
+func parseEnvValue(t reflect.Type, value string) (any, error) {
+	v := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, errors.New("want true or false")
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, errors.New("want a whole number")
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, errors.New("want a number")
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v = reflect.ValueOf(items)
+	default:
+		return nil, fmt.Errorf("%s settings can't be set from the environment", t.Kind())
+	}
+	return v.Interface(), nil
+}
@@ -0,0 +1,190 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// CurrentVersion is the config_version of the layout this release reads.
+// A file without config_version is version 1.
+const CurrentVersion = 2
+
+// configMigration upgrades a config file by one version
+type configMigration struct {
+	renamed  map[string]string // Old key to new key, dotted like "smtp.relay_networks"
+	removed  map[string]string // Key no longer read to what replaces it
+	defaults map[string]any    // Setting whose default changed to the value older files relied on
+}
+
+// configMigrations[i] upgrades version i+1 to i+2. Renames and removals
+// must come with a migration, so older files keep working.
+var configMigrations = []configMigration{
+	// Version 1 is every file written before config_version existed; only
+	// the version number is added
+	{},
+}
+
+// Upgrade migrates config file data to CurrentVersion, keeping comments. It
+// returns the upgraded file and a note for each change; a file already at
+// CurrentVersion is returned as is, with no notes.
+func Upgrade(data []byte) ([]byte, []string, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, nil, err
+	}
+	if doc.Kind == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, nil, errors.New("config file must be a mapping of settings")
+	}
+
+	version := 1
+	if v := lookupKey(root, "config_version"); v != nil {
+		n, err := strconv.Atoi(v.Value)
+		if err != nil || n < 1 {
+			return nil, nil, fmt.Errorf("config_version must be a positive whole number (got: %s)", v.Value)
+		}
+		version = n
+	}
+	if version > CurrentVersion {
+		return nil, nil, fmt.Errorf("config_version %d is newer than this release reads (%d)", version, CurrentVersion)
+	}
+	if version == CurrentVersion {
+		return data, nil, nil
+	}
+
+	var notes []string
+	for ; version < CurrentVersion; version++ {
+		notes = append(notes, configMigrations[version-1].apply(root, version+1)...)
+	}
+	setKey(root, "config_version", &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: strconv.Itoa(CurrentVersion)})
+
+	var out bytes.Buffer
+	enc := yaml.NewEncoder(&out)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return nil, nil, err
+	}
+	enc.Close()
+	return out.Bytes(), notes, nil
+}
+
+// apply makes the changes of version to root, returning a note for each
+func (m configMigration) apply(root *yaml.Node, version int) []string {
+	var notes []string
+	for _, old := range sortedKeys(m.renamed) {
+		value := removeKey(root, old)
+		if value == nil {
+			continue
+		}
+		if lookupKey(root, m.renamed[old]) != nil {
+			notes = append(notes, fmt.Sprintf("%s was renamed to %s in version %d; both are set, so %s was dropped", old, m.renamed[old], version, old))
+			continue
+		}
+		setKey(root, m.renamed[old], value)
+		notes = append(notes, fmt.Sprintf("%s was renamed to %s in version %d", old, m.renamed[old], version))
+	}
+	for _, key := range sortedKeys(m.removed) {
+		if removeKey(root, key) != nil {
+			notes = append(notes, fmt.Sprintf("%s was removed in version %d and is ignored: %s", key, version, m.removed[key]))
+		}
+	}
+	for _, key := range sortedKeys(m.defaults) {
+		if lookupKey(root, key) != nil {
+			continue
+		}
+		var value yaml.Node
+		if err := value.Encode(m.defaults[key]); err != nil {
+			continue
+		}
+		setKey(root, key, &value)
+		notes = append(notes, fmt.Sprintf("%s is set to %v, the default before version %d", key, m.defaults[key], version))
+	}
+	return notes
+}
+
+// lookupKey returns the value of the dotted key in the mapping m, or nil
+func lookupKey(m *yaml.Node, key string) *yaml.Node {
+	for _, name := range strings.Split(key, ".") {
+		if m == nil || m.Kind != yaml.MappingNode {
+			return nil
+		}
+		var next *yaml.Node
+		for i := 0; i+1 < len(m.Content); i += 2 {
+			if m.Content[i].Value == name {
+				next = m.Content[i+1]
+			}
+		}
+		m = next
+	}
+	return m
+}
+
+// setKey sets the dotted key in the mapping m to value, adding the
+// mappings on the way. A new key at the top goes first, one further down last.
+func setKey(m *yaml.Node, key string, value *yaml.Node) {
+	names := strings.Split(key, ".")
+	for i, name := range names {
+		next := value
+		if i < len(names)-1 {
+			next = &yaml.Node{Kind: yaml.MappingNode}
+		}
+		found := false
+		for j := 0; j+1 < len(m.Content); j += 2 {
+			if m.Content[j].Value != name {
+				continue
+			}
+			found = true
+			if next != value && m.Content[j+1].Kind == yaml.MappingNode {
+				next = m.Content[j+1]
+			} else {
+				m.Content[j+1] = next
+			}
+			break
+		}
+		if !found {
+			pair := []*yaml.Node{{Kind: yaml.ScalarNode, Tag: "!!str", Value: name}, next}
+			if len(names) == 1 {
+				// Keep the comment heading the file at the top
+				if len(m.Content) > 0 {
+					pair[0].HeadComment, m.Content[0].HeadComment = m.Content[0].HeadComment, ""
+				}
+				m.Content = append(pair, m.Content...)
+			} else {
+				m.Content = append(m.Content, pair...)
+			}
+		}
+		m = next
+	}
+}
+
+// removeKey deletes the dotted key from the mapping m and returns its
+// value, or nil when it isn't set. Mappings it leaves empty are removed too.
+func removeKey(m *yaml.Node, key string) *yaml.Node {
+	name, rest, nested := strings.Cut(key, ".")
+	if m == nil || m.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value != name {
+			continue
+		}
+		value := m.Content[i+1]
+		if nested {
+			value = removeKey(value, rest)
+			if value == nil || len(m.Content[i+1].Content) > 0 {
+				return value
+			}
+		}
+		m.Content = append(m.Content[:i], m.Content[i+2:]...)
+		return value
+	}
+	return nil
+}
@@ -18,6 +18,10 @@ type CalDAVBackend struct {
 var (
 	// ErrRandomGeneration is returned when random number generation fails
 	ErrRandomGeneration = errors.New("failed to generate random data")
+
+	// ErrETagMismatch is returned when a conditional update finds the
+	// resource changed since the client read it
+	ErrETagMismatch = errors.New("ETag does not match")
 )
 
 // NewCalDAVBackend creates a new CalDAV backend
@@ -168,6 +172,28 @@ func (b *CalDAVBackend) UpdateCalendar(ctx context.Context, uid string, name, de
 	return nil
 }
 
+// UpdateCalendarProperties saves a calendar's name, description, color and
+// timezone as set on cal
+func (b *CalDAVBackend) UpdateCalendarProperties(ctx context.Context, cal *Calendar) error {
+	cal.CTag = generateCTag()
+
+	result, err := b.db.ExecContext(ctx,
+		`UPDATE calendars SET name = ?, description = ?, color = ?, timezone = ?, ctag = ?, updated_at = CURRENT_TIMESTAMP
+		 WHERE uid = ?`,
+		cal.Name, cal.Description, cal.Color, cal.Timezone, cal.CTag, cal.UID,
+	)
+	if err != nil {
+		return err
+	}
+
+	affected, _ := result.RowsAffected()
+	if affected == 0 {
+		return fmt.Errorf("calendar not found: %s", cal.UID)
+	}
+
+	return nil
+}
+
 // DeleteCalendar removes a calendar and all its events
 func (b *CalDAVBackend) DeleteCalendar(ctx context.Context, uid string) error {
 	result, err := b.db.ExecContext(ctx, "DELETE FROM calendars WHERE uid = ?", uid)
@@ -328,6 +354,13 @@ func (b *CalDAVBackend) ListEventsInRange(ctx context.Context, calendarUID strin
 
 // UpdateEvent updates an existing event
 func (b *CalDAVBackend) UpdateEvent(ctx context.Context, calendarUID string, event *CalendarEvent) error {
+	return b.UpdateEventIfMatch(ctx, calendarUID, event, "")
+}
+
+// UpdateEventIfMatch updates an existing event only if its stored ETag is
+// still ifMatch, so two clients editing the same event can't overwrite each
+// other. An empty ifMatch updates unconditionally.
+func (b *CalDAVBackend) UpdateEventIfMatch(ctx context.Context, calendarUID string, event *CalendarEvent, ifMatch string) error {
 	etag, err := generateETag()
 	if err != nil {
 		return fmt.Errorf("failed to generate ETag: %w", err)
@@ -337,9 +370,10 @@ func (b *CalDAVBackend) UpdateEvent(ctx context.Context, calendarUID string, eve
 	result, err := b.db.ExecContext(ctx,
 		`UPDATE calendar_events SET etag = ?, icalendar_data = ?, summary = ?, description = ?,
 		        location = ?, start_time = ?, end_time = ?, all_day = ?, recurrence_rule = ?, updated_at = CURRENT_TIMESTAMP
-		 WHERE uid = ? AND calendar_id = (SELECT id FROM calendars WHERE uid = ?)`,
+		 WHERE uid = ? AND calendar_id = (SELECT id FROM calendars WHERE uid = ?) AND (? = '' OR etag = ?)`,
 		event.ETag, event.ICalendarData, event.Summary, event.Description, event.Location,
 		event.StartTime, event.EndTime, event.AllDay, event.Recurrence, event.UID, calendarUID,
+		ifMatch, ifMatch,
 	)
 	if err != nil {
 		return fmt.Errorf("failed to update event: %w", err)
@@ -350,6 +384,9 @@ func (b *CalDAVBackend) UpdateEvent(ctx context.Context, calendarUID string, eve
 		return fmt.Errorf("failed to get affected rows: %w", err)
 	}
 	if affected == 0 {
+		if ifMatch != "" {
+			return fmt.Errorf("%w: %s", ErrETagMismatch, event.UID)
+		}
 		return fmt.Errorf("event not found: %s", event.UID)
 	}
 
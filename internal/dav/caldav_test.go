@@ -3,10 +3,16 @@ package dav
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/fenilsonani/email-server/internal/auth"
 	_ "github.com/mattn/go-sqlite3"
 )
 
@@ -522,3 +528,219 @@ func TestCalDAVBackend_CascadeDelete(t *testing.T) {
 		t.Errorf("Expected 0 events after calendar deletion, got %d", len(events))
 	}
 }
+
+const meetingICS = "BEGIN:VCALENDAR\r\nVERSION:2.0\r\nBEGIN:VEVENT\r\nUID:meeting\r\n" +
+	"DTSTART:20260105T100000Z\r\nSUMMARY:Planning\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"
+
+func TestCalDAVPut_Preconditions(t *testing.T) {
+	db, cleanup := setupCalDAVTestDB(t)
+	defer cleanup()
+
+	backend, err := NewCalDAVBackend(db)
+	if err != nil {
+		t.Fatalf("NewCalDAVBackend failed: %v", err)
+	}
+	s := &Server{caldavBackend: backend}
+	cal, _ := backend.CreateCalendar(context.Background(), 1, "Work", "")
+	path := "/caldav/testuser/" + cal.UID + "/meeting.ics"
+
+	put := func(header, value string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, path, strings.NewReader(meetingICS))
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		rec := httptest.NewRecorder()
+		s.handleCalDAVPut(rec, req, nil)
+		return rec
+	}
+
+	if rec := put("If-Match", `"abc"`); rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("If-Match on a missing event = %d, want 412", rec.Code)
+	}
+	rec := put("If-None-Match", "*")
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("If-None-Match: * create = %d, want 201", rec.Code)
+	}
+	etag := rec.Header().Get("ETag")
+	if rec := put("If-None-Match", "*"); rec.Code != http.StatusPreconditionFailed || rec.Header().Get("ETag") != etag {
+		t.Errorf("If-None-Match: * on an existing event = %d, ETag %q; want 412, %q", rec.Code, rec.Header().Get("ETag"), etag)
+	}
+
+	rec = put("If-Match", etag)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("matching If-Match = %d, want 204", rec.Code)
+	}
+	current := rec.Header().Get("ETag")
+	if current == etag {
+		t.Errorf("ETag unchanged after update")
+	}
+
+	// A client still holding the first ETag would overwrite the update
+	if rec := put("If-Match", etag); rec.Code != http.StatusPreconditionFailed || rec.Header().Get("ETag") != current {
+		t.Errorf("stale If-Match = %d, ETag %q; want 412, %q", rec.Code, rec.Header().Get("ETag"), current)
+	}
+	if rec := put("If-Match", "W/"+current); rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("weak If-Match = %d, want 412", rec.Code)
+	}
+	if rec := put("If-Match", `"other", `+current); rec.Code != http.StatusNoContent {
+		t.Errorf("If-Match list naming the current ETag = %d, want 204", rec.Code)
+	}
+}
+
+func TestCalDAVBackend_UpdateEventIfMatch(t *testing.T) {
+	db, cleanup := setupCalDAVTestDB(t)
+	defer cleanup()
+
+	backend, err := NewCalDAVBackend(db)
+	if err != nil {
+		t.Fatalf("NewCalDAVBackend failed: %v", err)
+	}
+	ctx := context.Background()
+
+	cal, _ := backend.CreateCalendar(ctx, 1, "Events Calendar", "")
+	event := &CalendarEvent{UID: "race", ICalendarData: "BEGIN:VCALENDAR\nEND:VCALENDAR"}
+	backend.CreateEvent(ctx, cal.UID, event)
+	read := event.ETag
+
+	// Another client updates the event after this one read it
+	if err := backend.UpdateEventIfMatch(ctx, cal.UID, &CalendarEvent{UID: "race", ICalendarData: "first"}, read); err != nil {
+		t.Fatalf("UpdateEventIfMatch with the current ETag failed: %v", err)
+	}
+	err = backend.UpdateEventIfMatch(ctx, cal.UID, &CalendarEvent{UID: "race", ICalendarData: "second"}, read)
+	if !errors.Is(err, ErrETagMismatch) {
+		t.Errorf("UpdateEventIfMatch with a stale ETag = %v, want ErrETagMismatch", err)
+	}
+	if got, _ := backend.GetEvent(ctx, cal.UID, "race"); got.ICalendarData != "first" {
+		t.Errorf("event data = %q, want the first update kept", got.ICalendarData)
+	}
+}
+
+func TestCalDAVPropfind_CollectionAndItemProperties(t *testing.T) {
+	db, cleanup := setupCalDAVTestDB(t)
+	defer cleanup()
+
+	backend, err := NewCalDAVBackend(db)
+	if err != nil {
+		t.Fatalf("NewCalDAVBackend failed: %v", err)
+	}
+	s := &Server{caldavBackend: backend}
+	user := &auth.User{ID: 1, Email: "testuser@test.com"}
+	ctx := context.Background()
+	cal, _ := backend.CreateCalendar(ctx, 1, "Work", "")
+	data := "BEGIN:VCALENDAR\nEND:VCALENDAR"
+	backend.CreateEvent(ctx, cal.UID, &CalendarEvent{UID: "meeting", ICalendarData: data})
+
+	propfind := func(path, depth string) string {
+		req := httptest.NewRequest("PROPFIND", path, nil)
+		req.Header.Set("Depth", depth)
+		rec := httptest.NewRecorder()
+		s.handleCalDAVPropfind(rec, req, user)
+		if rec.Code != http.StatusMultiStatus {
+			t.Fatalf("PROPFIND %s = %d, want 207", path, rec.Code)
+		}
+		return rec.Body.String()
+	}
+
+	body := propfind("/calendars/testuser@test.com/"+cal.UID+"/", "0")
+	for _, want := range []string{"<C:calendar-query/>", "<C:calendar-multiget/>"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("calendar PROPFIND missing supported report %s:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "meeting.ics") {
+		t.Errorf("Depth: 0 PROPFIND listed the calendar's events")
+	}
+
+	contentLength := fmt.Sprintf("<D:getcontentlength>%d</D:getcontentlength>", len(data))
+	for _, path := range []string{
+		"/calendars/testuser@test.com/" + cal.UID + "/",
+		"/calendars/testuser@test.com/" + cal.UID + "/meeting.ics",
+	} {
+		body := propfind(path, "1")
+		if !strings.Contains(body, "meeting.ics</D:href>") || !strings.Contains(body, contentLength) ||
+			!strings.Contains(body, "<D:getlastmodified>") || !strings.Contains(body, "<D:getetag>") {
+			t.Errorf("PROPFIND %s = %s, want the event with its length, ETag and modification time", path, body)
+		}
+	}
+}
+
+func TestCalDAVProppatch_Color(t *testing.T) {
+	db, cleanup := setupCalDAVTestDB(t)
+	defer cleanup()
+
+	backend, err := NewCalDAVBackend(db)
+	if err != nil {
+		t.Fatalf("NewCalDAVBackend failed: %v", err)
+	}
+	s := &Server{caldavBackend: backend}
+	user := &auth.User{ID: 1, Email: "testuser@test.com"}
+	cal, _ := backend.CreateCalendar(context.Background(), 1, "Work", "")
+	path := "/calendars/testuser@test.com/" + cal.UID + "/"
+
+	proppatch := func(props string) string {
+		req := httptest.NewRequest("PROPPATCH", path, strings.NewReader(`<?xml version="1.0"?>
+<D:propertyupdate xmlns:D="DAV:" xmlns:I="http://apple.com/ns/ical/">
+  <D:set><D:prop>`+props+`</D:prop></D:set>
+</D:propertyupdate>`))
+		rec := httptest.NewRecorder()
+		s.handleCalDAVProppatch(rec, req, user)
+		if rec.Code != http.StatusMultiStatus {
+			t.Fatalf("PROPPATCH = %d, want 207", rec.Code)
+		}
+		return rec.Body.String()
+	}
+
+	if body := proppatch(`<I:calendar-color>#FF2968FF</I:calendar-color>`); !strings.Contains(body, "200 OK") {
+		t.Errorf("PROPPATCH calendar-color = %s, want 200 OK", body)
+	}
+
+	// One bad value fails the whole update
+	body := proppatch(`<D:displayname>Renamed</D:displayname><I:calendar-color>red</I:calendar-color>`)
+	if !strings.Contains(body, "409 Conflict") || !strings.Contains(body, "424 Failed Dependency") {
+		t.Errorf("PROPPATCH with an invalid color = %s, want 409 and 424", body)
+	}
+
+	req := httptest.NewRequest("PROPFIND", path, nil)
+	req.Header.Set("Depth", "0")
+	rec := httptest.NewRecorder()
+	s.handleCalDAVPropfind(rec, req, user)
+	if body := rec.Body.String(); !strings.Contains(body, "<I:calendar-color>#FF2968FF</I:calendar-color>") ||
+		!strings.Contains(body, "<D:displayname>Work</D:displayname>") {
+		t.Errorf("PROPFIND after PROPPATCH = %s, want the color set and the name unchanged", body)
+	}
+}
+
+func TestCalDAVProppatch_Rename(t *testing.T) {
+	db, cleanup := setupCalDAVTestDB(t)
+	defer cleanup()
+
+	backend, err := NewCalDAVBackend(db)
+	if err != nil {
+		t.Fatalf("NewCalDAVBackend failed: %v", err)
+	}
+	s := &Server{caldavBackend: backend}
+	ctx := context.Background()
+	cal, _ := backend.CreateCalendar(ctx, 1, "Work", "Old description")
+
+	req := httptest.NewRequest("PROPPATCH", "/calendars/testuser@test.com/"+cal.UID+"/", strings.NewReader(`<?xml version="1.0"?>
+<D:propertyupdate xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav">
+  <D:set><D:prop><D:displayname>Projects</D:displayname></D:prop></D:set>
+  <D:remove><D:prop><C:calendar-description/></D:prop></D:remove>
+</D:propertyupdate>`))
+	rec := httptest.NewRecorder()
+	s.handleCalDAVProppatch(rec, req, &auth.User{ID: 1, Email: "testuser@test.com"})
+
+	if rec.Code != http.StatusMultiStatus || strings.Count(rec.Body.String(), "200 OK") != 2 {
+		t.Fatalf("PROPPATCH = %d, %s; want 207 with both properties 200 OK", rec.Code, rec.Body.String())
+	}
+	updated, err := backend.GetCalendar(ctx, cal.UID)
+	if err != nil {
+		t.Fatalf("GetCalendar failed: %v", err)
+	}
+	if updated.Name != "Projects" || updated.Description != "" {
+		t.Errorf("calendar = %q, %q; want renamed to Projects with no description", updated.Name, updated.Description)
+	}
+	if updated.CTag == cal.CTag {
+		t.Error("Expected CTag to change after PROPPATCH")
+	}
+}
@@ -328,6 +328,12 @@ func (b *CardDAVBackend) SearchContacts(ctx context.Context, addressBookUID, que
 
 // UpdateContact updates an existing contact
 func (b *CardDAVBackend) UpdateContact(ctx context.Context, addressBookUID string, contact *Contact) error {
+	return b.UpdateContactIfMatch(ctx, addressBookUID, contact, "")
+}
+
+// UpdateContactIfMatch updates an existing contact only if its stored ETag
+// is still ifMatch. An empty ifMatch updates unconditionally.
+func (b *CardDAVBackend) UpdateContactIfMatch(ctx context.Context, addressBookUID string, contact *Contact, ifMatch string) error {
 	etag, err := generateETag()
 	if err != nil {
 		return fmt.Errorf("failed to generate ETag: %w", err)
@@ -337,9 +343,10 @@ func (b *CardDAVBackend) UpdateContact(ctx context.Context, addressBookUID strin
 	result, err := b.db.ExecContext(ctx,
 		`UPDATE contacts SET etag = ?, vcard_data = ?, full_name = ?, given_name = ?, family_name = ?,
 		        nickname = ?, emails = ?, phones = ?, organization = ?, updated_at = CURRENT_TIMESTAMP
-		 WHERE uid = ? AND addressbook_id = (SELECT id FROM addressbooks WHERE uid = ?)`,
+		 WHERE uid = ? AND addressbook_id = (SELECT id FROM addressbooks WHERE uid = ?) AND (? = '' OR etag = ?)`,
 		contact.ETag, contact.VCardData, contact.FullName, contact.GivenName, contact.FamilyName,
 		contact.Nickname, contact.Emails, contact.Phones, contact.Organization, contact.UID, addressBookUID,
+		ifMatch, ifMatch,
 	)
 	if err != nil {
 		return fmt.Errorf("failed to update contact: %w", err)
@@ -350,6 +357,9 @@ func (b *CardDAVBackend) UpdateContact(ctx context.Context, addressBookUID strin
 		return fmt.Errorf("failed to get affected rows: %w", err)
 	}
 	if affected == 0 {
+		if ifMatch != "" {
+			return fmt.Errorf("%w: %s", ErrETagMismatch, contact.UID)
+		}
 		return fmt.Errorf("contact not found: %s", contact.UID)
 	}
 
@@ -3,9 +3,13 @@ package dav
 import (
 	"context"
 	"database/sql"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 
+	"github.com/fenilsonani/email-server/internal/auth"
 	_ "github.com/mattn/go-sqlite3"
 )
 
@@ -529,3 +533,107 @@ func TestCardDAVBackend_MultipleAddressBooks(t *testing.T) {
 		t.Errorf("Expected 5 work contacts, got %d", len(workContacts))
 	}
 }
+
+func TestCardDAVPut_StaleIfMatch(t *testing.T) {
+	db, cleanup := setupCardDAVTestDB(t)
+	defer cleanup()
+
+	backend, err := NewCardDAVBackend(db)
+	if err != nil {
+		t.Fatalf("NewCardDAVBackend failed: %v", err)
+	}
+	s := &Server{carddavBackend: backend}
+	ab, _ := backend.CreateAddressBook(context.Background(), 1, "Contacts", "")
+	path := "/carddav/testuser/" + ab.UID + "/john.vcf"
+
+	put := func(ifMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, path, strings.NewReader("BEGIN:VCARD\nVERSION:3.0\nUID:john\nFN:John Doe\nN:Doe;John;;;\nEND:VCARD"))
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		rec := httptest.NewRecorder()
+		s.handleCardDAVPut(rec, req, nil)
+		return rec
+	}
+
+	rec := put("")
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create = %d, want 201", rec.Code)
+	}
+	read := rec.Header().Get("ETag")
+	rec = put(read)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("matching If-Match = %d, want 204", rec.Code)
+	}
+	current := rec.Header().Get("ETag")
+	if rec := put(read); rec.Code != http.StatusPreconditionFailed || rec.Header().Get("ETag") != current {
+		t.Errorf("stale If-Match = %d, ETag %q; want 412, %q", rec.Code, rec.Header().Get("ETag"), current)
+	}
+}
+
+func TestCardDAVPropfind_AddressBookReports(t *testing.T) {
+	db, cleanup := setupCardDAVTestDB(t)
+	defer cleanup()
+
+	backend, err := NewCardDAVBackend(db)
+	if err != nil {
+		t.Fatalf("NewCardDAVBackend failed: %v", err)
+	}
+	s := &Server{carddavBackend: backend}
+	ab, _ := backend.CreateAddressBook(context.Background(), 1, "Contacts", "")
+
+	req := httptest.NewRequest("PROPFIND", "/addressbooks/testuser@test.com/"+ab.UID+"/", nil)
+	req.Header.Set("Depth", "0")
+	rec := httptest.NewRecorder()
+	s.handleCardDAVPropfind(rec, req, &auth.User{ID: 1, Email: "testuser@test.com"})
+
+	if rec.Code != http.StatusMultiStatus || !strings.Contains(rec.Body.String(), "<A:addressbook-query/>") {
+		t.Errorf("PROPFIND = %d, %s; want the addressbook-query report advertised", rec.Code, rec.Body.String())
+	}
+
+	// Someone else's address book doesn't exist as far as this user knows
+	rec = httptest.NewRecorder()
+	s.handleCardDAVPropfind(rec, req, &auth.User{ID: 2, Email: "other@test.com"})
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("PROPFIND on another user's address book = %d, want 404", rec.Code)
+	}
+}
+
+func TestCardDAVProppatch(t *testing.T) {
+	db, cleanup := setupCardDAVTestDB(t)
+	defer cleanup()
+
+	backend, err := NewCardDAVBackend(db)
+	if err != nil {
+		t.Fatalf("NewCardDAVBackend failed: %v", err)
+	}
+	s := &Server{carddavBackend: backend}
+	ctx := context.Background()
+	ab, _ := backend.CreateAddressBook(ctx, 1, "Contacts", "")
+
+	proppatch := func(props string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PROPPATCH", "/addressbooks/testuser@test.com/"+ab.UID+"/", strings.NewReader(`<?xml version="1.0"?>
+<D:propertyupdate xmlns:D="DAV:" xmlns:A="urn:ietf:params:xml:ns:carddav">
+  <D:set><D:prop>`+props+`</D:prop></D:set>
+</D:propertyupdate>`))
+		rec := httptest.NewRecorder()
+		s.handleCardDAVProppatch(rec, req, &auth.User{ID: 1, Email: "testuser@test.com"})
+		return rec
+	}
+
+	rec := proppatch(`<D:displayname>Family</D:displayname><A:addressbook-description>Relatives</A:addressbook-description>`)
+	if rec.Code != http.StatusMultiStatus || strings.Count(rec.Body.String(), "200 OK") != 2 {
+		t.Fatalf("PROPPATCH = %d, %s; want 207 with both properties 200 OK", rec.Code, rec.Body.String())
+	}
+
+	// A protected property is refused, and with it the rest of the update
+	rec = proppatch(`<D:displayname>Friends</D:displayname><D:getetag>"x"</D:getetag>`)
+	if body := rec.Body.String(); !strings.Contains(body, "403 Forbidden") || !strings.Contains(body, "424 Failed Dependency") {
+		t.Errorf("PROPPATCH of getetag = %s, want 403 and 424", body)
+	}
+
+	updated, _ := backend.GetAddressBook(ctx, ab.UID)
+	if updated.Name != "Family" || updated.Description != "Relatives" {
+		t.Errorf("address book = %q, %q; want Family, Relatives", updated.Name, updated.Description)
+	}
+}
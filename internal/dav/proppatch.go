@@ -0,0 +1,215 @@
+package dav
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/fenilsonani/email-server/internal/auth"
+)
+
+const (
+	nsDAV       = "DAV:"
+	nsCalDAV    = "urn:ietf:params:xml:ns:caldav"
+	nsCardDAV   = "urn:ietf:params:xml:ns:carddav"
+	nsAppleICal = "http://apple.com/ns/ical/"
+
+	// Column defaults from the calendars table, restored when a client
+	// removes the property
+	defaultCalendarColor    = "#0066CC"
+	defaultCalendarTimezone = "UTC"
+)
+
+// calendarColorPattern matches #RRGGBB and Apple's #RRGGBBAA
+var calendarColorPattern = regexp.MustCompile(`^#[0-9A-Fa-f]{6}([0-9A-Fa-f]{2})?$`)
+
+// propertyUpdate is a PROPPATCH request body (RFC 4918 section 14.19)
+type propertyUpdate struct {
+	XMLName xml.Name           `xml:"DAV: propertyupdate"`
+	Actions []propertyUpdateOp `xml:",any"`
+}
+
+// propertyUpdateOp is a set or remove instruction, applied in order
+type propertyUpdateOp struct {
+	XMLName xml.Name
+	Prop    struct {
+		Props []patchProp `xml:",any"`
+	} `xml:"DAV: prop"`
+}
+
+type patchProp struct {
+	XMLName xml.Name
+	Value   string `xml:",chardata"`
+}
+
+// handleCalDAVProppatch sets or removes a calendar's display name,
+// description, color and timezone
+func (s *Server) handleCalDAVProppatch(w http.ResponseWriter, r *http.Request, user *auth.User) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) != 3 {
+		http.Error(w, "Properties can only be changed on a calendar", http.StatusForbidden)
+		return
+	}
+
+	ctx := r.Context()
+	cal, err := s.caldavBackend.GetCalendar(ctx, parts[2])
+	if err != nil || cal.UserID != user.ID {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	s.proppatch(w, r, func(prop patchProp, remove bool) int {
+		return applyCalendarProp(cal, prop, remove)
+	}, func() error {
+		return s.caldavBackend.UpdateCalendarProperties(ctx, cal)
+	})
+}
+
+// handleCardDAVProppatch sets or removes an address book's display name and
+// description
+func (s *Server) handleCardDAVProppatch(w http.ResponseWriter, r *http.Request, user *auth.User) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) != 3 {
+		http.Error(w, "Properties can only be changed on an address book", http.StatusForbidden)
+		return
+	}
+
+	ctx := r.Context()
+	ab, err := s.carddavBackend.GetAddressBook(ctx, parts[2])
+	if err != nil || ab.UserID != user.ID {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	s.proppatch(w, r, func(prop patchProp, remove bool) int {
+		return applyAddressBookProp(ab, prop, remove)
+	}, func() error {
+		return s.carddavBackend.UpdateAddressBook(ctx, ab.UID, ab.Name, ab.Description)
+	})
+}
+
+// proppatch applies a PROPPATCH body with apply, which sets or removes one
+// property on the collection and returns its status, then saves the
+// collection. As RFC 4918 requires, either every instruction is applied or
+// none is: one the server can't honor fails with its own status and the
+// rest with 424 Failed Dependency.
+func (s *Server) proppatch(w http.ResponseWriter, r *http.Request, apply func(patchProp, bool) int, save func() error) {
+	data, err := safeReadBody(r, maxRequestBodySize)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	var update propertyUpdate
+	if err := xml.Unmarshal(data, &update); err != nil {
+		http.Error(w, "Invalid propertyupdate body", http.StatusBadRequest)
+		return
+	}
+
+	var props []patchProp
+	var statuses []int
+	failed := false
+	for _, op := range update.Actions {
+		if op.XMLName.Space != nsDAV || (op.XMLName.Local != "set" && op.XMLName.Local != "remove") {
+			continue
+		}
+		for _, prop := range op.Prop.Props {
+			status := apply(prop, op.XMLName.Local == "remove")
+			failed = failed || status != http.StatusOK
+			props = append(props, prop)
+			statuses = append(statuses, status)
+		}
+	}
+
+	if failed {
+		for i, status := range statuses {
+			if status == http.StatusOK {
+				statuses[i] = http.StatusFailedDependency
+			}
+		}
+	} else if len(props) > 0 {
+		if err := save(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	var responses strings.Builder
+	fmt.Fprintf(&responses, `<?xml version="1.0" encoding="UTF-8"?>
+<D:multistatus xmlns:D="DAV:">
+  <D:response>
+    <D:href>%s</D:href>`, escapeXML(r.URL.Path))
+	for i, prop := range props {
+		fmt.Fprintf(&responses, `
+    <D:propstat>
+      <D:prop><X:%s xmlns:X="%s"/></D:prop>
+      <D:status>HTTP/1.1 %d %s</D:status>
+    </D:propstat>`, prop.XMLName.Local, escapeXML(prop.XMLName.Space), statuses[i], http.StatusText(statuses[i]))
+	}
+	responses.WriteString(`
+  </D:response>
+</D:multistatus>`)
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	w.Write([]byte(responses.String()))
+}
+
+// applyCalendarProp sets or removes one property on cal, returning the
+// status to report for it
+func applyCalendarProp(cal *Calendar, prop patchProp, remove bool) int {
+	value := strings.TrimSpace(prop.Value)
+	switch prop.XMLName {
+	case xml.Name{Space: nsDAV, Local: "displayname"}:
+		if remove || value == "" {
+			return http.StatusForbidden
+		}
+		cal.Name = value
+	case xml.Name{Space: nsCalDAV, Local: "calendar-description"}:
+		if remove {
+			value = ""
+		}
+		cal.Description = value
+	case xml.Name{Space: nsAppleICal, Local: "calendar-color"}:
+		if remove {
+			value = defaultCalendarColor
+		}
+		if !calendarColorPattern.MatchString(value) {
+			return http.StatusConflict
+		}
+		cal.Color = value
+	case xml.Name{Space: nsCalDAV, Local: "calendar-timezone"}:
+		// A VCALENDAR holding the calendar's VTIMEZONE (RFC 4791 section 5.2.2)
+		if remove {
+			value = defaultCalendarTimezone
+		} else if !isValidICalendar(value) || !strings.Contains(value, "BEGIN:VTIMEZONE") {
+			return http.StatusConflict
+		}
+		cal.Timezone = value
+	default:
+		return http.StatusForbidden
+	}
+	return http.StatusOK
+}
+
+// applyAddressBookProp sets or removes one property on ab, returning the
+// status to report for it
+func applyAddressBookProp(ab *AddressBook, prop patchProp, remove bool) int {
+	value := strings.TrimSpace(prop.Value)
+	switch prop.XMLName {
+	case xml.Name{Space: nsDAV, Local: "displayname"}:
+		if remove || value == "" {
+			return http.StatusForbidden
+		}
+		ab.Name = value
+	case xml.Name{Space: nsCardDAV, Local: "addressbook-description"}:
+		if remove {
+			value = ""
+		}
+		ab.Description = value
+	default:
+		return http.StatusForbidden
+	}
+	return http.StatusOK
+}
@@ -11,6 +11,7 @@ import (
 	"log"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/fenilsonani/email-server/internal/auth"
 	"github.com/fenilsonani/email-server/internal/config"
@@ -130,7 +131,8 @@ func (s *Server) authMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
-		user, err := s.authenticator.Authenticate(r.Context(), username, password)
+		user, err := s.authenticator.AuthenticateClient(r.Context(), username, password)
+		s.authenticator.RecordAuth("dav", username, r.RemoteAddr, user, err)
 		if err != nil {
 			log.Printf("DAV authentication failed for user %s from %s: %v", username, r.RemoteAddr, err)
 			w.Header().Set("WWW-Authenticate", `Basic realm="Mail Server"`)
@@ -323,6 +325,8 @@ func (s *Server) handleCalDAV(w http.ResponseWriter, r *http.Request) {
 		s.handleCalDAVPut(w, r, user)
 	case "DELETE":
 		s.handleCalDAVDelete(w, r, user)
+	case "PROPPATCH":
+		s.handleCalDAVProppatch(w, r, user)
 	case "MKCALENDAR":
 		s.handleMkCalendar(w, r, user)
 	default:
@@ -332,13 +336,19 @@ func (s *Server) handleCalDAV(w http.ResponseWriter, r *http.Request) {
 
 // handleCalDAVOptions returns supported methods
 func (s *Server) handleCalDAVOptions(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Allow", "OPTIONS, GET, PUT, DELETE, PROPFIND, REPORT, MKCALENDAR")
+	w.Header().Set("Allow", "OPTIONS, GET, PUT, DELETE, PROPFIND, PROPPATCH, REPORT, MKCALENDAR")
 	w.Header().Set("DAV", "1, 2, 3, calendar-access")
 	w.WriteHeader(http.StatusOK)
 }
 
 // handleCalDAVPropfind handles PROPFIND for calendars
 func (s *Server) handleCalDAVPropfind(w http.ResponseWriter, r *http.Request, user *auth.User) {
+	// A PROPFIND on one calendar or event describes it rather than the home
+	if parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/"); len(parts) >= 3 {
+		s.handleCalendarPropfind(w, r, user, parts[2], parts[3:])
+		return
+	}
+
 	ctx := r.Context()
 	calendars, err := s.caldavBackend.ListCalendars(ctx, user.ID)
 	if err != nil {
@@ -349,7 +359,7 @@ func (s *Server) handleCalDAVPropfind(w http.ResponseWriter, r *http.Request, us
 	// Build response
 	var responses strings.Builder
 	responses.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
-<D:multistatus xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav" xmlns:CS="http://calendarserver.org/ns/">`)
+<D:multistatus xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav" xmlns:CS="http://calendarserver.org/ns/" xmlns:I="http://apple.com/ns/ical/">`)
 
 	// Calendar home
 	homeURL := fmt.Sprintf("/calendars/%s/", user.Email)
@@ -376,8 +386,72 @@ func (s *Server) handleCalDAVPropfind(w http.ResponseWriter, r *http.Request, us
 
 	// Each calendar
 	for _, cal := range calendars {
-		calURL := fmt.Sprintf("/calendars/%s/%s/", user.Email, cal.UID)
-		responses.WriteString(fmt.Sprintf(`
+		writeCalendarResponse(&responses, user, cal)
+	}
+
+	responses.WriteString(`
+</D:multistatus>`)
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	w.Write([]byte(responses.String()))
+}
+
+// handleCalendarPropfind handles PROPFIND on a calendar, listing its events
+// unless Depth is 0, or on one event (rest holds its file name)
+func (s *Server) handleCalendarPropfind(w http.ResponseWriter, r *http.Request, user *auth.User, calendarUID string, rest []string) {
+	ctx := r.Context()
+	cal, err := s.caldavBackend.GetCalendar(ctx, calendarUID)
+	if err != nil || cal.UserID != user.ID {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	var responses strings.Builder
+	responses.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<D:multistatus xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav" xmlns:CS="http://calendarserver.org/ns/" xmlns:I="http://apple.com/ns/ical/">`)
+
+	var events []*CalendarEvent
+	if len(rest) > 0 && rest[0] != "" {
+		event, err := s.caldavBackend.GetEvent(ctx, cal.UID, strings.TrimSuffix(rest[0], ".ics"))
+		if err != nil {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		events = append(events, event)
+	} else {
+		writeCalendarResponse(&responses, user, cal)
+		if r.Header.Get("Depth") != "0" {
+			if events, err = s.caldavBackend.ListEvents(ctx, cal.UID); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+	for _, event := range events {
+		eventURL := fmt.Sprintf("/calendars/%s/%s/%s.ics", user.Email, cal.UID, event.UID)
+		writeItemResponse(&responses, eventURL, event.ETag, "text/calendar; charset=utf-8",
+			len(event.ICalendarData), event.UpdatedAt)
+	}
+
+	responses.WriteString(`
+</D:multistatus>`)
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	w.Write([]byte(responses.String()))
+}
+
+// writeCalendarResponse writes the PROPFIND response for a calendar
+func writeCalendarResponse(b *strings.Builder, user *auth.User, cal *Calendar) {
+	calURL := fmt.Sprintf("/calendars/%s/%s/", user.Email, cal.UID)
+	// The column holds a bare zone name until a client sets a VTIMEZONE
+	var timezone string
+	if isValidICalendar(cal.Timezone) {
+		timezone = fmt.Sprintf(`
+        <C:calendar-timezone>%s</C:calendar-timezone>`, escapeXML(cal.Timezone))
+	}
+	fmt.Fprintf(b, `
   <D:response>
     <D:href>%s</D:href>
     <D:propstat>
@@ -389,22 +463,37 @@ func (s *Server) handleCalDAVPropfind(w http.ResponseWriter, r *http.Request, us
         <D:displayname>%s</D:displayname>
         <CS:getctag>%s</CS:getctag>
         <C:calendar-description>%s</C:calendar-description>
+        <I:calendar-color>%s</I:calendar-color>%s
         <C:supported-calendar-component-set>
           <C:comp name="VEVENT"/>
           <C:comp name="VTODO"/>
         </C:supported-calendar-component-set>
+        <D:supported-report-set>
+          <D:supported-report><D:report><C:calendar-query/></D:report></D:supported-report>
+          <D:supported-report><D:report><C:calendar-multiget/></D:report></D:supported-report>
+        </D:supported-report-set>
       </D:prop>
       <D:status>HTTP/1.1 200 OK</D:status>
     </D:propstat>
-  </D:response>`, calURL, cal.Name, cal.CTag, cal.Description))
-	}
-
-	responses.WriteString(`
-</D:multistatus>`)
+  </D:response>`, calURL, escapeXML(cal.Name), cal.CTag, escapeXML(cal.Description), escapeXML(cal.Color), timezone)
+}
 
-	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
-	w.WriteHeader(http.StatusMultiStatus)
-	w.Write([]byte(responses.String()))
+// writeItemResponse writes the PROPFIND response for an event or contact
+func writeItemResponse(b *strings.Builder, href, etag, contentType string, length int, modified time.Time) {
+	fmt.Fprintf(b, `
+  <D:response>
+    <D:href>%s</D:href>
+    <D:propstat>
+      <D:prop>
+        <D:resourcetype/>
+        <D:getetag>%s</D:getetag>
+        <D:getcontenttype>%s</D:getcontenttype>
+        <D:getcontentlength>%d</D:getcontentlength>
+        <D:getlastmodified>%s</D:getlastmodified>
+      </D:prop>
+      <D:status>HTTP/1.1 200 OK</D:status>
+    </D:propstat>
+  </D:response>`, href, escapeXML(etag), contentType, length, modified.UTC().Format(http.TimeFormat))
 }
 
 // handleCalDAVReport handles REPORT requests for calendar queries
@@ -505,7 +594,11 @@ func (s *Server) handleCalDAVPut(w http.ResponseWriter, r *http.Request, user *a
 
 	// Validate iCalendar data format
 	if !isValidICalendar(icalData) {
-		http.Error(w, "Invalid iCalendar data", http.StatusBadRequest)
+		http.Error(w, "Expected iCalendar data", http.StatusUnsupportedMediaType)
+		return
+	}
+	if err := validateICalendar(icalData, eventUID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
@@ -514,19 +607,12 @@ func (s *Server) handleCalDAVPut(w http.ResponseWriter, r *http.Request, user *a
 	// Try to get existing event
 	existing, _ := s.caldavBackend.GetEvent(ctx, calendarUID, eventUID)
 
-	// Check If-Match header for conditional updates
-	ifMatch := r.Header.Get("If-Match")
-	if ifMatch != "" && existing != nil {
-		if ifMatch != existing.ETag && ifMatch != "*" {
-			http.Error(w, "Precondition failed", http.StatusPreconditionFailed)
-			return
-		}
+	// Honor If-Match and If-None-Match against the stored ETag
+	var currentETag string
+	if existing != nil {
+		currentETag = existing.ETag
 	}
-
-	// Check If-None-Match header (prevent overwriting)
-	ifNoneMatch := r.Header.Get("If-None-Match")
-	if ifNoneMatch == "*" && existing != nil {
-		http.Error(w, "Resource already exists", http.StatusPreconditionFailed)
+	if !checkPreconditions(w, r, currentETag) {
 		return
 	}
 
@@ -537,11 +623,24 @@ func (s *Server) handleCalDAVPut(w http.ResponseWriter, r *http.Request, user *a
 
 	var updateErr error
 	if existing != nil {
-		updateErr = s.caldavBackend.UpdateEvent(ctx, calendarUID, event)
+		// With If-Match, the update itself checks the ETag again so a
+		// concurrent edit between the check and the write isn't lost
+		var ifMatch string
+		if r.Header.Get("If-Match") != "" {
+			ifMatch = existing.ETag
+		}
+		updateErr = s.caldavBackend.UpdateEventIfMatch(ctx, calendarUID, event, ifMatch)
 	} else {
 		updateErr = s.caldavBackend.CreateEvent(ctx, calendarUID, event)
 	}
 
+	if errors.Is(updateErr, ErrETagMismatch) {
+		if current, err := s.caldavBackend.GetEvent(ctx, calendarUID, eventUID); err == nil {
+			w.Header().Set("ETag", current.ETag)
+		}
+		http.Error(w, "Precondition failed", http.StatusPreconditionFailed)
+		return
+	}
 	if updateErr != nil {
 		http.Error(w, updateErr.Error(), http.StatusInternalServerError)
 		return
@@ -634,6 +733,8 @@ func (s *Server) handleCardDAV(w http.ResponseWriter, r *http.Request) {
 		s.handleCardDAVPut(w, r, user)
 	case "DELETE":
 		s.handleCardDAVDelete(w, r, user)
+	case "PROPPATCH":
+		s.handleCardDAVProppatch(w, r, user)
 	case "MKCOL":
 		s.handleMkAddressBook(w, r, user)
 	default:
@@ -643,13 +744,20 @@ func (s *Server) handleCardDAV(w http.ResponseWriter, r *http.Request) {
 
 // handleCardDAVOptions returns supported methods
 func (s *Server) handleCardDAVOptions(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Allow", "OPTIONS, GET, PUT, DELETE, PROPFIND, REPORT, MKCOL")
+	w.Header().Set("Allow", "OPTIONS, GET, PUT, DELETE, PROPFIND, PROPPATCH, REPORT, MKCOL")
 	w.Header().Set("DAV", "1, 2, 3, addressbook")
 	w.WriteHeader(http.StatusOK)
 }
 
 // handleCardDAVPropfind handles PROPFIND for address books
 func (s *Server) handleCardDAVPropfind(w http.ResponseWriter, r *http.Request, user *auth.User) {
+	// A PROPFIND on one address book or contact describes it rather than
+	// the home
+	if parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/"); len(parts) >= 3 {
+		s.handleAddressBookPropfind(w, r, user, parts[2], parts[3:])
+		return
+	}
+
 	ctx := r.Context()
 	addressBooks, err := s.carddavBackend.ListAddressBooks(ctx, user.ID)
 	if err != nil {
@@ -686,8 +794,67 @@ func (s *Server) handleCardDAVPropfind(w http.ResponseWriter, r *http.Request, u
 
 	// Each address book
 	for _, ab := range addressBooks {
-		abURL := fmt.Sprintf("/addressbooks/%s/%s/", user.Email, ab.UID)
-		responses.WriteString(fmt.Sprintf(`
+		writeAddressBookResponse(&responses, user, ab)
+	}
+
+	responses.WriteString(`
+</D:multistatus>`)
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	w.Write([]byte(responses.String()))
+}
+
+// handleAddressBookPropfind handles PROPFIND on an address book, listing
+// its contacts unless Depth is 0, or on one contact (rest holds its file
+// name)
+func (s *Server) handleAddressBookPropfind(w http.ResponseWriter, r *http.Request, user *auth.User, addressBookUID string, rest []string) {
+	ctx := r.Context()
+	ab, err := s.carddavBackend.GetAddressBook(ctx, addressBookUID)
+	if err != nil || ab.UserID != user.ID {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	var responses strings.Builder
+	responses.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<D:multistatus xmlns:D="DAV:" xmlns:A="urn:ietf:params:xml:ns:carddav" xmlns:CS="http://calendarserver.org/ns/">`)
+
+	var contacts []*Contact
+	if len(rest) > 0 && rest[0] != "" {
+		contact, err := s.carddavBackend.GetContact(ctx, ab.UID, strings.TrimSuffix(rest[0], ".vcf"))
+		if err != nil {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		contacts = append(contacts, contact)
+	} else {
+		writeAddressBookResponse(&responses, user, ab)
+		if r.Header.Get("Depth") != "0" {
+			if contacts, err = s.carddavBackend.ListContacts(ctx, ab.UID); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+	for _, contact := range contacts {
+		contactURL := fmt.Sprintf("/addressbooks/%s/%s/%s.vcf", user.Email, ab.UID, contact.UID)
+		writeItemResponse(&responses, contactURL, contact.ETag, "text/vcard; charset=utf-8",
+			len(contact.VCardData), contact.UpdatedAt)
+	}
+
+	responses.WriteString(`
+</D:multistatus>`)
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	w.Write([]byte(responses.String()))
+}
+
+// writeAddressBookResponse writes the PROPFIND response for an address book
+func writeAddressBookResponse(b *strings.Builder, user *auth.User, ab *AddressBook) {
+	abURL := fmt.Sprintf("/addressbooks/%s/%s/", user.Email, ab.UID)
+	fmt.Fprintf(b, `
   <D:response>
     <D:href>%s</D:href>
     <D:propstat>
@@ -699,18 +866,14 @@ func (s *Server) handleCardDAVPropfind(w http.ResponseWriter, r *http.Request, u
         <D:displayname>%s</D:displayname>
         <CS:getctag>%s</CS:getctag>
         <A:addressbook-description>%s</A:addressbook-description>
+        <D:supported-report-set>
+          <D:supported-report><D:report><A:addressbook-query/></D:report></D:supported-report>
+          <D:supported-report><D:report><A:addressbook-multiget/></D:report></D:supported-report>
+        </D:supported-report-set>
       </D:prop>
       <D:status>HTTP/1.1 200 OK</D:status>
     </D:propstat>
-  </D:response>`, abURL, ab.Name, ab.CTag, ab.Description))
-	}
-
-	responses.WriteString(`
-</D:multistatus>`)
-
-	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
-	w.WriteHeader(http.StatusMultiStatus)
-	w.Write([]byte(responses.String()))
+  </D:response>`, abURL, escapeXML(ab.Name), ab.CTag, escapeXML(ab.Description))
 }
 
 // handleCardDAVReport handles REPORT requests for address book queries
@@ -810,7 +973,11 @@ func (s *Server) handleCardDAVPut(w http.ResponseWriter, r *http.Request, user *
 
 	// Validate vCard data format
 	if !isValidVCard(vcardData) {
-		http.Error(w, "Invalid vCard data", http.StatusBadRequest)
+		http.Error(w, "Expected vCard data", http.StatusUnsupportedMediaType)
+		return
+	}
+	if err := validateVCard(vcardData, contactUID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
@@ -819,19 +986,12 @@ func (s *Server) handleCardDAVPut(w http.ResponseWriter, r *http.Request, user *
 	// Try to get existing contact
 	existing, _ := s.carddavBackend.GetContact(ctx, addressBookUID, contactUID)
 
-	// Check If-Match header for conditional updates
-	ifMatch := r.Header.Get("If-Match")
-	if ifMatch != "" && existing != nil {
-		if ifMatch != existing.ETag && ifMatch != "*" {
-			http.Error(w, "Precondition failed", http.StatusPreconditionFailed)
-			return
-		}
+	// Honor If-Match and If-None-Match against the stored ETag
+	var currentETag string
+	if existing != nil {
+		currentETag = existing.ETag
 	}
-
-	// Check If-None-Match header (prevent overwriting)
-	ifNoneMatch := r.Header.Get("If-None-Match")
-	if ifNoneMatch == "*" && existing != nil {
-		http.Error(w, "Resource already exists", http.StatusPreconditionFailed)
+	if !checkPreconditions(w, r, currentETag) {
 		return
 	}
 
@@ -842,11 +1002,22 @@ func (s *Server) handleCardDAVPut(w http.ResponseWriter, r *http.Request, user *
 
 	var updateErr error
 	if existing != nil {
-		updateErr = s.carddavBackend.UpdateContact(ctx, addressBookUID, contact)
+		var ifMatch string
+		if r.Header.Get("If-Match") != "" {
+			ifMatch = existing.ETag
+		}
+		updateErr = s.carddavBackend.UpdateContactIfMatch(ctx, addressBookUID, contact, ifMatch)
 	} else {
 		updateErr = s.carddavBackend.CreateContact(ctx, addressBookUID, contact)
 	}
 
+	if errors.Is(updateErr, ErrETagMismatch) {
+		if current, err := s.carddavBackend.GetContact(ctx, addressBookUID, contactUID); err == nil {
+			w.Header().Set("ETag", current.ETag)
+		}
+		http.Error(w, "Precondition failed", http.StatusPreconditionFailed)
+		return
+	}
 	if updateErr != nil {
 		http.Error(w, updateErr.Error(), http.StatusInternalServerError)
 		return
@@ -865,6 +1036,50 @@ func (s *Server) handleCardDAVPut(w http.ResponseWriter, r *http.Request, user *
 	}
 }
 
+// checkPreconditions applies a PUT's If-Match and If-None-Match headers
+// (RFC 7232) to the stored ETag of the resource, "" if it doesn't exist yet.
+// If one fails it answers 412 with the current ETag and returns false.
+func checkPreconditions(w http.ResponseWriter, r *http.Request, etag string) bool {
+	failed := false
+	if ifMatch := r.Header.Values("If-Match"); len(ifMatch) > 0 {
+		failed = etag == "" || !etagListMatches(ifMatch, etag, false)
+	}
+	if ifNoneMatch := r.Header.Values("If-None-Match"); len(ifNoneMatch) > 0 && !failed {
+		failed = etag != "" && etagListMatches(ifNoneMatch, etag, true)
+	}
+	if failed {
+		if etag != "" {
+			w.Header().Set("ETag", etag)
+		}
+		http.Error(w, "Precondition failed", http.StatusPreconditionFailed)
+	}
+	return !failed
+}
+
+// etagListMatches reports whether If-Match or If-None-Match header values
+// name etag or are "*". If-Match compares strongly, so a weak tag never
+// matches it; If-None-Match compares weakly.
+func etagListMatches(values []string, etag string, weak bool) bool {
+	for _, value := range values {
+		for _, tag := range strings.Split(value, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" {
+				return true
+			}
+			if t, ok := strings.CutPrefix(tag, "W/"); ok {
+				if !weak {
+					continue
+				}
+				tag = t
+			}
+			if tag == etag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // handleCardDAVDelete removes a contact
 func (s *Server) handleCardDAVDelete(w http.ResponseWriter, r *http.Request, user *auth.User) {
 	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
@@ -0,0 +1,156 @@
+package dav
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Payloads are checked before they are stored, so a malformed one can't
+// break the REPORTs that return it later. This is a structural check of
+// RFC 5545 and RFC 6350 content lines, not a full parser.
+
+var (
+	// ErrInvalidObject is returned for iCalendar or vCard data that is
+	// malformed or missing a required property
+	ErrInvalidObject = errors.New("invalid object")
+
+	// ErrUIDMismatch is returned when an object's UID isn't the one in
+	// the URL it was stored at
+	ErrUIDMismatch = errors.New("UID does not match the resource name")
+)
+
+// contentLine is an unfolded content line split into its name, without
+// parameters, and value
+type contentLine struct {
+	name, value string
+}
+
+// parseContentLines unfolds data and splits it into content lines
+func parseContentLines(data string) []contentLine {
+	data = strings.ReplaceAll(data, "\r\n", "\n")
+	data = strings.ReplaceAll(data, "\n ", "")
+	data = strings.ReplaceAll(data, "\n\t", "")
+
+	var lines []contentLine
+	for _, l := range strings.Split(data, "\n") {
+		if strings.TrimSpace(l) == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(l, ":")
+		name, _, _ = strings.Cut(name, ";")
+		lines = append(lines, contentLine{name: strings.ToUpper(strings.TrimSpace(name)), value: strings.TrimSpace(value)})
+	}
+	return lines
+}
+
+// component is a BEGIN/END block and the properties directly inside it
+type component struct {
+	name  string
+	props map[string]string
+	subs  []*component
+}
+
+// parseComponents checks that BEGIN and END lines nest properly and that
+// data is a single top-level component named root, which it returns
+func parseComponents(data, root string) (*component, error) {
+	var stack []*component
+	var top *component
+	for _, l := range parseContentLines(data) {
+		switch l.name {
+		case "BEGIN":
+			if top != nil && len(stack) == 0 {
+				return nil, fmt.Errorf("%w: content after END:%s", ErrInvalidObject, top.name)
+			}
+			c := &component{name: strings.ToUpper(l.value), props: make(map[string]string)}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.subs = append(parent.subs, c)
+			} else if c.name != root {
+				return nil, fmt.Errorf("%w: expected BEGIN:%s", ErrInvalidObject, root)
+			}
+			stack = append(stack, c)
+		case "END":
+			if len(stack) == 0 || stack[len(stack)-1].name != strings.ToUpper(l.value) {
+				return nil, fmt.Errorf("%w: unmatched END:%s", ErrInvalidObject, l.value)
+			}
+			top = stack[0]
+			stack = stack[:len(stack)-1]
+		default:
+			if len(stack) == 0 {
+				return nil, fmt.Errorf("%w: property %s outside BEGIN:%s", ErrInvalidObject, l.name, root)
+			}
+			if _, ok := stack[len(stack)-1].props[l.name]; !ok {
+				stack[len(stack)-1].props[l.name] = l.value
+			}
+		}
+	}
+	if len(stack) > 0 {
+		return nil, fmt.Errorf("%w: missing END:%s", ErrInvalidObject, stack[len(stack)-1].name)
+	}
+	if top == nil {
+		return nil, fmt.Errorf("%w: expected BEGIN:%s", ErrInvalidObject, root)
+	}
+	return top, nil
+}
+
+// validateICalendar checks a calendar object resource (RFC 4791 section
+// 4.1): one VCALENDAR whose events, to-dos and journals all share a UID,
+// which must be uid, and whose events each have a DTSTART
+func validateICalendar(data, uid string) error {
+	cal, err := parseComponents(data, "VCALENDAR")
+	if err != nil {
+		return err
+	}
+
+	var objectUID string
+	for _, c := range cal.subs {
+		switch c.name {
+		case "VEVENT", "VTODO", "VJOURNAL":
+		default:
+			continue
+		}
+		u := c.props["UID"]
+		if u == "" {
+			return fmt.Errorf("%w: %s without UID", ErrInvalidObject, c.name)
+		}
+		if objectUID != "" && u != objectUID {
+			return fmt.Errorf("%w: components with different UIDs", ErrInvalidObject)
+		}
+		objectUID = u
+		if c.name == "VEVENT" && c.props["DTSTART"] == "" {
+			return fmt.Errorf("%w: VEVENT without DTSTART", ErrInvalidObject)
+		}
+	}
+	if objectUID == "" {
+		return fmt.Errorf("%w: no VEVENT, VTODO or VJOURNAL", ErrInvalidObject)
+	}
+	if objectUID != uid {
+		return fmt.Errorf("%w: %s", ErrUIDMismatch, objectUID)
+	}
+	return nil
+}
+
+// validateVCard checks an address object resource (RFC 6352 section 5.1):
+// one VCARD with FN, N before vCard 4.0, and a UID that must be uid
+func validateVCard(data, uid string) error {
+	card, err := parseComponents(data, "VCARD")
+	if err != nil {
+		return err
+	}
+
+	if card.props["FN"] == "" {
+		return fmt.Errorf("%w: VCARD without FN", ErrInvalidObject)
+	}
+	if _, ok := card.props["N"]; !ok && card.props["VERSION"] != "4.0" {
+		return fmt.Errorf("%w: VCARD without N", ErrInvalidObject)
+	}
+	objectUID := strings.TrimPrefix(card.props["UID"], "urn:uuid:")
+	if objectUID == "" {
+		return fmt.Errorf("%w: VCARD without UID", ErrInvalidObject)
+	}
+	if objectUID != uid && card.props["UID"] != uid {
+		return fmt.Errorf("%w: %s", ErrUIDMismatch, card.props["UID"])
+	}
+	return nil
+}
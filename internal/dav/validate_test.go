@@ -0,0 +1,91 @@
+package dav
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidateICalendar(t *testing.T) {
+	tests := []struct {
+		name, data string
+		want       error
+	}{
+		{"valid", meetingICS, nil},
+		{"folded and with an alarm",
+			"BEGIN:VCALENDAR\nBEGIN:VEVENT\nUID:mee\n ting\nDTSTART;TZID=Europe/Berlin:20260105T100000\n" +
+				"BEGIN:VALARM\nTRIGGER:-PT15M\nEND:VALARM\nEND:VEVENT\nEND:VCALENDAR", nil},
+		{"to-do without DTSTART", "BEGIN:VCALENDAR\nBEGIN:VTODO\nUID:meeting\nEND:VTODO\nEND:VCALENDAR", nil},
+		{"event without UID", "BEGIN:VCALENDAR\nBEGIN:VEVENT\nDTSTART:20260105T100000Z\nEND:VEVENT\nEND:VCALENDAR", ErrInvalidObject},
+		{"event without DTSTART", "BEGIN:VCALENDAR\nBEGIN:VEVENT\nUID:meeting\nEND:VEVENT\nEND:VCALENDAR", ErrInvalidObject},
+		{"no components", "BEGIN:VCALENDAR\nVERSION:2.0\nEND:VCALENDAR", ErrInvalidObject},
+		{"unmatched END", "BEGIN:VCALENDAR\nBEGIN:VEVENT\nUID:meeting\nDTSTART:20260105\nEND:VTODO\nEND:VCALENDAR", ErrInvalidObject},
+		{"unclosed", "BEGIN:VCALENDAR\nBEGIN:VEVENT\nUID:meeting\nDTSTART:20260105\nEND:VCALENDAR", ErrInvalidObject},
+		{"two calendars", meetingICS + meetingICS, ErrInvalidObject},
+		{"other UID", strings.Replace(meetingICS, "UID:meeting", "UID:lunch", 1), ErrUIDMismatch},
+	}
+	for _, tt := range tests {
+		if err := validateICalendar(tt.data, "meeting"); !errors.Is(err, tt.want) || (tt.want == nil) != (err == nil) {
+			t.Errorf("%s: validateICalendar() = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestValidateVCard(t *testing.T) {
+	tests := []struct {
+		name, data string
+		want       error
+	}{
+		{"3.0", "BEGIN:VCARD\nVERSION:3.0\nUID:john\nFN:John Doe\nN:Doe;John;;;\nEND:VCARD", nil},
+		{"4.0 without N", "BEGIN:VCARD\nVERSION:4.0\nUID:urn:uuid:john\nFN:John Doe\nEND:VCARD", nil},
+		{"3.0 without N", "BEGIN:VCARD\nVERSION:3.0\nUID:john\nFN:John Doe\nEND:VCARD", ErrInvalidObject},
+		{"without FN", "BEGIN:VCARD\nVERSION:4.0\nUID:john\nEND:VCARD", ErrInvalidObject},
+		{"without UID", "BEGIN:VCARD\nVERSION:4.0\nFN:John Doe\nEND:VCARD", ErrInvalidObject},
+		{"other UID", "BEGIN:VCARD\nVERSION:4.0\nUID:jane\nFN:John Doe\nEND:VCARD", ErrUIDMismatch},
+	}
+	for _, tt := range tests {
+		if err := validateVCard(tt.data, "john"); !errors.Is(err, tt.want) || (tt.want == nil) != (err == nil) {
+			t.Errorf("%s: validateVCard() = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestCalDAVPut_RejectsInvalidEvent(t *testing.T) {
+	db, cleanup := setupCalDAVTestDB(t)
+	defer cleanup()
+
+	backend, err := NewCalDAVBackend(db)
+	if err != nil {
+		t.Fatalf("NewCalDAVBackend failed: %v", err)
+	}
+	s := &Server{caldavBackend: backend}
+	ctx := context.Background()
+	cal, _ := backend.CreateCalendar(ctx, 1, "Work", "")
+	path := "/calendars/testuser@test.com/" + cal.UID + "/meeting.ics"
+
+	put := func(data string) int {
+		rec := httptest.NewRecorder()
+		s.handleCalDAVPut(rec, httptest.NewRequest(http.MethodPut, path, strings.NewReader(data)), nil)
+		return rec.Code
+	}
+
+	if code := put(strings.Replace(meetingICS, "UID:meeting\r\n", "", 1)); code != http.StatusBadRequest {
+		t.Errorf("PUT of a VEVENT without UID = %d, want 400", code)
+	}
+	if code := put("BEGIN:VCARD\nFN:John Doe\nEND:VCARD"); code != http.StatusUnsupportedMediaType {
+		t.Errorf("PUT of a vCard = %d, want 415", code)
+	}
+	if _, err := backend.GetEvent(ctx, cal.UID, "meeting"); err == nil {
+		t.Fatal("invalid event was stored")
+	}
+
+	if code := put(meetingICS); code != http.StatusCreated {
+		t.Fatalf("PUT of a valid event = %d, want 201", code)
+	}
+	if event, err := backend.GetEvent(ctx, cal.UID, "meeting"); err != nil || event.ICalendarData != meetingICS {
+		t.Errorf("stored event = %v, %v; want the PUT data", event, err)
+	}
+}
@@ -0,0 +1,192 @@
+package diskmon
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Usage holds the free space and inode counters for a single path
+type Usage struct {
+	Path        string `json:"path"`
+	FreeBytes   uint64 `json:"free_bytes"`
+	TotalBytes  uint64 `json:"total_bytes"`
+	FreeInodes  uint64 `json:"free_inodes"`
+	TotalInodes uint64 `json:"total_inodes"`
+	Low         bool   `json:"low"`
+}
+
+// StatFunc reports filesystem usage for a path. It is swappable for testing.
+type StatFunc func(path string) (Usage, error)
+
+// Config holds disk monitor configuration
+type Config struct {
+	Paths         []string      // Paths to watch (maildir, database, ...)
+	MinFreeBytes  uint64        // Below this many free bytes the disk is considered low
+	MinFreeInodes uint64        // Below this many free inodes the disk is considered low
+	Interval      time.Duration // How often to poll
+}
+
+// Monitor periodically polls filesystem usage and reports when free space
+// drops below the configured thresholds
+type Monitor struct {
+	cfg  Config
+	stat StatFunc
+
+	mu     sync.RWMutex
+	usage  []Usage
+	low    bool
+	onPoll func([]Usage)
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// New creates a disk monitor. A nil stat uses statfs(2).
+func New(cfg Config, stat StatFunc) *Monitor {
+	if stat == nil {
+		stat = Statfs
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 30 * time.Second
+	}
+	return &Monitor{
+		cfg:  cfg,
+		stat: stat,
+	}
+}
+
+// OnPoll registers a callback invoked with the latest usage after every poll
+func (m *Monitor) OnPoll(fn func([]Usage)) {
+	m.mu.Lock()
+	m.onPoll = fn
+	m.mu.Unlock()
+}
+
+// Check polls all paths once and updates the monitor state
+func (m *Monitor) Check() []Usage {
+	usage := make([]Usage, 0, len(m.cfg.Paths))
+	low := false
+
+	for _, path := range m.cfg.Paths {
+		u, err := m.stat(path)
+		if err != nil {
+			// Keep the previous reading rather than flapping on a transient error
+			if prev, ok := m.lookup(path); ok {
+				usage = append(usage, prev)
+				low = low || prev.Low
+			}
+			continue
+		}
+		u.Path = path
+		u.Low = m.isLow(u)
+		low = low || u.Low
+		usage = append(usage, u)
+	}
+
+	m.mu.Lock()
+	m.usage = usage
+	m.low = low
+	onPoll := m.onPoll
+	m.mu.Unlock()
+
+	if onPoll != nil {
+		onPoll(usage)
+	}
+
+	return usage
+}
+
+// Start polls immediately and then in the background until Stop is called
+func (m *Monitor) Start() {
+	m.Check()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancel = cancel
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		ticker := time.NewTicker(m.cfg.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				m.Check()
+			}
+		}
+	}()
+}
+
+// Stop stops background polling
+func (m *Monitor) Stop() {
+	if m.cancel != nil {
+		m.cancel()
+	}
+	m.wg.Wait()
+}
+
+// Low reports whether any watched path is below its free-space thresholds
+func (m *Monitor) Low() bool {
+	if m == nil {
+		return false
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.low
+}
+
+// Usage returns the most recent readings
+func (m *Monitor) Usage() []Usage {
+	if m == nil {
+		return nil
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	out := make([]Usage, len(m.usage))
+	copy(out, m.usage)
+	return out
+}
+
+func (m *Monitor) isLow(u Usage) bool {
+	if m.cfg.MinFreeBytes > 0 && u.FreeBytes < m.cfg.MinFreeBytes {
+		return true
+	}
+	// Some filesystems (e.g. btrfs) report zero inodes; ignore them
+	if m.cfg.MinFreeInodes > 0 && u.TotalInodes > 0 && u.FreeInodes < m.cfg.MinFreeInodes {
+		return true
+	}
+	return false
+}
+
+func (m *Monitor) lookup(path string) (Usage, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, u := range m.usage {
+		if u.Path == path {
+			return u, true
+		}
+	}
+	return Usage{}, false
+}
+
+// Statfs reports usage for path using statfs(2)
+func Statfs(path string) (Usage, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return Usage{}, fmt.Errorf("statfs %s: %w", path, err)
+	}
+	bsize := uint64(st.Bsize)
+	return Usage{
+		Path:        path,
+		FreeBytes:   uint64(st.Bavail) * bsize,
+		TotalBytes:  uint64(st.Blocks) * bsize,
+		FreeInodes:  uint64(st.Ffree),
+		TotalInodes: uint64(st.Files),
+	}, nil
+}
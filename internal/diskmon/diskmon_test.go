@@ -0,0 +1,120 @@
+package diskmon
+
+import (
+	"errors"
+	"testing"
+)
+
+type fakeStat struct {
+	usage map[string]Usage
+	err   error
+}
+
+func (f *fakeStat) stat(path string) (Usage, error) {
+	if f.err != nil {
+		return Usage{}, f.err
+	}
+	return f.usage[path], nil
+}
+
+func TestMonitorThresholds(t *testing.T) {
+	tests := []struct {
+		name  string
+		usage Usage
+		low   bool
+	}{
+		{"plenty of space", Usage{FreeBytes: 10 << 30, FreeInodes: 1 << 20, TotalInodes: 1 << 21}, false},
+		{"bytes below threshold", Usage{FreeBytes: 10 << 20, FreeInodes: 1 << 20, TotalInodes: 1 << 21}, true},
+		{"inodes below threshold", Usage{FreeBytes: 10 << 30, FreeInodes: 10, TotalInodes: 1 << 21}, true},
+		{"no inode accounting", Usage{FreeBytes: 10 << 30, FreeInodes: 0, TotalInodes: 0}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := &fakeStat{usage: map[string]Usage{"/data": tt.usage}}
+			m := New(Config{
+				Paths:         []string{"/data"},
+				MinFreeBytes:  100 << 20,
+				MinFreeInodes: 1000,
+			}, fs.stat)
+
+			usage := m.Check()
+			if len(usage) != 1 {
+				t.Fatalf("Check() returned %d readings, want 1", len(usage))
+			}
+			if usage[0].Path != "/data" {
+				t.Errorf("Path = %q, want /data", usage[0].Path)
+			}
+			if m.Low() != tt.low {
+				t.Errorf("Low() = %v, want %v", m.Low(), tt.low)
+			}
+		})
+	}
+}
+
+func TestMonitorAnyPathLow(t *testing.T) {
+	fs := &fakeStat{usage: map[string]Usage{
+		"/maildir": {FreeBytes: 10 << 30},
+		"/db":      {FreeBytes: 1 << 20},
+	}}
+	m := New(Config{Paths: []string{"/maildir", "/db"}, MinFreeBytes: 100 << 20}, fs.stat)
+	m.Check()
+
+	if !m.Low() {
+		t.Error("Low() should be true when any path is below threshold")
+	}
+
+	usage := m.Usage()
+	if usage[0].Low || !usage[1].Low {
+		t.Errorf("per-path Low flags = %v/%v, want false/true", usage[0].Low, usage[1].Low)
+	}
+}
+
+func TestMonitorKeepsLastReadingOnError(t *testing.T) {
+	fs := &fakeStat{usage: map[string]Usage{"/data": {FreeBytes: 1 << 20}}}
+	m := New(Config{Paths: []string{"/data"}, MinFreeBytes: 100 << 20}, fs.stat)
+	m.Check()
+
+	fs.err = errors.New("transient")
+	m.Check()
+
+	if !m.Low() {
+		t.Error("Low() should keep the previous reading when statfs fails")
+	}
+	if len(m.Usage()) != 1 {
+		t.Errorf("Usage() returned %d readings, want 1", len(m.Usage()))
+	}
+}
+
+func TestMonitorOnPoll(t *testing.T) {
+	fs := &fakeStat{usage: map[string]Usage{"/data": {FreeBytes: 42}}}
+	m := New(Config{Paths: []string{"/data"}}, fs.stat)
+
+	var got []Usage
+	m.OnPoll(func(u []Usage) { got = u })
+	m.Check()
+
+	if len(got) != 1 || got[0].FreeBytes != 42 {
+		t.Errorf("OnPoll received %+v", got)
+	}
+}
+
+func TestNilMonitor(t *testing.T) {
+	var m *Monitor
+	if m.Low() {
+		t.Error("nil monitor should never report low")
+	}
+	if m.Usage() != nil {
+		t.Error("nil monitor should report no usage")
+	}
+}
+
+func TestStatfs(t *testing.T) {
+	u, err := Statfs(t.TempDir())
+	if err != nil {
+		t.Fatalf("Statfs() error = %v", err)
+	}
+	if u.TotalBytes == 0 {
+		t.Error("TotalBytes should be non-zero")
+	}
+}
@@ -28,6 +28,13 @@ type Generator struct {
 	serverIP   string
 	dkimKey    *rsa.PublicKey
 	dkimKeyPEM string
+	dkimKeys   []dkimSelectorKey // Published under their own selectors
+}
+
+// dkimSelectorKey is a DKIM public key and the selector it is published at
+type dkimSelectorKey struct {
+	selector string
+	key      *rsa.PublicKey
 }
 
 var (
@@ -86,6 +93,22 @@ func (g *Generator) SetDKIMKey(key *rsa.PublicKey) error {
 	return nil
 }
 
+// AddDKIMKey adds a DKIM public key to publish at selector. Once keys are
+// added, one record is generated per selector instead of the mail selector.
+func (g *Generator) AddDKIMKey(selector string, key *rsa.PublicKey) error {
+	if selector == "" {
+		return errors.New("DKIM selector cannot be empty")
+	}
+	if key == nil {
+		return errors.New("DKIM key cannot be nil")
+	}
+	if key.N.BitLen() < 1024 {
+		return fmt.Errorf("DKIM key too short: %d bits (minimum 1024)", key.N.BitLen())
+	}
+	g.dkimKeys = append(g.dkimKeys, dkimSelectorKey{selector: selector, key: key})
+	return nil
+}
+
 // SetDKIMKeyPEM sets the DKIM public key from PEM format
 func (g *Generator) SetDKIMKeyPEM(pem string) error {
 	if pem == "" {
@@ -106,7 +129,7 @@ func (g *Generator) GenerateAll() []Record {
 	records = append(records, g.GenerateMX())
 	records = append(records, g.GenerateA())
 	records = append(records, g.GenerateSPF())
-	records = append(records, g.GenerateDKIM())
+	records = append(records, g.GenerateDKIMRecords()...)
 	records = append(records, g.GenerateDMARC())
 
 	return records
@@ -157,15 +180,7 @@ func (g *Generator) GenerateDKIM() Record {
 	var value string
 
 	if g.dkimKey != nil {
-		// Generate from RSA public key
-		pubBytes, err := x509.MarshalPKIXPublicKey(g.dkimKey)
-		if err != nil {
-			// Log error and use placeholder - don't silently fail
-			value = fmt.Sprintf("v=DKIM1; k=rsa; p=<ERROR_MARSHALING_KEY:%s>", err.Error())
-		} else {
-			pubB64 := base64.StdEncoding.EncodeToString(pubBytes)
-			value = fmt.Sprintf("v=DKIM1; k=rsa; p=%s", pubB64)
-		}
+		value = dkimValue(g.dkimKey)
 	} else if g.dkimKeyPEM != "" {
 		// Extract key from PEM
 		lines := strings.Split(g.dkimKeyPEM, "\n")
@@ -193,6 +208,36 @@ func (g *Generator) GenerateDKIM() Record {
 	}
 }
 
+// GenerateDKIMRecords generates a DKIM record for every key added with
+// AddDKIMKey, so keys being rolled in or out stay published alongside the
+// one signing. Without any it returns the single GenerateDKIM record.
+func (g *Generator) GenerateDKIMRecords() []Record {
+	if len(g.dkimKeys) == 0 {
+		return []Record{g.GenerateDKIM()}
+	}
+	records := make([]Record, 0, len(g.dkimKeys))
+	for _, k := range g.dkimKeys {
+		records = append(records, Record{
+			Type:    "TXT",
+			Host:    k.selector + "._domainkey",
+			Value:   dkimValue(k.key),
+			TTL:     3600,
+			Comment: fmt.Sprintf("DKIM signing key for selector %s - verifies email authenticity", k.selector),
+		})
+	}
+	return records
+}
+
+// dkimValue formats an RSA public key as a DKIM record value
+func dkimValue(key *rsa.PublicKey) string {
+	pubBytes, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		// Log error and use placeholder - don't silently fail
+		return fmt.Sprintf("v=DKIM1; k=rsa; p=<ERROR_MARSHALING_KEY:%s>", err.Error())
+	}
+	return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(pubBytes)
+}
+
 // GenerateDMARC generates DMARC record
 func (g *Generator) GenerateDMARC() Record {
 	dmarc := fmt.Sprintf("v=DMARC1; p=quarantine; rua=mailto:postmaster@%s; ruf=mailto:postmaster@%s; fo=1", g.domain, g.domain)
@@ -0,0 +1,223 @@
+package dnsmon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fenilsonani/email-server/internal/dns"
+)
+
+// checkTimeout bounds the checks of one domain, so a hung resolver can't
+// stall the others
+const checkTimeout = 30 * time.Second
+
+// CheckFunc runs the DNS checks of a domain. It is swappable for testing.
+type CheckFunc func(ctx context.Context, domain string) []dns.CheckResult
+
+// Config holds DNS monitor configuration
+type Config struct {
+	Domains    []string      // Domains to check
+	MailServer string        // Hostname the MX records should point to
+	Interval   time.Duration // How often to check
+}
+
+// DomainResult holds the latest checks of one domain
+type DomainResult struct {
+	Domain  string
+	Checked time.Time
+	Results []dns.CheckResult
+}
+
+// Alert reports a record that passed the previous check and no longer does
+type Alert struct {
+	Domain     string    `json:"domain"`
+	RecordType string    `json:"record_type"`
+	Previous   string    `json:"previous"`
+	Current    string    `json:"current"`
+	Message    string    `json:"message"`
+	Time       time.Time `json:"time"`
+}
+
+// Monitor periodically re-runs the DNS checks of the configured domains
+// and raises an alert when a record that passed starts failing, which can
+// mean drift or a hijacked zone
+type Monitor struct {
+	cfg   Config
+	check CheckFunc
+
+	mu      sync.RWMutex
+	results map[string]DomainResult
+	onCheck func(DomainResult)
+	onAlert func(Alert)
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// New creates a DNS monitor. A nil check uses dns.Checker.
+func New(cfg Config, check CheckFunc) *Monitor {
+	if check == nil {
+		check = func(ctx context.Context, domain string) []dns.CheckResult {
+			checker, err := dns.NewChecker(domain, cfg.MailServer)
+			if err != nil {
+				return []dns.CheckResult{{RecordType: "DOMAIN", Status: dns.StatusFail, Message: err.Error()}}
+			}
+			return checker.CheckAll(ctx)
+		}
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 6 * time.Hour
+	}
+	return &Monitor{
+		cfg:     cfg,
+		check:   check,
+		results: make(map[string]DomainResult),
+	}
+}
+
+// OnCheck registers a callback invoked with each domain's results
+func (m *Monitor) OnCheck(fn func(DomainResult)) {
+	m.mu.Lock()
+	m.onCheck = fn
+	m.mu.Unlock()
+}
+
+// OnAlert registers a callback invoked for each record that stopped passing
+func (m *Monitor) OnAlert(fn func(Alert)) {
+	m.mu.Lock()
+	m.onAlert = fn
+	m.mu.Unlock()
+}
+
+// Check checks every domain once, raising alerts against the previous
+// results, and returns the alerts raised
+func (m *Monitor) Check(ctx context.Context) []Alert {
+	var alerts []Alert
+	for _, domain := range m.cfg.Domains {
+		if ctx.Err() != nil {
+			break
+		}
+		checkCtx, cancel := context.WithTimeout(ctx, checkTimeout)
+		result := DomainResult{Domain: domain, Checked: time.Now(), Results: m.check(checkCtx, domain)}
+		cancel()
+
+		m.mu.Lock()
+		prev, seen := m.results[domain]
+		m.results[domain] = result
+		onCheck, onAlert := m.onCheck, m.onAlert
+		m.mu.Unlock()
+
+		if onCheck != nil {
+			onCheck(result)
+		}
+		if !seen {
+			continue
+		}
+		for _, a := range transitions(prev, result) {
+			alerts = append(alerts, a)
+			if onAlert != nil {
+				onAlert(a)
+			}
+		}
+	}
+	return alerts
+}
+
+// transitions returns an alert for each record that passed in prev and
+// doesn't in cur
+func transitions(prev, cur DomainResult) []Alert {
+	passed := make(map[string]bool, len(prev.Results))
+	for _, r := range prev.Results {
+		passed[r.RecordType] = r.Status == dns.StatusPass
+	}
+
+	var alerts []Alert
+	for _, r := range cur.Results {
+		if r.Status == dns.StatusPass || !passed[r.RecordType] {
+			continue
+		}
+		alerts = append(alerts, Alert{
+			Domain:     cur.Domain,
+			RecordType: r.RecordType,
+			Previous:   string(dns.StatusPass),
+			Current:    string(r.Status),
+			Message:    r.Message,
+			Time:       cur.Checked,
+		})
+	}
+	return alerts
+}
+
+// Start checks in the background, at once and then every interval, until
+// Stop is called
+func (m *Monitor) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancel = cancel
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		ticker := time.NewTicker(m.cfg.Interval)
+		defer ticker.Stop()
+
+		m.Check(ctx)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				m.Check(ctx)
+			}
+		}
+	}()
+}
+
+// Stop stops background checking
+func (m *Monitor) Stop() {
+	if m.cancel != nil {
+		m.cancel()
+	}
+	m.wg.Wait()
+}
+
+// Results returns the latest results of each domain checked so far, in
+// configuration order
+func (m *Monitor) Results() []DomainResult {
+	if m == nil {
+		return nil
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	results := make([]DomainResult, 0, len(m.results))
+	for _, domain := range m.cfg.Domains {
+		if r, ok := m.results[domain]; ok {
+			results = append(results, r)
+		}
+	}
+	return results
+}
+
+// Webhook returns an alert callback that POSTs each alert as JSON to url
+func Webhook(url string) func(Alert) error {
+	client := &http.Client{Timeout: 10 * time.Second}
+	return func(a Alert) error {
+		body, err := json.Marshal(a)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("webhook returned %s", resp.Status)
+		}
+		return nil
+	}
+}
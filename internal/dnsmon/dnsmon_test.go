@@ -0,0 +1,77 @@
+package dnsmon
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fenilsonani/email-server/internal/dns"
+)
+
+type fakeDNS struct {
+	status map[string]dns.Status // Record type to status
+}
+
+func (f *fakeDNS) check(ctx context.Context, domain string) []dns.CheckResult {
+	var results []dns.CheckResult
+	for _, record := range []string{"MX", "SPF", "DKIM"} {
+		results = append(results, dns.CheckResult{RecordType: record, Status: f.status[record], Message: record + " checked"})
+	}
+	return results
+}
+
+func TestMonitorAlertsOnPassToFail(t *testing.T) {
+	f := &fakeDNS{status: map[string]dns.Status{"MX": dns.StatusPass, "SPF": dns.StatusPass, "DKIM": dns.StatusMissing}}
+	m := New(Config{Domains: []string{"example.com"}}, f.check)
+	var raised []Alert
+	m.OnAlert(func(a Alert) { raised = append(raised, a) })
+	ctx := context.Background()
+
+	if alerts := m.Check(ctx); len(alerts) != 0 {
+		t.Errorf("first Check() = %+v, want no alerts without a previous result", alerts)
+	}
+	if alerts := m.Check(ctx); len(alerts) != 0 {
+		t.Errorf("unchanged Check() = %+v, want no alerts", alerts)
+	}
+
+	// SPF breaks; DKIM, which never passed, stays missing
+	f.status["SPF"] = dns.StatusFail
+	alerts := m.Check(ctx)
+	if len(alerts) != 1 || alerts[0].Domain != "example.com" || alerts[0].RecordType != "SPF" ||
+		alerts[0].Previous != "PASS" || alerts[0].Current != "FAIL" {
+		t.Fatalf("Check() after SPF broke = %+v, want one SPF PASS to FAIL alert", alerts)
+	}
+	if len(raised) != 1 {
+		t.Errorf("OnAlert called %d times, want 1", len(raised))
+	}
+
+	// Still failing is not a new transition
+	if alerts := m.Check(ctx); len(alerts) != 0 {
+		t.Errorf("Check() with SPF still failing = %+v, want no alerts", alerts)
+	}
+
+	results := m.Results()
+	if len(results) != 1 || len(results[0].Results) != 3 || results[0].Results[1].Status != dns.StatusFail {
+		t.Errorf("Results() = %+v, want the latest checks of example.com", results)
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	var got Alert
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("webhook body: %v", err)
+		}
+	}))
+	defer srv.Close()
+
+	alert := Alert{Domain: "example.com", RecordType: "MX", Previous: "PASS", Current: "FAIL"}
+	if err := Webhook(srv.URL)(alert); err != nil {
+		t.Fatalf("Webhook() error = %v", err)
+	}
+	if got.Domain != alert.Domain || got.RecordType != alert.RecordType || got.Current != alert.Current {
+		t.Errorf("webhook received %+v, want %+v", got, alert)
+	}
+}
@@ -0,0 +1,404 @@
+package imap
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/fenilsonani/email-server/internal/auth"
+	"github.com/fenilsonani/email-server/internal/storage"
+)
+
+// allRights are the RFC 4314 rights the server supports, in the order they
+// are listed. The owner of a mailbox always has all of them.
+const allRights = "lrswipkxtea"
+
+// rightsCap lists the rights beyond RFC 2086's in the RIGHTS= capability
+const rightsCap = "kxte"
+
+// defaultSharedPrefix is the namespace (RFC 2342) mailboxes shared with a
+// user appear in unless the server is given another. Like the namespaces of
+// other servers it starts with '#', so it doesn't hide a folder named
+// Shared or the like a user already has.
+const defaultSharedPrefix = "#shared/"
+
+// sharedMailboxName returns the name a mailbox of owner's has for user:
+// <prefix>/<owner>/<mailbox>, with the owner's local part alone when they
+// share the user's domain
+func (s *Session) sharedMailboxName(user *auth.User, owner, name string) string {
+	if local, domain, ok := strings.Cut(owner, "@"); ok && strings.EqualFold(domain, user.Domain) {
+		owner = local
+	}
+	return s.server.sharedPrefix + owner + "/" + name
+}
+
+// isSharedName reports whether name is in the shared namespace
+func (s *Session) isSharedName(name string) bool {
+	return strings.HasPrefix(name, s.server.sharedPrefix)
+}
+
+// Namespace reports the user's own mailboxes and those other users shared
+// with them (RFC 2342)
+func (s *Session) Namespace() (*imap.NamespaceData, error) {
+	return &imap.NamespaceData{
+		Personal: []imap.NamespaceDescriptor{{Prefix: "", Delim: '/'}},
+		Other:    []imap.NamespaceDescriptor{{Prefix: s.server.sharedPrefix, Delim: '/'}},
+	}, nil
+}
+
+// noPerm refuses a command the user doesn't have the rights for
+func noPerm(text string) *imap.Error {
+	return &imap.Error{Type: imap.StatusResponseTypeNo, Code: imap.ResponseCodeNoPerm, Text: text}
+}
+
+// hasRights reports whether rights include every right in need
+func hasRights(rights, need string) bool {
+	for _, r := range need {
+		if !strings.ContainsRune(rights, r) {
+			return false
+		}
+	}
+	return true
+}
+
+// openMailbox resolves a mailbox name to one of the user's own mailboxes,
+// on which they have every right, or to a mailbox another user shared with
+// them. A shared mailbox the user has no rights on doesn't exist for them.
+func (s *Session) openMailbox(ctx context.Context, user *auth.User, name string) (*storage.Mailbox, string, error) {
+	rest, shared := strings.CutPrefix(name, s.server.sharedPrefix)
+	if !shared {
+		mb, err := s.server.store.GetMailbox(ctx, user.ID, name)
+		if err != nil {
+			return nil, "", err
+		}
+		return mb, allRights, nil
+	}
+
+	notFound := fmt.Errorf("%w: %s", storage.ErrMailboxNotFound, name)
+	ownerEmail, mbName, ok := strings.Cut(rest, "/")
+	if !ok {
+		return nil, "", notFound
+	}
+	if !strings.Contains(ownerEmail, "@") {
+		ownerEmail += "@" + user.Domain
+	}
+	owner, err := s.server.authenticator.LookupUser(ctx, ownerEmail)
+	if err != nil {
+		return nil, "", notFound
+	}
+	mb, err := s.server.store.GetMailbox(ctx, owner.ID, mbName)
+	if err != nil {
+		return nil, "", err
+	}
+	if owner.ID == user.ID {
+		return mb, allRights, nil
+	}
+	rights, err := s.server.store.MailboxRights(ctx, mb.ID, user.ID)
+	if err != nil {
+		return nil, "", err
+	}
+	if rights == "" {
+		return nil, "", notFound
+	}
+	return mb, rights, nil
+}
+
+// storeRights returns the rights needed to change flags: s for \Seen, t for
+// \Deleted and w for the rest
+func storeRights(flags []imap.Flag) string {
+	var need strings.Builder
+	for _, f := range flags {
+		switch {
+		case strings.EqualFold(string(f), string(imap.FlagSeen)):
+			need.WriteByte('s')
+		case strings.EqualFold(string(f), string(imap.FlagDeleted)):
+			need.WriteByte('t')
+		default:
+			need.WriteByte('w')
+		}
+	}
+	return need.String()
+}
+
+// permanentFlags limits the flags a client may change to those the rights allow
+func permanentFlags(rights string) []imap.Flag {
+	var flags []imap.Flag
+	if hasRights(rights, "s") {
+		flags = append(flags, imap.FlagSeen)
+	}
+	if hasRights(rights, "w") {
+		flags = append(flags, imap.FlagAnswered, imap.FlagFlagged)
+	}
+	if hasRights(rights, "t") {
+		flags = append(flags, imap.FlagDeleted)
+	}
+	if hasRights(rights, "w") {
+		flags = append(flags, imap.FlagDraft, imap.FlagWildcard)
+	}
+	return flags
+}
+
+// parseRights validates the rights of a SETACL. The RFC 2086 rights c and
+// d are taken as the RFC 4314 rights that replaced them.
+func parseRights(s string) (string, error) {
+	var rights strings.Builder
+	for _, r := range s {
+		switch {
+		case r == 'c':
+			rights.WriteString("k")
+		case r == 'd':
+			rights.WriteString("xte")
+		case strings.ContainsRune(allRights, r):
+			rights.WriteRune(r)
+		default:
+			return "", fmt.Errorf("unsupported right %q", r)
+		}
+	}
+	return rights.String(), nil
+}
+
+// canonicalRights returns the rights in allRights order without repeats
+func canonicalRights(rights string) string {
+	var out strings.Builder
+	for _, r := range allRights {
+		if strings.ContainsRune(rights, r) {
+			out.WriteRune(r)
+		}
+	}
+	return out.String()
+}
+
+// aclTarget resolves the mailbox argument of an ACL command, which needs
+// the user to have the a right except for MYRIGHTS
+func (s *Session) aclTarget(ctx context.Context, mailbox string, administer bool) (*storage.Mailbox, string, *imap.StatusResponse) {
+	mb, rights, err := s.openMailbox(ctx, s.user, mailbox)
+	if errors.Is(err, storage.ErrMailboxNotFound) {
+		return nil, "", &imap.StatusResponse{Type: imap.StatusResponseTypeNo, Code: imap.ResponseCodeNonExistent, Text: "Mailbox not found"}
+	}
+	if err != nil {
+		log.Printf("IMAP v2: ACL lookup failed for %s: %v", mailbox, err)
+		return nil, "", &imap.StatusResponse{Type: imap.StatusResponseTypeNo, Code: imap.ResponseCodeServerBug, Text: "Failed to read mailbox rights"}
+	}
+	if administer && !hasRights(rights, "a") {
+		return nil, "", &imap.StatusResponse{Type: imap.StatusResponseTypeNo, Code: imap.ResponseCodeNoPerm, Text: "Permission denied"}
+	}
+	return mb, rights, nil
+}
+
+// aclGrantee resolves the identifier of an ACL command to a user other than
+// the mailbox owner
+func (s *Session) aclGrantee(ctx context.Context, mb *storage.Mailbox, identifier string) (*auth.User, *imap.StatusResponse) {
+	if strings.EqualFold(identifier, string(imap.RightsIdentifierAnyone)) || strings.HasPrefix(identifier, "-") {
+		return nil, &imap.StatusResponse{Type: imap.StatusResponseTypeNo, Text: "Rights can only be granted to users"}
+	}
+	grantee, err := s.server.authenticator.LookupUser(ctx, identifier)
+	if err != nil {
+		return nil, &imap.StatusResponse{Type: imap.StatusResponseTypeNo, Text: "No such user"}
+	}
+	if grantee.ID == mb.UserID {
+		return nil, &imap.StatusResponse{Type: imap.StatusResponseTypeNo, Code: imap.ResponseCodeCannot, Text: "The owner always has every right"}
+	}
+	return grantee, nil
+}
+
+// handleSetACL implements SETACL (RFC 4314 section 3.1)
+func (s *Session) handleSetACL(w *bytes.Buffer, args *argReader) *imap.StatusResponse {
+	mailbox, identifier, err := mailboxAndIdentifier(args)
+	if err != nil {
+		return badACLArgs(err)
+	}
+	if err := args.sp(); err != nil {
+		return badACLArgs(err)
+	}
+	modRights, err := args.astring()
+	if err != nil {
+		return badACLArgs(err)
+	}
+	if !args.done() {
+		return badACLArgs(errBadArgs)
+	}
+	mod := imap.RightModificationReplace
+	if modRights != "" && (modRights[0] == '+' || modRights[0] == '-') {
+		mod = imap.RightModification(modRights[0])
+		modRights = modRights[1:]
+	}
+	rights, err := parseRights(modRights)
+	if err != nil {
+		return badACLArgs(err)
+	}
+	return s.setACL(mailbox, identifier, mod, rights)
+}
+
+// handleDeleteACL implements DELETEACL (RFC 4314 section 3.2)
+func (s *Session) handleDeleteACL(w *bytes.Buffer, args *argReader) *imap.StatusResponse {
+	mailbox, identifier, err := mailboxAndIdentifier(args)
+	if err != nil {
+		return badACLArgs(err)
+	}
+	if !args.done() {
+		return badACLArgs(errBadArgs)
+	}
+	return s.setACL(mailbox, identifier, imap.RightModificationReplace, "")
+}
+
+// setACL changes the rights identifier has on mailbox
+func (s *Session) setACL(mailbox, identifier string, mod imap.RightModification, rights string) *imap.StatusResponse {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	mb, _, status := s.aclTarget(ctx, mailbox, true)
+	if status != nil {
+		return status
+	}
+	grantee, status := s.aclGrantee(ctx, mb, identifier)
+	if status != nil {
+		return status
+	}
+
+	current, err := s.server.store.MailboxRights(ctx, mb.ID, grantee.ID)
+	if err != nil {
+		log.Printf("IMAP v2: SETACL failed for %s: %v", mailbox, err)
+		return &imap.StatusResponse{Type: imap.StatusResponseTypeNo, Code: imap.ResponseCodeServerBug, Text: "Failed to read mailbox rights"}
+	}
+	switch mod {
+	case imap.RightModificationAdd:
+		rights = current + rights
+	case imap.RightModificationRemove:
+		rights = string(imap.RightSet(current).Remove(imap.RightSet(rights)))
+	}
+	if err := s.server.store.SetMailboxRights(ctx, mb.ID, grantee.ID, canonicalRights(rights)); err != nil {
+		log.Printf("IMAP v2: SETACL failed for %s: %v", mailbox, err)
+		return &imap.StatusResponse{Type: imap.StatusResponseTypeNo, Code: imap.ResponseCodeServerBug, Text: "Failed to store mailbox rights"}
+	}
+	return nil
+}
+
+// handleGetACL implements GETACL (RFC 4314 section 3.3)
+func (s *Session) handleGetACL(w *bytes.Buffer, args *argReader) *imap.StatusResponse {
+	mailbox, err := args.mailbox()
+	if err != nil {
+		return badACLArgs(err)
+	}
+	if !args.done() {
+		return badACLArgs(errBadArgs)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	mb, _, status := s.aclTarget(ctx, mailbox, true)
+	if status != nil {
+		return status
+	}
+	owner, err := s.server.authenticator.LookupUserByID(ctx, mb.UserID)
+	if err != nil {
+		log.Printf("IMAP v2: GETACL failed for %s: %v", mailbox, err)
+		return &imap.StatusResponse{Type: imap.StatusResponseTypeNo, Code: imap.ResponseCodeServerBug, Text: "Failed to read mailbox owner"}
+	}
+	entries, err := s.server.store.MailboxACL(ctx, mb.ID)
+	if err != nil {
+		log.Printf("IMAP v2: GETACL failed for %s: %v", mailbox, err)
+		return &imap.StatusResponse{Type: imap.StatusResponseTypeNo, Code: imap.ResponseCodeServerBug, Text: "Failed to read mailbox rights"}
+	}
+
+	w.WriteString("* ACL ")
+	writeString(w, []byte(encodeMailboxName(mailbox)))
+	w.WriteByte(' ')
+	writeString(w, []byte(owner.Email))
+	w.WriteString(" " + allRights)
+	for _, e := range entries {
+		w.WriteByte(' ')
+		writeString(w, []byte(e.Email))
+		w.WriteByte(' ')
+		writeString(w, []byte(e.Rights))
+	}
+	w.WriteString("\r\n")
+	return nil
+}
+
+// handleListRights implements LISTRIGHTS (RFC 4314 section 3.4). The owner
+// has every right; anyone else may be granted each of them on its own.
+func (s *Session) handleListRights(w *bytes.Buffer, args *argReader) *imap.StatusResponse {
+	mailbox, identifier, err := mailboxAndIdentifier(args)
+	if err != nil {
+		return badACLArgs(err)
+	}
+	if !args.done() {
+		return badACLArgs(errBadArgs)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	mb, _, status := s.aclTarget(ctx, mailbox, true)
+	if status != nil {
+		return status
+	}
+	required, optional := "", strings.Split(allRights, "")
+	if user, err := s.server.authenticator.LookupUser(ctx, identifier); err == nil && user.ID == mb.UserID {
+		required, optional = allRights, nil
+	}
+
+	w.WriteString("* LISTRIGHTS ")
+	writeString(w, []byte(encodeMailboxName(mailbox)))
+	w.WriteByte(' ')
+	writeString(w, []byte(identifier))
+	w.WriteByte(' ')
+	writeString(w, []byte(required))
+	for _, r := range optional {
+		w.WriteString(" " + r)
+	}
+	w.WriteString("\r\n")
+	return nil
+}
+
+// handleMyRights implements MYRIGHTS (RFC 4314 section 3.5)
+func (s *Session) handleMyRights(w *bytes.Buffer, args *argReader) *imap.StatusResponse {
+	mailbox, err := args.mailbox()
+	if err != nil {
+		return badACLArgs(err)
+	}
+	if !args.done() {
+		return badACLArgs(errBadArgs)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, rights, status := s.aclTarget(ctx, mailbox, false)
+	if status != nil {
+		return status
+	}
+	w.WriteString("* MYRIGHTS ")
+	writeString(w, []byte(encodeMailboxName(mailbox)))
+	w.WriteByte(' ')
+	writeString(w, []byte(rights))
+	w.WriteString("\r\n")
+	return nil
+}
+
+// mailboxAndIdentifier reads the mailbox and identifier arguments shared
+// by SETACL, DELETEACL and LISTRIGHTS
+func mailboxAndIdentifier(args *argReader) (string, string, error) {
+	mailbox, err := args.mailbox()
+	if err != nil {
+		return "", "", err
+	}
+	if err := args.sp(); err != nil {
+		return "", "", err
+	}
+	identifier, err := args.astring()
+	if err != nil {
+		return "", "", err
+	}
+	return mailbox, identifier, nil
+}
+
+func badACLArgs(err error) *imap.StatusResponse {
+	return &imap.StatusResponse{Type: imap.StatusResponseTypeBad, Text: err.Error()}
+}
@@ -0,0 +1,191 @@
+package imap
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// addTestUser creates a user in example.com with the default mailboxes
+func addTestUser(t *testing.T, srv *Server, username string) {
+	t.Helper()
+	ctx := context.Background()
+	domainID, err := srv.authenticator.GetDomainID(ctx, "example.com")
+	if err != nil {
+		t.Fatalf("GetDomainID() error = %v", err)
+	}
+	user, err := srv.authenticator.CreateUser(ctx, username, "password123", domainID)
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	if err := srv.store.InitializeUserMailboxes(ctx, user.ID); err != nil {
+		t.Fatalf("InitializeUserMailboxes() error = %v", err)
+	}
+}
+
+func TestSharedMailboxRights(t *testing.T) {
+	srv, _ := newTestServer(t)
+	addTestUser(t, srv, "bob")
+	addr := listenTestServer(t, srv)
+	ctx := context.Background()
+
+	alice, err := srv.authenticator.LookupUser(ctx, "alice@example.com")
+	if err != nil {
+		t.Fatalf("LookupUser() error = %v", err)
+	}
+	if _, err := srv.store.CreateMailbox(ctx, alice.ID, "Team", ""); err != nil {
+		t.Fatalf("CreateMailbox() error = %v", err)
+	}
+	team, err := srv.store.GetMailbox(ctx, alice.ID, "Team")
+	if err != nil {
+		t.Fatalf("GetMailbox() error = %v", err)
+	}
+	if _, err := srv.store.AppendMessage(ctx, team.ID, nil, time.Now(), strings.NewReader("Subject: hi\r\n\r\nhello\r\n")); err != nil {
+		t.Fatalf("AppendMessage() error = %v", err)
+	}
+
+	owner := dialRaw(t, addr)
+	owner.login()
+	if untagged, _ := owner.command("CAPABILITY"); len(untagged) != 1 || !strings.Contains(untagged[0], " ACL") {
+		t.Errorf("CAPABILITY response = %q, want ACL", untagged)
+	}
+	if _, status := owner.command("SETACL Team bob@example.com lr"); !strings.HasPrefix(status, "OK") {
+		t.Fatalf("SETACL = %q", status)
+	}
+	untagged, status := owner.command("GETACL Team")
+	if !strings.HasPrefix(status, "OK") || len(untagged) != 1 ||
+		untagged[0] != `* ACL "Team" "alice@example.com" lrswipkxtea "bob@example.com" "lr"` {
+		t.Fatalf("GETACL = %q, %q", untagged, status)
+	}
+
+	const shared = `"#shared/alice/Team"`
+	c := dialRaw(t, addr)
+	if _, status := c.command("LOGIN bob@example.com password123"); !strings.HasPrefix(status, "OK") {
+		t.Fatalf("LOGIN = %q", status)
+	}
+	untagged, _ = c.command(`LIST "" "*"`)
+	if !strings.Contains(strings.Join(untagged, "\n"), shared) {
+		t.Errorf("LIST = %q, want %s", untagged, shared)
+	}
+	if untagged, _ := c.command("MYRIGHTS " + shared); len(untagged) != 1 || !strings.HasSuffix(untagged[0], ` "lr"`) {
+		t.Errorf("MYRIGHTS = %q, want lr", untagged)
+	}
+	untagged, status = c.command("SELECT " + shared)
+	if !strings.HasPrefix(status, "OK") {
+		t.Fatalf("SELECT = %q", status)
+	}
+	if !strings.Contains(strings.Join(untagged, "\n"), "* 1 EXISTS") {
+		t.Errorf("SELECT response = %q, want one message", untagged)
+	}
+	if _, status := c.command("STORE 1 +FLAGS (\\Deleted)"); !strings.HasPrefix(status, "NO [NOPERM]") {
+		t.Errorf("STORE without t = %q, want NO [NOPERM]", status)
+	}
+	if _, status := c.command("SETACL %s bob@example.com lrswipkxtea", shared); !strings.HasPrefix(status, "NO [NOPERM]") {
+		t.Errorf("SETACL without a = %q, want NO [NOPERM]", status)
+	}
+	if _, status := c.command("DELETE " + shared); !strings.HasPrefix(status, "NO [NOPERM]") {
+		t.Fatalf("DELETE without x = %q, want NO [NOPERM]", status)
+	}
+	if _, err := srv.store.GetMailbox(ctx, alice.ID, "Team"); err != nil {
+		t.Fatalf("GetMailbox() after refused DELETE error = %v", err)
+	}
+
+	// Taking l and r away leaves nothing to see
+	if _, status := owner.command("SETACL Team bob@example.com -lr"); !strings.HasPrefix(status, "OK") {
+		t.Fatalf("SETACL -lr = %q", status)
+	}
+	c.command("UNSELECT")
+	if _, status := c.command("SELECT " + shared); !strings.HasPrefix(status, "NO") {
+		t.Errorf("SELECT after revoke = %q, want NO", status)
+	}
+
+	if _, status := owner.command("SETACL Team bob@example.com lrx"); !strings.HasPrefix(status, "OK") {
+		t.Fatalf("SETACL lrx = %q", status)
+	}
+	if _, status := c.command("DELETE " + shared); !strings.HasPrefix(status, "OK") {
+		t.Fatalf("DELETE with x = %q", status)
+	}
+	if _, err := srv.store.GetMailbox(ctx, alice.ID, "Team"); err == nil {
+		t.Errorf("Team still exists after DELETE")
+	}
+	// A folder of bob's own named Shared isn't hidden by the namespace
+	if _, status := c.command("CREATE Shared/Notes"); !strings.HasPrefix(status, "OK") {
+		t.Fatalf("CREATE Shared/Notes = %q", status)
+	}
+	if _, status := c.command("SELECT Shared/Notes"); !strings.HasPrefix(status, "OK") {
+		t.Errorf("SELECT Shared/Notes = %q, want OK", status)
+	}
+}
+
+func TestSharedNamespace(t *testing.T) {
+	srv, db := newTestServer(t)
+	srv.SetSharedPrefix("Team Folders/")
+	addTestUser(t, srv, "bob")
+	ctx := context.Background()
+
+	// carol is in another domain, so her mailboxes are listed by address
+	res, err := db.ExecContext(ctx, "INSERT INTO domains (name) VALUES ('example.org')")
+	if err != nil {
+		t.Fatalf("Failed to insert domain: %v", err)
+	}
+	domainID, _ := res.LastInsertId()
+	carol, err := srv.authenticator.CreateUser(ctx, "carol", "password123", domainID)
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	if err := srv.store.InitializeUserMailboxes(ctx, carol.ID); err != nil {
+		t.Fatalf("InitializeUserMailboxes() error = %v", err)
+	}
+	alice, err := srv.authenticator.LookupUser(ctx, "alice@example.com")
+	if err != nil {
+		t.Fatalf("LookupUser() error = %v", err)
+	}
+	bob, err := srv.authenticator.LookupUser(ctx, "bob@example.com")
+	if err != nil {
+		t.Fatalf("LookupUser() error = %v", err)
+	}
+	project, err := srv.store.CreateMailbox(ctx, alice.ID, "Project", "")
+	if err != nil {
+		t.Fatalf("CreateMailbox() error = %v", err)
+	}
+	carolInbox, err := srv.store.GetMailbox(ctx, carol.ID, "INBOX")
+	if err != nil {
+		t.Fatalf("GetMailbox() error = %v", err)
+	}
+	for _, mb := range []int64{project.ID, carolInbox.ID} {
+		if err := srv.store.SetMailboxRights(ctx, mb, bob.ID, "lr"); err != nil {
+			t.Fatalf("SetMailboxRights() error = %v", err)
+		}
+	}
+
+	c := dialRaw(t, listenTestServer(t, srv))
+	if _, status := c.command("LOGIN bob@example.com password123"); !strings.HasPrefix(status, "OK") {
+		t.Fatalf("LOGIN = %q", status)
+	}
+	untagged, status := c.command("NAMESPACE")
+	if !strings.HasPrefix(status, "OK") || len(untagged) != 1 ||
+		untagged[0] != `* NAMESPACE (("" "/")) (("Team Folders/" "/")) NIL` {
+		t.Errorf("NAMESPACE = %q, %q", untagged, status)
+	}
+
+	untagged, _ = c.command(`LIST "" "Team Folders/*"`)
+	list := strings.Join(untagged, "\n")
+	for _, want := range []string{`"Team Folders/alice/Project"`, `"Team Folders/carol@example.org/INBOX"`} {
+		if !strings.Contains(list, want) {
+			t.Errorf("LIST = %q, want %s", untagged, want)
+		}
+	}
+
+	for _, name := range []string{"alice/Project", "alice@example.com/Project", "carol@example.org/INBOX"} {
+		if _, status := c.command(`SELECT "Team Folders/%s"`, name); !strings.HasPrefix(status, "OK") {
+			t.Errorf("SELECT %s = %q", name, status)
+		}
+	}
+	if _, status := c.command(`SELECT "Team Folders/carol/INBOX"`); !strings.HasPrefix(status, "NO") {
+		t.Errorf("SELECT of carol's INBOX by local part = %q, want NO", status)
+	}
+	if _, status := c.command(`CREATE "Team Folders/alice/New"`); !strings.HasPrefix(status, "NO") {
+		t.Errorf("CREATE under the shared namespace = %q, want NO", status)
+	}
+}
@@ -0,0 +1,112 @@
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+	"github.com/emersion/go-message/textproto"
+	"github.com/fenilsonani/email-server/internal/storage/maildir"
+)
+
+// extractBodyStructure describes the MIME structure of a message for
+// BODY and BODYSTRUCTURE. Parameters are parsed with maildir.ParseMediaType
+// so RFC 2231 filenames, continued or in a legacy charset, reach the client
+// as the name the sender gave them.
+func extractBodyStructure(data []byte) imap.BodyStructure {
+	br := bufio.NewReader(bytes.NewReader(data))
+	header, _ := textproto.ReadHeader(br)
+	return bodyStructurePart(header, br)
+}
+
+func bodyStructurePart(header textproto.Header, r io.Reader) imap.BodyStructure {
+	mediaType, typeParams := contentType(header)
+	primaryType, subType, _ := strings.Cut(mediaType, "/")
+
+	if primaryType == "multipart" {
+		bs := &imap.BodyStructureMultiPart{Subtype: subType}
+		mr := textproto.NewMultipartReader(r, typeParams["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				break
+			}
+			bs.Children = append(bs.Children, bodyStructurePart(part.Header, part))
+		}
+		bs.Extended = &imap.BodyStructureMultiPartExt{
+			Params:      typeParams,
+			Disposition: contentDisposition(header),
+			Language:    contentLanguage(header),
+			Location:    header.Get("Content-Location"),
+		}
+		return bs
+	}
+
+	body, _ := io.ReadAll(r)
+	bs := &imap.BodyStructureSinglePart{
+		Type:        primaryType,
+		Subtype:     subType,
+		Params:      typeParams,
+		ID:          header.Get("Content-Id"),
+		Description: header.Get("Content-Description"),
+		Encoding:    header.Get("Content-Transfer-Encoding"),
+		Size:        uint32(len(body)),
+	}
+	if mediaType == "message/rfc822" || mediaType == "message/global" {
+		cr := bufio.NewReader(bytes.NewReader(body))
+		childHeader, _ := textproto.ReadHeader(cr)
+		bs.MessageRFC822 = &imap.BodyStructureMessageRFC822{
+			Envelope:      imapserver.ExtractEnvelope(childHeader),
+			BodyStructure: bodyStructurePart(childHeader, cr),
+			NumLines:      int64(bytes.Count(body, []byte("\n"))),
+		}
+	}
+	if primaryType == "text" {
+		bs.Text = &imap.BodyStructureText{NumLines: int64(bytes.Count(body, []byte("\n")))}
+	}
+	bs.Extended = &imap.BodyStructureSinglePartExt{
+		Disposition: contentDisposition(header),
+		Language:    contentLanguage(header),
+		Location:    header.Get("Content-Location"),
+	}
+	return bs
+}
+
+// contentType returns a part's media type and parameters, text/plain
+// (RFC 2045 section 5.2) when it has none or it can't be parsed
+func contentType(header textproto.Header) (string, map[string]string) {
+	mediaType, params, err := maildir.ParseMediaType(header.Get("Content-Type"))
+	if mediaType == "" || !strings.Contains(mediaType, "/") {
+		return "text/plain", map[string]string{"charset": "us-ascii"}
+	}
+	if err != nil {
+		params = nil
+	}
+	return mediaType, params
+}
+
+func contentDisposition(header textproto.Header) *imap.BodyStructureDisposition {
+	disp, params, err := maildir.ParseMediaType(header.Get("Content-Disposition"))
+	if disp == "" {
+		return nil
+	}
+	if err != nil {
+		params = nil
+	}
+	return &imap.BodyStructureDisposition{Value: disp, Params: params}
+}
+
+func contentLanguage(header textproto.Header) []string {
+	v := header.Get("Content-Language")
+	if v == "" {
+		return nil
+	}
+	langs := strings.Split(v, ",")
+	for i, lang := range langs {
+		langs[i] = strings.TrimSpace(lang)
+	}
+	return langs
+}
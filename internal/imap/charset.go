@@ -0,0 +1,150 @@
+package imap
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/fenilsonani/email-server/internal/storage/maildir"
+)
+
+// imapserver only accepts US-ASCII and UTF-8 as SEARCH charsets. extConn
+// rewrites a SEARCH in another charset the maildir package can decode
+// into UTF-8 before imapserver sees it, and answers an unknown charset
+// with the list of supported ones (RFC 3501 section 6.4.4).
+
+// badCharsetCode lists the SEARCH charsets in a BADCHARSET response code
+var badCharsetCode = imap.ResponseCode("BADCHARSET (" + strings.Join(maildir.Charsets(), " ") + ")")
+
+// searchCharset finds the CHARSET argument in the arguments of SEARCH,
+// returning the charset and where its name starts and ends in args
+func searchCharset(args []byte) (charset string, start, end int, ok bool) {
+	r := &argReader{b: args}
+	atom, err := r.atom()
+	if err != nil {
+		return "", 0, 0, false
+	}
+	if strings.EqualFold(atom, "RETURN") {
+		// Skip the return options (RFC 4731)
+		if r.sp() != nil || !r.consume('(') {
+			return "", 0, 0, false
+		}
+		i := bytes.IndexByte(r.b[r.pos:], ')')
+		if i < 0 {
+			return "", 0, 0, false
+		}
+		r.pos += i + 1
+		if r.sp() != nil {
+			return "", 0, 0, false
+		}
+		if atom, err = r.atom(); err != nil {
+			return "", 0, 0, false
+		}
+	}
+	if !strings.EqualFold(atom, "CHARSET") || r.sp() != nil {
+		return "", 0, 0, false
+	}
+	start = r.pos
+	if charset, err = r.astring(); err != nil {
+		return "", 0, 0, false
+	}
+	return charset, start, r.pos, true
+}
+
+// transcodeSearch rewrites a SEARCH or UID SEARCH command whose CHARSET
+// imapserver doesn't accept. Commands in US-ASCII or UTF-8, and those
+// without a readable CHARSET on their first line, are left to imapserver.
+func (c *extConn) transcodeSearch(tag, name string, rest []byte) (bool, error) {
+	cmd := name
+	if name == "UID" {
+		cmd, rest = "UID SEARCH", rest[len("SEARCH "):]
+	}
+
+	charset, start, end, ok := searchCharset(rest)
+	if !ok || c.authenticatedSession() == nil {
+		return false, nil
+	}
+	switch strings.ToUpper(charset) {
+	case "US-ASCII", "UTF-8":
+		return false, nil
+	}
+
+	args, err := c.readArgs(rest)
+	if errors.Is(err, errCommandTooLarge) {
+		return true, c.writeResponse(tag, nil, &imap.StatusResponse{
+			Type: imap.StatusResponseTypeNo,
+			Code: imap.ResponseCodeTooBig,
+			Text: "Command too large",
+		})
+	}
+	if err != nil {
+		return true, err
+	}
+
+	if _, err := maildir.DecodeCharset(charset, nil); err != nil {
+		return true, c.writeResponse(tag, nil, &imap.StatusResponse{
+			Type: imap.StatusResponseTypeNo,
+			Code: badCharsetCode,
+			Text: "Unsupported SEARCH charset",
+		})
+	}
+
+	var line bytes.Buffer
+	fmt.Fprintf(&line, "%s %s ", tag, cmd)
+	line.Write(args[:start])
+	line.WriteString("UTF-8")
+	if err := transcodeStrings(&line, args[end:], charset); err != nil {
+		return true, c.writeResponse(tag, nil, &imap.StatusResponse{
+			Type: imap.StatusResponseTypeBad,
+			Text: fmt.Sprintf("Invalid SEARCH arguments: %v", err),
+		})
+	}
+	line.WriteString("\r\n")
+
+	// Read hands the rewritten command to imapserver
+	c.pending = append(c.pending[:0], line.Bytes()...)
+	return true, nil
+}
+
+// transcodeStrings copies search keys to w, decoding their strings from
+// charset to UTF-8
+func transcodeStrings(w *bytes.Buffer, b []byte, charset string) error {
+	r := &argReader{b: b}
+	for !r.done() {
+		c := r.peek()
+		if c == '"' || c == '{' || (c == '~' && r.pos+1 < len(r.b) && r.b[r.pos+1] == '{') {
+			s, err := r.string()
+			if err != nil {
+				return err
+			}
+			decoded, err := maildir.DecodeCharset(charset, s)
+			if err != nil {
+				return err
+			}
+			writeUTF8String(w, decoded)
+			continue
+		}
+		w.WriteByte(c)
+		r.pos++
+	}
+	return nil
+}
+
+// writeUTF8String writes s as a quoted string, which imapserver reads as
+// UTF-8, or as a non-synchronizing literal if it has line breaks
+func writeUTF8String(w *bytes.Buffer, s string) {
+	if strings.ContainsAny(s, "\r\n\x00") {
+		fmt.Fprintf(w, "{%d+}\r\n%s", len(s), s)
+		return
+	}
+	w.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		if s[i] == '"' || s[i] == '\\' {
+			w.WriteByte('\\')
+		}
+		w.WriteByte(s[i])
+	}
+	w.WriteByte('"')
+}
@@ -0,0 +1,752 @@
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/fenilsonani/email-server/internal/logging"
+)
+
+// go-imap's server has no hook for commands it doesn't implement, so
+// extension commands are answered by extConn, a thin layer between the
+// client connection and imapserver. It tracks command and literal
+// boundaries in both directions so that only real command lines are
+// inspected, and passes everything else through untouched.
+
+// maxExtCommandSize bounds the literal data an extension command may carry
+const maxExtCommandSize = 1 << 20
+
+// startTLSTimeout bounds the TLS handshake after STARTTLS
+const startTLSTimeout = 30 * time.Second
+
+// extCommand handles an extension command for an authenticated session.
+// Untagged responses are written to w; a nil status means OK.
+type extCommand func(s *Session, w *bytes.Buffer, args *argReader) *imap.StatusResponse
+
+// extCommands are the commands extConn answers itself
+var extCommands = map[string]extCommand{
+	"GETMETADATA": (*Session).handleGetMetadata,
+	"SETMETADATA": (*Session).handleSetMetadata,
+
+	"SETACL":     (*Session).handleSetACL,
+	"DELETEACL":  (*Session).handleDeleteACL,
+	"GETACL":     (*Session).handleGetACL,
+	"LISTRIGHTS": (*Session).handleListRights,
+	"MYRIGHTS":   (*Session).handleMyRights,
+
+	"XAPPLEPUSHSERVICE": (*Session).handleXApplePushService,
+}
+
+// extCaps are appended to every capability list imapserver writes. The
+// server adds optional ones, such as XAPPLEPUSHSERVICE, per listener.
+var extCaps = []imap.Cap{imap.CapMetadata, imap.CapObjectID, imap.CapACL, imap.Cap("RIGHTS=" + rightsCap)}
+
+var (
+	errCommandTooLarge = errors.New("command too large")
+
+	capabilityLine = regexp.MustCompile(`^\* CAPABILITY (.*)$`)
+	capabilityCode = regexp.MustCompile(`^(\S+ (?:OK|PREAUTH) \[CAPABILITY )([^\]]*)(\].*)$`)
+	literalSuffix  = regexp.MustCompile(`~?\{([0-9]+)(\+?)\}$`)
+)
+
+// extListener wraps accepted connections in an extConn
+type extListener struct {
+	net.Listener
+	tlsConfig *tls.Config
+	caps      []imap.Cap // Capabilities to advertise; extCaps when nil
+
+	// requireTLSForAuth refuses LOGIN and AUTHENTICATE until STARTTLS
+	requireTLSForAuth bool
+
+	tracer *logging.Tracer // Selects connections to trace; nil for none
+}
+
+func (l *extListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	caps := l.caps
+	if caps == nil {
+		caps = extCaps
+	}
+	trace := l.tracer.Start("imap", conn.RemoteAddr(), imapTraceFilter())
+	c := newExtConn(conn, l.tlsConfig, caps, trace)
+	c.requireTLSForAuth = l.requireTLSForAuth
+	return c, nil
+}
+
+type extConn struct {
+	net.Conn  // replaced by the TLS connection after STARTTLS
+	tlsConfig *tls.Config
+	caps      []imap.Cap
+
+	requireTLSForAuth bool
+
+	trace   *logging.Trace // Records the plaintext exchange; nil when not traced
+	br      *bufio.Reader
+	pending []byte
+	literal int64 // client literal bytes still to pass through
+	midLine bool  // the next client bytes continue a command line
+
+	wmu      sync.Mutex
+	wLiteral int64  // server literal bytes still to pass through
+	wMidLine bool   // the next server bytes continue a response line
+	wTail    []byte // end of the current partial response line
+
+	objectIDRequests []objectIDRequest // guarded by wmu
+
+	mu      sync.Mutex
+	session *Session
+	isTLS   bool
+}
+
+func newExtConn(conn net.Conn, tlsConfig *tls.Config, caps []imap.Cap, trace *logging.Trace) *extConn {
+	_, isTLS := conn.(*tls.Conn)
+	return &extConn{
+		Conn:      conn,
+		tlsConfig: tlsConfig,
+		caps:      caps,
+		trace:     trace,
+		br:        bufio.NewReaderSize(trace.Reader(conn), 64*1024),
+		isTLS:     isTLS,
+	}
+}
+
+// setSession attaches the session created for this connection
+func (c *extConn) setSession(s *Session) {
+	c.mu.Lock()
+	c.session = s
+	c.mu.Unlock()
+}
+
+// authenticatedSession returns the session if a user has logged in
+func (c *extConn) authenticatedSession() *Session {
+	c.mu.Lock()
+	s := c.session
+	c.mu.Unlock()
+	if s == nil {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.user == nil {
+		return nil
+	}
+	return s
+}
+
+// Read hands client data to imapserver, answering extension commands on the way
+func (c *extConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if c.literal > 0 {
+			n := int64(len(p))
+			if n > c.literal {
+				n = c.literal
+			}
+			read, err := c.br.Read(p[:n])
+			c.literal -= int64(read)
+			return read, err
+		}
+
+		line, err := c.br.ReadSlice('\n')
+		if len(line) == 0 {
+			return 0, err
+		}
+		if err != nil && err != bufio.ErrBufferFull && err != io.EOF {
+			return 0, err
+		}
+		complete := err == nil
+
+		if complete && !c.midLine {
+			handled, herr := c.intercept(line)
+			if herr != nil {
+				return 0, herr
+			}
+			if handled {
+				continue
+			}
+		}
+
+		c.pending = append(c.pending[:0], line...)
+		c.midLine = !complete
+		if complete {
+			if n, _, ok := trailingLiteral(bytes.TrimRight(line, "\r\n")); ok {
+				c.literal = n
+				c.midLine = true
+			}
+		}
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// intercept answers line if it starts a command extConn handles itself
+func (c *extConn) intercept(line []byte) (bool, error) {
+	tag, name, rest, ok := splitCommand(line)
+	if !ok {
+		return false, nil
+	}
+
+	if name == "STARTTLS" {
+		return c.startTLS(tag)
+	}
+	if (name == "LOGIN" || name == "AUTHENTICATE") && c.loginDisabled() {
+		return c.refuseCleartextAuth(tag, rest)
+	}
+	if name == "CLOSE" && len(bytes.TrimSpace(rest)) == 0 {
+		if s := c.authenticatedSession(); s != nil {
+			s.beginClose()
+		}
+		return false, nil
+	}
+	if name == "SELECT" || name == "EXAMINE" {
+		c.trackObjectIDs(objectIDRequest{tag: tag, selects: true})
+		return false, nil
+	}
+	if name == "FETCH" || name == "UID" && len(rest) > 6 && strings.EqualFold(string(rest[:6]), "FETCH ") {
+		return c.fetchObjectIDs(tag, name, rest)
+	}
+	if name == "SEARCH" || name == "UID" && len(rest) > 7 && strings.EqualFold(string(rest[:7]), "SEARCH ") {
+		return c.transcodeSearch(tag, name, rest)
+	}
+
+	cmd, ok := extCommands[name]
+	if !ok {
+		return false, nil
+	}
+	s := c.authenticatedSession()
+	if s == nil {
+		// Let imapserver reject it
+		return false, nil
+	}
+
+	args, err := c.readArgs(rest)
+	if errors.Is(err, errCommandTooLarge) {
+		return true, c.writeResponse(tag, nil, &imap.StatusResponse{
+			Type: imap.StatusResponseTypeNo,
+			Code: imap.ResponseCodeTooBig,
+			Text: "Command too large",
+		})
+	}
+	if err != nil {
+		return true, err
+	}
+
+	var untagged bytes.Buffer
+	status := cmd(s, &untagged, &argReader{b: args})
+	if status == nil {
+		status = &imap.StatusResponse{Type: imap.StatusResponseTypeOK, Text: name + " completed"}
+	}
+	return true, c.writeResponse(tag, untagged.Bytes(), status)
+}
+
+// readArgs collects the rest of a command, reading any literals it carries
+func (c *extConn) readArgs(rest []byte) ([]byte, error) {
+	args := append([]byte(nil), rest...)
+	tooLarge := false
+
+	for {
+		n, nonSync, ok := trailingLiteral(args)
+		if !ok {
+			break
+		}
+		if int64(len(args))+n > maxExtCommandSize {
+			if !nonSync {
+				// The client waits for a continuation, so it won't send the literal
+				return nil, errCommandTooLarge
+			}
+			tooLarge = true
+		} else if !nonSync {
+			if err := c.writeRaw([]byte("+ Ready for literal data\r\n")); err != nil {
+				return nil, err
+			}
+		}
+
+		if tooLarge {
+			if _, err := io.CopyN(io.Discard, c.br, n); err != nil {
+				return nil, err
+			}
+			args = args[:0]
+		} else {
+			args = append(args, '\r', '\n')
+			start := len(args)
+			args = append(args, make([]byte, n)...)
+			if _, err := io.ReadFull(c.br, args[start:]); err != nil {
+				return nil, err
+			}
+		}
+
+		line, err := c.br.ReadSlice('\n')
+		if err != nil && !errors.Is(err, bufio.ErrBufferFull) {
+			return nil, err
+		}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			return nil, errCommandTooLarge
+		}
+		args = append(args, bytes.TrimRight(line, "\r\n")...)
+	}
+
+	if tooLarge {
+		return nil, errCommandTooLarge
+	}
+	return args, nil
+}
+
+// tlsState returns the state of the connection's completed TLS handshake,
+// or nil before TLS
+func (c *extConn) tlsState() *tls.ConnectionState {
+	tlsConn, ok := c.Conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	state := tlsConn.ConnectionState()
+	if !state.HandshakeComplete {
+		return nil
+	}
+	return &state
+}
+
+// peerCertificate returns the client's TLS certificate, if it sent one
+func (c *extConn) peerCertificate() *x509.Certificate {
+	state := c.tlsState()
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	return state.PeerCertificates[0]
+}
+
+// loginDisabled reports whether authentication must wait for STARTTLS
+func (c *extConn) loginDisabled() bool {
+	return c.requireTLSForAuth && !c.isTLS
+}
+
+// refuseCleartextAuth rejects LOGIN or AUTHENTICATE before TLS. LITERAL+
+// arguments the client already sent are skipped; a synchronizing literal
+// is refused before the client sends it, so the password never arrives.
+func (c *extConn) refuseCleartextAuth(tag string, rest []byte) (bool, error) {
+	for {
+		n, nonSync, ok := trailingLiteral(rest)
+		if !ok || !nonSync {
+			break
+		}
+		if _, err := io.CopyN(io.Discard, c.br, n); err != nil {
+			return true, err
+		}
+		line, err := c.br.ReadSlice('\n')
+		if err != nil {
+			return true, err
+		}
+		rest = bytes.TrimRight(line, "\r\n")
+	}
+
+	return true, c.writeResponse(tag, nil, &imap.StatusResponse{
+		Type: imap.StatusResponseTypeNo,
+		Code: imap.ResponseCodePrivacyRequired,
+		Text: "Authentication is disabled until STARTTLS",
+	})
+}
+
+// startTLS performs STARTTLS here rather than in imapserver, so that extConn
+// keeps seeing the cleartext stream
+func (c *extConn) startTLS(tag string) (bool, error) {
+	if c.isTLS {
+		return true, c.writeResponse(tag, nil, &imap.StatusResponse{
+			Type: imap.StatusResponseTypeBad,
+			Text: "TLS is already active",
+		})
+	}
+	if c.tlsConfig == nil || c.authenticatedSession() != nil {
+		// Let imapserver reject it
+		return false, nil
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if err := c.send([]byte(tag + " OK Begin TLS negotiation now\r\n")); err != nil {
+		return true, err
+	}
+
+	// The client may have sent its ClientHello right behind the command
+	buffered, _ := c.br.Peek(c.br.Buffered())
+	cleartext := &prefixConn{Conn: c.Conn, r: io.MultiReader(bytes.NewReader(append([]byte(nil), buffered...)), c.Conn)}
+
+	tlsConn := tls.Server(cleartext, c.tlsConfig)
+	tlsConn.SetDeadline(time.Now().Add(startTLSTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		return true, fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	c.Conn = tlsConn
+	c.br.Reset(c.trace.Reader(tlsConn))
+	c.isTLS = true
+	return true, nil
+}
+
+// prefixConn reads from r instead of the underlying connection
+type prefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *extConn) writeResponse(tag string, untagged []byte, status *imap.StatusResponse) error {
+	var b bytes.Buffer
+	b.Write(untagged)
+	b.WriteString(tag)
+	b.WriteByte(' ')
+	b.WriteString(string(status.Type))
+	if status.Code != "" {
+		fmt.Fprintf(&b, " [%s]", status.Code)
+	}
+	fmt.Fprintf(&b, " %s\r\n", status.Text)
+	return c.writeRaw(b.Bytes())
+}
+
+func (c *extConn) writeRaw(p []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.send(p)
+}
+
+// send writes p to the client. The caller holds wmu.
+func (c *extConn) send(p []byte) error {
+	_, err := c.Conn.Write(p)
+	c.trace.Server(p)
+	return err
+}
+
+// Write forwards imapserver's output, adding extension capabilities and
+// object IDs
+func (c *extConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	out := p
+	if !c.wMidLine && c.wLiteral == 0 {
+		out = c.addObjectIDs(c.rewriteCapabilities(p))
+	}
+	c.trackWrite(p)
+
+	if err := c.send(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// trackWrite follows response line and literal boundaries in p
+func (c *extConn) trackWrite(p []byte) {
+	for len(p) > 0 {
+		if c.wLiteral > 0 {
+			n := int64(len(p))
+			if n > c.wLiteral {
+				n = c.wLiteral
+			}
+			p = p[n:]
+			c.wLiteral -= n
+			continue
+		}
+
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			c.wMidLine = true
+			c.wTail = append(c.wTail, p...)
+			if len(c.wTail) > 32 {
+				c.wTail = c.wTail[len(c.wTail)-32:]
+			}
+			return
+		}
+
+		line := append(c.wTail, p[:i]...)
+		c.wTail = c.wTail[:0]
+		c.wMidLine = false
+		if n, _, ok := trailingLiteral(bytes.TrimRight(line, "\r")); ok {
+			c.wLiteral = n
+			c.wMidLine = true
+		}
+		p = p[i+1:]
+	}
+}
+
+// rewriteCapabilities adds c.caps to a capability list at the start of p,
+// drops STARTTLS once extConn has done the TLS negotiation itself, and
+// replaces the AUTH= mechanisms with LOGINDISABLED while login is disabled
+func (c *extConn) rewriteCapabilities(p []byte) []byte {
+	end := bytes.Index(p, []byte("\r\n"))
+	if end < 0 {
+		return p
+	}
+	line := string(p[:end])
+
+	var prefix, caps, suffix string
+	if m := capabilityLine.FindStringSubmatch(line); m != nil {
+		prefix, caps = "* CAPABILITY ", m[1]
+	} else if m := capabilityCode.FindStringSubmatch(line); m != nil {
+		prefix, caps, suffix = m[1], m[2], m[3]
+	} else {
+		return p
+	}
+
+	fields := strings.Fields(caps)
+	out := make([]string, 0, len(fields)+len(c.caps))
+	for _, f := range fields {
+		if c.isTLS && strings.EqualFold(f, string(imap.CapStartTLS)) {
+			continue
+		}
+		if c.loginDisabled() && strings.HasPrefix(strings.ToUpper(f), "AUTH=") {
+			continue
+		}
+		out = append(out, f)
+	}
+	if c.loginDisabled() {
+		out = append(out, string(imap.CapLoginDisabled))
+	}
+	for _, ext := range c.caps {
+		out = append(out, string(ext))
+	}
+
+	rewritten := prefix + strings.Join(out, " ") + suffix
+	return append([]byte(rewritten), p[end:]...)
+}
+
+// splitCommand splits a command line into tag, upper-cased name and arguments
+func splitCommand(line []byte) (tag, name string, rest []byte, ok bool) {
+	line = bytes.TrimRight(line, "\r\n")
+	sp := bytes.IndexByte(line, ' ')
+	if sp <= 0 {
+		return "", "", nil, false
+	}
+	tag = string(line[:sp])
+	line = line[sp+1:]
+
+	if sp = bytes.IndexByte(line, ' '); sp >= 0 {
+		name, rest = string(line[:sp]), line[sp+1:]
+	} else {
+		name = string(line)
+	}
+	if name == "" {
+		return "", "", nil, false
+	}
+	return tag, strings.ToUpper(name), rest, true
+}
+
+// trailingLiteral reports whether line ends with a literal header such as
+// {12}, {12+} or ~{12}
+func trailingLiteral(line []byte) (n int64, nonSync, ok bool) {
+	m := literalSuffix.FindSubmatch(line)
+	if m == nil {
+		return 0, false, false
+	}
+	n, err := strconv.ParseInt(string(m[1]), 10, 64)
+	if err != nil {
+		return 0, false, false
+	}
+	return n, len(m[2]) > 0, true
+}
+
+// argReader parses the arguments of an extension command
+type argReader struct {
+	b   []byte
+	pos int
+}
+
+var errBadArgs = errors.New("invalid arguments")
+
+func (r *argReader) done() bool {
+	return r.pos >= len(r.b)
+}
+
+func (r *argReader) peek() byte {
+	if r.done() {
+		return 0
+	}
+	return r.b[r.pos]
+}
+
+// consume skips c if it is the next byte
+func (r *argReader) consume(c byte) bool {
+	if !r.done() && r.b[r.pos] == c {
+		r.pos++
+		return true
+	}
+	return false
+}
+
+func (r *argReader) expect(c byte) error {
+	if !r.consume(c) {
+		return fmt.Errorf("%w: expected %q", errBadArgs, c)
+	}
+	return nil
+}
+
+func (r *argReader) sp() error {
+	return r.expect(' ')
+}
+
+func isAtomChar(c byte) bool {
+	switch c {
+	case '(', ')', '{', ' ', '%', '*', '"', '\\':
+		return false
+	}
+	return c > 0x1f && c < 0x7f
+}
+
+// atom reads an atom, allowing the list wildcards used in entry names
+func (r *argReader) atom() (string, error) {
+	start := r.pos
+	for !r.done() && (isAtomChar(r.b[r.pos]) || r.b[r.pos] == '*' || r.b[r.pos] == '%') {
+		r.pos++
+	}
+	if r.pos == start {
+		return "", fmt.Errorf("%w: expected atom", errBadArgs)
+	}
+	return string(r.b[start:r.pos]), nil
+}
+
+func (r *argReader) quoted() ([]byte, error) {
+	if err := r.expect('"'); err != nil {
+		return nil, err
+	}
+	var out []byte
+	for !r.done() {
+		c := r.b[r.pos]
+		r.pos++
+		switch c {
+		case '"':
+			return out, nil
+		case '\\':
+			if r.done() {
+				return nil, fmt.Errorf("%w: unterminated quoted string", errBadArgs)
+			}
+			out = append(out, r.b[r.pos])
+			r.pos++
+		case '\r', '\n':
+			return nil, fmt.Errorf("%w: newline in quoted string", errBadArgs)
+		default:
+			out = append(out, c)
+		}
+	}
+	return nil, fmt.Errorf("%w: unterminated quoted string", errBadArgs)
+}
+
+// literal reads a literal readArgs has already inlined after its header
+func (r *argReader) literal() ([]byte, error) {
+	r.consume('~')
+	if err := r.expect('{'); err != nil {
+		return nil, err
+	}
+	start := r.pos
+	for !r.done() && r.b[r.pos] >= '0' && r.b[r.pos] <= '9' {
+		r.pos++
+	}
+	n, err := strconv.Atoi(string(r.b[start:r.pos]))
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad literal size", errBadArgs)
+	}
+	r.consume('+')
+	if err := r.expect('}'); err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(r.b[r.pos:], []byte("\r\n")) || len(r.b)-r.pos-2 < n {
+		return nil, fmt.Errorf("%w: truncated literal", errBadArgs)
+	}
+	r.pos += 2
+	out := r.b[r.pos : r.pos+n]
+	r.pos += n
+	return out, nil
+}
+
+// string reads a quoted string or literal
+func (r *argReader) string() ([]byte, error) {
+	switch r.peek() {
+	case '"':
+		return r.quoted()
+	case '{', '~':
+		return r.literal()
+	}
+	return nil, fmt.Errorf("%w: expected string", errBadArgs)
+}
+
+func (r *argReader) astring() (string, error) {
+	switch r.peek() {
+	case '"', '{', '~':
+		b, err := r.string()
+		return string(b), err
+	}
+	return r.atom()
+}
+
+// nstring reads a string or NIL, returning nil for NIL
+func (r *argReader) nstring() ([]byte, error) {
+	switch r.peek() {
+	case '"', '{', '~':
+		b, err := r.string()
+		if b == nil && err == nil {
+			b = []byte{}
+		}
+		return b, err
+	}
+	atom, err := r.atom()
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(atom, "NIL") {
+		return nil, fmt.Errorf("%w: expected string or NIL", errBadArgs)
+	}
+	return nil, nil
+}
+
+// mailbox reads a mailbox name, decoding modified UTF-7 as imapserver does
+func (r *argReader) mailbox() (string, error) {
+	name, err := r.astring()
+	if err != nil {
+		return "", err
+	}
+	if strings.EqualFold(name, "INBOX") {
+		return "INBOX", nil
+	}
+	return decodeMailboxName(name)
+}
+
+// writeString writes b as a quoted string, or a literal if it can't be quoted
+func writeString(w *bytes.Buffer, b []byte) {
+	quotable := len(b) < 1024
+	for _, c := range b {
+		if c == '\r' || c == '\n' || c == 0 || c >= 0x80 {
+			quotable = false
+			break
+		}
+	}
+	if !quotable {
+		fmt.Fprintf(w, "{%d}\r\n", len(b))
+		w.Write(b)
+		return
+	}
+	w.WriteByte('"')
+	for _, c := range b {
+		if c == '"' || c == '\\' {
+			w.WriteByte('\\')
+		}
+		w.WriteByte(c)
+	}
+	w.WriteByte('"')
+}
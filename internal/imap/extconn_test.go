@@ -0,0 +1,164 @@
+package imap
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testTLSConfig returns a server TLS config with a self-signed certificate
+func testTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+// startTLS runs STARTTLS and switches the client to the TLS connection
+func (c *rawClient) startTLS() {
+	c.t.Helper()
+	c.startTLSWith(&tls.Config{InsecureSkipVerify: true})
+}
+
+// startTLSWith is startTLS with a client TLS config
+func (c *rawClient) startTLSWith(config *tls.Config) {
+	c.t.Helper()
+	if _, status := c.command("STARTTLS"); !strings.HasPrefix(status, "OK") {
+		c.t.Fatalf("STARTTLS = %q", status)
+	}
+	tlsConn := tls.Client(c.conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		c.t.Fatalf("TLS handshake error: %v", err)
+	}
+	c.conn = tlsConn
+	c.r = bufio.NewReader(tlsConn)
+}
+
+func TestLoginDisabledUntilStartTLS(t *testing.T) {
+	srv, _ := newTestServerTLS(t, testTLSConfig(t))
+	srv.SetRequireTLSForAuth(true)
+	c := dialRaw(t, listenTestServer(t, srv))
+
+	untagged, _ := c.command("CAPABILITY")
+	if len(untagged) != 1 || !strings.Contains(untagged[0], " LOGINDISABLED") ||
+		!strings.Contains(untagged[0], " STARTTLS") || strings.Contains(untagged[0], "AUTH=") {
+		t.Errorf("CAPABILITY before STARTTLS = %q, want LOGINDISABLED and no AUTH=", untagged)
+	}
+
+	if _, status := c.command("LOGIN alice@example.com password123"); !strings.HasPrefix(status, "NO [PRIVACYREQUIRED]") {
+		t.Errorf("LOGIN before STARTTLS = %q, want NO [PRIVACYREQUIRED]", status)
+	}
+	if _, status := c.command("AUTHENTICATE PLAIN AGFsaWNlQGV4YW1wbGUuY29tAHBhc3N3b3JkMTIz"); !strings.HasPrefix(status, "NO") {
+		t.Errorf("AUTHENTICATE before STARTTLS = %q, want NO", status)
+	}
+	// Literal arguments are skipped, so the next command is read correctly
+	if _, status := c.command("LOGIN {17+}\r\nalice@example.com {11+}\r\npassword123"); !strings.HasPrefix(status, "NO") {
+		t.Errorf("LOGIN with literals before STARTTLS = %q, want NO", status)
+	}
+	if _, status := c.command("NOOP"); !strings.HasPrefix(status, "OK") {
+		t.Errorf("NOOP after refused LOGIN = %q", status)
+	}
+
+	c.startTLS()
+	untagged, _ = c.command("CAPABILITY")
+	if len(untagged) != 1 || strings.Contains(untagged[0], "LOGINDISABLED") || !strings.Contains(untagged[0], "AUTH=PLAIN") {
+		t.Errorf("CAPABILITY after STARTTLS = %q, want AUTH=PLAIN", untagged)
+	}
+	c.login()
+}
+
+func TestLoginAllowedWithoutTLSByDefault(t *testing.T) {
+	c := dialRaw(t, startTestServer(t))
+
+	untagged, _ := c.command("CAPABILITY")
+	if len(untagged) != 1 || strings.Contains(untagged[0], "LOGINDISABLED") {
+		t.Errorf("CAPABILITY = %q, want no LOGINDISABLED", untagged)
+	}
+	c.login()
+}
+
+func TestLoginWithAppPassword(t *testing.T) {
+	srv, _ := newTestServer(t)
+	addr := listenTestServer(t, srv)
+
+	ctx := context.Background()
+	alice, err := srv.authenticator.LookupUser(ctx, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	password, appPassword, err := srv.authenticator.CreateAppPassword(ctx, alice.ID, "Laptop")
+	if err != nil {
+		t.Fatalf("CreateAppPassword() error = %v", err)
+	}
+
+	c := dialRaw(t, addr)
+	if _, status := c.command("LOGIN alice@example.com %s", password); !strings.HasPrefix(status, "OK") {
+		t.Fatalf("LOGIN with app password = %q", status)
+	}
+
+	if err := srv.authenticator.RevokeAppPassword(ctx, alice.ID, appPassword.ID); err != nil {
+		t.Fatalf("RevokeAppPassword() error = %v", err)
+	}
+	c = dialRaw(t, addr)
+	if _, status := c.command("LOGIN alice@example.com %s", password); !strings.HasPrefix(status, "NO") {
+		t.Errorf("LOGIN with revoked app password = %q, want NO", status)
+	}
+}
+
+func TestSearchDecodesLatin1Charset(t *testing.T) {
+	srv, _ := newTestServer(t)
+	addr := listenTestServer(t, srv)
+	ctx := context.Background()
+
+	user, _ := srv.authenticator.LookupUser(ctx, "alice@example.com")
+	inbox, _ := srv.store.GetMailbox(ctx, user.ID, "INBOX")
+	for _, subject := range []string{"=?UTF-8?Q?Caf=C3=A9_menu?=", "Coffee menu"} {
+		msg := "Subject: " + subject + "\r\n\r\nhello\r\n"
+		if _, err := srv.store.AppendMessage(ctx, inbox.ID, nil, time.Now(), strings.NewReader(msg)); err != nil {
+			t.Fatalf("AppendMessage() error = %v", err)
+		}
+	}
+
+	c := dialRaw(t, addr)
+	c.login()
+	c.command("SELECT INBOX")
+
+	// "Café" in ISO-8859-1
+	untagged, status := c.command("SEARCH CHARSET ISO-8859-1 SUBJECT \"Caf\xe9\"")
+	if !strings.HasPrefix(status, "OK") || !containsLine(untagged, "* SEARCH 1") {
+		t.Errorf("SEARCH = %q, %q, want message 1", untagged, status)
+	}
+	untagged, status = c.command("UID SEARCH CHARSET latin1 SUBJECT {4+}\r\nCaf\xe9")
+	if !strings.HasPrefix(status, "OK") || !containsLine(untagged, "* SEARCH 1") {
+		t.Errorf("UID SEARCH with literal = %q, %q, want UID 1", untagged, status)
+	}
+
+	_, status = c.command("SEARCH CHARSET UTF-7 SUBJECT \"menu\"")
+	if want := "NO [BADCHARSET (US-ASCII UTF-8 ISO-8859-1 ISO-8859-2 ISO-8859-15 WINDOWS-1252 KOI8-R GBK SHIFT_JIS BIG5)]"; !strings.HasPrefix(status, want) {
+		t.Errorf("SEARCH in unsupported charset = %q, want %q", status, want)
+	}
+	if _, status := c.command("NOOP"); !strings.HasPrefix(status, "OK") {
+		t.Errorf("NOOP after refused SEARCH = %q", status)
+	}
+}
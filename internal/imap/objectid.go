@@ -0,0 +1,255 @@
+package imap
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fenilsonani/email-server/internal/storage"
+)
+
+// OBJECTID (RFC 8474) gives mailboxes and messages IDs that survive a
+// rename or a copy. imapserver knows nothing of them, so extConn strips
+// the EMAILID and THREADID items from FETCH commands and adds them to the
+// responses, and adds MAILBOXID to the end of a SELECT or EXAMINE.
+
+var fetchResponseUID = regexp.MustCompile(`^\* [0-9]+ FETCH \(UID ([0-9]+)`)
+
+// objectIDRequest is a command whose responses may need object IDs added
+type objectIDRequest struct {
+	tag      string
+	selects  bool // SELECT or EXAMINE: report the MAILBOXID
+	emailID  bool
+	threadID bool
+
+	ids map[uint32]storage.ObjectIDs // By UID, looked up by Fetch before it writes
+}
+
+// trackObjectIDs records a command until its tagged response is written
+func (c *extConn) trackObjectIDs(req objectIDRequest) {
+	c.wmu.Lock()
+	c.objectIDRequests = append(c.objectIDRequests, req)
+	c.wmu.Unlock()
+}
+
+// wantsObjectIDs reports whether the FETCH being answered asked for object
+// IDs
+func (c *extConn) wantsObjectIDs() bool {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if len(c.objectIDRequests) == 0 {
+		return false
+	}
+	req := c.objectIDRequests[0]
+	return !req.selects && (req.emailID || req.threadID)
+}
+
+// setObjectIDs hands the FETCH being answered the object IDs of the
+// messages it returns, so they needn't be looked up line by line
+func (c *extConn) setObjectIDs(ids map[uint32]storage.ObjectIDs) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if len(c.objectIDRequests) > 0 && !c.objectIDRequests[0].selects {
+		c.objectIDRequests[0].ids = ids
+	}
+}
+
+// fetchObjectIDs removes EMAILID and THREADID from a FETCH or UID FETCH
+// command before imapserver sees it, remembering them for the responses
+func (c *extConn) fetchObjectIDs(tag, name string, rest []byte) (bool, error) {
+	cmd := name
+	if name == "UID" {
+		cmd, rest = "UID FETCH", rest[len("FETCH "):]
+	}
+
+	req := objectIDRequest{tag: tag}
+	args, ok := stripObjectIDItems(rest, &req)
+	// Plain FETCHes are tracked too, so their responses aren't mistaken
+	// for those of a later pipelined one
+	c.trackObjectIDs(req)
+	if !ok || !req.emailID && !req.threadID {
+		return false, nil
+	}
+
+	// Read hands the rewritten command to imapserver
+	c.pending = append(c.pending[:0], fmt.Sprintf("%s %s %s\r\n", tag, cmd, args)...)
+	return true, nil
+}
+
+// stripObjectIDItems removes EMAILID and THREADID from the items of FETCH
+// arguments, noting them in req. A command ending in a literal is left
+// alone.
+func stripObjectIDItems(args []byte, req *objectIDRequest) ([]byte, bool) {
+	if _, _, ok := trailingLiteral(args); ok {
+		return nil, false
+	}
+	set, items, ok := bytes.Cut(args, []byte(" "))
+	if !ok || len(items) == 0 {
+		return nil, false
+	}
+
+	var rest []byte
+	var names [][]byte
+	if items[0] == '(' {
+		// Split the list at spaces outside of [...], which can hold a
+		// parenthesized header list
+		depth, start, end := 0, 1, -1
+		for i := 1; i < len(items) && end < 0; i++ {
+			switch items[i] {
+			case '[':
+				depth++
+			case ']':
+				depth--
+			case ' ', ')':
+				if depth > 0 {
+					continue
+				}
+				if i > start {
+					names = append(names, items[start:i])
+				}
+				start = i + 1
+				if items[i] == ')' {
+					end = i
+				}
+			}
+		}
+		if end < 0 {
+			return nil, false
+		}
+		rest = items[end+1:]
+	} else {
+		item, after, _ := bytes.Cut(items, []byte(" "))
+		names = [][]byte{item}
+		if len(after) > 0 {
+			rest = append([]byte(" "), after...)
+		}
+	}
+
+	kept := make([]string, 0, len(names))
+	for _, name := range names {
+		switch strings.ToUpper(string(name)) {
+		case "EMAILID":
+			req.emailID = true
+		case "THREADID":
+			req.threadID = true
+		default:
+			kept = append(kept, string(name))
+		}
+	}
+	if len(kept) == 0 {
+		// Responses always carry the UID, so asking for it changes nothing
+		kept = append(kept, "UID")
+	}
+
+	var out bytes.Buffer
+	out.Write(set)
+	out.WriteString(" (")
+	out.WriteString(strings.Join(kept, " "))
+	out.WriteByte(')')
+	out.Write(rest)
+	return out.Bytes(), true
+}
+
+// addObjectIDs adds the object IDs a command asked for to the response
+// line at the start of p. It is called with wmu held.
+func (c *extConn) addObjectIDs(p []byte) []byte {
+	if len(c.objectIDRequests) == 0 {
+		return p
+	}
+	end := bytes.Index(p, []byte("\r\n"))
+	if end < 0 {
+		return p
+	}
+	line := p[:end]
+
+	if tag, status, ok := bytes.Cut(line, []byte(" ")); ok && string(tag) != "*" && string(tag) != "+" {
+		for i, req := range c.objectIDRequests {
+			if req.tag != string(tag) {
+				continue
+			}
+			c.objectIDRequests = append(c.objectIDRequests[:i], c.objectIDRequests[i+1:]...)
+			if req.selects && bytes.HasPrefix(status, []byte("OK ")) {
+				if s := c.authenticatedSession(); s != nil {
+					if id := s.selectedMailboxID(); id != 0 {
+						untagged := fmt.Sprintf("* OK [MAILBOXID (%s)] Ok\r\n", mailboxObjectID(id))
+						return append([]byte(untagged), p...)
+					}
+				}
+			}
+			break
+		}
+		return p
+	}
+
+	req := c.objectIDRequests[0]
+	if !req.emailID && !req.threadID {
+		return p
+	}
+	m := fetchResponseUID.FindSubmatchIndex(line)
+	if m == nil {
+		return p
+	}
+	uid, err := strconv.ParseUint(string(line[m[2]:m[3]]), 10, 32)
+	if err != nil {
+		return p
+	}
+	ids, ok := req.ids[uint32(uid)]
+	if !ok {
+		// Not looked up ahead, as for a message added since
+		s := c.authenticatedSession()
+		if s == nil {
+			return p
+		}
+		ids.EmailID, ids.ThreadID, err = s.messageObjectIDs(uint32(uid))
+		if err != nil {
+			log.Printf("IMAP: Failed to get object IDs for UID %d: %v", uid, err)
+			return p
+		}
+	}
+	emailID, threadID := ids.EmailID, ids.ThreadID
+
+	var items bytes.Buffer
+	if req.emailID {
+		fmt.Fprintf(&items, " EMAILID (%s)", emailID)
+	}
+	if req.threadID {
+		fmt.Fprintf(&items, " THREADID (%s)", threadID)
+	}
+	out := make([]byte, 0, len(p)+items.Len())
+	out = append(out, p[:m[1]]...)
+	out = append(out, items.Bytes()...)
+	return append(out, p[m[1]:]...)
+}
+
+// mailboxObjectID returns the MAILBOXID of a mailbox: its row ID, which a
+// rename keeps
+func mailboxObjectID(mailboxID int64) string {
+	return "F" + strconv.FormatInt(mailboxID, 10)
+}
+
+// selectedMailboxID returns the ID of the selected mailbox, or 0
+func (s *Session) selectedMailboxID() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.selected == nil {
+		return 0
+	}
+	return s.selected.ID
+}
+
+// messageObjectIDs returns the EMAILID and THREADID of a message in the
+// selected mailbox
+func (s *Session) messageObjectIDs(uid uint32) (string, string, error) {
+	mailboxID := s.selectedMailboxID()
+	if mailboxID == 0 {
+		return "", "", fmt.Errorf("no mailbox selected")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return s.server.store.MessageObjectIDs(ctx, mailboxID, uid)
+}
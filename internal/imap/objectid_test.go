@@ -0,0 +1,136 @@
+package imap
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	mailboxIDPattern = regexp.MustCompile(`^\* OK \[MAILBOXID \(([A-Za-z0-9_-]+)\)\]`)
+	emailIDPattern   = regexp.MustCompile(`EMAILID \(([A-Za-z0-9_-]+)\)`)
+	threadIDPattern  = regexp.MustCompile(`THREADID \(([A-Za-z0-9_-]+)\)`)
+)
+
+// selectMailboxID selects mailbox and returns the MAILBOXID it reported
+func (c *rawClient) selectMailboxID(mailbox string) string {
+	c.t.Helper()
+	untagged, status := c.command("SELECT %s", mailbox)
+	if !strings.HasPrefix(status, "OK") {
+		c.t.Fatalf("SELECT %s = %q", mailbox, status)
+	}
+	for _, l := range untagged {
+		if m := mailboxIDPattern.FindStringSubmatch(l); m != nil {
+			return m[1]
+		}
+	}
+	c.t.Fatalf("SELECT %s response = %q, want MAILBOXID", mailbox, untagged)
+	return ""
+}
+
+func TestStripObjectIDItems(t *testing.T) {
+	tests := []struct {
+		args, want        string
+		emailID, threadID bool
+	}{
+		{"1:* (EMAILID FLAGS)", "1:* (FLAGS)", true, false},
+		{"1 (threadid emailid)", "1 (UID)", true, true},
+		{"1 EMAILID", "1 (UID)", true, false},
+		{"1 (BODY.PEEK[HEADER.FIELDS (EMAILID SUBJECT)] THREADID)", "1 (BODY.PEEK[HEADER.FIELDS (EMAILID SUBJECT)])", false, true},
+		{"1 (FLAGS) (CHANGEDSINCE 5)", "1 (FLAGS) (CHANGEDSINCE 5)", false, false},
+	}
+	for _, tt := range tests {
+		var req objectIDRequest
+		got, ok := stripObjectIDItems([]byte(tt.args), &req)
+		if !ok || string(got) != tt.want || req.emailID != tt.emailID || req.threadID != tt.threadID {
+			t.Errorf("stripObjectIDItems(%q) = %q, %v, %+v; want %q, %v, %v",
+				tt.args, got, ok, req, tt.want, tt.emailID, tt.threadID)
+		}
+	}
+}
+
+func TestEmailIDSurvivesCopy(t *testing.T) {
+	srv, _ := newTestServer(t)
+	addr := listenTestServer(t, srv)
+	ctx := context.Background()
+
+	user, err := srv.authenticator.LookupUser(ctx, "alice@example.com")
+	if err != nil {
+		t.Fatalf("LookupUser() error = %v", err)
+	}
+	inbox, err := srv.store.GetMailbox(ctx, user.ID, "INBOX")
+	if err != nil {
+		t.Fatalf("GetMailbox() error = %v", err)
+	}
+	for _, msg := range []string{
+		"Message-ID: <root@example.com>\r\nSubject: hi\r\n\r\nhello\r\n",
+		"Message-ID: <reply@example.com>\r\nReferences: <root@example.com>\r\nSubject: Re: hi\r\n\r\nhello back\r\n",
+	} {
+		if _, err := srv.store.AppendMessage(ctx, inbox.ID, nil, time.Now(), strings.NewReader(msg)); err != nil {
+			t.Fatalf("AppendMessage() error = %v", err)
+		}
+	}
+
+	c := dialRaw(t, addr)
+	c.login()
+	if untagged, _ := c.command("CAPABILITY"); len(untagged) != 1 || !strings.Contains(untagged[0], " OBJECTID") {
+		t.Errorf("CAPABILITY response = %q, want OBJECTID", untagged)
+	}
+	c.selectMailboxID("INBOX")
+
+	untagged, status := c.command("FETCH 1:2 (EMAILID THREADID FLAGS)")
+	if !strings.HasPrefix(status, "OK") || len(untagged) != 2 {
+		t.Fatalf("FETCH = %q, %q", untagged, status)
+	}
+	// By sequence number, since responses may come in any order
+	emailIDs, threadIDs := make(map[int]string), make(map[int]string)
+	for _, l := range untagged {
+		var seq int
+		fmt.Sscanf(l, "* %d FETCH", &seq)
+		e, th := emailIDPattern.FindStringSubmatch(l), threadIDPattern.FindStringSubmatch(l)
+		if seq == 0 || e == nil || th == nil || !strings.Contains(l, "FLAGS (") {
+			t.Fatalf("FETCH response = %q, want EMAILID, THREADID and FLAGS", l)
+		}
+		emailIDs[seq], threadIDs[seq] = e[1], th[1]
+	}
+	if emailIDs[1] == emailIDs[2] {
+		t.Errorf("different messages share EMAILID %s", emailIDs[1])
+	}
+	if threadIDs[1] != threadIDs[2] {
+		t.Errorf("THREADIDs = %q, want the reply in its parent's thread", threadIDs)
+	}
+
+	if _, status := c.command("COPY 1 Trash"); !strings.HasPrefix(status, "OK") {
+		t.Fatalf("COPY = %q", status)
+	}
+	c.selectMailboxID("Trash")
+	untagged, _ = c.command("UID FETCH 1:* EMAILID")
+	if len(untagged) != 1 {
+		t.Fatalf("UID FETCH = %q", untagged)
+	}
+	if m := emailIDPattern.FindStringSubmatch(untagged[0]); m == nil || m[1] != emailIDs[1] {
+		t.Errorf("copy's FETCH = %q, want EMAILID %s", untagged[0], emailIDs[1])
+	}
+}
+
+func TestMailboxIDSurvivesRename(t *testing.T) {
+	c := dialRaw(t, startTestServer(t))
+	c.login()
+
+	if _, status := c.command("CREATE Projects"); !strings.HasPrefix(status, "OK") {
+		t.Fatalf("CREATE = %q", status)
+	}
+	before := c.selectMailboxID("Projects")
+	if inbox := c.selectMailboxID("INBOX"); inbox == before {
+		t.Errorf("INBOX and Projects share MAILBOXID %s", before)
+	}
+	if _, status := c.command("RENAME Projects Work"); !strings.HasPrefix(status, "OK") {
+		t.Fatalf("RENAME = %q", status)
+	}
+	if after := c.selectMailboxID("Work"); after != before {
+		t.Errorf("MAILBOXID after rename = %s, want %s", after, before)
+	}
+}
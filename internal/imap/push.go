@@ -0,0 +1,403 @@
+package imap
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+// Apple Mail registers for push with the XAPPLEPUSHSERVICE command and then
+// expects a silent APNs notification carrying its aps-account-id whenever
+// one of the registered mailboxes gets new mail. The device re-syncs over
+// IMAP in response, so the push itself carries no message data.
+
+// capXApplePushService is advertised when a push notifier is configured
+const capXApplePushService imap.Cap = "XAPPLEPUSHSERVICE"
+
+// maxPushMailboxes bounds the mailboxes one registration may watch
+const maxPushMailboxes = 100
+
+// maxPushes bounds the pushes in flight; a delivery beyond it pushes nothing
+const maxPushes = 64
+
+// ErrDeviceUnregistered is returned by a PushNotifier when the push service
+// no longer accepts the device token. The registration is then removed.
+var ErrDeviceUnregistered = errors.New("push device is no longer registered")
+
+// PushDevice is a device registered for new-mail notifications
+type PushDevice struct {
+	ID          int64
+	UserID      int64
+	DeviceToken string   // hex APNs device token
+	AccountID   string   // aps-account-id, echoed back in the payload
+	Subtopic    string   // aps-subtopic, e.g. com.apple.mobilemail
+	Mailboxes   []string // Mailboxes that trigger a push
+}
+
+// watches reports whether the device wants pushes for mailbox
+func (d *PushDevice) watches(mailbox string) bool {
+	for _, name := range d.Mailboxes {
+		if name == mailbox {
+			return true
+		}
+	}
+	return false
+}
+
+// PushNotifier sends a push notification to one device
+type PushNotifier interface {
+	Notify(ctx context.Context, device *PushDevice) error
+}
+
+// PushStore handles push device registrations
+type PushStore struct {
+	db *sql.DB
+}
+
+// NewPushStore creates a new push device store
+func NewPushStore(db *sql.DB) *PushStore {
+	return &PushStore{db: db}
+}
+
+// Register adds a device, or updates the subtopic and mailboxes of an
+// existing registration for the same token and account
+func (s *PushStore) Register(ctx context.Context, d *PushDevice) error {
+	err := s.db.QueryRowContext(ctx, `
+		INSERT INTO push_devices (user_id, device_token, account_id, subtopic, mailboxes)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (user_id, device_token, account_id) DO UPDATE SET
+			subtopic = excluded.subtopic,
+			mailboxes = excluded.mailboxes,
+			updated_at = CURRENT_TIMESTAMP
+		RETURNING id
+	`, d.UserID, d.DeviceToken, d.AccountID, d.Subtopic, strings.Join(d.Mailboxes, "\n")).Scan(&d.ID)
+	if err != nil {
+		return fmt.Errorf("failed to register push device: %w", err)
+	}
+	return nil
+}
+
+// Unregister removes a device registration
+func (s *PushStore) Unregister(ctx context.Context, id int64) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM push_devices WHERE id = ?", id)
+	return err
+}
+
+// DevicesForMailbox returns the user's devices that watch mailbox
+func (s *PushStore) DevicesForMailbox(ctx context.Context, userID int64, mailbox string) ([]*PushDevice, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, user_id, device_token, account_id, subtopic, mailboxes
+		FROM push_devices
+		WHERE user_id = ?
+		ORDER BY id
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var devices []*PushDevice
+	for rows.Next() {
+		d := &PushDevice{}
+		var mailboxes string
+		if err := rows.Scan(&d.ID, &d.UserID, &d.DeviceToken, &d.AccountID, &d.Subtopic, &mailboxes); err != nil {
+			return nil, err
+		}
+		d.Mailboxes = strings.Split(mailboxes, "\n")
+		if d.watches(mailbox) {
+			devices = append(devices, d)
+		}
+	}
+	return devices, rows.Err()
+}
+
+// SetPushNotifier enables XAPPLEPUSHSERVICE. Devices register in store and
+// are notified through notifier; topic is returned to registering clients.
+// It must be called before the server starts listening.
+func (s *Server) SetPushNotifier(store *PushStore, notifier PushNotifier, topic string) {
+	s.pushStore = store
+	s.pushNotifier = notifier
+	s.pushTopic = topic
+}
+
+// capabilities returns the extension capabilities this server advertises
+func (s *Server) capabilities() []imap.Cap {
+	caps := append([]imap.Cap(nil), extCaps...)
+	if s.pushNotifier != nil {
+		caps = append(caps, capXApplePushService)
+	}
+	return caps
+}
+
+// notifyPush sends a push to every device of the user watching mailbox
+func (s *Server) notifyPush(ctx context.Context, userID int64, mailbox string) {
+	if s.pushNotifier == nil {
+		return
+	}
+
+	devices, err := s.pushStore.DevicesForMailbox(ctx, userID, mailbox)
+	if err != nil {
+		log.Printf("IMAP v2: Failed to look up push devices: %v", err)
+		return
+	}
+
+	for _, d := range devices {
+		err := s.pushNotifier.Notify(ctx, d)
+		switch {
+		case errors.Is(err, ErrDeviceUnregistered):
+			log.Printf("IMAP v2: Removing unregistered push device %d", d.ID)
+			if err := s.pushStore.Unregister(ctx, d.ID); err != nil {
+				log.Printf("IMAP v2: Failed to remove push device %d: %v", d.ID, err)
+			}
+		case err != nil:
+			log.Printf("IMAP v2: Push notification to device %d failed: %v", d.ID, err)
+		}
+	}
+}
+
+// handleXApplePushService registers the client's device for push:
+// XAPPLEPUSHSERVICE aps-version 2 aps-account-id <id> aps-device-token <hex>
+// aps-subtopic com.apple.mobilemail mailboxes (INBOX "Notes")
+func (s *Session) handleXApplePushService(w *bytes.Buffer, args *argReader) *imap.StatusResponse {
+	if s.server.pushNotifier == nil {
+		return &imap.StatusResponse{Type: imap.StatusResponseTypeBad, Text: "Unknown command"}
+	}
+
+	params := make(map[string]string)
+	var mailboxes []string
+	for !args.done() {
+		key, err := args.atom()
+		if err != nil {
+			return badPushArgs(err)
+		}
+		if err := args.sp(); err != nil {
+			return badPushArgs(err)
+		}
+		key = strings.ToLower(key)
+
+		if key == "mailboxes" {
+			if err := args.expect('('); err != nil {
+				return badPushArgs(err)
+			}
+			for !args.consume(')') {
+				if len(mailboxes) > 0 {
+					if err := args.sp(); err != nil {
+						return badPushArgs(err)
+					}
+				}
+				name, err := args.mailbox()
+				if err != nil {
+					return badPushArgs(err)
+				}
+				if len(mailboxes) >= maxPushMailboxes {
+					return badPushArgs(fmt.Errorf("too many mailboxes"))
+				}
+				mailboxes = append(mailboxes, name)
+			}
+		} else {
+			value, err := args.astring()
+			if err != nil {
+				return badPushArgs(err)
+			}
+			params[key] = value
+		}
+
+		if !args.done() {
+			if err := args.sp(); err != nil {
+				return badPushArgs(err)
+			}
+		}
+	}
+
+	version := params["aps-version"]
+	if version != "1" && version != "2" {
+		return badPushArgs(fmt.Errorf("unsupported aps-version %q", version))
+	}
+	token := strings.ToLower(params["aps-device-token"])
+	if _, err := hex.DecodeString(token); err != nil || token == "" || len(token) > 200 {
+		return badPushArgs(fmt.Errorf("invalid aps-device-token"))
+	}
+	accountID := params["aps-account-id"]
+	if accountID == "" || len(accountID) > 200 {
+		return badPushArgs(fmt.Errorf("invalid aps-account-id"))
+	}
+	if len(mailboxes) == 0 {
+		mailboxes = []string{"INBOX"}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	device := &PushDevice{
+		UserID:      s.user.ID,
+		DeviceToken: token,
+		AccountID:   accountID,
+		Subtopic:    params["aps-subtopic"],
+		Mailboxes:   mailboxes,
+	}
+	if err := s.server.pushStore.Register(ctx, device); err != nil {
+		log.Printf("IMAP v2: XAPPLEPUSHSERVICE failed for %s: %v", s.user.Email, err)
+		return &imap.StatusResponse{Type: imap.StatusResponseTypeNo, Code: imap.ResponseCodeServerBug, Text: "Failed to register device"}
+	}
+
+	w.WriteString("* XAPPLEPUSHSERVICE aps-version ")
+	writeString(w, []byte(version))
+	w.WriteString(" aps-topic ")
+	writeString(w, []byte(s.server.pushTopic))
+	w.WriteString("\r\n")
+	return nil
+}
+
+func badPushArgs(err error) *imap.StatusResponse {
+	return &imap.StatusResponse{Type: imap.StatusResponseTypeBad, Text: "Invalid XAPPLEPUSHSERVICE arguments: " + err.Error()}
+}
+
+// APNs endpoints for token-based provider connections
+const (
+	apnsProductionURL = "https://api.push.apple.com"
+	apnsSandboxURL    = "https://api.sandbox.push.apple.com"
+
+	// apnsTokenLifetime is how long a provider token is reused. APNs rejects
+	// tokens older than an hour and refreshes more often than every 20 minutes.
+	apnsTokenLifetime = 40 * time.Minute
+)
+
+// APNsConfig configures token-based authentication with APNs
+type APNsConfig struct {
+	KeyFile string // .p8 signing key from the Apple developer account
+	KeyID   string // 10-character key identifier
+	TeamID  string // Apple developer team identifier
+	Topic   string // apns-topic, e.g. com.apple.mail.XServer.<uuid>
+	Sandbox bool   // Use the development environment
+}
+
+// APNsNotifier sends silent pushes through the Apple Push Notification service
+type APNsNotifier struct {
+	config   APNsConfig
+	key      *ecdsa.PrivateKey
+	client   *http.Client
+	endpoint string
+
+	mu          sync.Mutex
+	token       string
+	tokenIssued time.Time
+}
+
+// NewAPNsNotifier loads the signing key and creates a notifier
+func NewAPNsNotifier(cfg APNsConfig) (*APNsNotifier, error) {
+	data, err := os.ReadFile(cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read APNs key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("APNs key %s is not PEM encoded", cfg.KeyFile)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse APNs key: %w", err)
+	}
+	key, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("APNs key %s is not an ECDSA key", cfg.KeyFile)
+	}
+
+	endpoint := apnsProductionURL
+	if cfg.Sandbox {
+		endpoint = apnsSandboxURL
+	}
+	return &APNsNotifier{
+		config:   cfg,
+		key:      key,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		endpoint: endpoint,
+	}, nil
+}
+
+// Notify sends a silent push asking the device to re-sync its account
+func (n *APNsNotifier) Notify(ctx context.Context, device *PushDevice) error {
+	token, err := n.providerToken()
+	if err != nil {
+		return err
+	}
+
+	payload, _ := json.Marshal(map[string]any{
+		"aps": map[string]string{"account-id": device.AccountID},
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		n.endpoint+"/3/device/"+device.DeviceToken, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("apns-topic", n.config.Topic)
+	req.Header.Set("apns-push-type", "background")
+	req.Header.Set("apns-priority", "5")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("APNs request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&body)
+	if resp.StatusCode == http.StatusGone || body.Reason == "BadDeviceToken" || body.Reason == "Unregistered" {
+		return fmt.Errorf("%w: %s", ErrDeviceUnregistered, body.Reason)
+	}
+	return fmt.Errorf("APNs rejected push: %d %s", resp.StatusCode, body.Reason)
+}
+
+// providerToken returns a cached ES256 JWT, signing a new one when it expires
+func (n *APNsNotifier) providerToken() (string, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	now := time.Now()
+	if n.token != "" && now.Sub(n.tokenIssued) < apnsTokenLifetime {
+		return n.token, nil
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": "ES256", "kid": n.config.KeyID})
+	claims, _ := json.Marshal(map[string]any{"iss": n.config.TeamID, "iat": now.Unix()})
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, n.key, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to sign APNs token: %w", err)
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+
+	n.token = signingInput + "." + base64.RawURLEncoding.EncodeToString(sig)
+	n.tokenIssued = now
+	return n.token, nil
+}
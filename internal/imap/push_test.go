@@ -0,0 +1,238 @@
+package imap
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNotifier records the devices it was asked to notify
+type fakeNotifier struct {
+	mu      sync.Mutex
+	devices []*PushDevice
+	err     error
+}
+
+func (n *fakeNotifier) Notify(ctx context.Context, d *PushDevice) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.devices = append(n.devices, d)
+	return n.err
+}
+
+func (n *fakeNotifier) calls() []*PushDevice {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]*PushDevice(nil), n.devices...)
+}
+
+const testDeviceToken = "2918390218931890821908309283098109381029309829018310983092892829"
+
+func TestXApplePushServiceRegistersDevice(t *testing.T) {
+	srv, db := newTestServer(t)
+	pushStore := NewPushStore(db.DB)
+	srv.SetPushNotifier(pushStore, &fakeNotifier{}, "com.apple.mail.XServer.test")
+	c := dialRaw(t, listenTestServer(t, srv))
+
+	untagged, _ := c.command("CAPABILITY")
+	if len(untagged) == 0 || !strings.Contains(untagged[0], "XAPPLEPUSHSERVICE") {
+		t.Errorf("CAPABILITY = %v, want XAPPLEPUSHSERVICE", untagged)
+	}
+
+	c.login()
+	untagged, status := c.command(`XAPPLEPUSHSERVICE aps-version 2 aps-account-id ACCT-1 aps-device-token %s aps-subtopic com.apple.mobilemail mailboxes (INBOX "Notes")`, testDeviceToken)
+	if !strings.HasPrefix(status, "OK") {
+		t.Fatalf("XAPPLEPUSHSERVICE = %q", status)
+	}
+	want := `* XAPPLEPUSHSERVICE aps-version "2" aps-topic "com.apple.mail.XServer.test"`
+	if len(untagged) != 1 || untagged[0] != want {
+		t.Errorf("untagged = %v, want %q", untagged, want)
+	}
+
+	devices, err := pushStore.DevicesForMailbox(context.Background(), 1, "Notes")
+	if err != nil {
+		t.Fatalf("DevicesForMailbox() error = %v", err)
+	}
+	if len(devices) != 1 || devices[0].DeviceToken != testDeviceToken || devices[0].AccountID != "ACCT-1" {
+		t.Errorf("devices = %+v, want the registered device", devices)
+	}
+}
+
+func TestXApplePushServiceHiddenWhenDisabled(t *testing.T) {
+	c := dialRaw(t, startTestServer(t))
+
+	untagged, _ := c.command("CAPABILITY")
+	if len(untagged) == 0 || strings.Contains(untagged[0], "XAPPLEPUSHSERVICE") {
+		t.Errorf("CAPABILITY = %v, want no XAPPLEPUSHSERVICE", untagged)
+	}
+	c.login()
+	if _, status := c.command("XAPPLEPUSHSERVICE aps-version 2 aps-account-id A aps-device-token %s", testDeviceToken); !strings.HasPrefix(status, "BAD") {
+		t.Errorf("XAPPLEPUSHSERVICE = %q, want BAD", status)
+	}
+}
+
+func TestDeliveryNotifiesRegisteredDevice(t *testing.T) {
+	srv, db := newTestServer(t)
+	ctx := context.Background()
+	notifier := &fakeNotifier{}
+	pushStore := NewPushStore(db.DB)
+	srv.SetPushNotifier(pushStore, notifier, "topic")
+
+	user, err := srv.authenticator.LookupUser(ctx, "alice@example.com")
+	if err != nil {
+		t.Fatalf("LookupUser() error = %v", err)
+	}
+	if err := pushStore.Register(ctx, &PushDevice{UserID: user.ID, DeviceToken: testDeviceToken, AccountID: "ACCT-1", Mailboxes: []string{"INBOX"}}); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+
+	srv.NotifyMailboxUpdateByName("alice@example.com", "INBOX")
+	srv.waitPushes(context.Background())
+	calls := notifier.calls()
+	if len(calls) != 1 || calls[0].DeviceToken != testDeviceToken || calls[0].AccountID != "ACCT-1" {
+		t.Fatalf("notifier calls = %+v, want one for the registered device", calls)
+	}
+
+	// Mailboxes the device didn't register for don't trigger a push
+	srv.NotifyMailboxUpdateByName("alice@example.com", "Sent")
+	srv.waitPushes(context.Background())
+	if n := len(notifier.calls()); n != 1 {
+		t.Errorf("notifier calls after Sent delivery = %d, want 1", n)
+	}
+}
+
+func TestDeliverySkipsUnregisteredUser(t *testing.T) {
+	srv, db := newTestServer(t)
+	ctx := context.Background()
+	notifier := &fakeNotifier{}
+	srv.SetPushNotifier(NewPushStore(db.DB), notifier, "topic")
+
+	user, err := srv.authenticator.CreateUser(ctx, "bob", "password123", 1)
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	if err := srv.store.InitializeUserMailboxes(ctx, user.ID); err != nil {
+		t.Fatalf("InitializeUserMailboxes() error = %v", err)
+	}
+
+	srv.NotifyMailboxUpdateByName("bob@example.com", "INBOX")
+	srv.waitPushes(context.Background())
+	if calls := notifier.calls(); len(calls) != 0 {
+		t.Errorf("notifier calls = %+v, want none", calls)
+	}
+}
+
+func TestDeliveryRemovesUnregisteredDevice(t *testing.T) {
+	srv, db := newTestServer(t)
+	ctx := context.Background()
+	notifier := &fakeNotifier{err: ErrDeviceUnregistered}
+	pushStore := NewPushStore(db.DB)
+	srv.SetPushNotifier(pushStore, notifier, "topic")
+
+	if err := pushStore.Register(ctx, &PushDevice{UserID: 1, DeviceToken: testDeviceToken, AccountID: "A", Mailboxes: []string{"INBOX"}}); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+	srv.NotifyMailboxUpdateByName("alice@example.com", "INBOX")
+	srv.waitPushes(context.Background())
+
+	devices, err := pushStore.DevicesForMailbox(ctx, 1, "INBOX")
+	if err != nil {
+		t.Fatalf("DevicesForMailbox() error = %v", err)
+	}
+	if len(devices) != 0 {
+		t.Errorf("devices = %+v, want the rejected device removed", devices)
+	}
+}
+
+func TestPushesBoundedAndAwaitedOnShutdown(t *testing.T) {
+	srv, db := newTestServer(t)
+	ctx := context.Background()
+	notifier := &fakeNotifier{}
+	pushStore := NewPushStore(db.DB)
+	srv.SetPushNotifier(pushStore, notifier, "topic")
+
+	if err := pushStore.Register(ctx, &PushDevice{UserID: 1, DeviceToken: testDeviceToken, AccountID: "A", Mailboxes: []string{"INBOX"}}); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+
+	// With every slot taken the delivery pushes nothing
+	for i := 0; i < maxPushes; i++ {
+		srv.pushes <- struct{}{}
+	}
+	srv.NotifyMailboxUpdateByName("alice@example.com", "INBOX")
+
+	// Shutdown waits for the pushes in flight as long as ctx allows
+	shutdownCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown() with pushes in flight = %v, want %v", err, context.DeadlineExceeded)
+	}
+	for i := 0; i < maxPushes; i++ {
+		<-srv.pushes
+	}
+	if calls := notifier.calls(); len(calls) != 0 {
+		t.Errorf("notifier calls = %+v, want none", calls)
+	}
+}
+
+func TestAPNsNotifierSendsSilentPush(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	keyFile := filepath.Join(t.TempDir(), "AuthKey.p8")
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+
+	var gotPath, gotTopic, gotAuth string
+	var gotBody map[string]map[string]string
+	apns := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath, gotTopic, gotAuth = r.URL.Path, r.Header.Get("apns-topic"), r.Header.Get("Authorization")
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &gotBody)
+		if strings.HasSuffix(r.URL.Path, "/gone") {
+			w.WriteHeader(http.StatusGone)
+			w.Write([]byte(`{"reason":"Unregistered"}`))
+		}
+	}))
+	defer apns.Close()
+
+	n, err := NewAPNsNotifier(APNsConfig{KeyFile: keyFile, KeyID: "KEY1234567", TeamID: "TEAM123456", Topic: "com.apple.mail.XServer.test"})
+	if err != nil {
+		t.Fatalf("NewAPNsNotifier() error = %v", err)
+	}
+	n.endpoint = apns.URL
+	n.client = apns.Client()
+
+	if err := n.Notify(context.Background(), &PushDevice{DeviceToken: "abcd", AccountID: "ACCT-1"}); err != nil {
+		t.Fatalf("Notify() error = %v", err)
+	}
+	if gotPath != "/3/device/abcd" || gotTopic != "com.apple.mail.XServer.test" {
+		t.Errorf("request = %s topic %q", gotPath, gotTopic)
+	}
+	if !strings.HasPrefix(gotAuth, "bearer ") || strings.Count(gotAuth, ".") != 2 {
+		t.Errorf("Authorization = %q, want a bearer JWT", gotAuth)
+	}
+	if gotBody["aps"]["account-id"] != "ACCT-1" {
+		t.Errorf("payload = %v, want aps.account-id ACCT-1", gotBody)
+	}
+
+	err = n.Notify(context.Background(), &PushDevice{DeviceToken: "gone", AccountID: "ACCT-1"})
+	if !errors.Is(err, ErrDeviceUnregistered) {
+		t.Errorf("Notify() to gone device error = %v, want ErrDeviceUnregistered", err)
+	}
+}
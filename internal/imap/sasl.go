@@ -0,0 +1,101 @@
+package imap
+
+import (
+	"context"
+	"crypto/x509"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+	"github.com/emersion/go-sasl"
+)
+
+// AuthenticateMechanisms lists the SASL mechanisms offered: PLAIN, plus
+// EXTERNAL (RFC 4422) once the client has presented a TLS certificate
+func (s *Session) AuthenticateMechanisms() []string {
+	mechs := []string{sasl.Plain}
+	if s.peerCertificate() != nil {
+		mechs = append(mechs, sasl.External)
+	}
+	return mechs
+}
+
+// Authenticate starts a SASL exchange for mech
+func (s *Session) Authenticate(mech string) (sasl.Server, error) {
+	switch mech {
+	case sasl.Plain:
+		return sasl.NewPlainServer(func(identity, username, password string) error {
+			if identity != "" && identity != username {
+				return errAuthorizationFailed
+			}
+			return s.Login(username, password)
+		}), nil
+
+	case sasl.External:
+		cert := s.peerCertificate()
+		if cert == nil {
+			return nil, &imap.Error{
+				Type: imap.StatusResponseTypeNo,
+				Text: "EXTERNAL requires a TLS client certificate",
+			}
+		}
+		return sasl.NewExternalServer(func(identity string) error {
+			return s.loginCertificate(cert, identity)
+		}), nil
+	}
+
+	return nil, &imap.Error{
+		Type: imap.StatusResponseTypeNo,
+		Text: "SASL mechanism not supported",
+	}
+}
+
+// errAuthorizationFailed refuses an authorization identity other than the
+// authenticated user; acting on behalf of another user isn't supported
+var errAuthorizationFailed = &imap.Error{
+	Type: imap.StatusResponseTypeNo,
+	Code: imap.ResponseCodeAuthorizationFailed,
+	Text: "Authorization identity must be the authenticated user",
+}
+
+// loginCertificate logs in as the user the client certificate is mapped to.
+// An authorization identity, if given, must name that user.
+func (s *Session) loginCertificate(cert *x509.Certificate, identity string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	user, err := s.server.authenticator.AuthenticateCertificate(ctx, cert)
+	s.server.authenticator.RecordAuth("imap", cert.Subject.String(), s.remoteAddr(), user, err)
+	if err != nil {
+		log.Printf("IMAP v2: EXTERNAL failed for certificate %q: %v", cert.Subject, err)
+		s.authFailed()
+		return imapserver.ErrAuthFailed
+	}
+	if identity != "" && !strings.EqualFold(identity, user.Email) {
+		log.Printf("IMAP v2: EXTERNAL for %s refused authorization identity %s", user.Email, identity)
+		return errAuthorizationFailed
+	}
+
+	s.mu.Lock()
+	s.user = user
+	s.mu.Unlock()
+	s.traceUser(user)
+
+	log.Printf("IMAP v2: EXTERNAL login successful for %s", user.Email)
+	return nil
+}
+
+// peerCertificate returns the certificate the client presented over TLS,
+// or nil if it didn't
+func (s *Session) peerCertificate() *x509.Certificate {
+	if s.conn == nil {
+		return nil
+	}
+	ec, ok := s.conn.NetConn().(*extConn)
+	if !ok {
+		return nil
+	}
+	return ec.peerCertificate()
+}
@@ -0,0 +1,115 @@
+package imap
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testClientCert returns a self-signed client certificate
+func testClientCert(t *testing.T, name string) (tls.Certificate, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert
+}
+
+func TestAuthenticateExternal(t *testing.T) {
+	srv, _ := newTestServerTLS(t, testTLSConfig(t))
+	srv.SetClientCertAuth(true)
+	addr := listenTestServer(t, srv)
+
+	ctx := context.Background()
+	alice, err := srv.authenticator.LookupUser(ctx, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapped, cert := testClientCert(t, "alice")
+	if err := srv.authenticator.AddClientCertificate(ctx, alice.ID, cert); err != nil {
+		t.Fatalf("AddClientCertificate() error = %v", err)
+	}
+	unmapped, _ := testClientCert(t, "mallory")
+
+	withCert := func(cert tls.Certificate) *rawClient {
+		c := dialRaw(t, addr)
+		c.startTLSWith(&tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{cert}})
+		return c
+	}
+
+	t.Run("mapped certificate", func(t *testing.T) {
+		c := withCert(mapped)
+		untagged, _ := c.command("CAPABILITY")
+		if len(untagged) != 1 || !strings.Contains(untagged[0], "AUTH=EXTERNAL") {
+			t.Errorf("CAPABILITY = %q, want AUTH=EXTERNAL", untagged)
+		}
+		if _, status := c.command("AUTHENTICATE EXTERNAL ="); !strings.HasPrefix(status, "OK") {
+			t.Fatalf("AUTHENTICATE EXTERNAL = %q", status)
+		}
+		if _, status := c.command("SELECT INBOX"); !strings.HasPrefix(status, "OK") {
+			t.Errorf("SELECT after EXTERNAL = %q", status)
+		}
+	})
+
+	t.Run("authorization identity", func(t *testing.T) {
+		c := withCert(mapped)
+		authzid := base64.StdEncoding.EncodeToString([]byte("alice@example.com"))
+		if _, status := c.command("AUTHENTICATE EXTERNAL %s", authzid); !strings.HasPrefix(status, "OK") {
+			t.Errorf("AUTHENTICATE EXTERNAL as alice = %q", status)
+		}
+
+		c = withCert(mapped)
+		authzid = base64.StdEncoding.EncodeToString([]byte("bob@example.com"))
+		if _, status := c.command("AUTHENTICATE EXTERNAL %s", authzid); !strings.HasPrefix(status, "NO [AUTHORIZATIONFAILED]") {
+			t.Errorf("AUTHENTICATE EXTERNAL as bob = %q, want NO [AUTHORIZATIONFAILED]", status)
+		}
+	})
+
+	t.Run("unmapped certificate", func(t *testing.T) {
+		c := withCert(unmapped)
+		if _, status := c.command("AUTHENTICATE EXTERNAL ="); !strings.HasPrefix(status, "NO") {
+			t.Errorf("AUTHENTICATE EXTERNAL = %q, want NO", status)
+		}
+	})
+
+	t.Run("no certificate", func(t *testing.T) {
+		c := dialRaw(t, addr)
+		c.startTLS()
+		untagged, _ := c.command("CAPABILITY")
+		if len(untagged) != 1 || strings.Contains(untagged[0], "AUTH=EXTERNAL") || !strings.Contains(untagged[0], "AUTH=PLAIN") {
+			t.Errorf("CAPABILITY = %q, want AUTH=PLAIN without AUTH=EXTERNAL", untagged)
+		}
+		if _, status := c.command("AUTHENTICATE EXTERNAL ="); !strings.HasPrefix(status, "NO") {
+			t.Errorf("AUTHENTICATE EXTERNAL without a certificate = %q, want NO", status)
+		}
+		// Passwords still work
+		if _, status := c.command("AUTHENTICATE PLAIN AGFsaWNlQGV4YW1wbGUuY29tAHBhc3N3b3JkMTIz"); !strings.HasPrefix(status, "OK") {
+			t.Errorf("AUTHENTICATE PLAIN = %q", status)
+		}
+	})
+}
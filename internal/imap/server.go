@@ -5,19 +5,53 @@ import (
 	"crypto/tls"
 	"log"
 	"net"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/emersion/go-imap/v2"
 	"github.com/emersion/go-imap/v2/imapserver"
 	"github.com/fenilsonani/email-server/internal/auth"
+	"github.com/fenilsonani/email-server/internal/logging"
+	"github.com/fenilsonani/email-server/internal/storage"
 	"github.com/fenilsonani/email-server/internal/storage/maildir"
 )
 
+// messageStore is the storage the IMAP server uses: the generic message
+// store plus the maildir store's mailbox setup, METADATA and ACL support
+type messageStore interface {
+	storage.MessageStore
+	InitializeUserMailboxes(ctx context.Context, userID int64) error
+	ListMetadata(ctx context.Context, userID, mailboxID int64) ([]storage.MetadataEntry, error)
+	SetMetadata(ctx context.Context, userID, mailboxID int64, entries []storage.MetadataEntry) error
+	FindRecentMessage(ctx context.Context, mailboxID int64, messageID string, window time.Duration) (*storage.Message, error)
+	MailboxKeywords(ctx context.Context, mailboxID int64) ([]storage.Flag, error)
+	MessageObjectIDs(ctx context.Context, mailboxID int64, uid uint32) (emailID, threadID string, err error)
+	MessagesObjectIDs(ctx context.Context, mailboxID int64, uids []uint32) (map[uint32]storage.ObjectIDs, error)
+	MailboxACL(ctx context.Context, mailboxID int64) ([]storage.ACLEntry, error)
+	MailboxRights(ctx context.Context, mailboxID, userID int64) (string, error)
+	SetMailboxRights(ctx context.Context, mailboxID, userID int64, rights string) error
+	SharedMailboxes(ctx context.Context, userID int64) ([]*storage.SharedMailbox, error)
+}
+
+// reputation refuses clients whose IP keeps failing to log in; it is
+// implemented by smtp.Reputation
+type reputation interface {
+	Blocked(remoteAddr string) bool
+	AuthFailure(remoteAddr string)
+}
+
+// errPoorReputation greets a blocked client with BYE
+var errPoorReputation = &imap.Error{
+	Type: imap.StatusResponseTypeBye,
+	Code: imap.ResponseCodeUnavailable,
+	Text: "Too many recent failures from your address, please try again later",
+}
+
 // Server wraps the go-imap v2 server
 type Server struct {
 	authenticator *auth.Authenticator
-	store         *maildir.Store
+	store         messageStore
 	imapServer    *imapserver.Server
 	tlsConfig     *tls.Config
 	addr          string
@@ -29,6 +63,30 @@ type Server struct {
 	trackersMu sync.RWMutex
 	trackers   map[int64]*imapserver.MailboxTracker
 
+	// Push notifications (XAPPLEPUSHSERVICE); nil when disabled
+	pushStore    *PushStore
+	pushNotifier PushNotifier
+	pushTopic    string
+	pushes       chan struct{} // One slot per push in flight, up to maxPushes
+
+	// Refuse LOGIN and AUTHENTICATE on the cleartext port before STARTTLS
+	requireTLSForAuth bool
+
+	// Ask TLS clients for a certificate, for AUTHENTICATE EXTERNAL
+	clientCertAuth bool
+
+	// APPENDs to \Sent matching a server-filed copy within this window are not stored again
+	sentDedupeWindow time.Duration
+
+	// Namespace mailboxes shared by other users appear in, ending in '/'
+	sharedPrefix string
+
+	// Selects connections whose protocol exchange is logged; nil for none
+	tracer *logging.Tracer
+
+	// Refuses clients with a poor IP reputation; nil when off
+	reputation reputation
+
 	// Shutdown coordination
 	ctx        context.Context
 	cancel     context.CancelFunc
@@ -45,6 +103,8 @@ func NewServer(authenticator *auth.Authenticator, store *maildir.Store, addr, tl
 		addr:          addr,
 		tlsAddr:       tlsAddr,
 		trackers:      make(map[int64]*imapserver.MailboxTracker),
+		pushes:        make(chan struct{}, maxPushes),
+		sharedPrefix:  defaultSharedPrefix,
 		ctx:           ctx,
 		cancel:        cancel,
 	}
@@ -52,12 +112,22 @@ func NewServer(authenticator *auth.Authenticator, store *maildir.Store, addr, tl
 	// Create IMAP server with v2 API
 	s.imapServer = imapserver.New(&imapserver.Options{
 		NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			if s.reputation != nil && s.reputation.Blocked(conn.NetConn().RemoteAddr().String()) {
+				return nil, nil, errPoorReputation
+			}
 			session := NewSession(s, conn)
+			if ec, ok := conn.NetConn().(*extConn); ok {
+				ec.setSession(session)
+			}
 			return session, &imapserver.GreetingData{}, nil
 		},
 		Caps: imap.CapSet{
 			imap.CapIMAP4rev1: {},
 			imap.CapIdle:      {},
+			imap.CapUIDPlus:   {},
+			imap.CapMove:      {},
+			imap.CapESearch:   {},
+			imap.CapNamespace: {},
 		},
 		TLSConfig:    tlsConfig,
 		InsecureAuth: true, // We handle auth security ourselves
@@ -67,6 +137,59 @@ func NewServer(authenticator *auth.Authenticator, store *maildir.Store, addr, tl
 	return s
 }
 
+// SetSentDedupeWindow makes an APPEND to a \Sent mailbox return the existing
+// message when one with the same Message-ID was stored within window, so a
+// client saving its own copy doesn't duplicate the one filed on submission
+func (s *Server) SetSentDedupeWindow(window time.Duration) {
+	s.sentDedupeWindow = window
+}
+
+// SetTracer logs the protocol exchange of the connections tracer selects.
+// It must be called before ListenAndServe.
+func (s *Server) SetTracer(tracer *logging.Tracer) {
+	s.tracer = tracer
+}
+
+// SetReputation makes failed logins count towards the reputation of the
+// client's IP, and refuses clients it blocks. It must be called before
+// ListenAndServe.
+func (s *Server) SetReputation(r reputation) {
+	s.reputation = r
+}
+
+// SetSharedPrefix sets the namespace mailboxes other users share appear
+// in, as <prefix>/<owner>/<mailbox>. Mailboxes of the user's own under it
+// can no longer be reached.
+func (s *Server) SetSharedPrefix(prefix string) {
+	s.sharedPrefix = strings.Trim(prefix, "/") + "/"
+}
+
+// SetRequireTLSForAuth makes the cleartext port advertise LOGINDISABLED and
+// refuse LOGIN and AUTHENTICATE until the client has run STARTTLS. It must
+// be called before ListenAndServe.
+func (s *Server) SetRequireTLSForAuth(require bool) {
+	s.requireTLSForAuth = require
+}
+
+// SetClientCertAuth makes the server ask TLS clients for a certificate, so
+// that one mapped to a user can log in with AUTHENTICATE EXTERNAL. It must
+// be called before ListenAndServe.
+func (s *Server) SetClientCertAuth(enabled bool) {
+	s.clientCertAuth = enabled
+}
+
+// clientTLSConfig returns cfg, asking clients for a certificate when client
+// certificate auth is enabled. Certificates are matched by fingerprint, so
+// they aren't verified against a CA.
+func (s *Server) clientTLSConfig(cfg *tls.Config) *tls.Config {
+	if !s.clientCertAuth || cfg == nil {
+		return cfg
+	}
+	cfg = cfg.Clone()
+	cfg.ClientAuth = tls.RequestClientCert
+	return cfg
+}
+
 // GetMailboxTracker returns or creates a tracker for a mailbox
 func (s *Server) GetMailboxTracker(mailboxID int64) *imapserver.MailboxTracker {
 	s.trackersMu.RLock()
@@ -135,6 +258,43 @@ func (s *Server) NotifyMailboxUpdateByName(username, mailboxName string) {
 	}
 
 	s.NotifyMailboxUpdate(mb.ID)
+
+	// Devices that aren't connected learn about new mail through push; a
+	// slow push service mustn't hold up the delivery that called us, so
+	// when too many pushes are in flight this one is dropped
+	if s.pushNotifier != nil && s.ctx.Err() == nil {
+		select {
+		case s.pushes <- struct{}{}:
+		default:
+			log.Printf("IMAP v2: Too many pushes in flight, not notifying devices of %s", username)
+			return
+		}
+		go func() {
+			defer func() { <-s.pushes }()
+			pushCtx, pushCancel := context.WithTimeout(context.Background(), 15*time.Second)
+			defer pushCancel()
+			s.notifyPush(pushCtx, user.ID, mb.Name)
+		}()
+	}
+}
+
+// waitPushes waits until no push is in flight or ctx is done
+func (s *Server) waitPushes(ctx context.Context) error {
+	// Holding every slot means every push has finished
+	for held := 0; held < cap(s.pushes); held++ {
+		select {
+		case s.pushes <- struct{}{}:
+		case <-ctx.Done():
+			for ; held > 0; held-- {
+				<-s.pushes
+			}
+			return ctx.Err()
+		}
+	}
+	for held := cap(s.pushes); held > 0; held-- {
+		<-s.pushes
+	}
+	return nil
 }
 
 // ListenAndServe starts the IMAP server
@@ -151,7 +311,13 @@ func (s *Server) ListenAndServe() error {
 		s.shutdownWg.Add(1)
 		go func() {
 			defer s.shutdownWg.Done()
-			if err := s.imapServer.Serve(listener); err != nil {
+			if err := s.imapServer.Serve(&extListener{
+				Listener:          listener,
+				tlsConfig:         s.clientTLSConfig(s.tlsConfig),
+				caps:              s.capabilities(),
+				requireTLSForAuth: s.requireTLSForAuth,
+				tracer:            s.tracer,
+			}); err != nil {
 				select {
 				case <-s.ctx.Done():
 					// Server is shutting down, expected error
@@ -169,7 +335,7 @@ func (s *Server) ListenAndServe() error {
 // ListenAndServeTLS starts the IMAPS server
 func (s *Server) ListenAndServeTLS(tlsConfig *tls.Config) error {
 	if s.tlsAddr != "" && tlsConfig != nil {
-		listener, err := tls.Listen("tcp", s.tlsAddr, tlsConfig)
+		listener, err := tls.Listen("tcp", s.tlsAddr, s.clientTLSConfig(tlsConfig))
 		if err != nil {
 			return err
 		}
@@ -180,7 +346,7 @@ func (s *Server) ListenAndServeTLS(tlsConfig *tls.Config) error {
 		s.shutdownWg.Add(1)
 		go func() {
 			defer s.shutdownWg.Done()
-			if err := s.imapServer.Serve(listener); err != nil {
+			if err := s.imapServer.Serve(&extListener{Listener: listener, caps: s.capabilities(), tracer: s.tracer}); err != nil {
 				select {
 				case <-s.ctx.Done():
 					// Server is shutting down, expected error
@@ -256,3 +422,16 @@ func (s *Server) Close() error {
 
 	return closeErr
 }
+
+// Shutdown closes the server like Close and then waits for the pushes in
+// flight until ctx is done. No push starts after Close.
+func (s *Server) Shutdown(ctx context.Context) error {
+	closeErr := s.Close()
+	if err := s.waitPushes(ctx); err != nil {
+		log.Printf("IMAP: Timeout waiting for pushes to finish")
+		if closeErr == nil {
+			closeErr = err
+		}
+	}
+	return closeErr
+}
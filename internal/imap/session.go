@@ -3,9 +3,13 @@ package imap
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -13,7 +17,9 @@ import (
 	"github.com/emersion/go-imap/v2"
 	"github.com/emersion/go-imap/v2/imapserver"
 	"github.com/fenilsonani/email-server/internal/auth"
+	"github.com/fenilsonani/email-server/internal/logging"
 	"github.com/fenilsonani/email-server/internal/storage"
+	"github.com/fenilsonani/email-server/internal/storage/maildir"
 )
 
 // Session implements imapserver.Session for go-imap v2
@@ -22,6 +28,10 @@ type Session struct {
 	conn     *imapserver.Conn
 	user     *auth.User
 	selected *storage.Mailbox
+	recent   map[uint32]bool // UIDs that are \Recent in this session
+	readOnly bool            // Whether the mailbox was opened with EXAMINE
+	rights   string          // The user's rights on the selected mailbox
+	closing  bool            // Whether the command running is CLOSE
 	tracker  *imapserver.SessionTracker
 	updates  chan any
 	mu       sync.RWMutex
@@ -64,26 +74,86 @@ func (s *Session) Close() error {
 
 // Login authenticates the user
 func (s *Session) Login(username, password string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(s.logContext(), 10*time.Second)
 	defer cancel()
 
 	log.Printf("IMAP v2: Login attempt for %s", username)
 
-	user, err := s.server.authenticator.Authenticate(ctx, username, password)
+	user, err := s.server.authenticator.AuthenticateClient(ctx, username, password)
+	s.server.authenticator.RecordAuth("imap", username, s.remoteAddr(), user, err)
 	if err != nil {
 		log.Printf("IMAP v2: Login failed for %s: %v", username, err)
+		s.authFailed()
 		return imapserver.ErrAuthFailed
 	}
 
 	s.mu.Lock()
 	s.user = user
 	s.mu.Unlock()
+	s.traceUser(user)
+
+	if state := s.tlsState(); state != nil {
+		log.Printf("IMAP v2: Login successful for %s over %s (cipher=%s)",
+			username, tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite))
+	} else {
+		log.Printf("IMAP v2: Login successful for %s", username)
+	}
+	return nil
+}
+
+// extConn returns the session's connection, or nil if it has none
+func (s *Session) extConn() *extConn {
+	if s.conn == nil {
+		return nil
+	}
+	ec, _ := s.conn.NetConn().(*extConn)
+	return ec
+}
 
-	log.Printf("IMAP v2: Login successful for %s", username)
+// tlsState returns the TLS state of the session's connection, or nil
+// before TLS
+func (s *Session) tlsState() *tls.ConnectionState {
+	if ec := s.extConn(); ec != nil {
+		return ec.tlsState()
+	}
 	return nil
 }
 
-// Select opens a mailbox
+// remoteAddr returns the address of the session's client, or "" if unknown
+func (s *Session) remoteAddr() string {
+	if s.conn == nil {
+		return ""
+	}
+	return s.conn.NetConn().RemoteAddr().String()
+}
+
+// authFailed counts a failed login towards the client's IP reputation
+func (s *Session) authFailed() {
+	if s.server.reputation != nil {
+		s.server.reputation.AuthFailure(s.remoteAddr())
+	}
+}
+
+// logContext returns a context carrying the connection's remote address
+// and TLS state for logging. STARTTLS may follow the greeting, so it is
+// built when needed rather than when the session starts.
+func (s *Session) logContext() context.Context {
+	ctx := logging.WithProtocol(context.Background(), "imap")
+	if s.conn == nil {
+		return ctx
+	}
+	ctx = logging.WithRemoteAddr(ctx, s.remoteAddr())
+	return logging.WithTLS(ctx, s.tlsState())
+}
+
+// errReadOnly refuses a change to a mailbox opened with EXAMINE
+var errReadOnly = &imap.Error{
+	Type: imap.StatusResponseTypeNo,
+	Code: "READ-ONLY",
+	Text: "Mailbox is open read-only",
+}
+
+// Select opens a mailbox, read-only when options.ReadOnly is set by EXAMINE
 func (s *Session) Select(name string, options *imap.SelectOptions) (*imap.SelectData, error) {
 	s.mu.RLock()
 	user := s.user
@@ -96,13 +166,12 @@ func (s *Session) Select(name string, options *imap.SelectOptions) (*imap.Select
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	mb, err := s.server.store.GetMailbox(ctx, user.ID, name)
+	mb, rights, err := s.openMailbox(ctx, user, name)
 	if err != nil {
-		return nil, &imap.Error{
-			Type: imap.StatusResponseTypeNo,
-			Code: imap.ResponseCodeNonExistent,
-			Text: "Mailbox not found",
-		}
+		return nil, storageError(err)
+	}
+	if !hasRights(rights, "r") {
+		return nil, noPerm("Permission denied")
 	}
 
 	stats, err := s.server.store.GetMailboxStats(ctx, mb.ID)
@@ -110,8 +179,28 @@ func (s *Session) Select(name string, options *imap.SelectOptions) (*imap.Select
 		return nil, fmt.Errorf("failed to get mailbox stats: %w", err)
 	}
 
+	// The first session to SELECT new mail takes its \Recent flags;
+	// EXAMINE leaves them for the next one
+	readOnly := options != nil && options.ReadOnly
+	numRecent := uint32(stats.Recent)
+	recent := make(map[uint32]bool)
+	if !readOnly {
+		uids, err := s.server.store.ClearRecent(ctx, mb.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to clear recent messages: %w", err)
+		}
+		for _, uid := range uids {
+			recent[uid] = true
+		}
+		numRecent = uint32(len(uids))
+	}
+
 	s.mu.Lock()
 	s.selected = mb
+	s.recent = recent
+	s.readOnly = readOnly
+	s.rights = rights
+	s.closing = false
 	// Create tracker for this mailbox
 	if s.tracker != nil {
 		s.tracker.Close()
@@ -119,19 +208,49 @@ func (s *Session) Select(name string, options *imap.SelectOptions) (*imap.Select
 	s.tracker = s.server.GetMailboxTracker(mb.ID).NewSession()
 	s.mu.Unlock()
 
+	// FLAGS lists the keywords in use so clients show them; \* in
+	// PERMANENTFLAGS lets them create new ones. No flag can be changed
+	// in a read-only mailbox, and in a shared one only those the user's
+	// rights allow.
+	flags := []imap.Flag{imap.FlagSeen, imap.FlagAnswered, imap.FlagFlagged, imap.FlagDeleted, imap.FlagDraft}
+	keywords, err := s.server.store.MailboxKeywords(ctx, mb.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list keywords: %w", err)
+	}
+	for _, k := range keywords {
+		flags = append(flags, imap.Flag(k))
+	}
+	permanentFlags := permanentFlags(rights)
+	if readOnly {
+		permanentFlags = nil
+	}
+
 	return &imap.SelectData{
-		Flags:          []imap.Flag{imap.FlagSeen, imap.FlagAnswered, imap.FlagFlagged, imap.FlagDeleted, imap.FlagDraft},
-		PermanentFlags: []imap.Flag{imap.FlagSeen, imap.FlagAnswered, imap.FlagFlagged, imap.FlagDeleted, imap.FlagDraft, imap.FlagWildcard},
+		Flags:          flags,
+		PermanentFlags: permanentFlags,
 		NumMessages:    uint32(stats.Messages),
+		NumRecent:      numRecent,
 		UIDValidity:    stats.UIDValidity,
 		UIDNext:        imap.UID(stats.UIDNext),
 	}, nil
 }
 
+// beginClose notes that the client sent CLOSE, whose expunge must not
+// fail the command when the mailbox can't be expunged
+func (s *Session) beginClose() {
+	s.mu.Lock()
+	s.closing = true
+	s.mu.Unlock()
+}
+
 // Unselect closes the current mailbox
 func (s *Session) Unselect() error {
 	s.mu.Lock()
 	s.selected = nil
+	s.recent = nil
+	s.readOnly = false
+	s.rights = ""
+	s.closing = false
 	if s.tracker != nil {
 		s.tracker.Close()
 		s.tracker = nil
@@ -150,11 +269,20 @@ func (s *Session) Create(name string, options *imap.CreateOptions) error {
 		return fmt.Errorf("not authenticated")
 	}
 
+	if s.isSharedName(name) {
+		return noPerm("Cannot create mailboxes of other users")
+	}
+	// A trailing delimiter only says the mailbox will have children
+	// (RFC 9051 section 6.3.4); missing parents are created by the store
+	name = strings.TrimSuffix(name, "/")
+
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	_, err := s.server.store.CreateMailbox(ctx, user.ID, name, "")
-	return err
+	if _, err := s.server.store.CreateMailbox(ctx, user.ID, name, ""); err != nil {
+		return storageError(err)
+	}
+	return nil
 }
 
 // Delete removes a mailbox
@@ -167,17 +295,27 @@ func (s *Session) Delete(name string) error {
 		return fmt.Errorf("not authenticated")
 	}
 
-	if name == "INBOX" {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	mb, rights, err := s.openMailbox(ctx, user, name)
+	if err != nil {
+		return storageError(err)
+	}
+	// Not even when shared: this is the owner's INBOX
+	if mb.Name == "INBOX" {
 		return &imap.Error{
 			Type: imap.StatusResponseTypeNo,
 			Text: "Cannot delete INBOX",
 		}
 	}
-
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	return s.server.store.DeleteMailbox(ctx, user.ID, name)
+	if !hasRights(rights, "x") {
+		return noPerm("Permission denied")
+	}
+	if err := s.server.store.DeleteMailbox(ctx, mb.UserID, mb.Name); err != nil {
+		return storageError(err)
+	}
+	return nil
 }
 
 // Rename renames a mailbox
@@ -196,11 +334,17 @@ func (s *Session) Rename(oldName, newName string, options *imap.RenameOptions) e
 			Text: "Cannot rename INBOX",
 		}
 	}
+	if s.isSharedName(oldName) || s.isSharedName(newName) {
+		return noPerm("Cannot rename mailboxes of other users")
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	return s.server.store.RenameMailbox(ctx, user.ID, oldName, newName)
+	if err := s.server.store.RenameMailbox(ctx, user.ID, oldName, newName); err != nil {
+		return storageError(err)
+	}
+	return nil
 }
 
 // Subscribe subscribes to a mailbox
@@ -213,6 +357,11 @@ func (s *Session) Subscribe(name string) error {
 		return fmt.Errorf("not authenticated")
 	}
 
+	// Shared mailboxes are always listed as subscribed
+	if s.isSharedName(name) {
+		return nil
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
@@ -229,6 +378,11 @@ func (s *Session) Unsubscribe(name string) error {
 		return fmt.Errorf("not authenticated")
 	}
 
+	// Shared mailboxes are always listed as subscribed
+	if s.isSharedName(name) {
+		return nil
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
@@ -253,6 +407,23 @@ func (s *Session) List(w *imapserver.ListWriter, ref string, patterns []string,
 		return fmt.Errorf("failed to list mailboxes: %w", err)
 	}
 
+	// Mailboxes shared with the user are listed in the other users
+	// namespace if they may look them up
+	shared, err := s.server.store.SharedMailboxes(ctx, user.ID)
+	if err != nil {
+		return fmt.Errorf("failed to list shared mailboxes: %w", err)
+	}
+	for _, sm := range shared {
+		if !hasRights(sm.Rights, "l") {
+			continue
+		}
+		mb := sm.Mailbox
+		mb.Name = s.sharedMailboxName(user, sm.OwnerEmail, mb.Name)
+		mb.Subscribed = true
+		mb.SpecialUse = "" // the owner's Sent is no special use of the grantee's
+		mailboxes = append(mailboxes, &mb)
+	}
+
 	for _, mb := range mailboxes {
 		// Check if matches pattern
 		match := false
@@ -299,13 +470,12 @@ func (s *Session) Status(name string, options *imap.StatusOptions) (*imap.Status
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	mb, err := s.server.store.GetMailbox(ctx, user.ID, name)
+	mb, rights, err := s.openMailbox(ctx, user, name)
 	if err != nil {
-		return nil, &imap.Error{
-			Type: imap.StatusResponseTypeNo,
-			Code: imap.ResponseCodeNonExistent,
-			Text: "Mailbox not found",
-		}
+		return nil, storageError(err)
+	}
+	if !hasRights(rights, "r") {
+		return nil, noPerm("Permission denied")
 	}
 
 	stats, err := s.server.store.GetMailboxStats(ctx, mb.ID)
@@ -316,13 +486,18 @@ func (s *Session) Status(name string, options *imap.StatusOptions) (*imap.Status
 	numMessages := uint32(stats.Messages)
 	numUnseen := uint32(stats.Unseen)
 
-	return &imap.StatusData{
+	data := &imap.StatusData{
 		Mailbox:     name,
 		NumMessages: &numMessages,
 		NumUnseen:   &numUnseen,
 		UIDNext:     imap.UID(stats.UIDNext),
 		UIDValidity: stats.UIDValidity,
-	}, nil
+	}
+	if options.NumRecent {
+		numRecent := uint32(stats.Recent)
+		data.NumRecent = &numRecent
+	}
+	return data, nil
 }
 
 // Append adds a message to a mailbox
@@ -338,13 +513,12 @@ func (s *Session) Append(mailbox string, r imap.LiteralReader, options *imap.App
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
-	mb, err := s.server.store.GetMailbox(ctx, user.ID, mailbox)
+	mb, rights, err := s.openMailbox(ctx, user, mailbox)
 	if err != nil {
-		return nil, &imap.Error{
-			Type: imap.StatusResponseTypeNo,
-			Code: imap.ResponseCodeTryCreate,
-			Text: "Mailbox not found",
-		}
+		return nil, tryCreateError(err)
+	}
+	if !hasRights(rights, "i") {
+		return nil, noPerm("Permission denied")
 	}
 
 	// Convert flags
@@ -361,7 +535,25 @@ func (s *Session) Append(mailbox string, r imap.LiteralReader, options *imap.App
 		date = options.Time
 	}
 
-	msg, err := s.server.store.AppendMessage(ctx, mb.ID, flags, date, r)
+	var body io.Reader = r
+	if mb.SpecialUse == storage.SpecialUseSent && s.server.sentDedupeWindow > 0 {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read message: %w", err)
+		}
+		if existing := s.findSentCopy(ctx, mb.ID, data); existing != nil {
+			return &imap.AppendData{
+				UID:         imap.UID(existing.UID),
+				UIDValidity: mb.UIDValidity,
+			}, nil
+		}
+		body = bytes.NewReader(data)
+	}
+
+	msg, err := s.server.store.AppendMessage(ctx, mb.ID, flags, date, body)
+	if errors.Is(err, storage.ErrOverQuota) {
+		return nil, storageError(err)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to append message: %w", err)
 	}
@@ -375,6 +567,20 @@ func (s *Session) Append(mailbox string, r imap.LiteralReader, options *imap.App
 	}, nil
 }
 
+// findSentCopy returns the copy of data already filed in a \Sent mailbox on
+// submission, matched by Message-ID, or nil if the APPEND should be stored
+func (s *Session) findSentCopy(ctx context.Context, mailboxID int64, data []byte) *storage.Message {
+	meta, err := maildir.ParseMessageHeaders(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+	existing, err := s.server.store.FindRecentMessage(ctx, mailboxID, meta.MessageID, s.server.sentDedupeWindow)
+	if err != nil {
+		return nil
+	}
+	return existing
+}
+
 // Poll checks for updates (called periodically)
 func (s *Session) Poll(w *imapserver.UpdateWriter, allowExpunge bool) error {
 	s.mu.RLock()
@@ -415,6 +621,7 @@ func (s *Session) Idle(w *imapserver.UpdateWriter, stop <-chan struct{}) error {
 func (s *Session) Fetch(w *imapserver.FetchWriter, numSet imap.NumSet, options *imap.FetchOptions) error {
 	s.mu.RLock()
 	selected := s.selected
+	recent := s.recent
 	s.mu.RUnlock()
 
 	if selected == nil {
@@ -458,6 +665,20 @@ func (s *Session) Fetch(w *imapserver.FetchWriter, numSet imap.NumSet, options *
 		}
 	}
 
+	// Look up the object IDs the command asked for in one query
+	if ec := s.extConn(); ec != nil && ec.wantsObjectIDs() {
+		uids := make([]uint32, 0, len(toFetch))
+		for _, seqNum := range toFetch {
+			uids = append(uids, seqToMsg[seqNum].UID)
+		}
+		ids, err := s.server.store.MessagesObjectIDs(ctx, selected.ID, uids)
+		if err != nil {
+			log.Printf("IMAP: Failed to get object IDs: %v", err)
+		} else {
+			ec.setObjectIDs(ids)
+		}
+	}
+
 	// Fetch each message
 	for _, seqNum := range toFetch {
 		msg := seqToMsg[seqNum]
@@ -465,6 +686,16 @@ func (s *Session) Fetch(w *imapserver.FetchWriter, numSet imap.NumSet, options *
 			continue
 		}
 
+		// The envelope, structure and sections all come from one read of
+		// the message, done before its response is started
+		var data []byte
+		if options.Envelope || options.BodyStructure != nil || len(options.BodySection) > 0 {
+			data, err = s.messageData(ctx, msg)
+			if err != nil {
+				return fmt.Errorf("failed to read message %d: %w", msg.UID, err)
+			}
+		}
+
 		respWriter := w.CreateMessage(seqNum)
 
 		// Always include UID
@@ -472,10 +703,13 @@ func (s *Session) Fetch(w *imapserver.FetchWriter, numSet imap.NumSet, options *
 
 		// Write flags
 		if options.Flags {
-			flags := make([]imap.Flag, len(msg.Flags))
+			flags := make([]imap.Flag, len(msg.Flags), len(msg.Flags)+1)
 			for i, f := range msg.Flags {
 				flags[i] = imap.Flag(f)
 			}
+			if recent[msg.UID] {
+				flags = append(flags, imap.Flag(storage.FlagRecent))
+			}
 			respWriter.WriteFlags(flags)
 		}
 
@@ -491,37 +725,16 @@ func (s *Session) Fetch(w *imapserver.FetchWriter, numSet imap.NumSet, options *
 
 		// Write envelope
 		if options.Envelope {
-			body, err := s.server.store.GetMessageBody(ctx, msg)
-			if err == nil {
-				data, readErr := io.ReadAll(body)
-				body.Close() // Close immediately, not deferred in loop
-				if readErr == nil {
-					envelope := extractEnvelope(data)
-					respWriter.WriteEnvelope(envelope)
-				} else {
-					log.Printf("IMAP: Failed to read message body for envelope: %v", readErr)
-				}
-			} else {
-				log.Printf("IMAP: Failed to get message body for envelope: %v", err)
-			}
+			respWriter.WriteEnvelope(extractEnvelope(data))
+		}
+
+		// Write body structure
+		if options.BodyStructure != nil {
+			respWriter.WriteBodyStructure(extractBodyStructure(data))
 		}
 
 		// Write body sections
 		for _, bs := range options.BodySection {
-			body, err := s.server.store.GetMessageBody(ctx, msg)
-			if err != nil {
-				log.Printf("IMAP: Failed to get message body for section: %v", err)
-				continue
-			}
-
-			data, readErr := io.ReadAll(body)
-			body.Close() // Close immediately after reading
-
-			if readErr != nil {
-				log.Printf("IMAP: Failed to read message body for section: %v", readErr)
-				continue
-			}
-
 			sectionData := extractBodySection(data, bs)
 			bsw := respWriter.WriteBodySection(bs, int64(len(sectionData)))
 			if _, err := bsw.Write(sectionData); err != nil {
@@ -536,19 +749,42 @@ func (s *Session) Fetch(w *imapserver.FetchWriter, numSet imap.NumSet, options *
 	return nil
 }
 
+// messageData reads the full content of msg
+func (s *Session) messageData(ctx context.Context, msg *storage.Message) ([]byte, error) {
+	body, err := s.server.store.GetMessageBody(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return io.ReadAll(body)
+}
+
 // Store updates message flags
 func (s *Session) Store(w *imapserver.FetchWriter, numSet imap.NumSet, flags *imap.StoreFlags, options *imap.StoreOptions) error {
 	s.mu.RLock()
 	selected := s.selected
+	readOnly := s.readOnly
+	rights := s.rights
 	s.mu.RUnlock()
 
 	if selected == nil {
 		return fmt.Errorf("no mailbox selected")
 	}
+	if readOnly {
+		return errReadOnly
+	}
 
 	if flags == nil {
 		return fmt.Errorf("flags cannot be nil")
 	}
+	// Replacing the flags may clear any of them
+	need := storeRights(flags.Flags)
+	if flags.Op == imap.StoreFlagsSet {
+		need = "stw"
+	}
+	if !hasRights(rights, need) {
+		return noPerm("Permission denied")
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
@@ -633,85 +869,145 @@ func (s *Session) Store(w *imapserver.FetchWriter, numSet imap.NumSet, flags *im
 
 // Expunge removes deleted messages
 func (s *Session) Expunge(w *imapserver.ExpungeWriter, uids *imap.UIDSet) error {
-	s.mu.RLock()
+	s.mu.Lock()
 	selected := s.selected
-	s.mu.RUnlock()
+	readOnly := s.readOnly
+	rights := s.rights
+	closing := s.closing
+	s.closing = false
+	s.mu.Unlock()
 
 	if selected == nil {
 		return fmt.Errorf("no mailbox selected")
 	}
+	if readOnly || !hasRights(rights, "e") {
+		// Closing a mailbox the user can't expunge succeeds without
+		// removing anything
+		if closing {
+			return nil
+		}
+		if readOnly {
+			return errReadOnly
+		}
+		return noPerm("Permission denied")
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
-	expunged, err := s.server.store.ExpungeMailbox(ctx, selected.ID)
-	if err != nil {
-		return fmt.Errorf("failed to expunge mailbox: %w", err)
-	}
-
-	// Get current message list for seq mapping
+	// Map UIDs to sequence numbers before anything is removed
 	messages, err := s.server.store.ListMessages(ctx, selected.ID, 0, 0)
 	if err != nil {
-		log.Printf("IMAP: Failed to list messages after expunge: %v", err)
-		// Still report expunged messages even if we can't get seq numbers
-		for _, uid := range expunged {
-			w.WriteExpunge(uid)
-		}
-		return nil
+		return fmt.Errorf("failed to list messages: %w", err)
 	}
-
-	uidToSeq := make(map[uint32]uint32)
+	uidToSeq := make(map[uint32]uint32, len(messages))
 	for i, msg := range messages {
 		uidToSeq[msg.UID] = uint32(i + 1)
 	}
 
+	var expunged []uint32
+	if uids == nil {
+		expunged, err = s.server.store.ExpungeMailbox(ctx, selected.ID)
+	} else {
+		// UID EXPUNGE only removes \Deleted messages within the given set
+		var candidates []uint32
+		for _, msg := range messages {
+			if uids.Contains(imap.UID(msg.UID)) && slices.Contains(msg.Flags, storage.FlagDeleted) {
+				candidates = append(candidates, msg.UID)
+			}
+		}
+		if len(candidates) > 0 {
+			expunged, err = s.server.store.ExpungeUIDs(ctx, selected.ID, candidates)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to expunge mailbox: %w", err)
+	}
+
+	return writeExpunges(w.WriteExpunge, uidToSeq, expunged)
+}
+
+// writeExpunges reports expunged UIDs by sequence number. Each EXPUNGE
+// renumbers the messages after it, so they are written from the highest
+// sequence number down to keep the earlier numbers valid.
+func writeExpunges(write func(seqNum uint32) error, uidToSeq map[uint32]uint32, expunged []uint32) error {
+	seqNums := make([]uint32, 0, len(expunged))
 	for _, uid := range expunged {
 		if seqNum, ok := uidToSeq[uid]; ok {
-			w.WriteExpunge(seqNum)
+			seqNums = append(seqNums, seqNum)
+		}
+	}
+	slices.Sort(seqNums)
+	for i := len(seqNums) - 1; i >= 0; i-- {
+		if err := write(seqNums[i]); err != nil {
+			return err
 		}
 	}
-
 	return nil
 }
 
-// Copy copies messages to another mailbox
-func (s *Session) Copy(numSet imap.NumSet, dest string) (*imap.CopyData, error) {
+// copyResult is the outcome of copying a set of messages
+type copyResult struct {
+	srcUIDs   []imap.UID
+	destUIDs  []imap.UID
+	uidToSeq  map[uint32]uint32 // source UID -> sequence number before the copy
+	failed    int
+	overQuota bool // Whether a message failed because the user is over quota
+}
+
+// copyData returns the COPYUID data for the messages that were copied
+func (r *copyResult) copyData(dest *storage.Mailbox) *imap.CopyData {
+	return &imap.CopyData{
+		UIDValidity: dest.UIDValidity,
+		SourceUIDs:  imap.UIDSetNum(r.srcUIDs...),
+		DestUIDs:    imap.UIDSetNum(r.destUIDs...),
+	}
+}
+
+// failureCode returns the response code for a copy with failed messages
+func (r *copyResult) failureCode() imap.ResponseCode {
+	if r.overQuota {
+		return imap.ResponseCodeOverQuota
+	}
+	return ""
+}
+
+// copyMessages copies each message in numSet from the selected mailbox to
+// dest. A failed message doesn't stop the rest; it is counted in failed.
+func (s *Session) copyMessages(ctx context.Context, numSet imap.NumSet, dest string) (*storage.Mailbox, *copyResult, error) {
 	s.mu.RLock()
 	selected := s.selected
 	user := s.user
 	s.mu.RUnlock()
 
 	if selected == nil {
-		return nil, fmt.Errorf("no mailbox selected")
+		return nil, nil, fmt.Errorf("no mailbox selected")
 	}
 
 	if user == nil {
-		return nil, fmt.Errorf("not authenticated")
+		return nil, nil, fmt.Errorf("not authenticated")
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-
 	// Get destination mailbox
-	destMb, err := s.server.store.GetMailbox(ctx, user.ID, dest)
+	destMb, destRights, err := s.openMailbox(ctx, user, dest)
 	if err != nil {
-		return nil, &imap.Error{
-			Type: imap.StatusResponseTypeNo,
-			Code: imap.ResponseCodeTryCreate,
-			Text: "Destination mailbox not found",
-		}
+		return nil, nil, tryCreateError(err)
+	}
+	if !hasRights(destRights, "i") {
+		return nil, nil, noPerm("Permission denied")
 	}
 
 	// Get messages
 	messages, err := s.server.store.ListMessages(ctx, selected.ID, 0, 0)
 	if err != nil {
-		return nil, fmt.Errorf("failed to list messages: %w", err)
+		return nil, nil, fmt.Errorf("failed to list messages: %w", err)
 	}
 
-	var srcUIDs, destUIDs []imap.UID
-
+	result := &copyResult{uidToSeq: make(map[uint32]uint32, len(messages))}
 	for i, msg := range messages {
 		seqNum := uint32(i + 1)
+		result.uidToSeq[msg.UID] = seqNum
+
 		var shouldCopy bool
 		switch set := numSet.(type) {
 		case imap.UIDSet:
@@ -719,26 +1015,117 @@ func (s *Session) Copy(numSet imap.NumSet, dest string) (*imap.CopyData, error)
 		case imap.SeqSet:
 			shouldCopy = set.Contains(seqNum)
 		}
+		if !shouldCopy {
+			continue
+		}
 
-		if shouldCopy {
-			newMsg, err := s.server.store.CopyMessage(ctx, selected.ID, msg.UID, destMb.ID)
-			if err == nil {
-				srcUIDs = append(srcUIDs, imap.UID(msg.UID))
-				destUIDs = append(destUIDs, imap.UID(newMsg.UID))
-			} else {
-				log.Printf("IMAP: Failed to copy message UID %d: %v", msg.UID, err)
-			}
+		newMsg, err := s.server.store.CopyMessage(ctx, selected.ID, msg.UID, destMb.ID)
+		if err != nil {
+			log.Printf("IMAP: Failed to copy message UID %d: %v", msg.UID, err)
+			result.failed++
+			result.overQuota = result.overQuota || errors.Is(err, storage.ErrOverQuota)
+			continue
+		}
+		result.srcUIDs = append(result.srcUIDs, imap.UID(msg.UID))
+		result.destUIDs = append(result.destUIDs, imap.UID(newMsg.UID))
+	}
+
+	return destMb, result, nil
+}
+
+// removeMessages permanently removes the given UIDs from a mailbox
+func (s *Session) removeMessages(ctx context.Context, mailboxID int64, uids []imap.UID) ([]uint32, error) {
+	raw := make([]uint32, 0, len(uids))
+	for _, uid := range uids {
+		if err := s.server.store.DeleteMessage(ctx, mailboxID, uint32(uid)); err != nil {
+			return nil, err
+		}
+		raw = append(raw, uint32(uid))
+	}
+	return s.server.store.ExpungeUIDs(ctx, mailboxID, raw)
+}
+
+// Copy copies messages to another mailbox. It is all or nothing: if any
+// message fails, the copies already made are removed again.
+func (s *Session) Copy(numSet imap.NumSet, dest string) (*imap.CopyData, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	destMb, result, err := s.copyMessages(ctx, numSet, dest)
+	if err != nil {
+		return nil, err
+	}
+
+	if result.failed > 0 {
+		if _, err := s.removeMessages(ctx, destMb.ID, result.destUIDs); err != nil {
+			log.Printf("IMAP: Failed to roll back partial copy to %s: %v", dest, err)
+		}
+		return nil, &imap.Error{
+			Type: imap.StatusResponseTypeNo,
+			Code: result.failureCode(),
+			Text: fmt.Sprintf("Failed to copy %d of %d messages, nothing was copied", result.failed, result.failed+len(result.srcUIDs)),
 		}
 	}
 
 	// Notify destination mailbox
 	s.server.NotifyMailboxUpdate(destMb.ID)
 
-	return &imap.CopyData{
-		UIDValidity: destMb.UIDValidity,
-		SourceUIDs:  imap.UIDSetNum(srcUIDs...),
-		DestUIDs:    imap.UIDSetNum(destUIDs...),
-	}, nil
+	return result.copyData(destMb), nil
+}
+
+// Move moves messages to another mailbox. A source message is only removed
+// once its copy in the destination exists, so a failure part way through
+// leaves the messages that weren't copied where they were.
+func (s *Session) Move(w *imapserver.MoveWriter, numSet imap.NumSet, dest string) error {
+	s.mu.RLock()
+	readOnly := s.readOnly
+	rights := s.rights
+	s.mu.RUnlock()
+	if readOnly {
+		return errReadOnly
+	}
+	if !hasRights(rights, "te") {
+		return noPerm("Permission denied")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	destMb, result, err := s.copyMessages(ctx, numSet, dest)
+	if err != nil {
+		return err
+	}
+
+	if len(result.srcUIDs) > 0 {
+		if err := w.WriteCopyData(result.copyData(destMb)); err != nil {
+			return err
+		}
+
+		s.mu.RLock()
+		selected := s.selected
+		s.mu.RUnlock()
+
+		expunged, err := s.removeMessages(ctx, selected.ID, result.srcUIDs)
+		if err != nil {
+			// The copies exist, so the worst case is a duplicate, not a loss
+			log.Printf("IMAP: Failed to remove moved messages from %s: %v", selected.Name, err)
+		}
+		if err := writeExpunges(w.WriteExpunge, result.uidToSeq, expunged); err != nil {
+			return err
+		}
+
+		s.server.NotifyMailboxUpdate(destMb.ID)
+		s.server.NotifyMailboxUpdate(selected.ID)
+	}
+
+	if result.failed > 0 {
+		return &imap.Error{
+			Type: imap.StatusResponseTypeNo,
+			Code: result.failureCode(),
+			Text: fmt.Sprintf("Failed to move %d of %d messages, they were left in place", result.failed, result.failed+len(result.srcUIDs)),
+		}
+	}
+	return nil
 }
 
 // Search searches for messages
@@ -769,6 +1156,16 @@ func (s *Session) Search(kind imapserver.NumKind, criteria *imap.SearchCriteria,
 		for _, f := range criteria.NotFlag {
 			storageCriteria.NotFlags = append(storageCriteria.NotFlags, storage.Flag(f))
 		}
+		for _, h := range criteria.Header {
+			switch strings.ToLower(h.Key) {
+			case "subject":
+				storageCriteria.Subject = h.Value
+			case "from":
+				storageCriteria.From = h.Value
+			case "to":
+				storageCriteria.To = h.Value
+			}
+		}
 	}
 
 	uids, err := s.server.store.SearchMessages(ctx, selected.ID, storageCriteria)
@@ -777,13 +1174,19 @@ func (s *Session) Search(kind imapserver.NumKind, criteria *imap.SearchCriteria,
 	}
 
 	if kind == imapserver.NumKindUID {
-		imapUIDs := make([]imap.UID, len(uids))
-		for i, uid := range uids {
-			imapUIDs[i] = imap.UID(uid)
-		}
-		return &imap.SearchData{
-			All: imap.UIDSetNum(imapUIDs...),
-		}, nil
+		return esearchData(uids, options, func(nums []uint32) imap.NumSet {
+			imapUIDs := make([]imap.UID, len(nums))
+			for i, uid := range nums {
+				imapUIDs[i] = imap.UID(uid)
+			}
+			return imap.UIDSetNum(imapUIDs...)
+		}), nil
+	}
+
+	// Every UID found is in the mailbox, so a count alone needs no
+	// sequence numbers
+	if options != nil && options.ReturnCount && !options.ReturnAll && !options.ReturnMin && !options.ReturnMax {
+		return &imap.SearchData{All: imap.SeqSet{}, Count: uint32(len(uids))}, nil
 	}
 
 	// Convert UIDs to sequence numbers
@@ -804,9 +1207,314 @@ func (s *Session) Search(kind imapserver.NumKind, criteria *imap.SearchCriteria,
 		}
 	}
 
-	return &imap.SearchData{
-		All: imap.SeqSetNum(seqNums...),
-	}, nil
+	return esearchData(seqNums, options, func(nums []uint32) imap.NumSet {
+		return imap.SeqSetNum(nums...)
+	}), nil
+}
+
+// esearchData fills in the results the ESEARCH return options (RFC 4731)
+// ask for from nums, which are ascending. The ALL set is only built when
+// requested, or when options is nil for a plain SEARCH.
+func esearchData(nums []uint32, options *imap.SearchOptions, numSet func([]uint32) imap.NumSet) *imap.SearchData {
+	data := &imap.SearchData{All: numSet(nil)}
+	if options == nil || options.ReturnAll {
+		data.All = numSet(nums)
+	}
+	if len(nums) > 0 {
+		data.Min = nums[0]
+		data.Max = nums[len(nums)-1]
+	}
+	data.Count = uint32(len(nums))
+	return data
+}
+
+// Annotation limits (RFC 5464 section 4.3)
+const (
+	maxMetadataValueSize = 16 * 1024 // per entry
+	maxMetadataTotalSize = 64 * 1024 // per mailbox, or per user for server entries
+)
+
+// handleGetMetadata implements GETMETADATA (RFC 5464 section 4.2)
+func (s *Session) handleGetMetadata(w *bytes.Buffer, args *argReader) *imap.StatusResponse {
+	maxSize, depth := -1, 0
+	if args.consume('(') {
+		for {
+			opt, err := args.atom()
+			if err != nil {
+				return badMetadataArgs(err)
+			}
+			if err := args.sp(); err != nil {
+				return badMetadataArgs(err)
+			}
+			value, err := args.atom()
+			if err != nil {
+				return badMetadataArgs(err)
+			}
+			switch strings.ToUpper(opt) {
+			case "MAXSIZE":
+				if maxSize, err = strconv.Atoi(value); err != nil || maxSize < 0 {
+					return badMetadataArgs(fmt.Errorf("invalid MAXSIZE %q", value))
+				}
+			case "DEPTH":
+				switch strings.ToLower(value) {
+				case "0":
+					depth = 0
+				case "1":
+					depth = 1
+				case "infinity":
+					depth = -1
+				default:
+					return badMetadataArgs(fmt.Errorf("invalid DEPTH %q", value))
+				}
+			default:
+				return badMetadataArgs(fmt.Errorf("unknown option %q", opt))
+			}
+			if args.consume(')') {
+				break
+			}
+			if err := args.sp(); err != nil {
+				return badMetadataArgs(err)
+			}
+		}
+		if err := args.sp(); err != nil {
+			return badMetadataArgs(err)
+		}
+	}
+
+	mailbox, err := args.mailbox()
+	if err != nil {
+		return badMetadataArgs(err)
+	}
+	if err := args.sp(); err != nil {
+		return badMetadataArgs(err)
+	}
+	var names []string
+	list := args.consume('(')
+	for {
+		name, err := args.astring()
+		if err != nil {
+			return badMetadataArgs(err)
+		}
+		if err := validateMetadataEntry(name); err != nil {
+			return badMetadataArgs(err)
+		}
+		names = append(names, strings.ToLower(name))
+		if !list || args.consume(')') {
+			break
+		}
+		if err := args.sp(); err != nil {
+			return badMetadataArgs(err)
+		}
+	}
+	if !args.done() {
+		return badMetadataArgs(errBadArgs)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	mailboxID, status := s.metadataTarget(ctx, mailbox)
+	if status != nil {
+		return status
+	}
+	stored, err := s.server.store.ListMetadata(ctx, s.user.ID, mailboxID)
+	if err != nil {
+		log.Printf("IMAP v2: GETMETADATA failed for %s: %v", mailbox, err)
+		return &imap.StatusResponse{Type: imap.StatusResponseTypeNo, Code: imap.ResponseCodeServerBug, Text: "Failed to read metadata"}
+	}
+
+	var out bytes.Buffer
+	longest := 0
+	seen := make(map[string]bool)
+	add := func(name string, value []byte) {
+		if seen[name] {
+			return
+		}
+		seen[name] = true
+		if value != nil && maxSize >= 0 && len(value) > maxSize {
+			if len(value) > longest {
+				longest = len(value)
+			}
+			return
+		}
+		if out.Len() > 0 {
+			out.WriteByte(' ')
+		}
+		out.WriteString(name)
+		out.WriteByte(' ')
+		if value == nil {
+			out.WriteString("NIL")
+		} else {
+			writeString(&out, value)
+		}
+	}
+
+	for _, name := range names {
+		found := false
+		for _, e := range stored {
+			if e.Name == name {
+				add(e.Name, e.Value)
+				found = true
+			} else if depth != 0 && strings.HasPrefix(e.Name, name+"/") {
+				if depth == -1 || !strings.Contains(e.Name[len(name)+1:], "/") {
+					add(e.Name, e.Value)
+				}
+			}
+		}
+		if !found && depth == 0 {
+			add(name, nil)
+		}
+	}
+
+	if out.Len() > 0 {
+		w.WriteString("* METADATA ")
+		writeString(w, []byte(encodeMailboxName(mailbox)))
+		fmt.Fprintf(w, " (%s)\r\n", out.Bytes())
+	}
+	if longest > 0 {
+		return &imap.StatusResponse{
+			Type: imap.StatusResponseTypeOK,
+			Code: imap.ResponseCode(fmt.Sprintf("METADATA LONGENTRIES %d", longest)),
+			Text: "GETMETADATA completed",
+		}
+	}
+	return nil
+}
+
+// handleSetMetadata implements SETMETADATA (RFC 5464 section 4.3).
+// Either every entry in the command is applied or none is.
+func (s *Session) handleSetMetadata(w *bytes.Buffer, args *argReader) *imap.StatusResponse {
+	mailbox, err := args.mailbox()
+	if err != nil {
+		return badMetadataArgs(err)
+	}
+	if err := args.sp(); err != nil {
+		return badMetadataArgs(err)
+	}
+	if err := args.expect('('); err != nil {
+		return badMetadataArgs(err)
+	}
+
+	var entries []storage.MetadataEntry
+	for {
+		name, err := args.astring()
+		if err != nil {
+			return badMetadataArgs(err)
+		}
+		if err := validateMetadataEntry(name); err != nil {
+			return badMetadataArgs(err)
+		}
+		if strings.Count(name, "/") < 2 {
+			return badMetadataArgs(fmt.Errorf("cannot set %q", name))
+		}
+		if err := args.sp(); err != nil {
+			return badMetadataArgs(err)
+		}
+		value, err := args.nstring()
+		if err != nil {
+			return badMetadataArgs(err)
+		}
+		if len(value) > maxMetadataValueSize {
+			return &imap.StatusResponse{
+				Type: imap.StatusResponseTypeNo,
+				Code: imap.ResponseCode(fmt.Sprintf("METADATA MAXSIZE %d", maxMetadataValueSize)),
+				Text: "Annotation value too large",
+			}
+		}
+		entries = append(entries, storage.MetadataEntry{Name: strings.ToLower(name), Value: value})
+		if args.consume(')') {
+			break
+		}
+		if err := args.sp(); err != nil {
+			return badMetadataArgs(err)
+		}
+	}
+	if !args.done() {
+		return badMetadataArgs(errBadArgs)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	mailboxID, status := s.metadataTarget(ctx, mailbox)
+	if status != nil {
+		return status
+	}
+	stored, err := s.server.store.ListMetadata(ctx, s.user.ID, mailboxID)
+	if err != nil {
+		log.Printf("IMAP v2: SETMETADATA failed for %s: %v", mailbox, err)
+		return &imap.StatusResponse{Type: imap.StatusResponseTypeNo, Code: imap.ResponseCodeServerBug, Text: "Failed to read metadata"}
+	}
+
+	// Check the total size the mailbox would carry after this update
+	sizes := make(map[string]int, len(stored)+len(entries))
+	for _, e := range stored {
+		sizes[e.Name] = len(e.Name) + len(e.Value)
+	}
+	for _, e := range entries {
+		if e.Value == nil {
+			delete(sizes, e.Name)
+		} else {
+			sizes[e.Name] = len(e.Name) + len(e.Value)
+		}
+	}
+	total := 0
+	for _, n := range sizes {
+		total += n
+	}
+	if total > maxMetadataTotalSize {
+		return &imap.StatusResponse{
+			Type: imap.StatusResponseTypeNo,
+			Code: imap.ResponseCode("METADATA TOOMANY"),
+			Text: "Too much metadata on this mailbox",
+		}
+	}
+
+	if err := s.server.store.SetMetadata(ctx, s.user.ID, mailboxID, entries); err != nil {
+		log.Printf("IMAP v2: SETMETADATA failed for %s: %v", mailbox, err)
+		return &imap.StatusResponse{Type: imap.StatusResponseTypeNo, Code: imap.ResponseCodeServerBug, Text: "Failed to store metadata"}
+	}
+	return nil
+}
+
+// metadataTarget resolves a METADATA mailbox argument to a mailbox ID, or 0
+// for the server annotations ("")
+func (s *Session) metadataTarget(ctx context.Context, mailbox string) (int64, *imap.StatusResponse) {
+	if mailbox == "" {
+		return 0, nil
+	}
+	mb, err := s.server.store.GetMailbox(ctx, s.user.ID, mailbox)
+	if err != nil {
+		return 0, &imap.StatusResponse{
+			Type: imap.StatusResponseTypeNo,
+			Code: imap.ResponseCodeNonExistent,
+			Text: "Mailbox not found",
+		}
+	}
+	return mb.ID, nil
+}
+
+// validateMetadataEntry checks an entry name against RFC 5464 section 3.2.
+// The bare /private and /shared roots are only useful with DEPTH.
+func validateMetadataEntry(name string) error {
+	lower := strings.ToLower(name)
+	switch {
+	case lower != "/private" && lower != "/shared" &&
+		!strings.HasPrefix(lower, "/private/") && !strings.HasPrefix(lower, "/shared/"):
+		return fmt.Errorf("entry %q must start with /private/ or /shared/", name)
+	case strings.ContainsAny(name, "*%"), strings.Contains(name, "//"), strings.HasSuffix(name, "/"):
+		return fmt.Errorf("invalid entry name %q", name)
+	}
+	for i := 0; i < len(name); i++ {
+		if name[i] < 0x20 || name[i] == 0x7f {
+			return fmt.Errorf("invalid entry name %q", name)
+		}
+	}
+	return nil
+}
+
+func badMetadataArgs(err error) *imap.StatusResponse {
+	return &imap.StatusResponse{Type: imap.StatusResponseTypeBad, Text: err.Error()}
 }
 
 // Helper functions
@@ -903,3 +1611,39 @@ func extractBodySection(data []byte, section *imap.FetchItemBodySection) []byte
 	}
 	return data
 }
+
+// storageError turns an error from the store into the NO response that
+// tells the client why the command failed. Errors without a matching
+// response code are returned unchanged.
+func storageError(err error) error {
+	var code imap.ResponseCode
+	var text string
+	switch {
+	case errors.Is(err, storage.ErrMailboxNotFound):
+		code, text = imap.ResponseCodeNonExistent, "Mailbox not found"
+	case errors.Is(err, storage.ErrMessageNotFound):
+		code, text = imap.ResponseCodeNonExistent, "Message not found"
+	case errors.Is(err, storage.ErrMailboxExists):
+		code, text = imap.ResponseCodeAlreadyExists, "Mailbox already exists"
+	case errors.Is(err, storage.ErrOverQuota):
+		code, text = imap.ResponseCodeOverQuota, "Quota exceeded"
+	case errors.Is(err, storage.ErrMailboxLimit):
+		code, text = imap.ResponseCodeLimit, "Too many mailboxes or hierarchy too deep"
+	default:
+		return err
+	}
+	return &imap.Error{Type: imap.StatusResponseTypeNo, Code: code, Text: text}
+}
+
+// tryCreateError is storageError for the target mailbox of APPEND, COPY or
+// MOVE, where a missing one is answered with TRYCREATE (RFC 3501 6.3.11)
+func tryCreateError(err error) error {
+	if errors.Is(err, storage.ErrMailboxNotFound) {
+		return &imap.Error{
+			Type: imap.StatusResponseTypeNo,
+			Code: imap.ResponseCodeTryCreate,
+			Text: "Mailbox not found",
+		}
+	}
+	return storageError(err)
+}
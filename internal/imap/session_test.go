@@ -0,0 +1,902 @@
+package imap
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fenilsonani/email-server/internal/auth"
+	"github.com/fenilsonani/email-server/internal/storage"
+	"github.com/fenilsonani/email-server/internal/storage/maildir"
+	"github.com/fenilsonani/email-server/internal/storage/metadata"
+)
+
+// startTestServer serves IMAP on a loopback listener with one user,
+// alice@example.com, whose password is "password123"
+func startTestServer(t *testing.T) string {
+	t.Helper()
+	srv, _ := newTestServer(t)
+	return listenTestServer(t, srv)
+}
+
+// newTestServer creates a server with alice@example.com, without listening
+func newTestServer(t *testing.T) (*Server, *metadata.DB) {
+	t.Helper()
+	return newTestServerTLS(t, nil)
+}
+
+// newTestServerTLS is newTestServer offering STARTTLS with tlsConfig
+func newTestServerTLS(t *testing.T, tlsConfig *tls.Config) (*Server, *metadata.DB) {
+	t.Helper()
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	db, err := metadata.Open(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := db.Migrate(ctx); err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+
+	authenticator := auth.NewAuthenticator(db.DB)
+	store, err := maildir.NewStore(db.DB, filepath.Join(dir, "maildir"))
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	store.SetQuotaEnforcement(true)
+
+	res, err := db.ExecContext(ctx, "INSERT INTO domains (name) VALUES ('example.com')")
+	if err != nil {
+		t.Fatalf("Failed to insert domain: %v", err)
+	}
+	domainID, _ := res.LastInsertId()
+	user, err := authenticator.CreateUser(ctx, "alice", "password123", domainID)
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	if err := store.InitializeUserMailboxes(ctx, user.ID); err != nil {
+		t.Fatalf("InitializeUserMailboxes() error = %v", err)
+	}
+
+	return NewServer(authenticator, store, "127.0.0.1:0", "", tlsConfig), db
+}
+
+// listenTestServer starts srv on a loopback listener and returns its address
+func listenTestServer(t *testing.T, srv *Server) string {
+	t.Helper()
+	if err := srv.ListenAndServe(); err != nil {
+		t.Fatalf("ListenAndServe() error = %v", err)
+	}
+	t.Cleanup(func() { srv.Close() })
+
+	return srv.listener.Addr().String()
+}
+
+// rawClient speaks IMAP line by line
+type rawClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+	seq  int
+}
+
+func dialRaw(t *testing.T, addr string) *rawClient {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	t.Cleanup(func() { conn.Close() })
+
+	c := &rawClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+	if greeting := c.line(); !strings.HasPrefix(greeting, "* OK") {
+		t.Fatalf("greeting = %q", greeting)
+	}
+	return c
+}
+
+func (c *rawClient) line() string {
+	c.t.Helper()
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("read error: %v", err)
+	}
+	return strings.TrimRight(line, "\r\n")
+}
+
+// command sends a tagged command and returns the untagged lines and the
+// tagged status line (without the tag)
+func (c *rawClient) command(format string, args ...any) ([]string, string) {
+	c.t.Helper()
+	c.seq++
+	tag := fmt.Sprintf("a%d", c.seq)
+	if _, err := fmt.Fprintf(c.conn, tag+" "+format+"\r\n", args...); err != nil {
+		c.t.Fatalf("write error: %v", err)
+	}
+
+	var untagged []string
+	for {
+		line := c.line()
+		if rest, ok := strings.CutPrefix(line, tag+" "); ok {
+			return untagged, rest
+		}
+		untagged = append(untagged, line)
+	}
+}
+
+func (c *rawClient) login() {
+	c.t.Helper()
+	if _, status := c.command("LOGIN alice@example.com password123"); !strings.HasPrefix(status, "OK") {
+		c.t.Fatalf("LOGIN = %q", status)
+	}
+}
+
+func TestExtractEnvelopePreservesUTF8(t *testing.T) {
+	data := []byte("From: Jörg Müller <müller@exämple.de>\r\n" +
+		"To: 田中 <田中@例え.jp>, zoë@example.com\r\n" +
+		"Subject: Grüße\r\n" +
+		"\r\n" +
+		"body\r\n")
+
+	env := extractEnvelope(data)
+
+	if env.Subject != "Grüße" {
+		t.Errorf("Subject = %q, want Grüße", env.Subject)
+	}
+	if len(env.From) != 1 {
+		t.Fatalf("From has %d addresses, want 1", len(env.From))
+	}
+	if from := env.From[0]; from.Name != "Jörg Müller" || from.Mailbox != "müller" || from.Host != "exämple.de" {
+		t.Errorf("From = %+v, want Jörg Müller <müller@exämple.de>", from)
+	}
+	if len(env.To) != 2 {
+		t.Fatalf("To has %d addresses, want 2", len(env.To))
+	}
+	if to := env.To[0]; to.Name != "田中" || to.Mailbox != "田中" || to.Host != "例え.jp" {
+		t.Errorf("To[0] = %+v, want 田中 <田中@例え.jp>", to)
+	}
+	if to := env.To[1]; to.Mailbox != "zoë" || to.Host != "example.com" {
+		t.Errorf("To[1] = %+v, want zoë@example.com", to)
+	}
+}
+
+func TestCapabilityAdvertisesMetadata(t *testing.T) {
+	c := dialRaw(t, startTestServer(t))
+
+	untagged, status := c.command("CAPABILITY")
+	if !strings.HasPrefix(status, "OK") {
+		t.Fatalf("CAPABILITY = %q", status)
+	}
+	if len(untagged) != 1 || !strings.Contains(untagged[0], " METADATA") {
+		t.Errorf("CAPABILITY response = %q, want METADATA", untagged)
+	}
+}
+
+func TestMetadataRoundTrip(t *testing.T) {
+	c := dialRaw(t, startTestServer(t))
+	c.login()
+
+	_, status := c.command("SETMETADATA INBOX (/private/comment \"My comment\" /shared/vendor/x {6+}\r\nline\r\n)")
+	if !strings.HasPrefix(status, "OK") {
+		t.Fatalf("SETMETADATA = %q", status)
+	}
+
+	untagged, status := c.command("GETMETADATA INBOX /private/comment")
+	if !strings.HasPrefix(status, "OK") {
+		t.Fatalf("GETMETADATA = %q", status)
+	}
+	if want := `* METADATA "INBOX" (/private/comment "My comment")`; len(untagged) != 1 || untagged[0] != want {
+		t.Errorf("GETMETADATA response = %q, want %q", untagged, want)
+	}
+
+	// DEPTH infinity returns the literal value under /shared
+	untagged, _ = c.command("GETMETADATA (DEPTH infinity) INBOX /shared")
+	if want := `* METADATA "INBOX" (/shared/vendor/x {6}`; len(untagged) != 3 || untagged[0] != want || untagged[1] != "line" {
+		t.Errorf("GETMETADATA DEPTH infinity response = %q", untagged)
+	}
+
+	// Server annotations live apart from mailbox ones
+	if _, status := c.command(`SETMETADATA "" (/private/comment "server")`); !strings.HasPrefix(status, "OK") {
+		t.Fatalf("SETMETADATA server = %q", status)
+	}
+	untagged, _ = c.command(`GETMETADATA "" (/private/comment /private/missing)`)
+	if want := `* METADATA "" (/private/comment "server" /private/missing NIL)`; len(untagged) != 1 || untagged[0] != want {
+		t.Errorf("GETMETADATA server response = %q, want %q", untagged, want)
+	}
+
+	// NIL removes an entry
+	c.command("SETMETADATA INBOX (/private/comment NIL)")
+	untagged, _ = c.command("GETMETADATA INBOX /private/comment")
+	if want := `* METADATA "INBOX" (/private/comment NIL)`; len(untagged) != 1 || untagged[0] != want {
+		t.Errorf("GETMETADATA after delete = %q, want %q", untagged, want)
+	}
+}
+
+func TestMetadataRejectsOversizedValue(t *testing.T) {
+	c := dialRaw(t, startTestServer(t))
+	c.login()
+
+	value := strings.Repeat("x", maxMetadataValueSize+1)
+	_, status := c.command("SETMETADATA INBOX (/private/comment {%d+}\r\n%s)", len(value), value)
+	if want := fmt.Sprintf("NO [METADATA MAXSIZE %d]", maxMetadataValueSize); !strings.HasPrefix(status, want) {
+		t.Fatalf("SETMETADATA = %q, want %s", status, want)
+	}
+
+	untagged, _ := c.command("GETMETADATA INBOX /private/comment")
+	if want := `* METADATA "INBOX" (/private/comment NIL)`; len(untagged) != 1 || untagged[0] != want {
+		t.Errorf("GETMETADATA = %q, want nothing stored", untagged)
+	}
+
+	// The connection stays in sync after the rejected literal
+	if _, status := c.command("NOOP"); !strings.HasPrefix(status, "OK") {
+		t.Errorf("NOOP = %q", status)
+	}
+}
+
+func TestMetadataRequiresOwnMailbox(t *testing.T) {
+	c := dialRaw(t, startTestServer(t))
+	c.login()
+
+	_, status := c.command(`SETMETADATA Nonexistent (/private/comment "x")`)
+	if !strings.HasPrefix(status, "NO [NONEXISTENT]") {
+		t.Errorf("SETMETADATA = %q, want NO [NONEXISTENT]", status)
+	}
+	_, status = c.command(`SETMETADATA INBOX (/comment "x")`)
+	if !strings.HasPrefix(status, "BAD") {
+		t.Errorf("SETMETADATA with invalid entry = %q, want BAD", status)
+	}
+}
+
+func TestSelectClearsRecent(t *testing.T) {
+	srv, _ := newTestServer(t)
+	addr := listenTestServer(t, srv)
+	ctx := context.Background()
+
+	user, err := srv.authenticator.LookupUser(ctx, "alice@example.com")
+	if err != nil {
+		t.Fatalf("LookupUser() error = %v", err)
+	}
+	inbox, err := srv.store.GetMailbox(ctx, user.ID, "INBOX")
+	if err != nil {
+		t.Fatalf("GetMailbox() error = %v", err)
+	}
+	if _, err := srv.store.AppendMessage(ctx, inbox.ID, nil, time.Now(), strings.NewReader("Subject: hi\r\n\r\nhello\r\n")); err != nil {
+		t.Fatalf("AppendMessage() error = %v", err)
+	}
+
+	c := dialRaw(t, addr)
+	c.login()
+
+	untagged, _ := c.command("STATUS INBOX (RECENT)")
+	if len(untagged) == 0 || !strings.Contains(untagged[0], "RECENT 1") {
+		t.Errorf("STATUS = %q, want RECENT 1", untagged)
+	}
+
+	// EXAMINE reports the message as recent without taking the flag
+	untagged, _ = c.command("EXAMINE INBOX")
+	if !containsLine(untagged, "* 1 RECENT") {
+		t.Errorf("EXAMINE = %q, want * 1 RECENT", untagged)
+	}
+
+	untagged, _ = c.command("SELECT INBOX")
+	if !containsLine(untagged, "* 1 RECENT") {
+		t.Errorf("first SELECT = %q, want * 1 RECENT", untagged)
+	}
+	untagged, _ = c.command("FETCH 1 (FLAGS)")
+	if len(untagged) == 0 || !strings.Contains(untagged[0], `\Recent`) {
+		t.Errorf("FETCH = %q, want \\Recent in this session", untagged)
+	}
+
+	untagged, _ = c.command("SELECT INBOX")
+	if !containsLine(untagged, "* 0 RECENT") {
+		t.Errorf("second SELECT = %q, want * 0 RECENT", untagged)
+	}
+	untagged, _ = c.command("FETCH 1 (FLAGS)")
+	if len(untagged) == 0 || strings.Contains(untagged[0], `\Recent`) {
+		t.Errorf("FETCH after reselect = %q, want no \\Recent", untagged)
+	}
+}
+
+func TestExamineIsReadOnly(t *testing.T) {
+	srv, _ := newTestServer(t)
+	addr := listenTestServer(t, srv)
+	ctx := context.Background()
+
+	user, err := srv.authenticator.LookupUser(ctx, "alice@example.com")
+	if err != nil {
+		t.Fatalf("LookupUser() error = %v", err)
+	}
+	inbox, err := srv.store.GetMailbox(ctx, user.ID, "INBOX")
+	if err != nil {
+		t.Fatalf("GetMailbox() error = %v", err)
+	}
+	if _, err := srv.store.AppendMessage(ctx, inbox.ID, []storage.Flag{storage.FlagDeleted}, time.Now(), strings.NewReader("Subject: hi\r\n\r\nhello\r\n")); err != nil {
+		t.Fatalf("AppendMessage() error = %v", err)
+	}
+
+	c := dialRaw(t, addr)
+	c.login()
+
+	untagged, status := c.command("EXAMINE INBOX")
+	if !strings.HasPrefix(status, "OK [READ-ONLY]") {
+		t.Errorf("EXAMINE status = %q, want OK [READ-ONLY]", status)
+	}
+	if !containsLine(untagged, "* OK [PERMANENTFLAGS ()] Permanent flags") {
+		t.Errorf("EXAMINE = %q, want empty PERMANENTFLAGS", untagged)
+	}
+	for _, cmd := range []string{"STORE 1 +FLAGS (\\Seen)", "EXPUNGE", "UID EXPUNGE 1", "MOVE 1 Trash"} {
+		if _, status := c.command(cmd); !strings.HasPrefix(status, "NO [READ-ONLY]") {
+			t.Errorf("%s while examined = %q, want NO [READ-ONLY]", cmd, status)
+		}
+	}
+	// CLOSE leaves \Deleted messages in a read-only mailbox
+	if _, status := c.command("CLOSE"); !strings.HasPrefix(status, "OK") {
+		t.Errorf("CLOSE = %q, want OK", status)
+	}
+	msg, err := srv.store.GetMessage(ctx, inbox.ID, 1)
+	if err != nil || msg == nil {
+		t.Fatalf("GetMessage() = %v, %v, want the message kept", msg, err)
+	}
+	if slices.Contains(msg.Flags, storage.FlagSeen) {
+		t.Errorf("flags = %v, STORE changed a read-only mailbox", msg.Flags)
+	}
+
+	_, status = c.command("SELECT INBOX")
+	if !strings.HasPrefix(status, "OK [READ-WRITE]") {
+		t.Errorf("SELECT status = %q, want OK [READ-WRITE]", status)
+	}
+	untagged, status = c.command("STORE 1 +FLAGS (\\Seen)")
+	if !strings.HasPrefix(status, "OK") || len(untagged) == 0 || !strings.Contains(untagged[0], `\Seen`) {
+		t.Errorf("STORE after SELECT = %q, %q, want \\Seen set", untagged, status)
+	}
+}
+
+func TestFetchBodyStructureDecodesRFC2231Filename(t *testing.T) {
+	srv, _ := newTestServer(t)
+	addr := listenTestServer(t, srv)
+	ctx := context.Background()
+
+	user, err := srv.authenticator.LookupUser(ctx, "alice@example.com")
+	if err != nil {
+		t.Fatalf("LookupUser() error = %v", err)
+	}
+	inbox, err := srv.store.GetMailbox(ctx, user.ID, "INBOX")
+	if err != nil {
+		t.Fatalf("GetMailbox() error = %v", err)
+	}
+	msg := "Subject: cv\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=b1\r\n" +
+		"\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"See attached\r\n" +
+		"--b1\r\n" +
+		"Content-Type: application/pdf;\r\n" +
+		" name*0*=UTF-8''R%C3%A9sum%C3%A9%20f%C3%BCr;\r\n" +
+		" name*1*=%20J%C3%BCrgen.pdf\r\n" +
+		"Content-Disposition: attachment;\r\n" +
+		" filename*0*=UTF-8''R%C3%A9sum%C3%A9%20f%C3%BCr;\r\n" +
+		" filename*1*=%20J%C3%BCrgen.pdf\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"JVBERi0xLjQK\r\n" +
+		"--b1--\r\n"
+	if _, err := srv.store.AppendMessage(ctx, inbox.ID, nil, time.Now(), strings.NewReader(msg)); err != nil {
+		t.Fatalf("AppendMessage() error = %v", err)
+	}
+
+	c := dialRaw(t, addr)
+	c.login()
+	c.command("SELECT INBOX")
+
+	untagged, status := c.command("FETCH 1 (BODYSTRUCTURE)")
+	if !strings.HasPrefix(status, "OK") {
+		t.Fatalf("FETCH status = %q", status)
+	}
+	resp := strings.Join(untagged, "\n")
+	if !strings.Contains(resp, "BODYSTRUCTURE") || !strings.Contains(resp, `"mixed"`) {
+		t.Errorf("FETCH = %q, want a multipart/mixed BODYSTRUCTURE", resp)
+	}
+	if n := strings.Count(resp, "Résumé für Jürgen.pdf"); n != 2 {
+		t.Errorf("FETCH = %q, want the decoded name and filename", resp)
+	}
+}
+
+func TestFetchFailsWhenMessageUnreadable(t *testing.T) {
+	srv, db := newTestServer(t)
+	addr := listenTestServer(t, srv)
+	ctx := context.Background()
+
+	user, err := srv.authenticator.LookupUser(ctx, "alice@example.com")
+	if err != nil {
+		t.Fatalf("LookupUser() error = %v", err)
+	}
+	inbox, err := srv.store.GetMailbox(ctx, user.ID, "INBOX")
+	if err != nil {
+		t.Fatalf("GetMailbox() error = %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := srv.store.AppendMessage(ctx, inbox.ID, nil, time.Now(), strings.NewReader("Subject: hi\r\n\r\nhello\r\n")); err != nil {
+			t.Fatalf("AppendMessage() error = %v", err)
+		}
+	}
+	// The second message's body is in object storage, which isn't configured
+	if _, err := db.ExecContext(ctx, "UPDATE messages SET body_key = 'gone' WHERE mailbox_id = ? AND uid = 2", inbox.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	c := dialRaw(t, addr)
+	c.login()
+	c.command("SELECT INBOX")
+
+	if _, status := c.command("FETCH 1 (ENVELOPE BODYSTRUCTURE BODY.PEEK[HEADER] BODY.PEEK[TEXT])"); !strings.HasPrefix(status, "OK") {
+		t.Errorf("FETCH of a readable message = %q, want OK", status)
+	}
+	untagged, status := c.command("FETCH 2 (FLAGS BODY.PEEK[])")
+	if strings.HasPrefix(status, "OK") {
+		t.Errorf("FETCH of an unreadable message = %q, %q; want it to fail", untagged, status)
+	}
+	if len(untagged) != 0 {
+		t.Errorf("FETCH of an unreadable message = %q, want no partial response", untagged)
+	}
+}
+
+func containsLine(lines []string, want string) bool {
+	for _, l := range lines {
+		if l == want {
+			return true
+		}
+	}
+	return false
+}
+
+func TestUIDExpungeOnlyRemovesGivenUIDs(t *testing.T) {
+	srv, _ := newTestServer(t)
+	addr := listenTestServer(t, srv)
+	ctx := context.Background()
+
+	user, err := srv.authenticator.LookupUser(ctx, "alice@example.com")
+	if err != nil {
+		t.Fatalf("LookupUser() error = %v", err)
+	}
+	inbox, err := srv.store.GetMailbox(ctx, user.ID, "INBOX")
+	if err != nil {
+		t.Fatalf("GetMailbox() error = %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := srv.store.AppendMessage(ctx, inbox.ID, []storage.Flag{storage.FlagDeleted}, time.Now(), strings.NewReader("Subject: hi\r\n\r\nhello\r\n")); err != nil {
+			t.Fatalf("AppendMessage() error = %v", err)
+		}
+	}
+
+	c := dialRaw(t, addr)
+	c.login()
+	c.command("SELECT INBOX")
+
+	untagged, status := c.command("UID EXPUNGE 2")
+	if !strings.Contains(status, "OK") {
+		t.Fatalf("UID EXPUNGE status = %q", status)
+	}
+	if len(untagged) != 1 || untagged[0] != "* 2 EXPUNGE" {
+		t.Errorf("UID EXPUNGE = %q, want only * 2 EXPUNGE", untagged)
+	}
+
+	messages, err := srv.store.ListMessages(ctx, inbox.ID, 0, 0)
+	if err != nil {
+		t.Fatalf("ListMessages() error = %v", err)
+	}
+	if len(messages) != 2 || messages[0].UID != 1 || messages[1].UID != 3 {
+		t.Fatalf("remaining messages = %d, want UIDs 1 and 3 still \\Deleted", len(messages))
+	}
+
+	// Plain EXPUNGE still removes everything flagged \Deleted
+	untagged, _ = c.command("EXPUNGE")
+	if len(untagged) != 2 || untagged[0] != "* 2 EXPUNGE" || untagged[1] != "* 1 EXPUNGE" {
+		t.Errorf("EXPUNGE = %q, want * 2 EXPUNGE then * 1 EXPUNGE", untagged)
+	}
+}
+
+// failingCopyStore fails CopyMessage for one source UID
+type failingCopyStore struct {
+	messageStore
+	failUID uint32
+}
+
+func (s *failingCopyStore) CopyMessage(ctx context.Context, srcMailboxID int64, uid uint32, destMailboxID int64) (*storage.Message, error) {
+	if uid == s.failUID {
+		return nil, errors.New("injected copy failure")
+	}
+	return s.messageStore.CopyMessage(ctx, srcMailboxID, uid, destMailboxID)
+}
+
+// setupCopyFailure fills INBOX with three messages and makes copying the
+// second one fail
+func setupCopyFailure(t *testing.T) (*rawClient, *Server, *storage.Mailbox, *storage.Mailbox) {
+	t.Helper()
+	srv, _ := newTestServer(t)
+	ctx := context.Background()
+
+	user, err := srv.authenticator.LookupUser(ctx, "alice@example.com")
+	if err != nil {
+		t.Fatalf("LookupUser() error = %v", err)
+	}
+	inbox, err := srv.store.GetMailbox(ctx, user.ID, "INBOX")
+	if err != nil {
+		t.Fatalf("GetMailbox(INBOX) error = %v", err)
+	}
+	trash, err := srv.store.GetMailbox(ctx, user.ID, "Trash")
+	if err != nil {
+		t.Fatalf("GetMailbox(Trash) error = %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := srv.store.AppendMessage(ctx, inbox.ID, nil, time.Now(), strings.NewReader("Subject: hi\r\n\r\nhello\r\n")); err != nil {
+			t.Fatalf("AppendMessage() error = %v", err)
+		}
+	}
+	srv.store = &failingCopyStore{messageStore: srv.store, failUID: 2}
+
+	c := dialRaw(t, listenTestServer(t, srv))
+	c.login()
+	c.command("SELECT INBOX")
+	return c, srv, inbox, trash
+}
+
+func TestMovePartialFailureKeepsUncopiedSources(t *testing.T) {
+	c, srv, inbox, trash := setupCopyFailure(t)
+	ctx := context.Background()
+
+	untagged, status := c.command("MOVE 1:3 Trash")
+	if !strings.HasPrefix(status, "NO") {
+		t.Errorf("MOVE status = %q, want NO for the failed message", status)
+	}
+	if !containsLine(untagged, "* 3 EXPUNGE") || !containsLine(untagged, "* 1 EXPUNGE") || containsLine(untagged, "* 2 EXPUNGE") {
+		t.Errorf("MOVE = %q, want EXPUNGE for 3 and 1 only", untagged)
+	}
+
+	remaining, err := srv.store.ListMessages(ctx, inbox.ID, 0, 0)
+	if err != nil {
+		t.Fatalf("ListMessages(INBOX) error = %v", err)
+	}
+	if len(remaining) != 1 || remaining[0].UID != 2 || slices.Contains(remaining[0].Flags, storage.FlagDeleted) {
+		t.Fatalf("INBOX after MOVE = %+v, want only UID 2, not \\Deleted", remaining)
+	}
+	moved, err := srv.store.ListMessages(ctx, trash.ID, 0, 0)
+	if err != nil {
+		t.Fatalf("ListMessages(Trash) error = %v", err)
+	}
+	if len(moved) != 2 {
+		t.Errorf("Trash has %d messages, want 2", len(moved))
+	}
+}
+
+func TestCopyPartialFailureCopiesNothing(t *testing.T) {
+	c, srv, inbox, trash := setupCopyFailure(t)
+	ctx := context.Background()
+
+	if _, status := c.command("COPY 1:3 Trash"); !strings.HasPrefix(status, "NO") {
+		t.Errorf("COPY status = %q, want NO", status)
+	}
+
+	copied, err := srv.store.ListMessages(ctx, trash.ID, 0, 0)
+	if err != nil {
+		t.Fatalf("ListMessages(Trash) error = %v", err)
+	}
+	if len(copied) != 0 {
+		t.Errorf("Trash has %d messages after failed COPY, want 0", len(copied))
+	}
+	sources, err := srv.store.ListMessages(ctx, inbox.ID, 0, 0)
+	if err != nil {
+		t.Fatalf("ListMessages(INBOX) error = %v", err)
+	}
+	if len(sources) != 3 {
+		t.Errorf("INBOX has %d messages after failed COPY, want 3", len(sources))
+	}
+}
+
+// appendLiteral APPENDs msg to mailbox using a synchronizing literal
+func (c *rawClient) appendLiteral(mailbox, msg string) ([]string, string) {
+	c.t.Helper()
+	c.seq++
+	tag := fmt.Sprintf("a%d", c.seq)
+	fmt.Fprintf(c.conn, "%s APPEND %s {%d}\r\n", tag, mailbox, len(msg))
+	if cont := c.line(); !strings.HasPrefix(cont, "+") {
+		c.t.Fatalf("APPEND continuation = %q", cont)
+	}
+	fmt.Fprintf(c.conn, "%s\r\n", msg)
+
+	var untagged []string
+	for {
+		line := c.line()
+		if rest, ok := strings.CutPrefix(line, tag+" "); ok {
+			return untagged, rest
+		}
+		untagged = append(untagged, line)
+	}
+}
+
+func TestAppendToSentSkipsServerFiledCopy(t *testing.T) {
+	srv, _ := newTestServer(t)
+	srv.SetSentDedupeWindow(5 * time.Minute)
+	addr := listenTestServer(t, srv)
+	ctx := context.Background()
+
+	user, err := srv.authenticator.LookupUser(ctx, "alice@example.com")
+	if err != nil {
+		t.Fatalf("LookupUser() error = %v", err)
+	}
+	sent, err := srv.store.GetMailbox(ctx, user.ID, "Sent")
+	if err != nil {
+		t.Fatalf("GetMailbox(Sent) error = %v", err)
+	}
+
+	// The copy filed on submission
+	msg := "Message-ID: <sent-1@example.com>\r\nSubject: hi\r\n\r\nhello\r\n"
+	if _, err := srv.store.AppendMessage(ctx, sent.ID, []storage.Flag{storage.FlagSeen}, time.Now(), strings.NewReader(msg)); err != nil {
+		t.Fatalf("AppendMessage() error = %v", err)
+	}
+
+	c := dialRaw(t, addr)
+	c.login()
+
+	_, status := c.appendLiteral("Sent", msg)
+	if !strings.HasPrefix(status, "OK") || !strings.Contains(status, "APPENDUID") || !strings.Contains(status, " 1]") {
+		t.Errorf("APPEND status = %q, want OK with the existing UID 1", status)
+	}
+
+	// A different message is stored as usual
+	if _, status := c.appendLiteral("Sent", "Message-ID: <sent-2@example.com>\r\nSubject: other\r\n\r\nbye\r\n"); !strings.HasPrefix(status, "OK") {
+		t.Fatalf("second APPEND status = %q", status)
+	}
+
+	messages, err := srv.store.ListMessages(ctx, sent.ID, 0, 0)
+	if err != nil {
+		t.Fatalf("ListMessages() error = %v", err)
+	}
+	if len(messages) != 2 {
+		t.Errorf("Sent has %d messages, want 2", len(messages))
+	}
+}
+
+func TestKeywordsSurviveReselect(t *testing.T) {
+	srv, _ := newTestServer(t)
+	addr := listenTestServer(t, srv)
+	ctx := context.Background()
+
+	user, err := srv.authenticator.LookupUser(ctx, "alice@example.com")
+	if err != nil {
+		t.Fatalf("LookupUser() error = %v", err)
+	}
+	inbox, err := srv.store.GetMailbox(ctx, user.ID, "INBOX")
+	if err != nil {
+		t.Fatalf("GetMailbox() error = %v", err)
+	}
+	if _, err := srv.store.AppendMessage(ctx, inbox.ID, nil, time.Now(), strings.NewReader("Subject: hi\r\n\r\nhello\r\n")); err != nil {
+		t.Fatalf("AppendMessage() error = %v", err)
+	}
+
+	c := dialRaw(t, addr)
+	c.login()
+	c.command("SELECT INBOX")
+	if _, status := c.command(`STORE 1 +FLAGS (\Seen $Label1 $Forwarded)`); !strings.HasPrefix(status, "OK") {
+		t.Fatalf("STORE = %q", status)
+	}
+	// Keywords match case-insensitively, so this adds nothing
+	c.command(`STORE 1 +FLAGS.SILENT ($label1)`)
+
+	c = dialRaw(t, addr)
+	c.login()
+	untagged, _ := c.command("SELECT INBOX")
+	var flagsLine string
+	for _, l := range untagged {
+		if strings.HasPrefix(l, "* FLAGS") {
+			flagsLine = l
+		}
+	}
+	if !strings.Contains(flagsLine, "$Label1") || !strings.Contains(flagsLine, "$Forwarded") {
+		t.Errorf("SELECT FLAGS = %q, want the mailbox's keywords", flagsLine)
+	}
+
+	untagged, _ = c.command("FETCH 1 (FLAGS)")
+	if len(untagged) != 1 || !strings.Contains(untagged[0], "$Label1") || !strings.Contains(untagged[0], "$Forwarded") ||
+		!strings.Contains(untagged[0], `\Seen`) || strings.Contains(untagged[0], "$label1") {
+		t.Errorf("FETCH after reconnect = %q, want \\Seen $Label1 $Forwarded", untagged)
+	}
+
+	if _, status := c.command(`STORE 1 -FLAGS ($LABEL1)`); !strings.HasPrefix(status, "OK") {
+		t.Fatalf("STORE -FLAGS = %q", status)
+	}
+	untagged, _ = c.command("FETCH 1 (FLAGS)")
+	if len(untagged) != 1 || strings.Contains(strings.ToLower(untagged[0]), "$label1") {
+		t.Errorf("FETCH after removing the keyword = %q", untagged)
+	}
+}
+
+func TestStorageErrorResponseCodes(t *testing.T) {
+	srv, db := newTestServer(t)
+	c := dialRaw(t, listenTestServer(t, srv))
+	c.login()
+
+	for _, tt := range []struct {
+		command, want string
+	}{
+		{"CREATE Trash", "NO [ALREADYEXISTS]"},
+		{"RENAME Sent Trash", "NO [ALREADYEXISTS]"},
+		{"DELETE Missing", "NO [NONEXISTENT]"},
+		{"RENAME Missing Elsewhere", "NO [NONEXISTENT]"},
+		{"SELECT Missing", "NO [NONEXISTENT]"},
+	} {
+		if _, status := c.command("%s", tt.command); !strings.HasPrefix(status, tt.want) {
+			t.Errorf("%s = %q, want %s", tt.command, status, tt.want)
+		}
+	}
+
+	if _, status := c.appendLiteral("Missing", "Subject: hi\r\n\r\nhello"); !strings.HasPrefix(status, "NO [TRYCREATE]") {
+		t.Errorf("APPEND to a missing mailbox = %q, want NO [TRYCREATE]", status)
+	}
+	if _, err := db.Exec("UPDATE users SET quota_bytes = 10"); err != nil {
+		t.Fatalf("Failed to set quota: %v", err)
+	}
+	if _, status := c.appendLiteral("INBOX", "Subject: hi\r\n\r\nhello"); !strings.HasPrefix(status, "NO [OVERQUOTA]") {
+		t.Errorf("APPEND over quota = %q, want NO [OVERQUOTA]", status)
+	}
+}
+
+func TestFailedLoginRecordedInAuthLog(t *testing.T) {
+	srv, db := newTestServer(t)
+	authLog := auth.NewAuthLog(db.DB)
+	srv.authenticator.SetAuthLog(authLog)
+	c := dialRaw(t, listenTestServer(t, srv))
+
+	if _, status := c.command("LOGIN alice@example.com wrong"); !strings.HasPrefix(status, "NO") {
+		t.Fatalf("LOGIN with a wrong password = %q, want NO", status)
+	}
+	authLog.Close()
+
+	var username, remoteAddr, reason string
+	var success bool
+	err := db.QueryRow(`SELECT username, remote_addr, success, failure_reason
+		FROM auth_log WHERE protocol = 'imap'`).Scan(&username, &remoteAddr, &success, &reason)
+	if err != nil {
+		t.Fatalf("Failed to read auth_log: %v", err)
+	}
+	if username != "alice@example.com" || success || reason == "" || !strings.HasPrefix(remoteAddr, "127.0.0.1:") {
+		t.Errorf("auth_log row = %q, %q, %v, %q; want a failed login by alice@example.com from 127.0.0.1",
+			username, remoteAddr, success, reason)
+	}
+}
+
+func TestSearchReturnOptions(t *testing.T) {
+	srv, _ := newTestServer(t)
+	addr := listenTestServer(t, srv)
+	ctx := context.Background()
+
+	user, _ := srv.authenticator.LookupUser(ctx, "alice@example.com")
+	inbox, _ := srv.store.GetMailbox(ctx, user.ID, "INBOX")
+	for _, subject := range []string{"lunch", "report", "report", "lunch", "report"} {
+		if _, err := srv.store.AppendMessage(ctx, inbox.ID, nil, time.Now(), strings.NewReader("Subject: "+subject+"\r\n\r\nhello\r\n")); err != nil {
+			t.Fatalf("AppendMessage() error = %v", err)
+		}
+	}
+
+	c := dialRaw(t, addr)
+	c.login()
+	if untagged, _ := c.command("CAPABILITY"); len(untagged) != 1 || !strings.Contains(untagged[0], " ESEARCH") {
+		t.Errorf("CAPABILITY response = %q, want ESEARCH", untagged)
+	}
+	c.command("SELECT INBOX")
+
+	// esearch runs cmd and returns its ESEARCH response after the TAG
+	esearch := func(cmd string) string {
+		t.Helper()
+		untagged, status := c.command(cmd)
+		if !strings.HasPrefix(status, "OK") {
+			t.Fatalf("%s = %q", cmd, status)
+		}
+		for _, l := range untagged {
+			if rest, ok := strings.CutPrefix(l, "* ESEARCH (TAG "); ok {
+				_, result, _ := strings.Cut(rest, ")")
+				return strings.TrimSpace(result)
+			}
+		}
+		t.Fatalf("%s untagged = %q, want ESEARCH", cmd, untagged)
+		return ""
+	}
+
+	if got := esearch("SEARCH RETURN (COUNT) SUBJECT report"); got != "COUNT 3" {
+		t.Errorf("RETURN (COUNT) = %q, want COUNT 3", got)
+	}
+	if got := esearch("SEARCH RETURN (MIN MAX) SUBJECT report"); got != "MIN 2 MAX 5" {
+		t.Errorf("RETURN (MIN MAX) = %q, want MIN 2 MAX 5", got)
+	}
+	if got := esearch("UID SEARCH RETURN (MIN COUNT) SUBJECT lunch"); got != "UID MIN 1 COUNT 2" {
+		t.Errorf("UID RETURN (MIN COUNT) = %q, want UID MIN 1 COUNT 2", got)
+	}
+	if got := esearch("SEARCH RETURN () SUBJECT report"); got != "ALL 2:3,5" {
+		t.Errorf("RETURN () = %q, want ALL 2:3,5", got)
+	}
+	if got := esearch("SEARCH RETURN (COUNT MIN MAX) SUBJECT nothing"); got != "COUNT 0" {
+		t.Errorf("RETURN with no match = %q, want COUNT 0", got)
+	}
+
+	// Without RETURN, the plain SEARCH response is kept
+	if untagged, _ := c.command("SEARCH SUBJECT report"); !containsLine(untagged, "* SEARCH 2 3 5") {
+		t.Errorf("SEARCH = %q, want * SEARCH 2 3 5", untagged)
+	}
+}
+
+func TestCreateMakesParentMailboxes(t *testing.T) {
+	srv, _ := newTestServer(t)
+	c := dialRaw(t, listenTestServer(t, srv))
+	c.login()
+
+	if _, status := c.command("CREATE Projects/2026/Q1"); !strings.HasPrefix(status, "OK") {
+		t.Fatalf("CREATE = %q", status)
+	}
+	if _, status := c.command("CREATE Work/"); !strings.HasPrefix(status, "OK") {
+		t.Fatalf("CREATE with a trailing delimiter = %q", status)
+	}
+	if _, status := c.command("RENAME Projects/2026/Q1 Done/2026/Q1"); !strings.HasPrefix(status, "OK") {
+		t.Fatalf("RENAME into a new parent = %q", status)
+	}
+
+	untagged, _ := c.command(`LIST "" "*"`)
+	for _, name := range []string{"Projects", "Projects/2026", "Work", "Done", "Done/2026", "Done/2026/Q1"} {
+		if !containsLine(untagged, `* LIST () "/" "`+name+`"`) {
+			t.Errorf("LIST = %q, missing %s", untagged, name)
+		}
+	}
+	if containsLine(untagged, `* LIST () "/" "Projects/2026/Q1"`) {
+		t.Errorf("LIST = %q, still has the renamed mailbox", untagged)
+	}
+
+	// The parents count toward the mailbox limit
+	ctx := context.Background()
+	user, _ := srv.authenticator.LookupUser(ctx, "alice@example.com")
+	mailboxes, _ := srv.store.ListMailboxes(ctx, user.ID)
+	srv.store.(*maildir.Store).SetMailboxLimits(len(mailboxes)+1, 0)
+	if _, status := c.command("CREATE Clients/Acme"); !strings.HasPrefix(status, "NO [LIMIT]") {
+		t.Errorf("CREATE needing two mailboxes with room for one = %q, want NO [LIMIT]", status)
+	}
+	if _, status := c.command("SELECT Clients"); !strings.HasPrefix(status, "NO") {
+		t.Errorf("SELECT of a parent left over from a refused CREATE = %q, want NO", status)
+	}
+}
+
+func TestCreateBeyondMailboxLimitsRefused(t *testing.T) {
+	srv, _ := newTestServer(t)
+	addr := listenTestServer(t, srv)
+	srv.store.(*maildir.Store).SetMailboxLimits(0, 2)
+
+	c := dialRaw(t, addr)
+	c.login()
+	if _, status := c.command("CREATE Work/Clients"); !strings.HasPrefix(status, "OK") {
+		t.Fatalf("CREATE at the depth limit = %q", status)
+	}
+	if _, status := c.command("CREATE Work/Clients/Acme"); !strings.HasPrefix(status, "NO [LIMIT]") {
+		t.Errorf("CREATE past the depth limit = %q, want NO [LIMIT]", status)
+	}
+
+	ctx := context.Background()
+	user, _ := srv.authenticator.LookupUser(ctx, "alice@example.com")
+	mailboxes, err := srv.store.ListMailboxes(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("ListMailboxes() error = %v", err)
+	}
+	srv.store.(*maildir.Store).SetMailboxLimits(len(mailboxes), 0)
+	if _, status := c.command("CREATE Projects"); !strings.HasPrefix(status, "NO [LIMIT]") {
+		t.Errorf("CREATE past the count limit = %q, want NO [LIMIT]", status)
+	}
+}
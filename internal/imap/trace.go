@@ -0,0 +1,55 @@
+package imap
+
+import (
+	"strings"
+
+	"github.com/fenilsonani/email-server/internal/auth"
+	"github.com/fenilsonani/email-server/internal/logging"
+)
+
+// imapTraceFilter hides credentials and literals in an IMAP trace. Every
+// line the client sends for LOGIN or AUTHENTICATE, up to the command's
+// tagged response, is redacted, and literal data such as message bodies is
+// left out.
+func imapTraceFilter() logging.TraceFilter {
+	var authTag string
+	return func(fromClient bool, line string) (string, int64) {
+		n, _, _ := trailingLiteral([]byte(line))
+		if !fromClient {
+			if authTag != "" && strings.HasPrefix(line, authTag+" ") {
+				authTag = ""
+			}
+			return line, n
+		}
+		if authTag != "" {
+			return "[redacted]", n
+		}
+		tag, name, rest, ok := splitCommand([]byte(line))
+		if !ok {
+			return line, n
+		}
+		switch name {
+		case "LOGIN":
+			authTag = tag
+			return tag + " LOGIN [redacted]", n
+		case "AUTHENTICATE":
+			authTag = tag
+			mechanism, initial, _ := strings.Cut(string(rest), " ")
+			if initial != "" {
+				mechanism += " [redacted]"
+			}
+			return tag + " AUTHENTICATE " + mechanism, n
+		}
+		return line, n
+	}
+}
+
+// traceUser starts the trace of the session's connection if user is traced
+func (s *Session) traceUser(user *auth.User) {
+	if s.conn == nil {
+		return
+	}
+	if ec, ok := s.conn.NetConn().(*extConn); ok {
+		ec.trace.SetUser(user.Email)
+	}
+}
@@ -0,0 +1,102 @@
+package imap
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fenilsonani/email-server/internal/logging"
+)
+
+// lockedBuffer is a log destination the server and the test share
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// tracedSession logs in as alice and selects INBOX on a server tracing ips
+// and users, and returns what was logged
+func tracedSession(t *testing.T, ips, users []string) string {
+	t.Helper()
+	var logs lockedBuffer
+	logger := &logging.Logger{Logger: slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))}
+	tracer, err := logging.NewTracer(logger, ips, users, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("NewTracer() error = %v", err)
+	}
+	srv, _ := newTestServer(t)
+	srv.SetTracer(tracer)
+
+	c := dialRaw(t, listenTestServer(t, srv))
+	c.login()
+	if _, status := c.command("SELECT INBOX"); !strings.HasPrefix(status, "OK") {
+		t.Fatalf("SELECT = %q", status)
+	}
+	c.command("LOGOUT")
+	// The server logs each response after writing it; it has finished once
+	// it closes the connection
+	io.Copy(io.Discard, c.r)
+	return logs.String()
+}
+
+func TestTraceIMAPClient(t *testing.T) {
+	out := tracedSession(t, []string{"127.0.0.1"}, nil)
+	for _, want := range []string{`line="a1 LOGIN [redacted]"`, `line="a2 SELECT INBOX"`, `line="a3 LOGOUT"`, "direction=server"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("trace is missing %s:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "password123") {
+		t.Errorf("trace logged the password:\n%s", out)
+	}
+
+	// Traced by user, the session is followed from the login on
+	out = tracedSession(t, nil, []string{"alice@example.com"})
+	if strings.Contains(out, "LOGIN") || !strings.Contains(out, `line="a2 SELECT INBOX"`) || !strings.Contains(out, "user=alice@example.com") {
+		t.Errorf("trace of alice = %s, want the commands after LOGIN", out)
+	}
+
+	if out := tracedSession(t, []string{"192.0.2.0/24"}, []string{"bob@example.com"}); strings.Contains(out, "Protocol trace") {
+		t.Errorf("untraced session was logged:\n%s", out)
+	}
+}
+
+func TestIMAPTraceFilterRedactsAuthenticate(t *testing.T) {
+	filter := imapTraceFilter()
+	for _, step := range []struct {
+		fromClient bool
+		line, want string
+		skip       int64
+	}{
+		{true, "a1 AUTHENTICATE PLAIN", "a1 AUTHENTICATE PLAIN", 0},
+		{false, "+ ", "+ ", 0},
+		{true, "AGFsaWNlAHNlY3JldA==", "[redacted]", 0},
+		{false, "a1 OK Logged in", "a1 OK Logged in", 0},
+		{true, "a2 LOGIN {5}", "a2 LOGIN [redacted]", 5},
+		{true, " {6}", "[redacted]", 6},
+		{false, "a2 NO Authentication failed", "a2 NO Authentication failed", 0},
+		{true, "a3 APPEND INBOX {310}", "a3 APPEND INBOX {310}", 310},
+		{false, "* 1 FETCH (BODY[] {42}", "* 1 FETCH (BODY[] {42}", 42},
+	} {
+		text, skip := filter(step.fromClient, step.line)
+		if text != step.want || skip != step.skip {
+			t.Errorf("filter(%v, %q) = %q, %d; want %q, %d", step.fromClient, step.line, text, skip, step.want, step.skip)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package imap
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Mailbox names arrive in IMAP's modified UTF-7 (RFC 3501 section 5.1.3).
+// imapserver decodes them for its own commands; these helpers do the same
+// for the commands extConn handles.
+
+var mutf7 = base64.NewEncoding("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+,").WithPadding(base64.NoPadding)
+
+// decodeMailboxName converts a modified UTF-7 mailbox name to UTF-8.
+// Raw UTF-8 (as sent by UTF8=ACCEPT clients) is passed through.
+func decodeMailboxName(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '&' {
+			b.WriteByte(s[i])
+			continue
+		}
+		end := strings.IndexByte(s[i+1:], '-')
+		if end < 0 {
+			return "", fmt.Errorf("%w: unterminated UTF-7 sequence", errBadArgs)
+		}
+		enc := s[i+1 : i+1+end]
+		i += end + 1
+		if enc == "" {
+			b.WriteByte('&')
+			continue
+		}
+
+		raw, err := mutf7.DecodeString(enc)
+		if err != nil || len(raw)%2 != 0 {
+			return "", fmt.Errorf("%w: invalid UTF-7 sequence", errBadArgs)
+		}
+		units := make([]uint16, len(raw)/2)
+		for j := range units {
+			units[j] = uint16(raw[2*j])<<8 | uint16(raw[2*j+1])
+		}
+		b.WriteString(string(utf16.Decode(units)))
+	}
+	return b.String(), nil
+}
+
+// encodeMailboxName converts a UTF-8 mailbox name to modified UTF-7
+func encodeMailboxName(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c >= 0x20 && c <= 0x7e {
+			if c == '&' {
+				b.WriteString("&-")
+			} else {
+				b.WriteByte(c)
+			}
+			i++
+			continue
+		}
+
+		// Collect the run of characters that need encoding
+		var units []uint16
+		for i < len(s) && (s[i] < 0x20 || s[i] > 0x7e) {
+			r, size := utf8.DecodeRuneInString(s[i:])
+			units = append(units, utf16.Encode([]rune{r})...)
+			i += size
+		}
+		raw := make([]byte, 0, 2*len(units))
+		for _, u := range units {
+			raw = append(raw, byte(u>>8), byte(u))
+		}
+		b.WriteByte('&')
+		b.WriteString(mutf7.EncodeToString(raw))
+		b.WriteByte('-')
+	}
+	return b.String()
+}
@@ -0,0 +1,293 @@
+package jmap
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fenilsonani/email-server/internal/auth"
+	"github.com/fenilsonani/email-server/internal/storage/maildir"
+	"github.com/fenilsonani/email-server/internal/storage/metadata"
+)
+
+type testEnv struct {
+	server *Server
+	store  *maildir.Store
+	user   *auth.User
+}
+
+func setupTestServer(t *testing.T) *testEnv {
+	t.Helper()
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	db, err := metadata.Open(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := db.Migrate(ctx); err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+
+	authenticator := auth.NewAuthenticator(db.DB)
+	store, err := maildir.NewStore(db.DB, filepath.Join(dir, "maildir"))
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+
+	res, err := db.ExecContext(ctx, "INSERT INTO domains (name) VALUES ('example.com')")
+	if err != nil {
+		t.Fatalf("Failed to insert domain: %v", err)
+	}
+	domainID, _ := res.LastInsertId()
+	user, err := authenticator.CreateUser(ctx, "alice", "password123", domainID)
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	if err := store.InitializeUserMailboxes(ctx, user.ID); err != nil {
+		t.Fatalf("InitializeUserMailboxes() error = %v", err)
+	}
+
+	srv, err := NewServer(authenticator, store)
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	return &testEnv{server: srv, store: store, user: user}
+}
+
+func (e *testEnv) appendMessage(t *testing.T, mailbox, raw string) {
+	t.Helper()
+	ctx := context.Background()
+	mb, err := e.store.GetMailbox(ctx, e.user.ID, mailbox)
+	if err != nil {
+		t.Fatalf("GetMailbox(%s) error = %v", mailbox, err)
+	}
+	if _, err := e.store.AppendMessage(ctx, mb.ID, nil, time.Now(), strings.NewReader(raw)); err != nil {
+		t.Fatalf("AppendMessage() error = %v", err)
+	}
+}
+
+func (e *testEnv) mailboxID(t *testing.T, name string) string {
+	t.Helper()
+	mb, err := e.store.GetMailbox(context.Background(), e.user.ID, name)
+	if err != nil {
+		t.Fatalf("GetMailbox(%s) error = %v", name, err)
+	}
+	return mailboxJMAPID(mb.ID)
+}
+
+// call posts method calls and returns the method responses
+func (e *testEnv) call(t *testing.T, calls ...[]any) [][]json.RawMessage {
+	t.Helper()
+	body, _ := json.Marshal(map[string]any{
+		"using":       []string{capCore, capMail},
+		"methodCalls": calls,
+	})
+	req := httptest.NewRequest(http.MethodPost, "/jmap/api", bytes.NewReader(body))
+	req.SetBasicAuth("alice@example.com", "password123")
+	rec := httptest.NewRecorder()
+	e.server.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("POST /jmap/api status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+
+	var resp struct {
+		MethodResponses [][]json.RawMessage `json:"methodResponses"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	return resp.MethodResponses
+}
+
+func TestSessionRequiresAuth(t *testing.T) {
+	env := setupTestServer(t)
+
+	rec := httptest.NewRecorder()
+	env.server.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/.well-known/jmap", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("unauthenticated status = %d, want 401", rec.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/.well-known/jmap", nil)
+	req.Header.Set("Authorization", "Bearer "+base64.StdEncoding.EncodeToString([]byte("alice@example.com:password123")))
+	rec = httptest.NewRecorder()
+	env.server.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("bearer status = %d, want 200", rec.Code)
+	}
+
+	var session struct {
+		PrimaryAccounts map[string]string `json:"primaryAccounts"`
+		APIURL          string            `json:"apiUrl"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &session); err != nil {
+		t.Fatalf("Failed to decode session: %v", err)
+	}
+	if session.PrimaryAccounts[capMail] != accountID(env.user) {
+		t.Errorf("primary mail account = %q, want %q", session.PrimaryAccounts[capMail], accountID(env.user))
+	}
+	if !strings.HasSuffix(session.APIURL, "/jmap/api") {
+		t.Errorf("apiUrl = %q", session.APIURL)
+	}
+}
+
+func TestEmailQueryFiltersByMailbox(t *testing.T) {
+	env := setupTestServer(t)
+	env.appendMessage(t, "INBOX", "From: bob@example.org\r\nSubject: one\r\n\r\nbody\r\n")
+	env.appendMessage(t, "INBOX", "From: bob@example.org\r\nSubject: two\r\n\r\nbody\r\n")
+	env.appendMessage(t, "Sent", "From: alice@example.com\r\nSubject: sent\r\n\r\nbody\r\n")
+
+	inbox := env.mailboxID(t, "INBOX")
+	responses := env.call(t, []any{"Email/query", map[string]any{
+		"accountId":      accountID(env.user),
+		"filter":         map[string]any{"inMailbox": inbox},
+		"calculateTotal": true,
+	}, "q"})
+
+	var name string
+	json.Unmarshal(responses[0][0], &name)
+	if name != "Email/query" {
+		t.Fatalf("response = %s %s", responses[0][0], responses[0][1])
+	}
+	var result struct {
+		IDs   []string `json:"ids"`
+		Total int      `json:"total"`
+	}
+	json.Unmarshal(responses[0][1], &result)
+
+	if len(result.IDs) != 2 || result.Total != 2 {
+		t.Fatalf("ids = %v, total = %d, want the 2 INBOX messages", result.IDs, result.Total)
+	}
+	prefix := "e" + strings.TrimPrefix(inbox, "m") + "-"
+	for _, id := range result.IDs {
+		if !strings.HasPrefix(id, prefix) {
+			t.Errorf("id %q is not in INBOX", id)
+		}
+	}
+}
+
+func TestEmailGetReturnsStoredHeaders(t *testing.T) {
+	env := setupTestServer(t)
+	env.appendMessage(t, "INBOX", "From: Bob Smith <bob@example.org>\r\nTo: alice@example.com\r\nSubject: Quarterly report\r\nMessage-ID: <abc@example.org>\r\n\r\nbody\r\n")
+
+	// Chain Email/get to Email/query with a result reference
+	responses := env.call(t,
+		[]any{"Email/query", map[string]any{
+			"accountId": accountID(env.user),
+			"filter":    map[string]any{"inMailbox": env.mailboxID(t, "INBOX")},
+		}, "q"},
+		[]any{"Email/get", map[string]any{
+			"accountId":  accountID(env.user),
+			"#ids":       map[string]any{"resultOf": "q", "name": "Email/query", "path": "/ids"},
+			"properties": []string{"subject", "from", "messageId"},
+		}, "g"},
+	)
+
+	if len(responses) != 2 {
+		t.Fatalf("got %d responses, want 2", len(responses))
+	}
+	var result struct {
+		List []struct {
+			ID      string `json:"id"`
+			Subject string `json:"subject"`
+			From    []struct {
+				Email string `json:"email"`
+			} `json:"from"`
+			MessageID []string `json:"messageId"`
+		} `json:"list"`
+	}
+	if err := json.Unmarshal(responses[1][1], &result); err != nil {
+		t.Fatalf("Failed to decode Email/get: %v", err)
+	}
+	if len(result.List) != 1 {
+		t.Fatalf("Email/get = %s, want one email", responses[1][1])
+	}
+
+	email := result.List[0]
+	if email.Subject != "Quarterly report" {
+		t.Errorf("subject = %q, want Quarterly report", email.Subject)
+	}
+	if len(email.From) != 1 || email.From[0].Email != "bob@example.org" {
+		t.Errorf("from = %+v, want bob@example.org", email.From)
+	}
+	if len(email.MessageID) != 1 || email.MessageID[0] != "abc@example.org" {
+		t.Errorf("messageId = %v, want [abc@example.org]", email.MessageID)
+	}
+}
+
+func TestEmailGetHidesOtherAccounts(t *testing.T) {
+	env := setupTestServer(t)
+
+	responses := env.call(t, []any{"Email/get", map[string]any{
+		"accountId": "a999",
+		"ids":       []string{"e1-1"},
+	}, "g"})
+
+	var name string
+	var merr methodError
+	json.Unmarshal(responses[0][0], &name)
+	json.Unmarshal(responses[0][1], &merr)
+	if name != "error" || merr.Type != "accountNotFound" {
+		t.Errorf("response = %s %s, want accountNotFound error", responses[0][0], responses[0][1])
+	}
+}
+
+func TestEventSourceSendsStateChange(t *testing.T) {
+	env := setupTestServer(t)
+	env.server.eventPoll = 10 * time.Millisecond
+
+	// The current state comes first
+	req := httptest.NewRequest(http.MethodGet, "/jmap/eventsource/?types=Email&closeafter=state&ping=0", nil)
+	req.SetBasicAuth("alice@example.com", "password123")
+	rec := httptest.NewRecorder()
+	env.server.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("status = %d, Content-Type = %q; want a 200 event stream", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	state, _ := env.server.state(context.Background(), env.user)
+	want := fmt.Sprintf(`event: state`+"\n"+`data: {"@type":"StateChange","changed":{%q:{"Email":%q}}}`+"\n\n", accountID(env.user), state)
+	if rec.Body.String() != want {
+		t.Errorf("body = %q, want %q", rec.Body.String(), want)
+	}
+}
+
+func TestDownloadTypeIsWhitelisted(t *testing.T) {
+	env := setupTestServer(t)
+	env.appendMessage(t, "INBOX", "Subject: hi\r\n\r\n<script>alert(1)</script>\r\n")
+	responses := env.call(t, []any{"Email/query", map[string]any{"accountId": accountID(env.user)}, "q"})
+	var query struct {
+		IDs []string `json:"ids"`
+	}
+	json.Unmarshal(responses[0][1], &query)
+	if len(query.IDs) != 1 {
+		t.Fatalf("Email/query = %s, want one email", responses[0][1])
+	}
+	blob := "b" + strings.TrimPrefix(query.IDs[0], "e")
+
+	for typ, want := range map[string]string{
+		"":           "message/rfc822",
+		"text/plain": "text/plain",
+		"text/html":  "message/rfc822",
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/jmap/download/"+accountID(env.user)+"/"+blob+"/msg.eml?type="+typ, nil)
+		req.SetBasicAuth("alice@example.com", "password123")
+		rec := httptest.NewRecorder()
+		env.server.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("download status = %d, body = %s", rec.Code, rec.Body.String())
+		}
+		if got := rec.Header().Get("Content-Type"); got != want {
+			t.Errorf("type=%q served as %q, want %q", typ, got, want)
+		}
+	}
+}
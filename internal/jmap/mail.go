@@ -0,0 +1,510 @@
+package jmap
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net/http"
+	"net/mail"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fenilsonani/email-server/internal/auth"
+	"github.com/fenilsonani/email-server/internal/storage"
+)
+
+// Mailbox ids are "m<mailbox id>"; email and blob ids name the message by
+// mailbox and UID, since a message only ever lives in one mailbox.
+
+func mailboxJMAPID(id int64) string {
+	return fmt.Sprintf("m%d", id)
+}
+
+func emailJMAPID(mailboxID int64, uid uint32) string {
+	return fmt.Sprintf("e%d-%d", mailboxID, uid)
+}
+
+func blobJMAPID(mailboxID int64, uid uint32) string {
+	return fmt.Sprintf("b%d-%d", mailboxID, uid)
+}
+
+func parseMailboxID(id string) (int64, bool) {
+	rest, ok := strings.CutPrefix(id, "m")
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(rest, 10, 64)
+	return n, err == nil
+}
+
+// parseMessageID parses an email or blob id with the given prefix
+func parseMessageID(id, prefix string) (int64, uint32, bool) {
+	rest, ok := strings.CutPrefix(id, prefix)
+	if !ok {
+		return 0, 0, false
+	}
+	mb, uid, ok := strings.Cut(rest, "-")
+	if !ok {
+		return 0, 0, false
+	}
+	mailboxID, err := strconv.ParseInt(mb, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	n, err := strconv.ParseUint(uid, 10, 32)
+	if err != nil {
+		return 0, 0, false
+	}
+	return mailboxID, uint32(n), true
+}
+
+// state summarizes the user's mailboxes; it changes whenever a message is
+// added or removed
+func (s *Server) state(ctx context.Context, user *auth.User) (string, error) {
+	mailboxes, err := s.store.ListMailboxes(ctx, user.ID)
+	if err != nil {
+		return "", err
+	}
+	h := fnv.New64a()
+	for _, mb := range mailboxes {
+		stats, err := s.store.GetMailboxStats(ctx, mb.ID)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%d:%s:%d:%d:%d:%d;", mb.ID, mb.Name, stats.UIDValidity, stats.UIDNext, stats.Messages, stats.Unseen)
+	}
+	return strconv.FormatUint(h.Sum64(), 36), nil
+}
+
+// checkAccount verifies the accountId argument names the user's account
+func checkAccount(user *auth.User, id string) error {
+	if id != accountID(user) {
+		return &methodError{Type: "accountNotFound"}
+	}
+	return nil
+}
+
+type getArgs struct {
+	AccountID  string    `json:"accountId"`
+	IDs        *[]string `json:"ids"`
+	Properties []string  `json:"properties"`
+}
+
+type getResponse struct {
+	AccountID string           `json:"accountId"`
+	State     string           `json:"state"`
+	List      []map[string]any `json:"list"`
+	NotFound  []string         `json:"notFound"`
+}
+
+// pick keeps only the requested properties of obj; id is always returned
+func pick(obj map[string]any, properties []string) map[string]any {
+	if properties == nil {
+		return obj
+	}
+	out := map[string]any{"id": obj["id"]}
+	for _, p := range properties {
+		if v, ok := obj[p]; ok {
+			out[p] = v
+		}
+	}
+	return out
+}
+
+var mailboxRoles = map[storage.SpecialUse]string{
+	storage.SpecialUseDrafts:  "drafts",
+	storage.SpecialUseSent:    "sent",
+	storage.SpecialUseTrash:   "trash",
+	storage.SpecialUseJunk:    "junk",
+	storage.SpecialUseArchive: "archive",
+	storage.SpecialUseAll:     "all",
+}
+
+// mailboxGet implements Mailbox/get (RFC 8621 section 2.1)
+func (s *Server) mailboxGet(ctx context.Context, user *auth.User, raw json.RawMessage) (any, error) {
+	var args getArgs
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, invalidArguments("%v", err)
+	}
+	if err := checkAccount(user, args.AccountID); err != nil {
+		return nil, err
+	}
+
+	mailboxes, err := s.store.ListMailboxes(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	state, err := s.state(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	byName := make(map[string]*storage.Mailbox, len(mailboxes))
+	byID := make(map[string]*storage.Mailbox, len(mailboxes))
+	for _, mb := range mailboxes {
+		byName[mb.Name] = mb
+		byID[mailboxJMAPID(mb.ID)] = mb
+	}
+
+	var wanted []*storage.Mailbox
+	resp := &getResponse{AccountID: args.AccountID, State: state, List: []map[string]any{}, NotFound: []string{}}
+	if args.IDs == nil {
+		wanted = mailboxes
+	} else {
+		if len(*args.IDs) > maxObjectsInGet {
+			return nil, &methodError{Type: "requestTooLarge"}
+		}
+		for _, id := range *args.IDs {
+			if mb, ok := byID[id]; ok {
+				wanted = append(wanted, mb)
+			} else {
+				resp.NotFound = append(resp.NotFound, id)
+			}
+		}
+	}
+
+	for _, mb := range wanted {
+		stats, err := s.store.GetMailboxStats(ctx, mb.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		name := mb.Name
+		var parentID any
+		if i := strings.LastIndex(mb.Name, "/"); i >= 0 {
+			name = mb.Name[i+1:]
+			if parent, ok := byName[mb.Name[:i]]; ok {
+				parentID = mailboxJMAPID(parent.ID)
+			}
+		}
+		var role any
+		if strings.EqualFold(mb.Name, "INBOX") {
+			role = "inbox"
+		} else if r, ok := mailboxRoles[mb.SpecialUse]; ok {
+			role = r
+		}
+
+		resp.List = append(resp.List, pick(map[string]any{
+			"id":            mailboxJMAPID(mb.ID),
+			"name":          name,
+			"parentId":      parentID,
+			"role":          role,
+			"sortOrder":     0,
+			"totalEmails":   stats.Messages,
+			"unreadEmails":  stats.Unseen,
+			"totalThreads":  stats.Messages,
+			"unreadThreads": stats.Unseen,
+			"myRights": map[string]bool{
+				"mayReadItems":   true,
+				"mayAddItems":    false,
+				"mayRemoveItems": false,
+				"maySetSeen":     false,
+				"maySetKeywords": false,
+				"mayCreateChild": false,
+				"mayRename":      false,
+				"mayDelete":      false,
+				"maySubmit":      false,
+			},
+			"isSubscribed": mb.Subscribed,
+		}, args.Properties))
+	}
+	return resp, nil
+}
+
+type queryArgs struct {
+	AccountID string `json:"accountId"`
+	Filter    *struct {
+		InMailbox string     `json:"inMailbox"`
+		After     *time.Time `json:"after"`
+		Before    *time.Time `json:"before"`
+	} `json:"filter"`
+	Sort []struct {
+		Property    string `json:"property"`
+		IsAscending *bool  `json:"isAscending"`
+	} `json:"sort"`
+	Position       int  `json:"position"`
+	Limit          *int `json:"limit"`
+	CalculateTotal bool `json:"calculateTotal"`
+}
+
+// emailQuery implements Email/query (RFC 8621 section 4.4) with the
+// inMailbox, after and before filters and sorting by receivedAt
+func (s *Server) emailQuery(ctx context.Context, user *auth.User, raw json.RawMessage) (any, error) {
+	var args queryArgs
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, invalidArguments("%v", err)
+	}
+	if err := checkAccount(user, args.AccountID); err != nil {
+		return nil, err
+	}
+	if err := rejectUnknownFilter(raw); err != nil {
+		return nil, err
+	}
+
+	ascending := false
+	for _, c := range args.Sort {
+		if c.Property != "receivedAt" {
+			return nil, &methodError{Type: "unsupportedSort", Description: c.Property}
+		}
+		ascending = c.IsAscending == nil || *c.IsAscending
+	}
+	if args.Position < 0 {
+		return nil, invalidArguments("position must not be negative")
+	}
+
+	mailboxes, err := s.store.ListMailboxes(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if args.Filter != nil && args.Filter.InMailbox != "" {
+		id, ok := parseMailboxID(args.Filter.InMailbox)
+		var only []*storage.Mailbox
+		for _, mb := range mailboxes {
+			if ok && mb.ID == id {
+				only = append(only, mb)
+			}
+		}
+		mailboxes = only
+	}
+
+	var msgs []*storage.Message
+	for _, mb := range mailboxes {
+		list, err := s.store.ListMessages(ctx, mb.ID, 0, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range list {
+			if f := args.Filter; f != nil {
+				if f.After != nil && msg.InternalDate.Before(*f.After) {
+					continue
+				}
+				if f.Before != nil && !msg.InternalDate.Before(*f.Before) {
+					continue
+				}
+			}
+			msgs = append(msgs, msg)
+		}
+	}
+
+	sort.SliceStable(msgs, func(i, j int) bool {
+		if ascending {
+			return msgs[i].InternalDate.Before(msgs[j].InternalDate)
+		}
+		return msgs[j].InternalDate.Before(msgs[i].InternalDate)
+	})
+
+	state, err := s.state(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for i := args.Position; i < len(msgs); i++ {
+		if args.Limit != nil && len(ids) >= *args.Limit {
+			break
+		}
+		ids = append(ids, emailJMAPID(msgs[i].MailboxID, msgs[i].UID))
+	}
+
+	resp := map[string]any{
+		"accountId":           args.AccountID,
+		"queryState":          state,
+		"canCalculateChanges": false,
+		"position":            args.Position,
+		"ids":                 ids,
+	}
+	if args.CalculateTotal {
+		resp["total"] = len(msgs)
+	}
+	return resp, nil
+}
+
+// rejectUnknownFilter reports filter conditions emailQuery can't evaluate
+func rejectUnknownFilter(raw json.RawMessage) error {
+	var args struct {
+		Filter map[string]json.RawMessage `json:"filter"`
+	}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return invalidArguments("%v", err)
+	}
+	for key := range args.Filter {
+		switch key {
+		case "inMailbox", "after", "before":
+		default:
+			return &methodError{Type: "unsupportedFilter", Description: key}
+		}
+	}
+	return nil
+}
+
+var keywordFlags = map[storage.Flag]string{
+	storage.FlagSeen:     "$seen",
+	storage.FlagFlagged:  "$flagged",
+	storage.FlagAnswered: "$answered",
+	storage.FlagDraft:    "$draft",
+}
+
+// emailAddresses converts stored address strings to EmailAddress objects
+func emailAddresses(addrs ...string) []map[string]any {
+	out := []map[string]any{}
+	for _, a := range addrs {
+		if a == "" {
+			continue
+		}
+		parsed, err := mail.ParseAddressList(a)
+		if err != nil {
+			out = append(out, map[string]any{"name": nil, "email": a})
+			continue
+		}
+		for _, p := range parsed {
+			var name any
+			if p.Name != "" {
+				name = p.Name
+			}
+			out = append(out, map[string]any{"name": name, "email": p.Address})
+		}
+	}
+	return out
+}
+
+// emailGet implements Email/get (RFC 8621 section 4.2) for the metadata
+// properties kept in the message index
+func (s *Server) emailGet(ctx context.Context, user *auth.User, raw json.RawMessage) (any, error) {
+	var args getArgs
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, invalidArguments("%v", err)
+	}
+	if err := checkAccount(user, args.AccountID); err != nil {
+		return nil, err
+	}
+	if args.IDs == nil {
+		return nil, &methodError{Type: "requestTooLarge", Description: "ids is required"}
+	}
+	if len(*args.IDs) > maxObjectsInGet {
+		return nil, &methodError{Type: "requestTooLarge"}
+	}
+
+	state, err := s.state(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	resp := &getResponse{AccountID: args.AccountID, State: state, List: []map[string]any{}, NotFound: []string{}}
+
+	owned := make(map[int64]bool)
+	for _, id := range *args.IDs {
+		msg, ok := s.lookupMessage(ctx, user, id, "e", owned)
+		if !ok {
+			resp.NotFound = append(resp.NotFound, id)
+			continue
+		}
+
+		keywords := map[string]bool{}
+		for _, f := range msg.Flags {
+			if k, ok := keywordFlags[f]; ok {
+				keywords[k] = true
+			}
+		}
+		var messageID any
+		if msg.MessageID != "" {
+			messageID = []string{strings.Trim(msg.MessageID, "<>")}
+		}
+		var subject any
+		if msg.Subject != "" {
+			subject = msg.Subject
+		}
+
+		resp.List = append(resp.List, pick(map[string]any{
+			"id":         id,
+			"blobId":     blobJMAPID(msg.MailboxID, msg.UID),
+			"threadId":   "t" + strings.TrimPrefix(id, "e"),
+			"mailboxIds": map[string]bool{mailboxJMAPID(msg.MailboxID): true},
+			"keywords":   keywords,
+			"size":       msg.Size,
+			"receivedAt": msg.InternalDate.UTC().Format(time.RFC3339),
+			"messageId":  messageID,
+			"subject":    subject,
+			"from":       emailAddresses(msg.From),
+			"to":         emailAddresses(msg.To...),
+		}, args.Properties))
+	}
+	return resp, nil
+}
+
+// lookupMessage loads a message by email or blob id if the user owns its
+// mailbox. owned caches mailbox ownership across calls.
+func (s *Server) lookupMessage(ctx context.Context, user *auth.User, id, prefix string, owned map[int64]bool) (*storage.Message, bool) {
+	mailboxID, uid, ok := parseMessageID(id, prefix)
+	if !ok {
+		return nil, false
+	}
+	isOwner, checked := owned[mailboxID]
+	if !checked {
+		mb, err := s.store.GetMailboxByID(ctx, mailboxID)
+		isOwner = err == nil && mb.UserID == user.ID
+		owned[mailboxID] = isOwner
+	}
+	if !isOwner {
+		return nil, false
+	}
+	msg, err := s.store.GetMessage(ctx, mailboxID, uid)
+	if err != nil {
+		return nil, false
+	}
+	return msg, true
+}
+
+// downloadTypes are the Content-Types a download may be served as
+var downloadTypes = map[string]bool{
+	"message/rfc822":           true,
+	"application/octet-stream": true,
+	"text/plain":               true,
+}
+
+// handleDownload serves a message's raw RFC 5322 blob
+func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := getUserFromContext(r.Context())
+
+	// /jmap/download/{accountId}/{blobId}/{name}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/jmap/download/"), "/")
+	if len(parts) < 2 || parts[0] != accountID(user) {
+		http.NotFound(w, r)
+		return
+	}
+	msg, ok := s.lookupMessage(r.Context(), user, parts[1], "b", map[int64]bool{})
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	body, err := s.store.GetMessageBody(r.Context(), msg)
+	if err != nil {
+		log.Printf("JMAP: failed to read blob %s for %s: %v", parts[1], user.Email, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer body.Close()
+
+	// The blob is always a whole message; a client may only ask for it as
+	// one of a few types, so the URL can't make it render as HTML
+	contentType := "message/rfc822"
+	if t := r.URL.Query().Get("type"); downloadTypes[t] {
+		contentType = t
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if len(parts) > 2 && parts[2] != "" {
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", parts[2]))
+	}
+	if _, err := io.Copy(w, body); err != nil {
+		log.Printf("JMAP: failed to send blob %s: %v", parts[1], err)
+	}
+}
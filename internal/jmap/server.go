@@ -0,0 +1,599 @@
+// Package jmap serves a read-only subset of JMAP (RFC 8620) and JMAP Mail
+// (RFC 8621) on top of the mail store.
+package jmap
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fenilsonani/email-server/internal/auth"
+	"github.com/fenilsonani/email-server/internal/storage/maildir"
+)
+
+// Capability URIs
+const (
+	capCore = "urn:ietf:params:jmap:core"
+	capMail = "urn:ietf:params:jmap:mail"
+)
+
+const (
+	// Maximum request body size (10MB)
+	maxRequestSize = 10 * 1024 * 1024
+	// Maximum method calls in one request
+	maxCallsInRequest = 16
+	// Maximum ids accepted by a /get call
+	maxObjectsInGet = 500
+	// How often an event source checks whether the state changed
+	eventSourcePoll = 5 * time.Second
+)
+
+var (
+	// ErrNilAuthenticator is returned when authenticator is nil
+	ErrNilAuthenticator = errors.New("authenticator cannot be nil")
+	// ErrNilStore is returned when store is nil
+	ErrNilStore = errors.New("store cannot be nil")
+)
+
+// Server handles JMAP requests
+type Server struct {
+	authenticator *auth.Authenticator
+	store         *maildir.Store
+	mux           *http.ServeMux
+	httpServer    *http.Server
+	eventPoll     time.Duration // How often event sources look for changes
+}
+
+// NewServer creates a new JMAP server
+func NewServer(authenticator *auth.Authenticator, store *maildir.Store) (*Server, error) {
+	if authenticator == nil {
+		return nil, ErrNilAuthenticator
+	}
+	if store == nil {
+		return nil, ErrNilStore
+	}
+
+	s := &Server{
+		authenticator: authenticator,
+		store:         store,
+		mux:           http.NewServeMux(),
+		eventPoll:     eventSourcePoll,
+	}
+	s.mux.HandleFunc("/.well-known/jmap", s.handleSession)
+	s.mux.HandleFunc("/jmap/session", s.handleSession)
+	s.mux.HandleFunc("/jmap/api", s.handleAPI)
+	s.mux.HandleFunc("/jmap/download/", s.handleDownload)
+	s.mux.HandleFunc("/jmap/upload/", s.handleUpload)
+	s.mux.HandleFunc("/jmap/eventsource/", s.handleEventSource)
+	return s, nil
+}
+
+// ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.authMiddleware(s.mux).ServeHTTP(w, r)
+}
+
+// Start starts the JMAP server
+func (s *Server) Start(addr string, tlsConfig *tls.Config) error {
+	s.httpServer = &http.Server{
+		Addr:      addr,
+		Handler:   s,
+		TLSConfig: tlsConfig,
+	}
+
+	log.Printf("JMAP server starting on %s", addr)
+
+	if tlsConfig != nil {
+		return s.httpServer.ListenAndServeTLS("", "")
+	}
+	return s.httpServer.ListenAndServe()
+}
+
+// Shutdown gracefully stops the server
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.httpServer != nil {
+		return s.httpServer.Shutdown(ctx)
+	}
+	return nil
+}
+
+// authMiddleware accepts the user's mail credentials, either as HTTP Basic
+// or as a Bearer token carrying the same base64 "user:password" pair
+func (s *Server) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := credentials(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="Mail Server"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		user, err := s.authenticator.AuthenticateClient(r.Context(), username, password)
+		s.authenticator.RecordAuth("jmap", username, r.RemoteAddr, user, err)
+		if err != nil {
+			log.Printf("JMAP authentication failed for user %s from %s: %v", username, r.RemoteAddr, err)
+			w.Header().Set("WWW-Authenticate", `Basic realm="Mail Server"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), userContextKey, user)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func credentials(r *http.Request) (username, password string, ok bool) {
+	if username, password, ok = r.BasicAuth(); ok {
+		return username, password, true
+	}
+
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(token))
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
+
+type contextKey string
+
+const userContextKey contextKey = "user"
+
+func getUserFromContext(ctx context.Context) *auth.User {
+	user, _ := ctx.Value(userContextKey).(*auth.User)
+	return user
+}
+
+func accountID(user *auth.User) string {
+	return fmt.Sprintf("a%d", user.ID)
+}
+
+// handleSession serves the JMAP session resource (RFC 8620 section 2)
+func (s *Server) handleSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := getUserFromContext(r.Context())
+
+	state, err := s.state(r.Context(), user)
+	if err != nil {
+		log.Printf("JMAP: failed to compute state for %s: %v", user.Email, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Session URLs are absolute, on the host the client connected to
+	base := "https://" + r.Host
+	if r.TLS == nil {
+		base = "http://" + r.Host
+	}
+
+	id := accountID(user)
+	writeJSON(w, http.StatusOK, map[string]any{
+		"capabilities": map[string]any{
+			capCore: map[string]any{
+				"maxSizeUpload":         0,
+				"maxConcurrentUpload":   1,
+				"maxSizeRequest":        maxRequestSize,
+				"maxConcurrentRequests": 4,
+				"maxCallsInRequest":     maxCallsInRequest,
+				"maxObjectsInGet":       maxObjectsInGet,
+				"maxObjectsInSet":       0,
+				"collationAlgorithms":   []string{},
+			},
+			capMail: map[string]any{},
+		},
+		"accounts": map[string]any{
+			id: map[string]any{
+				"name":       user.Email,
+				"isPersonal": true,
+				"isReadOnly": true,
+				"accountCapabilities": map[string]any{
+					capMail: map[string]any{
+						"maxMailboxesPerEmail":       1,
+						"maxMailboxDepth":            nil,
+						"maxSizeMailboxName":         255,
+						"maxSizeAttachmentsPerEmail": 0,
+						"emailQuerySortOptions":      []string{"receivedAt"},
+						"mayCreateTopLevelMailbox":   false,
+					},
+				},
+			},
+		},
+		"primaryAccounts": map[string]string{
+			capMail: id,
+		},
+		"username":       user.Email,
+		"apiUrl":         base + "/jmap/api",
+		"downloadUrl":    base + "/jmap/download/{accountId}/{blobId}/{name}?type={type}",
+		"uploadUrl":      base + "/jmap/upload/{accountId}/",
+		"eventSourceUrl": base + "/jmap/eventsource/?types={types}&closeafter={closeafter}&ping={ping}",
+		"state":          state,
+	})
+}
+
+// request is a JMAP API request (RFC 8620 section 3.3)
+type request struct {
+	Using       []string     `json:"using"`
+	MethodCalls []invocation `json:"methodCalls"`
+}
+
+// invocation is a [name, arguments, callId] triple
+type invocation struct {
+	Name   string
+	Args   json.RawMessage
+	CallID string
+}
+
+func (inv *invocation) UnmarshalJSON(data []byte) error {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	if len(raw) != 3 {
+		return errors.New("invocation must have 3 elements")
+	}
+	if err := json.Unmarshal(raw[0], &inv.Name); err != nil {
+		return err
+	}
+	inv.Args = raw[1]
+	return json.Unmarshal(raw[2], &inv.CallID)
+}
+
+func (inv invocation) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]any{inv.Name, inv.Args, inv.CallID})
+}
+
+// methodError is a method-level error response (RFC 8620 section 3.6.2)
+type methodError struct {
+	Type        string `json:"type"`
+	Description string `json:"description,omitempty"`
+}
+
+func (e *methodError) Error() string {
+	return e.Type
+}
+
+func invalidArguments(format string, args ...any) *methodError {
+	return &methodError{Type: "invalidArguments", Description: fmt.Sprintf(format, args...)}
+}
+
+type method func(s *Server, ctx context.Context, user *auth.User, args json.RawMessage) (any, error)
+
+var methods = map[string]struct {
+	capability string
+	handler    method
+}{
+	"Core/echo":   {capCore, (*Server).coreEcho},
+	"Mailbox/get": {capMail, (*Server).mailboxGet},
+	"Email/query": {capMail, (*Server).emailQuery},
+	"Email/get":   {capMail, (*Server).emailGet},
+}
+
+// handleAPI processes a batch of method calls (RFC 8620 section 3)
+func (s *Server) handleAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := getUserFromContext(r.Context())
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRequestSize+1))
+	if err != nil {
+		writeProblem(w, "urn:ietf:params:jmap:error:notRequest", "failed to read request body")
+		return
+	}
+	if len(body) > maxRequestSize {
+		writeProblem(w, "urn:ietf:params:jmap:error:limit", "request too large")
+		return
+	}
+
+	var req request
+	if err := json.Unmarshal(body, &req); err != nil || req.MethodCalls == nil {
+		writeProblem(w, "urn:ietf:params:jmap:error:notRequest", "request is not a valid JMAP request")
+		return
+	}
+	if len(req.MethodCalls) > maxCallsInRequest {
+		writeProblem(w, "urn:ietf:params:jmap:error:limit", "too many method calls")
+		return
+	}
+	using := make(map[string]bool, len(req.Using))
+	for _, c := range req.Using {
+		if c != capCore && c != capMail {
+			writeProblem(w, "urn:ietf:params:jmap:error:unknownCapability", fmt.Sprintf("unknown capability %q", c))
+			return
+		}
+		using[c] = true
+	}
+
+	responses := make([]invocation, 0, len(req.MethodCalls))
+	for _, call := range req.MethodCalls {
+		responses = append(responses, s.call(r.Context(), user, using, call, responses))
+	}
+
+	state, err := s.state(r.Context(), user)
+	if err != nil {
+		log.Printf("JMAP: failed to compute state for %s: %v", user.Email, err)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"methodResponses": responses,
+		"sessionState":    state,
+	})
+}
+
+// call runs one method call, returning its response or error invocation
+func (s *Server) call(ctx context.Context, user *auth.User, using map[string]bool, call invocation, previous []invocation) invocation {
+	fail := func(err *methodError) invocation {
+		data, _ := json.Marshal(err)
+		return invocation{Name: "error", Args: data, CallID: call.CallID}
+	}
+
+	m, ok := methods[call.Name]
+	if !ok {
+		return fail(&methodError{Type: "unknownMethod"})
+	}
+	if !using[m.capability] {
+		return fail(&methodError{Type: "unknownMethod", Description: m.capability + " not in using"})
+	}
+
+	args, err := resolveReferences(call.Args, previous)
+	if err != nil {
+		return fail(err)
+	}
+
+	result, herr := m.handler(s, ctx, user, args)
+	if herr != nil {
+		var merr *methodError
+		if errors.As(herr, &merr) {
+			return fail(merr)
+		}
+		log.Printf("JMAP: %s failed for %s: %v", call.Name, user.Email, herr)
+		return fail(&methodError{Type: "serverFail"})
+	}
+
+	data, jerr := json.Marshal(result)
+	if jerr != nil {
+		return fail(&methodError{Type: "serverFail"})
+	}
+	return invocation{Name: call.Name, Args: data, CallID: call.CallID}
+}
+
+// resultReference points into an earlier response (RFC 8620 section 3.7)
+type resultReference struct {
+	ResultOf string `json:"resultOf"`
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+}
+
+// resolveReferences replaces "#name" arguments with the values they reference
+func resolveReferences(args json.RawMessage, previous []invocation) (json.RawMessage, *methodError) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(args, &fields); err != nil {
+		return nil, invalidArguments("arguments must be an object")
+	}
+
+	changed := false
+	for key, value := range fields {
+		name, ok := strings.CutPrefix(key, "#")
+		if !ok {
+			continue
+		}
+		if _, dup := fields[name]; dup {
+			return nil, invalidArguments("both %s and #%s given", name, name)
+		}
+
+		var ref resultReference
+		if err := json.Unmarshal(value, &ref); err != nil {
+			return nil, &methodError{Type: "invalidResultReference"}
+		}
+		resolved, ok := lookupReference(ref, previous)
+		if !ok {
+			return nil, &methodError{Type: "invalidResultReference"}
+		}
+		delete(fields, key)
+		fields[name] = resolved
+		changed = true
+	}
+
+	if !changed {
+		return args, nil
+	}
+	data, _ := json.Marshal(fields)
+	return data, nil
+}
+
+func lookupReference(ref resultReference, previous []invocation) (json.RawMessage, bool) {
+	for _, inv := range previous {
+		if inv.CallID != ref.ResultOf {
+			continue
+		}
+		if inv.Name != ref.Name {
+			return nil, false
+		}
+		var value any
+		if err := json.Unmarshal(inv.Args, &value); err != nil {
+			return nil, false
+		}
+		value, ok := evalPointer(value, ref.Path)
+		if !ok {
+			return nil, false
+		}
+		data, err := json.Marshal(value)
+		return data, err == nil
+	}
+	return nil, false
+}
+
+// evalPointer evaluates a JSON pointer with the JMAP "*" extension
+func evalPointer(value any, path string) (any, bool) {
+	if path == "" {
+		return value, true
+	}
+	if !strings.HasPrefix(path, "/") {
+		return nil, false
+	}
+	return evalTokens(value, strings.Split(path[1:], "/"))
+}
+
+func evalTokens(value any, tokens []string) (any, bool) {
+	if len(tokens) == 0 {
+		return value, true
+	}
+	token := strings.ReplaceAll(strings.ReplaceAll(tokens[0], "~1", "/"), "~0", "~")
+
+	switch v := value.(type) {
+	case map[string]any:
+		child, ok := v[token]
+		if !ok {
+			return nil, false
+		}
+		return evalTokens(child, tokens[1:])
+	case []any:
+		if token != "*" {
+			i, err := strconv.Atoi(token)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			return evalTokens(v[i], tokens[1:])
+		}
+		// Map the rest of the path over every element, flattening arrays
+		out := []any{}
+		for _, item := range v {
+			child, ok := evalTokens(item, tokens[1:])
+			if !ok {
+				return nil, false
+			}
+			if list, isList := child.([]any); isList {
+				out = append(out, list...)
+			} else {
+				out = append(out, child)
+			}
+		}
+		return out, true
+	}
+	return nil, false
+}
+
+func (s *Server) coreEcho(ctx context.Context, user *auth.User, args json.RawMessage) (any, error) {
+	return args, nil
+}
+
+// handleUpload rejects uploads; accounts are read-only
+func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "Uploads are not supported", http.StatusForbidden)
+}
+
+// handleEventSource pushes StateChange events (RFC 8620 section 7.3) as
+// text/event-stream. The state is polled, so a change is seen within
+// s.eventPoll. The current state is sent first.
+func (s *Server) handleEventSource(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := getUserFromContext(r.Context())
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	query := r.URL.Query()
+	var types []string
+	for _, t := range strings.Split(query.Get("types"), ",") {
+		switch t {
+		case "*", "":
+			types = []string{"Mailbox", "Email"}
+		case "Mailbox", "Email":
+			types = append(types, t)
+		}
+	}
+	closeAfter := query.Get("closeafter") == "state"
+	var ping time.Duration
+	if n, err := strconv.Atoi(query.Get("ping")); err == nil && n > 0 {
+		// The server may raise the interval; one ping in 30s is plenty
+		ping = time.Duration(max(n, 30)) * time.Second
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	poll := time.NewTicker(s.eventPoll)
+	defer poll.Stop()
+	var pings <-chan time.Time
+	if ping > 0 {
+		pinger := time.NewTicker(ping)
+		defer pinger.Stop()
+		pings = pinger.C
+	}
+
+	last := ""
+	for {
+		state, err := s.state(r.Context(), user)
+		if err != nil {
+			if r.Context().Err() == nil {
+				log.Printf("JMAP: failed to compute state for %s: %v", user.Email, err)
+			}
+			return
+		}
+		if state != last {
+			last = state
+			changed := make(map[string]string, len(types))
+			for _, t := range types {
+				changed[t] = state
+			}
+			data, _ := json.Marshal(map[string]any{
+				"@type":   "StateChange",
+				"changed": map[string]any{accountID(user): changed},
+			})
+			fmt.Fprintf(w, "event: state\ndata: %s\n\n", data)
+			flusher.Flush()
+			if closeAfter {
+				return
+			}
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-pings:
+			fmt.Fprintf(w, "event: ping\ndata: {\"interval\":%d}\n\n", int(ping/time.Second))
+			flusher.Flush()
+		case <-poll.C:
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("JMAP: failed to write response: %v", err)
+	}
+}
+
+// writeProblem writes a request-level error (RFC 7807)
+func writeProblem(w http.ResponseWriter, problemType, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]any{
+		"type":   problemType,
+		"status": http.StatusBadRequest,
+		"detail": detail,
+	})
+}
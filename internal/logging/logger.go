@@ -3,6 +3,7 @@ package logging
 
 import (
 	"context"
+	"crypto/tls"
 	"io"
 	"log/slog"
 	"os"
@@ -21,6 +22,7 @@ const (
 	protocolKey  contextKey = "protocol"
 	messageIDKey contextKey = "message_id"
 	mailboxKey   contextKey = "mailbox"
+	tlsKey       contextKey = "tls"
 )
 
 // Logger wraps slog with email-server-specific functionality.
@@ -149,6 +151,25 @@ func WithMailbox(ctx context.Context, mailbox string) context.Context {
 	return context.WithValue(ctx, mailboxKey, mailbox)
 }
 
+// tlsInfo is the negotiated TLS version and cipher of a connection
+type tlsInfo struct {
+	version string
+	cipher  string
+}
+
+// WithTLS returns a new context with the TLS version and cipher suite of a
+// connection. It returns ctx unchanged for a nil state or one whose
+// handshake hasn't completed.
+func WithTLS(ctx context.Context, state *tls.ConnectionState) context.Context {
+	if state == nil || !state.HandshakeComplete {
+		return ctx
+	}
+	return context.WithValue(ctx, tlsKey, tlsInfo{
+		version: tls.VersionName(state.Version),
+		cipher:  tls.CipherSuiteName(state.CipherSuite),
+	})
+}
+
 // extractContextAttrs extracts logging attributes from context.
 func extractContextAttrs(ctx context.Context) []slog.Attr {
 	var attrs []slog.Attr
@@ -171,6 +192,10 @@ func extractContextAttrs(ctx context.Context) []slog.Attr {
 	if v := ctx.Value(mailboxKey); v != nil {
 		attrs = append(attrs, slog.String("mailbox", v.(string)))
 	}
+	if v := ctx.Value(tlsKey); v != nil {
+		info := v.(tlsInfo)
+		attrs = append(attrs, slog.String("tls_version", info.version), slog.String("tls_cipher", info.cipher))
+	}
 
 	return attrs
 }
@@ -3,6 +3,7 @@ package logging
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"log/slog"
@@ -383,6 +384,35 @@ func TestExtractContextAttrs(t *testing.T) {
 	})
 }
 
+func TestWithTLS(t *testing.T) {
+	var buf bytes.Buffer
+	logger := &Logger{
+		Logger: slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{
+			Level: slog.LevelInfo,
+		})),
+	}
+
+	state := &tls.ConnectionState{
+		HandshakeComplete: true,
+		Version:           tls.VersionTLS13,
+		CipherSuite:       tls.TLS_AES_128_GCM_SHA256,
+	}
+	logger.InfoContext(WithTLS(context.Background(), state), "connected")
+
+	output := buf.String()
+	if !strings.Contains(output, `"tls_version":"TLS 1.3"`) || !strings.Contains(output, `"tls_cipher":"TLS_AES_128_GCM_SHA256"`) {
+		t.Errorf("Log output should contain the TLS version and cipher, got: %s", output)
+	}
+
+	// Nothing is recorded before the handshake or without TLS
+	if attrs := extractContextAttrs(WithTLS(context.Background(), &tls.ConnectionState{})); len(attrs) != 0 {
+		t.Errorf("Expected 0 attrs before the handshake, got %d", len(attrs))
+	}
+	if attrs := extractContextAttrs(WithTLS(context.Background(), nil)); len(attrs) != 0 {
+		t.Errorf("Expected 0 attrs without TLS, got %d", len(attrs))
+	}
+}
+
 func TestLogger_Caller(t *testing.T) {
 	logger := Default()
 	withCaller := logger.Caller()
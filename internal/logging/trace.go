@@ -0,0 +1,251 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxTraceLine is how much of a line a trace logs
+const maxTraceLine = 1000
+
+// Tracer selects the IMAP and SMTP connections whose protocol exchange is
+// logged line by line at debug level, for debugging a client without a
+// packet capture. A connection is traced when it comes from one of the
+// traced networks, or once a traced user has logged in on it. Tracing
+// stops altogether at the deadline, so a forgotten trace doesn't go on
+// filling the logs.
+type Tracer struct {
+	logger *Logger
+	nets   []*net.IPNet
+	users  map[string]bool
+	until  time.Time
+}
+
+// NewTracer returns a Tracer for connections from ips, each an address or
+// CIDR, and of users, that traces until the given time. It returns nil,
+// which traces nothing, when there are neither.
+func NewTracer(logger *Logger, ips, users []string, until time.Time) (*Tracer, error) {
+	if len(ips) == 0 && len(users) == 0 {
+		return nil, nil
+	}
+	t := &Tracer{logger: logger, users: make(map[string]bool, len(users)), until: until}
+	for _, s := range ips {
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", s)
+			}
+			bits := 8 * len(ip.To4())
+			if bits == 0 {
+				bits = 128
+			}
+			ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		}
+		t.nets = append(t.nets, ipNet)
+	}
+	for _, u := range users {
+		t.users[strings.ToLower(u)] = true
+	}
+	return t, nil
+}
+
+// expired reports whether the tracer has stopped tracing
+func (t *Tracer) expired() bool {
+	return t == nil || !time.Now().Before(t.until)
+}
+
+func (t *Tracer) tracesIP(ip net.IP) bool {
+	for _, n := range t.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// A TraceFilter sees every line of a traced connection, in order, without
+// its line ending. It returns the text to log, with credentials removed,
+// or "" to log nothing. skip is a number of bytes that follow the line
+// without being logged, such as a literal; a negative skip ends the trace
+// because the rest of the stream can't be read, as after STARTTLS.
+type TraceFilter func(fromClient bool, line string) (text string, skip int64)
+
+// Start begins a trace of a connection from remote. A nil filter logs
+// every line as it is, for callers that record only what may be logged.
+// It returns nil, which traces nothing, when the connection can't match:
+// tracing has stopped, or the client isn't traced and no user is.
+func (t *Tracer) Start(protocol string, remote net.Addr, filter TraceFilter) *Trace {
+	if t.expired() {
+		return nil
+	}
+	var ip net.IP
+	if addr, ok := remote.(*net.TCPAddr); ok {
+		ip = addr.IP
+	}
+	traced := ip != nil && t.tracesIP(ip)
+	if !traced && len(t.users) == 0 {
+		return nil
+	}
+	return &Trace{
+		tracer: t,
+		ctx:    WithProtocol(WithRemoteAddr(context.Background(), remote.String()), protocol),
+		filter: filter,
+		traced: traced,
+	}
+}
+
+// Trace logs the lines exchanged on one connection. A nil *Trace is valid
+// and logs nothing.
+type Trace struct {
+	tracer *Tracer
+	ctx    context.Context
+	filter TraceFilter
+
+	mu      sync.Mutex
+	traced  bool // The client or its user is traced
+	user    string
+	stopped bool
+	client  traceStream
+	server  traceStream
+}
+
+// traceStream is the state of one direction of a traced connection
+type traceStream struct {
+	line      []byte
+	truncated bool
+	skip      int64
+}
+
+// SetUser records the user who logged in on the connection, which starts
+// the trace if they are traced
+func (t *Trace) SetUser(email string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.user = email
+	t.traced = t.traced || t.tracer.users[strings.ToLower(email)]
+}
+
+// Client records data the client sent
+func (t *Trace) Client(p []byte) {
+	t.record(true, false, p)
+}
+
+// Server records data sent to the client
+func (t *Trace) Server(p []byte) {
+	t.record(false, false, p)
+}
+
+// SynthesizedServer records a reply the caller rebuilt rather than read
+// off the connection. Its lines are logged marked synthesized, as they
+// may differ from what the client was sent.
+func (t *Trace) SynthesizedServer(p []byte) {
+	t.record(false, true, p)
+}
+
+func (t *Trace) record(fromClient, synthesized bool, p []byte) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopped {
+		return
+	}
+	if t.tracer.expired() {
+		t.stopped = true
+		return
+	}
+
+	s := &t.server
+	if fromClient {
+		s = &t.client
+	}
+	for len(p) > 0 {
+		if s.skip > 0 {
+			n := min(s.skip, int64(len(p)))
+			s.skip -= n
+			p = p[n:]
+			continue
+		}
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			s.append(p)
+			return
+		}
+		s.append(p[:i])
+		p = p[i+1:]
+
+		line := strings.TrimSuffix(string(s.line), "\r")
+		truncated := s.truncated
+		s.line, s.truncated = s.line[:0], false
+
+		text, skip := line, int64(0)
+		if t.filter != nil {
+			text, skip = t.filter(fromClient, line)
+		}
+		if text != "" && t.traced {
+			if truncated {
+				text += "..."
+			}
+			t.log(fromClient, synthesized, text)
+		}
+		if skip < 0 {
+			t.stopped = true
+			return
+		}
+		s.skip = skip
+	}
+}
+
+// append adds to the current line, keeping at most maxTraceLine bytes
+func (s *traceStream) append(p []byte) {
+	if room := maxTraceLine - len(s.line); len(p) > room {
+		p = p[:max(room, 0)]
+		s.truncated = true
+	}
+	s.line = append(s.line, p...)
+}
+
+func (t *Trace) log(fromClient, synthesized bool, text string) {
+	direction := "server"
+	if fromClient {
+		direction = "client"
+	}
+	args := []any{"direction", direction, "line", text}
+	if synthesized {
+		args = append(args, "synthesized", true)
+	}
+	if t.user != "" {
+		args = append(args, "user", t.user)
+	}
+	t.tracer.logger.DebugContext(t.ctx, "Protocol trace", args...)
+}
+
+// Reader returns r, recording what is read from it as client data
+func (t *Trace) Reader(r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+	return &traceReader{Reader: r, trace: t}
+}
+
+type traceReader struct {
+	io.Reader
+	trace *Trace
+}
+
+func (r *traceReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.trace.Client(p[:n])
+	return n, err
+}
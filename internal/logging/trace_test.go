@@ -0,0 +1,114 @@
+package logging
+
+import (
+	"bytes"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTraceTestLogger() (*Logger, *bytes.Buffer) {
+	var buf bytes.Buffer
+	return &Logger{Logger: slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))}, &buf
+}
+
+// passFilter logs every line as it is
+func passFilter(fromClient bool, line string) (string, int64) {
+	return line, 0
+}
+
+func TestTracerSelectsConnections(t *testing.T) {
+	logger, buf := newTraceTestLogger()
+	tracer, err := NewTracer(logger, []string{"192.0.2.0/24", "2001:db8::1"}, []string{"Alice@example.com"}, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("NewTracer() error = %v", err)
+	}
+
+	traced := tracer.Start("smtp", &net.TCPAddr{IP: net.ParseIP("192.0.2.7"), Port: 1025}, nil)
+	traced.Client([]byte("EHLO client.example\r\nMAIL FROM:<a@exa"))
+	traced.Server([]byte("250 OK\r\n"))
+	out := buf.String()
+	for _, want := range []string{`line="EHLO client.example"`, `direction=server line="250 OK"`, "remote_addr=192.0.2.7:1025", "protocol=smtp"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("trace = %q, missing %s", out, want)
+		}
+	}
+	if strings.Contains(out, "MAIL FROM") {
+		t.Errorf("trace = %q, logged an unfinished line", out)
+	}
+	if strings.Contains(out, "synthesized") {
+		t.Errorf("trace = %q, marked a reply read off the connection synthesized", out)
+	}
+	buf.Reset()
+	traced.SynthesizedServer([]byte("250 OK: queued\r\n"))
+	if out := buf.String(); !strings.Contains(out, `direction=server line="250 OK: queued" synthesized=true`) {
+		t.Errorf("trace = %q, want the rebuilt reply marked synthesized", out)
+	}
+
+	// Another client is traced only once a traced user logs in
+	buf.Reset()
+	other := tracer.Start("imap", &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 1143}, passFilter)
+	other.Client([]byte("a1 LOGIN alice@example.com secret\r\n"))
+	if buf.Len() != 0 {
+		t.Errorf("untraced client logged %q", buf.String())
+	}
+	other.SetUser("alice@example.com")
+	other.Client([]byte("a2 SELECT INBOX\r\n"))
+	if out := buf.String(); !strings.Contains(out, `line="a2 SELECT INBOX"`) || !strings.Contains(out, "user=alice@example.com") {
+		t.Errorf("trace after login = %q, want the SELECT", out)
+	}
+
+	// Without user rules, a client that isn't traced isn't followed at all
+	ipOnly, _ := NewTracer(logger, []string{"192.0.2.7"}, nil, time.Now().Add(time.Hour))
+	if tr := ipOnly.Start("smtp", &net.TCPAddr{IP: net.ParseIP("192.0.2.8")}, passFilter); tr != nil {
+		t.Errorf("Start() for an untraced client = %v, want nil", tr)
+	}
+	if tr, _ := NewTracer(logger, nil, nil, time.Now().Add(time.Hour)); tr != nil {
+		t.Errorf("NewTracer() with no rules = %v, want nil", tr)
+	}
+}
+
+func TestTraceExpires(t *testing.T) {
+	logger, buf := newTraceTestLogger()
+	tracer, _ := NewTracer(logger, []string{"192.0.2.7"}, nil, time.Now().Add(-time.Second))
+	if tr := tracer.Start("smtp", &net.TCPAddr{IP: net.ParseIP("192.0.2.7")}, passFilter); tr != nil {
+		t.Errorf("Start() after the deadline = %v, want nil", tr)
+	}
+
+	tracer.until = time.Now().Add(time.Hour)
+	tr := tracer.Start("smtp", &net.TCPAddr{IP: net.ParseIP("192.0.2.7")}, passFilter)
+	tracer.until = time.Now()
+	tr.Client([]byte("EHLO client.example\r\n"))
+	if buf.Len() != 0 {
+		t.Errorf("trace after the deadline logged %q", buf.String())
+	}
+}
+
+func TestTraceFilterSkipsAndStops(t *testing.T) {
+	logger, buf := newTraceTestLogger()
+	tracer, _ := NewTracer(logger, []string{"192.0.2.7"}, nil, time.Now().Add(time.Hour))
+	tr := tracer.Start("imap", &net.TCPAddr{IP: net.ParseIP("192.0.2.7")}, func(fromClient bool, line string) (string, int64) {
+		switch {
+		case strings.HasSuffix(line, "{5}"):
+			return line, 5
+		case line == "a2 STARTTLS":
+			return line, -1
+		}
+		return line, 0
+	})
+
+	tr.Client([]byte("a1 APPEND INBOX {5}\r\nhel"))
+	tr.Client([]byte("lo\r\n" + strings.Repeat("x", 2*maxTraceLine) + "\r\na2 STARTTLS\r\n\x16\x03\x01\r\n"))
+	out := buf.String()
+	if strings.Contains(out, "hello") || strings.Contains(out, "\\x16") {
+		t.Errorf("trace = %q, logged skipped data", out)
+	}
+	if !strings.Contains(out, strings.Repeat("x", maxTraceLine)+"...") || strings.Contains(out, strings.Repeat("x", maxTraceLine+1)) {
+		t.Errorf("trace = %q, want the long line cut at %d bytes", out, maxTraceLine)
+	}
+	if !strings.Contains(out, `line="a2 STARTTLS"`) {
+		t.Errorf("trace = %q, want the line that ended it", out)
+	}
+}
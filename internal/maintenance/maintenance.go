@@ -0,0 +1,132 @@
+package maintenance
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/fenilsonani/email-server/internal/auth"
+	"github.com/fenilsonani/email-server/internal/smtp/delivery"
+	"github.com/fenilsonani/email-server/internal/storage/maildir"
+	"github.com/fenilsonani/email-server/internal/storage/metadata"
+)
+
+// StaleTmpAge is how old a file in a maildir's tmp directory must be before
+// it is taken to be left over from a failed append
+const StaleTmpAge = 24 * time.Hour
+
+// SentEmailRetention is how long a VERP send is kept for bounces to be
+// matched to it. Bounces come within days; this leaves room for slow ones.
+const SentEmailRetention = 30 * 24 * time.Hour
+
+// DeliveryAttemptRetention is how long the attempts the admin panel's
+// delivery timeline shows are kept
+const DeliveryAttemptRetention = 30 * 24 * time.Hour
+
+// AuthLogRetention is how long login attempts are kept for the admin
+// panel's auth log
+const AuthLogRetention = 90 * 24 * time.Hour
+
+// Report summarizes a maintenance run
+type Report struct {
+	DatabaseReclaimed int64         // Bytes VACUUM freed from the database
+	TmpFiles          int           // Stale files removed from maildir tmp directories
+	TmpReclaimed      int64         // Total size of those files
+	SentEmailsPruned  int64         // Sends older than SentEmailRetention removed
+	AttemptsPruned    int64         // Delivery attempts older than DeliveryAttemptRetention removed
+	AuthLogPruned     int64         // Login attempts older than AuthLogRetention removed
+	Duration          time.Duration // How long the run took
+}
+
+// Run prunes stale maildir tmp files, old sent email records, delivery
+// attempts and login attempts, and then vacuums the database
+func Run(ctx context.Context, db *metadata.DB, store *maildir.Store) (*Report, error) {
+	start := time.Now()
+	report := &Report{}
+
+	var err error
+	report.TmpFiles, report.TmpReclaimed, err = store.PruneTmp(ctx, StaleTmpAge)
+	if err != nil {
+		return report, fmt.Errorf("failed to prune maildir tmp: %w", err)
+	}
+
+	report.SentEmailsPruned, err = delivery.NewSentLog(db.DB).Prune(ctx, time.Now().Add(-SentEmailRetention))
+	if err != nil {
+		return report, err
+	}
+
+	report.AttemptsPruned, err = delivery.NewAttemptLog(db.DB).Prune(ctx, time.Now().Add(-DeliveryAttemptRetention))
+	if err != nil {
+		return report, err
+	}
+
+	report.AuthLogPruned, err = auth.PruneAuthLog(ctx, db.DB, time.Now().Add(-AuthLogRetention))
+	if err != nil {
+		return report, err
+	}
+
+	report.DatabaseReclaimed, err = db.Vacuum(ctx)
+	if err != nil {
+		return report, err
+	}
+
+	report.Duration = time.Since(start)
+	return report, nil
+}
+
+// Scheduler runs maintenance in the background at a fixed interval
+type Scheduler struct {
+	db       *metadata.DB
+	store    *maildir.Store
+	interval time.Duration
+	onRun    func(*Report, error)
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewScheduler creates a scheduler that runs maintenance every interval
+// and passes each result to onRun
+func NewScheduler(db *metadata.DB, store *maildir.Store, interval time.Duration, onRun func(*Report, error)) *Scheduler {
+	return &Scheduler{
+		db:       db,
+		store:    store,
+		interval: interval,
+		onRun:    onRun,
+	}
+}
+
+// Start runs maintenance in the background until Stop is called. The first
+// run is one interval after Start, so a restart doesn't vacuum at once.
+func (s *Scheduler) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				report, err := Run(ctx, s.db, s.store)
+				if s.onRun != nil {
+					s.onRun(report, err)
+				}
+			}
+		}
+	}()
+}
+
+// Stop stops the scheduler, interrupting a run in progress
+func (s *Scheduler) Stop() {
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.wg.Wait()
+}
@@ -0,0 +1,209 @@
+package maintenance
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fenilsonani/email-server/internal/smtp/delivery"
+	"github.com/fenilsonani/email-server/internal/storage/maildir"
+	"github.com/fenilsonani/email-server/internal/storage/metadata"
+)
+
+// setupTestStore returns a migrated database and a maildir store under
+// the returned directory, with one user whose ID is 1
+func setupTestStore(t *testing.T) (*metadata.DB, *maildir.Store, string) {
+	t.Helper()
+	dir := t.TempDir()
+
+	db, err := metadata.Open(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := db.Migrate(context.Background()); err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+	if _, err := db.Exec(`
+		INSERT INTO domains (id, name) VALUES (1, 'example.com');
+		INSERT INTO users (id, domain_id, username, password_hash) VALUES (1, 1, 'alice', 'hash');
+	`); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+
+	store, err := maildir.NewStore(db.DB, filepath.Join(dir, "maildir"))
+	if err != nil {
+		t.Fatalf("NewStore() error = %v", err)
+	}
+	return db, store, filepath.Join(dir, "maildir")
+}
+
+func TestRunPrunesStaleTmpFiles(t *testing.T) {
+	db, store, base := setupTestStore(t)
+	ctx := context.Background()
+
+	// A mailbox named tmp is a maildir of its own, not a tmp directory
+	for _, name := range []string{"INBOX", "tmp"} {
+		if _, err := store.CreateMailbox(ctx, 1, name, ""); err != nil {
+			t.Fatalf("CreateMailbox(%s) error = %v", name, err)
+		}
+	}
+	var stale, fresh []string
+	for _, name := range []string{"INBOX", "tmp"} {
+		tmp := filepath.Join(base, "user_1", name, "tmp")
+		old := filepath.Join(tmp, "crashed.append")
+		if err := os.WriteFile(old, []byte("partial"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		when := time.Now().Add(-2 * StaleTmpAge)
+		if err := os.Chtimes(old, when, when); err != nil {
+			t.Fatal(err)
+		}
+		recent := filepath.Join(tmp, "in-progress.append")
+		if err := os.WriteFile(recent, []byte("writing"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		stale, fresh = append(stale, old), append(fresh, recent)
+	}
+
+	report, err := Run(ctx, db, store)
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if report.TmpFiles != 2 || report.TmpReclaimed != int64(2*len("partial")) {
+		t.Errorf("report = %+v, want 2 tmp files of %d bytes", report, 2*len("partial"))
+	}
+	for _, path := range stale {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("stale %s still exists", path)
+		}
+	}
+	for _, path := range fresh {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("recent %s was removed: %v", path, err)
+		}
+	}
+}
+
+func TestRunPrunesOldSentEmails(t *testing.T) {
+	db, store, _ := setupTestStore(t)
+	ctx := context.Background()
+
+	for _, age := range []time.Duration{2 * SentEmailRetention, time.Hour} {
+		if _, err := db.Exec(
+			"INSERT INTO sent_emails (message_id, sender, recipient, return_path, sent_at) VALUES ('m', 'a@example.com', 'b@example.org', 'a@example.com', ?)",
+			time.Now().Add(-age).UTC(),
+		); err != nil {
+			t.Fatalf("Failed to insert sent email: %v", err)
+		}
+	}
+
+	report, err := Run(ctx, db, store)
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	var left int
+	db.QueryRow("SELECT COUNT(*) FROM sent_emails").Scan(&left)
+	if report.SentEmailsPruned != 1 || left != 1 {
+		t.Errorf("SentEmailsPruned = %d with %d left, want 1 and 1", report.SentEmailsPruned, left)
+	}
+}
+
+func TestRunPrunesOldDeliveryAttempts(t *testing.T) {
+	db, store, _ := setupTestStore(t)
+	ctx := context.Background()
+
+	attempts := delivery.NewAttemptLog(db.DB)
+	for _, age := range []time.Duration{2 * DeliveryAttemptRetention, time.Hour} {
+		if err := attempts.Record(ctx, &delivery.Attempt{MessageID: "m", Host: "mx.example.org", CreatedAt: time.Now().Add(-age)}); err != nil {
+			t.Fatalf("Failed to record attempt: %v", err)
+		}
+	}
+
+	report, err := Run(ctx, db, store)
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	left, _ := attempts.List(ctx, "m")
+	if report.AttemptsPruned != 1 || len(left) != 1 {
+		t.Errorf("AttemptsPruned = %d with %d left, want 1 and 1", report.AttemptsPruned, len(left))
+	}
+}
+
+func TestRunPrunesOldAuthLog(t *testing.T) {
+	db, store, _ := setupTestStore(t)
+	ctx := context.Background()
+
+	for _, age := range []time.Duration{2 * AuthLogRetention, time.Hour} {
+		if _, err := db.Exec(
+			"INSERT INTO auth_log (username, protocol, success, created_at) VALUES ('alice@example.com', 'imap', 1, ?)",
+			time.Now().Add(-age).UTC().Format(time.DateTime),
+		); err != nil {
+			t.Fatalf("Failed to insert auth log entry: %v", err)
+		}
+	}
+
+	report, err := Run(ctx, db, store)
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	var left int
+	db.QueryRow("SELECT COUNT(*) FROM auth_log").Scan(&left)
+	if report.AuthLogPruned != 1 || left != 1 {
+		t.Errorf("AuthLogPruned = %d with %d left, want 1 and 1", report.AuthLogPruned, left)
+	}
+}
+
+func TestRunVacuumKeepsData(t *testing.T) {
+	db, store, _ := setupTestStore(t)
+	ctx := context.Background()
+
+	mb, err := store.CreateMailbox(ctx, 1, "INBOX", "")
+	if err != nil {
+		t.Fatalf("CreateMailbox() error = %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := store.AppendMessage(ctx, mb.ID, nil, time.Now(), strings.NewReader("Subject: kept\r\n\r\nbody\r\n")); err != nil {
+			t.Fatalf("AppendMessage() error = %v", err)
+		}
+	}
+
+	// Leave free pages behind for VACUUM to reclaim
+	padding := strings.Repeat("x", 4096)
+	for i := 0; i < 200; i++ {
+		if _, err := db.Exec("INSERT INTO delivery_log (sender, recipient, status, error_message) VALUES ('a', 'b', 'bounced', ?)", padding); err != nil {
+			t.Fatalf("Failed to insert delivery log: %v", err)
+		}
+	}
+	if _, err := db.Exec("DELETE FROM delivery_log"); err != nil {
+		t.Fatalf("Failed to delete delivery log: %v", err)
+	}
+
+	report, err := Run(ctx, db, store)
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if report.DatabaseReclaimed <= 0 {
+		t.Errorf("DatabaseReclaimed = %d, want > 0", report.DatabaseReclaimed)
+	}
+
+	var integrity string
+	if err := db.QueryRow("PRAGMA integrity_check").Scan(&integrity); err != nil || integrity != "ok" {
+		t.Fatalf("integrity_check = %q, %v; want ok", integrity, err)
+	}
+	msgs, err := store.ListMessages(ctx, mb.ID, 0, 0)
+	if err != nil {
+		t.Fatalf("ListMessages() error = %v", err)
+	}
+	if len(msgs) != 3 {
+		t.Fatalf("len(messages) = %d, want 3", len(msgs))
+	}
+	for _, msg := range msgs {
+		if msg.Subject != "kept" {
+			t.Errorf("message %d subject = %q, want kept", msg.UID, msg.Subject)
+		}
+	}
+}
@@ -97,6 +97,27 @@ var (
 		Help: "Server uptime in seconds",
 	})
 
+	DiskFreeBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mailserver_disk_free_bytes",
+		Help: "Free bytes available on monitored storage paths",
+	}, []string{"path"})
+
+	DiskFreeInodes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mailserver_disk_free_inodes",
+		Help: "Free inodes available on monitored storage paths",
+	}, []string{"path"})
+
+	// DNS Metrics
+	DNSRecordPassing = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mailserver_dns_record_passing",
+		Help: "Whether a domain's DNS record passed its last scheduled check (1) or not (0)",
+	}, []string{"domain", "record"})
+
+	DNSAlerts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailserver_dns_alerts_total",
+		Help: "Total DNS records that started failing after passing",
+	}, []string{"domain", "record"})
+
 	// Error Metrics
 	Errors = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "mailserver_errors_total",
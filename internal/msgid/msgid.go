@@ -0,0 +1,17 @@
+// Package msgid generates RFC 5322 Message-ID values.
+package msgid
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"time"
+)
+
+// New returns a unique Message-ID for domain, without the angle brackets
+func New(domain string) string {
+	now := time.Now()
+	b := make([]byte, 6)
+	rand.Read(b)
+	return now.Format("20060102150405") + "." + strconv.FormatInt(now.UnixNano(), 36) + "." + hex.EncodeToString(b) + "@" + domain
+}
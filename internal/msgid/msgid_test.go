@@ -0,0 +1,27 @@
+package msgid
+
+import (
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		id := New("example.com")
+		if seen[id] {
+			t.Fatalf("duplicate Message-ID %q", id)
+		}
+		seen[id] = true
+	}
+
+	id := New("example.com")
+	if !strings.HasSuffix(id, "@example.com") {
+		t.Errorf("New() = %q, want @example.com suffix", id)
+	}
+	// A Message-ID must parse as an addr-spec inside angle brackets
+	if _, err := mail.ParseAddress("<" + id + ">"); err != nil {
+		t.Errorf("New() = %q does not parse: %v", id, err)
+	}
+}
@@ -0,0 +1,63 @@
+// Package provision adds user accounts the same way from every command
+// that creates one: the user, their default mailboxes and the welcome
+// message.
+package provision
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/fenilsonani/email-server/internal/auth"
+	"github.com/fenilsonani/email-server/internal/config"
+	"github.com/fenilsonani/email-server/internal/storage"
+	"github.com/fenilsonani/email-server/internal/welcome"
+)
+
+// Store is the part of the mail store a new user is set up in
+type Store interface {
+	welcome.Store
+	InitializeUserMailboxes(ctx context.Context, userID int64) error
+}
+
+// DefaultMailboxes converts the configured default mailbox set for the store
+func DefaultMailboxes(cfg *config.Config) []storage.DefaultMailbox {
+	mailboxes := make([]storage.DefaultMailbox, 0, len(cfg.Storage.DefaultMailboxes))
+	for _, mb := range cfg.Storage.DefaultMailboxes {
+		mailboxes = append(mailboxes, storage.DefaultMailbox{
+			Name:       mb.Name,
+			SpecialUse: storage.SpecialUse(mb.SpecialUseAttr()),
+		})
+	}
+	return mailboxes
+}
+
+// CreateUser adds the user email, whose domain must already exist, then
+// creates the store's default mailboxes for them and delivers the welcome
+// message. When only those last steps fail the user exists, and is
+// returned with the error.
+func CreateUser(ctx context.Context, cfg *config.Config, authenticator *auth.Authenticator, store Store, email, password string) (*auth.User, error) {
+	i := strings.LastIndex(email, "@")
+	if i < 0 {
+		return nil, fmt.Errorf("invalid email format: %s", email)
+	}
+	username, domain := email[:i], email[i+1:]
+
+	domainID, err := authenticator.GetDomainID(ctx, domain)
+	if err != nil {
+		return nil, fmt.Errorf("domain '%s' not found. Add it first with: mailserver domain add %s", domain, domain)
+	}
+
+	user, err := authenticator.CreateUser(ctx, username, password, domainID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := store.InitializeUserMailboxes(ctx, user.ID); err != nil {
+		return user, fmt.Errorf("failed to create default mailboxes: %w", err)
+	}
+	if err := welcome.Deliver(ctx, cfg, store, user.ID, user.Email); err != nil {
+		return user, err
+	}
+	return user, nil
+}
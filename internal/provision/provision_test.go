@@ -0,0 +1,64 @@
+package provision
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/fenilsonani/email-server/internal/auth"
+	"github.com/fenilsonani/email-server/internal/config"
+	"github.com/fenilsonani/email-server/internal/storage/maildir"
+	"github.com/fenilsonani/email-server/internal/storage/metadata"
+)
+
+func TestCreateUserSetsUpMailboxes(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	db, err := metadata.Open(filepath.Join(dir, "mail.db"))
+	if err != nil {
+		t.Fatalf("metadata.Open() error = %v", err)
+	}
+	defer db.Close()
+	if err := db.Migrate(ctx); err != nil {
+		t.Fatalf("Migrate() error = %v", err)
+	}
+
+	cfg := config.DefaultConfig()
+	cfg.Welcome.Enabled = true
+	store, err := maildir.NewStore(db.DB, filepath.Join(dir, "maildir"))
+	if err != nil {
+		t.Fatalf("NewStore() error = %v", err)
+	}
+	store.SetDefaultMailboxes(DefaultMailboxes(cfg))
+	authenticator := auth.NewAuthenticator(db.DB)
+
+	if _, err := CreateUser(ctx, cfg, authenticator, store, "alice@example.com", "password123"); err == nil {
+		t.Fatal("CreateUser() without the domain succeeded")
+	}
+	if _, err := authenticator.CreateDomain(ctx, "example.com"); err != nil {
+		t.Fatalf("CreateDomain() error = %v", err)
+	}
+	if _, err := authenticator.CreateDomain(ctx, "Example.com"); !errors.Is(err, auth.ErrDomainExists) {
+		t.Errorf("CreateDomain() again error = %v, want ErrDomainExists", err)
+	}
+
+	user, err := CreateUser(ctx, cfg, authenticator, store, "alice@example.com", "password123")
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	mailboxes, err := store.ListMailboxes(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("ListMailboxes() error = %v", err)
+	}
+	if len(mailboxes) != len(cfg.Storage.DefaultMailboxes) {
+		t.Errorf("mailboxes = %d, want %d", len(mailboxes), len(cfg.Storage.DefaultMailboxes))
+	}
+	inbox, err := store.GetMailbox(ctx, user.ID, "INBOX")
+	if err != nil {
+		t.Fatalf("GetMailbox() error = %v", err)
+	}
+	if stats, _ := store.GetMailboxStats(ctx, inbox.ID); stats == nil || stats.Messages != 1 {
+		t.Errorf("INBOX stats = %+v, want the welcome message", stats)
+	}
+}
@@ -0,0 +1,535 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Retention of finished messages, matching the key expiry in RedisQueue
+const (
+	memorySentRetention   = 7 * 24 * time.Hour
+	memoryFailedRetention = 30 * 24 * time.Hour
+	memoryExpireInterval  = time.Minute
+)
+
+// memorySet is the queue set a message belongs to.
+type memorySet int
+
+const (
+	setPending memorySet = iota
+	setProcessing
+	setSent
+	setFailed
+	setHeld
+)
+
+// memoryEntry is a message and its position in the queue. at is when a
+// pending message is due, when a held message was held, or when a sent or
+// failed message finished.
+type memoryEntry struct {
+	msg Message
+	set memorySet
+	at  time.Time
+}
+
+// MemoryQueue implements the message queue in process memory, for
+// single-node setups without Redis. Queued messages do not survive a
+// restart, although their spooled files do.
+type MemoryQueue struct {
+	config Config
+
+	mu         sync.Mutex
+	entries    map[string]*memoryEntry
+	stats      QueueStats // Only the Total* counters are maintained
+	lastExpire time.Time
+	closed     bool
+}
+
+// NewMemoryQueue creates a new in-memory message queue. RedisURL and
+// Prefix are ignored.
+func NewMemoryQueue(cfg Config) *MemoryQueue {
+	return &MemoryQueue{
+		config:  cfg,
+		entries: make(map[string]*memoryEntry),
+	}
+}
+
+// lock acquires the queue mutex unless the queue is closed.
+func (q *MemoryQueue) lock(ctx context.Context) error {
+	if ctx == nil {
+		return errors.New("context is nil")
+	}
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return ErrQueueClosed
+	}
+	return nil
+}
+
+// entry returns the entry for msgID. The caller holds q.mu.
+func (q *MemoryQueue) entry(msgID string) (*memoryEntry, error) {
+	e, ok := q.entries[msgID]
+	if !ok {
+		return nil, ErrMessageNotFound
+	}
+	return e, nil
+}
+
+// copyMessage returns a copy of msg that shares no memory with it.
+func copyMessage(msg *Message) *Message {
+	c := *msg
+	c.Recipients = append([]string(nil), msg.Recipients...)
+	return &c
+}
+
+// Enqueue adds a message to the queue for delivery. A message with
+// StatusHeld is held for review instead.
+func (q *MemoryQueue) Enqueue(ctx context.Context, msg *Message) error {
+	if err := q.lock(ctx); err != nil {
+		return err
+	}
+	defer q.mu.Unlock()
+
+	if msg == nil {
+		return errors.New("message is nil")
+	}
+	now := time.Now()
+	if msg.ID == "" {
+		msg.ID = generateMessageID()
+	}
+	if msg.CreatedAt.IsZero() {
+		msg.CreatedAt = now
+	}
+	if msg.NextAttempt.IsZero() {
+		msg.NextAttempt = now
+	}
+	if msg.MaxAttempts == 0 {
+		msg.MaxAttempts = q.config.MaxRetries
+	}
+	set, at := setPending, msg.NextAttempt
+	if msg.Status == StatusHeld {
+		set, at = setHeld, now
+	} else {
+		msg.Status = StatusPending
+	}
+
+	q.entries[msg.ID] = &memoryEntry{msg: *copyMessage(msg), set: set, at: at}
+	q.stats.TotalEnqueued++
+	q.expire(now)
+	return nil
+}
+
+// expire drops sent and failed messages past their retention, at most
+// once per memoryExpireInterval. The caller holds q.mu.
+func (q *MemoryQueue) expire(now time.Time) {
+	if now.Sub(q.lastExpire) < memoryExpireInterval {
+		return
+	}
+	q.lastExpire = now
+	for id, e := range q.entries {
+		if (e.set == setSent && now.Sub(e.at) > memorySentRetention) ||
+			(e.set == setFailed && now.Sub(e.at) > memoryFailedRetention) {
+			delete(q.entries, id)
+		}
+	}
+}
+
+// Dequeue retrieves the next message ready for delivery.
+// Returns nil if no messages are ready.
+func (q *MemoryQueue) Dequeue(ctx context.Context) (*Message, error) {
+	if err := q.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	var next *memoryEntry
+	for _, e := range q.entries {
+		if e.set != setPending || e.at.After(now) {
+			continue
+		}
+		if next == nil || e.at.Before(next.at) || (e.at.Equal(next.at) && e.msg.ID < next.msg.ID) {
+			next = e
+		}
+	}
+	if next == nil {
+		return nil, nil
+	}
+
+	next.set = setProcessing
+	next.msg.Status = StatusSending
+	next.msg.Attempts++
+	next.msg.LastAttempt = now
+	return copyMessage(&next.msg), nil
+}
+
+// Complete marks a message as successfully delivered.
+func (q *MemoryQueue) Complete(ctx context.Context, msgID string) error {
+	if err := q.lock(ctx); err != nil {
+		return err
+	}
+	defer q.mu.Unlock()
+
+	e, err := q.entry(msgID)
+	if err != nil {
+		return err
+	}
+	e.set, e.at = setSent, time.Now()
+	e.msg.Status = StatusSent
+	q.stats.TotalSent++
+	return nil
+}
+
+// Retry schedules a message for retry with exponential backoff.
+func (q *MemoryQueue) Retry(ctx context.Context, msgID string, lastError error) error {
+	if err := q.lock(ctx); err != nil {
+		return err
+	}
+	defer q.mu.Unlock()
+
+	e, err := q.entry(msgID)
+	if err != nil {
+		return err
+	}
+	q.retry(e, lastError)
+	return nil
+}
+
+// retry schedules e for retry, or fails it once it is out of attempts or
+// too old. The caller holds q.mu.
+func (q *MemoryQueue) retry(e *memoryEntry, lastError error) {
+	e.msg.LastError = lastError.Error()
+
+	// Check if we should give up
+	if e.msg.Attempts >= e.msg.MaxAttempts {
+		q.fail(e, "max attempts exceeded")
+		return
+	}
+
+	// Check if message is too old
+	if time.Since(e.msg.CreatedAt) > q.config.RetryMaxAge {
+		q.fail(e, "message expired")
+		return
+	}
+
+	e.msg.NextAttempt = q.config.Retry.NextRetry(e.msg.Attempts)
+	e.msg.Status = StatusDeferred
+	e.set, e.at = setPending, e.msg.NextAttempt
+	q.stats.TotalRetried++
+}
+
+// Defer returns a dequeued message to the pending queue until the given
+// time without counting the attempt, e.g. when its domain is throttled.
+func (q *MemoryQueue) Defer(ctx context.Context, msgID string, until time.Time) error {
+	if err := q.lock(ctx); err != nil {
+		return err
+	}
+	defer q.mu.Unlock()
+
+	e, err := q.entry(msgID)
+	if err != nil {
+		return err
+	}
+	if e.msg.Attempts > 0 {
+		e.msg.Attempts-- // Dequeue counted an attempt that never happened
+	}
+	e.msg.NextAttempt = until
+	e.msg.Status = StatusDeferred
+	e.set, e.at = setPending, until
+	return nil
+}
+
+// Reschedule makes a pending or failed message due at the given time with
+// a fresh attempt budget, moving failed messages back to pending. Messages
+// being delivered or already sent are left alone.
+func (q *MemoryQueue) Reschedule(ctx context.Context, msgID string, at time.Time) error {
+	if err := q.lock(ctx); err != nil {
+		return err
+	}
+	defer q.mu.Unlock()
+
+	e, err := q.entry(msgID)
+	if err != nil {
+		return err
+	}
+	switch e.msg.Status {
+	case StatusPending, StatusDeferred, StatusFailed:
+	default:
+		return fmt.Errorf("cannot reschedule %s message %s", e.msg.Status, msgID)
+	}
+
+	e.msg.Attempts = 0
+	e.msg.NextAttempt = at
+	e.msg.Status = StatusPending
+	e.set, e.at = setPending, at
+	return nil
+}
+
+// Release sends a held message on for delivery now.
+func (q *MemoryQueue) Release(ctx context.Context, msgID string) error {
+	if err := q.lock(ctx); err != nil {
+		return err
+	}
+	defer q.mu.Unlock()
+
+	e, err := q.entry(msgID)
+	if err != nil {
+		return err
+	}
+	if e.set != setHeld {
+		return fmt.Errorf("message %s is not held", msgID)
+	}
+
+	now := time.Now()
+	e.msg.NextAttempt = now
+	e.msg.Status = StatusPending
+	e.set, e.at = setPending, now
+	return nil
+}
+
+// Fail permanently fails a message (no more retries).
+func (q *MemoryQueue) Fail(ctx context.Context, msgID string, reason string) error {
+	if err := q.lock(ctx); err != nil {
+		return err
+	}
+	defer q.mu.Unlock()
+
+	e, err := q.entry(msgID)
+	if err != nil {
+		return err
+	}
+	q.fail(e, reason)
+	return nil
+}
+
+// fail moves e to the failed set. The caller holds q.mu.
+func (q *MemoryQueue) fail(e *memoryEntry, reason string) {
+	e.msg.Status = StatusFailed
+	e.msg.LastError = reason
+	e.set, e.at = setFailed, time.Now()
+	q.stats.TotalFailed++
+}
+
+// GetMessage retrieves a message by ID.
+func (q *MemoryQueue) GetMessage(ctx context.Context, msgID string) (*Message, error) {
+	if err := q.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer q.mu.Unlock()
+
+	e, err := q.entry(msgID)
+	if err != nil {
+		return nil, err
+	}
+	return copyMessage(&e.msg), nil
+}
+
+// Stats returns queue statistics.
+func (q *MemoryQueue) Stats(ctx context.Context) (*QueueStats, error) {
+	if err := q.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer q.mu.Unlock()
+
+	stats := q.stats
+	for _, e := range q.entries {
+		switch e.set {
+		case setPending:
+			stats.Pending++
+		case setProcessing:
+			stats.Processing++
+		case setSent:
+			stats.Sent++
+		case setFailed:
+			stats.Failed++
+		case setHeld:
+			stats.Held++
+		}
+	}
+	return &stats, nil
+}
+
+// sorted returns the entries in set ordered by at, oldest first unless
+// newestFirst. The caller holds q.mu.
+func (q *MemoryQueue) sorted(set memorySet, newestFirst bool) []*memoryEntry {
+	var entries []*memoryEntry
+	for _, e := range q.entries {
+		if e.set == set {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if newestFirst {
+			a, b = b, a
+		}
+		if !a.at.Equal(b.at) {
+			return a.at.Before(b.at)
+		}
+		return a.msg.ID < b.msg.ID
+	})
+	return entries
+}
+
+// list returns copies of up to limit messages in set.
+func (q *MemoryQueue) list(ctx context.Context, set memorySet, newestFirst bool, limit int64) ([]*Message, error) {
+	if err := q.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer q.mu.Unlock()
+
+	entries := q.sorted(set, newestFirst)
+	if int64(len(entries)) > limit {
+		entries = entries[:limit]
+	}
+	messages := make([]*Message, 0, len(entries))
+	for _, e := range entries {
+		messages = append(messages, copyMessage(&e.msg))
+	}
+	return messages, nil
+}
+
+// ListPending returns pending messages up to limit.
+func (q *MemoryQueue) ListPending(ctx context.Context, limit int64) ([]*Message, error) {
+	return q.list(ctx, setPending, false, limit)
+}
+
+// ListFailed returns failed messages up to limit.
+func (q *MemoryQueue) ListFailed(ctx context.Context, limit int64) ([]*Message, error) {
+	return q.list(ctx, setFailed, true, limit)
+}
+
+// ListHeld returns messages held for review up to limit, oldest first.
+func (q *MemoryQueue) ListHeld(ctx context.Context, limit int64) ([]*Message, error) {
+	return q.list(ctx, setHeld, false, limit)
+}
+
+// ListSent returns recently sent messages up to limit.
+func (q *MemoryQueue) ListSent(ctx context.Context, limit int64) ([]*Message, error) {
+	return q.list(ctx, setSent, true, limit)
+}
+
+// ids returns the IDs of entries[offset:offset+limit].
+func ids(entries []*memoryEntry, offset, limit int64) []string {
+	var out []string
+	for i := offset; i < int64(len(entries)) && i < offset+limit; i++ {
+		out = append(out, entries[i].msg.ID)
+	}
+	return out
+}
+
+// DeferredIDs returns up to limit IDs of pending messages not due until
+// after the given time, soonest first, skipping the first offset.
+func (q *MemoryQueue) DeferredIDs(ctx context.Context, after time.Time, offset, limit int64) ([]string, error) {
+	if err := q.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer q.mu.Unlock()
+
+	pending := q.sorted(setPending, false)
+	due := sort.Search(len(pending), func(i int) bool { return pending[i].at.After(after) })
+	return ids(pending[due:], offset, limit), nil
+}
+
+// FailedIDs returns up to limit IDs of failed messages, oldest first,
+// skipping the first offset.
+func (q *MemoryQueue) FailedIDs(ctx context.Context, offset, limit int64) ([]string, error) {
+	if err := q.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer q.mu.Unlock()
+
+	return ids(q.sorted(setFailed, false), offset, limit), nil
+}
+
+// Search returns up to limit messages with the given status (pending,
+// held, failed or sent) that match f, skipping the first offset matches,
+// in the same order and with the same scan limit as RedisQueue.Search.
+func (q *MemoryQueue) Search(ctx context.Context, status Status, f SearchFilter, offset, limit int) (msgs []*Message, more bool, err error) {
+	var set memorySet
+	newestFirst := true
+	switch status {
+	case StatusPending:
+		set, newestFirst = setPending, false
+	case StatusHeld:
+		set, newestFirst = setHeld, false
+	case StatusFailed:
+		set = setFailed
+	case StatusSent:
+		set = setSent
+	default:
+		return nil, false, fmt.Errorf("cannot search %s messages", status)
+	}
+
+	if err := q.lock(ctx); err != nil {
+		return nil, false, err
+	}
+	defer q.mu.Unlock()
+
+	entries := q.sorted(set, newestFirst)
+	if len(entries) > maxSearchScan {
+		entries = entries[:maxSearchScan]
+	}
+	matched := 0
+	for _, e := range entries {
+		if !f.Matches(&e.msg) {
+			continue
+		}
+		matched++
+		if matched <= offset {
+			continue
+		}
+		if len(msgs) == limit {
+			return msgs, true, nil
+		}
+		msgs = append(msgs, copyMessage(&e.msg))
+	}
+	return msgs, false, nil
+}
+
+// RecoverStale moves messages stuck in processing back to pending.
+// This handles cases where a worker crashed.
+func (q *MemoryQueue) RecoverStale(ctx context.Context, staleThreshold time.Duration) (int, error) {
+	if err := q.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer q.mu.Unlock()
+
+	recovered := 0
+	for _, e := range q.entries {
+		if e.set == setProcessing && time.Since(e.msg.LastAttempt) > staleThreshold {
+			q.retry(e, errors.New("worker timeout"))
+			recovered++
+		}
+	}
+	return recovered, nil
+}
+
+// Cleanup removes old sent/failed messages.
+func (q *MemoryQueue) Cleanup(ctx context.Context, olderThan time.Duration) error {
+	if err := q.lock(ctx); err != nil {
+		return err
+	}
+	defer q.mu.Unlock()
+
+	threshold := time.Now().Add(-olderThan)
+	for id, e := range q.entries {
+		if (e.set == setSent || e.set == setFailed) && e.at.Before(threshold) {
+			delete(q.entries, id)
+		}
+	}
+	return nil
+}
+
+// Close closes the queue. Later calls fail with ErrQueueClosed.
+func (q *MemoryQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	return nil
+}
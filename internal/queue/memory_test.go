@@ -0,0 +1,252 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func newTestMemoryQueue() *MemoryQueue {
+	cfg := DefaultConfig()
+	cfg.MaxRetries = 3
+	return NewMemoryQueue(cfg)
+}
+
+func TestMemoryQueue_EnqueueDequeueComplete(t *testing.T) {
+	ctx := context.Background()
+	q := newTestMemoryQueue()
+
+	msg := &Message{Sender: "alice@example.com", Recipients: []string{"bob@example.org"}, Domain: "example.org"}
+	if err := q.Enqueue(ctx, msg); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+	if msg.ID == "" || msg.MaxAttempts != 3 || msg.Status != StatusPending {
+		t.Errorf("Enqueue() left message as %+v", msg)
+	}
+
+	got, err := q.Dequeue(ctx)
+	if err != nil || got == nil {
+		t.Fatalf("Dequeue() = %v, %v", got, err)
+	}
+	if got.ID != msg.ID || got.Status != StatusSending || got.Attempts != 1 {
+		t.Errorf("Dequeue() = %+v", got)
+	}
+	if again, _ := q.Dequeue(ctx); again != nil {
+		t.Errorf("second Dequeue() = %+v, want nil", again)
+	}
+
+	if err := q.Complete(ctx, msg.ID); err != nil {
+		t.Fatalf("Complete() error = %v", err)
+	}
+	stats, _ := q.Stats(ctx)
+	if stats.Pending != 0 || stats.Processing != 0 || stats.Sent != 1 || stats.TotalEnqueued != 1 || stats.TotalSent != 1 {
+		t.Errorf("Stats() = %+v", stats)
+	}
+	sent, _ := q.ListSent(ctx, 10)
+	if len(sent) != 1 || sent[0].Status != StatusSent {
+		t.Errorf("ListSent() = %+v", sent)
+	}
+}
+
+func TestMemoryQueue_DequeueOrder(t *testing.T) {
+	ctx := context.Background()
+	q := newTestMemoryQueue()
+	now := time.Now()
+
+	q.Enqueue(ctx, &Message{ID: "later", NextAttempt: now.Add(-time.Second)})
+	q.Enqueue(ctx, &Message{ID: "sooner", NextAttempt: now.Add(-time.Minute)})
+	q.Enqueue(ctx, &Message{ID: "future", NextAttempt: now.Add(time.Hour)})
+
+	for _, want := range []string{"sooner", "later"} {
+		msg, err := q.Dequeue(ctx)
+		if err != nil || msg == nil || msg.ID != want {
+			t.Fatalf("Dequeue() = %+v, %v, want %s", msg, err, want)
+		}
+	}
+	if msg, _ := q.Dequeue(ctx); msg != nil {
+		t.Errorf("Dequeue() = %s, want nothing before it is due", msg.ID)
+	}
+
+	ids, _ := q.DeferredIDs(ctx, now, 0, 10)
+	if len(ids) != 1 || ids[0] != "future" {
+		t.Errorf("DeferredIDs() = %v, want [future]", ids)
+	}
+}
+
+func TestMemoryQueue_Retry(t *testing.T) {
+	ctx := context.Background()
+	q := newTestMemoryQueue()
+
+	q.Enqueue(ctx, &Message{ID: "m1"})
+	for attempt := 1; attempt <= 3; attempt++ {
+		// Retried messages are due later, so make them due now
+		q.entries["m1"].at = time.Now()
+		msg, err := q.Dequeue(ctx)
+		if err != nil || msg == nil {
+			t.Fatalf("attempt %d: Dequeue() = %v, %v", attempt, msg, err)
+		}
+		if err := q.Retry(ctx, "m1", errors.New("451 try later")); err != nil {
+			t.Fatalf("attempt %d: Retry() error = %v", attempt, err)
+		}
+
+		msg, _ = q.GetMessage(ctx, "m1")
+		if attempt < 3 {
+			if msg.Status != StatusDeferred || !msg.NextAttempt.After(time.Now()) || msg.LastError != "451 try later" {
+				t.Errorf("attempt %d: after Retry() message = %+v", attempt, msg)
+			}
+		} else if msg.Status != StatusFailed || msg.LastError != "max attempts exceeded" {
+			t.Errorf("after last Retry() message = %+v, want failed", msg)
+		}
+	}
+
+	failed, _ := q.ListFailed(ctx, 10)
+	if len(failed) != 1 || failed[0].ID != "m1" {
+		t.Errorf("ListFailed() = %+v", failed)
+	}
+	stats, _ := q.Stats(ctx)
+	if stats.TotalRetried != 2 || stats.TotalFailed != 1 || stats.Failed != 1 {
+		t.Errorf("Stats() = %+v", stats)
+	}
+
+	// A failed message can be rescheduled with a fresh budget
+	if err := q.Reschedule(ctx, "m1", time.Now()); err != nil {
+		t.Fatalf("Reschedule() error = %v", err)
+	}
+	if msg, _ := q.Dequeue(ctx); msg == nil || msg.Attempts != 1 {
+		t.Errorf("Dequeue() after Reschedule() = %+v", msg)
+	}
+}
+
+func TestMemoryQueue_DeferKeepsAttempt(t *testing.T) {
+	ctx := context.Background()
+	q := newTestMemoryQueue()
+
+	q.Enqueue(ctx, &Message{ID: "m1"})
+	q.Dequeue(ctx)
+	until := time.Now().Add(time.Minute)
+	if err := q.Defer(ctx, "m1", until); err != nil {
+		t.Fatalf("Defer() error = %v", err)
+	}
+
+	msg, _ := q.GetMessage(ctx, "m1")
+	if msg.Attempts != 0 || !msg.NextAttempt.Equal(until) || msg.Status != StatusDeferred {
+		t.Errorf("after Defer() message = %+v", msg)
+	}
+	if stats, _ := q.Stats(ctx); stats.Pending != 1 || stats.Processing != 0 {
+		t.Errorf("Stats() = %+v", stats)
+	}
+}
+
+func TestMemoryQueue_RecoverStale(t *testing.T) {
+	ctx := context.Background()
+	q := newTestMemoryQueue()
+
+	q.Enqueue(ctx, &Message{ID: "m1"})
+	q.Dequeue(ctx)
+
+	if n, _ := q.RecoverStale(ctx, time.Hour); n != 0 {
+		t.Errorf("RecoverStale() = %d for a fresh message, want 0", n)
+	}
+	if n, _ := q.RecoverStale(ctx, 0); n != 1 {
+		t.Errorf("RecoverStale() = %d, want 1", n)
+	}
+	if msg, _ := q.GetMessage(ctx, "m1"); msg.Status != StatusDeferred || msg.LastError != "worker timeout" {
+		t.Errorf("recovered message = %+v", msg)
+	}
+}
+
+func TestMemoryQueue_ReturnsCopies(t *testing.T) {
+	ctx := context.Background()
+	q := newTestMemoryQueue()
+
+	msg := &Message{ID: "m1", Recipients: []string{"bob@example.org"}}
+	q.Enqueue(ctx, msg)
+	msg.Recipients[0] = "mallory@example.org"
+
+	got, _ := q.GetMessage(ctx, "m1")
+	if got.Recipients[0] != "bob@example.org" {
+		t.Errorf("queued recipient changed through caller's message: %v", got.Recipients)
+	}
+}
+
+func TestMemoryQueue_Search(t *testing.T) {
+	ctx := context.Background()
+	q := newTestMemoryQueue()
+
+	q.Enqueue(ctx, &Message{ID: "a", Sender: "alice@example.com"})
+	q.Enqueue(ctx, &Message{ID: "b", Sender: "bob@example.com"})
+	q.Enqueue(ctx, &Message{ID: "c", Sender: "alice@example.com"})
+
+	msgs, more, err := q.Search(ctx, StatusPending, SearchFilter{Sender: "ALICE"}, 0, 1)
+	if err != nil || len(msgs) != 1 || !more {
+		t.Fatalf("Search() = %v, %v, %v", msgs, more, err)
+	}
+	msgs, more, _ = q.Search(ctx, StatusPending, SearchFilter{Sender: "alice"}, 1, 10)
+	if len(msgs) != 1 || more {
+		t.Errorf("Search() page 2 = %v, more %v", msgs, more)
+	}
+	if _, _, err := q.Search(ctx, StatusSending, SearchFilter{}, 0, 10); err == nil {
+		t.Error("Search() of sending messages succeeded, want error")
+	}
+}
+
+func TestMemoryQueue_Closed(t *testing.T) {
+	ctx := context.Background()
+	q := newTestMemoryQueue()
+	q.Close()
+
+	if err := q.Enqueue(ctx, &Message{}); !errors.Is(err, ErrQueueClosed) {
+		t.Errorf("Enqueue() after Close() error = %v, want ErrQueueClosed", err)
+	}
+	if _, err := q.Dequeue(ctx); !errors.Is(err, ErrQueueClosed) {
+		t.Errorf("Dequeue() after Close() error = %v, want ErrQueueClosed", err)
+	}
+	if _, err := q.GetMessage(ctx, "missing"); !errors.Is(err, ErrQueueClosed) {
+		t.Errorf("GetMessage() after Close() error = %v, want ErrQueueClosed", err)
+	}
+}
+
+func TestMemoryQueue_HeldUntilReleased(t *testing.T) {
+	ctx := context.Background()
+	q := newTestMemoryQueue()
+
+	q.Enqueue(ctx, &Message{ID: "m1", Status: StatusHeld, HoldReason: "too many recipients"})
+	if msg, _ := q.Dequeue(ctx); msg != nil {
+		t.Fatalf("Dequeue() = %s, want held message skipped", msg.ID)
+	}
+	if stats, _ := q.Stats(ctx); stats.Held != 1 || stats.Pending != 0 {
+		t.Errorf("Stats() = %+v", stats)
+	}
+	if held, _ := q.ListHeld(ctx, 10); len(held) != 1 || held[0].HoldReason != "too many recipients" {
+		t.Errorf("ListHeld() = %+v", held)
+	}
+
+	if err := q.Release(ctx, "m1"); err != nil {
+		t.Fatalf("Release() error = %v", err)
+	}
+	if msg, _ := q.Dequeue(ctx); msg == nil || msg.ID != "m1" {
+		t.Errorf("Dequeue() after Release() = %+v", msg)
+	}
+	if err := q.Release(ctx, "m1"); err == nil {
+		t.Error("Release() of a message that isn't held succeeded")
+	}
+}
+
+func TestMemoryQueue_RejectHeld(t *testing.T) {
+	ctx := context.Background()
+	q := newTestMemoryQueue()
+
+	q.Enqueue(ctx, &Message{ID: "m1", Status: StatusHeld})
+	if err := q.Fail(ctx, "m1", "Rejected by admin: spam"); err != nil {
+		t.Fatalf("Fail() error = %v", err)
+	}
+
+	msg, _ := q.GetMessage(ctx, "m1")
+	if msg.Status != StatusFailed || msg.LastError != "Rejected by admin: spam" {
+		t.Errorf("rejected message = %+v", msg)
+	}
+	if stats, _ := q.Stats(ctx); stats.Held != 0 || stats.Failed != 1 {
+		t.Errorf("Stats() = %+v", stats)
+	}
+}
@@ -0,0 +1,96 @@
+package queue
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// Queue is a delivery queue. RedisQueue shares it across nodes;
+// MemoryQueue keeps it in process for single-node setups.
+type Queue interface {
+	// Enqueue adds a message to the queue for delivery, or holds it for
+	// review if its status is StatusHeld.
+	Enqueue(ctx context.Context, msg *Message) error
+	// Dequeue retrieves the next message ready for delivery, or nil if
+	// none is ready.
+	Dequeue(ctx context.Context) (*Message, error)
+	// Complete marks a message as successfully delivered.
+	Complete(ctx context.Context, msgID string) error
+	// Retry schedules a message for retry with exponential backoff.
+	Retry(ctx context.Context, msgID string, lastError error) error
+	// Defer returns a dequeued message to pending until the given time
+	// without counting the attempt.
+	Defer(ctx context.Context, msgID string, until time.Time) error
+	// Reschedule makes a pending or failed message due at the given time
+	// with a fresh attempt budget.
+	Reschedule(ctx context.Context, msgID string, at time.Time) error
+	// Release sends a held message on for delivery now.
+	Release(ctx context.Context, msgID string) error
+	// Fail permanently fails a message (no more retries).
+	Fail(ctx context.Context, msgID string, reason string) error
+
+	// GetMessage retrieves a message by ID.
+	GetMessage(ctx context.Context, msgID string) (*Message, error)
+	// Stats returns queue statistics.
+	Stats(ctx context.Context) (*QueueStats, error)
+	// ListPending returns pending messages up to limit, soonest due first.
+	ListPending(ctx context.Context, limit int64) ([]*Message, error)
+	// ListHeld returns messages held for review up to limit, oldest first.
+	ListHeld(ctx context.Context, limit int64) ([]*Message, error)
+	// ListFailed returns failed messages up to limit, newest first.
+	ListFailed(ctx context.Context, limit int64) ([]*Message, error)
+	// ListSent returns recently sent messages up to limit, newest first.
+	ListSent(ctx context.Context, limit int64) ([]*Message, error)
+	// DeferredIDs returns up to limit IDs of pending messages not due
+	// until after the given time, soonest first, skipping offset.
+	DeferredIDs(ctx context.Context, after time.Time, offset, limit int64) ([]string, error)
+	// FailedIDs returns up to limit IDs of failed messages, oldest first,
+	// skipping offset.
+	FailedIDs(ctx context.Context, offset, limit int64) ([]string, error)
+	// Search returns messages with the given status that match f.
+	Search(ctx context.Context, status Status, f SearchFilter, offset, limit int) ([]*Message, bool, error)
+
+	// RecoverStale moves messages stuck in processing back to pending.
+	RecoverStale(ctx context.Context, staleThreshold time.Duration) (int, error)
+	// Cleanup removes sent and failed messages older than olderThan.
+	Cleanup(ctx context.Context, olderThan time.Duration) error
+	// Close releases the queue's resources.
+	Close() error
+}
+
+var (
+	_ Queue = (*RedisQueue)(nil)
+	_ Queue = (*MemoryQueue)(nil)
+)
+
+// DSN holds the delivery status notifications (RFC 3461) a sender asked
+// for with the MAIL FROM and RCPT TO parameters
+type DSN struct {
+	// EnvelopeID is the ENVID= the sender gave, echoed in notices.
+	EnvelopeID string `json:"envelope_id,omitempty"`
+	// Return is RET=, FULL or HDRS: how much of the message a failure
+	// notice returns.
+	Return string `json:"return,omitempty"`
+	// Notify holds each recipient's NOTIFY=, NEVER or a comma-separated
+	// list of SUCCESS, FAILURE and DELAY.
+	Notify map[string]string `json:"notify,omitempty"`
+}
+
+// Wants reports whether the sender wants a notice of kind (SUCCESS,
+// FAILURE or DELAY) for rcpt. Without NOTIFY only failures are reported.
+func (d *DSN) Wants(rcpt, kind string) bool {
+	notify := ""
+	if d != nil {
+		notify = d.Notify[rcpt]
+	}
+	if notify == "" {
+		return kind == "FAILURE"
+	}
+	for _, k := range strings.Split(notify, ",") {
+		if strings.EqualFold(k, kind) {
+			return true
+		}
+	}
+	return false
+}
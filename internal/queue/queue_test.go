@@ -183,6 +183,64 @@ func TestCalculateNextRetry_NegativeAttempts(t *testing.T) {
 	}
 }
 
+// within reports whether d is base with at most 10% jitter.
+func within(d, base time.Duration) bool {
+	return d >= base-base/10 && d <= base+base/10
+}
+
+func TestRetrySchedule_Custom(t *testing.T) {
+	s := RetrySchedule{InitialDelay: time.Minute, Multiplier: 3, MaxInterval: time.Hour}
+	want := []time.Duration{
+		time.Minute,      // attempt 1
+		3 * time.Minute,  // attempt 2
+		9 * time.Minute,  // attempt 3
+		27 * time.Minute, // attempt 4
+		time.Hour,        // attempt 5, capped
+		time.Hour,        // attempt 50
+	}
+	for i, attempts := range []int{1, 2, 3, 4, 5, 50} {
+		if d := time.Until(s.NextRetry(attempts)); !within(d, want[i]) {
+			t.Errorf("NextRetry(%d) = %v, want ~%v", attempts, d, want[i])
+		}
+	}
+}
+
+func TestRetrySchedule_Defaults(t *testing.T) {
+	// The zero schedule is the built-in curve
+	if d := time.Until(RetrySchedule{}.NextRetry(2)); !within(d, 15*time.Minute) {
+		t.Errorf("zero schedule NextRetry(2) = %v, want ~15m", d)
+	}
+
+	// A partial override fills in 5m, x2 and 24h
+	s := RetrySchedule{Multiplier: 4}
+	if d := time.Until(s.NextRetry(2)); !within(d, 20*time.Minute) {
+		t.Errorf("NextRetry(2) = %v, want ~20m", d)
+	}
+	if d := time.Until(s.NextRetry(20)); !within(d, 24*time.Hour) {
+		t.Errorf("NextRetry(20) = %v, want ~24h", d)
+	}
+}
+
+func TestRetrySchedule_QuickRetryShortensFirstIntervalOnly(t *testing.T) {
+	for _, s := range []RetrySchedule{
+		{QuickRetry: time.Minute},
+		{QuickRetry: time.Minute, InitialDelay: 10 * time.Minute, Multiplier: 2},
+	} {
+		slow := s
+		slow.QuickRetry = 0
+
+		if d := time.Until(s.NextRetry(1)); !within(d, time.Minute) {
+			t.Errorf("%+v: NextRetry(1) = %v, want ~1m", s, d)
+		}
+		for _, attempts := range []int{2, 3, 6} {
+			quick, base := time.Until(s.NextRetry(attempts)), time.Until(slow.NextRetry(attempts))
+			if !within(quick, base) {
+				t.Errorf("%+v: NextRetry(%d) = %v, want ~%v as without quick retry", s, attempts, quick, base)
+			}
+		}
+	}
+}
+
 func TestMessage_Struct(t *testing.T) {
 	msg := Message{
 		ID:          "test-123",
@@ -642,6 +700,37 @@ func TestCalculateNextRetry_Consistency(t *testing.T) {
 	}
 }
 
+func TestSearchFilter_Matches(t *testing.T) {
+	msg := &Message{
+		ID:         "1700000000-abcdef",
+		Sender:     "Alice@Example.com",
+		Recipients: []string{"bob@example.org", "carol@partner.example"},
+	}
+
+	tests := []struct {
+		name   string
+		filter SearchFilter
+		want   bool
+	}{
+		{"empty", SearchFilter{}, true},
+		{"sender case-insensitive", SearchFilter{Sender: "alice@"}, true},
+		{"sender mismatch", SearchFilter{Sender: "mallory"}, false},
+		{"any recipient", SearchFilter{Recipient: "PARTNER.example"}, true},
+		{"recipient mismatch", SearchFilter{Recipient: "dave@"}, false},
+		{"id prefix", SearchFilter{MessageID: "1700000000-"}, true},
+		{"id not prefix", SearchFilter{MessageID: "abcdef"}, false},
+		{"all fields", SearchFilter{Sender: "alice", Recipient: "bob", MessageID: "1700"}, true},
+		{"one field fails", SearchFilter{Sender: "alice", Recipient: "dave"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.Matches(msg); got != tt.want {
+				t.Errorf("Matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func BenchmarkGenerateMessageID(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		generateMessageID()
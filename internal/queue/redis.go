@@ -8,6 +8,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -35,7 +36,10 @@ type Message struct {
 	LastError   string    `json:"last_error,omitempty"`
 	Status      Status    `json:"status"`
 	CreatedAt   time.Time `json:"created_at"`
-	Domain      string    `json:"domain"` // Recipient domain for circuit breaker
+	Domain      string    `json:"domain"`                // Recipient domain for circuit breaker
+	HoldReason  string    `json:"hold_reason,omitempty"` // Why the message is held for review
+	DSN         *DSN      `json:"dsn,omitempty"`         // Delivery status notifications the sender asked for
+	DSNPassedOn bool      `json:"-"`                     // Set by a delivery to a server that took the DSN parameters
 }
 
 // Status represents the message delivery status.
@@ -48,18 +52,23 @@ const (
 	StatusFailed    Status = "failed"
 	StatusDeferred  Status = "deferred"
 	StatusBounced   Status = "bounced"
+	StatusHeld      Status = "held" // Waiting for an admin to release or reject it
 )
 
 // Config configures the Redis queue.
 type Config struct {
 	// RedisURL is the Redis connection URL.
 	RedisURL string
+	// RedisPassword, if set, overrides the password in RedisURL.
+	RedisPassword string
 	// Prefix is the key prefix for all queue keys.
 	Prefix string
 	// MaxRetries is the maximum delivery attempts.
 	MaxRetries int
 	// RetryMaxAge is the maximum time to retry before permanent failure.
 	RetryMaxAge time.Duration
+	// Retry sets the delay between attempts.
+	Retry RetrySchedule
 }
 
 // DefaultConfig returns default queue configuration.
@@ -89,6 +98,9 @@ func NewRedisQueue(cfg Config) (*RedisQueue, error) {
 	if err != nil {
 		return nil, fmt.Errorf("invalid Redis URL: %w", err)
 	}
+	if cfg.RedisPassword != "" {
+		opts.Password = cfg.RedisPassword
+	}
 
 	// Configure connection pool for reliability
 	opts.MaxRetries = 3
@@ -143,6 +155,7 @@ func (q *RedisQueue) pendingKey() string    { return q.config.Prefix + ":queue:p
 func (q *RedisQueue) processingKey() string { return q.config.Prefix + ":queue:processing" }
 func (q *RedisQueue) failedKey() string     { return q.config.Prefix + ":queue:failed" }
 func (q *RedisQueue) sentKey() string       { return q.config.Prefix + ":queue:sent" }
+func (q *RedisQueue) heldKey() string       { return q.config.Prefix + ":queue:held" }
 func (q *RedisQueue) messageKey(id string) string {
 	return q.config.Prefix + ":message:" + id
 }
@@ -189,7 +202,8 @@ func (q *RedisQueue) validateContext(ctx context.Context) error {
 	return nil
 }
 
-// Enqueue adds a message to the queue for delivery.
+// Enqueue adds a message to the queue for delivery. A message with
+// StatusHeld is held for review instead.
 func (q *RedisQueue) Enqueue(ctx context.Context, msg *Message) error {
 	if err := q.validateContext(ctx); err != nil {
 		return err
@@ -213,7 +227,12 @@ func (q *RedisQueue) Enqueue(ctx context.Context, msg *Message) error {
 	if msg.MaxAttempts == 0 {
 		msg.MaxAttempts = q.config.MaxRetries
 	}
-	msg.Status = StatusPending
+	key, score := q.pendingKey(), float64(msg.NextAttempt.UnixNano())
+	if msg.Status == StatusHeld {
+		key, score = q.heldKey(), float64(time.Now().UnixNano())
+	} else {
+		msg.Status = StatusPending
+	}
 
 	// Store message data
 	data, err := json.Marshal(msg)
@@ -226,8 +245,8 @@ func (q *RedisQueue) Enqueue(ctx context.Context, msg *Message) error {
 	for attempt := 0; attempt < maxRetries; attempt++ {
 		pipe := q.client.TxPipeline()
 		pipe.Set(ctx, q.messageKey(msg.ID), data, 0)
-		pipe.ZAdd(ctx, q.pendingKey(), redis.Z{
-			Score:  float64(msg.NextAttempt.UnixNano()),
+		pipe.ZAdd(ctx, key, redis.Z{
+			Score:  score,
 			Member: msg.ID,
 		})
 		pipe.HIncrBy(ctx, q.statsKey(), "enqueued", 1)
@@ -380,7 +399,7 @@ func (q *RedisQueue) Retry(ctx context.Context, msgID string, lastError error) e
 	}
 
 	// Calculate next retry time with exponential backoff + jitter
-	msg.NextAttempt = calculateNextRetry(msg.Attempts)
+	msg.NextAttempt = q.config.Retry.NextRetry(msg.Attempts)
 	msg.Status = StatusDeferred
 
 	pipe := q.client.TxPipeline()
@@ -402,6 +421,151 @@ func (q *RedisQueue) Retry(ctx context.Context, msgID string, lastError error) e
 	return err
 }
 
+// Defer returns a dequeued message to the pending queue until the given
+// time without counting the attempt, e.g. when its domain is throttled.
+func (q *RedisQueue) Defer(ctx context.Context, msgID string, until time.Time) error {
+	msg, err := q.GetMessage(ctx, msgID)
+	if err != nil {
+		return err
+	}
+
+	if msg.Attempts > 0 {
+		msg.Attempts-- // Dequeue counted an attempt that never happened
+	}
+	msg.NextAttempt = until
+	msg.Status = StatusDeferred
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	pipe := q.client.TxPipeline()
+	pipe.SRem(ctx, q.processingKey(), msgID)
+	pipe.ZAdd(ctx, q.pendingKey(), redis.Z{
+		Score:  float64(until.UnixNano()),
+		Member: msgID,
+	})
+	pipe.Set(ctx, q.messageKey(msgID), data, 0)
+
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// Reschedule makes a pending or failed message due at the given time with
+// a fresh attempt budget, moving failed messages back to pending. Messages
+// being delivered or already sent are left alone.
+func (q *RedisQueue) Reschedule(ctx context.Context, msgID string, at time.Time) error {
+	msg, err := q.GetMessage(ctx, msgID)
+	if err != nil {
+		return err
+	}
+
+	switch msg.Status {
+	case StatusPending, StatusDeferred, StatusFailed:
+	default:
+		return fmt.Errorf("cannot reschedule %s message %s", msg.Status, msgID)
+	}
+
+	msg.Attempts = 0
+	msg.NextAttempt = at
+	msg.Status = StatusPending
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	pipe := q.client.TxPipeline()
+	pipe.ZRem(ctx, q.failedKey(), msgID)
+	pipe.ZAdd(ctx, q.pendingKey(), redis.Z{
+		Score:  float64(at.UnixNano()),
+		Member: msgID,
+	})
+	pipe.Set(ctx, q.messageKey(msgID), data, 0) // Clears the failed-message expiry
+
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// DeferredIDs returns up to limit IDs of pending messages not due until
+// after the given time, soonest first, skipping the first offset.
+func (q *RedisQueue) DeferredIDs(ctx context.Context, after time.Time, offset, limit int64) ([]string, error) {
+	if err := q.validateContext(ctx); err != nil {
+		return nil, err
+	}
+
+	return q.client.ZRangeByScore(ctx, q.pendingKey(), &redis.ZRangeBy{
+		Min:    fmt.Sprintf("(%d", after.UnixNano()),
+		Max:    "+inf",
+		Offset: offset,
+		Count:  limit,
+	}).Result()
+}
+
+// FailedIDs returns up to limit IDs of failed messages, oldest first,
+// skipping the first offset.
+func (q *RedisQueue) FailedIDs(ctx context.Context, offset, limit int64) ([]string, error) {
+	if err := q.validateContext(ctx); err != nil {
+		return nil, err
+	}
+
+	return q.client.ZRange(ctx, q.failedKey(), offset, offset+limit-1).Result()
+}
+
+// Release sends a held message on for delivery now. The message is
+// watched while it moves, so if it is released or rejected at the same
+// time only one of the two takes effect.
+func (q *RedisQueue) Release(ctx context.Context, msgID string) error {
+	key := q.messageKey(msgID)
+	release := func(tx *redis.Tx) error {
+		data, err := tx.Get(ctx, key).Bytes()
+		if err == redis.Nil {
+			return ErrMessageNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get message: %w", err)
+		}
+		var msg Message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return fmt.Errorf("failed to unmarshal message: %w", err)
+		}
+		if msg.Status != StatusHeld {
+			return fmt.Errorf("message %s is not held", msgID)
+		}
+
+		now := time.Now()
+		msg.Status = StatusPending
+		msg.NextAttempt = now
+		data, err = json.Marshal(&msg)
+		if err != nil {
+			return fmt.Errorf("failed to marshal message: %w", err)
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.ZRem(ctx, q.heldKey(), msgID)
+			pipe.ZAdd(ctx, q.pendingKey(), redis.Z{
+				Score:  float64(now.UnixNano()),
+				Member: msgID,
+			})
+			pipe.Set(ctx, key, data, 0)
+			return nil
+		})
+		return err
+	}
+
+	// Another change to the message in between aborts the transaction;
+	// looking again then finds it released, failed or still held
+	maxRetries := 3
+	for attempt := 0; attempt < maxRetries; attempt++ {
+		err := q.client.Watch(ctx, release, key)
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return fmt.Errorf("failed to release message %s: it kept changing", msgID)
+}
+
 // Fail permanently fails a message (no more retries).
 func (q *RedisQueue) Fail(ctx context.Context, msgID string, reason string) error {
 	msg, err := q.GetMessage(ctx, msgID)
@@ -414,6 +578,8 @@ func (q *RedisQueue) Fail(ctx context.Context, msgID string, reason string) erro
 
 	pipe := q.client.TxPipeline()
 	pipe.SRem(ctx, q.processingKey(), msgID)
+	pipe.ZRem(ctx, q.pendingKey(), msgID)
+	pipe.ZRem(ctx, q.heldKey(), msgID)
 	pipe.ZAdd(ctx, q.failedKey(), redis.Z{
 		Score:  float64(time.Now().UnixNano()),
 		Member: msgID,
@@ -465,6 +631,7 @@ func (q *RedisQueue) Stats(ctx context.Context) (*QueueStats, error) {
 	processingCmd := pipe.SCard(ctx, q.processingKey())
 	sentCmd := pipe.ZCard(ctx, q.sentKey())
 	failedCmd := pipe.ZCard(ctx, q.failedKey())
+	heldCmd := pipe.ZCard(ctx, q.heldKey())
 	statsCmd := pipe.HGetAll(ctx, q.statsKey())
 
 	_, err := pipe.Exec(ctx)
@@ -477,6 +644,7 @@ func (q *RedisQueue) Stats(ctx context.Context) (*QueueStats, error) {
 		Processing: processingCmd.Val(),
 		Sent:       sentCmd.Val(),
 		Failed:     failedCmd.Val(),
+		Held:       heldCmd.Val(),
 	}
 
 	counters := statsCmd.Val()
@@ -502,6 +670,7 @@ type QueueStats struct {
 	Processing    int64
 	Sent          int64
 	Failed        int64
+	Held          int64
 	TotalEnqueued int64
 	TotalSent     int64
 	TotalFailed   int64
@@ -566,6 +735,29 @@ func (q *RedisQueue) ListFailed(ctx context.Context, limit int64) ([]*Message, e
 	return messages, nil
 }
 
+// ListHeld returns messages held for review up to limit, oldest first.
+func (q *RedisQueue) ListHeld(ctx context.Context, limit int64) ([]*Message, error) {
+	if err := q.validateContext(ctx); err != nil {
+		return nil, err
+	}
+
+	ids, err := q.client.ZRange(ctx, q.heldKey(), 0, limit-1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to query held queue: %w", err)
+	}
+
+	messages := make([]*Message, 0, len(ids))
+	for _, msgID := range ids {
+		msg, err := q.GetMessage(ctx, msgID)
+		if err != nil {
+			continue
+		}
+		messages = append(messages, msg)
+	}
+
+	return messages, nil
+}
+
 // ListSent returns recently sent messages up to limit.
 func (q *RedisQueue) ListSent(ctx context.Context, limit int64) ([]*Message, error) {
 	if err := q.validateContext(ctx); err != nil {
@@ -590,6 +782,121 @@ func (q *RedisQueue) ListSent(ctx context.Context, limit int64) ([]*Message, err
 	return messages, nil
 }
 
+// SearchFilter selects queued messages. Empty fields match everything.
+type SearchFilter struct {
+	Sender    string // Substring of the envelope sender, case-insensitive
+	Recipient string // Substring of any recipient, case-insensitive
+	MessageID string // Queue message ID prefix
+}
+
+// IsEmpty reports whether the filter matches every message.
+func (f SearchFilter) IsEmpty() bool {
+	return f.Sender == "" && f.Recipient == "" && f.MessageID == ""
+}
+
+// Matches reports whether msg satisfies every set field of the filter.
+func (f SearchFilter) Matches(msg *Message) bool {
+	if f.MessageID != "" && !strings.HasPrefix(msg.ID, f.MessageID) {
+		return false
+	}
+	if f.Sender != "" && !strings.Contains(strings.ToLower(msg.Sender), strings.ToLower(f.Sender)) {
+		return false
+	}
+	if f.Recipient != "" {
+		want := strings.ToLower(f.Recipient)
+		found := false
+		for _, rcpt := range msg.Recipients {
+			if strings.Contains(strings.ToLower(rcpt), want) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Search limits
+const (
+	searchBatchSize = 500   // Message IDs fetched per round trip
+	maxSearchScan   = 10000 // Messages examined per search
+)
+
+// Search returns up to limit messages with the given status (pending,
+// held, failed or sent) that match f, skipping the first offset matches.
+// Messages are ordered as in ListPending, ListHeld, ListFailed and
+// ListSent. more reports whether further matches exist. At most
+// maxSearchScan messages are examined, so very large queues may report
+// partial results.
+func (q *RedisQueue) Search(ctx context.Context, status Status, f SearchFilter, offset, limit int) (msgs []*Message, more bool, err error) {
+	if err := q.validateContext(ctx); err != nil {
+		return nil, false, err
+	}
+
+	var key string
+	newestFirst := true
+	switch status {
+	case StatusPending:
+		key, newestFirst = q.pendingKey(), false
+	case StatusHeld:
+		key, newestFirst = q.heldKey(), false
+	case StatusFailed:
+		key = q.failedKey()
+	case StatusSent:
+		key = q.sentKey()
+	default:
+		return nil, false, fmt.Errorf("cannot search %s messages", status)
+	}
+
+	matched := 0
+	for start := int64(0); start < maxSearchScan; start += searchBatchSize {
+		var ids []string
+		if newestFirst {
+			ids, err = q.client.ZRevRange(ctx, key, start, start+searchBatchSize-1).Result()
+		} else {
+			ids, err = q.client.ZRange(ctx, key, start, start+searchBatchSize-1).Result()
+		}
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to scan %s queue: %w", status, err)
+		}
+		if len(ids) == 0 {
+			break
+		}
+
+		keys := make([]string, len(ids))
+		for i, id := range ids {
+			keys[i] = q.messageKey(id)
+		}
+		values, err := q.client.MGet(ctx, keys...).Result()
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to load messages: %w", err)
+		}
+
+		for _, v := range values {
+			data, ok := v.(string)
+			if !ok {
+				continue // Expired or deleted
+			}
+			var msg Message
+			if err := json.Unmarshal([]byte(data), &msg); err != nil || !f.Matches(&msg) {
+				continue
+			}
+			matched++
+			if matched <= offset {
+				continue
+			}
+			if len(msgs) == limit {
+				return msgs, true, nil
+			}
+			msgs = append(msgs, &msg)
+		}
+	}
+
+	return msgs, false, nil
+}
+
 // RecoverStale moves messages stuck in processing back to pending.
 // This handles cases where a worker crashed.
 func (q *RedisQueue) RecoverStale(ctx context.Context, staleThreshold time.Duration) (int, error) {
@@ -698,7 +1005,57 @@ func contains(s, substr string) bool {
 
 // Helper functions
 
-// calculateNextRetry calculates the next retry time with exponential backoff.
+// RetrySchedule sets the delay before each retry of a temporarily failed
+// message. The zero value is the built-in schedule: 5m, 15m, 30m, 1h, 2h,
+// 4h, 8h, 16h, then every 24h. Setting any of InitialDelay, Multiplier or
+// MaxInterval switches to exponential backoff, with 5m, 2 and 24h for the
+// others. Every delay is jittered by up to 10% either way.
+type RetrySchedule struct {
+	InitialDelay time.Duration // Delay after the first failure
+	Multiplier   float64       // Growth of the delay per further failure
+	MaxInterval  time.Duration // Longest delay between attempts
+	// QuickRetry, if set, replaces the first delay only, so a greylisted
+	// message is retried within minutes before the long backoff.
+	QuickRetry time.Duration
+}
+
+// custom reports whether the schedule overrides the built-in intervals.
+func (s RetrySchedule) custom() bool {
+	return s.InitialDelay > 0 || s.Multiplier > 0 || s.MaxInterval > 0
+}
+
+// NextRetry returns when to retry a message that has failed attempts times.
+func (s RetrySchedule) NextRetry(attempts int) time.Time {
+	if attempts <= 1 && s.QuickRetry > 0 {
+		return time.Now().Add(withJitter(s.QuickRetry))
+	}
+	if !s.custom() {
+		return calculateNextRetry(attempts)
+	}
+
+	initial, multiplier, maxInterval := s.InitialDelay, s.Multiplier, s.MaxInterval
+	if initial <= 0 {
+		initial = 5 * time.Minute
+	}
+	if multiplier < 1 {
+		multiplier = 2
+	}
+	if maxInterval <= 0 {
+		maxInterval = 24 * time.Hour
+	}
+
+	delay := float64(initial)
+	for i := 1; i < attempts && delay < float64(maxInterval); i++ {
+		delay *= multiplier
+	}
+	base := time.Duration(delay)
+	if base > maxInterval {
+		base = maxInterval
+	}
+	return time.Now().Add(withJitter(base))
+}
+
+// calculateNextRetry calculates the next retry time on the built-in schedule.
 func calculateNextRetry(attempts int) time.Time {
 	// Retry intervals: 5m, 15m, 30m, 1h, 2h, 4h, 8h, 16h, 24h, then every 24h
 	intervals := []time.Duration{
@@ -721,16 +1078,18 @@ func calculateNextRetry(attempts int) time.Time {
 		idx = len(intervals) - 1
 	}
 
-	base := intervals[idx]
+	return time.Now().Add(withJitter(intervals[idx]))
+}
 
-	// Add jitter: +/- 10%
-	jitterRange := int64(base / 10)
+// withJitter moves base by up to 10% either way, so retries of messages
+// that failed together don't all line up.
+func withJitter(base time.Duration) time.Duration {
+	jitterRange := int64(base / 5)
 	if jitterRange > 0 {
 		jitter := time.Duration(time.Now().UnixNano()%jitterRange) - time.Duration(jitterRange/2)
 		base += jitter
 	}
-
-	return time.Now().Add(base)
+	return base
 }
 
 // generateMessageID generates a unique message ID.
@@ -0,0 +1,257 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// SpooledQueue wraps a Queue and records the envelope of every unfinished
+// message as a JSON file in a directory. The message files themselves are
+// already on disk, so Recover can put messages a restart dropped from the
+// queue (the in-memory queue, or Redis without persistence) back into it.
+type SpooledQueue struct {
+	Queue
+	dir string
+}
+
+// NewSpooledQueue wraps q, keeping envelopes in dir.
+func NewSpooledQueue(q Queue, dir string) (*SpooledQueue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create envelope directory: %w", err)
+	}
+	return &SpooledQueue{Queue: q, dir: dir}, nil
+}
+
+// envelopePath returns where the envelope of msgID is kept.
+func (s *SpooledQueue) envelopePath(msgID string) string {
+	return filepath.Join(s.dir, msgID+".json")
+}
+
+// save writes msg's envelope atomically.
+func (s *SpooledQueue) save(msg *Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal envelope: %w", err)
+	}
+	path := s.envelopePath(msg.ID)
+	tempPath := path + ".tmp"
+	if err := os.WriteFile(tempPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write envelope: %w", err)
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to write envelope: %w", err)
+	}
+	return nil
+}
+
+// remove deletes the envelope of msgID, if any.
+func (s *SpooledQueue) remove(msgID string) error {
+	if err := os.Remove(s.envelopePath(msgID)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove envelope: %w", err)
+	}
+	return nil
+}
+
+// sync brings the envelope of msgID up to date with the queue, dropping it
+// once the message is sent or failed.
+func (s *SpooledQueue) sync(ctx context.Context, msgID string) error {
+	msg, err := s.Queue.GetMessage(ctx, msgID)
+	if errors.Is(err, ErrMessageNotFound) {
+		return s.remove(msgID)
+	}
+	if err != nil {
+		return err
+	}
+	switch msg.Status {
+	case StatusSent, StatusFailed, StatusBounced:
+		return s.remove(msgID)
+	}
+	return s.save(msg)
+}
+
+// Enqueue records the message's envelope, then adds it to the queue.
+func (s *SpooledQueue) Enqueue(ctx context.Context, msg *Message) error {
+	if msg == nil {
+		return errors.New("message is nil")
+	}
+	if msg.ID == "" {
+		msg.ID = generateMessageID()
+	}
+	if msg.CreatedAt.IsZero() {
+		msg.CreatedAt = time.Now() // Recovered messages keep their age
+	}
+	if err := s.save(msg); err != nil {
+		return err
+	}
+	if err := s.Queue.Enqueue(ctx, msg); err != nil {
+		s.remove(msg.ID)
+		return err
+	}
+	return nil
+}
+
+// Complete marks a message as delivered and drops its envelope.
+func (s *SpooledQueue) Complete(ctx context.Context, msgID string) error {
+	if err := s.Queue.Complete(ctx, msgID); err != nil {
+		return err
+	}
+	return s.remove(msgID)
+}
+
+// Fail permanently fails a message and drops its envelope.
+func (s *SpooledQueue) Fail(ctx context.Context, msgID string, reason string) error {
+	if err := s.Queue.Fail(ctx, msgID, reason); err != nil {
+		return err
+	}
+	return s.remove(msgID)
+}
+
+// Retry schedules a message for retry and records its attempt count.
+func (s *SpooledQueue) Retry(ctx context.Context, msgID string, lastError error) error {
+	if err := s.Queue.Retry(ctx, msgID, lastError); err != nil {
+		return err
+	}
+	return s.sync(ctx, msgID)
+}
+
+// Defer returns a dequeued message to pending and records its due time.
+func (s *SpooledQueue) Defer(ctx context.Context, msgID string, until time.Time) error {
+	if err := s.Queue.Defer(ctx, msgID, until); err != nil {
+		return err
+	}
+	return s.sync(ctx, msgID)
+}
+
+// Reschedule makes a message due at the given time and records it,
+// restoring the envelope of a failed message.
+func (s *SpooledQueue) Reschedule(ctx context.Context, msgID string, at time.Time) error {
+	if err := s.Queue.Reschedule(ctx, msgID, at); err != nil {
+		return err
+	}
+	return s.sync(ctx, msgID)
+}
+
+// Release sends a held message on for delivery and records it.
+func (s *SpooledQueue) Release(ctx context.Context, msgID string) error {
+	if err := s.Queue.Release(ctx, msgID); err != nil {
+		return err
+	}
+	return s.sync(ctx, msgID)
+}
+
+// RecoverStale moves messages stuck in processing back to pending, then
+// brings the envelopes up to date, since a recovered message may have
+// used up its attempts and failed.
+func (s *SpooledQueue) RecoverStale(ctx context.Context, staleThreshold time.Duration) (int, error) {
+	n, err := s.Queue.RecoverStale(ctx, staleThreshold)
+	if err != nil {
+		return n, err
+	}
+	return n, s.syncAll(ctx)
+}
+
+// Cleanup drops the envelopes of finished messages, then removes old sent
+// and failed messages from the queue.
+func (s *SpooledQueue) Cleanup(ctx context.Context, olderThan time.Duration) error {
+	if err := s.syncAll(ctx); err != nil {
+		return err
+	}
+	return s.Queue.Cleanup(ctx, olderThan)
+}
+
+// syncAll brings every envelope of a message still in the queue up to
+// date. Envelopes of messages the queue has lost are left for Recover.
+func (s *SpooledQueue) syncAll(ctx context.Context) error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read envelope directory: %w", err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		msgID := strings.TrimSuffix(name, ".json")
+		if _, err := s.Queue.GetMessage(ctx, msgID); errors.Is(err, ErrMessageNotFound) {
+			continue
+		}
+		if err := s.sync(ctx, msgID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// quarantine moves an envelope Recover can't read out of the way, into
+// the quarantine directory, so it can be looked at rather than lost.
+func (s *SpooledQueue) quarantine(name string, reason error) {
+	dir := filepath.Join(s.dir, "quarantine")
+	err := os.MkdirAll(dir, 0700)
+	if err == nil {
+		err = os.Rename(filepath.Join(s.dir, name), filepath.Join(dir, name))
+	}
+	if err != nil {
+		log.Printf("Queue: Failed to quarantine corrupt envelope %s: %v", name, err)
+		return
+	}
+	log.Printf("Queue: Moved corrupt envelope %s to %s: %v", name, dir, reason)
+}
+
+// Recover re-enqueues every recorded message that the queue no longer
+// knows about and whose message file still exists, keeping its ID and
+// attempt count; held messages stay held. Envelopes whose message file is
+// gone are dropped, and unreadable ones are quarantined. It returns how
+// many messages were re-enqueued.
+func (s *SpooledQueue) Recover(ctx context.Context) (int, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read envelope directory: %w", err)
+	}
+
+	recovered := 0
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		msgID := strings.TrimSuffix(name, ".json")
+
+		if _, err := s.Queue.GetMessage(ctx, msgID); err == nil {
+			continue // Still queued
+		} else if !errors.Is(err, ErrMessageNotFound) {
+			return recovered, err
+		}
+
+		data, err := os.ReadFile(filepath.Join(s.dir, name))
+		if err != nil {
+			return recovered, fmt.Errorf("failed to read envelope: %w", err)
+		}
+		var msg Message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			s.quarantine(name, err) // Unreadable, e.g. truncated by a crash
+			continue
+		}
+		if msg.ID != msgID {
+			s.quarantine(name, fmt.Errorf("envelope is for message %q", msg.ID))
+			continue
+		}
+		if _, err := os.Stat(msg.MessagePath); err != nil {
+			s.remove(msgID)
+			continue
+		}
+
+		if err := s.Queue.Enqueue(ctx, &msg); err != nil {
+			return recovered, fmt.Errorf("failed to re-enqueue %s: %w", msgID, err)
+		}
+		recovered++
+	}
+	return recovered, nil
+}
@@ -0,0 +1,150 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// spoolMessage writes a message file and enqueues it through s.
+func spoolMessage(t *testing.T, s *SpooledQueue, dir string) *Message {
+	t.Helper()
+	path := filepath.Join(dir, "1-abc.eml")
+	if err := os.WriteFile(path, []byte("Subject: hi\r\n\r\nhello\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	msg := &Message{Sender: "alice@example.com", Recipients: []string{"bob@example.org"}, MessagePath: path, Domain: "example.org"}
+	if err := s.Enqueue(context.Background(), msg); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+	return msg
+}
+
+func TestSpooledQueue_RecoverAfterRestart(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	envelopes := filepath.Join(dir, "envelopes")
+
+	s, err := NewSpooledQueue(newTestMemoryQueue(), envelopes)
+	if err != nil {
+		t.Fatalf("NewSpooledQueue() error = %v", err)
+	}
+	msg := spoolMessage(t, s, dir)
+	s.Dequeue(ctx)
+	s.Retry(ctx, msg.ID, errors.New("451 try later"))
+
+	// A fresh in-memory queue has lost the message but the envelope remains
+	restarted, _ := NewSpooledQueue(newTestMemoryQueue(), envelopes)
+	n, err := restarted.Recover(ctx)
+	if err != nil || n != 1 {
+		t.Fatalf("Recover() = %d, %v, want 1", n, err)
+	}
+	got, err := restarted.GetMessage(ctx, msg.ID)
+	if err != nil {
+		t.Fatalf("GetMessage() error = %v", err)
+	}
+	if got.Sender != msg.Sender || got.MessagePath != msg.MessagePath || got.Attempts != 1 || !got.CreatedAt.Equal(msg.CreatedAt) {
+		t.Errorf("recovered message = %+v", got)
+	}
+
+	// Recovering again finds it already queued
+	if n, _ := restarted.Recover(ctx); n != 0 {
+		t.Errorf("second Recover() = %d, want 0", n)
+	}
+}
+
+func TestSpooledQueue_FinishedMessagesAreNotRecovered(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	envelopes := filepath.Join(dir, "envelopes")
+
+	s, _ := NewSpooledQueue(newTestMemoryQueue(), envelopes)
+	sent := spoolMessage(t, s, dir)
+	s.Dequeue(ctx)
+	if err := s.Complete(ctx, sent.ID); err != nil {
+		t.Fatalf("Complete() error = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(envelopes, sent.ID+".json")); !os.IsNotExist(err) {
+		t.Errorf("envelope of sent message still present: %v", err)
+	}
+
+	failed := spoolMessage(t, s, dir)
+	s.Fail(ctx, failed.ID, "550 no such user")
+
+	restarted, _ := NewSpooledQueue(newTestMemoryQueue(), envelopes)
+	if n, _ := restarted.Recover(ctx); n != 0 {
+		t.Errorf("Recover() = %d, want 0", n)
+	}
+}
+
+func TestSpooledQueue_RecoverDropsMissingMessageFile(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	envelopes := filepath.Join(dir, "envelopes")
+
+	s, _ := NewSpooledQueue(newTestMemoryQueue(), envelopes)
+	msg := spoolMessage(t, s, dir)
+	os.Remove(msg.MessagePath)
+	os.WriteFile(filepath.Join(envelopes, "garbage.json"), []byte("{"), 0600)
+
+	restarted, _ := NewSpooledQueue(newTestMemoryQueue(), envelopes)
+	if n, err := restarted.Recover(ctx); err != nil || n != 0 {
+		t.Errorf("Recover() = %d, %v, want 0", n, err)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(envelopes, "*.json")); len(matches) != 0 {
+		t.Errorf("envelopes left after Recover(): %v", matches)
+	}
+
+	// The unreadable envelope is kept aside rather than deleted
+	if _, err := os.Stat(filepath.Join(envelopes, "quarantine", "garbage.json")); err != nil {
+		t.Errorf("corrupt envelope not quarantined: %v", err)
+	}
+}
+
+func TestSpooledQueue_RecoverStaleDropsFailedEnvelope(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	envelopes := filepath.Join(dir, "envelopes")
+
+	s, _ := NewSpooledQueue(newTestMemoryQueue(), envelopes)
+	path := filepath.Join(dir, "1-abc.eml")
+	os.WriteFile(path, []byte("Subject: hi\r\n\r\nhello\r\n"), 0600)
+	msg := &Message{Sender: "alice@example.com", Recipients: []string{"bob@example.org"}, MessagePath: path, Domain: "example.org", MaxAttempts: 1}
+	if err := s.Enqueue(ctx, msg); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+	s.Dequeue(ctx)
+
+	// The worker died on its only attempt, so the message fails
+	if n, err := s.RecoverStale(ctx, -time.Second); err != nil || n != 1 {
+		t.Fatalf("RecoverStale() = %d, %v, want 1", n, err)
+	}
+	if _, err := os.Stat(filepath.Join(envelopes, msg.ID+".json")); !os.IsNotExist(err) {
+		t.Errorf("envelope of failed message still present: %v", err)
+	}
+}
+
+func TestSpooledQueue_RecoverKeepsHeld(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	envelopes := filepath.Join(dir, "envelopes")
+
+	s, _ := NewSpooledQueue(newTestMemoryQueue(), envelopes)
+	path := filepath.Join(dir, "1-abc.eml")
+	os.WriteFile(path, []byte("Subject: hi\r\n\r\nhello\r\n"), 0600)
+	msg := &Message{Sender: "alice@example.com", MessagePath: path, Status: StatusHeld}
+	if err := s.Enqueue(ctx, msg); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+
+	restarted, _ := NewSpooledQueue(newTestMemoryQueue(), envelopes)
+	if n, err := restarted.Recover(ctx); err != nil || n != 1 {
+		t.Fatalf("Recover() = %d, %v, want 1", n, err)
+	}
+	if got, _ := restarted.GetMessage(ctx, msg.ID); got.Status != StatusHeld {
+		t.Errorf("recovered status = %s, want held", got.Status)
+	}
+}
@@ -8,7 +8,9 @@ import (
 	"encoding/pem"
 	"fmt"
 	"io"
+	"maps"
 	"os"
+	"slices"
 	"strings"
 
 	"github.com/emersion/go-msgauth/dkim"
@@ -79,31 +81,75 @@ func (s *DKIMSigner) Sign(w io.Writer, r io.Reader) error {
 	return dkim.Sign(w, r, options)
 }
 
-// DKIMSignerPool manages DKIM signers for multiple domains
+// Selector returns the selector the signer signs with
+func (s *DKIMSigner) Selector() string {
+	return s.selector
+}
+
+// PublicKey returns the public half of the signing key, for publishing
+func (s *DKIMSigner) PublicKey() *rsa.PublicKey {
+	return &s.privateKey.PublicKey
+}
+
+// DKIMSignerPool manages DKIM signers for multiple domains. A domain can
+// have several selectors loaded, so a new key can be published before it
+// takes over signing; one of them is active and signs outbound mail.
 type DKIMSignerPool struct {
-	signers map[string]*DKIMSigner
+	signers map[string]map[string]*DKIMSigner // Domain, then selector
+	active  map[string]string                 // Domain to signing selector
 }
 
 // NewDKIMSignerPool creates a new pool of DKIM signers
 func NewDKIMSignerPool() *DKIMSignerPool {
 	return &DKIMSignerPool{
-		signers: make(map[string]*DKIMSigner),
+		signers: make(map[string]map[string]*DKIMSigner),
+		active:  make(map[string]string),
 	}
 }
 
-// AddSigner adds a DKIM signer for a domain
+// AddSigner adds a DKIM signer for a domain and selector. The first
+// selector added for a domain is its active one until SetActive changes it.
 func (p *DKIMSignerPool) AddSigner(domain, selector, keyPath string) error {
 	signer, err := NewDKIMSigner(domain, selector, keyPath)
 	if err != nil {
 		return err
 	}
-	p.signers[strings.ToLower(domain)] = signer
+	domain = strings.ToLower(domain)
+	if p.signers[domain] == nil {
+		p.signers[domain] = make(map[string]*DKIMSigner)
+	}
+	p.signers[domain][selector] = signer
+	if _, ok := p.active[domain]; !ok {
+		p.active[domain] = selector
+	}
 	return nil
 }
 
-// GetSigner returns the DKIM signer for a domain
+// SetActive makes selector, which must have been added, the one that signs
+// a domain's mail
+func (p *DKIMSignerPool) SetActive(domain, selector string) error {
+	domain = strings.ToLower(domain)
+	if p.signers[domain][selector] == nil {
+		return fmt.Errorf("no DKIM key for selector %s of domain %s", selector, domain)
+	}
+	p.active[domain] = selector
+	return nil
+}
+
+// GetSigner returns the active DKIM signer for a domain
 func (p *DKIMSignerPool) GetSigner(domain string) *DKIMSigner {
-	return p.signers[strings.ToLower(domain)]
+	domain = strings.ToLower(domain)
+	return p.signers[domain][p.active[domain]]
+}
+
+// Signers returns every DKIM signer loaded for a domain, sorted by selector
+func (p *DKIMSignerPool) Signers(domain string) []*DKIMSigner {
+	bySelector := p.signers[strings.ToLower(domain)]
+	signers := make([]*DKIMSigner, 0, len(bySelector))
+	for _, selector := range slices.Sorted(maps.Keys(bySelector)) {
+		signers = append(signers, bySelector[selector])
+	}
+	return signers
 }
 
 // Sign signs a message using the appropriate domain signer
@@ -325,3 +325,55 @@ func TestDKIMSigner_PKCS8Key(t *testing.T) {
 		t.Error("Expected non-nil private key")
 	}
 }
+
+func TestDKIMSignerPool_MultipleSelectors(t *testing.T) {
+	oldPath, _ := generateTestKey(t)
+	defer os.Remove(oldPath)
+
+	newPath, newKey := generateTestKey(t)
+	defer os.Remove(newPath)
+
+	pool := NewDKIMSignerPool()
+	if err := pool.AddSigner("example.com", "2025", oldPath); err != nil {
+		t.Fatalf("AddSigner failed: %v", err)
+	}
+	if err := pool.AddSigner("example.com", "2026", newPath); err != nil {
+		t.Fatalf("AddSigner failed: %v", err)
+	}
+
+	// Both selectors are loaded, in selector order
+	signers := pool.Signers("example.com")
+	if len(signers) != 2 || signers[0].Selector() != "2025" || signers[1].Selector() != "2026" {
+		t.Fatalf("Expected selectors 2025 and 2026, got %d signers", len(signers))
+	}
+
+	// The first selector added signs until another is made active
+	if got := pool.GetSigner("example.com").Selector(); got != "2025" {
+		t.Errorf("Expected active selector 2025, got %s", got)
+	}
+
+	if err := pool.SetActive("example.com", "2026"); err != nil {
+		t.Fatalf("SetActive failed: %v", err)
+	}
+	if err := pool.SetActive("example.com", "missing"); err == nil {
+		t.Error("Expected error activating an unknown selector")
+	}
+
+	signer := pool.GetSigner("EXAMPLE.COM")
+	if signer.Selector() != "2026" {
+		t.Errorf("Expected active selector 2026, got %s", signer.Selector())
+	}
+	if !signer.PublicKey().Equal(&newKey.PublicKey) {
+		t.Error("Expected active signer to use the 2026 key")
+	}
+
+	email := "From: sender@example.com\r\nTo: recipient@example.com\r\nSubject: Test\r\n\r\nBody\r\n"
+	var buf bytes.Buffer
+	if err := pool.Sign("example.com", &buf, strings.NewReader(email)); err != nil {
+		t.Fatalf("Pool Sign failed: %v", err)
+	}
+	header := strings.SplitN(buf.String(), "\r\n\r\n", 2)[0]
+	if !strings.Contains(header, "s=2026;") {
+		t.Errorf("Expected signature with selector 2026, got:\n%s", header)
+	}
+}
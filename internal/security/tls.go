@@ -3,6 +3,9 @@ package security
 import (
 	"crypto/tls"
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/fenilsonani/email-server/internal/config"
 	"golang.org/x/crypto/acme/autocert"
@@ -13,8 +16,16 @@ type TLSManager struct {
 	config      *config.Config
 	certManager *autocert.Manager
 	tlsConfig   *tls.Config
+	hostCerts   map[string]*tls.Certificate // By lowercase hostname, from tls.cert_dir
 }
 
+// Files a hostname's certificate is loaded from within tls.cert_dir, as
+// certbot lays them out
+const (
+	hostCertFile = "fullchain.pem"
+	hostKeyFile  = "privkey.pem"
+)
+
 // NewTLSManager creates a new TLS manager
 func NewTLSManager(cfg *config.Config) (*TLSManager, error) {
 	manager := &TLSManager{config: cfg}
@@ -38,27 +49,79 @@ func NewTLSManager(cfg *config.Config) (*TLSManager, error) {
 
 		manager.tlsConfig = &tls.Config{
 			Certificates: []tls.Certificate{cert},
-			MinVersion:   tls.VersionTLS12,
+		}
+
+		// Hostnames with their own certificate are picked by SNI; the
+		// others get cert_file
+		if cfg.TLS.CertDir != "" {
+			manager.hostCerts, err = loadHostCertificates(cfg.TLS.CertDir)
+			if err != nil {
+				return nil, err
+			}
+			manager.tlsConfig.GetCertificate = manager.getCertificate
 		}
 	}
 
-	// Set secure defaults if TLS is configured
+	// Apply the configured version and cipher policy if TLS is configured
 	if manager.tlsConfig != nil {
-		manager.tlsConfig.MinVersion = tls.VersionTLS12
-		manager.tlsConfig.PreferServerCipherSuites = true
-		manager.tlsConfig.CipherSuites = []uint16{
-			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
-			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
-			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
-			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
-			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		if err := applyTLSPolicy(manager.tlsConfig, cfg.TLS); err != nil {
+			return nil, err
 		}
 	}
 
 	return manager, nil
 }
 
+// loadHostCertificates loads the certificate of each hostname that has a
+// directory in dir. Directories without a certificate are skipped.
+func loadHostCertificates(dir string) (map[string]*tls.Certificate, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read TLS certificate directory: %w", err)
+	}
+
+	certs := make(map[string]*tls.Certificate)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		certFile := filepath.Join(dir, entry.Name(), hostCertFile)
+		if _, err := os.Stat(certFile); os.IsNotExist(err) {
+			continue
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, filepath.Join(dir, entry.Name(), hostKeyFile))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS certificate for %s: %w", entry.Name(), err)
+		}
+		certs[strings.ToLower(entry.Name())] = &cert
+	}
+	return certs, nil
+}
+
+// getCertificate returns the certificate of the hostname the client asked
+// for with SNI, or nil for the default certificate
+func (m *TLSManager) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	return m.hostCerts[name], nil
+}
+
+// applyTLSPolicy sets the minimum version and TLS 1.2 cipher suites. Every
+// listener shares the manager's config, so this covers all of them.
+func applyTLSPolicy(tlsConfig *tls.Config, policy config.TLSConfig) error {
+	version, err := policy.Version()
+	if err != nil {
+		return fmt.Errorf("tls.min_version: %w", err)
+	}
+	suites, err := policy.Suites()
+	if err != nil {
+		return fmt.Errorf("tls.cipher_suites: %w", err)
+	}
+	tlsConfig.MinVersion = version
+	tlsConfig.CipherSuites = suites
+	tlsConfig.PreferServerCipherSuites = true
+	return nil
+}
+
 // TLSConfig returns the TLS configuration
 func (m *TLSManager) TLSConfig() *tls.Config {
 	return m.tlsConfig
@@ -0,0 +1,204 @@
+package security
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/fenilsonani/email-server/internal/config"
+)
+
+// writeTestCertificate writes a self-signed certificate and key for
+// 127.0.0.1 and returns their paths
+func writeTestCertificate(t *testing.T) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writeCertificate(t, certFile, keyFile, "")
+	return certFile, keyFile
+}
+
+// writeCertificate writes a self-signed certificate and key for 127.0.0.1
+// and, if set, hostname, which is also its common name
+func writeCertificate(t *testing.T, certFile, keyFile, hostname string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: hostname},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	if hostname != "" {
+		tmpl.DNSNames = []string{hostname}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// handshake connects a client with clientCfg to a listener serving serverCfg
+func handshake(t *testing.T, serverCfg, clientCfg *tls.Config) error {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", serverCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		conn.(*tls.Conn).Handshake()
+		conn.Close()
+	}()
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), clientCfg)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func TestTLSManager_MinVersion(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t)
+	cfg := config.DefaultConfig()
+	cfg.TLS.CertFile = certFile
+	cfg.TLS.KeyFile = keyFile
+	cfg.TLS.MinVersion = "1.2"
+
+	manager, err := NewTLSManager(cfg)
+	if err != nil {
+		t.Fatalf("NewTLSManager() error = %v", err)
+	}
+	if got := manager.TLSConfig().MinVersion; got != tls.VersionTLS12 {
+		t.Errorf("MinVersion = %x, want %x", got, tls.VersionTLS12)
+	}
+
+	tls10 := &tls.Config{InsecureSkipVerify: true, MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS10}
+	if err := handshake(t, manager.TLSConfig(), tls10); err == nil {
+		t.Error("TLS 1.0 client completed a handshake with min_version 1.2")
+	}
+	tls12 := &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12}
+	if err := handshake(t, manager.TLSConfig(), tls12); err != nil {
+		t.Errorf("TLS 1.2 handshake error = %v", err)
+	}
+}
+
+func TestTLSManager_CipherSuites(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t)
+	cfg := config.DefaultConfig()
+	cfg.TLS.CertFile = certFile
+	cfg.TLS.KeyFile = keyFile
+
+	manager, err := NewTLSManager(cfg)
+	if err != nil {
+		t.Fatalf("NewTLSManager() error = %v", err)
+	}
+	if got := manager.TLSConfig().CipherSuites; !slices.Contains(got, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256) {
+		t.Errorf("default CipherSuites = %v, want the modern suites", got)
+	}
+
+	cfg.TLS.CipherSuites = []string{"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256"}
+	manager, err = NewTLSManager(cfg)
+	if err != nil {
+		t.Fatalf("NewTLSManager() error = %v", err)
+	}
+	want := []uint16{tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305}
+	if got := manager.TLSConfig().CipherSuites; !slices.Equal(got, want) {
+		t.Errorf("CipherSuites = %v, want %v", got, want)
+	}
+
+	cfg.TLS.CipherSuites = []string{"TLS_RSA_WITH_RC4_128_SHA"}
+	if _, err := NewTLSManager(cfg); err == nil {
+		t.Error("NewTLSManager() accepted an insecure cipher suite")
+	}
+}
+
+func TestTLSManager_SNICertificates(t *testing.T) {
+	dir := t.TempDir()
+	writeCertificate(t, filepath.Join(dir, "default.pem"), filepath.Join(dir, "default.key"), "mail.example.com")
+	certDir := filepath.Join(dir, "live")
+	for _, host := range []string{"mail.domain-a.com", "mail.domain-b.com"} {
+		if err := os.MkdirAll(filepath.Join(certDir, host), 0700); err != nil {
+			t.Fatal(err)
+		}
+		writeCertificate(t, filepath.Join(certDir, host, "fullchain.pem"), filepath.Join(certDir, host, "privkey.pem"), host)
+	}
+	// Not a hostname directory, as certbot leaves next to them
+	if err := os.WriteFile(filepath.Join(certDir, "README"), []byte("certs"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.DefaultConfig()
+	cfg.TLS.CertFile = filepath.Join(dir, "default.pem")
+	cfg.TLS.KeyFile = filepath.Join(dir, "default.key")
+	cfg.TLS.CertDir = certDir
+	manager, err := NewTLSManager(cfg)
+	if err != nil {
+		t.Fatalf("NewTLSManager() error = %v", err)
+	}
+
+	tests := []struct {
+		serverName, want string
+	}{
+		{"mail.domain-b.com", "mail.domain-b.com"},
+		{"MAIL.Domain-A.com", "mail.domain-a.com"},
+		{"mail.unknown.com", "mail.example.com"},
+		{"", "mail.example.com"},
+	}
+	for _, tt := range tests {
+		ln, err := tls.Listen("tcp", "127.0.0.1:0", manager.TLSConfig())
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}()
+
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true, ServerName: tt.serverName})
+		ln.Close()
+		if err != nil {
+			t.Fatalf("handshake with SNI %q error = %v", tt.serverName, err)
+		}
+		got := conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+		conn.Close()
+		if got != tt.want {
+			t.Errorf("SNI %q got the certificate of %q, want %q", tt.serverName, got, tt.want)
+		}
+	}
+}
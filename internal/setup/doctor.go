@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/tls"
 	"database/sql"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
@@ -12,7 +13,9 @@ import (
 	"strings"
 	"time"
 
+	"github.com/fenilsonani/email-server/internal/auth"
 	"github.com/fenilsonani/email-server/internal/config"
+	"github.com/fenilsonani/email-server/internal/smtp"
 )
 
 // DoctorResults contains all doctor check results
@@ -38,6 +41,7 @@ func RunDoctor(cfg *config.Config) *DoctorResults {
 		checkDNSRecords,
 		checkDiskSpaceDoctor,
 		checkMaildirPermissions,
+		checkOpenRelay,
 	}
 
 	for _, check := range checks {
@@ -63,7 +67,7 @@ func RunDoctor(cfg *config.Config) *DoctorResults {
 func (r *DoctorResults) Print() {
 	fmt.Println("\n━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
 	fmt.Println("                    HEALTH CHECK")
-	fmt.Println("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━\n")
+	fmt.Print("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━\n\n")
 
 	for _, check := range r.Checks {
 		icon := "✓"
@@ -208,6 +212,14 @@ func checkDatabaseConnection(cfg *config.Config) CheckResult {
 }
 
 func checkRedisConnection(cfg *config.Config) CheckResult {
+	if cfg.Queue.Backend == "memory" {
+		return CheckResult{
+			Name:    "Redis",
+			Status:  "pass",
+			Message: "Not used (in-memory queue)",
+		}
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
@@ -470,3 +482,50 @@ func checkMaildirPermissions(cfg *config.Config) CheckResult {
 	}
 }
 
+// checkOpenRelay runs the SMTP session logic for an unauthenticated client
+// outside smtp.relay_networks and fails if it could send to a remote domain
+func checkOpenRelay(cfg *config.Config) CheckResult {
+	db, err := openDatabaseReadOnly(cfg.Storage.DatabasePath)
+	if err != nil {
+		return CheckResult{
+			Name:    "Open Relay",
+			Status:  "warn",
+			Message: "Cannot open database to run the relay test",
+			Help:    err.Error(),
+		}
+	}
+	defer db.Close()
+
+	err = smtp.CheckOpenRelay(cfg, auth.NewAuthenticator(db))
+	if errors.Is(err, smtp.ErrRelayCheckInconclusive) {
+		return CheckResult{
+			Name:    "Open Relay",
+			Status:  "warn",
+			Message: "Relay test got a temporary failure",
+			Help:    err.Error(),
+		}
+	}
+	if err != nil {
+		return CheckResult{
+			Name:    "Open Relay",
+			Status:  "fail",
+			Message: err.Error(),
+			Help:    "Narrow smtp.relay_networks to the hosts that must relay without AUTH",
+		}
+	}
+
+	return CheckResult{
+		Name:    "Open Relay",
+		Status:  "pass",
+		Message: "Unauthenticated mail to remote domains is refused",
+	}
+}
+
+// openDatabaseReadOnly opens the existing database at path without
+// creating it or writing to it
+func openDatabaseReadOnly(path string) (*sql.DB, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	return sql.Open("sqlite3", "file:"+path+"?mode=ro")
+}
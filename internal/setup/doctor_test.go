@@ -0,0 +1,40 @@
+package setup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fenilsonani/email-server/internal/config"
+	"github.com/fenilsonani/email-server/internal/storage/metadata"
+)
+
+func TestCheckOpenRelay(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.Storage.DatabasePath = filepath.Join(t.TempDir(), "mail.db")
+	if got := checkOpenRelay(cfg); got.Status != "warn" {
+		t.Errorf("checkOpenRelay() without a database = %+v, want warn", got)
+	}
+	if _, err := os.Stat(cfg.Storage.DatabasePath); !os.IsNotExist(err) {
+		t.Errorf("checkOpenRelay() created the database, stat error = %v", err)
+	}
+
+	db, err := metadata.Open(cfg.Storage.DatabasePath)
+	if err != nil {
+		t.Fatalf("metadata.Open() error = %v", err)
+	}
+	defer db.Close()
+	if err := db.Migrate(context.Background()); err != nil {
+		t.Fatalf("Migrate() error = %v", err)
+	}
+
+	if got := checkOpenRelay(cfg); got.Status != "pass" {
+		t.Errorf("checkOpenRelay() = %+v, want pass", got)
+	}
+
+	cfg.SMTP.RelayNetworks = []string{"0.0.0.0/0", "::/0"}
+	if got := checkOpenRelay(cfg); got.Status != "fail" {
+		t.Errorf("checkOpenRelay() trusting every address = %+v, want fail", got)
+	}
+}
@@ -2,6 +2,7 @@ package setup
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"os"
@@ -39,6 +40,8 @@ func RunPreflightWithOptions(force bool) *PreflightResults {
 
 	checks := []func() CheckResult{
 		checkRoot,
+		checkPortPrivilege,
+		checkDirectories,
 		checkOS,
 		checkMemory,
 		checkDiskSpace,
@@ -49,6 +52,7 @@ func RunPreflightWithOptions(force bool) *PreflightResults {
 		checkPort993,
 		checkPort25Outbound,
 		checkRedis,
+		checkSQLite,
 		checkGo,
 		checkSystemd,
 	}
@@ -93,7 +97,7 @@ func RunPreflightWithOptions(force bool) *PreflightResults {
 func (r *PreflightResults) Print() {
 	fmt.Println("\n━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
 	fmt.Println("                    PREFLIGHT CHECK")
-	fmt.Println("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━\n")
+	fmt.Print("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━\n\n")
 
 	for _, check := range r.Checks {
 		icon := "✓"
@@ -111,7 +115,7 @@ func (r *PreflightResults) Print() {
 		if check.Message != "" {
 			fmt.Printf("  %s\n", check.Message)
 		}
-		if check.Status == "fail" && check.Help != "" {
+		if check.Status != "pass" && check.Help != "" {
 			fmt.Printf("  → %s\n", check.Help)
 		}
 		fmt.Println()
@@ -129,22 +133,6 @@ func (r *PreflightResults) Print() {
 	fmt.Println("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
 }
 
-func checkRoot() CheckResult {
-	if os.Geteuid() == 0 {
-		return CheckResult{
-			Name:    "Running as root",
-			Status:  "pass",
-			Message: "Root access available for system setup",
-		}
-	}
-	return CheckResult{
-		Name:    "Running as root",
-		Status:  "fail",
-		Message: "Not running as root",
-		Help:    "Run with sudo or as root user",
-	}
-}
-
 func checkOS() CheckResult {
 	if runtime.GOOS != "linux" {
 		return CheckResult{
@@ -284,6 +272,14 @@ func checkPortAvailable(port int, name string) CheckResult {
 				Help:    "Make sure no other service is using this port",
 			}
 		}
+		if errors.Is(err, os.ErrPermission) {
+			return CheckResult{
+				Name:    fmt.Sprintf("Port %d (%s)", port, name),
+				Status:  "fail",
+				Message: "Permission denied binding the port",
+				Help:    "See Port Privileges above",
+			}
+		}
 		return CheckResult{
 			Name:    fmt.Sprintf("Port %d (%s)", port, name),
 			Status:  "fail",
@@ -371,10 +367,11 @@ func checkGo() CheckResult {
 	cmd := exec.Command("go", "version")
 	output, err := cmd.Output()
 	if err != nil {
+		// Only needed to build from source; a prebuilt binary runs without it
 		return CheckResult{
 			Name:    "Go Compiler",
-			Status:  "fail",
-			Message: "Go not installed",
+			Status:  "warn",
+			Message: "Go not installed (only needed to build from source)",
 			Help:    "Install Go: https://golang.org/dl/",
 		}
 	}
@@ -0,0 +1,188 @@
+package setup
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/fenilsonani/email-server/internal/storage/metadata"
+)
+
+// capNetBindService is the bit for CAP_NET_BIND_SERVICE in a capability mask
+const capNetBindService = 10
+
+// privileges describes what the current process may do
+type privileges struct {
+	EUID int
+	// NetBindCap is true when CAP_NET_BIND_SERVICE is in the effective set
+	NetBindCap bool
+	// UnprivilegedPortStart is net.ipv4.ip_unprivileged_port_start, the
+	// lowest port any user may bind
+	UnprivilegedPortStart int
+}
+
+// probePrivileges reads the current process's privileges. It is a variable
+// so tests can stub the capability probe.
+var probePrivileges = func() privileges {
+	p := privileges{EUID: os.Geteuid(), UnprivilegedPortStart: 1024}
+	if data, err := os.ReadFile("/proc/self/status"); err == nil {
+		if caps, ok := parseCapEff(string(data)); ok {
+			p.NetBindCap = caps&(1<<capNetBindService) != 0
+		}
+	}
+	if data, err := os.ReadFile("/proc/sys/net/ipv4/ip_unprivileged_port_start"); err == nil {
+		if n, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil {
+			p.UnprivilegedPortStart = n
+		}
+	}
+	return p
+}
+
+// parseCapEff extracts the effective capability mask from /proc/<pid>/status
+func parseCapEff(status string) (uint64, bool) {
+	for _, line := range strings.Split(status, "\n") {
+		if v, ok := strings.CutPrefix(line, "CapEff:"); ok {
+			caps, err := strconv.ParseUint(strings.TrimSpace(v), 16, 64)
+			return caps, err == nil
+		}
+	}
+	return 0, false
+}
+
+// mailPorts are the privileged ports the server listens on
+var mailPorts = []int{25, 143, 465, 587, 993}
+
+// remediationHint explains how to re-run as root. sudo's secure_path often
+// leaves out the directory mailserver was installed to, so pass the full path.
+const remediationHint = "Re-run as root: sudo \"$(command -v mailserver)\" preflight"
+
+func checkRoot() CheckResult {
+	if os.Geteuid() == 0 {
+		return CheckResult{
+			Name:    "Running as root",
+			Status:  "pass",
+			Message: "Root access available for system setup",
+		}
+	}
+	return CheckResult{
+		Name:    "Running as root",
+		Status:  "fail",
+		Message: fmt.Sprintf("Running as uid %d; setup creates the mailserver user, writes /etc/mailserver and installs a systemd unit", os.Geteuid()),
+		Help:    remediationHint,
+	}
+}
+
+func checkPortPrivilege() CheckResult {
+	return portPrivilegeCheck(probePrivileges())
+}
+
+// portPrivilegeCheck reports whether the process may bind the mail ports,
+// all of which are below 1024
+func portPrivilegeCheck(p privileges) CheckResult {
+	result := CheckResult{Name: "Port Privileges", Status: "pass"}
+	lowest := mailPorts[0]
+	for _, port := range mailPorts {
+		lowest = min(lowest, port)
+	}
+
+	switch {
+	case p.EUID == 0:
+		result.Message = "Root may bind ports below 1024"
+	case p.NetBindCap:
+		result.Message = "CAP_NET_BIND_SERVICE is set"
+	case p.UnprivilegedPortStart <= lowest:
+		result.Message = fmt.Sprintf("Unprivileged ports start at %d", p.UnprivilegedPortStart)
+	default:
+		result.Status = "fail"
+		result.Message = fmt.Sprintf("Cannot bind ports below %d as uid %d without CAP_NET_BIND_SERVICE", p.UnprivilegedPortStart, p.EUID)
+		result.Help = "Run as root, or grant the capability: sudo setcap cap_net_bind_service=+ep \"$(command -v mailserver)\""
+	}
+	return result
+}
+
+// setupDirs are the directories setup writes to
+var setupDirs = []string{"/var/lib/mailserver", "/etc/mailserver"}
+
+func checkDirectories() CheckResult {
+	var problems []string
+	for _, dir := range setupDirs {
+		if err := checkWritable(dir); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		return CheckResult{
+			Name:    "Writable Directories",
+			Status:  "fail",
+			Message: strings.Join(problems, "; "),
+			Help:    remediationHint,
+		}
+	}
+	return CheckResult{
+		Name:    "Writable Directories",
+		Status:  "pass",
+		Message: strings.Join(setupDirs, ", ") + " can be written",
+	}
+}
+
+// checkWritable reports whether dir, or the nearest existing parent it would
+// be created under, accepts new files
+func checkWritable(dir string) error {
+	existing := dir
+	for {
+		info, err := os.Stat(existing)
+		if err == nil {
+			if !info.IsDir() {
+				return fmt.Errorf("%s is not a directory", existing)
+			}
+			break
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("%s: %w", existing, err)
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return fmt.Errorf("%s: no existing parent directory", dir)
+		}
+		existing = parent
+	}
+
+	f, err := os.CreateTemp(existing, ".preflight-*")
+	if err != nil {
+		if errors.Is(err, os.ErrPermission) {
+			return fmt.Errorf("%s is not writable", existing)
+		}
+		return fmt.Errorf("%s: %w", existing, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+func checkSQLite() CheckResult {
+	dir, err := os.MkdirTemp("", "mailserver-preflight-")
+	if err == nil {
+		defer os.RemoveAll(dir)
+		var db *metadata.DB
+		db, err = metadata.Open(filepath.Join(dir, "preflight.db"))
+		if err == nil {
+			defer db.Close()
+			var version string
+			if err = db.QueryRow("SELECT sqlite_version()").Scan(&version); err == nil {
+				return CheckResult{
+					Name:    "SQLite",
+					Status:  "pass",
+					Message: "SQLite " + version + " with WAL journaling",
+				}
+			}
+		}
+	}
+	return CheckResult{
+		Name:    "SQLite",
+		Status:  "fail",
+		Message: err.Error(),
+		Help:    "Rebuild mailserver with CGO_ENABLED=1 and a C compiler (apt install gcc)",
+	}
+}
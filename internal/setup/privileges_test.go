@@ -0,0 +1,76 @@
+package setup
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPortPrivilegeCheck(t *testing.T) {
+	tests := []struct {
+		name string
+		p    privileges
+		want string
+	}{
+		{"root", privileges{EUID: 0, UnprivilegedPortStart: 1024}, "pass"},
+		{"capability", privileges{EUID: 1000, NetBindCap: true, UnprivilegedPortStart: 1024}, "pass"},
+		{"sysctl lowered", privileges{EUID: 1000, UnprivilegedPortStart: 25}, "pass"},
+		{"sysctl above smtp", privileges{EUID: 1000, UnprivilegedPortStart: 80}, "fail"},
+		{"unprivileged", privileges{EUID: 1000, UnprivilegedPortStart: 1024}, "fail"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := portPrivilegeCheck(tt.p)
+			if got.Status != tt.want {
+				t.Errorf("Status = %q, want %q (%s)", got.Status, tt.want, got.Message)
+			}
+			if got.Status == "fail" && !strings.Contains(got.Help, "setcap") {
+				t.Errorf("Help = %q, want a setcap remediation", got.Help)
+			}
+		})
+	}
+}
+
+func TestCheckPortPrivilegeUsesProbe(t *testing.T) {
+	orig := probePrivileges
+	t.Cleanup(func() { probePrivileges = orig })
+
+	probePrivileges = func() privileges { return privileges{EUID: 1000, UnprivilegedPortStart: 1024} }
+	if got := checkPortPrivilege(); got.Status != "fail" {
+		t.Errorf("without capability: Status = %q, want fail", got.Status)
+	}
+	probePrivileges = func() privileges { return privileges{EUID: 1000, NetBindCap: true, UnprivilegedPortStart: 1024} }
+	if got := checkPortPrivilege(); got.Status != "pass" {
+		t.Errorf("with capability: Status = %q, want pass", got.Status)
+	}
+}
+
+func TestParseCapEff(t *testing.T) {
+	status := "Name:\tmailserver\nCapInh:\t0000000000000000\nCapEff:\t0000000000000400\n"
+	caps, ok := parseCapEff(status)
+	if !ok {
+		t.Fatal("parseCapEff() found no CapEff line")
+	}
+	if caps&(1<<capNetBindService) == 0 {
+		t.Errorf("caps = %#x, want CAP_NET_BIND_SERVICE set", caps)
+	}
+	if _, ok := parseCapEff("Name:\tmailserver\n"); ok {
+		t.Error("parseCapEff() without CapEff should report !ok")
+	}
+}
+
+func TestCheckWritableWalksToExistingParent(t *testing.T) {
+	dir := t.TempDir()
+	if err := checkWritable(filepath.Join(dir, "lib", "mailserver")); err != nil {
+		t.Errorf("checkWritable(missing under writable dir) error = %v", err)
+	}
+
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkWritable(filepath.Join(file, "sub")); err == nil {
+		t.Error("checkWritable() under a regular file should fail")
+	}
+}
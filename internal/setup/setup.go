@@ -2,10 +2,12 @@ package setup
 
 import (
 	"bufio"
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"net"
 	"os"
@@ -14,7 +16,11 @@ import (
 	"strconv"
 	"strings"
 
-	"golang.org/x/crypto/bcrypt"
+	"github.com/fenilsonani/email-server/internal/auth"
+	"github.com/fenilsonani/email-server/internal/config"
+	"github.com/fenilsonani/email-server/internal/provision"
+	"github.com/fenilsonani/email-server/internal/storage/maildir"
+	"github.com/fenilsonani/email-server/internal/storage/metadata"
 	"gopkg.in/yaml.v3"
 )
 
@@ -30,14 +36,42 @@ type SetupConfig struct {
 	UseExisting bool
 }
 
+// databasePath is where the generated config points storage.database_path
+func (c *SetupConfig) databasePath() string {
+	return c.DataDir + "/mail.db"
+}
+
+// serverConfig is the server configuration generateConfig writes, for the
+// steps that set up the server in-process
+func (c *SetupConfig) serverConfig() *config.Config {
+	serverCfg := config.DefaultConfig()
+	serverCfg.Server.Hostname = c.Hostname
+	serverCfg.Server.Domain = c.Domain
+	serverCfg.Domains = []config.DomainConfig{{Name: c.Domain}}
+	serverCfg.Storage.DatabasePath = c.databasePath()
+	serverCfg.Storage.MaildirPath = c.DataDir + "/maildir"
+	return serverCfg
+}
+
 // Step represents a setup step
 type Step struct {
 	Name     string
 	Action   func(*SetupConfig) error
 	Verify   func(*SetupConfig) error
 	Rollback func(*SetupConfig) error
+	// Done reports whether the step's result already exists on the system,
+	// such as from an earlier install, so Action can be skipped
+	Done func(*SetupConfig) bool
 }
 
+// StepStatus is the outcome of one step in a setup run
+type StepStatus string
+
+const (
+	StepCreated StepStatus = "created"
+	StepSkipped StepStatus = "skipped"
+)
+
 // RunSetup runs the interactive setup wizard
 func RunSetup() error {
 	return RunSetupWithOptions(false)
@@ -47,10 +81,10 @@ func RunSetup() error {
 func RunSetupWithOptions(force bool) error {
 	fmt.Println("\n━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
 	fmt.Println("              MAIL SERVER SETUP WIZARD")
-	fmt.Println("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━\n")
+	fmt.Print("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━\n\n")
 
 	// First run preflight
-	fmt.Println("Running preflight checks...\n")
+	fmt.Print("Running preflight checks...\n\n")
 	preflight := RunPreflightWithOptions(force)
 
 	if !preflight.Ready {
@@ -63,9 +97,9 @@ func RunSetupWithOptions(force bool) error {
 
 	if force && preflight.Failed > 0 {
 		preflight.Print()
-		fmt.Println("\033[33m! Some checks failed but --force was used, continuing...\033[0m\n")
+		fmt.Print("\033[33m! Some checks failed but --force was used, continuing...\033[0m\n\n")
 	} else {
-		fmt.Println("\033[32m✓ Preflight checks passed!\033[0m\n")
+		fmt.Print("\033[32m✓ Preflight checks passed!\033[0m\n\n")
 	}
 
 	// Gather configuration
@@ -139,40 +173,144 @@ func RunSetupWithOptions(force bool) error {
 
 	// Run setup steps
 	steps := []Step{
-		{Name: "Create system user", Action: createSystemUser, Verify: verifySystemUser},
+		{Name: "Create system user", Action: createSystemUser, Verify: verifySystemUser, Done: systemUserExists},
 		{Name: "Create directories", Action: createDirectories, Verify: verifyDirectories},
-		{Name: "Generate configuration", Action: generateConfig, Verify: verifyConfig},
-		{Name: "Generate DKIM keys", Action: generateDKIM, Verify: verifyDKIM},
+		{Name: "Generate configuration", Action: generateConfig, Verify: verifyConfig, Done: configExists},
+		{Name: "Generate DKIM keys", Action: generateDKIM, Verify: verifyDKIM, Done: dkimKeyExists},
 		{Name: "Initialize database", Action: initDatabase, Verify: verifyDatabase},
-		{Name: "Create admin user", Action: createAdminUser, Verify: verifyAdminUser},
+		{Name: "Create admin user", Action: createAdminUser, Verify: verifyAdminUser, Done: adminUserExists},
 		{Name: "Install systemd service", Action: installSystemd, Verify: verifySystemd},
 		{Name: "Start service", Action: startService, Verify: verifyService},
 	}
 
-	fmt.Println("\n")
+	fmt.Print("\n\n")
+
+	if _, err := runSteps(cfg, steps); err != nil {
+		return err
+	}
 
+	// Print success and next steps
+	printSuccess(cfg)
+
+	return nil
+}
+
+// statePath records the steps completed so far, so a setup that failed part
+// way through resumes at the failed step when re-run
+func (c *SetupConfig) statePath() string {
+	return c.DataDir + "/.setup-state"
+}
+
+// loadState returns the names of steps completed by earlier runs
+func loadState(cfg *SetupConfig) (map[string]bool, error) {
+	data, err := os.ReadFile(cfg.statePath())
+	if os.IsNotExist(err) {
+		return map[string]bool{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read setup state: %w", err)
+	}
+	done := make(map[string]bool)
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			done[line] = true
+		}
+	}
+	return done, nil
+}
+
+// markDone appends a completed step to the state file
+func markDone(cfg *SetupConfig, name string) error {
+	if err := os.MkdirAll(cfg.DataDir, 0750); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(cfg.statePath(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to record setup state: %w", err)
+	}
+	defer f.Close()
+	_, err = fmt.Fprintln(f, name)
+	return err
+}
+
+// runSteps runs each step in order and reports it as created or skipped.
+// A step is skipped when an earlier run recorded it as complete or its Done
+// check finds it already in place, as long as it still verifies; otherwise
+// its Action runs again.
+func runSteps(cfg *SetupConfig, steps []Step) ([]StepStatus, error) {
+	done, err := loadState(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]StepStatus, 0, len(steps))
 	for i, step := range steps {
 		fmt.Printf("[%d/%d] %s...\n", i+1, len(steps), step.Name)
 
-		if err := step.Action(cfg); err != nil {
-			fmt.Printf("\033[31m    ✗ Failed: %s\033[0m\n", err)
-			return fmt.Errorf("setup failed at step '%s': %w", step.Name, err)
+		status := StepCreated
+		if (done[step.Name] || (step.Done != nil && step.Done(cfg))) && verifyStep(cfg, step) == nil {
+			status = StepSkipped
+		} else {
+			if err := step.Action(cfg); err != nil {
+				fmt.Printf("\033[31m    ✗ Failed: %s\033[0m\n", err)
+				return statuses, fmt.Errorf("setup failed at step '%s': %w", step.Name, err)
+			}
+			if err := verifyStep(cfg, step); err != nil {
+				fmt.Printf("\033[31m    ✗ Verification failed: %s\033[0m\n", err)
+				return statuses, fmt.Errorf("verification failed at step '%s': %w", step.Name, err)
+			}
 		}
 
-		if step.Verify != nil {
-			if err := step.Verify(cfg); err != nil {
-				fmt.Printf("\033[31m    ✗ Verification failed: %s\033[0m\n", err)
-				return fmt.Errorf("verification failed at step '%s': %w", step.Name, err)
+		if !done[step.Name] {
+			if err := markDone(cfg, step.Name); err != nil {
+				return statuses, err
 			}
 		}
+		statuses = append(statuses, status)
 
-		fmt.Printf("\033[32m    ✓ Done\033[0m\n")
+		if status == StepSkipped {
+			fmt.Printf("\033[32m    ✓ Already done, skipped\033[0m\n")
+		} else {
+			fmt.Printf("\033[32m    ✓ Done\033[0m\n")
+		}
 	}
+	return statuses, nil
+}
 
-	// Print success and next steps
-	printSuccess(cfg)
+func verifyStep(cfg *SetupConfig, step Step) error {
+	if step.Verify == nil {
+		return nil
+	}
+	return step.Verify(cfg)
+}
 
-	return nil
+func systemUserExists(cfg *SetupConfig) bool {
+	_, err := user.Lookup("mailserver")
+	return err == nil
+}
+
+func configExists(cfg *SetupConfig) bool {
+	_, err := os.Stat(cfg.ConfigDir + "/config.yaml")
+	return err == nil
+}
+
+func dkimKeyExists(cfg *SetupConfig) bool {
+	_, err := os.Stat(cfg.ConfigDir + "/dkim/" + cfg.Domain + ".key")
+	return err == nil
+}
+
+// adminUserExists reports whether the admin account is already in the database
+func adminUserExists(cfg *SetupConfig) bool {
+	if _, err := os.Stat(cfg.databasePath()); err != nil {
+		return false
+	}
+	db, err := metadata.Open(cfg.databasePath())
+	if err != nil {
+		return false
+	}
+	defer db.Close()
+	_, err = auth.NewAuthenticator(db.DB).LookupUser(context.Background(), cfg.AdminEmail)
+	return err == nil
 }
 
 func createSystemUser(cfg *SetupConfig) error {
@@ -331,38 +469,61 @@ func verifyDKIM(cfg *SetupConfig) error {
 }
 
 func initDatabase(cfg *SetupConfig) error {
-	// Run migrations
-	cmd := exec.Command("mailserver", "migrate", "--config", cfg.ConfigDir+"/config.yaml")
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+	// Migrate in-process rather than exec'ing `mailserver migrate`, which
+	// fails when the binary isn't on root's PATH
+	db, err := metadata.Open(cfg.databasePath())
+	if err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	defer db.Close()
+
+	if err := db.Migrate(context.Background()); err != nil {
+		return fmt.Errorf("failed to run migrations: %w", err)
+	}
+	return nil
 }
 
 func verifyDatabase(cfg *SetupConfig) error {
-	dbPath := cfg.DataDir + "/mail.db"
-	_, err := os.Stat(dbPath)
+	_, err := os.Stat(cfg.databasePath())
 	return err
 }
 
 func createAdminUser(cfg *SetupConfig) error {
-	// Hash password
-	hash, err := bcrypt.GenerateFromPassword([]byte(cfg.AdminPass), bcrypt.DefaultCost)
+	ctx := context.Background()
+	serverCfg := cfg.serverConfig()
+
+	db, err := metadata.Open(serverCfg.Storage.DatabasePath)
 	if err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	defer db.Close()
+
+	// Add the domain, ignoring it if it already exists
+	authenticator := auth.NewAuthenticator(db.DB)
+	if _, err := authenticator.CreateDomain(ctx, cfg.Domain); err != nil && !errors.Is(err, auth.ErrDomainExists) {
 		return err
 	}
 
-	// Use mailserver CLI to add domain and user
-	// First add domain
-	cmd := exec.Command("mailserver", "domain", "add", cfg.Domain, "--config", cfg.ConfigDir+"/config.yaml")
-	cmd.Run() // Ignore error if domain already exists
+	store, err := maildir.NewStore(db.DB, serverCfg.Storage.MaildirPath)
+	if err != nil {
+		return fmt.Errorf("failed to initialize maildir store: %w", err)
+	}
+	store.SetDefaultMailboxes(provision.DefaultMailboxes(serverCfg))
 
-	// Add user
-	cmd = exec.Command("mailserver", "user", "add", cfg.AdminEmail, "--password-hash", string(hash), "--admin", "--config", cfg.ConfigDir+"/config.yaml")
-	return cmd.Run()
+	admin, err := provision.CreateUser(ctx, serverCfg, authenticator, store, cfg.AdminEmail, cfg.AdminPass)
+	if admin == nil {
+		return err
+	}
+	if err != nil {
+		fmt.Printf("  Warning: %v\n", err)
+	}
+	return authenticator.SetAdmin(ctx, admin.ID, true)
 }
 
 func verifyAdminUser(cfg *SetupConfig) error {
-	// Just verify the command ran - actual verification would need DB check
+	if !adminUserExists(cfg) {
+		return fmt.Errorf("admin user %s not found in database", cfg.AdminEmail)
+	}
 	return nil
 }
 
@@ -432,7 +593,7 @@ func verifyService(cfg *SetupConfig) error {
 }
 
 func printSuccess(cfg *SetupConfig) {
-	fmt.Println("\n")
+	fmt.Print("\n\n")
 	fmt.Println("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
 	fmt.Println("\033[32m           ✓ SETUP COMPLETE!\033[0m")
 	fmt.Println("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
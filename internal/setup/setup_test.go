@@ -0,0 +1,172 @@
+package setup
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/fenilsonani/email-server/internal/auth"
+	"github.com/fenilsonani/email-server/internal/storage/metadata"
+)
+
+func TestInitDatabaseMigratesInProcess(t *testing.T) {
+	// With an empty PATH any attempt to exec the mailserver binary fails
+	t.Setenv("PATH", "")
+
+	cfg := &SetupConfig{
+		Domain:     "example.com",
+		Hostname:   "mail.example.com",
+		DataDir:    t.TempDir(),
+		AdminEmail: "admin@example.com",
+		AdminPass:  "Sup3r-secret-pass",
+	}
+	if err := initDatabase(cfg); err != nil {
+		t.Fatalf("initDatabase() error = %v", err)
+	}
+	if err := verifyDatabase(cfg); err != nil {
+		t.Fatalf("verifyDatabase() error = %v", err)
+	}
+	if err := createAdminUser(cfg); err != nil {
+		t.Fatalf("createAdminUser() error = %v", err)
+	}
+
+	db, err := metadata.Open(cfg.databasePath())
+	if err != nil {
+		t.Fatalf("metadata.Open() error = %v", err)
+	}
+	defer db.Close()
+
+	user, err := auth.NewAuthenticator(db.DB).LookupUser(context.Background(), cfg.AdminEmail)
+	if err != nil {
+		t.Fatalf("LookupUser() error = %v", err)
+	}
+	var isAdmin bool
+	if err := db.QueryRow("SELECT is_admin FROM users WHERE id = ?", user.ID).Scan(&isAdmin); err != nil {
+		t.Fatalf("query is_admin error = %v", err)
+	}
+	if !isAdmin {
+		t.Error("setup admin user should have is_admin set")
+	}
+
+	// The admin gets the default mailboxes, like a user added with `user add`
+	var mailboxes int
+	if err := db.QueryRow("SELECT COUNT(*) FROM mailboxes WHERE user_id = ?", user.ID).Scan(&mailboxes); err != nil {
+		t.Fatalf("query mailboxes error = %v", err)
+	}
+	if want := len(cfg.serverConfig().Storage.DefaultMailboxes); mailboxes != want {
+		t.Errorf("admin has %d mailboxes, want %d", mailboxes, want)
+	}
+}
+
+func TestRunStepsTwiceSkipsCompletedSteps(t *testing.T) {
+	cfg := &SetupConfig{DataDir: t.TempDir()}
+	runs := map[string]int{}
+	step := func(name string) Step {
+		return Step{Name: name, Action: func(*SetupConfig) error {
+			runs[name]++
+			return nil
+		}}
+	}
+	steps := []Step{step("first"), step("second"), step("third")}
+
+	statuses, err := runSteps(cfg, steps)
+	if err != nil {
+		t.Fatalf("first runSteps() error = %v", err)
+	}
+	for i, s := range statuses {
+		if s != StepCreated {
+			t.Errorf("first run step %d = %s, want created", i, s)
+		}
+	}
+
+	statuses, err = runSteps(cfg, steps)
+	if err != nil {
+		t.Fatalf("second runSteps() error = %v", err)
+	}
+	if len(statuses) != len(steps) {
+		t.Fatalf("second run reported %d steps, want %d", len(statuses), len(steps))
+	}
+	for i, s := range statuses {
+		if s != StepSkipped {
+			t.Errorf("second run step %d = %s, want skipped", i, s)
+		}
+	}
+	for name, n := range runs {
+		if n != 1 {
+			t.Errorf("step %s ran %d times, want 1", name, n)
+		}
+	}
+}
+
+func TestRunStepsResumesAtFailedStep(t *testing.T) {
+	cfg := &SetupConfig{DataDir: t.TempDir()}
+	runs := map[string]int{}
+	fail := true
+	steps := []Step{
+		{Name: "users", Action: func(*SetupConfig) error { runs["users"]++; return nil }},
+		{Name: "database", Action: func(*SetupConfig) error {
+			runs["database"]++
+			if fail {
+				return errors.New("mailserver not found")
+			}
+			return nil
+		}},
+		{Name: "service", Action: func(*SetupConfig) error { runs["service"]++; return nil }},
+	}
+
+	if _, err := runSteps(cfg, steps); err == nil {
+		t.Fatal("runSteps() should fail at the database step")
+	}
+
+	fail = false
+	statuses, err := runSteps(cfg, steps)
+	if err != nil {
+		t.Fatalf("resumed runSteps() error = %v", err)
+	}
+	want := []StepStatus{StepSkipped, StepCreated, StepCreated}
+	for i := range want {
+		if statuses[i] != want[i] {
+			t.Errorf("resumed step %d = %s, want %s", i, statuses[i], want[i])
+		}
+	}
+	if runs["users"] != 1 || runs["database"] != 2 || runs["service"] != 1 {
+		t.Errorf("step runs = %v, want users=1 database=2 service=1", runs)
+	}
+}
+
+func TestRunStepsSkipsExistingAndRedoesUnverified(t *testing.T) {
+	cfg := &SetupConfig{DataDir: t.TempDir()}
+	ran := false
+	existing := Step{
+		Name:   "existing",
+		Action: func(*SetupConfig) error { ran = true; return nil },
+		Done:   func(*SetupConfig) bool { return true },
+	}
+	statuses, err := runSteps(cfg, []Step{existing})
+	if err != nil {
+		t.Fatalf("runSteps() error = %v", err)
+	}
+	if ran || statuses[0] != StepSkipped {
+		t.Errorf("step already in place: ran = %v, status = %s; want skipped", ran, statuses[0])
+	}
+
+	// Recorded as done, but no longer verifies, so the action runs again
+	healthy := false
+	stopped := Step{
+		Name:   "existing",
+		Action: func(*SetupConfig) error { healthy = true; return nil },
+		Verify: func(*SetupConfig) error {
+			if !healthy {
+				return errors.New("not running")
+			}
+			return nil
+		},
+	}
+	statuses, err = runSteps(cfg, []Step{stopped})
+	if err != nil {
+		t.Fatalf("runSteps() error = %v", err)
+	}
+	if !healthy || statuses[0] != StepCreated {
+		t.Errorf("unverified step: healthy = %v, status = %s; want rerun", healthy, statuses[0])
+	}
+}
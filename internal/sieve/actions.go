@@ -31,14 +31,16 @@ func (a *FileIntoAction) Apply(ctx context.Context, result *Result, msg *Message
 		return fmt.Errorf("action or result is nil")
 	}
 	result.Filed = true
-	result.FileInto = a.Folder
+	result.FileInto = msg.expand(a.Folder)
 	result.Keep = false
 	return nil
 }
 
-// RedirectAction forwards message to another address
+// RedirectAction forwards message to another address. Without :copy
+// (RFC 3894) it cancels the implicit keep.
 type RedirectAction struct {
 	Address string
+	Copy    bool
 }
 
 func (a *RedirectAction) Apply(ctx context.Context, result *Result, msg *Message, vs *VacationStore, userID int64) error {
@@ -46,8 +48,10 @@ func (a *RedirectAction) Apply(ctx context.Context, result *Result, msg *Message
 		return fmt.Errorf("action or result is nil")
 	}
 	result.Redirected = true
-	result.RedirectTo = append(result.RedirectTo, a.Address)
-	result.Keep = false
+	result.RedirectTo = append(result.RedirectTo, msg.expand(a.Address))
+	if !a.Copy {
+		result.Keep = false
+	}
 	return nil
 }
 
@@ -67,7 +71,7 @@ type RejectAction struct {
 
 func (a *RejectAction) Apply(ctx context.Context, result *Result, msg *Message, vs *VacationStore, userID int64) error {
 	result.Rejected = true
-	result.RejectMsg = a.Message
+	result.RejectMsg = msg.expand(a.Message)
 	result.Keep = false
 	return nil
 }
@@ -124,11 +128,11 @@ func (a *VacationAction) Apply(ctx context.Context, result *Result, msg *Message
 
 	result.Vacation = true
 	result.VacationTo = msg.From
-	result.VacationSubject = a.Subject
+	result.VacationSubject = msg.expand(a.Subject)
 	if result.VacationSubject == "" {
 		result.VacationSubject = "Re: " + msg.Subject
 	}
-	result.VacationBody = a.Body
+	result.VacationBody = msg.expand(a.Body)
 
 	return nil
 }
@@ -52,11 +52,11 @@ func (c *HeaderCondition) Evaluate(msg *Message) bool {
 	}
 
 	for _, headerName := range c.Headers {
-		headerValues := c.getHeaderValues(msg, headerName)
+		headerValues := c.getHeaderValues(msg, msg.expand(headerName))
 
 		for _, headerValue := range headerValues {
 			for _, testValue := range c.Values {
-				if c.match(headerValue, testValue) {
+				if c.match(msg, headerValue, testValue) {
 					return true
 				}
 			}
@@ -123,7 +123,27 @@ func (c *HeaderCondition) getHeaderValues(msg *Message, headerName string) []str
 	return nil
 }
 
-func (c *HeaderCondition) match(value, pattern string) bool {
+func (c *HeaderCondition) match(msg *Message, value, pattern string) bool {
+	pattern = msg.expand(pattern)
+
+	if c.MatchType == "matches" {
+		// Convert Sieve glob pattern to a case-insensitive regex, matching
+		// the original value so captured wildcards keep their case
+		re, err := regexp.Compile("(?i)" + globToRegex(pattern))
+		if err != nil {
+			// Invalid regex, fail closed
+			return false
+		}
+		groups := re.FindStringSubmatch(value)
+		if groups == nil {
+			return false
+		}
+		if msg != nil && msg.vars != nil {
+			msg.vars.setMatches(groups)
+		}
+		return true
+	}
+
 	// Case-insensitive by default
 	value = strings.ToLower(value)
 	pattern = strings.ToLower(pattern)
@@ -133,20 +153,50 @@ func (c *HeaderCondition) match(value, pattern string) bool {
 		return value == pattern
 	case "contains":
 		return strings.Contains(value, pattern)
-	case "matches":
-		// Convert Sieve glob pattern to regex
-		re := globToRegex(pattern)
-		matched, err := regexp.MatchString(re, value)
-		if err != nil {
-			// Invalid regex, fail closed
-			return false
-		}
-		return matched
 	default:
 		return value == pattern
 	}
 }
 
+// EnvelopeCondition matches the SMTP envelope (RFC 5228 section 5.4)
+type EnvelopeCondition struct {
+	Parts       []string // "from" (MAIL FROM) and/or "to" (RCPT TO)
+	Values      []string // Values to match against
+	MatchType   string   // "is", "contains", "matches"
+	AddressPart string   // "localpart", "domain", "all"
+}
+
+func (c *EnvelopeCondition) Evaluate(msg *Message) bool {
+	if c == nil || msg == nil {
+		return false
+	}
+
+	hc := &HeaderCondition{MatchType: c.MatchType}
+	for _, part := range c.Parts {
+		var addr string
+		switch strings.ToLower(part) {
+		case "from":
+			addr = msg.EnvelopeFrom
+		case "to":
+			addr = msg.EnvelopeTo
+		default:
+			continue
+		}
+
+		// The null reverse-path only matches an empty key
+		value := ""
+		if addr != "" {
+			value = extractAddressPart(addr, c.AddressPart)
+		}
+		for _, testValue := range c.Values {
+			if hc.match(msg, value, testValue) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // extractAddressPart extracts localpart, domain, or full address
 func extractAddressPart(addr, part string) string {
 	// Handle "Name <email@domain>" format
@@ -177,9 +227,9 @@ func extractAddressPart(addr, part string) string {
 func globToRegex(pattern string) string {
 	// Escape regex special chars except * and ?
 	result := regexp.QuoteMeta(pattern)
-	// Convert * to .* and ? to .
-	result = strings.ReplaceAll(result, `\*`, `.*`)
-	result = strings.ReplaceAll(result, `\?`, `.`)
+	// Convert * and ? to groups so :matches can fill ${1}..${9}
+	result = strings.ReplaceAll(result, `\*`, `(.*?)`)
+	result = strings.ReplaceAll(result, `\?`, `(.)`)
 	return "^" + result + "$"
 }
 
@@ -0,0 +1,81 @@
+package sieve
+
+import (
+	"context"
+	"testing"
+)
+
+// TestEnvelopeMatchesRcptNotHeader verifies envelope "to" uses RCPT TO
+func TestEnvelopeMatchesRcptNotHeader(t *testing.T) {
+	script := `
+require ["envelope", "fileinto"];
+
+if envelope :domain :is "to" "example.com" {
+	fileinto "Envelope";
+}
+`
+	parsed, err := Parse(script)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	e := &Executor{}
+	ctx := context.Background()
+
+	// BCC-style delivery: the To header names someone else entirely
+	msg := &Message{
+		From:         "bob@example.org",
+		To:           []string{"carol@elsewhere.net"},
+		EnvelopeFrom: "bob@example.org",
+		EnvelopeTo:   "alice@example.com",
+	}
+	result, err := e.executeScript(ctx, 1, parsed, msg)
+	if err != nil {
+		t.Fatalf("executeScript failed: %v", err)
+	}
+	if !result.Filed || result.FileInto != "Envelope" {
+		t.Errorf("Expected fileinto Envelope for RCPT alice@example.com, got %+v", result)
+	}
+
+	// The To header alone must not satisfy the envelope test
+	msg = &Message{
+		To:         []string{"alice@example.com"},
+		EnvelopeTo: "carol@elsewhere.net",
+	}
+	result, err = e.executeScript(ctx, 1, parsed, msg)
+	if err != nil {
+		t.Fatalf("executeScript failed: %v", err)
+	}
+	if result.Filed {
+		t.Error("Envelope test matched the To header instead of RCPT TO")
+	}
+}
+
+// TestEnvelopeParts verifies :localpart and :all against MAIL FROM
+func TestEnvelopeParts(t *testing.T) {
+	msg := &Message{EnvelopeFrom: "Bounces+123@lists.example.org"}
+
+	tests := []struct {
+		cond *EnvelopeCondition
+		want bool
+	}{
+		{&EnvelopeCondition{Parts: []string{"from"}, Values: []string{"bounces+*"}, MatchType: "matches", AddressPart: "localpart"}, true},
+		{&EnvelopeCondition{Parts: []string{"from"}, Values: []string{"bounces+123@lists.example.org"}, MatchType: "is", AddressPart: "all"}, true},
+		{&EnvelopeCondition{Parts: []string{"from"}, Values: []string{"example.org"}, MatchType: "is", AddressPart: "domain"}, false},
+		{&EnvelopeCondition{Parts: []string{"to"}, Values: []string{""}, MatchType: "is"}, true},
+	}
+	for i, tt := range tests {
+		if got := tt.cond.Evaluate(msg); got != tt.want {
+			t.Errorf("case %d: Evaluate() = %v, want %v", i, got, tt.want)
+		}
+	}
+}
+
+// TestEnvelopeRequiresCapability verifies the envelope require is enforced
+func TestEnvelopeRequiresCapability(t *testing.T) {
+	script := `if envelope :is "from" "bob@example.org" { discard; }`
+
+	if _, err := Parse(script); err == nil {
+		t.Error("Expected error for envelope test without require \"envelope\"")
+	}
+}
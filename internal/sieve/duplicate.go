@@ -0,0 +1,134 @@
+package sieve
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Bounds on the duplicate test's :seconds window (RFC 7352)
+const (
+	defaultDuplicateSeconds = 7 * 24 * 60 * 60  // 7 days
+	maxDuplicateSeconds     = 30 * 24 * 60 * 60 // Longer windows are clamped
+)
+
+// DuplicateCondition is the RFC 7352 duplicate test. It matches when the
+// message's unique ID, the Message-ID unless :header or :uniqueid says
+// otherwise, was already seen by an earlier delivery within the window.
+type DuplicateCondition struct {
+	Handle   string // Separates the IDs tracked by different tests
+	Header   string // Header holding the unique ID, "" for Message-ID
+	UniqueID string // Explicit unique ID, overrides Header
+	Seconds  int    // How long an ID is remembered
+	Last     bool   // Restart the window on every match
+}
+
+func (c *DuplicateCondition) Evaluate(msg *Message) bool {
+	if c == nil || msg == nil || msg.dups == nil {
+		return false
+	}
+
+	var id string
+	if c.UniqueID != "" {
+		id = msg.expand(c.UniqueID)
+	} else {
+		header := c.Header
+		if header == "" {
+			header = "Message-ID"
+		}
+		values := (&HeaderCondition{}).getHeaderValues(msg, msg.expand(header))
+		if len(values) > 0 {
+			id = strings.TrimSpace(values[0])
+		}
+	}
+	if id == "" {
+		return false // Nothing to track
+	}
+
+	return msg.dups.check(c.Handle, id, c.Seconds, c.Last)
+}
+
+// duplicateTracker checks unique IDs for one script run. New IDs are only
+// recorded once the run succeeds, so a failed run doesn't make the retry
+// look like a duplicate.
+type duplicateTracker struct {
+	ctx     context.Context
+	store   *DuplicateStore
+	userID  int64
+	pending map[string]time.Time // tracking key -> new expiry
+}
+
+// check reports whether the ID was seen within its window and queues the
+// expiry to record: always for a new ID, and on a match only with :last
+func (t *duplicateTracker) check(handle, id string, seconds int, last bool) bool {
+	sum := sha256.Sum256([]byte(handle + "\x00" + id))
+	key := hex.EncodeToString(sum[:])
+
+	seen, err := t.store.Seen(t.ctx, t.userID, key)
+	if err != nil {
+		log.Printf("sieve: duplicate lookup failed for user %d: %v", t.userID, err)
+		return false
+	}
+	if !seen || last {
+		t.pending[key] = time.Now().Add(time.Duration(seconds) * time.Second)
+	}
+	return seen
+}
+
+// commit records the IDs the run saw
+func (t *duplicateTracker) commit() {
+	for key, expires := range t.pending {
+		if err := t.store.Record(t.ctx, t.userID, key, expires); err != nil {
+			log.Printf("sieve: failed to record duplicate for user %d: %v", t.userID, err)
+		}
+	}
+}
+
+// DuplicateStore tracks the unique IDs seen by the duplicate test
+type DuplicateStore struct {
+	db *sql.DB
+}
+
+// NewDuplicateStore creates a new duplicate store
+func NewDuplicateStore(db *sql.DB) *DuplicateStore {
+	return &DuplicateStore{db: db}
+}
+
+// Seen reports whether the tracking key is recorded and not yet expired
+func (s *DuplicateStore) Seen(ctx context.Context, userID int64, key string) (bool, error) {
+	if s == nil || s.db == nil {
+		return false, fmt.Errorf("duplicate store or database is nil")
+	}
+
+	var n int
+	err := s.db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM sieve_duplicates
+		WHERE user_id = ? AND tracking_key = ? AND expires_at > ?
+	`, userID, key, time.Now().Unix()).Scan(&n)
+	return n > 0, err
+}
+
+// Record remembers the tracking key until expires, and drops the user's
+// expired keys
+func (s *DuplicateStore) Record(ctx context.Context, userID int64, key string, expires time.Time) error {
+	if s == nil || s.db == nil {
+		return fmt.Errorf("duplicate store or database is nil")
+	}
+
+	if _, err := s.db.ExecContext(ctx, `
+		DELETE FROM sieve_duplicates WHERE user_id = ? AND expires_at <= ?
+	`, userID, time.Now().Unix()); err != nil {
+		return err
+	}
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO sieve_duplicates (user_id, tracking_key, expires_at)
+		VALUES (?, ?, ?)
+		ON CONFLICT (user_id, tracking_key) DO UPDATE SET expires_at = excluded.expires_at
+	`, userID, key, expires.Unix())
+	return err
+}
@@ -0,0 +1,108 @@
+package sieve
+
+import (
+	"context"
+	"testing"
+)
+
+// TestDuplicateMatchesRepeatedMessageID verifies the second copy of a
+// message is discarded and the first is kept
+func TestDuplicateMatchesRepeatedMessageID(t *testing.T) {
+	e, userID := setupTestExecutor(t)
+	ctx := context.Background()
+	script := `
+require "duplicate";
+
+if duplicate {
+	discard;
+}
+`
+	if _, err := e.store.CreateScript(ctx, userID, "dedupe", script); err != nil {
+		t.Fatalf("CreateScript failed: %v", err)
+	}
+	if err := e.store.SetActiveScript(ctx, userID, "dedupe"); err != nil {
+		t.Fatalf("SetActiveScript failed: %v", err)
+	}
+
+	deliver := func(messageID string) *Result {
+		t.Helper()
+		msg := &Message{Headers: map[string][]string{"Message-Id": {messageID}}}
+		result, err := e.Execute(ctx, userID, msg)
+		if err != nil {
+			t.Fatalf("Execute failed: %v", err)
+		}
+		return result
+	}
+
+	if result := deliver("<one@example.org>"); result.Discarded {
+		t.Error("First copy matched duplicate")
+	}
+	if result := deliver("<one@example.org>"); !result.Discarded {
+		t.Error("Second copy within the window did not match duplicate")
+	}
+	if result := deliver("<two@example.org>"); result.Discarded {
+		t.Error("A different Message-ID matched duplicate")
+	}
+
+	// Once the window has passed the ID is new again
+	if _, err := e.db.ExecContext(ctx, "UPDATE sieve_duplicates SET expires_at = 0"); err != nil {
+		t.Fatal(err)
+	}
+	if result := deliver("<one@example.org>"); result.Discarded {
+		t.Error("Copy after the window expired matched duplicate")
+	}
+}
+
+// TestDuplicateUniqueIDAndHandle verifies :uniqueid keys and that handles
+// track separately
+func TestDuplicateUniqueIDAndHandle(t *testing.T) {
+	e, userID := setupTestExecutor(t)
+	ctx := context.Background()
+	parsed, err := Parse(`
+require ["duplicate", "variables"];
+
+if header :matches "subject" "ALERT: *" {
+	set "alert" "${1}";
+}
+if duplicate :handle "alerts" :uniqueid "${alert}" {
+	discard;
+}
+`)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	msg := &Message{Subject: "ALERT: disk full", Headers: map[string][]string{"Message-Id": {"<a@example.org>"}}}
+	if result, _ := e.executeScript(ctx, userID, parsed, msg); result.Discarded {
+		t.Error("First alert matched duplicate")
+	}
+	msg.Headers["Message-Id"] = []string{"<b@example.org>"}
+	if result, _ := e.executeScript(ctx, userID, parsed, msg); !result.Discarded {
+		t.Error("Repeated alert with a new Message-ID did not match duplicate")
+	}
+
+	// The same ID under the default handle has not been seen
+	other, _ := Parse(`require "duplicate"; if duplicate :uniqueid "disk full" { discard; }`)
+	if result, _ := e.executeScript(ctx, userID, other, msg); result.Discarded {
+		t.Error("Handles share tracked IDs")
+	}
+}
+
+// TestDuplicateParse verifies the capability, tag checks and window bound
+func TestDuplicateParse(t *testing.T) {
+	if _, err := Parse(`if duplicate { discard; }`); err == nil {
+		t.Error("Expected error for duplicate test without require \"duplicate\"")
+	}
+	if _, err := Parse(`require "duplicate"; if duplicate :header "X-Id" :uniqueid "x" { discard; }`); err == nil {
+		t.Error("Expected error for :header with :uniqueid")
+	}
+
+	parsed, err := Parse(`require "duplicate"; if duplicate :seconds 999999999 :last { discard; }`)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	cond := parsed.Rules[0].Conditions[0].(*DuplicateCondition)
+	if cond.Seconds != maxDuplicateSeconds || !cond.Last {
+		t.Errorf("Parsed %+v, want :seconds clamped to %d and :last", cond, maxDuplicateSeconds)
+	}
+}
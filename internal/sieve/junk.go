@@ -0,0 +1,88 @@
+package sieve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// The junk filter installed from the Sieve page files mail a spam filter
+// upstream marked as spam. It reads the headers SpamAssassin and
+// compatible filters add: X-Spam-Flag, X-Spam-Status ("Yes, score=...")
+// and X-Spam-Level, one * per point of score.
+
+// JunkScriptName is the name the junk filter script is stored under
+const JunkScriptName = "junk"
+
+// maxJunkLevel bounds the score threshold, past which X-Spam-Level is
+// unlikely to ever match
+const maxJunkLevel = 50
+
+// ErrActiveScriptExists is returned when installing the junk filter would
+// deactivate another script and replacing it wasn't confirmed
+var ErrActiveScriptExists = errors.New("another script is active")
+
+// JunkScript returns a script that files spam into mailbox. Mail is spam
+// when marked so by X-Spam-Flag or X-Spam-Status, or when level is above
+// zero and X-Spam-Level shows at least that score.
+func JunkScript(mailbox string, level int) (string, error) {
+	if strings.TrimSpace(mailbox) == "" {
+		return "", fmt.Errorf("junk mailbox is required")
+	}
+	if level < 0 || level > maxJunkLevel {
+		return "", fmt.Errorf("spam score threshold must be between 0 and %d", maxJunkLevel)
+	}
+
+	tests := []string{
+		`header :is "X-Spam-Flag" "YES"`,
+		`header :matches "X-Spam-Status" "Yes*"`,
+	}
+	if level > 0 {
+		tests = append(tests, fmt.Sprintf(`header :contains "X-Spam-Level" %s`, quoteString(strings.Repeat("*", level))))
+	}
+
+	var sb strings.Builder
+	sb.WriteString("# File mail marked as spam into Junk (installed from the Sieve page)\n")
+	sb.WriteString("require \"fileinto\";\n")
+	fmt.Fprintf(&sb, "if anyof (%s) {\n", strings.Join(tests, ",\n          "))
+	fmt.Fprintf(&sb, "    fileinto %s;\n", quoteString(mailbox))
+	sb.WriteString("    stop;\n}\n")
+
+	script := sb.String()
+	if _, err := Parse(script); err != nil {
+		return "", fmt.Errorf("generated junk script is invalid: %w", err)
+	}
+	return script, nil
+}
+
+// InstallJunkScript stores the junk filter for mailbox and level as the
+// user's active script. A user can only have one active script, so unless
+// replace is set it refuses with ErrActiveScriptExists when another one is
+// active; that script is kept, only deactivated.
+func (s *Store) InstallJunkScript(ctx context.Context, userID int64, mailbox string, level int, replace bool) error {
+	content, err := JunkScript(mailbox, level)
+	if err != nil {
+		return err
+	}
+
+	active, err := s.GetActiveScript(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if active != nil && active.Name != JunkScriptName && !replace {
+		return fmt.Errorf("%w: %s", ErrActiveScriptExists, active.Name)
+	}
+
+	if exists, err := s.ScriptExists(ctx, userID, JunkScriptName); err != nil {
+		return err
+	} else if exists {
+		err = s.UpdateScript(ctx, userID, JunkScriptName, content)
+	} else {
+		_, err = s.CreateScript(ctx, userID, JunkScriptName, content)
+	}
+	if err != nil {
+		return err
+	}
+	return s.SetActiveScript(ctx, userID, JunkScriptName)
+}
@@ -0,0 +1,80 @@
+package sieve
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestJunkScriptFilesSpam(t *testing.T) {
+	script, err := JunkScript("Junk", 5)
+	if err != nil {
+		t.Fatalf("JunkScript() error = %v", err)
+	}
+	parsed, err := Parse(script)
+	if err != nil {
+		t.Fatalf("Parse() error = %v\n%s", err, script)
+	}
+
+	tests := []struct {
+		name    string
+		headers map[string][]string
+		junk    bool
+	}{
+		{"status yes", map[string][]string{"X-Spam-Status": {"Yes, score=7.1 required=5.0"}}, true},
+		{"flag", map[string][]string{"X-Spam-Flag": {"YES"}}, true},
+		{"level at threshold", map[string][]string{"X-Spam-Level": {"*****"}}, true},
+		{"status no", map[string][]string{"X-Spam-Status": {"No, score=1.2 required=5.0"}, "X-Spam-Level": {"*"}}, false},
+		{"unscored", nil, false},
+	}
+	for _, tt := range tests {
+		result, err := (&Executor{}).executeScript(context.Background(), 1, parsed, &Message{Headers: tt.headers})
+		if err != nil {
+			t.Fatalf("%s: executeScript() error = %v", tt.name, err)
+		}
+		if filed := result.Filed && result.FileInto == "Junk"; filed != tt.junk {
+			t.Errorf("%s: result = %+v, want filed into Junk %v", tt.name, result, tt.junk)
+		}
+	}
+
+	if _, err := JunkScript("Junk", -1); err == nil {
+		t.Error("JunkScript() with a negative threshold succeeded")
+	}
+}
+
+func TestInstallJunkScriptKeepsActiveScript(t *testing.T) {
+	e, userID := setupTestExecutor(t)
+	ctx := context.Background()
+	if _, err := e.store.CreateScript(ctx, userID, "main", `require "fileinto"; if header :contains "Subject" "news" { fileinto "News"; }`); err != nil {
+		t.Fatalf("CreateScript failed: %v", err)
+	}
+	if err := e.store.SetActiveScript(ctx, userID, "main"); err != nil {
+		t.Fatalf("SetActiveScript failed: %v", err)
+	}
+
+	if err := e.store.InstallJunkScript(ctx, userID, "Spam", 0, false); !errors.Is(err, ErrActiveScriptExists) {
+		t.Fatalf("InstallJunkScript() without replace = %v, want ErrActiveScriptExists", err)
+	}
+	if active, _ := e.store.GetActiveScript(ctx, userID); active == nil || active.Name != "main" {
+		t.Fatalf("active script = %+v, want main untouched", active)
+	}
+
+	if err := e.store.InstallJunkScript(ctx, userID, "Spam", 0, true); err != nil {
+		t.Fatalf("InstallJunkScript() with replace error = %v", err)
+	}
+	result, err := e.Execute(ctx, userID, &Message{Headers: map[string][]string{"X-Spam-Flag": {"YES"}}})
+	if err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	if !result.Filed || result.FileInto != "Spam" {
+		t.Errorf("result = %+v, want filed into Spam", result)
+	}
+	if main, _ := e.store.GetScript(ctx, userID, "main"); main == nil {
+		t.Error("replaced script was deleted, want it kept inactive")
+	}
+
+	// Reinstalling over its own script needs no confirmation
+	if err := e.store.InstallJunkScript(ctx, userID, "Spam", 8, false); err != nil {
+		t.Errorf("InstallJunkScript() over the junk script = %v", err)
+	}
+}
@@ -36,7 +36,8 @@ type Parser struct {
 	input  string
 	pos    int
 	tokens []token
-	depth  int // Current parsing depth
+	depth  int             // Current parsing depth
+	caps   map[string]bool // Capabilities declared with require
 }
 
 type token struct {
@@ -59,8 +60,10 @@ const (
 	tokenFalse
 	tokenAddress
 	tokenHeader
+	tokenEnvelope
 	tokenSize
 	tokenExists
+	tokenDuplicate
 	tokenContains
 	tokenIs
 	tokenMatches
@@ -73,6 +76,7 @@ const (
 	tokenReject
 	tokenVacation
 	tokenStop
+	tokenSet
 	tokenString
 	tokenNumber
 	tokenLBracket // [
@@ -149,31 +153,34 @@ func (p *Parser) tokenize() error {
 
 	// Keywords regex
 	keywords := map[string]tokenType{
-		"require":  tokenRequire,
-		"if":       tokenIf,
-		"elsif":    tokenElsif,
-		"else":     tokenElse,
-		"allof":    tokenAllof,
-		"anyof":    tokenAnyof,
-		"not":      tokenNot,
-		"true":     tokenTrue,
-		"false":    tokenFalse,
-		"address":  tokenAddress,
-		"header":   tokenHeader,
-		"size":     tokenSize,
-		"exists":   tokenExists,
-		"contains": tokenContains,
-		"is":       tokenIs,
-		"matches":  tokenMatches,
-		"over":     tokenOver,
-		"under":    tokenUnder,
-		"keep":     tokenKeep,
-		"fileinto": tokenFileinto,
-		"redirect": tokenRedirect,
-		"discard":  tokenDiscard,
-		"reject":   tokenReject,
-		"vacation": tokenVacation,
-		"stop":     tokenStop,
+		"require":   tokenRequire,
+		"if":        tokenIf,
+		"elsif":     tokenElsif,
+		"else":      tokenElse,
+		"allof":     tokenAllof,
+		"anyof":     tokenAnyof,
+		"not":       tokenNot,
+		"true":      tokenTrue,
+		"false":     tokenFalse,
+		"address":   tokenAddress,
+		"header":    tokenHeader,
+		"envelope":  tokenEnvelope,
+		"size":      tokenSize,
+		"exists":    tokenExists,
+		"duplicate": tokenDuplicate,
+		"contains":  tokenContains,
+		"is":        tokenIs,
+		"matches":   tokenMatches,
+		"over":      tokenOver,
+		"under":     tokenUnder,
+		"keep":      tokenKeep,
+		"fileinto":  tokenFileinto,
+		"redirect":  tokenRedirect,
+		"discard":   tokenDiscard,
+		"reject":    tokenReject,
+		"vacation":  tokenVacation,
+		"stop":      tokenStop,
+		"set":       tokenSet,
 	}
 
 	i := 0
@@ -336,6 +343,20 @@ func (p *Parser) parse() (*ParsedScript, error) {
 				return nil, err
 			}
 			script.Require = append(script.Require, reqs...)
+			if p.caps == nil {
+				p.caps = make(map[string]bool)
+			}
+			for _, r := range reqs {
+				p.caps[r] = true
+			}
+
+		case tokenSet:
+			// Top-level set commands run unconditionally, in order
+			action, err := p.parseSetAction()
+			if err != nil {
+				return nil, err
+			}
+			script.Rules = append(script.Rules, Rule{Actions: []Action{action}})
 
 		case tokenIf:
 			rule, err := p.parseRule()
@@ -568,12 +589,18 @@ func (p *Parser) parseSingleCondition() (Condition, error) {
 	case tokenAddress, tokenHeader:
 		return p.parseHeaderCondition(tok.typ == tokenAddress)
 
+	case tokenEnvelope:
+		return p.parseEnvelopeCondition()
+
 	case tokenSize:
 		return p.parseSizeCondition()
 
 	case tokenExists:
 		return p.parseExistsCondition()
 
+	case tokenDuplicate:
+		return p.parseDuplicateCondition()
+
 	case tokenTrue:
 		p.advance()
 		return &TrueCondition{}, nil
@@ -588,7 +615,31 @@ func (p *Parser) parseSingleCondition() (Condition, error) {
 }
 
 func (p *Parser) parseHeaderCondition(isAddress bool) (Condition, error) {
-	p.advance() // skip 'header' or 'address'
+	return p.parseHeaderTest(isAddress)
+}
+
+func (p *Parser) parseEnvelopeCondition() (Condition, error) {
+	if !p.caps["envelope"] {
+		return nil, fmt.Errorf("envelope test requires \"envelope\" capability")
+	}
+
+	// envelope shares the address test syntax, with parts in place of headers
+	hc, err := p.parseHeaderTest(true)
+	if err != nil {
+		return nil, err
+	}
+	return &EnvelopeCondition{
+		Parts:       hc.Headers,
+		Values:      hc.Values,
+		MatchType:   hc.MatchType,
+		AddressPart: hc.AddressPart,
+	}, nil
+}
+
+// parseHeaderTest parses the tagged arguments, header list and key list
+// shared by the header, address and envelope tests
+func (p *Parser) parseHeaderTest(isAddress bool) (*HeaderCondition, error) {
+	p.advance() // skip 'header', 'address' or 'envelope'
 
 	var matchType string
 	var comparator string
@@ -769,6 +820,59 @@ func (p *Parser) parseExistsCondition() (Condition, error) {
 	return &ExistsCondition{Headers: headers}, nil
 }
 
+func (p *Parser) parseDuplicateCondition() (Condition, error) {
+	if !p.caps["duplicate"] {
+		return nil, fmt.Errorf("duplicate test requires \"duplicate\" capability")
+	}
+	p.advance() // skip 'duplicate'
+
+	cond := &DuplicateCondition{Seconds: defaultDuplicateSeconds}
+	modCount := 0
+	for p.current().typ == tokenColon {
+		modCount++
+		if modCount > 10 {
+			return nil, ErrInvalidInput
+		}
+		p.advance()
+		tag := p.current().val
+		p.advance()
+
+		switch tag {
+		case "handle", "header", "uniqueid":
+			tok := p.current()
+			if tok.typ != tokenString {
+				return nil, fmt.Errorf("duplicate :%s requires a string", tag)
+			}
+			switch tag {
+			case "handle":
+				cond.Handle = tok.val
+			case "header":
+				cond.Header = tok.val
+			case "uniqueid":
+				cond.UniqueID = tok.val
+			}
+			p.advance()
+		case "seconds":
+			tok := p.current()
+			seconds, err := strconv.Atoi(tok.val)
+			if tok.typ != tokenNumber || err != nil {
+				return nil, fmt.Errorf("duplicate :seconds requires a number")
+			}
+			cond.Seconds = min(seconds, maxDuplicateSeconds)
+			p.advance()
+		case "last":
+			cond.Last = true
+		default:
+			return nil, fmt.Errorf("unknown duplicate tag :%s", tag)
+		}
+	}
+	if cond.Header != "" && cond.UniqueID != "" {
+		return nil, fmt.Errorf("duplicate :header and :uniqueid are mutually exclusive")
+	}
+
+	return cond, nil
+}
+
 func (p *Parser) parseAction() (Action, error) {
 	tok := p.current()
 
@@ -803,6 +907,18 @@ func (p *Parser) parseAction() (Action, error) {
 
 	case tokenRedirect:
 		p.advance()
+		action := &RedirectAction{}
+		if p.current().typ == tokenColon {
+			p.advance()
+			if tag := p.current().val; tag != "copy" {
+				return nil, fmt.Errorf("unknown redirect tag :%s", tag)
+			}
+			if !p.caps["copy"] {
+				return nil, fmt.Errorf("redirect :copy requires \"copy\" capability")
+			}
+			action.Copy = true
+			p.advance()
+		}
 		var address string
 		tok = p.current()
 		if tok.typ == tokenString {
@@ -819,7 +935,8 @@ func (p *Parser) parseAction() (Action, error) {
 		if address == "" {
 			return nil, fmt.Errorf("redirect requires an address")
 		}
-		return &RedirectAction{Address: address}, nil
+		action.Address = address
+		return action, nil
 
 	case tokenDiscard:
 		p.advance()
@@ -849,6 +966,9 @@ func (p *Parser) parseAction() (Action, error) {
 	case tokenVacation:
 		return p.parseVacationAction()
 
+	case tokenSet:
+		return p.parseSetAction()
+
 	case tokenStop:
 		p.advance()
 		tok = p.current()
@@ -961,6 +1081,50 @@ func (p *Parser) parseVacationAction() (Action, error) {
 	return action, nil
 }
 
+func (p *Parser) parseSetAction() (Action, error) {
+	if !p.caps["variables"] {
+		return nil, fmt.Errorf("set requires \"variables\" capability")
+	}
+	p.advance() // skip 'set'
+
+	action := &SetAction{}
+	modCount := 0
+	for p.current().typ == tokenColon {
+		modCount++
+		if modCount > 10 {
+			return nil, ErrInvalidInput
+		}
+		p.advance()
+		mod := p.current().val
+		if _, ok := setModifierPrecedence[mod]; !ok {
+			return nil, fmt.Errorf("unknown set modifier :%s", mod)
+		}
+		action.Modifiers = append(action.Modifiers, mod)
+		p.advance()
+	}
+
+	var args []string
+	for len(args) < 2 && p.current().typ == tokenString {
+		if len(p.current().val) > maxStringLength {
+			return nil, ErrStringTooLong
+		}
+		args = append(args, p.current().val)
+		p.advance()
+	}
+	if len(args) != 2 {
+		return nil, fmt.Errorf("set requires a name and a value")
+	}
+	if !variableNameRegex.MatchString(args[0]) {
+		return nil, fmt.Errorf("invalid variable name %q", args[0])
+	}
+	action.Name, action.Value = args[0], args[1]
+
+	if p.current().typ == tokenSemi {
+		p.advance()
+	}
+	return action, nil
+}
+
 // parseSize parses a size string like "100K" or "1M" into bytes
 func parseSize(s string) (int64, error) {
 	s = strings.TrimSpace(s)
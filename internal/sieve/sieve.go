@@ -4,10 +4,26 @@ package sieve
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"log"
 	"time"
 )
 
+// Execution bounds, so a buggy or hostile script can't hold up delivery
+const (
+	maxActionsPerMessage   = 32              // Actions applied in one run
+	maxRedirects           = 4               // Redirect fan-out per message
+	executionTimeout       = 5 * time.Second // Wall-clock limit per run
+	maxConsecutiveFailures = 5               // Failures before a script is disabled
+)
+
+var (
+	ErrTooManyActions   = errors.New("sieve script exceeded the action limit")
+	ErrTooManyRedirects = errors.New("sieve script exceeded the redirect limit")
+	ErrExecutionTimeout = errors.New("sieve script exceeded the execution time limit")
+)
+
 // Script represents a stored Sieve script
 type Script struct {
 	ID        int64
@@ -18,6 +34,10 @@ type Script struct {
 	CreatedAt time.Time
 	UpdatedAt time.Time
 	Parsed    *ParsedScript // Compiled representation, nil if not parsed
+
+	FailureCount int        // Consecutive failed executions
+	LastError    string     // Error from the most recent failure
+	DisabledAt   *time.Time // Set when deactivated after repeated failures
 }
 
 // ParsedScript is the compiled representation of a Sieve script
@@ -60,21 +80,29 @@ type Message struct {
 	Body        []byte
 	Date        time.Time
 	InternalDate time.Time
+
+	EnvelopeFrom string // SMTP MAIL FROM, empty for the null reverse-path
+	EnvelopeTo   string // SMTP RCPT TO for this delivery
+
+	vars *varState         // Variables of the running script, nil without "variables"
+	dups *duplicateTracker // Unique IDs seen by the running script, nil without "duplicate"
 }
 
 // Executor executes Sieve scripts against messages
 type Executor struct {
-	store         *Store
-	vacationStore *VacationStore
-	db            *sql.DB
+	store          *Store
+	vacationStore  *VacationStore
+	duplicateStore *DuplicateStore
+	db             *sql.DB
 }
 
 // NewExecutor creates a new Sieve executor
 func NewExecutor(db *sql.DB) *Executor {
 	return &Executor{
-		store:         NewStore(db),
-		vacationStore: NewVacationStore(db),
-		db:            db,
+		store:          NewStore(db),
+		vacationStore:  NewVacationStore(db),
+		duplicateStore: NewDuplicateStore(db),
+		db:             db,
 	}
 }
 
@@ -107,13 +135,37 @@ func (e *Executor) Execute(ctx context.Context, userID int64, msg *Message) (*Re
 		parsed, err := Parse(script.Content)
 		if err != nil {
 			// Script parse error - fall back to keep
-			return &Result{Keep: true}, nil
+			return &Result{Keep: true}, e.recordFailure(ctx, userID, script, err)
 		}
 		script.Parsed = parsed
 	}
 
 	// Execute the script
-	return e.executeScript(ctx, userID, script.Parsed, msg)
+	result, err := e.executeScript(ctx, userID, script.Parsed, msg)
+	if err != nil {
+		// Any failure falls back to keep, never a partial result
+		return &Result{Keep: true}, e.recordFailure(ctx, userID, script, err)
+	}
+	if script.FailureCount > 0 {
+		if err := e.store.ResetFailures(ctx, script.ID); err != nil {
+			log.Printf("sieve: failed to reset failure count for script %d: %v", script.ID, err)
+		}
+	}
+	return result, nil
+}
+
+// recordFailure counts a failed run and disables the script after
+// maxConsecutiveFailures in a row. It returns execErr for the caller.
+func (e *Executor) recordFailure(ctx context.Context, userID int64, script *Script, execErr error) error {
+	disabled, err := e.store.RecordFailure(ctx, script.ID, execErr, maxConsecutiveFailures)
+	if err != nil {
+		log.Printf("sieve: failed to record failure for script %d: %v", script.ID, err)
+	}
+	if disabled {
+		log.Printf("sieve: disabled script %q for user %d after %d consecutive failures: %v",
+			script.Name, userID, maxConsecutiveFailures, execErr)
+	}
+	return fmt.Errorf("script %q: %w", script.Name, execErr)
 }
 
 // executeScript runs a parsed script against a message
@@ -126,9 +178,38 @@ func (e *Executor) executeScript(ctx context.Context, userID int64, script *Pars
 		return nil, fmt.Errorf("message is nil")
 	}
 
+	ctx, cancel := context.WithTimeout(ctx, executionTimeout)
+	defer cancel()
+
 	result := &Result{Keep: true} // Default action
+	actions := 0
+
+	// Evaluate against a copy so variable state never leaks between runs
+	m := *msg
+	msg = &m
+	msg.vars = nil
+	msg.dups = nil
+	for _, req := range script.Require {
+		switch req {
+		case "variables":
+			msg.vars = newVarState()
+		case "duplicate":
+			if e.duplicateStore != nil {
+				msg.dups = &duplicateTracker{
+					ctx:     ctx,
+					store:   e.duplicateStore,
+					userID:  userID,
+					pending: make(map[string]time.Time),
+				}
+			}
+		}
+	}
 
 	for _, rule := range script.Rules {
+		if ctx.Err() != nil {
+			return nil, ErrExecutionTimeout
+		}
+
 		// Check if rule conditions match
 		matched := e.evaluateConditions(rule.Conditions, rule.AllOf, msg)
 
@@ -138,19 +219,31 @@ func (e *Executor) executeScript(ctx context.Context, userID int64, script *Pars
 				if action == nil {
 					continue
 				}
+				actions++
+				if actions > maxActionsPerMessage {
+					return nil, ErrTooManyActions
+				}
 				if err := action.Apply(ctx, result, msg, e.vacationStore, userID); err != nil {
 					// Log error but continue
 					continue
 				}
+				if len(result.RedirectTo) > maxRedirects {
+					return nil, ErrTooManyRedirects
+				}
 			}
 
-			// If stop is set or explicit action taken, don't process more rules
-			if rule.Stop || result.Discarded || result.Rejected || result.Filed || result.Redirected {
+			// If stop is set or explicit action taken, don't process more
+			// rules. A redirect :copy keeps the message, so later rules
+			// may still file it.
+			if rule.Stop || result.Discarded || result.Rejected || result.Filed || result.Redirected && !result.Keep {
 				break
 			}
 		}
 	}
 
+	if msg.dups != nil {
+		msg.dups.commit()
+	}
 	return result, nil
 }
 
@@ -0,0 +1,162 @@
+package sieve
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fenilsonani/email-server/internal/storage/metadata"
+)
+
+// setupTestExecutor returns an executor over a migrated database with one user
+func setupTestExecutor(t *testing.T) (*Executor, int64) {
+	t.Helper()
+	ctx := context.Background()
+
+	db, err := metadata.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := db.Migrate(ctx); err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+
+	if _, err := db.ExecContext(ctx, "INSERT INTO domains (name) VALUES ('example.com')"); err != nil {
+		t.Fatalf("Failed to insert domain: %v", err)
+	}
+	res, err := db.ExecContext(ctx, "INSERT INTO users (domain_id, username, password_hash) VALUES (1, 'alice', 'x')")
+	if err != nil {
+		t.Fatalf("Failed to insert user: %v", err)
+	}
+	userID, _ := res.LastInsertId()
+
+	return NewExecutor(db.DB), userID
+}
+
+// TestActionLimitAbortsSafely verifies runaway scripts fall back to keep
+func TestActionLimitAbortsSafely(t *testing.T) {
+	script := "require \"fileinto\";\nif true {\n" +
+		strings.Repeat("\tfileinto \"Spam\";\n", maxActionsPerMessage+1) + "}\n"
+	parsed, err := Parse(script)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	_, err = (&Executor{}).executeScript(context.Background(), 1, parsed, &Message{})
+	if err != ErrTooManyActions {
+		t.Fatalf("Expected ErrTooManyActions, got %v", err)
+	}
+
+	e, userID := setupTestExecutor(t)
+	ctx := context.Background()
+	if _, err := e.store.CreateScript(ctx, userID, "runaway", script); err != nil {
+		t.Fatalf("CreateScript failed: %v", err)
+	}
+	if err := e.store.SetActiveScript(ctx, userID, "runaway"); err != nil {
+		t.Fatalf("SetActiveScript failed: %v", err)
+	}
+
+	result, err := e.Execute(ctx, userID, &Message{})
+	if err == nil {
+		t.Error("Expected Execute to report the failure")
+	}
+	if result == nil || !result.Keep || result.Filed {
+		t.Errorf("Expected keep fallback, got %+v", result)
+	}
+}
+
+// TestRedirectLimit verifies redirect fan-out is capped
+func TestRedirectLimit(t *testing.T) {
+	script := "if true {\n" + strings.Repeat("\tredirect \"x@example.org\";\n", maxRedirects+1) + "}\n"
+	parsed, err := Parse(script)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	_, err = (&Executor{}).executeScript(context.Background(), 1, parsed, &Message{})
+	if err != ErrTooManyRedirects {
+		t.Errorf("Expected ErrTooManyRedirects, got %v", err)
+	}
+}
+
+// TestRedirectCopy verifies redirect :copy keeps the message and a plain
+// redirect doesn't
+func TestRedirectCopy(t *testing.T) {
+	if _, err := Parse(`if true { redirect :copy "x@example.org"; }`); err == nil {
+		t.Error("Expected :copy without require \"copy\" to be rejected")
+	}
+
+	tests := []struct {
+		script string
+		keep   bool
+	}{
+		{`require "copy"; if true { redirect :copy "x@example.org"; }`, true},
+		{`if true { redirect "x@example.org"; }`, false},
+	}
+	for _, tt := range tests {
+		parsed, err := Parse(tt.script)
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", tt.script, err)
+		}
+		result, err := (&Executor{}).executeScript(context.Background(), 1, parsed, &Message{})
+		if err != nil {
+			t.Fatalf("executeScript(%q) failed: %v", tt.script, err)
+		}
+		if !result.Redirected || len(result.RedirectTo) != 1 || result.Keep != tt.keep {
+			t.Errorf("%q: result = %+v, want redirect with Keep %v", tt.script, result, tt.keep)
+		}
+	}
+}
+
+// TestRepeatedFailuresDisableScript verifies the per-user circuit breaker
+func TestRepeatedFailuresDisableScript(t *testing.T) {
+	e, userID := setupTestExecutor(t)
+	ctx := context.Background()
+
+	script := "if true {\n" + strings.Repeat("\tredirect \"x@example.org\";\n", maxRedirects+1) + "}\n"
+	if _, err := e.store.CreateScript(ctx, userID, "broken", script); err != nil {
+		t.Fatalf("CreateScript failed: %v", err)
+	}
+	if err := e.store.SetActiveScript(ctx, userID, "broken"); err != nil {
+		t.Fatalf("SetActiveScript failed: %v", err)
+	}
+
+	for i := 0; i < maxConsecutiveFailures; i++ {
+		if _, err := e.Execute(ctx, userID, &Message{}); err == nil {
+			t.Fatalf("Execute %d: expected failure", i)
+		}
+	}
+
+	active, err := e.store.GetActiveScript(ctx, userID)
+	if err != nil {
+		t.Fatalf("GetActiveScript failed: %v", err)
+	}
+	if active != nil {
+		t.Fatal("Script should be disabled after repeated failures")
+	}
+
+	got, err := e.store.GetScript(ctx, userID, "broken")
+	if err != nil || got == nil {
+		t.Fatalf("GetScript failed: %v", err)
+	}
+	if got.DisabledAt == nil || !strings.Contains(got.LastError, "redirect limit") {
+		t.Errorf("Expected disabled state with last error, got disabled_at=%v last_error=%q", got.DisabledAt, got.LastError)
+	}
+
+	// With the script disabled, mail is kept without error
+	result, err := e.Execute(ctx, userID, &Message{})
+	if err != nil || !result.Keep {
+		t.Errorf("Expected plain keep once disabled, got %+v, %v", result, err)
+	}
+
+	// Re-activating clears the failure state
+	if err := e.store.SetActiveScript(ctx, userID, "broken"); err != nil {
+		t.Fatalf("SetActiveScript failed: %v", err)
+	}
+	got, _ = e.store.GetScript(ctx, userID, "broken")
+	if got.FailureCount != 0 || got.DisabledAt != nil {
+		t.Errorf("Expected failure state cleared, got count=%d disabled_at=%v", got.FailureCount, got.DisabledAt)
+	}
+}
@@ -17,6 +17,29 @@ func NewStore(db *sql.DB) *Store {
 	return &Store{db: db}
 }
 
+// scriptColumns lists the sieve_scripts columns read by scanScript
+const scriptColumns = `id, user_id, name, content, is_active, created_at, updated_at,
+		failure_count, last_error, disabled_at`
+
+// scanScript scans a row selected with scriptColumns
+func scanScript(row interface{ Scan(...any) error }, script *Script) error {
+	var lastError sql.NullString
+	var disabledAt sql.NullTime
+	err := row.Scan(
+		&script.ID, &script.UserID, &script.Name, &script.Content,
+		&script.IsActive, &script.CreatedAt, &script.UpdatedAt,
+		&script.FailureCount, &lastError, &disabledAt,
+	)
+	if err != nil {
+		return err
+	}
+	script.LastError = lastError.String
+	if disabledAt.Valid {
+		script.DisabledAt = &disabledAt.Time
+	}
+	return nil
+}
+
 // GetActiveScript returns the active Sieve script for a user
 func (s *Store) GetActiveScript(ctx context.Context, userID int64) (*Script, error) {
 	if s == nil || s.db == nil {
@@ -25,15 +48,12 @@ func (s *Store) GetActiveScript(ctx context.Context, userID int64) (*Script, err
 
 	script := &Script{}
 
-	err := s.db.QueryRowContext(ctx, `
-		SELECT id, user_id, name, content, is_active, created_at, updated_at
+	err := scanScript(s.db.QueryRowContext(ctx, `
+		SELECT `+scriptColumns+`
 		FROM sieve_scripts
 		WHERE user_id = ? AND is_active = TRUE
 		LIMIT 1
-	`, userID).Scan(
-		&script.ID, &script.UserID, &script.Name, &script.Content,
-		&script.IsActive, &script.CreatedAt, &script.UpdatedAt,
-	)
+	`, userID), script)
 
 	if err == sql.ErrNoRows {
 		return nil, nil
@@ -49,14 +69,11 @@ func (s *Store) GetActiveScript(ctx context.Context, userID int64) (*Script, err
 func (s *Store) GetScript(ctx context.Context, userID int64, name string) (*Script, error) {
 	script := &Script{}
 
-	err := s.db.QueryRowContext(ctx, `
-		SELECT id, user_id, name, content, is_active, created_at, updated_at
+	err := scanScript(s.db.QueryRowContext(ctx, `
+		SELECT `+scriptColumns+`
 		FROM sieve_scripts
 		WHERE user_id = ? AND name = ?
-	`, userID, name).Scan(
-		&script.ID, &script.UserID, &script.Name, &script.Content,
-		&script.IsActive, &script.CreatedAt, &script.UpdatedAt,
-	)
+	`, userID, name), script)
 
 	if err == sql.ErrNoRows {
 		return nil, nil
@@ -71,7 +88,7 @@ func (s *Store) GetScript(ctx context.Context, userID int64, name string) (*Scri
 // ListScripts returns all Sieve scripts for a user
 func (s *Store) ListScripts(ctx context.Context, userID int64) ([]*Script, error) {
 	rows, err := s.db.QueryContext(ctx, `
-		SELECT id, user_id, name, content, is_active, created_at, updated_at
+		SELECT `+scriptColumns+`
 		FROM sieve_scripts
 		WHERE user_id = ?
 		ORDER BY name
@@ -84,11 +101,7 @@ func (s *Store) ListScripts(ctx context.Context, userID int64) ([]*Script, error
 	var scripts []*Script
 	for rows.Next() {
 		script := &Script{}
-		err := rows.Scan(
-			&script.ID, &script.UserID, &script.Name, &script.Content,
-			&script.IsActive, &script.CreatedAt, &script.UpdatedAt,
-		)
-		if err != nil {
+		if err := scanScript(rows, script); err != nil {
 			return nil, err
 		}
 		scripts = append(scripts, script)
@@ -176,7 +189,8 @@ func (s *Store) SetActiveScript(ctx context.Context, userID int64, name string)
 	if name != "" {
 		_, err = tx.ExecContext(ctx, `
 			UPDATE sieve_scripts
-			SET is_active = TRUE, updated_at = CURRENT_TIMESTAMP
+			SET is_active = TRUE, failure_count = 0, last_error = NULL, disabled_at = NULL,
+			    updated_at = CURRENT_TIMESTAMP
 			WHERE user_id = ? AND name = ?
 		`, userID, name)
 		if err != nil {
@@ -187,6 +201,49 @@ func (s *Store) SetActiveScript(ctx context.Context, userID int64, name string)
 	return tx.Commit()
 }
 
+// RecordFailure counts a failed execution of a script and deactivates it
+// once maxFailures consecutive executions have failed. It reports whether
+// the script was disabled by this call.
+func (s *Store) RecordFailure(ctx context.Context, scriptID int64, execErr error, maxFailures int) (bool, error) {
+	if s == nil || s.db == nil {
+		return false, fmt.Errorf("store or database is nil")
+	}
+
+	msg := execErr.Error()
+	if len(msg) > 1024 {
+		msg = msg[:1024]
+	}
+
+	var failures int
+	err := s.db.QueryRowContext(ctx, `
+		UPDATE sieve_scripts
+		SET failure_count = failure_count + 1, last_error = ?
+		WHERE id = ?
+		RETURNING failure_count
+	`, msg, scriptID).Scan(&failures)
+	if err != nil {
+		return false, err
+	}
+	if failures < maxFailures {
+		return false, nil
+	}
+
+	_, err = s.db.ExecContext(ctx, `
+		UPDATE sieve_scripts
+		SET is_active = FALSE, disabled_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND is_active = TRUE
+	`, scriptID)
+	return err == nil, err
+}
+
+// ResetFailures clears the consecutive failure count after a clean run
+func (s *Store) ResetFailures(ctx context.Context, scriptID int64) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE sieve_scripts SET failure_count = 0, last_error = NULL WHERE id = ?
+	`, scriptID)
+	return err
+}
+
 // RenameScript renames a Sieve script
 func (s *Store) RenameScript(ctx context.Context, userID int64, oldName, newName string) error {
 	_, err := s.db.ExecContext(ctx, `
@@ -0,0 +1,223 @@
+package sieve
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// The vacation auto-reply set from the account page is kept as a marked
+// block in the user's active script, so it runs alongside the user's own
+// rules instead of replacing them. The block goes right after the script's
+// require commands, which RFC 5228 section 3.2 puts before all others.
+const (
+	vacationBlockStart = "# BEGIN vacation (managed by the account page)\n"
+	vacationBlockEnd   = "# END vacation\n"
+
+	// vacationScriptName is used when the user has no active script yet
+	vacationScriptName = "main"
+)
+
+// VacationSettings is a vacation auto-reply
+type VacationSettings struct {
+	Enabled bool
+	Subject string // Defaults to "Re: " and the original subject
+	Body    string
+	Days    int // Minimum days between replies to the same sender
+}
+
+// GetVacation returns the user's managed vacation auto-reply. It is
+// disabled when the active script has no vacation block.
+func (s *Store) GetVacation(ctx context.Context, userID int64) (*VacationSettings, error) {
+	script, err := s.GetActiveScript(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	settings := &VacationSettings{Days: 7}
+	if script == nil {
+		return settings, nil
+	}
+	block, _ := splitVacationBlock(script.Content)
+	if block == "" {
+		return settings, nil
+	}
+
+	parsed, err := Parse(block)
+	if err != nil {
+		return nil, fmt.Errorf("invalid vacation block: %w", err)
+	}
+	for _, rule := range parsed.Rules {
+		for _, action := range rule.Actions {
+			if v, ok := action.(*VacationAction); ok {
+				settings.Enabled = true
+				settings.Subject = v.Subject
+				settings.Body = v.Body
+				settings.Days = v.Days
+			}
+		}
+	}
+	return settings, nil
+}
+
+// SetVacation writes the vacation auto-reply into the user's active script,
+// creating and activating one if there is none. Disabling it removes the
+// block and leaves the rest of the script untouched.
+func (s *Store) SetVacation(ctx context.Context, userID int64, v VacationSettings) error {
+	if v.Enabled && strings.TrimSpace(v.Body) == "" {
+		return fmt.Errorf("vacation message is required")
+	}
+	if v.Days < 1 || v.Days > maxVacationDays {
+		return fmt.Errorf("vacation days must be between 1 and %d", maxVacationDays)
+	}
+
+	script, err := s.GetActiveScript(ctx, userID)
+	if err != nil {
+		return err
+	}
+	var rest string
+	if script != nil {
+		_, rest = splitVacationBlock(script.Content)
+	}
+
+	content := rest
+	if v.Enabled {
+		end, caps := requireSection(rest)
+		content = rest[:end] + vacationBlock(v, !slices.Contains(caps, "vacation")) + rest[end:]
+	}
+
+	if script != nil {
+		return s.UpdateScript(ctx, userID, script.Name, content)
+	}
+	if !v.Enabled {
+		return nil
+	}
+	if exists, err := s.ScriptExists(ctx, userID, vacationScriptName); err != nil {
+		return err
+	} else if exists {
+		err = s.UpdateScript(ctx, userID, vacationScriptName, content)
+	} else {
+		_, err = s.CreateScript(ctx, userID, vacationScriptName, content)
+	}
+	if err != nil {
+		return err
+	}
+	return s.SetActiveScript(ctx, userID, vacationScriptName)
+}
+
+// vacationBlock renders the managed block for v, requiring the vacation
+// extension unless the script already does
+func vacationBlock(v VacationSettings, require bool) string {
+	var sb strings.Builder
+	sb.WriteString(vacationBlockStart)
+	if require {
+		sb.WriteString("require \"vacation\";\n")
+	}
+	fmt.Fprintf(&sb, "if true { vacation :days %d", v.Days)
+	if v.Subject != "" {
+		fmt.Fprintf(&sb, " :subject %s", quoteString(v.Subject))
+	}
+	fmt.Fprintf(&sb, " %s; }\n", quoteString(v.Body))
+	sb.WriteString(vacationBlockEnd)
+	return sb.String()
+}
+
+// splitVacationBlock separates the managed vacation block, if any, from the
+// rest of a script
+func splitVacationBlock(content string) (block, rest string) {
+	start := strings.Index(content, vacationBlockStart)
+	if start < 0 {
+		return "", content
+	}
+	end := strings.Index(content[start:], vacationBlockEnd)
+	if end < 0 {
+		return "", content
+	}
+	end += start + len(vacationBlockEnd)
+	return content[start:end], content[:start] + content[end:]
+}
+
+// requireSection returns the end of the require commands that open a
+// script, with any comments among them, and the capabilities they name
+func requireSection(content string) (end int, caps []string) {
+	i := 0
+	for i < len(content) {
+		switch {
+		case content[i] == ' ' || content[i] == '\t' || content[i] == '\r' || content[i] == '\n':
+			i++
+		case content[i] == '#':
+			nl := strings.IndexByte(content[i:], '\n')
+			if nl < 0 {
+				return len(content), caps
+			}
+			i += nl + 1
+		case strings.HasPrefix(content[i:], "/*"):
+			n := strings.Index(content[i+2:], "*/")
+			if n < 0 {
+				return end, caps
+			}
+			i += n + 4
+		case isRequire(content[i:]):
+			j, names, ok := scanRequire(content, i+len("require"))
+			if !ok {
+				return end, caps
+			}
+			caps = append(caps, names...)
+			i = j
+			if i < len(content) && content[i] == '\n' {
+				i++
+			}
+			end = i
+		default:
+			return end, caps
+		}
+	}
+	return end, caps
+}
+
+// isRequire reports whether s starts with the require command
+func isRequire(s string) bool {
+	const word = "require"
+	if len(s) <= len(word) || !strings.EqualFold(s[:len(word)], word) {
+		return false
+	}
+	c := s[len(word)]
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '"' || c == '['
+}
+
+// scanRequire reads the arguments of a require command from i through its
+// semicolon, returning the offset after it and the strings it names
+func scanRequire(content string, i int) (int, []string, bool) {
+	var names []string
+	for i < len(content) {
+		switch content[i] {
+		case ';':
+			return i + 1, names, true
+		case '"':
+			var sb strings.Builder
+			for i++; i < len(content) && content[i] != '"'; i++ {
+				if content[i] == '\\' && i+1 < len(content) {
+					i++
+				}
+				sb.WriteByte(content[i])
+			}
+			if i >= len(content) {
+				return 0, nil, false
+			}
+			names = append(names, sb.String())
+			i++
+		case '{', '}':
+			return 0, nil, false
+		default:
+			i++
+		}
+	}
+	return 0, nil, false
+}
+
+// quoteString quotes s as a Sieve string literal
+func quoteString(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + s + `"`
+}
@@ -0,0 +1,115 @@
+package sieve
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// TestVacationKeepsUserRules verifies the managed vacation block is added
+// to and removed from the active script without touching the user's rules
+func TestVacationKeepsUserRules(t *testing.T) {
+	e, userID := setupTestExecutor(t)
+	ctx := context.Background()
+	filters := `require "fileinto";
+
+if header :contains "Subject" "invoice" {
+	fileinto "Invoices";
+}
+`
+	if _, err := e.store.CreateScript(ctx, userID, "filters", filters); err != nil {
+		t.Fatalf("CreateScript failed: %v", err)
+	}
+	if err := e.store.SetActiveScript(ctx, userID, "filters"); err != nil {
+		t.Fatalf("SetActiveScript failed: %v", err)
+	}
+
+	want := VacationSettings{Enabled: true, Subject: `Away "until" Monday`, Body: "Back soon.\nC:\\notes", Days: 3}
+	if err := e.store.SetVacation(ctx, userID, want); err != nil {
+		t.Fatalf("SetVacation failed: %v", err)
+	}
+	script, err := e.store.GetActiveScript(ctx, userID)
+	if err != nil {
+		t.Fatalf("GetActiveScript failed: %v", err)
+	}
+	if !strings.HasPrefix(script.Content, "require \"fileinto\";\n"+vacationBlockStart+"require \"vacation\";\n") {
+		t.Errorf("script content = %q, want the block after the user's require", script.Content)
+	}
+	got, err := e.store.GetVacation(ctx, userID)
+	if err != nil {
+		t.Fatalf("GetVacation failed: %v", err)
+	}
+	if *got != want {
+		t.Errorf("GetVacation() = %+v, want %+v", got, want)
+	}
+
+	msg := &Message{From: "bob@example.org", Subject: "invoice 42"}
+	result, err := e.Execute(ctx, userID, msg)
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	if !result.Vacation || result.VacationSubject != want.Subject || result.VacationBody != want.Body {
+		t.Errorf("Execute() vacation = %v %q %q, want the configured reply", result.Vacation, result.VacationSubject, result.VacationBody)
+	}
+	if result.FileInto != "Invoices" {
+		t.Errorf("Execute() FileInto = %q, want the user's rule to still run", result.FileInto)
+	}
+
+	if err := e.store.SetVacation(ctx, userID, VacationSettings{Days: 7}); err != nil {
+		t.Fatalf("SetVacation(disabled) failed: %v", err)
+	}
+	script, err = e.store.GetActiveScript(ctx, userID)
+	if err != nil {
+		t.Fatalf("GetActiveScript failed: %v", err)
+	}
+	if script.Name != "filters" || script.Content != filters {
+		t.Errorf("script after disabling = %s %q, want the original filters", script.Name, script.Content)
+	}
+}
+
+// TestVacationWithoutActiveScript verifies a script is created and
+// activated for a user who had none
+func TestVacationWithoutActiveScript(t *testing.T) {
+	e, userID := setupTestExecutor(t)
+	ctx := context.Background()
+
+	if got, err := e.store.GetVacation(ctx, userID); err != nil || got.Enabled {
+		t.Fatalf("GetVacation() = %+v, %v, want disabled", got, err)
+	}
+	if err := e.store.SetVacation(ctx, userID, VacationSettings{Enabled: true, Body: "Away", Days: 7}); err != nil {
+		t.Fatalf("SetVacation failed: %v", err)
+	}
+	script, err := e.store.GetActiveScript(ctx, userID)
+	if err != nil || script == nil {
+		t.Fatalf("GetActiveScript() = %v, %v, want the new script", script, err)
+	}
+	if !strings.Contains(script.Content, "vacation :days 7") {
+		t.Errorf("script content = %q", script.Content)
+	}
+
+	if err := e.store.SetVacation(ctx, userID, VacationSettings{Enabled: true, Days: 7}); err == nil {
+		t.Error("SetVacation accepted an empty message")
+	}
+}
+
+// TestRequireSection verifies where the vacation block goes in scripts
+// opening with comments and require commands
+func TestRequireSection(t *testing.T) {
+	tests := []struct {
+		script string
+		end    int
+		caps   []string
+	}{
+		{"keep;\n", 0, nil},
+		{"# filters\nrequire \"fileinto\";\nkeep;\n", 30, []string{"fileinto"}},
+		{"/* a */ REQUIRE [\"fileinto\", \"vacation\"];\r\nrequire \"copy\";\nif true { keep; }", 59, []string{"fileinto", "vacation", "copy"}},
+		{"requirements;\nrequire \"copy\";\n", 0, nil},
+		{"require \"fileinto\"", 0, nil},
+	}
+	for _, tt := range tests {
+		end, caps := requireSection(tt.script)
+		if end != tt.end || strings.Join(caps, ",") != strings.Join(tt.caps, ",") {
+			t.Errorf("requireSection(%q) = %d %v, want %d %v", tt.script, end, caps, tt.end, tt.caps)
+		}
+	}
+}
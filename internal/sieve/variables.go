@@ -0,0 +1,158 @@
+package sieve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Limits for the variables extension (RFC 5229)
+const (
+	maxVariables     = 128  // Maximum distinct variables per execution
+	maxVariableSize  = 4096 // Maximum variable value length in bytes
+	maxMatchVariable = 9    // ${1}..${9}; ${0} is the whole match
+)
+
+var (
+	ErrTooManyVariables = errors.New("sieve script sets too many variables")
+
+	variableNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	variableRefRegex  = regexp.MustCompile(`\$\{([A-Za-z0-9_.]+)\}`)
+)
+
+// varState holds the variables of a single script execution
+type varState struct {
+	named   map[string]string
+	matches []string // ${0}..${9} from the last successful :matches
+}
+
+func newVarState() *varState {
+	return &varState{named: make(map[string]string)}
+}
+
+// set assigns a named variable, truncating oversized values
+func (v *varState) set(name, value string) error {
+	name = strings.ToLower(name)
+	if _, ok := v.named[name]; !ok && len(v.named) >= maxVariables {
+		return ErrTooManyVariables
+	}
+	v.named[name] = truncateUTF8(value, maxVariableSize)
+	return nil
+}
+
+// setMatches records the groups of a successful :matches test
+func (v *varState) setMatches(groups []string) {
+	if len(groups) > maxMatchVariable+1 {
+		groups = groups[:maxMatchVariable+1]
+	}
+	v.matches = make([]string, len(groups))
+	for i, g := range groups {
+		v.matches[i] = truncateUTF8(g, maxVariableSize)
+	}
+}
+
+// expand replaces ${name} and ${N} references. Unknown variables expand to
+// the empty string; malformed references are left untouched.
+func (v *varState) expand(s string) string {
+	if v == nil || !strings.Contains(s, "${") {
+		return s
+	}
+	out := variableRefRegex.ReplaceAllStringFunc(s, func(ref string) string {
+		name := ref[2 : len(ref)-1]
+		if n, err := strconv.Atoi(name); err == nil {
+			if n < len(v.matches) {
+				return v.matches[n]
+			}
+			return ""
+		}
+		if !variableNameRegex.MatchString(name) {
+			return "" // Namespaced variables are not supported
+		}
+		return v.named[strings.ToLower(name)]
+	})
+	return truncateUTF8(out, maxVariableSize)
+}
+
+// expand applies variable expansion when the script requires "variables"
+func (m *Message) expand(s string) string {
+	if m == nil {
+		return s
+	}
+	return m.vars.expand(s)
+}
+
+// truncateUTF8 shortens s to at most n bytes without splitting a rune
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// SetAction assigns a variable (RFC 5229 section 4)
+type SetAction struct {
+	Name      string
+	Value     string
+	Modifiers []string // lower, upper, lowerfirst, upperfirst, quotewildcard, length
+}
+
+func (a *SetAction) Apply(ctx context.Context, result *Result, msg *Message, vs *VacationStore, userID int64) error {
+	if a == nil || msg == nil || msg.vars == nil {
+		return fmt.Errorf("set requires the variables extension")
+	}
+	return msg.vars.set(a.Name, applyModifiers(msg.expand(a.Value), a.Modifiers))
+}
+
+// setModifierPrecedence orders modifiers as RFC 5229 section 4.1 requires:
+// higher values are applied first
+var setModifierPrecedence = map[string]int{
+	"lower":         40,
+	"upper":         40,
+	"lowerfirst":    30,
+	"upperfirst":    30,
+	"quotewildcard": 20,
+	"length":        10,
+}
+
+func applyModifiers(value string, modifiers []string) string {
+	ordered := append([]string(nil), modifiers...)
+	for i := 1; i < len(ordered); i++ {
+		for j := i; j > 0 && setModifierPrecedence[ordered[j]] > setModifierPrecedence[ordered[j-1]]; j-- {
+			ordered[j], ordered[j-1] = ordered[j-1], ordered[j]
+		}
+	}
+
+	for _, mod := range ordered {
+		switch mod {
+		case "lower":
+			value = strings.ToLower(value)
+		case "upper":
+			value = strings.ToUpper(value)
+		case "lowerfirst", "upperfirst":
+			r, size := utf8.DecodeRuneInString(value)
+			if size == 0 {
+				continue
+			}
+			if mod == "lowerfirst" {
+				r = unicode.ToLower(r)
+			} else {
+				r = unicode.ToUpper(r)
+			}
+			value = string(r) + value[size:]
+		case "quotewildcard":
+			r := strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`)
+			value = r.Replace(value)
+		case "length":
+			value = strconv.Itoa(utf8.RuneCountInString(value))
+		}
+	}
+	return value
+}
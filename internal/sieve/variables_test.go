@@ -0,0 +1,96 @@
+package sieve
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// TestMatchesCaptureInFileinto verifies ${1} holds the first :matches wildcard
+func TestMatchesCaptureInFileinto(t *testing.T) {
+	script := `
+require ["variables", "fileinto"];
+
+if header :matches "List-Id" "*@*" {
+	fileinto "Lists/${1}";
+}
+`
+	parsed, err := Parse(script)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	msg := &Message{Headers: map[string][]string{"List-Id": {"Golang-Nuts@googlegroups.com"}}}
+	result, err := (&Executor{}).executeScript(context.Background(), 1, parsed, msg)
+	if err != nil {
+		t.Fatalf("executeScript failed: %v", err)
+	}
+	if result.FileInto != "Lists/Golang-Nuts" {
+		t.Errorf("FileInto = %q, want Lists/Golang-Nuts", result.FileInto)
+	}
+	if msg.vars != nil {
+		t.Error("Variable state leaked into the caller's message")
+	}
+}
+
+// TestSetAndExpand verifies set, modifiers and ${name} expansion
+func TestSetAndExpand(t *testing.T) {
+	script := `
+require ["variables", "fileinto"];
+
+set :lower "folder" "Archive";
+set :upperfirst "greeting" "hello";
+
+if header :is "subject" "${greeting}" {
+	fileinto "${FOLDER}/${missing}x";
+}
+`
+	parsed, err := Parse(script)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	result, err := (&Executor{}).executeScript(context.Background(), 1, parsed, &Message{Subject: "Hello"})
+	if err != nil {
+		t.Fatalf("executeScript failed: %v", err)
+	}
+	if result.FileInto != "archive/x" {
+		t.Errorf("FileInto = %q, want archive/x", result.FileInto)
+	}
+}
+
+// TestVariablesRequireCapability verifies expansion is off without require
+func TestVariablesRequireCapability(t *testing.T) {
+	if _, err := Parse(`set "a" "b";`); err == nil {
+		t.Error("Expected error for set without require \"variables\"")
+	}
+
+	parsed, err := Parse(`require "fileinto"; if true { fileinto "${1}"; }`)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	result, _ := (&Executor{}).executeScript(context.Background(), 1, parsed, &Message{})
+	if result.FileInto != "${1}" {
+		t.Errorf("FileInto = %q, want the literal ${1}", result.FileInto)
+	}
+}
+
+// TestVariableLimits verifies the variable count and size caps
+func TestVariableLimits(t *testing.T) {
+	v := newVarState()
+	for i := 0; i < maxVariables; i++ {
+		if err := v.set(fmt.Sprintf("v%d", i), "x"); err != nil {
+			t.Fatalf("set %d failed: %v", i, err)
+		}
+	}
+	if err := v.set("overflow", "x"); err != ErrTooManyVariables {
+		t.Errorf("Expected ErrTooManyVariables, got %v", err)
+	}
+	if err := v.set("v0", strings.Repeat("y", maxVariableSize*2)); err != nil {
+		t.Fatalf("Reassigning existing variable failed: %v", err)
+	}
+	if got := len(v.expand("${v0}")); got != maxVariableSize {
+		t.Errorf("Variable length = %d, want it capped at %d", got, maxVariableSize)
+	}
+}
@@ -0,0 +1,312 @@
+package smtp
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Access rule actions
+const (
+	AccessAllow = "allow"
+	AccessDeny  = "deny"
+)
+
+// AccessRule allows or denies an inbound sender or client network
+type AccessRule struct {
+	Pattern   string // Sender address, domain or *.domain, or a CIDR
+	Action    string // AccessAllow or AccessDeny
+	Comment   string
+	CreatedAt time.Time
+}
+
+// IsIP reports whether the rule is for a client network
+func (r AccessRule) IsIP() bool {
+	return strings.Contains(r.Pattern, "/")
+}
+
+// ipRulesTTL is how long client network rules are cached, so a rule added
+// by the CLI in another process applies within this long
+const ipRulesTTL = 30 * time.Second
+
+// AccessRules is the allowlist and denylist of inbound mail, kept in the
+// sender_rules and ip_rules tables. Sender rules are read on every check;
+// network rules, checked on every connection, are cached for ipRulesTTL.
+//
+// An allowed client IP skips greylisting, DNSBL, HELO, spam trap throttling
+// and reputation checks. An allowed sender, which a client can forge, only
+// skips greylisting and DNSBL. A denied one is refused. Of the rules
+// matching, the most specific decides: the longest prefix, or an address
+// before its domain before wildcards.
+type AccessRules struct {
+	db *sql.DB
+
+	mu       sync.Mutex
+	ipRules  []ipRule
+	ipLoaded time.Time // When ipRules was read; zero = not cached
+}
+
+// ipRule is a parsed row of ip_rules
+type ipRule struct {
+	network *net.IPNet
+	action  string
+}
+
+// NewAccessRules returns the access rules stored in db
+func NewAccessRules(db *sql.DB) *AccessRules {
+	return &AccessRules{db: db}
+}
+
+// errDeniedIP refuses a client on a denied network
+var errDeniedIP = &smtp.SMTPError{
+	Code:         554,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+	Message:      "Your IP address is blocked by this server's policy",
+}
+
+// ParseAccessPattern checks and normalizes an access rule pattern: an IP
+// address or CIDR, an email address, a domain or *.domain
+func ParseAccessPattern(pattern string) (string, error) {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	if _, network, err := net.ParseCIDR(pattern); err == nil {
+		return network.String(), nil
+	}
+	if ip := net.ParseIP(pattern); ip != nil {
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		return (&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}).String(), nil
+	}
+
+	invalid := fmt.Errorf("invalid pattern %q: want an IP address, CIDR, email address, domain or *.domain", pattern)
+	local, domain, isAddress := strings.Cut(strings.TrimPrefix(pattern, "@"), "@")
+	if !isAddress {
+		local, domain = "", local
+	}
+	name := domain
+	if !isAddress {
+		name = strings.TrimPrefix(domain, "*.")
+	}
+	if isAddress && (local == "" || strings.ContainsAny(local, " \t*<>")) {
+		return "", invalid
+	}
+	if !strings.Contains(name, ".") || strings.ContainsAny(name, " \t*@<>/") {
+		return "", invalid
+	}
+	if isAddress {
+		return local + "@" + domain, nil
+	}
+	return domain, nil
+}
+
+// Set adds or replaces the rule for pattern
+func (a *AccessRules) Set(ctx context.Context, pattern, action, comment string) (string, error) {
+	if action != AccessAllow && action != AccessDeny {
+		return "", fmt.Errorf("invalid action %q", action)
+	}
+	pattern, err := ParseAccessPattern(pattern)
+	if err != nil {
+		return "", err
+	}
+	table, column := accessTable(pattern)
+	_, err = a.db.ExecContext(ctx, `
+		INSERT INTO `+table+` (`+column+`, action, comment) VALUES (?, ?, ?)
+		ON CONFLICT(`+column+`) DO UPDATE SET action = excluded.action, comment = excluded.comment
+	`, pattern, action, comment)
+	if err != nil {
+		return "", fmt.Errorf("failed to save rule for %s: %w", pattern, err)
+	}
+	a.forgetIPRules()
+	return pattern, nil
+}
+
+// Remove deletes the rule for pattern, reporting whether there was one
+func (a *AccessRules) Remove(ctx context.Context, pattern string) (bool, error) {
+	pattern, err := ParseAccessPattern(pattern)
+	if err != nil {
+		return false, err
+	}
+	table, column := accessTable(pattern)
+	result, err := a.db.ExecContext(ctx, `DELETE FROM `+table+` WHERE `+column+` = ?`, pattern)
+	if err != nil {
+		return false, fmt.Errorf("failed to remove rule for %s: %w", pattern, err)
+	}
+	a.forgetIPRules()
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
+
+// List returns every rule, networks first
+func (a *AccessRules) List(ctx context.Context) ([]AccessRule, error) {
+	rows, err := a.db.QueryContext(ctx, `
+		SELECT cidr, action, comment, created_at FROM ip_rules
+		UNION ALL
+		SELECT pattern, action, comment, created_at FROM sender_rules
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list access rules: %w", err)
+	}
+	defer rows.Close()
+
+	var ips, senders []AccessRule
+	for rows.Next() {
+		var r AccessRule
+		if err := rows.Scan(&r.Pattern, &r.Action, &r.Comment, &r.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to list access rules: %w", err)
+		}
+		if r.IsIP() {
+			ips = append(ips, r)
+		} else {
+			senders = append(senders, r)
+		}
+	}
+	return append(ips, senders...), rows.Err()
+}
+
+// CheckIP returns the action of the most specific rule for the IP of
+// remoteAddr, or "" when none matches
+func (a *AccessRules) CheckIP(ctx context.Context, remoteAddr string) (string, error) {
+	if a == nil {
+		return "", nil
+	}
+	ip := net.ParseIP(clientIP(remoteAddr))
+	if ip == nil {
+		return "", nil
+	}
+	rules, err := a.loadIPRules(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	action, best := "", -1
+	for _, r := range rules {
+		if !r.network.Contains(ip) {
+			continue
+		}
+		if ones, _ := r.network.Mask.Size(); ones > best {
+			action, best = r.action, ones
+		}
+	}
+	return action, nil
+}
+
+// loadIPRules returns the network rules, read from the database at most
+// once per ipRulesTTL
+func (a *AccessRules) loadIPRules(ctx context.Context) ([]ipRule, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.ipLoaded.IsZero() && time.Since(a.ipLoaded) < ipRulesTTL {
+		return a.ipRules, nil
+	}
+
+	rows, err := a.db.QueryContext(ctx, `SELECT cidr, action FROM ip_rules`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read IP rules: %w", err)
+	}
+	defer rows.Close()
+
+	var rules []ipRule
+	for rows.Next() {
+		var cidr, action string
+		if err := rows.Scan(&cidr, &action); err != nil {
+			return nil, fmt.Errorf("failed to read IP rules: %w", err)
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			continue
+		}
+		rules = append(rules, ipRule{network: network, action: action})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read IP rules: %w", err)
+	}
+	a.ipRules, a.ipLoaded = rules, time.Now()
+	return rules, nil
+}
+
+// forgetIPRules drops the cached network rules after a change
+func (a *AccessRules) forgetIPRules() {
+	a.mu.Lock()
+	a.ipLoaded = time.Time{}
+	a.mu.Unlock()
+}
+
+// CheckSender returns the action of the most specific rule for the
+// envelope sender addr, or "" when none matches
+func (a *AccessRules) CheckSender(ctx context.Context, addr string) (string, error) {
+	if a == nil {
+		return "", nil
+	}
+	local, domain := parseAddress(addr)
+	if domain == "" {
+		return "", nil // The null sender of bounces
+	}
+
+	// Candidates from the most specific on: the address, the domain, then
+	// wildcards for ever shorter parent domains
+	candidates := []string{local + "@" + domain, domain}
+	for name := domain; strings.Contains(name, "."); {
+		_, name, _ = strings.Cut(name, ".")
+		candidates = append(candidates, "*."+name)
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(candidates)), ",")
+	args := make([]any, len(candidates))
+	for i, c := range candidates {
+		args[i] = c
+	}
+	rows, err := a.db.QueryContext(ctx, `SELECT pattern, action FROM sender_rules WHERE pattern IN (`+placeholders+`)`, args...)
+	if err != nil {
+		return "", fmt.Errorf("failed to read sender rules: %w", err)
+	}
+	defer rows.Close()
+
+	found := make(map[string]string)
+	for rows.Next() {
+		var pattern, action string
+		if err := rows.Scan(&pattern, &action); err != nil {
+			return "", fmt.Errorf("failed to read sender rules: %w", err)
+		}
+		found[pattern] = action
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+	for _, c := range candidates {
+		if action, ok := found[c]; ok {
+			return action, nil
+		}
+	}
+	return "", nil
+}
+
+// accessTable returns the table and column holding rules like pattern
+func accessTable(pattern string) (table, column string) {
+	if strings.Contains(pattern, "/") {
+		return "ip_rules", "cidr"
+	}
+	return "sender_rules", "pattern"
+}
+
+// errDeniedSender refuses mail from a denied sender
+func errDeniedSender(from string) error {
+	return &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      fmt.Sprintf("Sender <%s> is blocked by this server's policy", from),
+	}
+}
+
+// allowlisted reports whether the client's IP or the sender of the current
+// transaction is allowed, skipping greylisting and DNSBL. Checks a forged
+// sender mustn't get past, such as HELO, look at s.ipAllowed only.
+func (s *Session) allowlisted() bool {
+	return s.ipAllowed || s.senderAllowed
+}
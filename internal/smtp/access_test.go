@@ -0,0 +1,147 @@
+package smtp
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fenilsonani/email-server/internal/greylist"
+)
+
+func TestAllowlistedSenderBypassesGreylisting(t *testing.T) {
+	env := setupTestBackend(t)
+	env.addUser(t, "bob", "example.com")
+	gl, err := greylist.New(env.db.DB, greylist.Config{Enabled: true, MinDelay: time.Hour, MaxAge: 24 * time.Hour})
+	if err != nil {
+		t.Fatalf("greylist.New() error = %v", err)
+	}
+	env.backend.SetGreylister(gl)
+	rules := NewAccessRules(env.db.DB)
+	env.backend.SetAccessRules(rules)
+	addr := startTestServer(t, env.backend)
+
+	// Greylisted without a rule
+	c := dialRaw(t, addr)
+	c.send("EHLO client.example.net\r\n")
+	c.expect(250)
+	c.send("MAIL FROM:<sender@example.net>\r\n")
+	c.expect(250)
+	c.send("RCPT TO:<bob@example.com>\r\n")
+	c.expect(451)
+
+	if _, err := rules.Set(context.Background(), "*.example.net", AccessAllow, ""); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	c = dialRaw(t, addr)
+	c.send("EHLO client.example.net\r\n")
+	c.expect(250)
+	c.send("MAIL FROM:<sender@lists.example.net>\r\n")
+	c.expect(250)
+	c.send("RCPT TO:<bob@example.com>\r\n")
+	c.expect(250)
+	c.send("DATA\r\n")
+	c.expect(354)
+	c.send("Subject: hi\r\n\r\nhello\r\n.\r\n")
+	c.expect(250)
+
+	// The wildcard doesn't cover the bare domain
+	c.send("MAIL FROM:<sender@example.net>\r\n")
+	c.expect(250)
+	c.send("RCPT TO:<bob@example.com>\r\n")
+	c.expect(451)
+}
+
+func TestAllowlistedSenderStillChecksHELO(t *testing.T) {
+	env := setupTestBackend(t)
+	env.backend.config.Security.HELOCheck = heloCheckReject
+	rules := NewAccessRules(env.db.DB)
+	env.backend.SetAccessRules(rules)
+	addr := startTestServer(t, env.backend)
+	ctx := context.Background()
+
+	// The sender is easily forged, so it doesn't excuse a bad HELO
+	if _, err := rules.Set(ctx, "example.net", AccessAllow, ""); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	c := dialRaw(t, addr)
+	c.send("EHLO client.example.net\r\n")
+	c.expect(250)
+	c.send("EHLO [203.0.113]\r\n")
+	c.expect(250)
+	c.send("MAIL FROM:<sender@example.net>\r\n")
+	c.expect(550)
+
+	// An allowed network does
+	if _, err := rules.Set(ctx, "127.0.0.1", AccessAllow, ""); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	c = dialRaw(t, addr)
+	c.send("EHLO [203.0.113]\r\n")
+	c.expect(250)
+	c.send("MAIL FROM:<sender@example.net>\r\n")
+	c.expect(250)
+}
+
+func TestDenylistedCIDRRejectedAtConnect(t *testing.T) {
+	env := setupTestBackend(t)
+	rules := NewAccessRules(env.db.DB)
+	env.backend.SetAccessRules(rules)
+	addr := startTestServer(t, env.backend)
+	ctx := context.Background()
+
+	if _, err := rules.Set(ctx, "127.0.0.0/8", AccessDeny, "test"); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	c := dialRaw(t, addr)
+	c.send("EHLO client.example.net\r\n")
+	if msg := c.expect(554); !strings.Contains(msg, "blocked by this server's policy") {
+		t.Errorf("EHLO reply = %q, want the policy named", msg)
+	}
+
+	// A more specific allow wins
+	if _, err := rules.Set(ctx, "127.0.0.1", AccessAllow, ""); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	c = dialRaw(t, addr)
+	c.send("EHLO client.example.net\r\n")
+	c.expect(250)
+
+	// A denied sender is rejected at MAIL FROM
+	if _, err := rules.Remove(ctx, "127.0.0.1/32"); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	if _, err := rules.Remove(ctx, "127.0.0.0/8"); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	if _, err := rules.Set(ctx, "spam@example.net", AccessDeny, ""); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	c = dialRaw(t, addr)
+	c.send("EHLO client.example.net\r\n")
+	c.expect(250)
+	c.send("MAIL FROM:<spam@example.net>\r\n")
+	if msg := c.expect(550); !strings.Contains(msg, "spam@example.net") {
+		t.Errorf("MAIL reply = %q, want the sender named", msg)
+	}
+}
+
+func TestParseAccessPattern(t *testing.T) {
+	for _, tt := range []struct{ in, want string }{
+		{"192.0.2.7", "192.0.2.7/32"},
+		{"192.0.2.7/24", "192.0.2.0/24"},
+		{"2001:DB8::1", "2001:db8::1/128"},
+		{"User@Example.com", "user@example.com"},
+		{"@example.com", "example.com"},
+		{"*.example.com", "*.example.com"},
+	} {
+		if got, err := ParseAccessPattern(tt.in); err != nil || got != tt.want {
+			t.Errorf("ParseAccessPattern(%q) = %q, %v, want %q", tt.in, got, err, tt.want)
+		}
+	}
+	for _, in := range []string{"", "localhost", "*", "*.com", "a*@example.com", "@", "user@"} {
+		if got, err := ParseAccessPattern(in); err == nil {
+			t.Errorf("ParseAccessPattern(%q) = %q, want an error", in, got)
+		}
+	}
+}
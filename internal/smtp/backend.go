@@ -8,6 +8,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
+	"net"
 	"net/textproto"
 	"os"
 	"path/filepath"
@@ -18,13 +19,17 @@ import (
 	"github.com/emersion/go-smtp"
 	"github.com/fenilsonani/email-server/internal/auth"
 	"github.com/fenilsonani/email-server/internal/config"
+	"github.com/fenilsonani/email-server/internal/diskmon"
 	"github.com/fenilsonani/email-server/internal/greylist"
 	"github.com/fenilsonani/email-server/internal/logging"
 	"github.com/fenilsonani/email-server/internal/metrics"
+	"github.com/fenilsonani/email-server/internal/msgid"
+	"github.com/fenilsonani/email-server/internal/queue"
 	"github.com/fenilsonani/email-server/internal/sieve"
 	"github.com/fenilsonani/email-server/internal/smtp/delivery"
 	"github.com/fenilsonani/email-server/internal/storage"
 	"github.com/fenilsonani/email-server/internal/storage/maildir"
+	"github.com/fenilsonani/email-server/internal/validation"
 )
 
 // LocalDeliveryNotifier is called when a message is delivered locally
@@ -41,6 +46,13 @@ type Backend struct {
 	onLocalDelivery LocalDeliveryNotifier
 	sieveExecutor   *sieve.Executor
 	greylister      *greylist.Greylister
+	diskMonitor     *diskmon.Monitor
+	sentLog         *delivery.SentLog
+	relayNetworks   []*net.IPNet    // Networks allowed to relay without AUTH
+	reputation      *Reputation     // Client IPs refused for failed logins and spam; nil when off
+	dnsbl           *dnsblChecker   // DNS blocklists of port 25 clients; nil when none are set
+	access          *AccessRules    // Allowed and denied senders and client networks; nil when unset
+	tracer          *logging.Tracer // Selects sessions whose exchange is logged; nil for none
 }
 
 // NewBackend creates a new SMTP backend
@@ -63,6 +75,11 @@ func NewBackend(cfg *config.Config, authenticator *auth.Authenticator, store *ma
 		return nil, fmt.Errorf("failed to create queue directory: %w", err)
 	}
 
+	relayNetworks, err := parseRelayNetworks(cfg.SMTP.RelayNetworks)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Backend{
 		config:         cfg,
 		authenticator:  authenticator,
@@ -70,6 +87,8 @@ func NewBackend(cfg *config.Config, authenticator *auth.Authenticator, store *ma
 		deliveryEngine: deliveryEngine,
 		logger:         logger.SMTP(),
 		queuePath:      queuePath,
+		relayNetworks:  relayNetworks,
+		dnsbl:          newDNSBLChecker(cfg.Security.DNSBL),
 	}, nil
 }
 
@@ -88,8 +107,40 @@ func (b *Backend) SetSieveExecutor(executor *sieve.Executor) {
 	b.sieveExecutor = executor
 }
 
+// SetDiskMonitor sets the disk monitor used to refuse mail when storage is low
+func (b *Backend) SetDiskMonitor(m *diskmon.Monitor) {
+	b.diskMonitor = m
+}
+
+// SetSentLog sets the log of outbound sends that bounces are matched
+// against
+func (b *Backend) SetSentLog(l *delivery.SentLog) {
+	b.sentLog = l
+}
+
+// SetAccessRules sets the allowlist and denylist of inbound senders and
+// client networks
+func (b *Backend) SetAccessRules(a *AccessRules) {
+	b.access = a
+}
+
+// SetReputation sets the IP reputation that failed logins, greylist
+// violations and spam trap hits count towards, and that refuses clients
+func (b *Backend) SetReputation(r *Reputation) {
+	b.reputation = r
+}
+
 // NewSession is called when a new SMTP connection is established
 func (b *Backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	s, err := b.newSession(c, false)
+	if err != nil {
+		return nil, err
+	}
+	return s.smtpSession(), nil
+}
+
+// newSession starts the session of a client that has sent HELO or EHLO
+func (b *Backend) newSession(c *smtp.Conn, submission bool) (*Session, error) {
 	if b == nil {
 		return nil, fmt.Errorf("backend is nil")
 	}
@@ -102,42 +153,113 @@ func (b *Backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
 		remoteAddr = c.Conn().RemoteAddr().String()
 	}
 
-	return &Session{
+	// go-smtp starts a new session after STARTTLS, so the TLS state is
+	// always that of the handshake the client has finished
+	ctx := logging.WithRemoteAddr(context.Background(), remoteAddr)
+	if state, ok := connTLSState(c); ok {
+		ctx = logging.WithTLS(ctx, &state)
+	}
+
+	// Access rules come before every other check
+	ipAction, err := b.access.CheckIP(ctx, remoteAddr)
+	if err != nil {
+		b.logger.WarnContext(ctx, "Access rule check failed", "error", err.Error())
+	}
+	if ipAction == AccessDeny {
+		b.logger.InfoContext(ctx, "Refused client on a denied network")
+		metrics.RecordRejection("denylist")
+		return nil, errDeniedIP
+	}
+
+	relayNet := b.relayNetwork(remoteAddr)
+	if ipAction != AccessAllow && relayNet == nil && b.reputation.Blocked(remoteAddr) {
+		b.logger.InfoContext(ctx, "Refused client with poor reputation")
+		metrics.RecordRejection("reputation")
+		return nil, errPoorReputation
+	}
+
+	s := &Session{
 		backend:      b,
 		conn:         c,
-		isSubmission: false,
+		isSubmission: submission,
 		remoteAddr:   remoteAddr,
-		ctx:          logging.WithRemoteAddr(context.Background(), remoteAddr),
-	}, nil
+		relayNet:     relayNet,
+		ipAllowed:    ipAction == AccessAllow,
+		ctx:          ctx,
+	}
+	if err := s.checkHELO(); err != nil {
+		return nil, err
+	}
+	return s, nil
 }
 
 // Session implements the go-smtp Session interface
 type Session struct {
-	backend      *Backend
-	conn         *smtp.Conn
-	user         *auth.User
-	from         string
-	rcpts        []string
-	isSubmission bool
-	remoteAddr   string
-	ctx          context.Context
+	backend       *Backend
+	conn          *smtp.Conn
+	user          *auth.User
+	from          string
+	rcpts         []string
+	isSubmission  bool
+	remoteAddr    string
+	ctx           context.Context
+	utf8          bool           // SMTPUTF8 requested on MAIL FROM
+	traceLen      int            // Length of our Received header at the start of the data
+	relayNet      *net.IPNet     // Trusted relay network of the client, if any
+	returnPaths   []string       // Addresses inbound recipients were given as, VERP addresses undecoded
+	dsn           queue.DSN      // DSN parameters of MAIL FROM and RCPT TO (RFC 3461)
+	trapped       bool           // A recipient was a spam trap; the message is discarded for it
+	dnsblChecked  bool           // The client has been looked up in the DNS blocklists
+	dnsblScore    float64        // Total weight of the blocklists the client is on
+	dnsblListed   []string       // Blocklists the client is on
+	ipAllowed     bool           // The client's network is allowlisted
+	senderAllowed bool           // The sender of this transaction is allowlisted
+	heloChecked   string         // HELO name security.helo_check last let through
+	trace         *logging.Trace // Records the exchange; nil when not traced
+}
+
+// errEncryptionRequired answers AUTH on a cleartext connection (RFC 4954)
+var errEncryptionRequired = &smtp.SMTPError{
+	Code:         538,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 11},
+	Message:      "Encryption required for requested authentication mechanism",
+}
+
+// authNeedsTLS reports whether AUTH must wait until the client has run
+// STARTTLS. Connections on the implicit-TLS port are already encrypted.
+func (s *Session) authNeedsTLS() bool {
+	cfg := s.backend.config
+	if s.conn == nil || !(cfg.SMTP.RequireTLSForAuth || cfg.Security.RequireTLS) {
+		return false
+	}
+	_, isTLS := connTLSState(s.conn)
+	return !isTLS
 }
 
-// AuthMechanisms returns the list of supported authentication mechanisms
+// AuthMechanisms returns the list of supported authentication mechanisms,
+// none until the connection is encrypted if TLS is required for AUTH
 func (s *Session) AuthMechanisms() []string {
+	if s.authNeedsTLS() {
+		return nil
+	}
 	return []string{sasl.Plain}
 }
 
 // Auth handles SASL authentication
 func (s *Session) Auth(mech string) (sasl.Server, error) {
+	if s.authNeedsTLS() {
+		return nil, errEncryptionRequired
+	}
 	return sasl.NewPlainServer(func(identity, username, password string) error {
-		user, err := s.backend.authenticator.Authenticate(s.ctx, username, password)
+		user, err := s.backend.authenticator.AuthenticateClient(s.ctx, username, password)
+		s.backend.authenticator.RecordAuth("smtp", username, s.remoteAddr, user, err)
 		if err != nil {
 			s.backend.logger.WarnContext(s.ctx, "Authentication failed",
 				"username", username,
 				"remote_addr", s.remoteAddr,
 			)
 			metrics.RecordAuth(false, "smtp")
+			s.backend.reputation.AuthFailure(s.remoteAddr)
 			return smtp.ErrAuthFailed
 		}
 
@@ -153,6 +275,63 @@ func (s *Session) Auth(mech string) (sasl.Server, error) {
 
 // Mail is called when the MAIL FROM command is received
 func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
+	// Refuse new mail up front rather than failing mid-write on a full disk
+	if s.backend.diskMonitor.Low() {
+		s.backend.logger.WarnContext(s.ctx, "Rejecting mail, insufficient storage",
+			"from", from,
+		)
+		metrics.RecordRejection("disk_full")
+		return &smtp.SMTPError{
+			Code:         452,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 1},
+			Message:      "Insufficient system storage",
+		}
+	}
+
+	utf8 := opts != nil && opts.UTF8
+	if !utf8 && !validation.IsASCII(from) {
+		return errNeedsSMTPUTF8
+	}
+
+	// Denied senders are refused and allowed ones skip greylisting and DNSBL
+	s.senderAllowed = false
+	if !s.isSubmission && !s.mayRelay() {
+		action, err := s.backend.access.CheckSender(s.ctx, from)
+		if err != nil {
+			s.backend.logger.WarnContext(s.ctx, "Access rule check failed", "error", err.Error())
+		}
+		if action == AccessDeny {
+			s.backend.logger.InfoContext(s.ctx, "Rejected denied sender", "from", from)
+			metrics.RecordRejection("denylist")
+			return errDeniedSender(from)
+		}
+		s.senderAllowed = action == AccessAllow
+	}
+
+	// A client may greet again under another name after the session started
+	if err := s.checkHELO(); err != nil {
+		return err
+	}
+
+	// Clients on DNS blocklists are refused on port 25
+	if !s.isSubmission && !s.mayRelay() && !s.allowlisted() {
+		if err := s.checkDNSBL(); err != nil {
+			return err
+		}
+	}
+
+	if s.isSubmission && s.user != nil && !s.user.CanSend {
+		s.backend.logger.WarnContext(s.ctx, "Rejecting submission, sending disabled for user",
+			"user_email", s.user.Email,
+		)
+		metrics.RecordRejection("send_disabled")
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      "Sending is disabled for this account",
+		}
+	}
+
 	// For submission (authenticated), validate sender
 	if s.isSubmission && s.user != nil {
 		fromLocal, fromDomain := parseAddress(from)
@@ -167,16 +346,60 @@ func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
 	}
 
 	s.from = from
+	s.utf8 = utf8
+	if opts != nil {
+		s.dsn.Return = string(opts.Return)
+		s.dsn.EnvelopeID = opts.EnvelopeID
+	}
 	return nil
 }
 
 // Rcpt is called when the RCPT TO command is received
 func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
-	if s.isSubmission {
-		// Authenticated user can send anywhere
+	if !s.utf8 && !validation.IsASCII(to) {
+		return errNeedsSMTPUTF8
+	}
+
+	if s.mayRelay() {
+		// Authenticated users and trusted relays can send anywhere
 		s.rcpts = append(s.rcpts, to)
+		if opts != nil && len(opts.Notify) > 0 {
+			notify := make([]string, len(opts.Notify))
+			for i, n := range opts.Notify {
+				notify[i] = string(n)
+			}
+			if s.dsn.Notify == nil {
+				s.dsn.Notify = make(map[string]string)
+			}
+			s.dsn.Notify[to] = strings.Join(notify, ",")
+		}
+		return nil
+	}
+
+	// A spam trap quietly accepts the mail, then its sender is throttled
+	if s.backend.isTrap(to) {
+		s.backend.logger.WarnContext(s.ctx, "Spam trap hit, throttling sender",
+			"sender_ip", s.remoteAddr,
+			"sender", s.from,
+			"recipient", to,
+		)
+		metrics.RecordRejection("honeypot")
+		s.backend.reputation.SpamTrap(s.remoteAddr, s.backend.trapPenalty())
+		s.trapped = true
 		return nil
 	}
+	if !s.ipAllowed && s.backend.reputation.Blocked(s.remoteAddr) {
+		metrics.RecordRejection("throttled")
+		return errThrottled
+	}
+
+	// Mail to a VERP address is for the sender it encodes
+	returnPath := to
+	if s.backend.config.Delivery.VERP {
+		if sender, _, ok := delivery.DecodeVERP(to); ok {
+			to = sender
+		}
+	}
 
 	// MX mode - verify recipient is local
 	valid, err := s.backend.authenticator.ValidateAddress(s.ctx, to)
@@ -202,8 +425,26 @@ func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
 		}
 	}
 
+	canReceive, err := s.backend.authenticator.CanReceive(s.ctx, to)
+	if err != nil {
+		s.backend.logger.ErrorContext(s.ctx, "Error checking recipient permissions", err,
+			"recipient", to,
+		)
+		return &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+			Message:      "Temporary failure, please try again",
+		}
+	}
+	if !canReceive {
+		s.backend.logger.InfoContext(s.ctx, "Rejected recipient, receiving disabled",
+			"recipient", to,
+		)
+		return errMailboxDisabled
+	}
+
 	// Check greylisting for inbound mail
-	if s.backend.greylister != nil && s.backend.greylister.IsEnabled() {
+	if s.backend.greylister != nil && s.backend.greylister.IsEnabled() && !s.allowlisted() {
 		allow, firstTime, err := s.backend.greylister.Check(s.ctx, s.remoteAddr, s.from, to)
 		if err != nil {
 			s.backend.logger.WarnContext(s.ctx, "Greylist check failed",
@@ -222,6 +463,7 @@ func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
 				)
 			} else {
 				metrics.GreylistChecks.WithLabelValues("deferred_retry").Inc()
+				s.backend.reputation.GreylistViolation(s.remoteAddr)
 			}
 			return &smtp.SMTPError{
 				Code:         451,
@@ -234,6 +476,7 @@ func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
 	}
 
 	s.rcpts = append(s.rcpts, to)
+	s.returnPaths = append(s.returnPaths, returnPath)
 	return nil
 }
 
@@ -251,6 +494,16 @@ func (s *Session) Data(r io.Reader) error {
 		}
 	}
 
+	if len(s.rcpts) == 0 && s.trapped {
+		// Only spam traps: read the message and drop it
+		if _, err := io.Copy(io.Discard, r); err != nil {
+			return fmt.Errorf("failed to read message data: %w", err)
+		}
+		s.backend.logger.InfoContext(s.ctx, "Discarded message to spam trap",
+			"from", s.from,
+		)
+		return nil
+	}
 	if len(s.rcpts) == 0 {
 		return &smtp.SMTPError{
 			Code:         503,
@@ -264,10 +517,21 @@ func (s *Session) Data(r io.Reader) error {
 		return fmt.Errorf("operation cancelled: %w", err)
 	}
 
-	// Read message data with size limit
-	data, err := io.ReadAll(io.LimitReader(r, int64(s.backend.config.Security.MaxMessageSize)))
+	// Stream the message (DATA or BDAT chunks) to a spool file with size enforcement,
+	// stamping our Received header first
+	queueID := generateID()
+	now := time.Now()
+	trace := s.receivedHeader(queueID, now)
+	s.traceLen = len(trace)
+	spoolPath, err := s.spoolMessage(r, trace)
 	if err != nil {
-		s.backend.logger.ErrorContext(s.ctx, "Failed to read message data", err)
+		return err
+	}
+	defer os.Remove(spoolPath)
+
+	data, err := os.ReadFile(spoolPath)
+	if err != nil {
+		s.backend.logger.ErrorContext(s.ctx, "Failed to read spooled message", err)
 		return &smtp.SMTPError{
 			Code:         451,
 			EnhancedCode: smtp.EnhancedCode{4, 3, 0},
@@ -275,30 +539,127 @@ func (s *Session) Data(r io.Reader) error {
 		}
 	}
 
+	// Hop limit (RFC 5321 section 6.3): a message that has passed through
+	// too many hosts is assumed to be looping
+	if hops := countReceivedHeaders(data); hops > s.backend.config.Security.MaxReceivedHeaders {
+		s.backend.logger.WarnContext(s.ctx, "Rejecting message, too many Received headers",
+			"queue_id", queueID,
+			"from", s.from,
+			"hops", hops,
+		)
+		metrics.RecordRejection("loop")
+		return &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 4, 6},
+			Message:      "Too many hops, possible mail loop",
+		}
+	}
+
+	// Accept and drop bounces to MAILER-DAEMON rather than answering them
+	if s.wouldLoop() {
+		s.backend.logger.WarnContext(s.ctx, "Dropping bounce addressed to MAILER-DAEMON",
+			"queue_id", queueID,
+			"from", s.from,
+			"recipients", s.rcpts,
+		)
+		metrics.RecordRejection("loop")
+		return nil
+	}
+
 	// Record message received
 	metrics.MessagesReceived.Inc()
 
-	if s.isSubmission {
-		return s.handleOutbound(data)
+	if s.mayRelay() {
+		if s.user == nil {
+			s.backend.logger.InfoContext(s.ctx, "Relaying message for trusted network",
+				"queue_id", queueID,
+				"network", s.relayNet.String(),
+				"from", s.from,
+				"recipients", len(s.rcpts),
+			)
+		}
+		data = s.completeHeaders(data, len(trace), now)
+		data = s.rewriteHeaders(data, s.backend.config.SMTP.Headers.Submission)
+		return s.handleOutbound(s.addFooter(data))
+	}
+
+	data = s.rewriteHeaders(data, s.backend.config.SMTP.Headers.Inbound)
+	data = s.addDNSBLHeader(data)
+
+	// Bounces of our mail update what was sent and are filed apart; those
+	// matching nothing we sent reach their recipients as usual
+	if s.from == "" && s.processBounce(data) {
+		if mailbox := s.backend.config.Delivery.BounceMailbox; mailbox != "" {
+			s.rcpts = []string{mailbox}
+		}
 	}
 
 	return s.handleInbound(data)
 }
 
+// spoolMessage copies the incoming message into a temporary spool file,
+// preceded by the trace header. With CHUNKING, r yields each BDAT chunk as it
+// arrives, and nothing is kept in memory until the message is complete and
+// within the size limit; Data then reads it back whole for the checks and
+// delivery. The size limit applies to the client's data only.
+func (s *Session) spoolMessage(r io.Reader, traceHeader string) (string, error) {
+	f, err := os.CreateTemp(s.backend.queuePath, "spool-*.tmp")
+	if err != nil {
+		s.backend.logger.ErrorContext(s.ctx, "Failed to create spool file", err)
+		return "", &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+			Message:      "Temporary failure saving message",
+		}
+	}
+	path := f.Name()
+
+	maxSize := int64(s.backend.config.Security.MaxMessageSize)
+	_, err = io.WriteString(f, traceHeader)
+	var n int64
+	if err == nil {
+		n, err = io.Copy(f, io.LimitReader(r, maxSize+1))
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		s.backend.logger.ErrorContext(s.ctx, "Failed to read message data", err)
+		return "", &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+			Message:      "Error reading message data",
+		}
+	}
+
+	if n > maxSize {
+		os.Remove(path)
+		metrics.RecordRejection("size")
+		return "", &smtp.SMTPError{
+			Code:         552,
+			EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+			Message:      "Message size exceeds fixed maximum message size",
+		}
+	}
+
+	return path, nil
+}
+
 // handleInbound delivers mail to local mailboxes
 func (s *Session) handleInbound(data []byte) error {
 	var deliveryErrors []error
-	successCount := 0
+	var delivered []string
 
 	for _, rcpt := range s.rcpts {
-		err := s.deliverToLocalRecipient(rcpt, data)
+		err := s.deliverToLocalRecipient(s.from, rcpt, data)
 		if err != nil {
 			deliveryErrors = append(deliveryErrors, fmt.Errorf("%s: %w", rcpt, err))
 			s.backend.logger.ErrorContext(s.ctx, "Local delivery failed", err,
 				"recipient", rcpt,
 			)
 		} else {
-			successCount++
+			delivered = append(delivered, rcpt)
 			s.backend.logger.InfoContext(s.ctx, "Message delivered locally",
 				"recipient", rcpt,
 			)
@@ -306,7 +667,10 @@ func (s *Session) handleInbound(data []byte) error {
 	}
 
 	// If no deliveries succeeded, return error
-	if successCount == 0 && len(deliveryErrors) > 0 {
+	if len(delivered) == 0 && len(deliveryErrors) > 0 {
+		if allLoops(deliveryErrors) {
+			return errDeliveryLoop
+		}
 		return &smtp.SMTPError{
 			Code:         451,
 			EnhancedCode: smtp.EnhancedCode{4, 0, 0},
@@ -314,13 +678,16 @@ func (s *Session) handleInbound(data []byte) error {
 		}
 	}
 
+	s.journalDelivery(data, delivered)
+
 	// Partial success is still success from SMTP perspective
 	// Failed recipients will be handled via DSN if needed
 	return nil
 }
 
-// deliverToLocalRecipient delivers to a single local recipient
-func (s *Session) deliverToLocalRecipient(rcpt string, data []byte) error {
+// deliverToLocalRecipient delivers to a single local recipient mail from
+// the envelope sender from
+func (s *Session) deliverToLocalRecipient(from, rcpt string, data []byte) error {
 	ctx := s.ctx
 
 	// Check for context cancellation
@@ -328,6 +695,10 @@ func (s *Session) deliverToLocalRecipient(rcpt string, data []byte) error {
 		return fmt.Errorf("operation cancelled: %w", err)
 	}
 
+	if alreadyDeliveredTo(data, rcpt) {
+		return errDeliveryLoop
+	}
+
 	// Check for alias
 	userID, external, err := s.backend.authenticator.ResolveAlias(ctx, rcpt)
 	if err != nil {
@@ -337,12 +708,12 @@ func (s *Session) deliverToLocalRecipient(rcpt string, data []byte) error {
 	// Handle external forwarding
 	if external != nil {
 		if s.backend.deliveryEngine != nil {
-			// Queue for outbound delivery
-			messagePath, err := s.saveMessageToQueue(data)
+			// Queue for outbound delivery, marked so it is refused if it comes back
+			messagePath, err := s.saveMessageToQueue(s.addDeliveryHeaders(data, "Delivered-To", rcpt))
 			if err != nil {
 				return fmt.Errorf("failed to save message for forwarding: %w", err)
 			}
-			if err := s.backend.deliveryEngine.Enqueue(ctx, s.from, []string{*external}, messagePath); err != nil {
+			if err := s.backend.deliveryEngine.Enqueue(ctx, from, []string{*external}, messagePath); err != nil {
 				// Clean up the orphaned queue file
 				if cleanupErr := os.Remove(messagePath); cleanupErr != nil {
 					s.backend.logger.WarnContext(ctx, "Failed to cleanup queue file after enqueue failure",
@@ -371,11 +742,17 @@ func (s *Session) deliverToLocalRecipient(rcpt string, data []byte) error {
 	if err != nil {
 		return fmt.Errorf("user not found: %w", err)
 	}
+	if !user.CanReceive {
+		return errMailboxDisabled
+	}
+	if alreadyDeliveredTo(data, user.Email) {
+		return errDeliveryLoop
+	}
 
 	// Execute Sieve filtering if available
 	targetMailbox := "INBOX"
 	if s.backend.sieveExecutor != nil {
-		msg := s.parseMessageForSieve(data)
+		msg := s.parseMessageForSieve(from, rcpt, data)
 		result, err := s.backend.sieveExecutor.Execute(ctx, user.ID, msg)
 		if err != nil {
 			s.backend.logger.WarnContext(ctx, "Sieve execution failed, delivering to INBOX",
@@ -399,14 +776,18 @@ func (s *Session) deliverToLocalRecipient(rcpt string, data []byte) error {
 				return fmt.Errorf("message rejected: %s", result.RejectMsg)
 			}
 
-			// Handle redirect
+			// Handle redirect. The envelope sender is kept, so bounces go
+			// back to the original sender and a redirected bounce keeps its
+			// null sender. Delivered-To marks the copy so a redirect loop
+			// is refused, and Return-Path is only added on final delivery.
 			if result.Redirected && len(result.RedirectTo) > 0 {
 				if s.backend.deliveryEngine != nil {
-					messagePath, err := s.saveMessageToQueue(data)
+					redirected := removeHeaderFields(data, "Return-Path")
+					messagePath, err := s.saveMessageToQueue(s.addDeliveryHeaders(redirected, "Delivered-To", user.Email))
 					if err != nil {
 						return fmt.Errorf("failed to save message for redirect: %w", err)
 					}
-					if err := s.backend.deliveryEngine.Enqueue(ctx, s.from, result.RedirectTo, messagePath); err != nil {
+					if err := s.backend.deliveryEngine.Enqueue(ctx, from, result.RedirectTo, messagePath); err != nil {
 						s.backend.logger.ErrorContext(ctx, "Failed to enqueue redirected message", err)
 						// Clean up the orphaned queue file
 						if cleanupErr := os.Remove(messagePath); cleanupErr != nil {
@@ -433,7 +814,7 @@ func (s *Session) deliverToLocalRecipient(rcpt string, data []byte) error {
 			}
 
 			// Handle vacation response
-			if result.Vacation && result.VacationTo != "" {
+			if result.Vacation && result.VacationTo != "" && !suppressAutoReply(from, msg) {
 				// Launch vacation response in goroutine with panic recovery
 				go func() {
 					defer func() {
@@ -472,6 +853,10 @@ func (s *Session) deliverToLocalRecipient(rcpt string, data []byte) error {
 		}
 	}
 
+	// Record the mailbox the message is filed into and the address it was
+	// sent to, which differ for aliases and role addresses
+	data = s.addDeliveryHeaders(data, "Delivered-To", user.Email, "X-Original-To", rcpt)
+
 	// Check quota before delivery
 	messageSize := int64(len(data))
 	if user.QuotaBytes > 0 {
@@ -491,23 +876,13 @@ func (s *Session) deliverToLocalRecipient(rcpt string, data []byte) error {
 		}
 	}
 
-	// Deliver message
+	// Deliver message; the store adds it to the user's used bytes
 	_, err = s.backend.store.AppendMessage(ctx, mailbox.ID, nil, time.Now(),
 		strings.NewReader(string(data)))
 	if err != nil {
 		return fmt.Errorf("failed to append message: %w", err)
 	}
 
-	// Update used bytes after successful delivery
-	if err := s.backend.authenticator.UpdateUsedBytes(ctx, user.ID, messageSize); err != nil {
-		s.backend.logger.WarnContext(ctx, "Failed to update used bytes",
-			"user_id", user.ID,
-			"delta", messageSize,
-			"error", err.Error(),
-		)
-		// Don't fail the delivery, just log the warning
-	}
-
 	// Notify IMAP clients about new message (for IDLE support) - async for speed
 	if s.backend.onLocalDelivery != nil {
 		// Launch notification in goroutine with panic recovery
@@ -533,11 +908,11 @@ func (s *Session) handleOutbound(data []byte) error {
 
 	// Separate local and external recipients
 	var localRcpts, externalRcpts []string
-	localDomain := s.backend.config.Server.Domain
+	localDomain, _ := auth.NormalizeDomain(s.backend.config.Server.Domain)
 
 	for _, rcpt := range s.rcpts {
 		_, domain := parseAddress(rcpt)
-		if domain == localDomain {
+		if domain, err := auth.NormalizeDomain(domain); err == nil && domain == localDomain {
 			localRcpts = append(localRcpts, rcpt)
 		} else {
 			externalRcpts = append(externalRcpts, rcpt)
@@ -557,7 +932,7 @@ func (s *Session) handleOutbound(data []byte) error {
 				return fmt.Errorf("operation cancelled during local delivery: %w", err)
 			}
 
-			if err := s.deliverToLocalRecipient(rcpt, data); err != nil {
+			if err := s.deliverToLocalRecipient(s.from, rcpt, data); err != nil {
 				s.backend.logger.ErrorContext(s.ctx, "Local delivery failed", err,
 					"recipient", rcpt,
 				)
@@ -594,7 +969,7 @@ func (s *Session) handleOutbound(data []byte) error {
 		}
 
 		// Enqueue for delivery
-		if err := s.backend.deliveryEngine.Enqueue(s.ctx, s.from, externalRcpts, messagePath); err != nil {
+		if err := s.backend.deliveryEngine.EnqueueWithDSN(s.ctx, s.from, externalRcpts, messagePath, s.dsnParams()); err != nil {
 			s.backend.logger.ErrorContext(s.ctx, "Failed to enqueue message for delivery", err)
 			// Clean up the orphaned queue file
 			if cleanupErr := os.Remove(messagePath); cleanupErr != nil {
@@ -617,17 +992,8 @@ func (s *Session) handleOutbound(data []byte) error {
 	}
 
 	// Store in user's Sent folder
-	if s.user != nil {
-		ctx := s.ctx
-		sent, err := s.backend.store.GetMailbox(ctx, s.user.ID, "Sent")
-		if err == nil {
-			flags := []storage.Flag{storage.FlagSeen}
-			_, err = s.backend.store.AppendMessage(ctx, sent.ID, flags, time.Now(),
-				strings.NewReader(string(data)))
-			if err != nil {
-				s.backend.logger.WarnContext(ctx, "Failed to save to Sent folder", "error", err.Error())
-			}
-		}
+	if s.user != nil && s.backend.config.Submission.SaveToSent {
+		s.saveToSent(data)
 	}
 
 	if lastError != nil && len(externalRcpts) == 0 {
@@ -639,9 +1005,76 @@ func (s *Session) handleOutbound(data []byte) error {
 		}
 	}
 
+	s.journalSubmission(data)
 	return nil
 }
 
+// saveToSent files a \Seen copy of a submitted message in the user's \Sent
+// mailbox, unless the client already APPENDed the same Message-ID there
+func (s *Session) saveToSent(data []byte) {
+	ctx := s.ctx
+	sent, err := s.backend.sentMailbox(ctx, s.user.ID)
+	if err != nil {
+		s.backend.logger.WarnContext(ctx, "No Sent folder to save submitted message", "error", err.Error())
+		return
+	}
+
+	meta, err := maildir.ParseMessageHeaders(bytes.NewReader(data))
+	if err == nil {
+		window, _ := time.ParseDuration(s.backend.config.Submission.SentDedupeWindow)
+		existing, err := s.backend.store.FindRecentMessage(ctx, sent.ID, meta.MessageID, window)
+		if err != nil {
+			s.backend.logger.WarnContext(ctx, "Failed to check Sent folder for duplicate", "error", err.Error())
+		} else if existing != nil {
+			return
+		}
+	}
+
+	flags := []storage.Flag{storage.FlagSeen}
+	_, err = s.backend.store.AppendMessage(ctx, sent.ID, flags, time.Now(), bytes.NewReader(data))
+	if err != nil {
+		s.backend.logger.WarnContext(ctx, "Failed to save to Sent folder", "error", err.Error())
+		return
+	}
+
+	// Notify IMAP clients of the Sent copy without holding up the reply
+	if s.backend.onLocalDelivery != nil {
+		email := s.user.Email
+		go func() {
+			defer func() {
+				if r := recover(); r != nil {
+					s.backend.logger.ErrorContext(ctx, "Panic in local delivery notification goroutine", fmt.Errorf("panic: %v", r))
+				}
+			}()
+			s.backend.onLocalDelivery(email, sent.Name)
+		}()
+	}
+}
+
+// isLocalAddress reports whether addr is in the domain this server
+// delivers to local mailboxes
+func (b *Backend) isLocalAddress(addr string) bool {
+	localDomain, _ := auth.NormalizeDomain(b.config.Server.Domain)
+	_, domain := parseAddress(addr)
+	domain, err := auth.NormalizeDomain(domain)
+	return err == nil && domain == localDomain
+}
+
+// sentMailbox returns the user's \Sent special-use mailbox, falling back to
+// one named "Sent" for mailboxes created without the attribute
+func (b *Backend) sentMailbox(ctx context.Context, userID int64) (*storage.Mailbox, error) {
+	mailboxes, err := b.store.ListMailboxes(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, mb := range mailboxes {
+		if mb.SpecialUse == storage.SpecialUseSent {
+			return mb, nil
+		}
+	}
+	return b.store.GetMailbox(ctx, userID, "Sent")
+}
+
 // saveMessageToQueue saves a message to the queue directory
 func (s *Session) saveMessageToQueue(data []byte) (string, error) {
 	// Defensive nil checks
@@ -676,6 +1109,21 @@ func (s *Session) saveMessageToQueue(data []byte) (string, error) {
 func (s *Session) Reset() {
 	s.from = ""
 	s.rcpts = nil
+	s.returnPaths = nil
+	s.utf8 = false
+	s.dsn = queue.DSN{}
+	s.trapped = false
+	s.senderAllowed = false
+}
+
+// dsnParams returns the DSN parameters the client gave, or nil if it gave
+// none
+func (s *Session) dsnParams() *queue.DSN {
+	if s.dsn.Return == "" && s.dsn.EnvelopeID == "" && len(s.dsn.Notify) == 0 {
+		return nil
+	}
+	dsn := s.dsn
+	return &dsn
 }
 
 // Logout is called when the connection is closed
@@ -683,6 +1131,20 @@ func (s *Session) Logout() error {
 	return nil
 }
 
+// errNeedsSMTPUTF8 rejects a non-ASCII address sent without the SMTPUTF8 parameter (RFC 6531 section 3.5)
+var errNeedsSMTPUTF8 = &smtp.SMTPError{
+	Code:         553,
+	EnhancedCode: smtp.EnhancedCode{5, 6, 7},
+	Message:      "Non-ASCII addresses require the SMTPUTF8 parameter",
+}
+
+// errMailboxDisabled rejects mail for a user whose receiving is disabled
+var errMailboxDisabled = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 2, 1},
+	Message:      "Mailbox disabled, not accepting messages",
+}
+
 // parseAddress extracts local part and domain from an email address
 func parseAddress(addr string) (local, domain string) {
 	// Handle <addr> format
@@ -707,10 +1169,13 @@ func generateID() string {
 }
 
 // parseMessageForSieve parses raw email data into a Sieve message structure
-func (s *Session) parseMessageForSieve(data []byte) *sieve.Message {
+// for delivery from the envelope sender from to rcpt
+func (s *Session) parseMessageForSieve(from, rcpt string, data []byte) *sieve.Message {
 	msg := &sieve.Message{
-		Headers: make(map[string][]string),
-		Size:    int64(len(data)),
+		Headers:      make(map[string][]string),
+		Size:         int64(len(data)),
+		EnvelopeFrom: from,
+		EnvelopeTo:   rcpt,
 	}
 
 	// Parse headers using textproto
@@ -719,7 +1184,7 @@ func (s *Session) parseMessageForSieve(data []byte) *sieve.Message {
 	headers, err := tp.ReadMIMEHeader()
 	if err != nil && len(headers) == 0 {
 		// Failed to parse headers, return minimal message
-		msg.From = s.from
+		msg.From = from
 		return msg
 	}
 
@@ -732,7 +1197,7 @@ func (s *Session) parseMessageForSieve(data []byte) *sieve.Message {
 	if from := headers.Get("From"); from != "" {
 		msg.From = from
 	} else {
-		msg.From = s.from
+		msg.From = from
 	}
 
 	if to := headers.Get("To"); to != "" {
@@ -772,7 +1237,7 @@ func (s *Session) sendVacationResponse(ctx context.Context, result *sieve.Result
 	msg.WriteString("Auto-Submitted: auto-replied\r\n")
 	msg.WriteString("X-Auto-Response-Suppress: All\r\n")
 	msg.WriteString(fmt.Sprintf("Date: %s\r\n", time.Now().Format(time.RFC1123Z)))
-	msg.WriteString(fmt.Sprintf("Message-ID: <%s@%s>\r\n", generateID(), s.backend.config.Server.Domain))
+	msg.WriteString(fmt.Sprintf("Message-ID: <%s>\r\n", msgid.New(s.backend.config.Server.Domain)))
 	msg.WriteString("MIME-Version: 1.0\r\n")
 	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
 	msg.WriteString("\r\n")
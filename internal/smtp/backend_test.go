@@ -1,8 +1,15 @@
 package smtp
 
 import (
+	"context"
+	"errors"
 	"sync"
 	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/fenilsonani/email-server/internal/config"
+	"github.com/fenilsonani/email-server/internal/diskmon"
+	"github.com/fenilsonani/email-server/internal/logging"
 )
 
 func TestGenerateID(t *testing.T) {
@@ -89,6 +96,59 @@ func TestParseAddress(t *testing.T) {
 	}
 }
 
+func TestMailDiskBackPressure(t *testing.T) {
+	tests := []struct {
+		name      string
+		freeBytes uint64
+		wantCode  int
+	}{
+		{"below threshold", 1 << 20, 452},
+		{"above threshold", 10 << 30, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stat := func(path string) (diskmon.Usage, error) {
+				return diskmon.Usage{FreeBytes: tt.freeBytes}, nil
+			}
+			monitor := diskmon.New(diskmon.Config{
+				Paths:        []string{"/maildir"},
+				MinFreeBytes: 100 << 20,
+			}, stat)
+			monitor.Check()
+
+			backend := &Backend{
+				config: config.DefaultConfig(),
+				logger: logging.Default().SMTP(),
+			}
+			backend.SetDiskMonitor(monitor)
+			session := &Session{backend: backend, ctx: context.Background()}
+
+			err := session.Mail("sender@example.com", nil)
+			if tt.wantCode == 0 {
+				if err != nil {
+					t.Fatalf("Mail() error = %v, want nil", err)
+				}
+				if session.from != "sender@example.com" {
+					t.Errorf("from = %q, want sender@example.com", session.from)
+				}
+				return
+			}
+
+			var smtpErr *smtp.SMTPError
+			if !errors.As(err, &smtpErr) {
+				t.Fatalf("Mail() error = %v, want *smtp.SMTPError", err)
+			}
+			if smtpErr.Code != tt.wantCode {
+				t.Errorf("Code = %d, want %d", smtpErr.Code, tt.wantCode)
+			}
+			if smtpErr.EnhancedCode != (smtp.EnhancedCode{4, 3, 1}) {
+				t.Errorf("EnhancedCode = %v, want 4.3.1", smtpErr.EnhancedCode)
+			}
+		})
+	}
+}
+
 func BenchmarkGenerateID(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		generateID()
@@ -0,0 +1,223 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+
+	"github.com/fenilsonani/email-server/internal/smtp/delivery"
+)
+
+// maxDSNStatusSize bounds how much of a DSN's delivery-status part is read
+const maxDSNStatusSize = 64 * 1024
+
+// dsnRecipient is the per-recipient part of a delivery status notification
+// (RFC 3464 section 2.3)
+type dsnRecipient struct {
+	Recipient  string // Final-Recipient address
+	Action     string // failed, delayed, delivered, relayed or expanded
+	Status     string // Enhanced status code, e.g. 5.1.1
+	Diagnostic string // The remote server's response, if given
+}
+
+// failed reports whether the DSN says delivery to the recipient failed
+func (r dsnRecipient) failed() bool {
+	if r.Action != "" {
+		return strings.EqualFold(r.Action, "failed")
+	}
+	return strings.HasPrefix(r.Status, "5")
+}
+
+// reason returns the remote server's response, or the status without one
+func (r dsnRecipient) reason() string {
+	if r.Diagnostic != "" {
+		return r.Diagnostic
+	}
+	if r.Status != "" {
+		return "status " + r.Status
+	}
+	return "bounced"
+}
+
+// dsnReport is what a delivery status notification says about a message
+type dsnReport struct {
+	EnvelopeID string // Original-Envelope-Id
+	MessageID  string // Message-ID of the returned message or headers, without <>
+	Recipients []dsnRecipient
+}
+
+// parseDSN reads a multipart/report delivery-status message, or returns
+// false when data isn't one
+func parseDSN(data []byte) (*dsnReport, bool) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, false
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/report" ||
+		!strings.EqualFold(params["report-type"], "delivery-status") || params["boundary"] == "" {
+		return nil, false
+	}
+
+	var report *dsnReport
+	messageID := ""
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		switch partType {
+		case "message/delivery-status", "message/global-delivery-status":
+			if report == nil {
+				report = parseDeliveryStatus(io.LimitReader(part, maxDSNStatusSize))
+			}
+		case "text/rfc822-headers", "message/rfc822", "message/global", "message/global-headers":
+			if messageID == "" {
+				messageID = delivery.HeaderMessageID(io.LimitReader(part, maxDSNStatusSize))
+			}
+		}
+	}
+	if report == nil {
+		return nil, false
+	}
+	report.MessageID = messageID
+	return report, true
+}
+
+// parseDeliveryStatus reads the per-message fields of a delivery-status
+// part and the per-recipient field groups that follow them
+func parseDeliveryStatus(r io.Reader) *dsnReport {
+	tp := textproto.NewReader(bufio.NewReader(r))
+	report := &dsnReport{}
+	perMessage, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return report
+	}
+	report.EnvelopeID = strings.TrimSpace(perMessage.Get("Original-Envelope-Id"))
+
+	for {
+		fields, err := tp.ReadMIMEHeader()
+		if rcpt := dsnValue(fields.Get("Final-Recipient")); rcpt != "" {
+			report.Recipients = append(report.Recipients, dsnRecipient{
+				Recipient:  rcpt,
+				Action:     strings.TrimSpace(fields.Get("Action")),
+				Status:     strings.TrimSpace(fields.Get("Status")),
+				Diagnostic: dsnValue(fields.Get("Diagnostic-Code")),
+			})
+		}
+		if err != nil {
+			return report
+		}
+	}
+}
+
+// returnedMessageID returns the first Message-ID field in the body of a
+// bounce that isn't a DSN, which is the returned message's when it quotes
+// its headers, without <>
+func returnedMessageID(data []byte) string {
+	_, body, ok := bytes.Cut(data, []byte("\r\n\r\n"))
+	if !ok {
+		return ""
+	}
+	for _, line := range strings.Split(string(body), "\n") {
+		name, value, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if ok && strings.EqualFold(strings.TrimSpace(name), "Message-ID") {
+			return strings.Trim(strings.TrimSpace(value), "<>")
+		}
+	}
+	return ""
+}
+
+// dsnValue returns the value of a typed DSN field such as
+// "rfc822; bob@example.org" or "smtp; 550 ...", without its type
+func dsnValue(field string) string {
+	if _, value, ok := strings.Cut(field, ";"); ok {
+		field = value
+	}
+	return strings.Trim(strings.TrimSpace(field), "<>")
+}
+
+// processBounce marks the sends a bounce reports failed as bounced, and
+// reports whether it matched any. Sends are found by the address the
+// bounce came to, our return path: a VERP address names the send by
+// itself, otherwise it is the sender and the DSN names the failed
+// recipients. Either way the bounce must also name the message, by the
+// Message-ID of the headers it returns or the ENVID it was sent with, so
+// mail forged to a return path can't mark sends it knows nothing of.
+func (s *Session) processBounce(data []byte) bool {
+	report, isDSN := parseDSN(data)
+	if !isDSN {
+		report = &dsnReport{MessageID: returnedMessageID(data)}
+	}
+
+	var failed []dsnRecipient
+	for _, r := range report.Recipients {
+		if r.failed() {
+			failed = append(failed, r)
+		}
+	}
+
+	matched := false
+	for _, returnPath := range s.returnPaths {
+		bounce := delivery.Bounce{
+			ReturnPath:        returnPath,
+			OriginalMessageID: report.MessageID,
+			EnvelopeID:        report.EnvelopeID,
+		}
+		if _, _, ok := delivery.DecodeVERP(returnPath); ok && s.backend.config.Delivery.VERP {
+			// A DSN without failures is a delay or delivery notice
+			switch {
+			case len(failed) > 0:
+				bounce.Reason = failed[0].reason()
+			case !isDSN:
+				bounce.Reason = delivery.BounceDiagnostic(data)
+			default:
+				continue
+			}
+			matched = s.markBounced(bounce) || matched
+			continue
+		}
+		for _, r := range failed {
+			bounce.Recipient, bounce.Reason = r.Recipient, r.reason()
+			matched = s.markBounced(bounce) || matched
+		}
+	}
+	return matched
+}
+
+// markBounced marks the send b is about as bounced, reporting whether
+// there was one
+func (s *Session) markBounced(b delivery.Bounce) bool {
+	if s.backend.sentLog == nil {
+		return false
+	}
+	sent, err := s.backend.sentLog.MarkBounced(s.ctx, b)
+	if err != nil {
+		s.backend.logger.WarnContext(s.ctx, "Failed to match bounce",
+			"return_path", b.ReturnPath,
+			"error", err.Error(),
+		)
+		return false
+	}
+	if sent == nil {
+		s.backend.logger.InfoContext(s.ctx, "Bounce matched no sent email",
+			"return_path", b.ReturnPath,
+			"recipient", b.Recipient,
+			"original_message_id", b.OriginalMessageID,
+		)
+		return false
+	}
+	s.backend.logger.InfoContext(s.ctx, "Bounce matched sent email",
+		"message_id", sent.MessageID,
+		"recipient", sent.Recipient,
+		"reason", sent.BounceReason,
+	)
+	return true
+}
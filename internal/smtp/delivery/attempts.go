@@ -0,0 +1,118 @@
+package delivery
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/textproto"
+	"time"
+
+	"github.com/fenilsonani/email-server/internal/validation"
+)
+
+// Attempt is a single connection attempt made while delivering a message.
+type Attempt struct {
+	ID        int64
+	MessageID string
+	Attempt   int
+	Host      string
+	Address   string
+	SMTPCode  int // 0 if the server never replied
+	Latency   time.Duration
+	Error     string // empty on success
+	CreatedAt time.Time
+}
+
+// AttemptLog persists per-message delivery attempts.
+type AttemptLog struct {
+	db *sql.DB
+}
+
+// NewAttemptLog creates an attempt log backed by the delivery_attempts table.
+func NewAttemptLog(db *sql.DB) *AttemptLog {
+	return &AttemptLog{db: db}
+}
+
+// Record stores an attempt. Remote-supplied strings are truncated before
+// they are written.
+func (l *AttemptLog) Record(ctx context.Context, a *Attempt) error {
+	if a.CreatedAt.IsZero() {
+		a.CreatedAt = time.Now()
+	}
+
+	var code, errMsg interface{}
+	if a.SMTPCode != 0 {
+		code = a.SMTPCode
+	}
+	if a.Error != "" {
+		errMsg = validation.Truncate(a.Error, validation.MaxExternalStringLength)
+	}
+
+	res, err := l.db.ExecContext(ctx, `
+		INSERT INTO delivery_attempts (message_id, attempt, host, address, smtp_code, latency_ms, error_message, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, a.MessageID, a.Attempt,
+		validation.Truncate(a.Host, validation.MaxExternalStringLength),
+		validation.Truncate(a.Address, validation.MaxExternalStringLength),
+		code, a.Latency.Milliseconds(), errMsg, a.CreatedAt.UTC())
+	if err != nil {
+		return fmt.Errorf("failed to record delivery attempt: %w", err)
+	}
+
+	a.ID, _ = res.LastInsertId()
+	return nil
+}
+
+// List returns all attempts for a message in chronological order.
+func (l *AttemptLog) List(ctx context.Context, messageID string) ([]*Attempt, error) {
+	rows, err := l.db.QueryContext(ctx, `
+		SELECT id, message_id, attempt, host, address, smtp_code, latency_ms, error_message, created_at
+		FROM delivery_attempts
+		WHERE message_id = ?
+		ORDER BY created_at ASC, id ASC
+	`, messageID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list delivery attempts: %w", err)
+	}
+	defer rows.Close()
+
+	var attempts []*Attempt
+	for rows.Next() {
+		var (
+			a         Attempt
+			address   sql.NullString
+			code      sql.NullInt64
+			latencyMS int64
+			errMsg    sql.NullString
+		)
+		if err := rows.Scan(&a.ID, &a.MessageID, &a.Attempt, &a.Host, &address, &code, &latencyMS, &errMsg, &a.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan delivery attempt: %w", err)
+		}
+		a.Address = address.String
+		a.SMTPCode = int(code.Int64)
+		a.Latency = time.Duration(latencyMS) * time.Millisecond
+		a.Error = errMsg.String
+		attempts = append(attempts, &a)
+	}
+
+	return attempts, rows.Err()
+}
+
+// Prune deletes the attempts made before t, returning how many went
+func (l *AttemptLog) Prune(ctx context.Context, t time.Time) (int64, error) {
+	result, err := l.db.ExecContext(ctx, "DELETE FROM delivery_attempts WHERE created_at < ?", t.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune delivery attempts: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// smtpReplyCode extracts the SMTP reply code from a delivery error, if any.
+func smtpReplyCode(err error) int {
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) {
+		return tpErr.Code
+	}
+	return 0
+}
@@ -17,6 +17,7 @@ type BounceGenerator struct {
 	hostname   string
 	postmaster string
 	template   *template.Template
+	success    *template.Template
 }
 
 // NewBounceGenerator creates a new bounce message generator
@@ -26,6 +27,7 @@ func NewBounceGenerator(hostname string) *BounceGenerator {
 		hostname:   hostname,
 		postmaster: "postmaster@" + hostname,
 		template:   tmpl,
+		success:    template.Must(template.New("success").Parse(successTemplate)),
 	}
 }
 
@@ -37,34 +39,56 @@ type BounceData struct {
 	To              string
 	OriginalSender  string
 	FailedRecipient string
+	Recipients      []string
+	EnvelopeID      string
 	ErrorCode       string
 	ErrorMessage    string
+	Reason          string
 	Hostname        string
 	OriginalHeaders string
+	OriginalMessage string // The whole message, when the sender asked for RET=FULL
 }
 
 // Generate creates a DSN for a failed delivery
 func (g *BounceGenerator) Generate(msg *queue.Message, failureErr error) ([]byte, error) {
-	// Extract original headers if message file exists
-	originalHeaders := ""
-	if msg.MessagePath != "" {
-		if content, err := os.ReadFile(msg.MessagePath); err == nil {
-			// Extract just the headers (up to first blank line)
-			if idx := bytes.Index(content, []byte("\r\n\r\n")); idx > 0 {
-				originalHeaders = string(content[:idx])
-			} else if idx := bytes.Index(content, []byte("\n\n")); idx > 0 {
-				originalHeaders = string(content[:idx])
-			}
-			// Limit header size to prevent huge bounces
-			if len(originalHeaders) > 4096 {
-				originalHeaders = originalHeaders[:4096] + "\n[... truncated ...]"
-			}
-		}
-	}
+	content := readMessage(msg.MessagePath)
 
 	// Classify error code
 	errorCode := classifyErrorCode(failureErr)
+	reason := "The message could not be delivered"
+	if status := classifyStatus(failureErr); status.known() {
+		reason = status.Reason
+	}
+
+	data := g.data(msg, content)
+	data.ErrorCode = errorCode
+	data.ErrorMessage = failureErr.Error()
+	data.Reason = reason
+	if content != nil && msg.DSN != nil && strings.EqualFold(msg.DSN.Return, "FULL") {
+		data.OriginalMessage = string(content)
+	}
 
+	var buf bytes.Buffer
+	if err := g.template.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("failed to generate bounce: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// GenerateSuccess creates a DSN reporting that msg was handed on to the
+// recipients' mail servers. Like RFC 3461 asks, it returns only the
+// message's headers whatever the sender gave for RET.
+func (g *BounceGenerator) GenerateSuccess(msg *queue.Message) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := g.success.Execute(&buf, g.data(msg, readMessage(msg.MessagePath))); err != nil {
+		return nil, fmt.Errorf("failed to generate delivery notice: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// data fills in the parts of a notice shared by failures and successes
+func (g *BounceGenerator) data(msg *queue.Message, content []byte) BounceData {
 	data := BounceData{
 		MessageID:       fmt.Sprintf("<%d.bounce@%s>", time.Now().UnixNano(), g.hostname),
 		Date:            time.Now().Format(time.RFC1123Z),
@@ -72,18 +96,43 @@ func (g *BounceGenerator) Generate(msg *queue.Message, failureErr error) ([]byte
 		To:              msg.Sender,
 		OriginalSender:  msg.Sender,
 		FailedRecipient: strings.Join(msg.Recipients, ", "),
-		ErrorCode:       errorCode,
-		ErrorMessage:    failureErr.Error(),
+		Recipients:      msg.Recipients,
 		Hostname:        g.hostname,
-		OriginalHeaders: originalHeaders,
+		OriginalHeaders: messageHeaders(content),
 	}
+	if msg.DSN != nil {
+		data.EnvelopeID = msg.DSN.EnvelopeID
+	}
+	return data
+}
 
-	var buf bytes.Buffer
-	if err := g.template.Execute(&buf, data); err != nil {
-		return nil, fmt.Errorf("failed to generate bounce: %w", err)
+// readMessage returns the message file's content, or nil if it can't be read
+func readMessage(path string) []byte {
+	if path == "" {
+		return nil
 	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	return content
+}
 
-	return buf.Bytes(), nil
+// messageHeaders returns the header section of content, cut short if it is
+// large
+func messageHeaders(content []byte) string {
+	// Extract just the headers (up to first blank line)
+	headers := ""
+	if idx := bytes.Index(content, []byte("\r\n\r\n")); idx > 0 {
+		headers = string(content[:idx])
+	} else if idx := bytes.Index(content, []byte("\n\n")); idx > 0 {
+		headers = string(content[:idx])
+	}
+	// Limit header size to prevent huge bounces
+	if len(headers) > 4096 {
+		headers = headers[:4096] + "\n[... truncated ...]"
+	}
+	return headers
 }
 
 // ShouldBounce returns true if a bounce should be generated for this message
@@ -107,6 +156,10 @@ func classifyErrorCode(err error) string {
 	if err == nil {
 		return "5.0.0"
 	}
+	// Prefer the enhanced code the remote server sent
+	if status := classifyStatus(err); status.Enhanced != "" && status.Permanent {
+		return status.Enhanced
+	}
 	errStr := err.Error()
 
 	// Map common SMTP codes to enhanced codes
@@ -145,6 +198,7 @@ more recipients. The following address(es) failed:
 
     {{.FailedRecipient}}
 
+Reason: {{.Reason}}
 Error: {{.ErrorMessage}}
 
 If this problem persists, please contact your mail administrator.
@@ -155,13 +209,64 @@ This is a permanent error; the message will not be retried.
 Content-Type: message/delivery-status
 
 Reporting-MTA: dns; {{.Hostname}}
+{{- if .EnvelopeID}}
+Original-Envelope-Id: {{.EnvelopeID}}
+{{- end}}
 Arrival-Date: {{.Date}}
-
-Final-Recipient: rfc822; {{.FailedRecipient}}
+{{range .Recipients}}
+Final-Recipient: rfc822; {{.}}
 Action: failed
-Status: {{.ErrorCode}}
-Diagnostic-Code: smtp; {{.ErrorMessage}}
+Status: {{$.ErrorCode}}
+Diagnostic-Code: smtp; {{$.ErrorMessage}}
+{{end}}
+--=_bounce_boundary
+{{- if .OriginalMessage}}
+Content-Type: message/rfc822
+
+{{.OriginalMessage}}
+{{- else}}
+Content-Type: text/rfc822-headers
+
+{{.OriginalHeaders}}
+{{- end}}
+
+--=_bounce_boundary--
+`
+
+const successTemplate = `From: Mail Delivery System <{{.From}}>
+To: <{{.To}}>
+Subject: Successful Mail Delivery Report
+Date: {{.Date}}
+Message-ID: {{.MessageID}}
+MIME-Version: 1.0
+Content-Type: multipart/report; report-type=delivery-status; boundary="=_bounce_boundary"
+Auto-Submitted: auto-replied
 
+--=_bounce_boundary
+Content-Type: text/plain; charset=utf-8
+
+This is the mail delivery system at {{.Hostname}}.
+
+Your message was handed on to the mail server of the following
+address(es), as you asked to be told:
+
+    {{.FailedRecipient}}
+
+That server doesn't report delivery, so no further notice will follow.
+
+--=_bounce_boundary
+Content-Type: message/delivery-status
+
+Reporting-MTA: dns; {{.Hostname}}
+{{- if .EnvelopeID}}
+Original-Envelope-Id: {{.EnvelopeID}}
+{{- end}}
+Arrival-Date: {{.Date}}
+{{range .Recipients}}
+Final-Recipient: rfc822; {{.}}
+Action: relayed
+Status: 2.0.0
+{{end}}
 --=_bounce_boundary
 Content-Type: text/rfc822-headers
 
@@ -1,12 +1,16 @@
 package delivery
 
 import (
+	"context"
 	"errors"
+	"net"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/fenilsonani/email-server/internal/logging"
 	"github.com/fenilsonani/email-server/internal/queue"
 )
 
@@ -344,3 +348,192 @@ func TestBounceGenerator_MessageIDUniqueness(t *testing.T) {
 		ids[msgID] = true
 	}
 }
+
+func TestBounceGenerator_ReturnsWhatSenderAsked(t *testing.T) {
+	bg := NewBounceGenerator("mail.example.com")
+	msgPath := filepath.Join(t.TempDir(), "test.eml")
+	if err := os.WriteFile(msgPath, []byte("Subject: Test Subject\r\n\r\nBody content here"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ret := range []string{"", "HDRS", "FULL"} {
+		msg := &queue.Message{
+			Sender:      "sender@example.com",
+			Recipients:  []string{"recipient@example.com"},
+			MessagePath: msgPath,
+			DSN:         &queue.DSN{Return: ret, EnvelopeID: "QQ314159"},
+		}
+		result, err := bg.Generate(msg, errors.New("550 User not found"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := string(result)
+		if !strings.Contains(body, "Subject: Test Subject") || !strings.Contains(body, "Original-Envelope-Id: QQ314159") {
+			t.Errorf("RET=%s: bounce is missing the headers or envelope ID:\n%s", ret, body)
+		}
+		if full := strings.Contains(body, "Body content here"); full != (ret == "FULL") {
+			t.Errorf("RET=%s: bounce returned the body = %v:\n%s", ret, full, body)
+		}
+	}
+}
+
+// deliverWithDSN delivers one message to bob@example.org and
+// carol@example.org through a relay advertising extensions, and returns the
+// notices queued for its sender
+func deliverWithDSN(t *testing.T, dsn *queue.DSN, extensions ...string) []string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mockPeer(t, conn, extensions...)
+		}
+	}()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "msg.eml")
+	if err := os.WriteFile(path, []byte("Subject: hi\r\n\r\nhello\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := DefaultConfig()
+	cfg.Hostname = "mail.example.com"
+	cfg.QueuePath = dir
+	cfg.RelayHost = ln.Addr().String()
+	cfg.ConnectTimeout = 5 * time.Second
+	cfg.CommandTimeout = 5 * time.Second
+
+	q := queue.NewMemoryQueue(queue.DefaultConfig())
+	defer q.Close()
+	e := NewEngine(cfg, q, nil, logging.Default())
+	ctx := context.Background()
+	if err := e.EnqueueWithDSN(ctx, "alice@example.com", []string{"bob@example.org", "carol@example.org"}, path, dsn); err != nil {
+		t.Fatalf("EnqueueWithDSN() error = %v", err)
+	}
+	msg, err := q.Dequeue(ctx)
+	if err != nil || msg == nil {
+		t.Fatalf("Dequeue() = %v, %v", msg, err)
+	}
+	e.deliverMessage(msg)
+
+	pending, _ := q.ListPending(ctx, 10)
+	var notices []string
+	for _, n := range pending {
+		if n.Sender != "" || len(n.Recipients) != 1 || n.Recipients[0] != "alice@example.com" {
+			t.Fatalf("queued %+v, want only notices to alice@example.com", n)
+		}
+		data, err := os.ReadFile(n.MessagePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		notices = append(notices, string(data))
+	}
+	return notices
+}
+
+func TestEngine_SuccessNotice(t *testing.T) {
+	notices := deliverWithDSN(t, &queue.DSN{
+		EnvelopeID: "QQ314159",
+		Notify:     map[string]string{"bob@example.org": "SUCCESS,FAILURE"},
+	})
+	if len(notices) != 1 {
+		t.Fatalf("queued %d notices, want 1", len(notices))
+	}
+	for _, want := range []string{"Final-Recipient: rfc822; bob@example.org\nAction: relayed\nStatus: 2.0.0", "Original-Envelope-Id: QQ314159", "Subject: hi"} {
+		if !strings.Contains(notices[0], want) {
+			t.Errorf("notice is missing %q:\n%s", want, notices[0])
+		}
+	}
+	if strings.Contains(notices[0], "carol@example.org") {
+		t.Errorf("notice names carol@example.org, who didn't ask for one:\n%s", notices[0])
+	}
+
+	// Without NOTIFY=SUCCESS a delivery is silent
+	if notices := deliverWithDSN(t, nil); len(notices) != 0 {
+		t.Errorf("queued %d notices for a plain delivery, want none", len(notices))
+	}
+}
+
+func TestEngine_NoRelayedNoticeToDSNPeer(t *testing.T) {
+	// A relay with DSN was given NOTIFY and reports the delivery itself
+	notices := deliverWithDSN(t, &queue.DSN{
+		Notify: map[string]string{"bob@example.org": "SUCCESS"},
+	}, "DSN")
+	if len(notices) != 0 {
+		t.Errorf("queued %d notices for a relay with DSN, want none:\n%s", len(notices), notices)
+	}
+}
+
+func TestDeliverOnConn_PassesDSNParameters(t *testing.T) {
+	msg := &queue.Message{
+		ID:         "m1",
+		Sender:     "alice@example.com",
+		Recipients: []string{"bob@example.org", "carol@example.org"},
+		DSN: &queue.DSN{
+			EnvelopeID: "QQ 31+4=159",
+			Return:     "HDRS",
+			Notify:     map[string]string{"bob@example.org": "SUCCESS,FAILURE"},
+		},
+	}
+	deliver := func(extensions ...string) []string {
+		client, server := net.Pipe()
+		done := mockPeer(t, server, extensions...)
+		if err := testSizeEngine().deliverOnConn(context.Background(), client, "192.0.2.1", "mx.example.org", msg, []byte("hello\r\n"), TLSPolicyNone); err != nil {
+			t.Fatalf("deliverOnConn() error = %v", err)
+		}
+		var envelope []string
+		for _, cmd := range <-done {
+			if strings.HasPrefix(cmd, "MAIL") || strings.HasPrefix(cmd, "RCPT") {
+				envelope = append(envelope, cmd)
+			}
+		}
+		return envelope
+	}
+
+	got := deliver("DSN")
+	want := []string{
+		"MAIL FROM:<alice@example.com> RET=HDRS ENVID=QQ+2031+2B4+3D159",
+		"RCPT TO:<bob@example.org> NOTIFY=SUCCESS,FAILURE",
+		"RCPT TO:<carol@example.org>",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("envelope = %q, want %q", got, want)
+	}
+	if !msg.DSNPassedOn {
+		t.Error("DSNPassedOn = false after a peer with DSN took the message")
+	}
+
+	// A peer without DSN gets none of the parameters
+	for _, cmd := range deliver() {
+		if strings.Contains(cmd, "RET=") || strings.Contains(cmd, "ENVID=") || strings.Contains(cmd, "NOTIFY=") {
+			t.Errorf("peer without DSN received %q", cmd)
+		}
+	}
+	if msg.DSNPassedOn {
+		t.Error("DSNPassedOn = true after a peer without DSN took the message")
+	}
+}
+
+func TestEngine_FailureNoticeHonorsNotify(t *testing.T) {
+	// The relay's SIZE limit fails the message permanently
+	notices := deliverWithDSN(t, &queue.DSN{
+		Notify: map[string]string{"bob@example.org": "NEVER", "carol@example.org": "NEVER"},
+	}, "SIZE 10")
+	if len(notices) != 0 {
+		t.Errorf("queued %d bounces with NOTIFY=NEVER, want none:\n%s", len(notices), notices)
+	}
+
+	notices = deliverWithDSN(t, &queue.DSN{
+		Notify: map[string]string{"bob@example.org": "NEVER"},
+	}, "SIZE 10")
+	if len(notices) != 1 || !strings.Contains(notices[0], "Final-Recipient: rfc822; carol@example.org\nAction: failed") || strings.Contains(notices[0], "bob@example.org") {
+		t.Errorf("bounces = %q, want one for carol@example.org only", notices)
+	}
+}
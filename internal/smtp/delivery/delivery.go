@@ -10,8 +10,11 @@ import (
 	"net"
 	"net/smtp"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fenilsonani/email-server/internal/logging"
@@ -34,8 +37,15 @@ var (
 type Config struct {
 	// Workers is the number of concurrent delivery workers.
 	Workers int
-	// Hostname is the HELO/EHLO hostname.
+	// Hostname is this server's name, used in trace headers and bounces and,
+	// unless HeloName is set, in HELO/EHLO.
 	Hostname string
+	// HeloName is the HELO/EHLO name, for hosts whose outbound address has
+	// a PTR record other than Hostname.
+	HeloName string
+	// SourceIP is the local address outbound connections are made from.
+	// Nil lets the system choose.
+	SourceIP net.IP
 	// ConnectTimeout is the TCP connection timeout.
 	ConnectTimeout time.Duration
 	// CommandTimeout is the SMTP command timeout.
@@ -50,6 +60,21 @@ type Config struct {
 	QueuePath string
 	// RelayHost is an optional smarthost for all outbound mail (host:port).
 	RelayHost string
+	// HappyEyeballsDelay is the stagger between parallel connection attempts
+	// to an MX's addresses (RFC 8305).
+	HappyEyeballsDelay time.Duration
+	// Throttle limits concurrency and rate per recipient domain.
+	Throttle ThrottleConfig
+	// TLSPolicies overrides the TLS policy for specific recipient domains
+	// (lowercase). Other domains use TLSPolicyMay, or a required policy
+	// when RequireTLS is set.
+	TLSPolicies map[string]TLSPolicy
+	// Hold selects messages to hold in the queue for admin review.
+	Hold HoldRules
+	// VERP queues each recipient separately and sends it with a VERP
+	// envelope sender that encodes the recipient, so bounces can be
+	// matched to the send they belong to.
+	VERP bool
 }
 
 // DefaultConfig returns sensible default configuration.
@@ -62,23 +87,55 @@ func DefaultConfig() Config {
 		MaxMessageSize: 25 * 1024 * 1024, // 25MB
 		RequireTLS:     false,
 		VerifyTLS:      true,
+
+		HappyEyeballsDelay: DefaultHappyEyeballsDelay,
+		Throttle: ThrottleConfig{
+			Default:          DomainLimit{MaxConcurrent: 5},
+			RateLimitBackoff: DefaultRateLimitBackoff,
+		},
+	}
+}
+
+// heloName returns the name to send in HELO/EHLO
+func (c Config) heloName() string {
+	if c.HeloName != "" {
+		return c.HeloName
+	}
+	return c.Hostname
+}
+
+// localAddr returns the address to dial from, or nil for the system's choice
+func (c Config) localAddr() net.Addr {
+	if c.SourceIP == nil {
+		return nil
 	}
+	return &net.TCPAddr{IP: c.SourceIP}
 }
 
 // Engine handles outbound email delivery.
 type Engine struct {
 	config         Config
-	queue          *queue.RedisQueue
+	queue          queue.Queue
 	mxResolver     *MXResolver
 	dkimPool       *security.DKIMSignerPool
 	breakers       *resilience.BreakerRegistry
 	logger         *logging.Logger
 	bounceGen      *BounceGenerator
+	attemptLog     *AttemptLog
+	sentLog        *SentLog
+	dialer         ContextDialer
+	throttle       *Throttle
 
-	ctx    context.Context
+	ctx    context.Context // Cancelled by Stop, so no new deliveries start
 	cancel context.CancelFunc
 	wg     sync.WaitGroup
 
+	// deliverCtx is cancelled only once Stop stops waiting, so deliveries
+	// in flight at shutdown can finish
+	deliverCtx    context.Context
+	cancelDeliver context.CancelFunc
+	inFlight      atomic.Int64
+
 	// Metrics
 	mu            sync.RWMutex
 	totalSent     int64
@@ -88,8 +145,9 @@ type Engine struct {
 }
 
 // NewEngine creates a new delivery engine.
-func NewEngine(cfg Config, q *queue.RedisQueue, dkim *security.DKIMSignerPool, logger *logging.Logger) *Engine {
+func NewEngine(cfg Config, q queue.Queue, dkim *security.DKIMSignerPool, logger *logging.Logger) *Engine {
 	ctx, cancel := context.WithCancel(context.Background())
+	deliverCtx, cancelDeliver := context.WithCancel(context.Background())
 
 	return &Engine{
 		config:     cfg,
@@ -108,11 +166,26 @@ func NewEngine(cfg Config, q *queue.RedisQueue, dkim *security.DKIMSignerPool, l
 		}),
 		logger:    logger.Delivery(),
 		bounceGen: NewBounceGenerator(cfg.Hostname),
+		dialer:    &net.Dialer{LocalAddr: cfg.localAddr()},
+		throttle:  NewThrottle(cfg.Throttle),
 		ctx:       ctx,
 		cancel:    cancel,
+
+		deliverCtx:    deliverCtx,
+		cancelDeliver: cancelDeliver,
 	}
 }
 
+// SetAttemptLog sets where per-message delivery attempts are recorded.
+func (e *Engine) SetAttemptLog(l *AttemptLog) {
+	e.attemptLog = l
+}
+
+// SetSentLog sets where delivered sends are recorded for bounce matching.
+func (e *Engine) SetSentLog(l *SentLog) {
+	e.sentLog = l
+}
+
 // Start starts the delivery workers.
 func (e *Engine) Start() {
 	e.logger.Info("Starting delivery engine", "workers", e.config.Workers)
@@ -127,16 +200,49 @@ func (e *Engine) Start() {
 	go e.recoveryWorker()
 }
 
-// Stop gracefully stops the delivery engine.
-func (e *Engine) Stop() {
-	e.logger.Info("Stopping delivery engine")
+// Stop stops taking messages off the queue and waits for deliveries in
+// flight to finish. If ctx ends first they are cancelled and left for the
+// queue to retry, and Stop returns an error saying how many were cut off.
+func (e *Engine) Stop(ctx context.Context) error {
+	e.logger.Info("Stopping delivery engine", "in_flight", e.inFlight.Load())
 	e.cancel()
-	e.wg.Wait()
-	e.logger.Info("Delivery engine stopped")
+
+	done := make(chan struct{})
+	go func() {
+		e.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		e.cancelDeliver()
+		e.logger.Info("Delivery engine stopped")
+		return nil
+	case <-ctx.Done():
+		n := e.inFlight.Load()
+		e.cancelDeliver()
+		<-done
+		e.logger.Warn("Delivery engine stopped, cancelled deliveries in flight", "count", n)
+		return fmt.Errorf("%d deliveries still in flight: %w", n, ctx.Err())
+	}
+}
+
+// wait sleeps for d, returning early once Stop is called.
+func (e *Engine) wait(d time.Duration) {
+	select {
+	case <-e.ctx.Done():
+	case <-time.After(d):
+	}
 }
 
 // Enqueue adds a message for delivery.
 func (e *Engine) Enqueue(ctx context.Context, sender string, recipients []string, messagePath string) error {
+	return e.EnqueueWithDSN(ctx, sender, recipients, messagePath, nil)
+}
+
+// EnqueueWithDSN adds a message for delivery, sending the delivery status
+// notifications dsn asks for. With a nil dsn only failures are reported.
+func (e *Engine) EnqueueWithDSN(ctx context.Context, sender string, recipients []string, messagePath string, dsn *queue.DSN) error {
 	// Validate message file exists and get size
 	info, err := os.Stat(messagePath)
 	if err != nil {
@@ -158,30 +264,81 @@ func (e *Engine) Enqueue(ctx context.Context, sender string, recipients []string
 		byDomain[domain] = append(byDomain[domain], rcpt)
 	}
 
-	// Create one queue message per domain
+	// Hold rules apply to the message as a whole, not per domain
+	holdReason := e.config.Hold.match(sender, recipients)
+
+	// Create one queue message per domain, or per recipient with VERP
+	verp := e.useVERP(sender)
+	queued := 0
 	for domain, rcpts := range byDomain {
-		msg := &queue.Message{
-			Sender:      sender,
-			Recipients:  rcpts,
-			MessagePath: messagePath,
-			Size:        info.Size(),
-			Domain:      domain,
+		batches := [][]string{rcpts}
+		if verp {
+			batches = batches[:0]
+			for _, rcpt := range rcpts {
+				batches = append(batches, []string{rcpt})
+			}
 		}
 
-		if err := e.queue.Enqueue(ctx, msg); err != nil {
-			return fmt.Errorf("failed to enqueue for domain %s: %w", domain, err)
+		for _, batch := range batches {
+			// Each VERP message is cleaned up on its own once delivered,
+			// so each gets its own link to the message file
+			path := messagePath
+			if verp && queued > 0 {
+				path = fmt.Sprintf("%s.%d", messagePath, queued)
+				if err := os.Link(messagePath, path); err != nil {
+					return fmt.Errorf("failed to link message file: %w", err)
+				}
+			}
+			queued++
+
+			msg := &queue.Message{
+				Sender:      sender,
+				Recipients:  batch,
+				MessagePath: path,
+				Size:        info.Size(),
+				Domain:      domain,
+				DSN:         dsn,
+			}
+			if holdReason != "" {
+				msg.Status = queue.StatusHeld
+				msg.HoldReason = holdReason
+			}
+
+			if err := e.queue.Enqueue(ctx, msg); err != nil {
+				if path != messagePath {
+					os.Remove(path)
+				}
+				return fmt.Errorf("failed to enqueue for domain %s: %w", domain, err)
+			}
 		}
 
 		e.logger.InfoContext(ctx, "Message enqueued",
 			"domain", domain,
 			"recipients", len(rcpts),
 			"size", info.Size(),
+			"held", holdReason != "",
 		)
 	}
 
 	return nil
 }
 
+// useVERP reports whether mail from sender is sent with VERP. Bounces and
+// other mail that must not be answered keep their envelope sender.
+func (e *Engine) useVERP(sender string) bool {
+	return e.config.VERP && ShouldBounce(sender)
+}
+
+// returnPath returns the envelope sender msg is sent with: its VERP
+// address when it has a single recipient and VERP applies, otherwise its
+// sender
+func (e *Engine) returnPath(msg *queue.Message) string {
+	if len(msg.Recipients) != 1 || !e.useVERP(msg.Sender) {
+		return msg.Sender
+	}
+	return EncodeVERP(msg.Sender, msg.Recipients[0])
+}
+
 // worker is a delivery worker goroutine.
 func (e *Engine) worker(id int) {
 	defer e.wg.Done()
@@ -199,39 +356,54 @@ func (e *Engine) worker(id int) {
 		// Try to get a message
 		msg, err := e.queue.Dequeue(e.ctx)
 		if err != nil {
-			if !errors.Is(err, queue.ErrQueueClosed) {
+			if !errors.Is(err, queue.ErrQueueClosed) && e.ctx.Err() == nil {
 				e.logger.Error("Failed to dequeue message", "error", err.Error(), "worker_id", id)
 			}
-			time.Sleep(time.Second)
+			e.wait(time.Second)
 			continue
 		}
 
 		if msg == nil {
 			// No messages ready, wait a bit
-			time.Sleep(500 * time.Millisecond)
+			e.wait(500 * time.Millisecond)
 			continue
 		}
 
-		// Deliver the message
+		// Deliver the message; Stop waits for it to finish
+		e.inFlight.Add(1)
 		e.deliverMessage(msg)
+		e.inFlight.Add(-1)
 	}
 }
 
 // deliverMessage attempts to deliver a single message.
 func (e *Engine) deliverMessage(msg *queue.Message) {
-	ctx := logging.WithMessageID(e.ctx, msg.ID)
+	ctx := logging.WithMessageID(e.deliverCtx, msg.ID)
 	logger := e.logger.WithFields("message_id", msg.ID, "domain", msg.Domain)
+	// Queue updates must land even if Stop cancelled the delivery
+	qctx := context.WithoutCancel(ctx)
 
 	logger.InfoContext(ctx, "Attempting delivery",
 		"attempt", msg.Attempts,
 		"recipients", len(msg.Recipients),
 	)
 
+	// Respect per-domain concurrency, rate and 4.7.x backoff
+	release, retryAt, ok := e.throttle.Acquire(msg.Domain)
+	if !ok {
+		logger.DebugContext(ctx, "Domain throttled, deferring", "until", retryAt)
+		if err := e.queue.Defer(qctx, msg.ID, retryAt); err != nil {
+			logger.WarnContext(ctx, "Failed to defer throttled message", "error", err.Error())
+		}
+		return
+	}
+	defer release()
+
 	// Check circuit breaker for this domain
 	breaker := e.breakers.Get(msg.Domain)
 	if breaker.State() == resilience.StateOpen {
 		logger.WarnContext(ctx, "Circuit breaker open, deferring")
-		e.queue.Retry(ctx, msg.ID, ErrCircuitOpen)
+		e.queue.Retry(qctx, msg.ID, ErrCircuitOpen)
 		e.mu.Lock()
 		e.totalRetried++
 		e.mu.Unlock()
@@ -247,14 +419,14 @@ func (e *Engine) deliverMessage(msg *queue.Message) {
 		// Determine if permanent or temporary
 		if isPermanentError(err) {
 			logger.ErrorContext(ctx, "Permanent delivery failure", err)
-			e.queue.Fail(ctx, msg.ID, err.Error())
+			e.queue.Fail(qctx, msg.ID, failureReason(err))
 			e.mu.Lock()
 			e.totalFailed++
 			e.mu.Unlock()
 
-			// Generate and send bounce message
-			if ShouldBounce(msg.Sender) {
-				if bounceErr := e.sendBounce(ctx, msg, err); bounceErr != nil {
+			// Generate and send bounce message to the recipients that want one
+			if notice := noticeFor(msg, "FAILURE"); notice != nil {
+				if bounceErr := e.sendBounce(qctx, notice, err); bounceErr != nil {
 					logger.WarnContext(ctx, "Failed to send bounce message",
 						"error", bounceErr.Error())
 				} else {
@@ -271,8 +443,12 @@ func (e *Engine) deliverMessage(msg *queue.Message) {
 					"error", err.Error())
 			}
 		} else {
+			if isRateLimited(err) {
+				until := e.throttle.Backoff(msg.Domain)
+				logger.WarnContext(ctx, "Rate limited by domain, backing off", "until", until)
+			}
 			logger.WarnContext(ctx, "Temporary delivery failure, will retry", "error", err.Error())
-			e.queue.Retry(ctx, msg.ID, err)
+			e.queue.Retry(qctx, msg.ID, errors.New(failureReason(err)))
 			e.mu.Lock()
 			e.totalRetried++
 			e.mu.Unlock()
@@ -282,10 +458,18 @@ func (e *Engine) deliverMessage(msg *queue.Message) {
 
 	// Success!
 	logger.InfoContext(ctx, "Message delivered successfully")
-	e.queue.Complete(ctx, msg.ID)
+	e.queue.Complete(qctx, msg.ID)
 	e.mu.Lock()
 	e.totalSent++
 	e.mu.Unlock()
+	e.recordSent(qctx, msg)
+
+	// A server that took the DSN parameters reports to the sender itself
+	if notice := noticeFor(msg, "SUCCESS"); notice != nil && !msg.DSNPassedOn {
+		if err := e.sendSuccessNotice(qctx, notice); err != nil {
+			logger.WarnContext(ctx, "Failed to send delivery notice", "error", err.Error())
+		}
+	}
 
 	// Clean up the message file from disk
 	if err := e.cleanupMessageFile(msg.MessagePath); err != nil {
@@ -295,6 +479,57 @@ func (e *Engine) deliverMessage(msg *queue.Message) {
 	}
 }
 
+// recordSent logs each recipient of a delivered message that can bounce,
+// so a bounce sent back to its return path can be matched to it
+func (e *Engine) recordSent(ctx context.Context, msg *queue.Message) {
+	if e.sentLog == nil || !ShouldBounce(msg.Sender) {
+		return
+	}
+	// The Message-ID and ENVID are what a bounce names the message by
+	var messageID, envelopeID string
+	if f, err := os.Open(msg.MessagePath); err == nil {
+		messageID = HeaderMessageID(f)
+		f.Close()
+	}
+	if msg.DSN != nil {
+		envelopeID = msg.DSN.EnvelopeID
+	}
+	returnPath := e.returnPath(msg)
+	for _, rcpt := range msg.Recipients {
+		sent := &SentEmail{
+			MessageID:         msg.ID,
+			Sender:            msg.Sender,
+			Recipient:         rcpt,
+			ReturnPath:        returnPath,
+			OriginalMessageID: messageID,
+			EnvelopeID:        envelopeID,
+		}
+		if err := e.sentLog.Record(ctx, sent); err != nil {
+			e.logger.WarnContext(ctx, "Failed to record sent email", "error", err.Error())
+		}
+	}
+}
+
+// noticeFor returns a copy of msg addressed to the recipients whose sender
+// wants a notice of kind (RFC 3461), or nil if none does
+func noticeFor(msg *queue.Message, kind string) *queue.Message {
+	if !ShouldBounce(msg.Sender) {
+		return nil
+	}
+	var rcpts []string
+	for _, rcpt := range msg.Recipients {
+		if msg.DSN.Wants(rcpt, kind) {
+			rcpts = append(rcpts, rcpt)
+		}
+	}
+	if len(rcpts) == 0 {
+		return nil
+	}
+	notice := *msg
+	notice.Recipients = rcpts
+	return &notice
+}
+
 // sendBounce generates and sends a bounce message back to the sender.
 func (e *Engine) sendBounce(ctx context.Context, msg *queue.Message, failureErr error) error {
 	// Generate bounce message
@@ -302,40 +537,65 @@ func (e *Engine) sendBounce(ctx context.Context, msg *queue.Message, failureErr
 	if err != nil {
 		return fmt.Errorf("failed to generate bounce: %w", err)
 	}
+	if err := e.queueNotice(ctx, msg, "bounce", bounceData); err != nil {
+		return err
+	}
+
+	e.logger.InfoContext(ctx, "Bounce message queued",
+		"original_message_id", msg.ID,
+		"bounce_recipient", msg.Sender,
+	)
+
+	return nil
+}
 
-	// Create temporary file for bounce message
-	tmpFile, err := os.CreateTemp(e.config.QueuePath, "bounce-*.eml")
+// sendSuccessNotice sends the sender a DSN saying msg was relayed.
+func (e *Engine) sendSuccessNotice(ctx context.Context, msg *queue.Message) error {
+	data, err := e.bounceGen.GenerateSuccess(msg)
 	if err != nil {
-		return fmt.Errorf("failed to create bounce temp file: %w", err)
+		return err
+	}
+	if err := e.queueNotice(ctx, msg, "dsn", data); err != nil {
+		return err
 	}
-	bouncePath := tmpFile.Name()
 
-	if _, err := tmpFile.Write(bounceData); err != nil {
+	e.logger.InfoContext(ctx, "Delivery notice queued",
+		"original_message_id", msg.ID,
+		"notice_recipient", msg.Sender,
+		"recipients", len(msg.Recipients),
+	)
+	return nil
+}
+
+// queueNotice queues a notice about msg to its sender from the null sender.
+func (e *Engine) queueNotice(ctx context.Context, msg *queue.Message, kind string, data []byte) error {
+	// Create temporary file for the notice
+	tmpFile, err := os.CreateTemp(e.config.QueuePath, kind+"-*.eml")
+	if err != nil {
+		return fmt.Errorf("failed to create %s temp file: %w", kind, err)
+	}
+	path := tmpFile.Name()
+
+	if _, err := tmpFile.Write(data); err != nil {
 		tmpFile.Close()
-		os.Remove(bouncePath)
-		return fmt.Errorf("failed to write bounce message: %w", err)
+		os.Remove(path)
+		return fmt.Errorf("failed to write %s message: %w", kind, err)
 	}
 	tmpFile.Close()
 
-	// Enqueue bounce for delivery (null sender as per RFC)
-	bounceMsg := &queue.Message{
-		Sender:      "", // Null sender for bounces
+	// Enqueue for delivery (null sender as per RFC)
+	noticeMsg := &queue.Message{
+		Sender:      "", // Null sender for notices
 		Recipients:  []string{msg.Sender},
-		MessagePath: bouncePath,
-		Size:        int64(len(bounceData)),
+		MessagePath: path,
+		Size:        int64(len(data)),
 		Domain:      extractDomain(msg.Sender),
 	}
 
-	if err := e.queue.Enqueue(ctx, bounceMsg); err != nil {
-		os.Remove(bouncePath)
-		return fmt.Errorf("failed to enqueue bounce: %w", err)
+	if err := e.queue.Enqueue(ctx, noticeMsg); err != nil {
+		os.Remove(path)
+		return fmt.Errorf("failed to enqueue %s: %w", kind, err)
 	}
-
-	e.logger.InfoContext(ctx, "Bounce message queued",
-		"original_message_id", msg.ID,
-		"bounce_recipient", msg.Sender,
-	)
-
 	return nil
 }
 
@@ -371,7 +631,10 @@ func (e *Engine) attemptDelivery(ctx context.Context, msg *queue.Message) error
 	// Use relay host if configured
 	if e.config.RelayHost != "" {
 		e.logger.DebugContext(ctx, "Using relay host", "relay", e.config.RelayHost)
-		return e.deliverToRelay(ctx, msg, messageData)
+		start := time.Now()
+		err := e.deliverToRelay(ctx, msg, messageData)
+		e.recordAttempt(ctx, msg, e.config.RelayHost, "", start, err)
+		return err
 	}
 
 	// Resolve MX records
@@ -380,29 +643,56 @@ func (e *Engine) attemptDelivery(ctx context.Context, msg *queue.Message) error
 		return fmt.Errorf("MX lookup failed: %w", err)
 	}
 
-	// Try each MX host in preference order
+	// Try each MX host in preference order, racing its addresses
 	var lastErr error
 	for _, mx := range mxHosts {
-		for _, addr := range mx.Addresses {
-			lastErr = e.deliverToHost(ctx, addr, mx.Host, msg, messageData)
-			if lastErr == nil {
-				return nil // Success
-			}
-
-			// Check if permanent error
-			if isPermanentError(lastErr) {
-				return lastErr
-			}
+		start := time.Now()
+		addr, err := e.deliverToHost(ctx, mx.Addresses, mx.Host, msg, messageData)
+		lastErr = err
+		e.recordAttempt(ctx, msg, mx.Host, addr, start, lastErr)
+		if lastErr == nil {
+			return nil // Success
+		}
 
-			e.logger.DebugContext(ctx, "MX attempt failed, trying next",
-				"host", mx.Host,
-				"addr", addr,
-				"error", lastErr.Error(),
-			)
+		// Check if permanent error
+		if isPermanentError(lastErr) {
+			return lastErr
 		}
+
+		e.logger.DebugContext(ctx, "MX attempt failed, trying next",
+			"host", mx.Host,
+			"addr", addr,
+			"error", lastErr.Error(),
+		)
 	}
 
-	return fmt.Errorf("%w: %v", ErrAllMXFailed, lastErr)
+	return fmt.Errorf("%w: %w", ErrAllMXFailed, lastErr)
+}
+
+// recordAttempt writes a delivery attempt to the attempt log, if configured.
+func (e *Engine) recordAttempt(ctx context.Context, msg *queue.Message, host, addr string, start time.Time, err error) {
+	if e.attemptLog == nil {
+		return
+	}
+
+	attempt := &Attempt{
+		MessageID: msg.ID,
+		Attempt:   msg.Attempts,
+		Host:      host,
+		Address:   addr,
+		Latency:   time.Since(start),
+		CreatedAt: start,
+	}
+	if err != nil {
+		attempt.SMTPCode = smtpReplyCode(err)
+		attempt.Error = err.Error()
+	} else {
+		attempt.SMTPCode = 250
+	}
+
+	if recErr := e.attemptLog.Record(ctx, attempt); recErr != nil {
+		e.logger.WarnContext(ctx, "Failed to record delivery attempt", "error", recErr.Error())
+	}
 }
 
 // deliverToRelay sends mail through the configured relay host.
@@ -416,7 +706,8 @@ func (e *Engine) deliverToRelay(ctx context.Context, msg *queue.Message, data []
 
 	// Connect with timeout
 	dialer := &net.Dialer{
-		Timeout: e.config.ConnectTimeout,
+		Timeout:   e.config.ConnectTimeout,
+		LocalAddr: e.config.localAddr(),
 	}
 
 	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
@@ -431,6 +722,9 @@ func (e *Engine) deliverToRelay(ctx context.Context, msg *queue.Message, data []
 		deadline = ctxDeadline
 	}
 	conn.SetDeadline(deadline)
+	// Abort a blocked read or write if the delivery is cancelled
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
 
 	// Create SMTP client
 	client, err := smtp.NewClient(conn, host)
@@ -443,36 +737,12 @@ func (e *Engine) deliverToRelay(ctx context.Context, msg *queue.Message, data []
 	}()
 
 	// Say hello
-	if err := client.Hello(e.config.Hostname); err != nil {
+	if err := client.Hello(e.config.heloName()); err != nil {
 		return fmt.Errorf("HELO failed: %w", err)
 	}
 
-	// Set sender
-	if err := client.Mail(msg.Sender); err != nil {
-		return classifyError(err)
-	}
-
-	// Set recipients - track successes
-	successfulRecipients := 0
-	var lastRcptErr error
-	for _, rcpt := range msg.Recipients {
-		if err := client.Rcpt(rcpt); err != nil {
-			lastRcptErr = err
-			e.logger.WarnContext(ctx, "RCPT failed",
-				"recipient", rcpt,
-				"error", err.Error(),
-			)
-		} else {
-			successfulRecipients++
-		}
-	}
-
-	// If no recipients accepted, fail
-	if successfulRecipients == 0 {
-		if lastRcptErr != nil {
-			return classifyError(lastRcptErr)
-		}
-		return fmt.Errorf("%w: no recipients accepted", ErrInvalidRecipient)
+	if err := e.sendEnvelope(ctx, client, msg, host, int64(len(data))); err != nil {
+		return err
 	}
 
 	// Send data
@@ -502,48 +772,94 @@ func (e *Engine) readAndSignMessage(ctx context.Context, msg *queue.Message) ([]
 		return nil, err
 	}
 
-	// Sign with DKIM if available
-	if e.dkimPool != nil {
-		senderDomain := extractDomain(msg.Sender)
-		signer := e.dkimPool.GetSigner(senderDomain)
-		if signer != nil {
-			var signed bytes.Buffer
-			if err := signer.Sign(&signed, bytes.NewReader(data)); err != nil {
-				e.logger.WarnContext(ctx, "DKIM signing failed", "error", err.Error())
-				// Continue without DKIM
-			} else {
-				data = signed.Bytes()
-			}
-		}
-	}
+	// Stamp our own hop ahead of the signature
+	data = append([]byte(e.receivedHeader(msg, time.Now())), data...)
 
-	return data, nil
+	return e.sign(ctx, msg.Sender, data), nil
 }
 
-// deliverToHost delivers to a specific SMTP server.
-func (e *Engine) deliverToHost(ctx context.Context, addr, hostname string, msg *queue.Message, data []byte) error {
-	return e.deliverToHostWithTLS(ctx, addr, hostname, msg, data, true)
+// sign applies the sender domain's DKIM signature, if one is configured.
+func (e *Engine) sign(ctx context.Context, sender string, data []byte) []byte {
+	if e.dkimPool == nil {
+		return data
+	}
+	signer := e.dkimPool.GetSigner(extractDomain(sender))
+	if signer == nil {
+		return data
+	}
+
+	var signed bytes.Buffer
+	if err := signer.Sign(&signed, bytes.NewReader(data)); err != nil {
+		e.logger.WarnContext(ctx, "DKIM signing failed", "error", err.Error())
+		// Continue without DKIM
+		return data
+	}
+	return signed.Bytes()
 }
 
-// deliverToHostWithTLS delivers to a specific SMTP server with optional TLS.
-func (e *Engine) deliverToHostWithTLS(ctx context.Context, addr, hostname string, msg *queue.Message, data []byte, tryTLS bool) error {
-	// Connect with timeout
-	dialer := &net.Dialer{
-		Timeout: e.config.ConnectTimeout,
+// receivedHeader builds the Received trace header (RFC 5321 section 4.4)
+// added when a queued message leaves this host.
+func (e *Engine) receivedHeader(msg *queue.Message, now time.Time) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Received: by %s with ESMTP id %s", e.config.Hostname, msg.ID)
+	if len(msg.Recipients) == 1 {
+		fmt.Fprintf(&b, "\r\n\tfor <%s>", msg.Recipients[0])
 	}
+	fmt.Fprintf(&b, "; %s\r\n", now.Format(time.RFC1123Z))
+	return b.String()
+}
 
-	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(addr, "25"))
-	if err != nil {
-		return fmt.Errorf("connection failed: %w", err)
+// deliverToHost delivers to a specific SMTP server, connecting to whichever
+// of its addresses answers first. It returns the address that was used.
+func (e *Engine) deliverToHost(ctx context.Context, addrs []string, hostname string, msg *queue.Message, data []byte) (string, error) {
+	return e.deliverToHostWithTLS(ctx, addrs, hostname, msg, data, e.tlsPolicy(msg.Domain))
+}
+
+// deliverToHostWithTLS delivers to a specific SMTP server under a TLS policy.
+// When the conversation with one address fails temporarily, the host's
+// other addresses are tried before giving up on it.
+func (e *Engine) deliverToHostWithTLS(ctx context.Context, addrs []string, hostname string, msg *queue.Message, data []byte, policy TLSPolicy) (string, error) {
+	var lastAddr string
+	var lastErr error
+	for remaining := addrs; len(remaining) > 0; {
+		// Race connections across address families, each bounded by the connect timeout
+		conn, addr, err := dialHappyEyeballs(ctx, e.dialer, remaining, "25", e.config.HappyEyeballsDelay, e.config.ConnectTimeout)
+		if err != nil {
+			if lastErr != nil {
+				return lastAddr, lastErr
+			}
+			return "", fmt.Errorf("connection failed: %w", err)
+		}
+		err = e.deliverOnConn(ctx, conn, addr, hostname, msg, data, policy)
+		conn.Close()
+		if err == nil || isPermanentError(err) || ctx.Err() != nil {
+			return addr, err
+		}
+		lastAddr, lastErr = addr, err
+
+		remaining = slices.DeleteFunc(slices.Clone(remaining), func(a string) bool { return a == addr })
+		if len(remaining) > 0 {
+			e.logger.DebugContext(ctx, "MX address failed, trying another",
+				"host", hostname,
+				"addr", addr,
+				"error", err.Error(),
+			)
+		}
 	}
-	defer conn.Close()
+	return lastAddr, lastErr
+}
 
+// deliverOnConn runs the SMTP transaction over an established connection.
+func (e *Engine) deliverOnConn(ctx context.Context, conn net.Conn, addr, hostname string, msg *queue.Message, data []byte, policy TLSPolicy) error {
 	// Set overall deadline from context or config timeout
 	deadline := time.Now().Add(e.config.CommandTimeout)
 	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
 		deadline = ctxDeadline
 	}
 	conn.SetDeadline(deadline)
+	// Abort a blocked read or write if the delivery is cancelled
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
 
 	// Create SMTP client
 	client, err := smtp.NewClient(conn, hostname)
@@ -556,21 +872,21 @@ func (e *Engine) deliverToHostWithTLS(ctx context.Context, addr, hostname string
 	}()
 
 	// Say hello
-	if err := client.Hello(e.config.Hostname); err != nil {
+	if err := client.Hello(e.config.heloName()); err != nil {
 		return fmt.Errorf("HELO failed: %w", err)
 	}
 
-	// Try STARTTLS if enabled and this is our first attempt
-	if tryTLS {
+	// Try STARTTLS unless the policy forbids it or we already fell back
+	if policy != TLSPolicyNone {
 		if ok, _ := client.Extension("STARTTLS"); ok {
 			tlsConfig := &tls.Config{
 				ServerName:         hostname,
-				InsecureSkipVerify: !e.config.VerifyTLS,
+				InsecureSkipVerify: !policy.verify(e.config.VerifyTLS),
 				MinVersion:         tls.VersionTLS12,
 			}
 			if err := client.StartTLS(tlsConfig); err != nil {
-				if e.config.RequireTLS {
-					return fmt.Errorf("STARTTLS required but failed: %w", err)
+				if policy.required() {
+					return tlsPolicyError(policy, hostname, "STARTTLS failed: "+err.Error())
 				}
 				// TLS handshake failed - reconnect without TLS
 				// This handles servers with invalid certificates
@@ -582,15 +898,69 @@ func (e *Engine) deliverToHostWithTLS(ctx context.Context, addr, hostname string
 				client.Quit()
 				client.Close()
 				conn.Close()
-				return e.deliverToHostWithTLS(ctx, addr, hostname, msg, data, false)
+				_, err := e.deliverToHostWithTLS(ctx, []string{addr}, hostname, msg, data, TLSPolicyNone)
+				return err
 			}
-		} else if e.config.RequireTLS {
-			return fmt.Errorf("STARTTLS required but not supported by server")
+		} else if policy.required() {
+			return tlsPolicyError(policy, hostname, "STARTTLS not offered")
+		}
+	}
+
+	if err := e.sendEnvelope(ctx, client, msg, hostname, int64(len(data))); err != nil {
+		return err
+	}
+
+	// Send data
+	w, err := client.Data()
+	if err != nil {
+		return classifyError(err)
+	}
+
+	_, err = w.Write(data)
+	if err != nil {
+		w.Close()
+		return fmt.Errorf("data write failed: %w", err)
+	}
+
+	if err := w.Close(); err != nil {
+		return classifyError(err)
+	}
+
+	return nil
+}
+
+// sendEnvelope issues MAIL FROM and RCPT TO for a message of size bytes.
+// Peers without SMTPUTF8 get A-label domains; UTF-8 local parts can't be
+// downgraded and are failed permanently. A message larger than the peer's
+// advertised SIZE is failed permanently before anything is sent. Peers
+// with DSN get the sender's RET, ENVID and NOTIFY parameters (RFC 3461).
+func (e *Engine) sendEnvelope(ctx context.Context, client *smtp.Client, msg *queue.Message, hostname string, size int64) error {
+	sizeOK, sizeParam := client.Extension("SIZE")
+	if sizeOK {
+		if limit, err := strconv.ParseInt(strings.TrimSpace(sizeParam), 10, 64); err == nil && limit > 0 && size > limit {
+			return fmt.Errorf("%w: %d bytes exceeds the %d byte limit advertised by %s",
+				ErrMessageTooLarge, size, limit, hostname)
+		}
+	}
+
+	sender := e.returnPath(msg)
+	utf8OK, _ := client.Extension("SMTPUTF8")
+	if !utf8OK {
+		var err error
+		if sender, err = downgradeAddress(sender); err != nil {
+			return err
 		}
 	}
 
+	dsnOK, _ := client.Extension("DSN")
+	dsn := msg.DSN
+	if !dsnOK {
+		dsn = nil
+	}
+	msg.DSNPassedOn = dsn != nil
+
 	// Set sender
-	if err := client.Mail(msg.Sender); err != nil {
+	if err := mailFrom(client, sender, size, sizeOK, utf8OK, dsn); err != nil {
 		return classifyError(err)
 	}
 
@@ -598,7 +968,23 @@ func (e *Engine) deliverToHostWithTLS(ctx context.Context, addr, hostname string
 	successfulRecipients := 0
 	var lastRcptErr error
 	for _, rcpt := range msg.Recipients {
-		if err := client.Rcpt(rcpt); err != nil {
+		var notify string
+		if dsn != nil {
+			notify = dsn.Notify[rcpt]
+		}
+		if !utf8OK {
+			downgraded, err := downgradeAddress(rcpt)
+			if err != nil {
+				lastRcptErr = err
+				e.logger.WarnContext(ctx, "Recipient requires SMTPUTF8",
+					"recipient", rcpt,
+					"host", hostname,
+				)
+				continue
+			}
+			rcpt = downgraded
+		}
+		if err := rcptTo(client, rcpt, notify); err != nil {
 			lastRcptErr = err
 			e.logger.WarnContext(ctx, "RCPT failed",
 				"recipient", rcpt,
@@ -617,23 +1003,81 @@ func (e *Engine) deliverToHostWithTLS(ctx context.Context, addr, hostname string
 		return fmt.Errorf("%w: no recipients accepted", ErrInvalidRecipient)
 	}
 
-	// Send data
-	w, err := client.Data()
-	if err != nil {
-		return classifyError(err)
+	return nil
+}
+
+// mailFrom issues MAIL FROM like smtp.Client.Mail, adding SIZE=<n>
+// (RFC 1870) when the peer supports it and the DSN parameters of dsn, if
+// any.
+func mailFrom(client *smtp.Client, from string, size int64, sizeOK, utf8OK bool, dsn *queue.DSN) error {
+	if strings.ContainsAny(from, "\r\n") {
+		return errors.New("smtp: A line must not contain CR or LF")
 	}
 
-	_, err = w.Write(data)
+	cmd := "MAIL FROM:<" + from + ">"
+	if ok, _ := client.Extension("8BITMIME"); ok {
+		cmd += " BODY=8BITMIME"
+	}
+	if sizeOK {
+		cmd += " SIZE=" + strconv.FormatInt(size, 10)
+	}
+	if utf8OK {
+		cmd += " SMTPUTF8"
+	}
+	if dsn != nil {
+		if ret := strings.ToUpper(dsn.Return); ret == "FULL" || ret == "HDRS" {
+			cmd += " RET=" + ret
+		}
+		if dsn.EnvelopeID != "" {
+			cmd += " ENVID=" + xtext(dsn.EnvelopeID)
+		}
+	}
+
+	id, err := client.Text.Cmd("%s", cmd)
 	if err != nil {
-		w.Close()
-		return fmt.Errorf("data write failed: %w", err)
+		return err
 	}
+	client.Text.StartResponse(id)
+	defer client.Text.EndResponse(id)
+	_, _, err = client.Text.ReadResponse(250)
+	return err
+}
 
-	if err := w.Close(); err != nil {
-		return classifyError(err)
+// rcptTo issues RCPT TO like smtp.Client.Rcpt, adding NOTIFY=<notify>
+// when it isn't empty.
+func rcptTo(client *smtp.Client, to, notify string) error {
+	if strings.ContainsAny(to, "\r\n") {
+		return errors.New("smtp: A line must not contain CR or LF")
 	}
 
-	return nil
+	cmd := "RCPT TO:<" + to + ">"
+	if notify != "" {
+		cmd += " NOTIFY=" + strings.ToUpper(notify)
+	}
+
+	id, err := client.Text.Cmd("%s", cmd)
+	if err != nil {
+		return err
+	}
+	client.Text.StartResponse(id)
+	defer client.Text.EndResponse(id)
+	_, _, err = client.Text.ReadResponse(25)
+	return err
+}
+
+// xtext encodes s as an xtext parameter value (RFC 3461 section 4): "+",
+// "=" and bytes outside printable ASCII become "+" and two hex digits.
+func xtext(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < '!' || c > '~' || c == '+' || c == '=' {
+			fmt.Fprintf(&b, "+%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
 }
 
 // recoveryWorker periodically recovers stale messages.
@@ -702,6 +1146,21 @@ func isPermanentError(err error) bool {
 		return false
 	}
 
+	// Specific permanent errors
+	if errors.Is(err, ErrPermanentFailure) ||
+		errors.Is(err, ErrInvalidRecipient) ||
+		errors.Is(err, ErrMessageTooLarge) {
+		return true
+	}
+	if errors.Is(err, ErrTemporaryFailure) {
+		return false
+	}
+
+	// Go by the reply's basic and enhanced status codes
+	if status := classifyStatus(err); status.known() {
+		return status.Permanent
+	}
+
 	errStr := err.Error()
 
 	// Check for permanent SMTP codes (5xx)
@@ -713,13 +1172,6 @@ func isPermanentError(err error) bool {
 		return true
 	}
 
-	// Specific permanent errors
-	if errors.Is(err, ErrPermanentFailure) ||
-		errors.Is(err, ErrInvalidRecipient) ||
-		errors.Is(err, ErrMessageTooLarge) {
-		return true
-	}
-
 	return false
 }
 
@@ -729,14 +1181,27 @@ func classifyError(err error) error {
 		return nil
 	}
 
+	// Already classified
+	if errors.Is(err, ErrPermanentFailure) || errors.Is(err, ErrTemporaryFailure) {
+		return err
+	}
+
+	// Go by the reply's basic and enhanced status codes
+	if status := classifyStatus(err); status.known() {
+		if status.Permanent {
+			return fmt.Errorf("%w: %w", ErrPermanentFailure, err)
+		}
+		return fmt.Errorf("%w: %w", ErrTemporaryFailure, err)
+	}
+
 	errStr := err.Error()
 
 	// 5xx errors are permanent
 	if strings.HasPrefix(errStr, "5") ||
 		strings.Contains(errStr, " 5") {
-		return fmt.Errorf("%w: %v", ErrPermanentFailure, err)
+		return fmt.Errorf("%w: %w", ErrPermanentFailure, err)
 	}
 
 	// 4xx errors are temporary
-	return fmt.Errorf("%w: %v", ErrTemporaryFailure, err)
+	return fmt.Errorf("%w: %w", ErrTemporaryFailure, err)
 }
@@ -1,7 +1,10 @@
 package delivery
 
 import (
+	"context"
 	"errors"
+	"net"
+	"net/textproto"
 	"os"
 	"path/filepath"
 	"strings"
@@ -9,6 +12,7 @@ import (
 	"time"
 
 	"github.com/fenilsonani/email-server/internal/logging"
+	"github.com/fenilsonani/email-server/internal/queue"
 )
 
 func TestConfig_Defaults(t *testing.T) {
@@ -130,6 +134,27 @@ func TestClassifyError(t *testing.T) {
 	}
 }
 
+func TestSMTPReplyCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"nil", nil, 0},
+		{"plain error", errors.New("connection refused"), 0},
+		{"textproto", &textproto.Error{Code: 550, Msg: "no such user"}, 550},
+		{"classified", classifyError(&textproto.Error{Code: 451, Msg: "try later"}), 451},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := smtpReplyCode(tt.err); got != tt.want {
+				t.Errorf("smtpReplyCode() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestEngine_CleanupMessageFile(t *testing.T) {
 	tmpDir := t.TempDir()
 	logger := logging.Default()
@@ -296,6 +321,55 @@ func TestExtractDomain_EdgeCases(t *testing.T) {
 	}
 }
 
+func TestDowngradeAddress(t *testing.T) {
+	tests := []struct {
+		addr      string
+		want      string
+		permanent bool
+	}{
+		{"user@example.com", "user@example.com", false},
+		{"", "", false},
+		{"user@exämple.de", "user@xn--exmple-cua.de", false},
+		{"müller@example.com", "", true},
+		{"müller", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			got, err := downgradeAddress(tt.addr)
+			if tt.permanent {
+				if !errors.Is(err, ErrPermanentFailure) {
+					t.Errorf("downgradeAddress(%q) error = %v, want permanent failure", tt.addr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("downgradeAddress(%q) error = %v", tt.addr, err)
+			}
+			if got != tt.want {
+				t.Errorf("downgradeAddress(%q) = %q, want %q", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEngine_ReceivedHeader(t *testing.T) {
+	e := &Engine{config: Config{Hostname: "mx.example.com"}}
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	got := e.receivedHeader(&queue.Message{ID: "abc123", Recipients: []string{"bob@example.net"}}, now)
+	want := "Received: by mx.example.com with ESMTP id abc123\r\n\tfor <bob@example.net>; Fri, 01 Mar 2024 12:00:00 +0000\r\n"
+	if got != want {
+		t.Errorf("receivedHeader() = %q, want %q", got, want)
+	}
+
+	// Multiple recipients are not disclosed
+	got = e.receivedHeader(&queue.Message{ID: "abc123", Recipients: []string{"a@example.net", "b@example.net"}}, now)
+	if strings.Contains(got, "for <") {
+		t.Errorf("receivedHeader() = %q, should omit recipients when there are several", got)
+	}
+}
+
 func BenchmarkExtractDomain(b *testing.B) {
 	email := "user@example.com"
 	for i := 0; i < b.N; i++ {
@@ -309,3 +383,297 @@ func BenchmarkIsPermanentError(b *testing.B) {
 		isPermanentError(err)
 	}
 }
+
+func TestEngine_DeliversFromMemoryQueue(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mockPeer(t, conn)
+		}
+	}()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "msg.eml")
+	if err := os.WriteFile(path, []byte("Subject: hi\r\n\r\nhello\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := DefaultConfig()
+	cfg.Workers = 1
+	cfg.Hostname = "mail.example.com"
+	cfg.QueuePath = dir
+	cfg.RelayHost = ln.Addr().String()
+	cfg.ConnectTimeout = 5 * time.Second
+	cfg.CommandTimeout = 5 * time.Second
+
+	q := queue.NewMemoryQueue(queue.DefaultConfig())
+	defer q.Close()
+	e := NewEngine(cfg, q, nil, logging.Default())
+	if err := e.Enqueue(context.Background(), "alice@example.com", []string{"bob@example.org"}, path); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+
+	e.Start()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats := e.Stats()
+		if stats.QueueStats.Sent == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			e.Stop(context.Background())
+			t.Fatalf("message not delivered, queue stats %+v", stats.QueueStats)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	e.Stop(context.Background())
+
+	if stats := e.Stats(); stats.TotalSent != 1 || stats.QueueStats.Pending != 0 || stats.QueueStats.Processing != 0 {
+		t.Errorf("Stats() after Stop() = %+v, queue %+v", stats, stats.QueueStats)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("message file still present after delivery: %v", err)
+	}
+}
+
+func TestEngine_SourceIPAndHeloName(t *testing.T) {
+	// Any 127/8 address is local on Linux; elsewhere only 127.0.0.1 may be
+	source := net.ParseIP("127.0.0.2")
+	if probe, err := net.Listen("tcp", "127.0.0.2:0"); err != nil {
+		source = net.ParseIP("127.0.0.1")
+	} else {
+		probe.Close()
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer ln.Close()
+	type session struct {
+		remote net.Addr
+		cmds   <-chan []string
+	}
+	sessions := make(chan session, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		sessions <- session{conn.RemoteAddr(), mockPeer(t, conn)}
+	}()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "msg.eml")
+	if err := os.WriteFile(path, []byte("Subject: hi\r\n\r\nhello\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := DefaultConfig()
+	cfg.Hostname = "mail.example.com"
+	cfg.HeloName = "out1.example.com"
+	cfg.SourceIP = source
+	cfg.QueuePath = dir
+	cfg.RelayHost = ln.Addr().String()
+	cfg.ConnectTimeout = 5 * time.Second
+	cfg.CommandTimeout = 5 * time.Second
+
+	e := NewEngine(cfg, nil, nil, logging.Default())
+	if got := e.dialer.(*net.Dialer).LocalAddr; got == nil || !got.(*net.TCPAddr).IP.Equal(source) {
+		t.Errorf("MX dialer LocalAddr = %v, want %s", got, source)
+	}
+
+	msg := &queue.Message{ID: "1", Sender: "alice@example.com", Recipients: []string{"bob@example.org"}, MessagePath: path}
+	if err := e.deliverToRelay(context.Background(), msg, []byte("Subject: hi\r\n\r\nhello\r\n")); err != nil {
+		t.Fatalf("deliverToRelay() error = %v", err)
+	}
+
+	s := <-sessions
+	if ip := s.remote.(*net.TCPAddr).IP; !ip.Equal(source) {
+		t.Errorf("connection came from %s, want %s", ip, source)
+	}
+	if cmds := <-s.cmds; len(cmds) == 0 || cmds[0] != "EHLO out1.example.com" {
+		t.Errorf("commands = %q, want EHLO out1.example.com first", cmds)
+	}
+}
+
+func TestEngine_HeldMessageWaitsForRelease(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mockPeer(t, conn)
+		}
+	}()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "msg.eml")
+	if err := os.WriteFile(path, []byte("Subject: hi\r\n\r\nhello\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := DefaultConfig()
+	cfg.Workers = 1
+	cfg.Hostname = "mail.example.com"
+	cfg.QueuePath = dir
+	cfg.RelayHost = ln.Addr().String()
+	cfg.ConnectTimeout = 5 * time.Second
+	cfg.CommandTimeout = 5 * time.Second
+	cfg.Hold = HoldRules{MaxRecipients: 1}
+
+	q := queue.NewMemoryQueue(queue.DefaultConfig())
+	defer q.Close()
+	e := NewEngine(cfg, q, nil, logging.Default())
+	rcpts := []string{"bob@example.org", "carol@example.org"}
+	if err := e.Enqueue(context.Background(), "alice@example.com", rcpts, path); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+
+	e.Start()
+	defer e.Stop(context.Background())
+
+	// Give the worker time to pick the message up if it were pending
+	time.Sleep(time.Second)
+	held, _ := q.ListHeld(context.Background(), 10)
+	if len(held) != 1 || !strings.Contains(held[0].HoldReason, "2 recipients") {
+		t.Fatalf("ListHeld() = %+v, want the message held", held)
+	}
+	if stats := e.Stats(); stats.QueueStats.Sent != 0 {
+		t.Fatalf("held message delivered, queue stats %+v", stats.QueueStats)
+	}
+
+	if err := q.Release(context.Background(), held[0].ID); err != nil {
+		t.Fatalf("Release() error = %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for e.Stats().QueueStats.Sent != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("released message not delivered, queue stats %+v", e.Stats().QueueStats)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// startStalledRelay starts an engine delivering one message through a relay
+// that accepts the connection but stays silent until release is closed.
+func startStalledRelay(t *testing.T, release <-chan struct{}) (*Engine, *queue.MemoryQueue, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	accepted := make(chan struct{}, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- struct{}{}
+			go func() {
+				<-release
+				mockPeer(t, conn)
+			}()
+		}
+	}()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "msg.eml")
+	if err := os.WriteFile(path, []byte("Subject: hi\r\n\r\nhello\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := DefaultConfig()
+	cfg.Workers = 1
+	cfg.Hostname = "mail.example.com"
+	cfg.QueuePath = dir
+	cfg.RelayHost = ln.Addr().String()
+	cfg.ConnectTimeout = 5 * time.Second
+	cfg.CommandTimeout = 10 * time.Second
+
+	q := queue.NewMemoryQueue(queue.DefaultConfig())
+	t.Cleanup(func() { q.Close() })
+	e := NewEngine(cfg, q, nil, logging.Default())
+	if err := e.Enqueue(context.Background(), "alice@example.com", []string{"bob@example.org"}, path); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+
+	e.Start()
+	select {
+	case <-accepted:
+	case <-time.After(5 * time.Second):
+		e.Stop(context.Background())
+		t.Fatal("engine never connected to the relay")
+	}
+	return e, q, path
+}
+
+func TestEngine_StopWaitsForInFlightDelivery(t *testing.T) {
+	release := make(chan struct{})
+	e, _, path := startStalledRelay(t, release)
+
+	stopped := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		stopped <- e.Stop(ctx)
+	}()
+
+	select {
+	case err := <-stopped:
+		t.Fatalf("Stop() returned %v before the delivery finished", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-stopped; err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+	if stats := e.Stats(); stats.TotalSent != 1 {
+		t.Errorf("TotalSent after Stop() = %d, want 1", stats.TotalSent)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("message file still present after delivery: %v", err)
+	}
+}
+
+func TestEngine_StopTimesOut(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	e, q, path := startStalledRelay(t, release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := e.Stop(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "1 deliveries") {
+		t.Fatalf("Stop() error = %v, want a deadline error counting 1 delivery", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Stop() took %v after its deadline", elapsed)
+	}
+
+	// The cancelled delivery goes back on the queue and keeps its file
+	if stats, _ := q.Stats(context.Background()); stats.Processing != 0 || stats.Sent != 0 {
+		t.Errorf("queue stats after Stop() = %+v, want the message returned for retry", stats)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("message file removed after a cancelled delivery: %v", err)
+	}
+}
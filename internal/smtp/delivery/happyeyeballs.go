@@ -0,0 +1,145 @@
+package delivery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// DefaultHappyEyeballsDelay is the stagger between connection attempts
+// recommended by RFC 8305 section 5.
+const DefaultHappyEyeballsDelay = 250 * time.Millisecond
+
+// ContextDialer dials network connections. *net.Dialer satisfies it; tests
+// substitute a fake.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// interleaveAddrFamilies orders addresses IPv6 first, alternating with IPv4,
+// so a connection race always has both families in flight early (RFC 8305 section 4).
+func interleaveAddrFamilies(addrs []string) []string {
+	var ipv4, ipv6 []string
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			continue
+		}
+		if ip.To4() != nil {
+			ipv4 = append(ipv4, addr)
+		} else {
+			ipv6 = append(ipv6, addr)
+		}
+	}
+
+	out := make([]string, 0, len(ipv4)+len(ipv6))
+	for i := 0; i < len(ipv4) || i < len(ipv6); i++ {
+		if i < len(ipv6) {
+			out = append(out, ipv6[i])
+		}
+		if i < len(ipv4) {
+			out = append(out, ipv4[i])
+		}
+	}
+	return out
+}
+
+type dialResult struct {
+	conn net.Conn
+	addr string
+	err  error
+}
+
+// dialHappyEyeballs races connections to addrs, starting a new attempt every
+// delay (or as soon as the previous one fails), and returns the first
+// connection to succeed. Losing attempts are cancelled and closed. Each
+// attempt is bounded by timeout.
+func dialHappyEyeballs(ctx context.Context, dialer ContextDialer, addrs []string, port string, delay, timeout time.Duration) (net.Conn, string, error) {
+	if len(addrs) == 0 {
+		return nil, "", errors.New("no addresses to dial")
+	}
+	if delay <= 0 {
+		delay = DefaultHappyEyeballsDelay
+	}
+
+	raceCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult, len(addrs))
+	start := func(addr string) {
+		go func() {
+			attemptCtx := raceCtx
+			if timeout > 0 {
+				var attemptCancel context.CancelFunc
+				attemptCtx, attemptCancel = context.WithTimeout(raceCtx, timeout)
+				defer attemptCancel()
+			}
+			conn, err := dialer.DialContext(attemptCtx, "tcp", net.JoinHostPort(addr, port))
+			results <- dialResult{conn: conn, addr: addr, err: err}
+		}()
+	}
+
+	next := 0
+	start(addrs[next])
+	next++
+	inFlight := 1
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var lastErr error
+	for inFlight > 0 {
+		select {
+		case res := <-results:
+			inFlight--
+			if res.err == nil {
+				// Winner: cancel the rest and close any that still connect
+				cancel()
+				go drainDials(results, inFlight)
+				return res.conn, res.addr, nil
+			}
+			lastErr = fmt.Errorf("%s: %w", res.addr, res.err)
+
+			// A failure starts the next attempt immediately
+			if next < len(addrs) {
+				start(addrs[next])
+				next++
+				inFlight++
+				resetTimer(timer, delay)
+			}
+		case <-timer.C:
+			if next < len(addrs) {
+				start(addrs[next])
+				next++
+				inFlight++
+				timer.Reset(delay)
+			}
+		case <-ctx.Done():
+			go drainDials(results, inFlight)
+			return nil, "", ctx.Err()
+		}
+	}
+
+	return nil, "", lastErr
+}
+
+// drainDials closes connections from attempts that complete after the race is over.
+func drainDials(results <-chan dialResult, n int) {
+	for i := 0; i < n; i++ {
+		if res := <-results; res.conn != nil {
+			res.conn.Close()
+		}
+	}
+}
+
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
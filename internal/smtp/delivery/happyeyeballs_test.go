@@ -0,0 +1,176 @@
+package delivery
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fenilsonani/email-server/internal/queue"
+)
+
+// fakeDialer hangs on IPv6 addresses until cancelled and connects IPv4
+// addresses immediately, unless listed in fail.
+type fakeDialer struct {
+	mu        sync.Mutex
+	dialed    []string
+	cancelled []string
+	fail      map[string]bool
+}
+
+func (d *fakeDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, _, _ := net.SplitHostPort(address)
+
+	d.mu.Lock()
+	d.dialed = append(d.dialed, host)
+	d.mu.Unlock()
+
+	if d.fail[host] {
+		return nil, errors.New("connection refused")
+	}
+
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		<-ctx.Done()
+		d.mu.Lock()
+		d.cancelled = append(d.cancelled, host)
+		d.mu.Unlock()
+		return nil, ctx.Err()
+	}
+
+	client, server := net.Pipe()
+	server.Close()
+	return client, nil
+}
+
+func TestInterleaveAddrFamilies(t *testing.T) {
+	got := interleaveAddrFamilies([]string{"192.0.2.1", "192.0.2.2", "2001:db8::1", "not-an-ip", "2001:db8::2", "192.0.2.3"})
+	want := []string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2", "192.0.2.3"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("interleaveAddrFamilies() = %v, want %v", got, want)
+	}
+}
+
+func TestDialHappyEyeballs_IPv6HangsIPv4Wins(t *testing.T) {
+	d := &fakeDialer{}
+	delay := 50 * time.Millisecond
+
+	start := time.Now()
+	conn, addr, err := dialHappyEyeballs(context.Background(), d, []string{"2001:db8::1", "192.0.2.1"}, "25", delay, 30*time.Second)
+	elapsed := time.Since(start)
+	if err != nil {
+		t.Fatalf("dialHappyEyeballs() error = %v", err)
+	}
+	defer conn.Close()
+
+	if addr != "192.0.2.1" {
+		t.Errorf("addr = %q, want 192.0.2.1", addr)
+	}
+	// The IPv4 attempt starts after one stagger delay, well before the connect timeout
+	if elapsed > delay+200*time.Millisecond {
+		t.Errorf("connection took %v, want within stagger window (~%v)", elapsed, delay)
+	}
+
+	// The hung IPv6 attempt must be cancelled
+	deadline := time.Now().Add(time.Second)
+	for {
+		d.mu.Lock()
+		n := len(d.cancelled)
+		d.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("IPv6 attempt was not cancelled")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestDialHappyEyeballs_FailureStartsNextImmediately(t *testing.T) {
+	d := &fakeDialer{fail: map[string]bool{"192.0.2.1": true}}
+
+	start := time.Now()
+	conn, addr, err := dialHappyEyeballs(context.Background(), d, []string{"192.0.2.1", "192.0.2.2"}, "25", time.Second, time.Second)
+	if err != nil {
+		t.Fatalf("dialHappyEyeballs() error = %v", err)
+	}
+	defer conn.Close()
+
+	if addr != "192.0.2.2" {
+		t.Errorf("addr = %q, want 192.0.2.2", addr)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("fallback waited %v, should not wait for the stagger delay after a failure", elapsed)
+	}
+}
+
+func TestDialHappyEyeballs_AllFail(t *testing.T) {
+	d := &fakeDialer{fail: map[string]bool{"192.0.2.1": true, "192.0.2.2": true}}
+
+	_, _, err := dialHappyEyeballs(context.Background(), d, []string{"192.0.2.1", "192.0.2.2"}, "25", 10*time.Millisecond, time.Second)
+	if err == nil {
+		t.Fatal("expected error when every address fails")
+	}
+}
+
+func TestDialHappyEyeballs_RespectsConnectTimeout(t *testing.T) {
+	d := &fakeDialer{}
+
+	start := time.Now()
+	_, _, err := dialHappyEyeballs(context.Background(), d, []string{"2001:db8::1"}, "25", 10*time.Millisecond, 50*time.Millisecond)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("error = %v, want deadline exceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("attempt ran %v, want it bounded by the connect timeout", elapsed)
+	}
+}
+
+func TestDialHappyEyeballs_NoAddresses(t *testing.T) {
+	if _, _, err := dialHappyEyeballs(context.Background(), &fakeDialer{}, nil, "25", 0, 0); err == nil {
+		t.Fatal("expected error with no addresses")
+	}
+}
+
+// dialerFunc adapts a function to ContextDialer
+type dialerFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+func (f dialerFunc) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return f(ctx, network, address)
+}
+
+func TestDeliverToHost_TriesOtherAddressesAfterTemporaryFailure(t *testing.T) {
+	var mu sync.Mutex
+	var dialed []string
+	e := testSizeEngine()
+	e.dialer = dialerFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, _, _ := net.SplitHostPort(address)
+		mu.Lock()
+		dialed = append(dialed, host)
+		mu.Unlock()
+		client, server := net.Pipe()
+		if host == "192.0.2.1" {
+			go func() {
+				server.Write([]byte("421 4.3.2 Too busy\r\n"))
+				server.Close()
+			}()
+		} else {
+			mockPeer(t, server)
+		}
+		return client, nil
+	})
+
+	msg := &queue.Message{ID: "m1", Sender: "alice@example.com", Recipients: []string{"bob@example.org"}}
+	addr, err := e.deliverToHostWithTLS(context.Background(), []string{"192.0.2.1", "192.0.2.2"}, "mx.example.org", msg, []byte("hello\r\n"), TLSPolicyNone)
+	if err != nil || addr != "192.0.2.2" {
+		t.Fatalf("deliverToHostWithTLS() = %q, %v; want delivery to 192.0.2.2", addr, err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"192.0.2.1", "192.0.2.2"}; !reflect.DeepEqual(dialed, want) {
+		t.Errorf("dialed %v, want %v", dialed, want)
+	}
+}
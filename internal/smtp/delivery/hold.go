@@ -0,0 +1,33 @@
+package delivery
+
+import (
+	"fmt"
+	"strings"
+)
+
+// HoldRules decides which outbound messages are held in the queue until an
+// admin releases or rejects them. Zero values hold nothing.
+type HoldRules struct {
+	// MaxRecipients holds messages addressed to more recipients than this.
+	MaxRecipients int
+	// Senders holds messages from these addresses, or from any address in
+	// a domain given as "@example.com".
+	Senders []string
+}
+
+// match returns why a message from sender to recipients should be held,
+// or "" if it should be delivered.
+func (h HoldRules) match(sender string, recipients []string) string {
+	if h.MaxRecipients > 0 && len(recipients) > h.MaxRecipients {
+		return fmt.Sprintf("%d recipients exceeds the limit of %d", len(recipients), h.MaxRecipients)
+	}
+
+	sender = strings.ToLower(sender)
+	for _, s := range h.Senders {
+		s = strings.ToLower(s)
+		if sender == s || (strings.HasPrefix(s, "@") && strings.HasSuffix(sender, s)) {
+			return "sender " + sender + " is held for review"
+		}
+	}
+	return ""
+}
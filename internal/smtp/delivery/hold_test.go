@@ -0,0 +1,32 @@
+package delivery
+
+import "testing"
+
+func TestHoldRules(t *testing.T) {
+	rules := HoldRules{MaxRecipients: 2, Senders: []string{"Bulk@Example.com", "@spam.example"}}
+
+	tests := []struct {
+		name       string
+		sender     string
+		recipients []string
+		held       bool
+	}{
+		{"within limit", "alice@example.com", []string{"a@x.org", "b@x.org"}, false},
+		{"too many recipients", "alice@example.com", []string{"a@x.org", "b@x.org", "c@x.org"}, true},
+		{"listed address", "bulk@example.com", []string{"a@x.org"}, true},
+		{"listed domain", "anyone@SPAM.example", []string{"a@x.org"}, true},
+		{"domain suffix only", "anyone@notspam.example", []string{"a@x.org"}, false},
+		{"null sender", "", []string{"a@x.org"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rules.match(tt.sender, tt.recipients); (got != "") != tt.held {
+				t.Errorf("match() = %q, want held %v", got, tt.held)
+			}
+		})
+	}
+
+	if got := (HoldRules{}).match("bulk@example.com", make([]string, 100)); got != "" {
+		t.Errorf("zero HoldRules match() = %q, want nothing held", got)
+	}
+}
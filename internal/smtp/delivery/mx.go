@@ -172,20 +172,8 @@ func (r *MXResolver) LookupWithFallback(ctx context.Context, domain string) ([]M
 			continue // Skip this MX if we can't resolve it
 		}
 
-		// Prefer IPv4 addresses
-		var ipv4, ipv6 []string
-		for _, addr := range addrs {
-			if ip := net.ParseIP(addr); ip != nil {
-				if ip.To4() != nil {
-					ipv4 = append(ipv4, addr)
-				} else {
-					ipv6 = append(ipv6, addr)
-				}
-			}
-		}
-
-		// IPv4 first, then IPv6
-		allAddrs := append(ipv4, ipv6...)
+		// Interleave families so happy-eyeballs dialing races both
+		allAddrs := interleaveAddrFamilies(addrs)
 		if len(allAddrs) > 0 {
 			hosts = append(hosts, MXHost{
 				Host:       mx.Host,
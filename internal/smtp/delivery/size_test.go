@@ -0,0 +1,130 @@
+package delivery
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fenilsonani/email-server/internal/logging"
+	"github.com/fenilsonani/email-server/internal/queue"
+)
+
+// mockPeer runs a minimal SMTP server on conn advertising the given EHLO
+// extensions and records every command it receives.
+func mockPeer(t *testing.T, conn net.Conn, extensions ...string) <-chan []string {
+	t.Helper()
+	done := make(chan []string, 1)
+	go func() {
+		defer conn.Close()
+		var cmds []string
+		defer func() { done <- cmds }()
+
+		r := bufio.NewReader(conn)
+		write := func(s string) { conn.Write([]byte(s + "\r\n")) }
+		write("220 mx.example.org ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			cmds = append(cmds, line)
+
+			verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+			switch verb {
+			case "EHLO":
+				write("250-mx.example.org")
+				for _, ext := range extensions {
+					write("250-" + ext)
+				}
+				write("250 HELP")
+			case "DATA":
+				write("354 go ahead")
+				for {
+					l, err := r.ReadString('\n')
+					if err != nil || l == ".\r\n" {
+						break
+					}
+				}
+				write("250 2.0.0 queued")
+			case "QUIT":
+				write("221 bye")
+				return
+			default:
+				write("250 OK")
+			}
+		}
+	}()
+	return done
+}
+
+func testSizeEngine() *Engine {
+	return &Engine{
+		config: Config{Hostname: "mail.example.com", CommandTimeout: 5 * time.Second},
+		logger: logging.Default().Delivery(),
+	}
+}
+
+func TestDeliverOnConn_RejectsOversizedBeforeData(t *testing.T) {
+	client, server := net.Pipe()
+	done := mockPeer(t, server, "SIZE 100")
+
+	msg := &queue.Message{ID: "m1", Sender: "alice@example.com", Recipients: []string{"bob@example.org"}}
+	data := []byte("Subject: big\r\n\r\n" + strings.Repeat("x", 200) + "\r\n")
+
+	err := testSizeEngine().deliverOnConn(context.Background(), client, "192.0.2.1", "mx.example.org", msg, data, TLSPolicyNone)
+	if !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("deliverOnConn() error = %v, want ErrMessageTooLarge", err)
+	}
+	if !isPermanentError(err) {
+		t.Errorf("oversized error %v should be permanent", err)
+	}
+
+	for _, cmd := range <-done {
+		if strings.HasPrefix(cmd, "MAIL") || cmd == "DATA" {
+			t.Errorf("peer received %q, want the message failed before MAIL FROM", cmd)
+		}
+	}
+}
+
+func TestDeliverOnConn_SendsSizeParameter(t *testing.T) {
+	client, server := net.Pipe()
+	done := mockPeer(t, server, "SIZE 10000")
+
+	msg := &queue.Message{ID: "m1", Sender: "alice@example.com", Recipients: []string{"bob@example.org"}}
+	data := []byte("Subject: small\r\n\r\nhello\r\n")
+
+	if err := testSizeEngine().deliverOnConn(context.Background(), client, "192.0.2.1", "mx.example.org", msg, data, TLSPolicyNone); err != nil {
+		t.Fatalf("deliverOnConn() error = %v", err)
+	}
+
+	var mail string
+	for _, cmd := range <-done {
+		if strings.HasPrefix(cmd, "MAIL FROM:") {
+			mail = cmd
+		}
+	}
+	if want := "MAIL FROM:<alice@example.com> SIZE=25"; mail != want {
+		t.Errorf("MAIL command = %q, want %q", mail, want)
+	}
+}
+
+func TestDeliverOnConn_NoSizeWithoutExtension(t *testing.T) {
+	client, server := net.Pipe()
+	done := mockPeer(t, server)
+
+	msg := &queue.Message{ID: "m1", Sender: "alice@example.com", Recipients: []string{"bob@example.org"}}
+	if err := testSizeEngine().deliverOnConn(context.Background(), client, "192.0.2.1", "mx.example.org", msg, []byte("hello\r\n"), TLSPolicyNone); err != nil {
+		t.Fatalf("deliverOnConn() error = %v", err)
+	}
+
+	for _, cmd := range <-done {
+		if strings.HasPrefix(cmd, "MAIL FROM:") && strings.Contains(cmd, "SIZE=") {
+			t.Errorf("MAIL command = %q, want no SIZE parameter", cmd)
+		}
+	}
+}
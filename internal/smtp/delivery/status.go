@@ -0,0 +1,142 @@
+package delivery
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxFailureReason bounds the failure reason stored with a queued message.
+const maxFailureReason = 512
+
+var (
+	// replyCodePattern finds a basic reply code in an error string
+	replyCodePattern = regexp.MustCompile(`(?:^|\s)([245][0-5]\d)(?:[\s-]|$)`)
+	// enhancedCodePattern finds an RFC 3463 enhanced status code
+	enhancedCodePattern = regexp.MustCompile(`(?:^|\s)([245])\.(\d{1,3})\.(\d{1,3})(?:\s|$)`)
+)
+
+// replyStatus is a delivery failure classified from the remote server's reply.
+type replyStatus struct {
+	// Code is the basic reply code, e.g. 550, or 0 without a reply.
+	Code int
+	// Enhanced is the RFC 3463 code, e.g. "5.1.1", if the reply had one.
+	Enhanced string
+	// Permanent reports whether the message should be bounced rather
+	// than retried.
+	Permanent bool
+	// Reason explains the failure in plain words, for bounces.
+	Reason string
+}
+
+// known reports whether the failure carried a reply code to classify.
+func (s replyStatus) known() bool {
+	return s.Code != 0 || s.Enhanced != ""
+}
+
+// classifyStatus parses the reply codes out of a delivery error. A 4xx
+// reply is always retried, as is a 5xx reply whose enhanced code is 4.x.x.
+func classifyStatus(err error) replyStatus {
+	if err == nil {
+		return replyStatus{}
+	}
+
+	var s replyStatus
+	var text string
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) {
+		s.Code, text = tpErr.Code, tpErr.Msg
+	} else {
+		text = err.Error()
+		if m := replyCodePattern.FindStringSubmatchIndex(text); m != nil {
+			fmt.Sscanf(text[m[2]:m[3]], "%d", &s.Code)
+			text = text[m[3]:]
+		}
+	}
+
+	class := 0
+	subject, detail := "", ""
+	if m := enhancedCodePattern.FindStringSubmatch(text); m != nil {
+		s.Enhanced = m[1] + "." + m[2] + "." + m[3]
+		class = int(m[1][0] - '0')
+		subject, detail = m[2], m[3]
+	}
+
+	switch {
+	case s.Code >= 500:
+		s.Permanent = class != 4
+	case s.Code >= 400:
+		s.Permanent = false
+	default:
+		s.Permanent = class == 5
+	}
+	s.Reason = statusReason(subject, detail, s.Permanent)
+	return s
+}
+
+// statusReasons describes common RFC 3463 subject.detail codes
+var statusReasons = map[string]string{
+	"1.1":  "The recipient's mailbox does not exist",
+	"1.2":  "The recipient's domain does not exist or does not accept mail",
+	"1.3":  "The recipient address is malformed",
+	"1.6":  "The recipient's mailbox has moved",
+	"1.10": "The recipient address does not accept mail",
+	"2.1":  "The recipient's mailbox is disabled",
+	"2.2":  "The recipient's mailbox is full",
+	"2.3":  "The message is larger than the recipient accepts",
+	"3.4":  "The message is larger than the receiving system accepts",
+	"4.4":  "No route to the recipient's mail server",
+	"4.7":  "The message expired before it could be delivered",
+	"5.3":  "Too many recipients",
+	"7.1":  "The receiving server refused the message by policy",
+	"7.23": "The sender's SPF check failed at the receiving server",
+	"7.25": "The sending server has no matching reverse DNS",
+	"7.26": "The message failed the receiving server's authentication checks",
+}
+
+// statusSubjects describes each RFC 3463 subject class
+var statusSubjects = map[string]string{
+	"1": "Addressing problem",
+	"2": "Problem with the recipient's mailbox",
+	"3": "Problem with the receiving mail system",
+	"4": "Network or routing problem",
+	"5": "Mail delivery protocol problem",
+	"6": "Problem with the message content",
+	"7": "Rejected by security or policy",
+}
+
+// statusReason describes an enhanced code's subject and detail, falling
+// back to whether the failure is permanent.
+func statusReason(subject, detail string, permanent bool) string {
+	if reason, ok := statusReasons[subject+"."+detail]; ok {
+		return reason
+	}
+	if reason, ok := statusSubjects[subject]; ok {
+		return reason
+	}
+	if permanent {
+		return "The receiving server permanently rejected the message"
+	}
+	return "The receiving server temporarily deferred the message"
+}
+
+// failureReason describes a delivery failure for the queue: the reason
+// for its reply code, if any, followed by the error, at most
+// maxFailureReason bytes long.
+func failureReason(err error) string {
+	reason := err.Error()
+	if s := classifyStatus(err); s.known() {
+		reason = s.Reason + ": " + reason
+	}
+	if len(reason) > maxFailureReason {
+		cut := maxFailureReason - len("...")
+		for cut > 0 && !utf8.RuneStart(reason[cut]) {
+			cut--
+		}
+		reason = strings.TrimSpace(reason[:cut]) + "..."
+	}
+	return reason
+}
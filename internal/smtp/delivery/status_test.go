@@ -0,0 +1,82 @@
+package delivery
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func TestClassifyStatus(t *testing.T) {
+	tests := []struct {
+		name          string
+		err           error
+		wantCode      int
+		wantEnhanced  string
+		wantPermanent bool
+		wantReason    string
+	}{
+		{"no such user", &textproto.Error{Code: 550, Msg: "5.1.1 <bob@example.org>: Recipient address rejected"},
+			550, "5.1.1", true, "does not exist"},
+		{"mailbox full", &textproto.Error{Code: 452, Msg: "4.2.2 Mailbox full"},
+			452, "4.2.2", false, "mailbox is full"},
+		{"5xx with temporary enhanced code", &textproto.Error{Code: 550, Msg: "4.2.2 Over quota, try later"},
+			550, "4.2.2", false, "mailbox is full"},
+		{"policy rejection", &textproto.Error{Code: 554, Msg: "5.7.1 Message rejected due to content"},
+			554, "5.7.1", true, "by policy"},
+		{"greylisted", &textproto.Error{Code: 451, Msg: "4.7.1 Greylisted, please retry"},
+			451, "4.7.1", false, "by policy"},
+		{"unlisted detail uses subject", &textproto.Error{Code: 550, Msg: "5.1.99 Something odd"},
+			550, "5.1.99", true, "Addressing problem"},
+		{"basic code only", &textproto.Error{Code: 421, Msg: "Service not available"},
+			421, "", false, "temporarily deferred"},
+		{"wrapped reply", fmt.Errorf("%w: %w", ErrTemporaryFailure, &textproto.Error{Code: 550, Msg: "5.1.1 unknown"}),
+			550, "5.1.1", true, "does not exist"},
+		{"reply in error text", errors.New("RCPT failed: 550 5.1.1 no such user"),
+			550, "5.1.1", true, "does not exist"},
+		{"no reply", errors.New("connection refused"), 0, "", false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := classifyStatus(tt.err)
+			if got.Code != tt.wantCode || got.Enhanced != tt.wantEnhanced || got.Permanent != tt.wantPermanent {
+				t.Errorf("classifyStatus() = %+v, want code %d, enhanced %q, permanent %v",
+					got, tt.wantCode, tt.wantEnhanced, tt.wantPermanent)
+			}
+			if !strings.Contains(got.Reason, tt.wantReason) {
+				t.Errorf("Reason = %q, want it to mention %q", got.Reason, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestClassifyError_EnhancedCodes(t *testing.T) {
+	full := &textproto.Error{Code: 552, Msg: "4.2.2 Mailbox full"}
+	if err := classifyError(full); !errors.Is(err, ErrTemporaryFailure) || isPermanentError(err) {
+		t.Errorf("classifyError(%v) = %v, want temporary", full, err)
+	}
+
+	unknown := &textproto.Error{Code: 550, Msg: "5.1.1 No such user"}
+	if err := classifyError(unknown); !errors.Is(err, ErrPermanentFailure) || !isPermanentError(err) {
+		t.Errorf("classifyError(%v) = %v, want permanent", unknown, err)
+	}
+}
+
+func TestFailureReason(t *testing.T) {
+	err := &textproto.Error{Code: 550, Msg: "5.1.1 No such user"}
+	if got, want := failureReason(err), "The recipient's mailbox does not exist: "+err.Error(); got != want {
+		t.Errorf("failureReason() = %q, want %q", got, want)
+	}
+
+	if got := failureReason(errors.New("dial tcp: timeout")); got != "dial tcp: timeout" {
+		t.Errorf("failureReason() = %q, want the error unchanged", got)
+	}
+
+	long := &textproto.Error{Code: 554, Msg: "5.7.1 " + strings.Repeat("é", 400)}
+	got := failureReason(long)
+	if len(got) > maxFailureReason || !strings.HasSuffix(got, "...") || !strings.HasPrefix(got, "The receiving server refused") {
+		t.Errorf("failureReason() = %q (%d bytes), want truncated to %d", got, len(got), maxFailureReason)
+	}
+}
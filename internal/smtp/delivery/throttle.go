@@ -0,0 +1,173 @@
+package delivery
+
+import (
+	"errors"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultRateLimitBackoff is how long a domain is paused after it answers
+// with a 4.7.x rate-limit reply.
+const DefaultRateLimitBackoff = 5 * time.Minute
+
+// DomainLimit bounds outbound delivery to one recipient domain. Zero values
+// mean unlimited.
+type DomainLimit struct {
+	// MaxConcurrent is the number of simultaneous deliveries to the domain.
+	MaxConcurrent int
+	// MaxPerMinute is the number of deliveries started per rolling minute.
+	MaxPerMinute int
+}
+
+// ThrottleConfig configures per-domain delivery limits.
+type ThrottleConfig struct {
+	// Default applies to every domain without an entry in Domains.
+	Default DomainLimit
+	// Domains overrides Default for specific recipient domains.
+	Domains map[string]DomainLimit
+	// RateLimitBackoff pauses a domain after a 4.7.x reply.
+	RateLimitBackoff time.Duration
+}
+
+// Throttle tracks in-flight and recent deliveries per recipient domain so
+// the worker pool doesn't hammer a single provider. Domains with nothing in
+// flight, no start in the last minute and no backoff are forgotten, so the
+// map only holds the domains being delivered to.
+type Throttle struct {
+	config    ThrottleConfig
+	now       func() time.Time
+	mu        sync.Mutex
+	domains   map[string]*domainState
+	lastSweep time.Time
+}
+
+type domainState struct {
+	active       int
+	started      []time.Time // Delivery start times within the last minute
+	backoffUntil time.Time
+}
+
+// NewThrottle creates a throttle with the given limits.
+func NewThrottle(cfg ThrottleConfig) *Throttle {
+	if cfg.RateLimitBackoff <= 0 {
+		cfg.RateLimitBackoff = DefaultRateLimitBackoff
+	}
+	domains := make(map[string]DomainLimit, len(cfg.Domains))
+	for name, limit := range cfg.Domains {
+		domains[strings.ToLower(name)] = limit
+	}
+	cfg.Domains = domains
+
+	return &Throttle{
+		config:  cfg,
+		now:     time.Now,
+		domains: make(map[string]*domainState),
+	}
+}
+
+// limit returns the limits that apply to domain.
+func (t *Throttle) limit(domain string) DomainLimit {
+	if l, ok := t.config.Domains[domain]; ok {
+		return l
+	}
+	return t.config.Default
+}
+
+// Acquire reserves a delivery slot for domain. When the domain is at its
+// concurrency or rate limit, or backing off, ok is false and retryAt is the
+// earliest time worth trying again. Callers must call release when done.
+func (t *Throttle) Acquire(domain string) (release func(), retryAt time.Time, ok bool) {
+	domain = strings.ToLower(domain)
+	limit := t.limit(domain)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	if now.Sub(t.lastSweep) >= time.Minute {
+		t.sweep(now)
+	}
+	st := t.domains[domain]
+	if st == nil {
+		st = &domainState{}
+		t.domains[domain] = st
+	}
+
+	if now.Before(st.backoffUntil) {
+		return nil, st.backoffUntil, false
+	}
+
+	if limit.MaxConcurrent > 0 && st.active >= limit.MaxConcurrent {
+		// A slot usually frees up within a few seconds
+		return nil, now.Add(5 * time.Second), false
+	}
+
+	// Drop starts that have left the rolling window
+	cutoff := now.Add(-time.Minute)
+	i := 0
+	for i < len(st.started) && !st.started[i].After(cutoff) {
+		i++
+	}
+	st.started = st.started[i:]
+
+	if limit.MaxPerMinute > 0 && len(st.started) >= limit.MaxPerMinute {
+		return nil, st.started[0].Add(time.Minute), false
+	}
+
+	st.active++
+	st.started = append(st.started, now)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			t.mu.Lock()
+			st.active--
+			t.mu.Unlock()
+		})
+	}, time.Time{}, true
+}
+
+// sweep forgets the domains that no longer limit anything. t.mu must be
+// held.
+func (t *Throttle) sweep(now time.Time) {
+	cutoff := now.Add(-time.Minute)
+	for domain, st := range t.domains {
+		idle := st.active == 0 && !now.Before(st.backoffUntil) &&
+			(len(st.started) == 0 || !st.started[len(st.started)-1].After(cutoff))
+		if idle {
+			delete(t.domains, domain)
+		}
+	}
+	t.lastSweep = now
+}
+
+// Backoff pauses new deliveries to domain for the configured backoff.
+func (t *Throttle) Backoff(domain string) time.Time {
+	domain = strings.ToLower(domain)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	st := t.domains[domain]
+	if st == nil {
+		st = &domainState{}
+		t.domains[domain] = st
+	}
+	until := t.now().Add(t.config.RateLimitBackoff)
+	if until.After(st.backoffUntil) {
+		st.backoffUntil = until
+	}
+	return st.backoffUntil
+}
+
+// isRateLimited reports whether err is a 4xx reply with a 4.7.x enhanced
+// status code, which providers use to say "slow down".
+func isRateLimited(err error) bool {
+	var tpErr *textproto.Error
+	if !errors.As(err, &tpErr) {
+		return false
+	}
+	return tpErr.Code >= 400 && tpErr.Code < 500 && strings.HasPrefix(tpErr.Msg, "4.7.")
+}
@@ -0,0 +1,184 @@
+package delivery
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestThrottle_ConcurrencyLimit(t *testing.T) {
+	const limit = 3
+	th := NewThrottle(ThrottleConfig{
+		Default: DomainLimit{MaxConcurrent: 10},
+		Domains: map[string]DomainLimit{"Gmail.com": {MaxConcurrent: limit}},
+	})
+
+	var active, peak, delivered int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				release, _, ok := th.Acquire("gmail.com")
+				if !ok {
+					time.Sleep(time.Millisecond)
+					continue
+				}
+				n := atomic.AddInt32(&active, 1)
+				for {
+					p := atomic.LoadInt32(&peak)
+					if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+						break
+					}
+				}
+				time.Sleep(2 * time.Millisecond)
+				atomic.AddInt32(&active, -1)
+				atomic.AddInt32(&delivered, 1)
+				release()
+				return
+			}
+		}()
+	}
+	wg.Wait()
+
+	if delivered != 20 {
+		t.Errorf("delivered = %d, want 20", delivered)
+	}
+	if peak > limit {
+		t.Errorf("peak concurrent deliveries = %d, want at most %d", peak, limit)
+	}
+	if peak < 1 {
+		t.Error("no deliveries ran")
+	}
+}
+
+func TestThrottle_ReleaseIsIdempotent(t *testing.T) {
+	th := NewThrottle(ThrottleConfig{Default: DomainLimit{MaxConcurrent: 1}})
+
+	release, _, ok := th.Acquire("example.com")
+	if !ok {
+		t.Fatal("first Acquire should succeed")
+	}
+	if _, _, ok := th.Acquire("example.com"); ok {
+		t.Fatal("second Acquire should hit the concurrency limit")
+	}
+	if _, _, ok := th.Acquire("other.example"); !ok {
+		t.Error("limits should be tracked per domain")
+	}
+
+	release()
+	release()
+	r1, _, ok1 := th.Acquire("example.com")
+	_, _, ok2 := th.Acquire("example.com")
+	if !ok1 || ok2 {
+		t.Errorf("after double release: ok1=%v ok2=%v, want true false", ok1, ok2)
+	}
+	r1()
+}
+
+func TestThrottle_PerMinuteLimit(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	th := NewThrottle(ThrottleConfig{Default: DomainLimit{MaxPerMinute: 2}})
+	th.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		release, _, ok := th.Acquire("example.com")
+		if !ok {
+			t.Fatalf("Acquire %d should succeed", i)
+		}
+		release()
+		now = now.Add(10 * time.Second)
+	}
+
+	_, retryAt, ok := th.Acquire("example.com")
+	if ok {
+		t.Fatal("third Acquire within a minute should be throttled")
+	}
+	want := time.Date(2025, 1, 1, 12, 1, 0, 0, time.UTC)
+	if !retryAt.Equal(want) {
+		t.Errorf("retryAt = %v, want %v", retryAt, want)
+	}
+
+	now = want
+	if _, _, ok := th.Acquire("example.com"); !ok {
+		t.Error("Acquire should succeed once the oldest start leaves the window")
+	}
+}
+
+func TestThrottle_Backoff(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	th := NewThrottle(ThrottleConfig{RateLimitBackoff: time.Minute})
+	th.now = func() time.Time { return now }
+
+	until := th.Backoff("outlook.com")
+	if !until.Equal(now.Add(time.Minute)) {
+		t.Errorf("Backoff until = %v, want %v", until, now.Add(time.Minute))
+	}
+	if _, retryAt, ok := th.Acquire("outlook.com"); ok || !retryAt.Equal(until) {
+		t.Errorf("Acquire during backoff = %v, %v; want throttled until %v", ok, retryAt, until)
+	}
+	if _, _, ok := th.Acquire("gmail.com"); !ok {
+		t.Error("backoff should only affect the rate-limited domain")
+	}
+
+	now = until
+	if _, _, ok := th.Acquire("outlook.com"); !ok {
+		t.Error("Acquire should succeed after the backoff expires")
+	}
+}
+
+func TestThrottle_ForgetsIdleDomains(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	th := NewThrottle(ThrottleConfig{Default: DomainLimit{MaxPerMinute: 1}, RateLimitBackoff: 5 * time.Minute})
+	th.now = func() time.Time { return now }
+
+	release, _, _ := th.Acquire("done.example")
+	release()
+	busy, _, _ := th.Acquire("busy.example")
+	defer busy()
+	th.Backoff("backoff.example")
+
+	now = now.Add(2 * time.Minute)
+	th.Acquire("new.example")
+
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	for domain, want := range map[string]bool{
+		"done.example":    false,
+		"busy.example":    true,
+		"backoff.example": true,
+		"new.example":     true,
+	} {
+		if _, ok := th.domains[domain]; ok != want {
+			t.Errorf("%s tracked = %v, want %v", domain, ok, want)
+		}
+	}
+}
+
+func TestIsRateLimited(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"421 4.7.0", &textproto.Error{Code: 421, Msg: "4.7.0 Try again later, closing connection"}, true},
+		{"450 4.7.28 wrapped", classifyError(&textproto.Error{Code: 450, Msg: "4.7.28 Unusual rate of mail"}), true},
+		{"all MX failed", fmt.Errorf("%w: %w", ErrAllMXFailed, &textproto.Error{Code: 451, Msg: "4.7.1 Rate limited"}), true},
+		{"451 4.3.0", &textproto.Error{Code: 451, Msg: "4.3.0 Temporary failure"}, false},
+		{"550 5.7.1", &textproto.Error{Code: 550, Msg: "5.7.1 Rejected"}, false},
+		{"plain error", errors.New("421 4.7.0 not a reply"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRateLimited(tt.err); got != tt.want {
+				t.Errorf("isRateLimited(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
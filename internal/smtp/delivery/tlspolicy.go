@@ -0,0 +1,82 @@
+package delivery
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// TLSPolicy controls STARTTLS for deliveries to a recipient domain. The
+// levels follow Postfix's smtp_tls_security_level.
+type TLSPolicy string
+
+const (
+	// TLSPolicyNone never attempts STARTTLS.
+	TLSPolicyNone TLSPolicy = "none"
+	// TLSPolicyMay uses STARTTLS when offered and falls back to cleartext.
+	TLSPolicyMay TLSPolicy = "may"
+	// TLSPolicyEncrypt requires STARTTLS but does not verify the certificate.
+	TLSPolicyEncrypt TLSPolicy = "encrypt"
+	// TLSPolicyDANE requires a certificate authenticated for the MX host.
+	// Without a DNSSEC-validating resolver TLSA records can't be trusted, so
+	// it is enforced like TLSPolicySecure.
+	TLSPolicyDANE TLSPolicy = "dane"
+	// TLSPolicySecure requires STARTTLS with a verified certificate.
+	TLSPolicySecure TLSPolicy = "secure"
+)
+
+// ErrTLSPolicy is returned when a peer can't satisfy the domain's TLS
+// policy. It is temporary: the message stays queued and is retried.
+var ErrTLSPolicy = errors.New("TLS policy not met")
+
+// ParseTLSPolicy parses a policy name. The empty string is TLSPolicyMay.
+func ParseTLSPolicy(s string) (TLSPolicy, error) {
+	switch p := TLSPolicy(strings.ToLower(strings.TrimSpace(s))); p {
+	case "":
+		return TLSPolicyMay, nil
+	case TLSPolicyNone, TLSPolicyMay, TLSPolicyEncrypt, TLSPolicyDANE, TLSPolicySecure:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown TLS policy %q (want none, may, encrypt, dane or secure)", s)
+	}
+}
+
+// tlsPolicy returns the policy for a recipient domain. Domains without an
+// entry are opportunistic unless RequireTLS is set, in which case VerifyTLS
+// picks between secure and encrypt.
+func (e *Engine) tlsPolicy(domain string) TLSPolicy {
+	if p, ok := e.config.TLSPolicies[strings.ToLower(domain)]; ok {
+		return p
+	}
+	switch {
+	case e.config.RequireTLS && e.config.VerifyTLS:
+		return TLSPolicySecure
+	case e.config.RequireTLS:
+		return TLSPolicyEncrypt
+	default:
+		return TLSPolicyMay
+	}
+}
+
+// required reports whether delivery must fail without TLS.
+func (p TLSPolicy) required() bool {
+	return p == TLSPolicyEncrypt || p == TLSPolicyDANE || p == TLSPolicySecure
+}
+
+// verify reports whether the peer certificate must be verified. may
+// follows the global VerifyTLS setting.
+func (p TLSPolicy) verify(global bool) bool {
+	switch p {
+	case TLSPolicyDANE, TLSPolicySecure:
+		return true
+	case TLSPolicyEncrypt:
+		return false
+	default:
+		return global
+	}
+}
+
+// tlsPolicyError reports an unmet policy as a temporary failure.
+func tlsPolicyError(policy TLSPolicy, hostname, reason string) error {
+	return fmt.Errorf("%w: %w: %s policy for %s: %s", ErrTemporaryFailure, ErrTLSPolicy, policy, hostname, reason)
+}
@@ -0,0 +1,86 @@
+package delivery
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/fenilsonani/email-server/internal/queue"
+)
+
+func TestParseTLSPolicy(t *testing.T) {
+	tests := map[string]TLSPolicy{
+		"":        TLSPolicyMay,
+		"none":    TLSPolicyNone,
+		"MAY":     TLSPolicyMay,
+		"encrypt": TLSPolicyEncrypt,
+		"dane":    TLSPolicyDANE,
+		"secure":  TLSPolicySecure,
+	}
+	for in, want := range tests {
+		got, err := ParseTLSPolicy(in)
+		if err != nil || got != want {
+			t.Errorf("ParseTLSPolicy(%q) = %q, %v, want %q", in, got, err, want)
+		}
+	}
+	if _, err := ParseTLSPolicy("mandatory"); err == nil {
+		t.Error("ParseTLSPolicy(mandatory) should fail")
+	}
+}
+
+func TestEngine_TLSPolicyLookup(t *testing.T) {
+	e := &Engine{config: Config{TLSPolicies: map[string]TLSPolicy{"partner.example": TLSPolicyEncrypt}}}
+	if got := e.tlsPolicy("Partner.Example"); got != TLSPolicyEncrypt {
+		t.Errorf("tlsPolicy(partner) = %q, want encrypt", got)
+	}
+	if got := e.tlsPolicy("example.org"); got != TLSPolicyMay {
+		t.Errorf("tlsPolicy(other) = %q, want may", got)
+	}
+
+	e.config.RequireTLS = true
+	e.config.VerifyTLS = true
+	if got := e.tlsPolicy("example.org"); got != TLSPolicySecure {
+		t.Errorf("tlsPolicy with require_tls = %q, want secure", got)
+	}
+}
+
+func TestDeliverOnConn_EncryptDefersWithoutSTARTTLS(t *testing.T) {
+	client, server := net.Pipe()
+	done := mockPeer(t, server)
+
+	msg := &queue.Message{ID: "m1", Sender: "alice@example.com", Recipients: []string{"bob@partner.example"}, Domain: "partner.example"}
+	err := testSizeEngine().deliverOnConn(context.Background(), client, "192.0.2.1", "mx.partner.example", msg, []byte("hello\r\n"), TLSPolicyEncrypt)
+	if !errors.Is(err, ErrTLSPolicy) {
+		t.Fatalf("deliverOnConn() error = %v, want ErrTLSPolicy", err)
+	}
+	if isPermanentError(err) {
+		t.Errorf("policy error %v should be a deferral, not permanent", err)
+	}
+
+	for _, cmd := range <-done {
+		if cmd == "DATA" {
+			t.Error("message was sent in cleartext despite the encrypt policy")
+		}
+	}
+}
+
+func TestDeliverOnConn_MayDeliversInCleartext(t *testing.T) {
+	client, server := net.Pipe()
+	done := mockPeer(t, server)
+
+	msg := &queue.Message{ID: "m1", Sender: "alice@example.com", Recipients: []string{"bob@partner.example"}, Domain: "partner.example"}
+	if err := testSizeEngine().deliverOnConn(context.Background(), client, "192.0.2.1", "mx.partner.example", msg, []byte("hello\r\n"), TLSPolicyMay); err != nil {
+		t.Fatalf("deliverOnConn() error = %v", err)
+	}
+
+	sawData := false
+	for _, cmd := range <-done {
+		if cmd == "DATA" {
+			sawData = true
+		}
+	}
+	if !sawData {
+		t.Error("may policy should deliver without STARTTLS")
+	}
+}
@@ -0,0 +1,198 @@
+package delivery
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Trace delivers data from sender to rcpt once, synchronously and without
+// the queue, writing each step to w: the hosts chosen, the TLS session and
+// every SMTP command and reply. Nothing is persisted. It returns the
+// delivery error, classified like a queued attempt.
+func (e *Engine) Trace(ctx context.Context, sender, rcpt string, data []byte, w io.Writer) error {
+	domain := extractDomain(rcpt)
+	if domain == "" {
+		return fmt.Errorf("%w: %s", ErrInvalidRecipient, rcpt)
+	}
+	data = e.sign(ctx, sender, data)
+
+	// The relay host is used without STARTTLS, as in deliverToRelay
+	if e.config.RelayHost != "" {
+		host, port, err := net.SplitHostPort(e.config.RelayHost)
+		if err != nil {
+			host, port = e.config.RelayHost, "25"
+		}
+		fmt.Fprintf(w, "Relay host: %s\n", net.JoinHostPort(host, port))
+		return e.traceHost(ctx, []string{host}, port, host, sender, rcpt, data, TLSPolicyNone, w)
+	}
+
+	mxHosts, err := e.mxResolver.LookupWithFallback(ctx, domain)
+	if err != nil {
+		fmt.Fprintf(w, "MX lookup for %s failed: %v\n", domain, err)
+		return fmt.Errorf("MX lookup failed: %w", err)
+	}
+	for _, mx := range mxHosts {
+		fmt.Fprintf(w, "MX %d %s (%s)\n", mx.Preference, mx.Host, strings.Join(mx.Addresses, ", "))
+	}
+
+	policy := e.tlsPolicy(domain)
+	fmt.Fprintf(w, "TLS policy: %s\n", policy)
+
+	var lastErr error
+	for _, mx := range mxHosts {
+		lastErr = e.traceHost(ctx, mx.Addresses, "25", mx.Host, sender, rcpt, data, policy, w)
+		if lastErr == nil || isPermanentError(lastErr) {
+			return lastErr
+		}
+	}
+	return fmt.Errorf("%w: %w", ErrAllMXFailed, lastErr)
+}
+
+// traceHost runs one traced SMTP transaction against hostname
+func (e *Engine) traceHost(ctx context.Context, addrs []string, port, hostname, sender, rcpt string, data []byte, policy TLSPolicy, w io.Writer) error {
+	fmt.Fprintf(w, "Connecting to %s\n", hostname)
+	conn, addr, err := dialHappyEyeballs(ctx, e.dialer, addrs, port, e.config.HappyEyeballsDelay, e.config.ConnectTimeout)
+	if err != nil {
+		fmt.Fprintf(w, "  connection failed: %v\n", err)
+		return fmt.Errorf("connection failed: %w", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(w, "  connected to %s\n", addr)
+
+	deadline := time.Now().Add(e.config.CommandTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	conn.SetDeadline(deadline)
+
+	t := &traceSession{text: textproto.NewConn(conn), w: w}
+	if _, _, err := t.read(220); err != nil {
+		return classifyError(err)
+	}
+	exts, err := t.ehlo(e.config.heloName())
+	if err != nil {
+		return classifyError(err)
+	}
+
+	if policy != TLSPolicyNone {
+		if _, ok := exts["STARTTLS"]; ok {
+			if _, _, err := t.cmd(220, "STARTTLS"); err != nil {
+				if policy.required() {
+					return tlsPolicyError(policy, hostname, "STARTTLS failed: "+err.Error())
+				}
+				return classifyError(err)
+			}
+			tlsConn := tls.Client(conn, &tls.Config{
+				ServerName:         hostname,
+				InsecureSkipVerify: !policy.verify(e.config.VerifyTLS),
+				MinVersion:         tls.VersionTLS12,
+			})
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				fmt.Fprintf(w, "  TLS handshake failed: %v\n", err)
+				if policy.required() {
+					return tlsPolicyError(policy, hostname, "STARTTLS failed: "+err.Error())
+				}
+				return fmt.Errorf("%w: TLS handshake with %s failed: %w", ErrTemporaryFailure, hostname, err)
+			}
+			state := tlsConn.ConnectionState()
+			fmt.Fprintf(w, "  TLS: %s, %s, certificate verified: %t\n",
+				tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite), policy.verify(e.config.VerifyTLS))
+
+			t.text = textproto.NewConn(tlsConn)
+			if exts, err = t.ehlo(e.config.heloName()); err != nil {
+				return classifyError(err)
+			}
+		} else if policy.required() {
+			fmt.Fprintf(w, "  STARTTLS not offered\n")
+			return tlsPolicyError(policy, hostname, "STARTTLS not offered")
+		} else {
+			fmt.Fprintf(w, "  STARTTLS not offered, continuing without TLS\n")
+		}
+	}
+
+	mail := "MAIL FROM:<" + sender + ">"
+	if _, ok := exts["SIZE"]; ok {
+		mail += fmt.Sprintf(" SIZE=%d", len(data))
+	}
+	if _, _, err := t.cmd(250, "%s", mail); err != nil {
+		return classifyError(err)
+	}
+	if _, _, err := t.cmd(25, "RCPT TO:<%s>", rcpt); err != nil {
+		return classifyError(err)
+	}
+	if _, _, err := t.cmd(354, "DATA"); err != nil {
+		return classifyError(err)
+	}
+
+	dw := t.text.DotWriter()
+	if _, err := dw.Write(data); err != nil {
+		dw.Close()
+		return fmt.Errorf("data write failed: %w", err)
+	}
+	if err := dw.Close(); err != nil {
+		return fmt.Errorf("data write failed: %w", err)
+	}
+	fmt.Fprintf(w, "  C: <%d bytes of message data>\n", len(data))
+	if _, _, err := t.read(250); err != nil {
+		return classifyError(err)
+	}
+
+	t.cmd(221, "QUIT")
+	return nil
+}
+
+// traceSession speaks SMTP over a textproto connection, echoing each
+// command and reply
+type traceSession struct {
+	text *textproto.Conn
+	w    io.Writer
+}
+
+// cmd sends a command and reads its reply
+func (t *traceSession) cmd(expectCode int, format string, args ...any) (int, string, error) {
+	line := fmt.Sprintf(format, args...)
+	fmt.Fprintf(t.w, "  C: %s\n", line)
+	id, err := t.text.Cmd("%s", line)
+	if err != nil {
+		return 0, "", err
+	}
+	t.text.StartResponse(id)
+	defer t.text.EndResponse(id)
+	return t.read(expectCode)
+}
+
+// read reads a reply, echoing every line of it
+func (t *traceSession) read(expectCode int) (int, string, error) {
+	code, msg, err := t.text.ReadResponse(expectCode)
+	var protoErr textproto.ProtocolError
+	if errors.As(err, &protoErr) {
+		fmt.Fprintf(t.w, "  S: %v\n", err)
+		return code, msg, err
+	}
+	for _, line := range strings.Split(msg, "\n") {
+		fmt.Fprintf(t.w, "  S: %d %s\n", code, line)
+	}
+	return code, msg, err
+}
+
+// ehlo greets the peer and returns its extensions, keyed by upper-case name
+func (t *traceSession) ehlo(hostname string) (map[string]string, error) {
+	_, msg, err := t.cmd(250, "EHLO %s", hostname)
+	if err != nil {
+		return nil, err
+	}
+	exts := make(map[string]string)
+	lines := strings.Split(msg, "\n")
+	for _, line := range lines[1:] {
+		name, param, _ := strings.Cut(line, " ")
+		exts[strings.ToUpper(name)] = param
+	}
+	return exts, nil
+}
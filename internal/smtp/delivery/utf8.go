@@ -0,0 +1,34 @@
+package delivery
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/fenilsonani/email-server/internal/validation"
+	"golang.org/x/net/idna"
+)
+
+// downgradeAddress rewrites an address for a peer that does not support
+// SMTPUTF8 (RFC 6531). An internationalized domain is converted to its
+// A-label form; a non-ASCII local part has no ASCII equivalent, so the
+// address is rejected with a permanent error.
+func downgradeAddress(addr string) (string, error) {
+	if !!validation.IsASCII(addr) {
+		return addr, nil
+	}
+
+	at := strings.LastIndex(addr, "@")
+	if at < 0 {
+		return "", fmt.Errorf("%w: address %q requires SMTPUTF8", ErrPermanentFailure, addr)
+	}
+	local, domain := addr[:at], addr[at+1:]
+	if !validation.IsASCII(local) {
+		return "", fmt.Errorf("%w: remote server does not support SMTPUTF8 required by %q", ErrPermanentFailure, addr)
+	}
+
+	ascii, err := idna.Lookup.ToASCII(domain)
+	if err != nil {
+		return "", fmt.Errorf("%w: invalid internationalized domain %q: %w", ErrPermanentFailure, domain, err)
+	}
+	return local + "@" + ascii, nil
+}
@@ -0,0 +1,250 @@
+package delivery
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fenilsonani/email-server/internal/validation"
+)
+
+// VERP (Variable Envelope Return Path) gives every recipient of a message
+// its own envelope sender, so a bounce names the recipient that failed
+// even when the remote DSN doesn't list it in a form we can parse. It is
+// still only matched to the send when it names the message, by Message-ID
+// or ENVID (see MarkBounced). The recipient is encoded into the sender's
+// local part the way qmail does it:
+//
+//	news@example.com to bob@example.org -> news+bob=example.org@example.com
+//
+// The recipient's local part has '+', '=' and '%' escaped as =XX, so the
+// last '+' ends the sender's local part and the last '=' starts the
+// recipient's domain.
+
+// EncodeVERP returns the envelope sender to use for mail from sender to
+// recipient. The null sender and malformed addresses are returned as is.
+func EncodeVERP(sender, recipient string) string {
+	senderLocal, senderDomain, ok := splitAddress(sender)
+	if !ok {
+		return sender
+	}
+	rcptLocal, rcptDomain, ok := splitAddress(recipient)
+	if !ok {
+		return sender
+	}
+
+	var b strings.Builder
+	b.WriteString(senderLocal)
+	b.WriteByte('+')
+	for i := 0; i < len(rcptLocal); i++ {
+		switch c := rcptLocal[i]; c {
+		case '+', '=', '%':
+			fmt.Fprintf(&b, "=%02X", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('=')
+	b.WriteString(rcptDomain)
+	b.WriteByte('@')
+	b.WriteString(senderDomain)
+	return b.String()
+}
+
+// DecodeVERP reverses EncodeVERP, returning the original sender and
+// recipient of a VERP address
+func DecodeVERP(addr string) (sender, recipient string, ok bool) {
+	local, domain, ok := splitAddress(addr)
+	if !ok {
+		return "", "", false
+	}
+	eq := strings.LastIndexByte(local, '=')
+	if eq < 0 || eq == len(local)-1 {
+		return "", "", false
+	}
+	rcptDomain := local[eq+1:]
+	plus := strings.LastIndexByte(local[:eq], '+')
+	if plus <= 0 || plus == eq-1 {
+		return "", "", false
+	}
+
+	encoded := local[plus+1 : eq]
+	var rcptLocal strings.Builder
+	for i := 0; i < len(encoded); i++ {
+		if encoded[i] != '=' {
+			rcptLocal.WriteByte(encoded[i])
+			continue
+		}
+		if i+2 >= len(encoded) {
+			return "", "", false
+		}
+		c, err := strconv.ParseUint(encoded[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", "", false
+		}
+		rcptLocal.WriteByte(byte(c))
+		i += 2
+	}
+
+	return local[:plus] + "@" + domain, rcptLocal.String() + "@" + rcptDomain, true
+}
+
+// splitAddress splits addr at its last '@'
+func splitAddress(addr string) (local, domain string, ok bool) {
+	at := strings.LastIndexByte(addr, '@')
+	if at <= 0 || at == len(addr)-1 {
+		return "", "", false
+	}
+	return addr[:at], addr[at+1:], true
+}
+
+// BounceDiagnostic returns the reason a DSN gives for a failure: its
+// Diagnostic-Code, else its Status, else a generic reason
+func BounceDiagnostic(data []byte) string {
+	var status string
+	for _, line := range strings.Split(string(data), "\n") {
+		name, value, ok := strings.Cut(strings.TrimRight(line, "\r"), ":")
+		if !ok {
+			continue
+		}
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "diagnostic-code":
+			if _, diag, ok := strings.Cut(value, ";"); ok {
+				value = diag
+			}
+			return strings.TrimSpace(value)
+		case "status":
+			if status == "" {
+				status = strings.TrimSpace(value)
+			}
+		}
+	}
+	if status != "" {
+		return "status " + status
+	}
+	return "bounced"
+}
+
+// SentEmail is one recipient a message was handed to
+type SentEmail struct {
+	ID                int64
+	MessageID         string // Queue message ID
+	Sender            string
+	Recipient         string
+	ReturnPath        string
+	OriginalMessageID string // Message-ID header, without <>
+	EnvelopeID        string // ENVID the sender gave
+	SentAt            time.Time
+	BouncedAt         *time.Time
+	BounceReason      string
+}
+
+// Bounce is a failure report to match to the send it is about
+type Bounce struct {
+	ReturnPath        string // Address the bounce was sent to
+	Recipient         string // Failed recipient; empty for a VERP return path, which names it
+	OriginalMessageID string // Message-ID of the returned message, without <>
+	EnvelopeID        string // Original-Envelope-Id of the DSN
+	Reason            string
+}
+
+// SentLog records outbound sends in the sent_emails table and matches
+// bounces back to them
+type SentLog struct {
+	db *sql.DB
+}
+
+// NewSentLog creates a sent log backed by the sent_emails table.
+func NewSentLog(db *sql.DB) *SentLog {
+	return &SentLog{db: db}
+}
+
+// Record stores a send. The return path is stored lowercased, as bounces
+// are matched to it.
+func (l *SentLog) Record(ctx context.Context, sent *SentEmail) error {
+	_, err := l.db.ExecContext(ctx, `
+		INSERT INTO sent_emails (message_id, sender, recipient, return_path, original_message_id, envelope_id, sent_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, sent.MessageID, sent.Sender, sent.Recipient, strings.ToLower(sent.ReturnPath),
+		nullIfEmpty(sent.OriginalMessageID), nullIfEmpty(sent.EnvelopeID), time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("failed to record sent email: %w", err)
+	}
+	return nil
+}
+
+// Prune deletes the sends made before t, returning how many went
+func (l *SentLog) Prune(ctx context.Context, t time.Time) (int64, error) {
+	result, err := l.db.ExecContext(ctx, "DELETE FROM sent_emails WHERE sent_at < ?", t.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune sent emails: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// MarkBounced marks the latest unbounced send b is about as bounced,
+// returning it, or nil when none matches. A send matches when it went to
+// b's return path and recipient and is the message b names, by Message-ID
+// or ENVID; a bounce naming neither matches nothing. Remote supplied
+// reasons are truncated before they are written.
+func (l *SentLog) MarkBounced(ctx context.Context, b Bounce) (*SentEmail, error) {
+	if b.OriginalMessageID == "" && b.EnvelopeID == "" {
+		return nil, nil
+	}
+	var sent SentEmail
+	var messageID, envelopeID sql.NullString
+	err := l.db.QueryRowContext(ctx, `
+		SELECT id, message_id, sender, recipient, return_path, original_message_id, envelope_id, sent_at
+		FROM sent_emails
+		WHERE return_path = ? AND (? = '' OR recipient = ? COLLATE NOCASE)
+			AND (original_message_id = ? OR envelope_id = ?)
+			AND bounced_at IS NULL
+		ORDER BY id DESC LIMIT 1
+	`, strings.ToLower(b.ReturnPath), b.Recipient, b.Recipient,
+		nullIfEmpty(b.OriginalMessageID), nullIfEmpty(b.EnvelopeID),
+	).Scan(&sent.ID, &sent.MessageID, &sent.Sender, &sent.Recipient, &sent.ReturnPath, &messageID, &envelopeID, &sent.SentAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find sent email: %w", err)
+	}
+	sent.OriginalMessageID = messageID.String
+	sent.EnvelopeID = envelopeID.String
+
+	now := time.Now().UTC()
+	sent.BouncedAt = &now
+	sent.BounceReason = validation.Truncate(b.Reason, validation.MaxExternalStringLength)
+	if _, err := l.db.ExecContext(ctx,
+		"UPDATE sent_emails SET bounced_at = ?, bounce_reason = ? WHERE id = ?",
+		now, sent.BounceReason, sent.ID,
+	); err != nil {
+		return nil, fmt.Errorf("failed to mark sent email bounced: %w", err)
+	}
+	return &sent, nil
+}
+
+// nullIfEmpty returns s, or nil for the empty string, which then matches
+// no column
+func nullIfEmpty(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// HeaderMessageID returns the Message-ID field of a message's header,
+// without <>, or "" when it has none
+func HeaderMessageID(r io.Reader) string {
+	header, err := textproto.NewReader(bufio.NewReader(r)).ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		return ""
+	}
+	return strings.Trim(strings.TrimSpace(header.Get("Message-Id")), "<>")
+}
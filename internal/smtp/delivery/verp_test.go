@@ -0,0 +1,247 @@
+package delivery
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fenilsonani/email-server/internal/logging"
+	"github.com/fenilsonani/email-server/internal/queue"
+	"github.com/fenilsonani/email-server/internal/storage/metadata"
+)
+
+func TestVERPRoundTrip(t *testing.T) {
+	tests := []struct {
+		sender, recipient, want string
+	}{
+		{"news@example.com", "bob@example.org", "news+bob=example.org@example.com"},
+		{"news+weekly@example.com", "bob@example.org", "news+weekly+bob=example.org@example.com"},
+		{"news@example.com", "bob+tag@example.org", "news+bob=2Btag=example.org@example.com"},
+		{"news@example.com", "a=b%c@example.org", "news+a=3Db=25c=example.org@example.com"},
+	}
+	for _, tt := range tests {
+		got := EncodeVERP(tt.sender, tt.recipient)
+		if got != tt.want {
+			t.Errorf("EncodeVERP(%q, %q) = %q, want %q", tt.sender, tt.recipient, got, tt.want)
+		}
+		sender, recipient, ok := DecodeVERP(got)
+		if !ok || sender != tt.sender || recipient != tt.recipient {
+			t.Errorf("DecodeVERP(%q) = %q, %q, %v; want %q, %q", got, sender, recipient, ok, tt.sender, tt.recipient)
+		}
+	}
+}
+
+func TestEncodeVERPKeepsNullSender(t *testing.T) {
+	if got := EncodeVERP("", "bob@example.org"); got != "" {
+		t.Errorf("EncodeVERP(null sender) = %q, want it unchanged", got)
+	}
+}
+
+func TestDecodeVERPRejectsPlainAddresses(t *testing.T) {
+	for _, addr := range []string{
+		"bob@example.com",
+		"bob+tag@example.com",
+		"a=b@example.com",
+		"news+bob=@example.com",
+		"news+bob=2=example.org@example.com",
+		"+bob=example.org@example.com",
+	} {
+		if s, r, ok := DecodeVERP(addr); ok {
+			t.Errorf("DecodeVERP(%q) = %q, %q, want no match", addr, s, r)
+		}
+	}
+}
+
+func TestEnqueueVERPSplitsRecipients(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "msg.eml")
+	if err := os.WriteFile(path, []byte("Subject: hi\r\n\r\nhello\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := DefaultConfig()
+	cfg.QueuePath = dir
+	cfg.VERP = true
+	q := queue.NewMemoryQueue(queue.DefaultConfig())
+	defer q.Close()
+	e := NewEngine(cfg, q, nil, logging.Default())
+
+	ctx := context.Background()
+	rcpts := []string{"bob@example.org", "carol@example.org"}
+	if err := e.Enqueue(ctx, "news@example.com", rcpts, path); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+
+	pending, err := q.ListPending(ctx, 10)
+	if err != nil {
+		t.Fatalf("ListPending() error = %v", err)
+	}
+	if len(pending) != 2 {
+		t.Fatalf("queued %d messages, want one per recipient", len(pending))
+	}
+	paths := make(map[string]bool)
+	for _, msg := range pending {
+		if len(msg.Recipients) != 1 {
+			t.Fatalf("queued message has recipients %v, want one", msg.Recipients)
+		}
+		want := EncodeVERP("news@example.com", msg.Recipients[0])
+		if got := e.returnPath(msg); got != want {
+			t.Errorf("returnPath() = %q, want %q", got, want)
+		}
+		if _, err := os.Stat(msg.MessagePath); err != nil {
+			t.Errorf("message file of %v: %v", msg.Recipients, err)
+		}
+		paths[msg.MessagePath] = true
+	}
+	if len(paths) != 2 {
+		t.Errorf("queued messages share a message file, so the first delivery would remove it")
+	}
+
+	// Bounces keep the null sender and are not split
+	if err := e.Enqueue(ctx, "", rcpts, path); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+	if pending, _ := q.ListPending(ctx, 10); len(pending) != 3 {
+		t.Errorf("queued %d messages after a bounce, want 3", len(pending))
+	}
+}
+
+func TestBounceDiagnostic(t *testing.T) {
+	dsn := "Content-Type: message/delivery-status\r\n\r\n" +
+		"Final-Recipient: rfc822; bob@example.org\r\n" +
+		"Action: failed\r\n" +
+		"Status: 5.1.1\r\n" +
+		"Diagnostic-Code: smtp; 550 5.1.1 User unknown\r\n"
+	if got := BounceDiagnostic([]byte(dsn)); got != "550 5.1.1 User unknown" {
+		t.Errorf("BounceDiagnostic() = %q", got)
+	}
+	if got := BounceDiagnostic([]byte("Status: 5.2.2\r\n")); got != "status 5.2.2" {
+		t.Errorf("BounceDiagnostic(status only) = %q", got)
+	}
+}
+
+func TestSentLogMarkBounced(t *testing.T) {
+	db, err := metadata.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+	if err := db.Migrate(ctx); err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+
+	log := NewSentLog(db.DB)
+	returnPath := EncodeVERP("news@example.com", "bob@example.org")
+	if err := log.Record(ctx, &SentEmail{
+		MessageID: "msg-1", Sender: "news@example.com", Recipient: "bob@example.org",
+		ReturnPath: returnPath, OriginalMessageID: "1@example.com",
+	}); err != nil {
+		t.Fatalf("Record() error = %v", err)
+	}
+	other := EncodeVERP("news@example.com", "carol@example.org")
+	if err := log.Record(ctx, &SentEmail{
+		MessageID: "msg-2", Sender: "news@example.com", Recipient: "carol@example.org",
+		ReturnPath: other, OriginalMessageID: "2@example.com", EnvelopeID: "env-2",
+	}); err != nil {
+		t.Fatalf("Record() error = %v", err)
+	}
+
+	// The bounce must name the message it returns
+	for _, b := range []Bounce{
+		{ReturnPath: returnPath},
+		{ReturnPath: returnPath, OriginalMessageID: "2@example.com"},
+		{ReturnPath: other, EnvelopeID: "env-1"},
+	} {
+		if sent, err := log.MarkBounced(ctx, b); err != nil || sent != nil {
+			t.Errorf("MarkBounced(%+v) = %+v, %v; want no match", b, sent, err)
+		}
+	}
+
+	sent, err := log.MarkBounced(ctx, Bounce{
+		ReturnPath:        strings.ToUpper(returnPath),
+		OriginalMessageID: "1@example.com",
+		Reason:            "550 User unknown",
+	})
+	if err != nil {
+		t.Fatalf("MarkBounced() error = %v", err)
+	}
+	if sent == nil || sent.MessageID != "msg-1" || sent.Recipient != "bob@example.org" {
+		t.Fatalf("MarkBounced() = %+v, want the send to bob", sent)
+	}
+
+	var bounced, unbounced int
+	db.QueryRowContext(ctx, "SELECT COUNT(*) FROM sent_emails WHERE bounced_at IS NOT NULL AND bounce_reason = '550 User unknown'").Scan(&bounced)
+	db.QueryRowContext(ctx, "SELECT COUNT(*) FROM sent_emails WHERE bounced_at IS NULL").Scan(&unbounced)
+	if bounced != 1 || unbounced != 1 {
+		t.Errorf("bounced = %d, unbounced = %d; want 1 and 1", bounced, unbounced)
+	}
+
+	// A second bounce for the same send matches nothing
+	if sent, err := log.MarkBounced(ctx, Bounce{ReturnPath: returnPath, OriginalMessageID: "1@example.com"}); err != nil || sent != nil {
+		t.Errorf("MarkBounced() again = %+v, %v; want no match", sent, err)
+	}
+	if sent, err := log.MarkBounced(ctx, Bounce{ReturnPath: other, EnvelopeID: "env-2"}); err != nil || sent == nil || sent.MessageID != "msg-2" {
+		t.Errorf("MarkBounced() by ENVID = %+v, %v; want the send to carol", sent, err)
+	}
+}
+
+func TestRecordSentForBounceableSenders(t *testing.T) {
+	db, err := metadata.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+	if err := db.Migrate(ctx); err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "msg.eml")
+	if err := os.WriteFile(path, []byte("Message-ID: <1@example.com>\r\nSubject: Hi\r\n\r\nHello\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	q := queue.NewMemoryQueue(queue.DefaultConfig())
+	defer q.Close()
+	for _, tt := range []struct {
+		sender         string
+		verp           bool
+		wantReturnPath string // Empty for no send recorded
+	}{
+		{"", true, ""},
+		{"mailer-daemon@example.com", false, ""},
+		{"news@example.com", true, "news+bob=example.org@example.com"},
+		{"news@example.com", false, "news@example.com"},
+	} {
+		db.ExecContext(ctx, "DELETE FROM sent_emails")
+		cfg := DefaultConfig()
+		cfg.VERP = tt.verp
+		e := NewEngine(cfg, q, nil, logging.Default())
+		e.SetSentLog(NewSentLog(db.DB))
+		e.recordSent(ctx, &queue.Message{ID: "msg-1", Sender: tt.sender, Recipients: []string{"bob@example.org"}, MessagePath: path})
+
+		var rows int
+		var returnPath string
+		db.QueryRowContext(ctx, "SELECT COUNT(*), COALESCE(MAX(return_path), '') FROM sent_emails").Scan(&rows, &returnPath)
+		if want := map[bool]int{false: 0, true: 1}[tt.wantReturnPath != ""]; rows != want || returnPath != tt.wantReturnPath {
+			t.Errorf("sender %q with VERP %v: %d rows with return path %q, want %d with %q",
+				tt.sender, tt.verp, rows, returnPath, want, tt.wantReturnPath)
+		}
+	}
+	var messageID string
+	db.QueryRowContext(ctx, "SELECT original_message_id FROM sent_emails").Scan(&messageID)
+	if messageID != "1@example.com" {
+		t.Errorf("original_message_id = %q, want 1@example.com", messageID)
+	}
+
+	log := NewSentLog(db.DB)
+	if n, err := log.Prune(ctx, time.Now().Add(-time.Hour)); err != nil || n != 0 {
+		t.Errorf("Prune() of older sends = %d, %v; want 0", n, err)
+	}
+	if n, err := log.Prune(ctx, time.Now().Add(time.Hour)); err != nil || n != 1 {
+		t.Errorf("Prune() of every send = %d, %v; want 1", n, err)
+	}
+}
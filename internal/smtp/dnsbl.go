@@ -0,0 +1,237 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/fenilsonani/email-server/internal/config"
+	"github.com/fenilsonani/email-server/internal/metrics"
+)
+
+// dnsblCacheSize bounds the IPs whose results are cached; at the bound an
+// arbitrary one is dropped to make room
+const dnsblCacheSize = 10000
+
+// hostResolver resolves the A records of DNSBL queries; *net.Resolver
+// implements it
+type hostResolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// dnsblChecker looks client IPs up in the DNS blocklists of
+// security.dnsbl, caching the results
+type dnsblChecker struct {
+	lists     []config.DNSBLListConfig
+	threshold float64
+	timeout   time.Duration
+	ttl       time.Duration
+	resolver  hostResolver
+
+	mu        sync.Mutex
+	cache     map[string]dnsblResult
+	nextSweep time.Time // When expired results are next removed
+}
+
+// dnsblResult is the outcome of looking an IP up in every list
+type dnsblResult struct {
+	score   float64
+	listed  []string // Zones the IP is on
+	expires time.Time
+}
+
+// newDNSBLChecker returns a checker for cfg, or nil when it has no lists
+func newDNSBLChecker(cfg config.DNSBLConfig) *dnsblChecker {
+	if len(cfg.Lists) == 0 {
+		return nil
+	}
+	timeout, _ := time.ParseDuration(cfg.Timeout)
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	ttl, _ := time.ParseDuration(cfg.CacheTTL)
+	if ttl <= 0 {
+		ttl = 15 * time.Minute
+	}
+	return &dnsblChecker{
+		lists:     cfg.Lists,
+		threshold: cfg.Threshold,
+		timeout:   timeout,
+		ttl:       ttl,
+		resolver:  &net.Resolver{PreferGo: true},
+		cache:     make(map[string]dnsblResult),
+	}
+}
+
+// check looks up the IP of remoteAddr in every list at once and returns its
+// score and the zones listing it. Lists that fail to answer in time count
+// as not listing it. Private and loopback addresses aren't looked up.
+func (c *dnsblChecker) check(ctx context.Context, remoteAddr string) (float64, []string) {
+	ip := net.ParseIP(clientIP(remoteAddr))
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		return 0, nil
+	}
+	key := ip.String()
+	now := time.Now()
+
+	c.mu.Lock()
+	if r, ok := c.cache[key]; ok && now.Before(r.expires) {
+		c.mu.Unlock()
+		return r.score, r.listed
+	}
+	c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	type answer struct {
+		index  int
+		listed bool
+		err    error
+	}
+	answers := make(chan answer, len(c.lists))
+	for i, l := range c.lists {
+		go func() {
+			listed, err := c.lookup(ctx, ip, l.Zone)
+			answers <- answer{i, listed, err}
+		}()
+	}
+
+	listedBy := make([]bool, len(c.lists))
+	failed := false
+	for range c.lists {
+		a := <-answers
+		if a.err != nil {
+			failed = true
+			continue
+		}
+		listedBy[a.index] = a.listed
+	}
+
+	result := dnsblResult{expires: now.Add(c.ttl)}
+	for i, l := range c.lists {
+		if !listedBy[i] {
+			continue
+		}
+		weight := l.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		result.score += weight
+		result.listed = append(result.listed, strings.Trim(l.Zone, "."))
+	}
+
+	// Don't let a resolver outage be remembered as a clean bill of health
+	if !failed {
+		c.mu.Lock()
+		c.evict(now)
+		c.cache[key] = result
+		c.mu.Unlock()
+	}
+	return result.score, result.listed
+}
+
+// evict makes room for a result: once per ttl it removes the expired ones,
+// and at dnsblCacheSize it drops one more. The caller holds c.mu.
+func (c *dnsblChecker) evict(now time.Time) {
+	if now.After(c.nextSweep) {
+		for ip, r := range c.cache {
+			if now.After(r.expires) {
+				delete(c.cache, ip)
+			}
+		}
+		c.nextSweep = now.Add(c.ttl)
+	}
+	if len(c.cache) >= dnsblCacheSize {
+		for ip := range c.cache {
+			delete(c.cache, ip)
+			break
+		}
+	}
+}
+
+// lookup reports whether zone lists ip. A list answers with an address in
+// 127.0.0.0/8 for a listed IP and NXDOMAIN otherwise; 127.255.255.0/24 is
+// how some lists refuse a query, which doesn't count as a listing.
+func (c *dnsblChecker) lookup(ctx context.Context, ip net.IP, zone string) (bool, error) {
+	addrs, err := c.resolver.LookupHost(ctx, dnsblQuery(ip, zone))
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	for _, addr := range addrs {
+		a := net.ParseIP(addr).To4()
+		if a != nil && a[0] == 127 && !(a[1] == 255 && a[2] == 255) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// dnsblQuery returns the name ip is looked up as in zone: the IPv4 octets,
+// or the IPv6 nibbles, in reverse order
+func dnsblQuery(ip net.IP, zone string) string {
+	var b strings.Builder
+	if v4 := ip.To4(); v4 != nil {
+		for i := len(v4) - 1; i >= 0; i-- {
+			fmt.Fprintf(&b, "%d.", v4[i])
+		}
+	} else {
+		v6 := ip.To16()
+		for i := len(v6) - 1; i >= 0; i-- {
+			fmt.Fprintf(&b, "%x.%x.", v6[i]&0xf, v6[i]>>4)
+		}
+	}
+	return b.String() + strings.Trim(zone, ".")
+}
+
+// checkDNSBL looks up an inbound client in the DNS blocklists once per
+// connection. A client at the threshold is rejected; one below it is
+// remembered for the X-DNSBL header.
+func (s *Session) checkDNSBL() error {
+	c := s.backend.dnsbl
+	if c == nil {
+		return nil
+	}
+	if !s.dnsblChecked {
+		s.dnsblChecked = true
+		s.dnsblScore, s.dnsblListed = c.check(s.ctx, s.remoteAddr)
+		if len(s.dnsblListed) > 0 {
+			s.backend.logger.InfoContext(s.ctx, "Client is on DNS blocklists",
+				"lists", s.dnsblListed,
+				"score", s.dnsblScore,
+			)
+		}
+	}
+	if len(s.dnsblListed) == 0 || s.dnsblScore < c.threshold {
+		return nil
+	}
+	metrics.RecordRejection("dnsbl")
+	return &smtp.SMTPError{
+		Code:         554,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      fmt.Sprintf("Service unavailable; client [%s] blocked using %s", clientIP(s.remoteAddr), strings.Join(s.dnsblListed, ", ")),
+	}
+}
+
+// addDNSBLHeader names the blocklists the client is on in an X-DNSBL
+// header. A sender's own X-DNSBL fields are removed, so filters can trust it.
+func (s *Session) addDNSBLHeader(data []byte) []byte {
+	if s.backend.dnsbl == nil {
+		return data
+	}
+	at := min(s.traceLen, len(data))
+	data = append(data[:at:at], removeHeaderFields(data[at:], "X-DNSBL")...)
+	if len(s.dnsblListed) == 0 {
+		return data
+	}
+	return s.addDeliveryHeaders(data, "X-DNSBL", fmt.Sprintf("%s; score=%g", strings.Join(s.dnsblListed, ", "), s.dnsblScore))
+}
@@ -0,0 +1,158 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/fenilsonani/email-server/internal/config"
+)
+
+// fakeResolver answers DNSBL queries from a table; other names don't exist.
+// A name answered with "timeout" blocks until the lookup is cancelled.
+type fakeResolver struct {
+	answers map[string][]string
+	queries atomic.Int32
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.queries.Add(1)
+	addrs, ok := r.answers[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	if len(addrs) == 1 && addrs[0] == "timeout" {
+		<-ctx.Done()
+		return nil, &net.DNSError{Err: ctx.Err().Error(), Name: host, IsTimeout: true}
+	}
+	return addrs, nil
+}
+
+// dnsblSession returns an inbound session from ip on a backend checking
+// the lists against resolver
+func dnsblSession(t *testing.T, ip string, resolver *fakeResolver, cfg config.DNSBLConfig) *Session {
+	t.Helper()
+	env := setupTestBackend(t)
+	env.backend.config.Security.DNSBL = cfg
+	env.backend.dnsbl = newDNSBLChecker(cfg)
+	env.backend.dnsbl.resolver = resolver
+	return &Session{backend: env.backend, ctx: context.Background(), remoteAddr: net.JoinHostPort(ip, "4000")}
+}
+
+func TestDNSBLRejectsListedIP(t *testing.T) {
+	resolver := &fakeResolver{answers: map[string][]string{
+		"5.113.0.203.zen.example.org":  {"127.0.0.2"},
+		"5.113.0.203.bl.example.net":   {"127.0.0.4"},
+		"7.113.0.203.bl.example.net":   {"127.0.0.2"},
+		"9.113.0.203.zen.example.org":  {"127.255.255.254"}, // Query refused, not a listing
+		"10.113.0.203.zen.example.org": {"timeout"},
+	}}
+	cfg := config.DNSBLConfig{
+		Lists: []config.DNSBLListConfig{
+			{Zone: "zen.example.org"},
+			{Zone: "bl.example.net", Weight: 0.5},
+		},
+		Threshold: 1,
+		Timeout:   "50ms",
+	}
+
+	s := dnsblSession(t, "203.0.113.5", resolver, cfg)
+	err := s.Mail("sender@example.net", nil)
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 554 || !strings.Contains(smtpErr.Message, "zen.example.org, bl.example.net") {
+		t.Fatalf("Mail() from a listed IP error = %v, want 554 naming both lists", err)
+	}
+
+	// Half the threshold: accepted, with the list in the header
+	s = dnsblSession(t, "203.0.113.7", resolver, cfg)
+	if err := s.Mail("sender@example.net", nil); err != nil {
+		t.Fatalf("Mail() below the threshold error = %v", err)
+	}
+	s.traceLen = len("Received: by mx\r\n")
+	data := s.addDNSBLHeader([]byte("Received: by mx\r\nX-DNSBL: forged\r\nSubject: hi\r\n\r\nbody\r\n"))
+	if want := "Received: by mx\r\nX-DNSBL: bl.example.net; score=0.5\r\nSubject: hi\r\n"; !strings.HasPrefix(string(data), want) {
+		t.Errorf("message = %q, want it to start %q", data, want)
+	}
+
+	// Refused queries and lookups that time out don't count
+	for _, ip := range []string{"203.0.113.9", "203.0.113.10"} {
+		start := time.Now()
+		if err := dnsblSession(t, ip, resolver, cfg).Mail("sender@example.net", nil); err != nil {
+			t.Errorf("Mail() from %s error = %v, want accepted", ip, err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("Mail() from %s took %v, want the lookup timeout to apply", ip, elapsed)
+		}
+	}
+}
+
+func TestDNSBLPassesUnlistedIP(t *testing.T) {
+	resolver := &fakeResolver{answers: map[string][]string{}}
+	cfg := config.DNSBLConfig{Lists: []config.DNSBLListConfig{{Zone: "zen.example.org"}}, Threshold: 1}
+	s := dnsblSession(t, "2001:db8::1", resolver, cfg)
+
+	if err := s.Mail("sender@example.net", nil); err != nil {
+		t.Fatalf("Mail() from an unlisted IP error = %v", err)
+	}
+	data := s.addDNSBLHeader([]byte("Subject: hi\r\n\r\nbody\r\n"))
+	if strings.Contains(string(data), "X-DNSBL") {
+		t.Errorf("unlisted client got an X-DNSBL header:\n%s", data)
+	}
+
+	// The result is cached for later connections
+	s.backend.dnsbl.check(context.Background(), "[2001:db8::1]:25")
+	if n := resolver.queries.Load(); n != 1 {
+		t.Errorf("resolver queried %d times, want 1", n)
+	}
+
+	// Local clients aren't looked up at all
+	s = dnsblSession(t, "127.0.0.1", resolver, cfg)
+	s.Mail("sender@example.net", nil)
+	if n := resolver.queries.Load(); n != 1 {
+		t.Errorf("resolver queried %d times after a loopback client, want 1", n)
+	}
+}
+
+func TestDNSBLCacheEviction(t *testing.T) {
+	c := newDNSBLChecker(config.DNSBLConfig{Lists: []config.DNSBLListConfig{{Zone: "zen.example.org"}}, CacheTTL: "1m"})
+	now := time.Now()
+	c.cache["192.0.2.1"] = dnsblResult{expires: now.Add(-time.Second)}
+	c.cache["192.0.2.2"] = dnsblResult{expires: now.Add(time.Minute)}
+
+	// Expired results go in the first sweep, and no sweep follows within the TTL
+	c.evict(now)
+	if _, ok := c.cache["192.0.2.1"]; ok || len(c.cache) != 1 {
+		t.Fatalf("cache after a sweep = %v, want only 192.0.2.2", c.cache)
+	}
+	c.cache["192.0.2.3"] = dnsblResult{expires: now}
+	c.evict(now.Add(time.Second))
+	if len(c.cache) != 2 {
+		t.Errorf("cache has %d results after evict() within the TTL, want 2", len(c.cache))
+	}
+
+	// A full cache drops one to make room
+	for i := len(c.cache); i < dnsblCacheSize; i++ {
+		c.cache[fmt.Sprint(i)] = dnsblResult{expires: now.Add(time.Minute)}
+	}
+	c.evict(now.Add(time.Second))
+	if len(c.cache) != dnsblCacheSize-1 {
+		t.Errorf("full cache has %d results after evict(), want %d", len(c.cache), dnsblCacheSize-1)
+	}
+}
+
+func TestDNSBLQuery(t *testing.T) {
+	for _, tt := range []struct{ ip, want string }{
+		{"192.0.2.99", "99.2.0.192.zen.example.org"},
+		{"2001:db8::567:89ab", "b.a.9.8.7.6.5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.zen.example.org"},
+	} {
+		if got := dnsblQuery(net.ParseIP(tt.ip), "zen.example.org."); got != tt.want {
+			t.Errorf("dnsblQuery(%s) = %s, want %s", tt.ip, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"html"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strings"
+
+	"github.com/fenilsonani/email-server/internal/validation"
+)
+
+// maxFooterDepth bounds how deeply nested multiparts are searched for the
+// text a footer is added to
+const maxFooterDepth = 5
+
+// addFooter appends the footer configured for the sending user's domain to
+// a submitted message; mail from relay networks has no user, so the envelope
+// sender's domain is used. Plain-text parts get the text footer and HTML
+// parts the HTML one; attachments, signed and encrypted messages are left
+// alone. A message carrying the skip header gets no footer and loses the
+// header.
+func (s *Session) addFooter(data []byte) []byte {
+	cfg := s.backend.config.Submission.Footer
+	// The envelope sender is the client's choice, so it mustn't pick the footer
+	_, domain := parseAddress(s.from)
+	if s.user != nil {
+		domain = s.user.Domain
+	}
+	text, htmlFooter := cfg.ForDomain(domain)
+	text = strings.TrimRight(text, "\r\n")
+	if text == "" {
+		return data
+	}
+
+	if cfg.SkipHeader != "" {
+		header, _ := textproto.NewReader(bufio.NewReader(bytes.NewReader(data))).ReadMIMEHeader()
+		if _, skip := header[textproto.CanonicalMIMEHeaderKey(cfg.SkipHeader)]; skip {
+			at := min(s.traceLen, len(data))
+			return append(data[:at:at], removeHeaderFields(data[at:], cfg.SkipHeader)...)
+		}
+	}
+
+	if htmlFooter == "" {
+		htmlFooter = "<p>" + strings.ReplaceAll(html.EscapeString(text), "\n", "<br>\n") + "</p>"
+	}
+	out, ok := footerEntity(data, crlf(text), crlf(strings.TrimRight(htmlFooter, "\r\n")), 0)
+	if !ok {
+		s.backend.logger.DebugContext(s.ctx, "No text part to add the footer to", "from", s.from)
+		return data
+	}
+	return out
+}
+
+// footerEntity adds the footers to the text of a MIME entity, returning
+// false if it has no text they can be added to
+func footerEntity(entity []byte, text, htmlFooter string, depth int) ([]byte, bool) {
+	header, body, ok := splitEntity(entity)
+	if !ok {
+		return nil, false
+	}
+	fields, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(header))).ReadMIMEHeader()
+	if err != nil {
+		return nil, false
+	}
+	if disposition, _, _ := mime.ParseMediaType(fields.Get("Content-Disposition")); disposition == "attachment" {
+		return nil, false
+	}
+
+	mediaType, params := "text/plain", map[string]string{}
+	if ct := fields.Get("Content-Type"); ct != "" {
+		if mediaType, params, err = mime.ParseMediaType(ct); err != nil {
+			return nil, false
+		}
+	}
+
+	switch mediaType {
+	case "text/plain":
+		return footerText(header, fields, mediaType, params, body, text, false)
+	case "text/html":
+		return footerText(header, fields, mediaType, params, body, htmlFooter, true)
+	case "multipart/alternative", "multipart/mixed", "multipart/related":
+		if depth >= maxFooterDepth || params["boundary"] == "" {
+			return nil, false
+		}
+		// Every alternative gets the footer; otherwise only the first
+		// part, the message text, does
+		all := mediaType == "multipart/alternative"
+		body, ok := footerMultipart(body, params["boundary"], all, text, htmlFooter, depth+1)
+		if !ok {
+			return nil, false
+		}
+		return append(header, body...), true
+	}
+	return nil, false
+}
+
+// footerMultipart adds the footers to the first part of a multipart body,
+// or to all of them
+func footerMultipart(body []byte, boundary string, all bool, text, htmlFooter string, depth int) ([]byte, bool) {
+	delimiter := []byte("--" + boundary)
+	var out []byte
+	added := false
+	start := -1 // Start of the current part's content
+	last := 0   // End of what has been copied to out
+	for pos := 0; pos < len(body); {
+		end := bytes.IndexByte(body[pos:], '\n') + 1
+		if end == 0 {
+			end = len(body) - pos
+		}
+		line := bytes.TrimRight(body[pos:pos+end], " \t\r\n")
+		if !bytes.HasPrefix(line, delimiter) || (len(line) != len(delimiter) && !bytes.Equal(line[len(delimiter):], []byte("--"))) {
+			pos += end
+			continue
+		}
+
+		if start >= 0 && (all || !added) {
+			// The line break before a delimiter belongs to it
+			partEnd := pos
+			if partEnd > start && body[partEnd-1] == '\n' {
+				partEnd--
+				if partEnd > start && body[partEnd-1] == '\r' {
+					partEnd--
+				}
+			}
+			if part, ok := footerEntity(body[start:partEnd], text, htmlFooter, depth); ok {
+				out = append(out, body[last:start]...)
+				out = append(out, part...)
+				last = partEnd
+				added = true
+			} else if !all {
+				// Only the first part is the message text
+				break
+			}
+		}
+		if len(line) != len(delimiter) {
+			break // Closing delimiter
+		}
+		pos += end
+		start = pos
+	}
+	if !added {
+		return nil, false
+	}
+	return append(out, body[last:]...), true
+}
+
+// footerText adds footer to the end of a text part, or for HTML before its
+// closing body tag. A non-ASCII footer needs a UTF-8 part: a US-ASCII one
+// becomes UTF-8, sent quoted-printable if it was 7bit.
+func footerText(header []byte, fields textproto.MIMEHeader, mediaType string, params map[string]string, body []byte, footer string, isHTML bool) ([]byte, bool) {
+	encoding := strings.ToLower(strings.TrimSpace(fields.Get("Content-Transfer-Encoding")))
+	content, ok := decodeBody(body, encoding)
+	if !ok {
+		return nil, false
+	}
+
+	rewrite := false
+	if !validation.IsASCII(footer) {
+		switch strings.ToLower(params["charset"]) {
+		case "utf-8", "utf8":
+		case "", "us-ascii":
+			params["charset"] = "utf-8"
+			rewrite = true
+		default:
+			return nil, false
+		}
+		if encoding == "" || encoding == "7bit" {
+			encoding = "quoted-printable"
+			rewrite = true
+		}
+	}
+
+	var updated []byte
+	if i := bytes.LastIndex(bytes.ToLower(content), []byte("</body")); isHTML && i >= 0 {
+		updated = append(updated, content[:i]...)
+		updated = append(updated, footer...)
+		updated = append(updated, "\r\n"...)
+		updated = append(updated, content[i:]...)
+	} else {
+		updated = append(updated, content...)
+		if len(updated) > 0 && !bytes.HasSuffix(updated, []byte("\n")) {
+			updated = append(updated, "\r\n"...)
+		}
+		if !isHTML {
+			updated = append(updated, "\r\n"...)
+		}
+		updated = append(updated, footer...)
+		updated = append(updated, "\r\n"...)
+	}
+
+	if rewrite {
+		header = removeHeaderFields(header, "Content-Type", "Content-Transfer-Encoding")
+		header = bytes.TrimSuffix(bytes.TrimSuffix(header, []byte("\n")), []byte("\r"))
+		header = append(header, "Content-Type: "+mime.FormatMediaType(mediaType, params)+"\r\n"...)
+		header = append(header, "Content-Transfer-Encoding: "+encoding+"\r\n\r\n"...)
+	}
+	return append(header, encodeBody(updated, encoding)...), true
+}
+
+// splitEntity splits a MIME entity after the blank line ending its header
+func splitEntity(entity []byte) (header, body []byte, ok bool) {
+	if bytes.HasPrefix(entity, []byte("\r\n")) {
+		return entity[:2:2], entity[2:], true
+	}
+	if i := bytes.Index(entity, []byte("\r\n\r\n")); i >= 0 {
+		return entity[: i+4 : i+4], entity[i+4:], true
+	}
+	if i := bytes.Index(entity, []byte("\n\n")); i >= 0 {
+		return entity[: i+2 : i+2], entity[i+2:], true
+	}
+	return nil, nil, false
+}
+
+// decodeBody undoes a part's Content-Transfer-Encoding
+func decodeBody(body []byte, encoding string) ([]byte, bool) {
+	switch encoding {
+	case "", "7bit", "8bit", "binary":
+		return body, true
+	case "quoted-printable":
+		content, err := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(body)))
+		return content, err == nil
+	case "base64":
+		content, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(body)), ""))
+		return content, err == nil
+	}
+	return nil, false
+}
+
+// encodeBody applies a Content-Transfer-Encoding decodeBody accepts
+func encodeBody(content []byte, encoding string) []byte {
+	switch encoding {
+	case "quoted-printable":
+		var buf bytes.Buffer
+		w := quotedprintable.NewWriter(&buf)
+		w.Write(content)
+		w.Close()
+		return buf.Bytes()
+	case "base64":
+		encoded := base64.StdEncoding.EncodeToString(content)
+		var buf bytes.Buffer
+		for len(encoded) > 76 {
+			buf.WriteString(encoded[:76] + "\r\n")
+			encoded = encoded[76:]
+		}
+		buf.WriteString(encoded + "\r\n")
+		return buf.Bytes()
+	}
+	return content
+}
+
+// crlf returns s with CRLF line endings
+func crlf(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "\r\n", "\n"), "\n", "\r\n")
+}
@@ -0,0 +1,234 @@
+package smtp
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/fenilsonani/email-server/internal/config"
+	"github.com/fenilsonani/email-server/internal/security"
+)
+
+const disclaimer = "Confidential: intended for the addressee only."
+
+// submitWithFooter submits msg from alice@example.com with the footer
+// configured and returns the message queued for carol@example.org
+func submitWithFooter(t *testing.T, footer config.FooterConfig, msg string) []byte {
+	t.Helper()
+	env := setupTestBackend(t)
+	q := env.withRelayQueue(t)
+	alice := env.addUser(t, "alice", "example.com")
+	env.backend.config.Submission.Footer = footer
+
+	env.submit(t, alice, "carol@example.org", msg)
+	pending, _ := q.ListPending(context.Background(), 10)
+	if len(pending) != 1 {
+		t.Fatalf("queued %d messages, want 1", len(pending))
+	}
+	data, err := os.ReadFile(pending[0].MessagePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestFooterPlainText(t *testing.T) {
+	footer := config.FooterConfig{Text: disclaimer, SkipHeader: "X-No-Footer"}
+	data := submitWithFooter(t, footer, "From: alice@example.com\r\nTo: carol@example.org\r\nSubject: hi\r\n\r\nhello\r\n")
+
+	m, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(m.Body)
+	if want := "hello\r\n\r\n" + disclaimer + "\r\n"; string(body) != want {
+		t.Errorf("body = %q, want %q", body, want)
+	}
+	if !strings.HasPrefix(string(data), "Received: ") {
+		t.Errorf("message doesn't start with our trace header:\n%s", data)
+	}
+
+	// The skip header leaves the message alone and is removed
+	data = submitWithFooter(t, footer, "From: alice@example.com\r\nX-No-Footer: yes\r\nSubject: hi\r\n\r\nhello\r\n")
+	if strings.Contains(string(data), disclaimer) || strings.Contains(string(data), "X-No-Footer") {
+		t.Errorf("message with the skip header =\n%s", data)
+	}
+
+	// A domain's own setting overrides the default
+	footer.Domains = []config.FooterDomainConfig{{Domain: "example.com"}}
+	data = submitWithFooter(t, footer, "Subject: hi\r\n\r\nhello\r\n")
+	if strings.Contains(string(data), disclaimer) {
+		t.Errorf("example.com has no footer, got\n%s", data)
+	}
+}
+
+func TestFooterFollowsUserDomain(t *testing.T) {
+	env := setupTestBackend(t)
+	q := env.withRelayQueue(t)
+	alice := env.addUser(t, "alice", "example.com")
+	env.backend.config.Submission.Footer = config.FooterConfig{
+		Text:    disclaimer,
+		Domains: []config.FooterDomainConfig{{Domain: "example.net"}},
+	}
+
+	// Sending as an address of a domain without a footer doesn't drop it
+	session := &Session{backend: env.backend, user: alice, isSubmission: true, ctx: context.Background()}
+	if err := session.Mail("alice@example.net", nil); err != nil {
+		t.Fatalf("Mail() error = %v", err)
+	}
+	if err := session.Rcpt("carol@example.org", nil); err != nil {
+		t.Fatalf("Rcpt() error = %v", err)
+	}
+	if err := session.Data(strings.NewReader("Subject: hi\r\n\r\nhello\r\n")); err != nil {
+		t.Fatalf("Data() error = %v", err)
+	}
+
+	pending, _ := q.ListPending(context.Background(), 10)
+	if len(pending) != 1 {
+		t.Fatalf("queued %d messages, want 1", len(pending))
+	}
+	data, err := os.ReadFile(pending[0].MessagePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), disclaimer) {
+		t.Errorf("mail from alice@example.com's account has no footer:\n%s", data)
+	}
+}
+
+func TestFooterMultipartAlternative(t *testing.T) {
+	msg := "From: alice@example.com\r\n" +
+		"Subject: hi\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/alternative; boundary=\"b1\"\r\n" +
+		"\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"caf=C3=A9 at noon\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"PGh0bWw+PGJvZHk+PHA+Y2Fmw6kgYXQgbm9vbjwvcD48L2JvZHk+PC9odG1sPg==\r\n" +
+		"--b1--\r\n"
+	data := submitWithFooter(t, config.FooterConfig{Text: disclaimer, HTML: "<p><i>" + disclaimer + "</i></p>"}, msg)
+
+	m, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr := multipart.NewReader(m.Body, params["boundary"])
+	var parts []string
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("NextPart() error = %v\n%s", err, data)
+		}
+		// multipart.Reader undoes quoted-printable but not base64
+		var r io.Reader = p
+		if p.Header.Get("Content-Transfer-Encoding") == "base64" {
+			r = base64.NewDecoder(base64.StdEncoding, p)
+		}
+		content, _ := io.ReadAll(r)
+		parts = append(parts, string(content))
+	}
+
+	want := []string{
+		"café at noon\r\n\r\n" + disclaimer + "\r\n",
+		"<html><body><p>café at noon</p><p><i>" + disclaimer + "</i></p>\r\n</body></html>",
+	}
+	if len(parts) != len(want) {
+		t.Fatalf("parts = %q, want %q", parts, want)
+	}
+	for i := range want {
+		if parts[i] != want[i] {
+			t.Errorf("part %d = %q, want %q", i, parts[i], want[i])
+		}
+	}
+}
+
+func TestFooterKeepsDKIMSignatureValid(t *testing.T) {
+	msg := "From: alice@example.com\r\n" +
+		"To: carol@example.org\r\n" +
+		"Subject: hi\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"outer\"\r\n" +
+		"\r\n" +
+		"--outer\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"See attached.\r\n" +
+		"--outer\r\n" +
+		"Content-Type: text/plain; name=\"notes.txt\"\r\n" +
+		"Content-Disposition: attachment; filename=\"notes.txt\"\r\n" +
+		"\r\n" +
+		"attached notes\r\n" +
+		"--outer--\r\n"
+	// A non-ASCII footer turns the US-ASCII text part into UTF-8
+	data := submitWithFooter(t, config.FooterConfig{Text: "Envoyé depuis example.com"}, msg)
+	if n := strings.Count(string(data), "Envoy"); n != 1 {
+		t.Errorf("footer added %d times, want only to the text, not the attachment:\n%s", n, data)
+	}
+	if !strings.Contains(string(data), "Content-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\nSee attached.\r\n\r\nEnvoy=C3=A9") {
+		t.Errorf("text part not re-encoded for the footer:\n%s", data)
+	}
+
+	// The delivery engine signs the queued message as it is
+	key, err := security.GenerateDKIMKey(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(t.TempDir(), "example.com.key")
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	pool := security.NewDKIMSignerPool()
+	if err := pool.AddSigner("example.com", "mail", keyPath); err != nil {
+		t.Fatal(err)
+	}
+	var signed bytes.Buffer
+	if err := pool.Sign("example.com", &signed, bytes.NewReader(data)); err != nil {
+		t.Fatalf("Sign() error = %v", err)
+	}
+
+	record, err := security.FormatDKIMPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifications, err := dkim.VerifyWithOptions(&signed, &dkim.VerifyOptions{
+		LookupTXT: func(name string) ([]string, error) {
+			if name != "mail._domainkey.example.com" {
+				return nil, fmt.Errorf("unexpected lookup of %s", name)
+			}
+			return []string{record}, nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+	if len(verifications) != 1 || verifications[0].Err != nil {
+		t.Fatalf("verifications = %+v, want one valid signature", verifications)
+	}
+}
@@ -0,0 +1,120 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/textproto"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/fenilsonani/email-server/internal/config"
+	"github.com/fenilsonani/email-server/internal/msgid"
+)
+
+// completeHeaders adds the Message-ID and Date headers a submitted message
+// is missing (RFC 6409 section 8). They are inserted after the trace header,
+// which occupies the first traceLen bytes of data.
+func (s *Session) completeHeaders(data []byte, traceLen int, now time.Time) []byte {
+	cfg := s.backend.config.Submission
+	if !cfg.AddMessageID && !cfg.AddDate {
+		return data
+	}
+
+	header, _ := textproto.NewReader(bufio.NewReader(bytes.NewReader(data))).ReadMIMEHeader()
+
+	var added bytes.Buffer
+	if cfg.AddMessageID && header.Get("Message-Id") == "" {
+		fmt.Fprintf(&added, "Message-ID: <%s>\r\n", msgid.New(s.messageIDDomain()))
+	}
+	if cfg.AddDate && header.Get("Date") == "" {
+		fmt.Fprintf(&added, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	}
+	if added.Len() == 0 {
+		return data
+	}
+
+	out := make([]byte, 0, len(data)+added.Len())
+	out = append(out, data[:traceLen]...)
+	out = append(out, added.Bytes()...)
+	return append(out, data[traceLen:]...)
+}
+
+// addDeliveryHeaders returns data with header fields, given as name and
+// value pairs, inserted after our trace header so that it stays first
+func (s *Session) addDeliveryHeaders(data []byte, fields ...string) []byte {
+	var added bytes.Buffer
+	for i := 0; i+1 < len(fields); i += 2 {
+		fmt.Fprintf(&added, "%s: %s\r\n", fields[i], fields[i+1])
+	}
+
+	at := min(s.traceLen, len(data))
+	out := make([]byte, 0, len(data)+added.Len())
+	out = append(out, data[:at]...)
+	out = append(out, added.Bytes()...)
+	return append(out, data[at:]...)
+}
+
+// messageIDDomain returns the domain used for generated Message-IDs
+func (s *Session) messageIDDomain() string {
+	if domain := s.backend.config.Submission.MessageIDDomain; domain != "" {
+		return domain
+	}
+	if _, domain := parseAddress(s.from); domain != "" {
+		return domain
+	}
+	return s.backend.config.Server.Hostname
+}
+
+// rewriteHeaders applies a configured header rewrite to a message: the
+// listed fields are removed from the client's header, leaving our trace
+// header alone, and the static fields are added after it
+func (s *Session) rewriteHeaders(data []byte, rw config.HeaderRewriteConfig) []byte {
+	if len(rw.Remove) == 0 && len(rw.Add) == 0 {
+		return data
+	}
+
+	if len(rw.Remove) > 0 {
+		at := min(s.traceLen, len(data))
+		data = append(data[:at:at], removeHeaderFields(data[at:], rw.Remove...)...)
+	}
+
+	fields := make([]string, 0, 2*len(rw.Add))
+	for _, f := range rw.Add {
+		fields = append(fields, f.Name, f.Value)
+	}
+	return s.addDeliveryHeaders(data, fields...)
+}
+
+// removeHeaderFields returns data without any header fields with one of
+// names, including their continuation lines. The body is left untouched.
+func removeHeaderFields(data []byte, names ...string) []byte {
+	out := make([]byte, 0, len(data))
+	removing := false
+	rest := data
+	for len(rest) > 0 {
+		end := bytes.IndexByte(rest, '\n') + 1
+		if end == 0 {
+			end = len(rest)
+		}
+		line := rest[:end]
+		rest = rest[end:]
+
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			// End of the header
+			out = append(out, line...)
+			return append(out, rest...)
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			field, _, _ := bytes.Cut(line, []byte(":"))
+			removing = slices.ContainsFunc(names, func(name string) bool {
+				return strings.EqualFold(string(bytes.TrimSpace(field)), name)
+			})
+		}
+		if !removing {
+			out = append(out, line...)
+		}
+	}
+	return out
+}
@@ -0,0 +1,169 @@
+package smtp
+
+import (
+	"bytes"
+	"net"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+	"github.com/fenilsonani/email-server/internal/metrics"
+)
+
+// HELO check modes for security.helo_check
+const (
+	heloCheckOff    = "off"
+	heloCheckLog    = "log"
+	heloCheckReject = "reject"
+)
+
+// errForgedHELO rejects a client that claims to be this server
+var errForgedHELO = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+	Message:      "HELO/EHLO claims to be this server",
+}
+
+// errInvalidHELO rejects a HELO that is not a domain or valid address literal
+var errInvalidHELO = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 5, 2},
+	Message:      "HELO/EHLO requires a domain or a bracketed address literal",
+}
+
+// checkHELO validates the name a client gave in HELO/EHLO. A client
+// connecting from outside may not use our own hostname or domains, and an
+// IP address must be an RFC 5321 address literal such as [192.0.2.1] or
+// [IPv6:2001:db8::1].
+func (b *Backend) checkHELO(helo, remoteAddr string) error {
+	if strings.HasPrefix(helo, "[") {
+		if !validAddressLiteral(helo) {
+			return errInvalidHELO
+		}
+		return nil
+	}
+	if net.ParseIP(helo) != nil {
+		return errInvalidHELO
+	}
+
+	if isLoopback(remoteAddr) {
+		return nil
+	}
+	name := strings.TrimSuffix(strings.ToLower(helo), ".")
+	if name == strings.ToLower(b.config.Server.Hostname) {
+		return errForgedHELO
+	}
+	for _, d := range b.config.Domains {
+		if name == strings.ToLower(d.Name) {
+			return errForgedHELO
+		}
+	}
+	return nil
+}
+
+// checkHELO applies security.helo_check to the name the client greeted
+// with. It runs at HELO/EHLO, when the session starts, and again at MAIL
+// when the client has since greeted under another name, which go-smtp
+// handles as a reset rather than a new session.
+func (s *Session) checkHELO() error {
+	mode := s.backend.config.Security.HELOCheck
+	if s.isSubmission || s.ipAllowed || s.conn == nil || mode == "" || mode == heloCheckOff {
+		return nil
+	}
+	helo := s.conn.Hostname()
+	if helo == s.heloChecked {
+		return nil
+	}
+	if err := s.backend.checkHELO(helo, s.remoteAddr); err != nil {
+		s.backend.logger.WarnContext(s.ctx, "Suspicious HELO",
+			"helo", helo,
+			"error", err.Error(),
+		)
+		if mode == heloCheckReject {
+			metrics.RecordRejection("helo")
+			return err
+		}
+	}
+	s.heloChecked = helo
+	return nil
+}
+
+// validAddressLiteral reports whether s is a bracketed IPv4 or IPv6 literal
+func validAddressLiteral(s string) bool {
+	inner, ok := strings.CutPrefix(s, "[")
+	if !ok {
+		return false
+	}
+	inner, ok = strings.CutSuffix(inner, "]")
+	if !ok {
+		return false
+	}
+	if v6, ok := strings.CutPrefix(inner, "IPv6:"); ok {
+		ip := net.ParseIP(v6)
+		return ip != nil && strings.Contains(v6, ":")
+	}
+	ip := net.ParseIP(inner)
+	return ip != nil && ip.To4() != nil && !strings.Contains(inner, ":")
+}
+
+// isLoopback reports whether a host:port remote address is on this machine
+func isLoopback(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// bannerListener replaces go-smtp's fixed "220 <domain> ESMTP Service Ready"
+// greeting with a configured one. The greeting is the first line go-smtp
+// writes, so only that write is rewritten; on port 465 the listener sits
+// above the one terminating TLS.
+type bannerListener struct {
+	net.Listener
+	greeting []byte
+}
+
+func newBannerListener(l net.Listener, hostname, banner string) net.Listener {
+	if banner == "" {
+		return l
+	}
+	return &bannerListener{
+		Listener: l,
+		greeting: []byte("220 " + hostname + " " + banner + "\r\n"),
+	}
+}
+
+func (l *bannerListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &bannerConn{Conn: c, greeting: l.greeting}, nil
+}
+
+// bannerConn rewrites the first 220 line it writes
+type bannerConn struct {
+	net.Conn
+	greeting []byte
+	greeted  bool
+}
+
+func (c *bannerConn) Write(p []byte) (int, error) {
+	if c.greeted {
+		return c.Conn.Write(p)
+	}
+	c.greeted = true
+	if !bytes.HasPrefix(p, []byte("220 ")) || !bytes.HasSuffix(p, []byte("\r\n")) {
+		return c.Conn.Write(p)
+	}
+	if _, err := c.Conn.Write(c.greeting); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Unwrap returns the connection the banner is written to
+func (c *bannerConn) Unwrap() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,132 @@
+package smtp
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/fenilsonani/email-server/internal/config"
+	"github.com/fenilsonani/email-server/internal/logging"
+)
+
+func TestCheckHELO(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.Server.Hostname = "mx.example.com"
+	cfg.Domains = []config.DomainConfig{{Name: "example.com"}}
+	b := &Backend{config: cfg, logger: logging.Default().SMTP()}
+
+	tests := []struct {
+		helo   string
+		remote string
+		want   error
+	}{
+		{"mail.example.net", "203.0.113.5:40000", nil},
+		{"[203.0.113.5]", "203.0.113.5:40000", nil},
+		{"[IPv6:2001:db8::1]", "[2001:db8::1]:40000", nil},
+		{"mx.example.com", "203.0.113.5:40000", errForgedHELO},
+		{"MX.Example.COM.", "203.0.113.5:40000", errForgedHELO},
+		{"example.com", "203.0.113.5:40000", errForgedHELO},
+		{"mx.example.com", "127.0.0.1:40000", nil},
+		{"203.0.113.5", "203.0.113.5:40000", errInvalidHELO},
+		{"[203.0.113]", "203.0.113.5:40000", errInvalidHELO},
+		{"[2001:db8::1]", "203.0.113.5:40000", errInvalidHELO},
+		{"[203.0.113.5", "203.0.113.5:40000", errInvalidHELO},
+	}
+	for _, tt := range tests {
+		if err := b.checkHELO(tt.helo, tt.remote); !errors.Is(err, tt.want) {
+			t.Errorf("checkHELO(%q, %s) = %v, want %v", tt.helo, tt.remote, err, tt.want)
+		}
+	}
+}
+
+func TestHELOCheckRejectsAtHELO(t *testing.T) {
+	env := setupTestBackend(t)
+	env.backend.config.Security.HELOCheck = heloCheckReject
+	addr := startTestServer(t, env.backend)
+
+	c := dialRaw(t, addr)
+	c.send("EHLO [203.0.113]\r\n")
+	if msg := c.expect(550); !strings.Contains(msg, "5.5.2") {
+		t.Errorf("EHLO reply = %q, want 5.5.2", msg)
+	}
+
+	c = dialRaw(t, addr)
+	c.send("EHLO client.example.net\r\n")
+	c.expect(250)
+	c.send("MAIL FROM:<sender@example.net>\r\n")
+	c.expect(250)
+
+	// Greeting again resets the session without starting a new one, so the
+	// new name is checked at MAIL
+	c.send("EHLO [203.0.113]\r\n")
+	c.expect(250)
+	c.send("MAIL FROM:<sender@example.net>\r\n")
+	c.expect(550)
+}
+
+func TestBannerListenerRewritesGreeting(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	srv := smtp.NewServer(setupTestBackend(t).backend)
+	srv.Domain = "mx.example.com"
+	go srv.Serve(newBannerListener(ln, "mx.example.com", "ESMTP ready for mail"))
+	t.Cleanup(func() { srv.Close() })
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	greeting, _ := r.ReadString('\n')
+	if greeting != "220 mx.example.com ESMTP ready for mail\r\n" {
+		t.Errorf("greeting = %q", greeting)
+	}
+
+	// Later replies pass through untouched
+	conn.Write([]byte("NOOP\r\n"))
+	if reply, _ := r.ReadString('\n'); !strings.HasPrefix(reply, "250 ") {
+		t.Errorf("NOOP reply = %q", reply)
+	}
+}
+
+func TestSMTPSUsesBanner(t *testing.T) {
+	env := setupTestBackend(t)
+	env.addUser(t, "alice", "example.com")
+	env.backend.config.SMTP.RequireTLSForAuth = true
+	srv := NewServer(env.backend, env.backend.config, testTLSConfig(t))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go srv.smtpsServer.Serve(newBannerListener(newImplicitTLSListener(ln, srv.tlsConfig), "mx.example.com", "ESMTP ready for mail"))
+	t.Cleanup(func() { srv.smtpsServer.Close() })
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	t.Cleanup(func() { conn.Close() })
+	c := &rawClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+
+	if greeting, _ := c.r.ReadString('\n'); greeting != "220 mx.example.com ESMTP ready for mail\r\n" {
+		t.Errorf("greeting = %q", greeting)
+	}
+
+	// The session sees the connection as encrypted
+	c.send("EHLO client.example.net\r\n")
+	if caps := c.expect(250); !strings.Contains(caps, "AUTH PLAIN") || strings.Contains(caps, "STARTTLS") {
+		t.Errorf("EHLO on SMTPS lacks AUTH or offers STARTTLS:\n%s", caps)
+	}
+	c.send(authPlain)
+	c.expect(235)
+}
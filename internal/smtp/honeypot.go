@@ -0,0 +1,50 @@
+package smtp
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// errThrottled defers mail from an IP that, during the session, wrote to a
+// spam trap or otherwise reached the reputation threshold
+var errThrottled = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+	Message:      "Too much mail from your address, please try again later",
+}
+
+// isTrap reports whether addr is one of smtp.honeypot.addresses, which
+// matches either the whole address or, given as @domain, its domain
+func (b *Backend) isTrap(addr string) bool {
+	addr = strings.ToLower(addr)
+	_, domain := parseAddress(addr)
+	for _, trap := range b.config.SMTP.Honeypot.Addresses {
+		trap = strings.ToLower(trap)
+		if trap == addr || (strings.HasPrefix(trap, "@") && trap[1:] == domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// trapPenalty returns smtp.honeypot.penalty, for which the sender of mail
+// to a spam trap is refused
+func (b *Backend) trapPenalty() time.Duration {
+	penalty, _ := time.ParseDuration(b.config.SMTP.Honeypot.Penalty)
+	if penalty <= 0 {
+		penalty = time.Hour
+	}
+	return penalty
+}
+
+// clientIP returns the IP address of a host:port remote address
+func clientIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
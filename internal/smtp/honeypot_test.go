@@ -0,0 +1,76 @@
+package smtp
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSpamTrapDiscardsAndThrottles(t *testing.T) {
+	env := setupTestBackend(t)
+	bob := env.addUser(t, "bob", "example.com")
+	env.backend.config.SMTP.Honeypot.Addresses = []string{"trap@example.com", "@spamtrap.example.com"}
+	r, _ := newTestReputation(t, 10)
+	env.backend.SetReputation(r)
+	addr := startTestServer(t, env.backend)
+
+	// The trap takes the recipient like any other address, and the sender
+	// is throttled, whoever it writes to next
+	c := dialRaw(t, addr)
+	c.send("EHLO client.example.net\r\n")
+	c.expect(250)
+	c.send("MAIL FROM:<sender@example.net>\r\n")
+	c.expect(250)
+	c.send("RCPT TO:<Trap@example.com>\r\n")
+	c.expect(250)
+	c.send("RCPT TO:<bob@example.com>\r\n")
+	if msg := c.expect(451); !strings.Contains(msg, "4.7.1") {
+		t.Errorf("RCPT reply = %q, want 4.7.1", msg)
+	}
+	c.send("RCPT TO:<anyone@spamtrap.example.com>\r\n")
+	c.expect(250)
+
+	// The message is accepted, then dropped
+	c.send("DATA\r\n")
+	c.expect(354)
+	c.send("Subject: offer\r\n\r\nbuy now\r\n.\r\n")
+	c.expect(250)
+	if bodies := env.inboxMessages(t, bob.ID); len(bodies) != 0 {
+		t.Errorf("bob INBOX has %d messages, want none", len(bodies))
+	}
+	spooled, _ := filepath.Glob(filepath.Join(env.backend.queuePath, "*"))
+	if len(spooled) != 0 {
+		t.Errorf("trap mail left %v in the queue directory", spooled)
+	}
+
+	// Its next connection is refused
+	c = dialRaw(t, addr)
+	c.send("EHLO client.example.net\r\n")
+	c.expect(451)
+}
+
+func TestSpamTrapPenalty(t *testing.T) {
+	r, now := newTestReputation(t, 10)
+
+	r.SpamTrap("192.0.2.1:2525", 6*time.Hour)
+	if !r.Blocked("192.0.2.1:25") {
+		t.Fatal("Blocked() = false, want true for the same IP on another port")
+	}
+	if r.Blocked("192.0.2.2:2525") {
+		t.Error("Blocked() = true for another IP, want false")
+	}
+	if e := r.Entries(); len(e) != 1 || e[0].Reason != "spam trap" {
+		t.Errorf("Entries() = %+v, want the trap hit", e)
+	}
+
+	// The penalty holds however long the half-life, then runs out
+	*now = now.Add(6*time.Hour - time.Minute)
+	if !r.Blocked("192.0.2.1:25") {
+		t.Error("Blocked() before the penalty ran out = false, want true")
+	}
+	*now = now.Add(2 * time.Minute)
+	if r.Blocked("192.0.2.1:25") {
+		t.Error("Blocked() after the penalty ran out = true, want false")
+	}
+}
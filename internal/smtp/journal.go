@@ -0,0 +1,115 @@
+package smtp
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/fenilsonani/email-server/internal/config"
+)
+
+// Journal copies are marked with these header fields, which also keep the
+// envelope: Bcc recipients appear nowhere else in a submitted message
+const (
+	journalReportHeader     = "X-Journal-Report"
+	journalSenderHeader     = "X-Journal-Sender"
+	journalRecipientsHeader = "X-Journal-Recipients"
+)
+
+// journalSubmission sends the archive copy of a submitted message, chosen
+// by the sender's domain
+func (s *Session) journalSubmission(data []byte) {
+	_, domain := parseAddress(s.from)
+	if s.user != nil {
+		_, domain = parseAddress(s.user.Email)
+	}
+	archive := s.backend.config.SMTP.Journal.ArchiveAddress(domain)
+	if archive == "" {
+		return
+	}
+	s.journal(archive, "submitted", s.rcpts, data)
+}
+
+// journalDelivery sends the archive copies of a message delivered to the
+// local recipients in delivered, one per archive address their domains use
+func (s *Session) journalDelivery(data []byte, delivered []string) {
+	if !s.backend.config.SMTP.Journal.Delivered {
+		return
+	}
+	byArchive := make(map[string][]string)
+	var archives []string
+	for _, rcpt := range delivered {
+		_, domain := parseAddress(rcpt)
+		archive := s.backend.config.SMTP.Journal.ArchiveAddress(domain)
+		if archive == "" {
+			continue
+		}
+		if _, ok := byArchive[archive]; !ok {
+			archives = append(archives, archive)
+		}
+		byArchive[archive] = append(byArchive[archive], rcpt)
+	}
+	for _, archive := range archives {
+		s.journal(archive, "delivered", byArchive[archive], data)
+	}
+}
+
+// journal sends archive a copy of data, marked as a journal copy and listing
+// the envelope sender and rcpts. Mail addressed only to archive addresses,
+// such as a journal copy that has come back, isn't journaled again.
+//
+// The copy goes with a null reverse-path, like a bounce: it is never DKIM
+// signed as the sender, and neither its delivery failures nor automatic
+// replies go back to the sender. Journaling is best effort and never fails
+// the original message.
+func (s *Session) journal(archive, kind string, rcpts []string, data []byte) {
+	rcpts = slices.DeleteFunc(slices.Clone(rcpts), s.isArchiveAddress)
+	if len(rcpts) == 0 {
+		return
+	}
+
+	data = s.addDeliveryHeaders(data,
+		journalReportHeader, kind,
+		journalSenderHeader, "<"+s.from+">",
+		journalRecipientsHeader, strings.Join(rcpts, ",\r\n\t"),
+	)
+	if err := s.sendJournal(archive, data); err != nil {
+		s.backend.logger.ErrorContext(s.ctx, "Failed to journal message", err,
+			"archive", archive,
+			"kind", kind,
+		)
+	}
+}
+
+// sendJournal delivers a journal copy to a local archive mailbox, or queues
+// it for one elsewhere
+func (s *Session) sendJournal(archive string, data []byte) error {
+	if s.backend.isLocalAddress(archive) {
+		return s.deliverToLocalRecipient("", archive, data)
+	}
+
+	if s.backend.deliveryEngine == nil {
+		return fmt.Errorf("delivery engine not configured")
+	}
+	messagePath, err := s.saveMessageToQueue(data)
+	if err != nil {
+		return err
+	}
+	if err := s.backend.deliveryEngine.Enqueue(s.ctx, "", []string{archive}, messagePath); err != nil {
+		os.Remove(messagePath)
+		return err
+	}
+	return nil
+}
+
+// isArchiveAddress reports whether addr is an address mail is journaled to
+func (s *Session) isArchiveAddress(addr string) bool {
+	j := s.backend.config.SMTP.Journal
+	if strings.EqualFold(addr, j.Address) {
+		return true
+	}
+	return slices.ContainsFunc(j.Domains, func(d config.JournalDomainConfig) bool {
+		return d.Address != "" && strings.EqualFold(addr, d.Address)
+	})
+}
@@ -0,0 +1,116 @@
+package smtp
+
+import (
+	"context"
+	"net/mail"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/fenilsonani/email-server/internal/config"
+)
+
+func TestSubmissionJournaled(t *testing.T) {
+	env := setupTestBackend(t)
+	env.backend.config.SMTP.Journal.Address = "archive@example.com"
+	alice := env.addUser(t, "alice", "example.com")
+	bob := env.addUser(t, "bob", "example.com")
+	archive := env.addUser(t, "archive", "example.com")
+
+	env.submit(t, alice, "bob@example.com", "Subject: hi\r\n\r\nhello\r\n")
+
+	if bodies := env.inboxMessages(t, bob.ID); len(bodies) != 1 || strings.Contains(bodies[0], "X-Journal") {
+		t.Fatalf("bob INBOX = %q, want one unmarked message", bodies)
+	}
+	copies := env.inboxMessages(t, archive.ID)
+	if len(copies) != 1 {
+		t.Fatalf("archive INBOX has %d messages, want 1", len(copies))
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(copies[0]))
+	if err != nil {
+		t.Fatalf("ReadMessage() error = %v", err)
+	}
+	if got := msg.Header.Get("X-Journal-Report"); got != "submitted" {
+		t.Errorf("X-Journal-Report = %q, want submitted", got)
+	}
+	if got := msg.Header.Get("X-Journal-Sender"); got != "<alice@example.com>" {
+		t.Errorf("X-Journal-Sender = %q, want <alice@example.com>", got)
+	}
+	if got := msg.Header.Get("X-Journal-Recipients"); got != "bob@example.com" {
+		t.Errorf("X-Journal-Recipients = %q, want bob@example.com", got)
+	}
+	if msg.Header.Get("Subject") != "hi" || !strings.HasPrefix(copies[0], "Received: ") {
+		t.Errorf("journal copy = %q, want the original message after our trace header", copies[0])
+	}
+}
+
+func TestJournalCopyNotRejournaled(t *testing.T) {
+	env := setupTestBackend(t)
+	env.backend.config.SMTP.Journal = config.JournalConfig{Address: "archive@example.com", Delivered: true}
+	bob := env.addUser(t, "bob", "example.com")
+	archive := env.addUser(t, "archive", "example.com")
+	addr := startTestServer(t, env.backend)
+
+	// Delivering the journal copy to the archive mailbox is itself a local
+	// delivery, which must not be journaled in turn
+	if code, text := sendMX(t, addr, "bob@example.com", "Subject: hi\r\n\r\nhello"); code != 250 {
+		t.Fatalf("DATA reply = %q", text)
+	}
+	if n := len(env.inboxMessages(t, bob.ID)); n != 1 {
+		t.Fatalf("bob INBOX has %d messages, want 1", n)
+	}
+	copies := env.inboxMessages(t, archive.ID)
+	if len(copies) != 1 {
+		t.Fatalf("archive INBOX has %d messages, want the one journal copy", len(copies))
+	}
+	if strings.Count(copies[0], "X-Journal-Report: delivered\r\n") != 1 {
+		t.Errorf("journal copy = %q, want one delivered report", copies[0])
+	}
+
+	// Nor is mail addressed to the archive, as a copy coming back would be
+	if code, text := sendMX(t, addr, "archive@example.com", "Subject: direct\r\n\r\nhello"); code != 250 {
+		t.Fatalf("DATA reply = %q", text)
+	}
+	copies = env.inboxMessages(t, archive.ID)
+	if len(copies) != 2 || strings.Contains(copies[1], "X-Journal-Report:") {
+		t.Errorf("archive INBOX = %q, want the direct message filed once, unmarked", copies)
+	}
+}
+
+func TestSubmissionJournaledToDomainArchive(t *testing.T) {
+	env := setupTestBackend(t)
+	q := env.withRelayQueue(t)
+	env.backend.config.SMTP.Journal = config.JournalConfig{
+		Address: "archive@example.com",
+		Domains: []config.JournalDomainConfig{{Domain: "Example.com", Address: "vault@archive.example"}},
+	}
+	alice := env.addUser(t, "alice", "example.com")
+
+	env.submit(t, alice, "carol@example.org", "Subject: hi\r\n\r\nhello\r\n")
+
+	pending, _ := q.ListPending(context.Background(), 10)
+	if len(pending) != 2 {
+		t.Fatalf("queued %d messages, want the message and its journal copy", len(pending))
+	}
+	var journal bool
+	for _, msg := range pending {
+		if msg.Recipients[0] != "vault@archive.example" {
+			continue
+		}
+		journal = true
+		// A null reverse-path keeps the copy from being signed as alice
+		if msg.Sender != "" {
+			t.Errorf("journal copy sender = %q, want the null reverse-path", msg.Sender)
+		}
+		data, err := os.ReadFile(msg.MessagePath)
+		if err != nil {
+			t.Fatalf("ReadFile() error = %v", err)
+		}
+		if !strings.Contains(string(data), "\r\nX-Journal-Recipients: carol@example.org\r\n") {
+			t.Errorf("journal copy = %q, want carol listed", data)
+		}
+	}
+	if !journal {
+		t.Errorf("nothing queued for vault@archive.example: %+v", pending)
+	}
+}
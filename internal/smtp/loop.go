@@ -0,0 +1,87 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net/textproto"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+	"github.com/fenilsonani/email-server/internal/sieve"
+)
+
+// errDeliveryLoop rejects a message that already carries the Delivered-To
+// header we would add, i.e. one that has been forwarded back to us
+var errDeliveryLoop = &smtp.SMTPError{
+	Code:         554,
+	EnhancedCode: smtp.EnhancedCode{5, 4, 6},
+	Message:      "Mail forwarding loop detected",
+}
+
+// isMailerDaemon reports whether addr is a MAILER-DAEMON address, with or
+// without a domain.
+func isMailerDaemon(addr string) bool {
+	local, _ := parseAddress(addr)
+	return strings.ToLower(local) == "mailer-daemon"
+}
+
+// wouldLoop reports whether the transaction is a bounce addressed to a
+// MAILER-DAEMON. Such a message can only be the result of an earlier bounce
+// bouncing, and answering it in any way (including a rejection) risks
+// bouncing it again.
+func (s *Session) wouldLoop() bool {
+	if s.from != "" && !isMailerDaemon(s.from) {
+		return false
+	}
+	for _, rcpt := range s.rcpts {
+		if isMailerDaemon(rcpt) {
+			return true
+		}
+	}
+	return false
+}
+
+// alreadyDeliveredTo reports whether data has a Delivered-To header for any
+// of addrs, which means we delivered or forwarded it to that address before
+func alreadyDeliveredTo(data []byte, addrs ...string) bool {
+	header, _ := textproto.NewReader(bufio.NewReader(bytes.NewReader(data))).ReadMIMEHeader()
+	for _, v := range header.Values("Delivered-To") {
+		for _, addr := range addrs {
+			if strings.EqualFold(strings.Trim(strings.TrimSpace(v), "<>"), addr) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// allLoops reports whether every delivery failed because of a loop, in
+// which case retrying can't help
+func allLoops(errs []error) bool {
+	for _, err := range errs {
+		if !errors.Is(err, errDeliveryLoop) {
+			return false
+		}
+	}
+	return true
+}
+
+// suppressAutoReply reports whether automatic responses such as vacation
+// replies must not be sent for msg, which came from the envelope sender
+// from (RFC 3834 section 2).
+func suppressAutoReply(from string, msg *sieve.Message) bool {
+	if from == "" || isMailerDaemon(from) {
+		return true
+	}
+	if msg == nil {
+		return false
+	}
+	for _, v := range msg.Headers["Auto-Submitted"] {
+		keyword, _, _ := strings.Cut(v, ";")
+		if !strings.EqualFold(strings.TrimSpace(keyword), "no") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// receivedHeader builds the Received trace header (RFC 5321 section 4.4)
+// stamped on every accepted message.
+func (s *Session) receivedHeader(queueID string, now time.Time) string {
+	helo := "unknown"
+	var tlsState *tls.ConnectionState
+	if s.conn != nil {
+		if h := sanitizeTraceToken(s.conn.Hostname()); h != "" {
+			helo = h
+		}
+		if state, ok := connTLSState(s.conn); ok {
+			tlsState = &state
+		}
+	}
+
+	ip := s.remoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Received: from %s ([%s])\r\n", helo, ip)
+	fmt.Fprintf(&b, "\tby %s with %s", s.backend.config.Server.Hostname, s.traceProtocol(tlsState != nil))
+	if tlsState != nil {
+		// "TLS 1.3" is written TLS1.3 so the comment reads as key=value pairs
+		version := strings.ReplaceAll(tls.VersionName(tlsState.Version), " ", "")
+		fmt.Fprintf(&b, " (version=%s cipher=%s)", version, tls.CipherSuiteName(tlsState.CipherSuite))
+	}
+	fmt.Fprintf(&b, "\r\n\tid %s", queueID)
+	// Only name the recipient when there is exactly one, so BCC recipients aren't disclosed
+	if len(s.rcpts) == 1 {
+		fmt.Fprintf(&b, "\r\n\tfor <%s>", s.rcpts[0])
+	}
+	fmt.Fprintf(&b, "; %s\r\n", now.Format(time.RFC1123Z))
+	return b.String()
+}
+
+// traceProtocol returns the "with" protocol keyword (RFC 3848, RFC 6531).
+func (s *Session) traceProtocol(tls bool) string {
+	proto := "ESMTP"
+	if s.utf8 {
+		proto = "UTF8SMTP"
+	}
+	if tls {
+		proto += "S"
+	}
+	if s.user != nil {
+		proto += "A"
+	}
+	return proto
+}
+
+// sanitizeTraceToken keeps a client-supplied name from breaking the header.
+func sanitizeTraceToken(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r <= ' ' || r >= 0x7f || r == '(' || r == ')' || r == ';' {
+			return -1
+		}
+		return r
+	}, s)
+	if len(s) > 255 {
+		s = s[:255]
+	}
+	return s
+}
+
+// countReceivedHeaders counts the Received headers in a message's header section.
+func countReceivedHeaders(data []byte) int {
+	count := 0
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 4096), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(bytes.TrimRight(line, "\r")) == 0 {
+			break // End of headers
+		}
+		if len(line) >= 9 && bytes.EqualFold(line[:9], []byte("received:")) {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,63 @@
+package smtp
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// parseRelayNetworks parses smtp.relay_networks. A bare IP address is a
+// network of that one address.
+func parseRelayNetworks(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid relay network %q", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if v4 := ip.To4(); v4 != nil {
+				ip, bits = v4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid relay network %q: %w", cidr, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// relayNetwork returns the trusted relay network a host:port remote address
+// belongs to, or nil if it isn't trusted to relay without AUTH
+func (b *Backend) relayNetwork(remoteAddr string) *net.IPNet {
+	if len(b.relayNetworks) == 0 {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+	for _, network := range b.relayNetworks {
+		if network.Contains(ip) {
+			return network
+		}
+	}
+	return nil
+}
+
+// mayRelay reports whether the session may send mail to remote domains:
+// it authenticated on the submission port, or it comes from a trusted
+// relay network. Everyone else may only deliver to local recipients, so
+// the server is never an open relay.
+func (s *Session) mayRelay() bool {
+	return (s.isSubmission && s.user != nil) || s.relayNet != nil
+}
@@ -0,0 +1,211 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/fenilsonani/email-server/internal/logging"
+	"github.com/fenilsonani/email-server/internal/queue"
+	"github.com/fenilsonani/email-server/internal/smtp/delivery"
+)
+
+// withRelayQueue gives the backend a delivery engine over an in-memory queue
+func (e *testEnv) withRelayQueue(t *testing.T) *queue.MemoryQueue {
+	t.Helper()
+	q := queue.NewMemoryQueue(queue.DefaultConfig())
+	t.Cleanup(func() { q.Close() })
+	e.backend.deliveryEngine = delivery.NewEngine(delivery.DefaultConfig(), q, nil, logging.Default())
+	return q
+}
+
+func TestTrustedNetworkMayRelay(t *testing.T) {
+	env := setupTestBackend(t)
+	q := env.withRelayQueue(t)
+	networks, err := parseRelayNetworks([]string{"10.0.0.0/8", "127.0.0.1"})
+	if err != nil {
+		t.Fatalf("parseRelayNetworks() error = %v", err)
+	}
+	env.backend.relayNetworks = networks
+	addr := startTestServer(t, env.backend)
+
+	c := dialRaw(t, addr)
+	c.send("EHLO app.internal\r\n")
+	c.expect(250)
+	c.send("MAIL FROM:<app@example.com>\r\n")
+	c.expect(250)
+	c.send("RCPT TO:<carol@example.org>\r\n")
+	c.expect(250)
+	c.send("DATA\r\n")
+	c.expect(354)
+	c.send("Subject: report\r\n\r\nhello\r\n.\r\n")
+	c.expect(250)
+
+	pending, _ := q.ListPending(context.Background(), 10)
+	if len(pending) != 1 || pending[0].Sender != "app@example.com" || pending[0].Recipients[0] != "carol@example.org" {
+		t.Fatalf("queued messages = %+v, want one to carol@example.org", pending)
+	}
+}
+
+func TestUntrustedNetworkMayNotRelay(t *testing.T) {
+	for _, submission := range []bool{false, true} {
+		name := "mx"
+		if submission {
+			name = "submission"
+		}
+		t.Run(name, func(t *testing.T) {
+			env := setupTestBackend(t)
+			q := env.withRelayQueue(t)
+			env.addUser(t, "bob", "example.com")
+			env.backend.relayNetworks, _ = parseRelayNetworks([]string{"10.0.0.0/8"})
+
+			var addr string
+			if submission {
+				addr = serveTestServer(t, NewServer(env.backend, env.backend.config, nil).submissionServer)
+			} else {
+				addr = startTestServer(t, env.backend)
+			}
+
+			c := dialRaw(t, addr)
+			c.send("EHLO client.example.net\r\n")
+			c.expect(250)
+			c.send("MAIL FROM:<someone@example.net>\r\n")
+			c.expect(250)
+			c.send("RCPT TO:<carol@example.org>\r\n")
+			if code, text := c.reply(); code != 550 {
+				t.Errorf("RCPT to a remote domain = %q, want 550", text)
+			}
+			// Local recipients are still accepted
+			c.send("RCPT TO:<bob@example.com>\r\n")
+			c.expect(250)
+
+			if pending, _ := q.ListPending(context.Background(), 10); len(pending) != 0 {
+				t.Errorf("queued messages = %+v, want none", pending)
+			}
+		})
+	}
+}
+
+func TestSubmissionStoresDSNParameters(t *testing.T) {
+	env := setupTestBackend(t)
+	q := env.withRelayQueue(t)
+	env.addUser(t, "alice", "example.com")
+	env.backend.config.Security.RequireTLS = false
+	addr := serveTestServer(t, NewServer(env.backend, env.backend.config, nil).submissionServer)
+
+	c := dialRaw(t, addr)
+	c.send("EHLO client.example.net\r\n")
+	if _, text := c.reply(); !strings.Contains(text, "DSN") {
+		t.Errorf("EHLO = %q, want DSN advertised", text)
+	}
+	c.send(authPlain)
+	c.expect(235)
+	c.send("MAIL FROM:<alice@example.com> RET=HDRS ENVID=QQ314159\r\n")
+	c.expect(250)
+	c.send("RCPT TO:<bob@example.org> NOTIFY=SUCCESS,FAILURE\r\n")
+	c.expect(250)
+	c.send("RCPT TO:<carol@example.org> NOTIFY=NEVER\r\n")
+	c.expect(250)
+	c.send("RCPT TO:<dave@example.org>\r\n")
+	c.expect(250)
+	c.send("DATA\r\n")
+	c.expect(354)
+	c.send("Subject: report\r\n\r\nhello\r\n.\r\n")
+	c.expect(250)
+
+	pending, _ := q.ListPending(context.Background(), 10)
+	if len(pending) != 1 || pending[0].DSN == nil {
+		t.Fatalf("queued messages = %+v, want one with DSN parameters", pending)
+	}
+	dsn := pending[0].DSN
+	if dsn.Return != "HDRS" || dsn.EnvelopeID != "QQ314159" {
+		t.Errorf("DSN = %+v, want RET=HDRS ENVID=QQ314159", dsn)
+	}
+	for rcpt, want := range map[string]string{"bob@example.org": "SUCCESS,FAILURE", "carol@example.org": "NEVER", "dave@example.org": ""} {
+		if got := dsn.Notify[rcpt]; got != want {
+			t.Errorf("NOTIFY of %s = %q, want %q", rcpt, got, want)
+		}
+	}
+}
+
+func TestParseRelayNetworks(t *testing.T) {
+	networks, err := parseRelayNetworks([]string{"192.0.2.0/24", "2001:db8::1"})
+	if err != nil {
+		t.Fatalf("parseRelayNetworks() error = %v", err)
+	}
+	b := &Backend{relayNetworks: networks}
+	tests := map[string]bool{
+		"192.0.2.7:2525":   true,
+		"192.0.3.7:2525":   false,
+		"[2001:db8::1]:25": true,
+		"[2001:db8::2]:25": false,
+		"not an address":   false,
+	}
+	for addr, want := range tests {
+		if got := b.relayNetwork(addr) != nil; got != want {
+			t.Errorf("relayNetwork(%q) trusted = %v, want %v", addr, got, want)
+		}
+	}
+
+	if _, err := parseRelayNetworks([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("parseRelayNetworks() accepted an invalid CIDR")
+	}
+	if got := networks[1].String(); got != "2001:db8::1/128" {
+		t.Errorf("bare IPv6 address parsed as %s, want 2001:db8::1/128", got)
+	}
+}
+
+func TestCheckOpenRelay(t *testing.T) {
+	env := setupTestBackend(t)
+	env.addUser(t, "bob", "example.com")
+	cfg := env.backend.config
+
+	cfg.SMTP.RelayNetworks = []string{"10.0.0.0/8"}
+	if err := CheckOpenRelay(cfg, env.auth); err != nil {
+		t.Errorf("CheckOpenRelay() with a narrow relay network = %v, want nil", err)
+	}
+
+	cfg.SMTP.RelayNetworks = []string{"0.0.0.0/0"}
+	err := CheckOpenRelay(cfg, env.auth)
+	if !errors.Is(err, ErrOpenRelay) || !strings.Contains(err.Error(), "0.0.0.0/0") {
+		t.Errorf("CheckOpenRelay() trusting every address = %v, want ErrOpenRelay naming the network", err)
+	}
+
+	// A database error turns the recipient away with 451, which says
+	// nothing about relaying
+	cfg.SMTP.RelayNetworks = []string{"10.0.0.0/8"}
+	env.db.Close()
+	if err := env.backend.CheckOpenRelay(); !errors.Is(err, ErrRelayCheckInconclusive) {
+		t.Errorf("CheckOpenRelay() with the database closed = %v, want ErrRelayCheckInconclusive", err)
+	}
+}
+
+func TestMXStoresDSNParametersOfTrustedRelay(t *testing.T) {
+	env := setupTestBackend(t)
+	q := env.withRelayQueue(t)
+	env.backend.relayNetworks, _ = parseRelayNetworks([]string{"127.0.0.1"})
+	addr := serveTestServer(t, NewServer(env.backend, env.backend.config, nil).mxServer)
+
+	c := dialRaw(t, addr)
+	c.send("EHLO app.internal\r\n")
+	if _, text := c.reply(); !strings.Contains(text, "DSN") {
+		t.Errorf("EHLO = %q, want DSN advertised", text)
+	}
+	c.send("MAIL FROM:<app@example.com> ENVID=QQ314159\r\n")
+	c.expect(250)
+	c.send("RCPT TO:<carol@example.org> NOTIFY=SUCCESS\r\n")
+	c.expect(250)
+	c.send("DATA\r\n")
+	c.expect(354)
+	c.send("Subject: report\r\n\r\nhello\r\n.\r\n")
+	c.expect(250)
+
+	pending, _ := q.ListPending(context.Background(), 10)
+	if len(pending) != 1 || pending[0].DSN == nil {
+		t.Fatalf("queued messages = %+v, want one with DSN parameters", pending)
+	}
+	if dsn := pending[0].DSN; dsn.EnvelopeID != "QQ314159" || dsn.Notify["carol@example.org"] != "SUCCESS" {
+		t.Errorf("DSN = %+v, want ENVID=QQ314159 and NOTIFY=SUCCESS for carol@example.org", dsn)
+	}
+}
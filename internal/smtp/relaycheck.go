@@ -0,0 +1,104 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/emersion/go-smtp"
+	"github.com/fenilsonani/email-server/internal/auth"
+	"github.com/fenilsonani/email-server/internal/config"
+	"github.com/fenilsonani/email-server/internal/logging"
+)
+
+// Open relay self-test. The probe plays an unauthenticated client from
+// addresses that should never be trusted (RFC 5737 and RFC 3849
+// documentation ranges) asking to send to a reserved remote domain, and
+// drives the session's MAIL FROM and RCPT TO handlers directly, so no
+// socket is needed and it runs exactly the checks a real client would hit.
+
+const (
+	relayProbeSender    = "relay-test@example.net"
+	relayProbeRecipient = "relay-test@relay-test.invalid"
+)
+
+var relayProbeAddrs = []string{"192.0.2.1:50000", "[2001:db8::1]:50000"}
+
+var (
+	// ErrOpenRelay is returned by CheckOpenRelay when the server would relay
+	// mail for an unauthenticated, untrusted client
+	ErrOpenRelay = errors.New("server is an open relay")
+
+	// ErrRelayCheckInconclusive is returned by CheckOpenRelay when the probe
+	// was turned away with a temporary failure, such as a database error,
+	// so it isn't known whether the recipient would have been refused
+	ErrRelayCheckInconclusive = errors.New("open relay check inconclusive")
+)
+
+// CheckOpenRelay reports whether a server with cfg refuses to relay to a
+// remote domain for an unauthenticated client outside smtp.relay_networks,
+// on both the MX and submission ports. It returns an error wrapping
+// ErrOpenRelay if either would accept the recipient, or
+// ErrRelayCheckInconclusive if a probe got a temporary failure. It is for
+// tools without a running server; the server checks its own Backend with
+// Backend.CheckOpenRelay.
+func CheckOpenRelay(cfg *config.Config, authenticator *auth.Authenticator) error {
+	networks, err := parseRelayNetworks(cfg.SMTP.RelayNetworks)
+	if err != nil {
+		return err
+	}
+	b := &Backend{
+		config:        cfg,
+		authenticator: authenticator,
+		logger:        &logging.Logger{Logger: slog.New(slog.DiscardHandler)},
+		relayNetworks: networks,
+	}
+	return b.CheckOpenRelay()
+}
+
+// CheckOpenRelay runs the relay probe against b, with its access rules,
+// reputation and other settings, and reports as the CheckOpenRelay function
+func (b *Backend) CheckOpenRelay() error {
+	var inconclusive error
+	for _, addr := range relayProbeAddrs {
+		for _, submission := range []bool{false, true} {
+			s := &Session{
+				backend:      b,
+				isSubmission: submission,
+				remoteAddr:   addr,
+				relayNet:     b.relayNetwork(addr),
+				ctx:          context.Background(),
+			}
+			err := s.Mail(relayProbeSender, nil)
+			if err == nil {
+				err = s.Rcpt(relayProbeRecipient, nil)
+			}
+			if isTemporary(err) {
+				if inconclusive == nil {
+					inconclusive = fmt.Errorf("%w: %s got %v", ErrRelayCheckInconclusive, addr, err)
+				}
+				continue
+			}
+			if err == nil {
+				port := "MX"
+				if submission {
+					port = "submission"
+				}
+				if s.relayNet != nil {
+					return fmt.Errorf("%w: %s accepted %s on the %s port because smtp.relay_networks trusts %s",
+						ErrOpenRelay, addr, relayProbeRecipient, port, s.relayNet)
+				}
+				return fmt.Errorf("%w: %s accepted %s on the %s port without authentication",
+					ErrOpenRelay, addr, relayProbeRecipient, port)
+			}
+		}
+	}
+	return inconclusive
+}
+
+// isTemporary reports whether err is a 4xx SMTP reply
+func isTemporary(err error) bool {
+	var smtpErr *smtp.SMTPError
+	return errors.As(err, &smtpErr) && smtpErr.Code >= 400 && smtpErr.Code < 500
+}
@@ -0,0 +1,350 @@
+package smtp
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/fenilsonani/email-server/internal/logging"
+)
+
+// Points an offence adds to the score of the IP it came from
+const (
+	reputationAuthFailure = 1.0 // Failed SMTP or IMAP login
+	reputationGreylist    = 2.0 // Retry before the greylisting delay was up
+	reputationSpam        = 5.0 // Mail to a spam trap
+)
+
+// forgetScore is the score below which an IP is forgotten
+const forgetScore = 0.1
+
+// reputationFlushInterval is how often changed scores are saved. A client
+// failing logins as fast as it can costs one write per interval, not one
+// per failure.
+const reputationFlushInterval = 5 * time.Second
+
+// errPoorReputation refuses a client whose IP has reached the threshold
+var errPoorReputation = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+	Message:      "Too many recent failures from your address, please try again later",
+}
+
+// Reputation scores client IPs by the failed logins, greylist violations and
+// spam they cause. A score halves every half-life, and an IP whose score has
+// reached the threshold is refused. Scores are kept in memory and, given a
+// database, saved there in the background so they survive a restart. A nil
+// Reputation scores nothing and refuses no one.
+type Reputation struct {
+	db        *sql.DB
+	logger    *logging.Logger
+	threshold float64
+	halfLife  time.Duration
+	now       func() time.Time
+
+	mu     sync.Mutex
+	scores map[string]*reputationScore
+	dirty  map[string]bool // IPs changed since the last save; a missing score is deleted
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// reputationScore is an IP's score as of its last offence
+type reputationScore struct {
+	score   float64
+	updated time.Time
+	reason  string
+}
+
+// ReputationEntry is an IP's current reputation
+type ReputationEntry struct {
+	IP      string
+	Score   float64
+	Reason  string // Latest offence
+	Updated time.Time
+	Blocked bool
+}
+
+// NewReputation creates a reputation store refusing IPs at threshold. Until
+// Close, it forgets decayed scores every reputationFlushInterval and, with a
+// database, saves the changed ones there, loading those saved before.
+func NewReputation(db *sql.DB, threshold float64, halfLife time.Duration, logger *logging.Logger) (*Reputation, error) {
+	if threshold <= 0 {
+		return nil, fmt.Errorf("reputation threshold must be positive")
+	}
+	if halfLife <= 0 {
+		halfLife = time.Hour
+	}
+	r := &Reputation{
+		db:        db,
+		logger:    logger,
+		threshold: threshold,
+		halfLife:  halfLife,
+		now:       time.Now,
+		scores:    make(map[string]*reputationScore),
+		dirty:     make(map[string]bool),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	if db != nil {
+		if err := r.load(); err != nil {
+			return nil, err
+		}
+	}
+	go r.run()
+	return r, nil
+}
+
+// load reads the scores saved in the database
+func (r *Reputation) load() error {
+	rows, err := r.db.Query(`SELECT ip, score, reason, updated_at FROM ip_reputation`)
+	if err != nil {
+		return fmt.Errorf("failed to load reputation: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ip string
+		var s reputationScore
+		var updated int64
+		if err := rows.Scan(&ip, &s.score, &s.reason, &updated); err != nil {
+			return fmt.Errorf("failed to load reputation: %w", err)
+		}
+		s.updated = time.Unix(updated, 0)
+		r.scores[ip] = &s
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to load reputation: %w", err)
+	}
+	return nil
+}
+
+// Close saves the scores changed since the last save and stops saving
+func (r *Reputation) Close() {
+	if r == nil {
+		return
+	}
+	select {
+	case <-r.stop:
+	default:
+		close(r.stop)
+	}
+	<-r.done
+}
+
+// run forgets decayed scores and saves changed ones every
+// reputationFlushInterval until stopped
+func (r *Reputation) run() {
+	defer close(r.done)
+	ticker := time.NewTicker(reputationFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.sweep()
+			r.flush()
+		case <-r.stop:
+			r.flush()
+			return
+		}
+	}
+}
+
+// sweep forgets the IPs whose score has decayed below forgetScore
+func (r *Reputation) sweep() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for ip, s := range r.scores {
+		if r.current(s) < forgetScore {
+			delete(r.scores, ip)
+			if r.db != nil {
+				r.dirty[ip] = true
+			}
+		}
+	}
+}
+
+// flush writes the changed scores in one transaction. On failure they stay
+// changed, to be tried again next time.
+func (r *Reputation) flush() {
+	r.mu.Lock()
+	if len(r.dirty) == 0 {
+		r.mu.Unlock()
+		return
+	}
+	changed := make(map[string]*reputationScore, len(r.dirty))
+	for ip := range r.dirty {
+		if s, ok := r.scores[ip]; ok {
+			saved := *s
+			changed[ip] = &saved
+		} else {
+			changed[ip] = nil
+		}
+	}
+	r.dirty = make(map[string]bool)
+	r.mu.Unlock()
+
+	if err := r.save(changed); err != nil {
+		if r.logger != nil {
+			r.logger.Warn("Failed to save IP reputation", "ips", len(changed), "error", err.Error())
+		}
+		r.mu.Lock()
+		for ip := range changed {
+			r.dirty[ip] = true
+		}
+		r.mu.Unlock()
+	}
+}
+
+// save upserts each score in changed and deletes the IPs without one
+func (r *Reputation) save(changed map[string]*reputationScore) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for ip, s := range changed {
+		if s == nil {
+			_, err = tx.Exec(`DELETE FROM ip_reputation WHERE ip = ?`, ip)
+		} else {
+			_, err = tx.Exec(`
+				INSERT INTO ip_reputation (ip, score, reason, updated_at) VALUES (?, ?, ?, ?)
+				ON CONFLICT(ip) DO UPDATE SET score = excluded.score, reason = excluded.reason, updated_at = excluded.updated_at
+			`, ip, s.score, s.reason, s.updated.Unix())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// AuthFailure counts a failed login from remoteAddr
+func (r *Reputation) AuthFailure(remoteAddr string) {
+	r.add(remoteAddr, reputationAuthFailure, "auth failure")
+}
+
+// GreylistViolation counts a retry from remoteAddr that came too soon
+func (r *Reputation) GreylistViolation(remoteAddr string) {
+	r.add(remoteAddr, reputationGreylist, "greylist violation")
+}
+
+// SpamTrap counts mail from remoteAddr to a spam trap. However good its
+// score was, the IP is refused for at least penalty.
+func (r *Reputation) SpamTrap(remoteAddr string, penalty time.Duration) {
+	if r == nil {
+		return
+	}
+	r.raise(remoteAddr, reputationSpam, r.threshold*math.Exp2(float64(penalty)/float64(r.halfLife)), "spam trap")
+}
+
+// Blocked reports whether the IP of remoteAddr has reached the threshold
+func (r *Reputation) Blocked(remoteAddr string) bool {
+	if r == nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.scores[clientIP(remoteAddr)]
+	return ok && r.current(s) >= r.threshold
+}
+
+// Entries returns the IPs with a score, highest first, then by IP
+func (r *Reputation) Entries() []ReputationEntry {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var entries []ReputationEntry
+	for ip, s := range r.scores {
+		score := r.current(s)
+		if score < forgetScore {
+			continue
+		}
+		entries = append(entries, ReputationEntry{
+			IP:      ip,
+			Score:   score,
+			Reason:  s.reason,
+			Updated: s.updated,
+			Blocked: score >= r.threshold,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Score != entries[j].Score {
+			return entries[i].Score > entries[j].Score
+		}
+		return entries[i].IP < entries[j].IP
+	})
+	return entries
+}
+
+// Clear forgets the score of ip
+func (r *Reputation) Clear(ctx context.Context, ip string) error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	delete(r.scores, ip)
+	delete(r.dirty, ip)
+	r.mu.Unlock()
+	if r.db == nil {
+		return nil
+	}
+	if _, err := r.db.ExecContext(ctx, `DELETE FROM ip_reputation WHERE ip = ?`, ip); err != nil {
+		return fmt.Errorf("failed to clear reputation of %s: %w", ip, err)
+	}
+	return nil
+}
+
+// add decays the score of the IP of remoteAddr to now and adds points
+func (r *Reputation) add(remoteAddr string, points float64, reason string) {
+	r.raise(remoteAddr, points, 0, reason)
+}
+
+// raise is add with the new score at least floor
+func (r *Reputation) raise(remoteAddr string, points, floor float64, reason string) {
+	if r == nil {
+		return
+	}
+	ip := clientIP(remoteAddr)
+	now := r.now()
+
+	r.mu.Lock()
+	s, ok := r.scores[ip]
+	if !ok {
+		s = &reputationScore{}
+		r.scores[ip] = s
+	}
+	wasBlocked := r.current(s) >= r.threshold
+	s.score = math.Max(r.current(s)+points, floor)
+	s.updated = now
+	s.reason = reason
+	score := s.score
+	if r.db != nil {
+		r.dirty[ip] = true
+	}
+	r.mu.Unlock()
+
+	if !wasBlocked && score >= r.threshold && r.logger != nil {
+		r.logger.Warn("Refusing client IP with poor reputation",
+			"ip", ip,
+			"score", score,
+			"reason", reason,
+		)
+	}
+}
+
+// current returns s decayed to now; the caller holds r.mu
+func (r *Reputation) current(s *reputationScore) float64 {
+	elapsed := r.now().Sub(s.updated)
+	if elapsed <= 0 {
+		return s.score
+	}
+	return s.score * math.Exp2(-float64(elapsed)/float64(r.halfLife))
+}
@@ -0,0 +1,152 @@
+package smtp
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fenilsonani/email-server/internal/logging"
+)
+
+// newTestReputation returns a reputation with a clock the test moves
+func newTestReputation(t *testing.T, threshold float64) (*Reputation, *time.Time) {
+	t.Helper()
+	r, err := NewReputation(nil, threshold, time.Hour, logging.Default())
+	if err != nil {
+		t.Fatalf("NewReputation() error = %v", err)
+	}
+	t.Cleanup(r.Close)
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	r.now = func() time.Time { return now }
+	return r, &now
+}
+
+func TestReputationBlocksAtThreshold(t *testing.T) {
+	r, _ := newTestReputation(t, 10)
+
+	for i := 0; i < 9; i++ {
+		r.AuthFailure("192.0.2.1:1234")
+	}
+	if r.Blocked("192.0.2.1:25") {
+		t.Fatal("Blocked() = true at 9 points, want false below the threshold of 10")
+	}
+	r.AuthFailure("192.0.2.1:1234")
+	if !r.Blocked("192.0.2.1:25") {
+		t.Fatal("Blocked() = false at 10 points, want true")
+	}
+	if r.Blocked("192.0.2.2:25") {
+		t.Error("Blocked() = true for another IP, want false")
+	}
+
+	// Offences of every kind add up
+	r.GreylistViolation("198.51.100.7:4000")
+	r.add("198.51.100.7:4001", reputationSpam, "spam")
+	r.GreylistViolation("198.51.100.7:4002")
+	r.AuthFailure("198.51.100.7:4003")
+	entries := r.Entries()
+	if len(entries) != 2 || entries[0].IP != "192.0.2.1" || entries[1].IP != "198.51.100.7" {
+		t.Fatalf("Entries() = %+v, want 192.0.2.1 then 198.51.100.7", entries)
+	}
+	if entries[1].Score != 10 || !entries[1].Blocked || entries[1].Reason != "auth failure" {
+		t.Errorf("entry = %+v, want score 10, blocked, latest offence auth failure", entries[1])
+	}
+
+	if err := r.Clear(context.Background(), "192.0.2.1"); err != nil {
+		t.Fatalf("Clear() error = %v", err)
+	}
+	if r.Blocked("192.0.2.1:25") {
+		t.Error("Blocked() after Clear() = true, want false")
+	}
+}
+
+func TestReputationDecays(t *testing.T) {
+	r, now := newTestReputation(t, 10)
+	for i := 0; i < 4; i++ {
+		r.add("192.0.2.1:25", reputationSpam, "spam")
+	}
+	if !r.Blocked("192.0.2.1:25") {
+		t.Fatal("Blocked() = false at 20 points, want true")
+	}
+
+	// One half-life takes 20 points to 10, still blocked; a little more
+	// unblocks the IP
+	*now = now.Add(time.Hour)
+	if !r.Blocked("192.0.2.1:25") {
+		t.Error("Blocked() after one half-life = false, want true at 10 points")
+	}
+	*now = now.Add(time.Minute)
+	if r.Blocked("192.0.2.1:25") {
+		t.Error("Blocked() after the score decayed below the threshold = true, want false")
+	}
+
+	// A new offence adds to the decayed score
+	r.add("192.0.2.1:25", reputationSpam, "spam")
+	if !r.Blocked("192.0.2.1:25") {
+		t.Error("Blocked() after another offence = false, want true")
+	}
+
+	// A score that has decayed away is forgotten
+	*now = now.Add(24 * time.Hour)
+	if entries := r.Entries(); len(entries) != 0 {
+		t.Errorf("Entries() a day later = %+v, want none", entries)
+	}
+	r.sweep()
+	if len(r.scores) != 0 {
+		t.Errorf("scores after a sweep a day later = %d, want none kept", len(r.scores))
+	}
+}
+
+func TestReputationPersists(t *testing.T) {
+	env := setupTestBackend(t)
+	r, err := NewReputation(env.db.DB, 2.5, time.Hour, logging.Default())
+	if err != nil {
+		t.Fatalf("NewReputation() error = %v", err)
+	}
+	r.AuthFailure("192.0.2.1:25")
+	r.AuthFailure("192.0.2.1:25")
+	r.add("192.0.2.2:25", reputationSpam, "spam")
+	if err := r.Clear(context.Background(), "192.0.2.2"); err != nil {
+		t.Fatalf("Clear() error = %v", err)
+	}
+	r.Close()
+
+	restarted, err := NewReputation(env.db.DB, 2.5, time.Hour, logging.Default())
+	if err != nil {
+		t.Fatalf("NewReputation() error = %v", err)
+	}
+	entries := restarted.Entries()
+	if len(entries) != 1 || entries[0].IP != "192.0.2.1" || entries[0].Score < 1.9 {
+		t.Fatalf("Entries() after restart = %+v, want 192.0.2.1 at 2 points", entries)
+	}
+	restarted.AuthFailure("192.0.2.1:25")
+	if !restarted.Blocked("192.0.2.1:25") {
+		t.Error("Blocked() = false, want the saved score to count")
+	}
+	restarted.Close()
+}
+
+func TestFailedLoginsRefuseClient(t *testing.T) {
+	env := setupTestBackend(t)
+	env.addUser(t, "alice", "example.com")
+	env.backend.config.Security.RequireTLS = false
+	r, _ := newTestReputation(t, 3)
+	env.backend.SetReputation(r)
+	srv := NewServer(env.backend, env.backend.config, nil)
+	addr := serveTestServer(t, srv.submissionServer)
+
+	c := dialRaw(t, addr)
+	c.send("EHLO client.example.net\r\n")
+	c.expect(250)
+	for i := 0; i < 3; i++ {
+		c.send("AUTH PLAIN AGFsaWNlQGV4YW1wbGUuY29tAHdyb25n\r\n")
+		c.expect(535)
+	}
+
+	// The next connection from the address is refused
+	c = dialRaw(t, addr)
+	c.send("EHLO client.example.net\r\n")
+	if msg := c.expect(451); !strings.Contains(msg, "4.7.1") {
+		t.Errorf("EHLO reply = %q, want 4.7.1", msg)
+	}
+}
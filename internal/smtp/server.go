@@ -15,13 +15,18 @@ import (
 type Server struct {
 	mxServer         *smtp.Server
 	submissionServer *smtp.Server
+	smtpsServer      *smtp.Server
+	tlsConfig        *tls.Config
 	config           *config.Config
 	mxListener       net.Listener
 	subListener      net.Listener
 	tlsListener      net.Listener
 }
 
-// NewServer creates SMTP servers for MX and submission
+// NewServer creates SMTP servers for MX and submission.
+// Both servers advertise PIPELINING and CHUNKING; BDAT chunks are streamed
+// into Session.Data exactly like a DATA body. SMTPUTF8 is advertised so
+// internationalized addresses can be used in MAIL FROM and RCPT TO.
 func NewServer(backend *Backend, cfg *config.Config, tlsConfig *tls.Config) *Server {
 	// MX server (port 25) - for receiving mail from other servers
 	mxServer := smtp.NewServer(backend)
@@ -31,15 +36,15 @@ func NewServer(backend *Backend, cfg *config.Config, tlsConfig *tls.Config) *Ser
 	mxServer.MaxMessageBytes = int64(cfg.Security.MaxMessageSize)
 	mxServer.MaxRecipients = 100
 	mxServer.AllowInsecureAuth = false // No auth on port 25
+	mxServer.EnableSMTPUTF8 = true
+	mxServer.EnableDSN = true
 
-	// Submission server (port 587/465) - for sending mail from clients
-	submissionServer := smtp.NewServer(&submissionBackend{Backend: backend})
-	submissionServer.Domain = cfg.Server.Hostname
-	submissionServer.ReadTimeout = 60 * time.Second
-	submissionServer.WriteTimeout = 60 * time.Second
-	submissionServer.MaxMessageBytes = int64(cfg.Security.MaxMessageSize)
-	submissionServer.MaxRecipients = 100
-	submissionServer.AllowInsecureAuth = !cfg.Security.RequireTLS
+	// Submission server (port 587) - for sending mail from clients
+	submissionServer := newSubmissionServer(backend, cfg)
+
+	// SMTPS server (port 465); the listener terminates TLS, so there is no
+	// STARTTLS to offer
+	smtpsServer := newSubmissionServer(backend, cfg)
 
 	if tlsConfig != nil {
 		submissionServer.TLSConfig = tlsConfig
@@ -49,22 +54,37 @@ func NewServer(backend *Backend, cfg *config.Config, tlsConfig *tls.Config) *Ser
 	return &Server{
 		mxServer:         mxServer,
 		submissionServer: submissionServer,
+		smtpsServer:      smtpsServer,
+		tlsConfig:        tlsConfig,
 		config:           cfg,
 	}
 }
 
+// newSubmissionServer returns a server for mail from clients
+func newSubmissionServer(backend *Backend, cfg *config.Config) *smtp.Server {
+	srv := smtp.NewServer(&submissionBackend{Backend: backend})
+	srv.Domain = cfg.Server.Hostname
+	srv.ReadTimeout = 60 * time.Second
+	srv.WriteTimeout = 60 * time.Second
+	srv.MaxMessageBytes = int64(cfg.Security.MaxMessageSize)
+	srv.MaxRecipients = 100
+	srv.AllowInsecureAuth = true // Session gates AUTH on TLS with a 538 reply
+	srv.EnableSMTPUTF8 = true
+	srv.EnableDSN = true
+	return srv
+}
+
 // submissionBackend wraps Backend to mark sessions as submission
 type submissionBackend struct {
 	*Backend
 }
 
 func (b *submissionBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
-	session, err := b.Backend.NewSession(c)
+	s, err := b.Backend.newSession(c, true)
 	if err != nil {
 		return nil, err
 	}
-	session.(*Session).isSubmission = true
-	return session, nil
+	return s.smtpSession(), nil
 }
 
 // ListenAndServe starts the MX server
@@ -75,6 +95,7 @@ func (s *Server) ListenAndServe() error {
 	if err != nil {
 		return fmt.Errorf("failed to listen on %s: %w", addr, err)
 	}
+	listener = newBannerListener(listener, s.config.Server.Hostname, s.config.Security.SMTPBanner)
 	s.mxListener = listener
 
 	log.Printf("SMTP MX server listening on %s", addr)
@@ -96,6 +117,7 @@ func (s *Server) ListenAndServeSubmission() error {
 	if err != nil {
 		return fmt.Errorf("failed to listen on %s: %w", addr, err)
 	}
+	listener = newBannerListener(listener, s.config.Server.Hostname, s.config.Security.SMTPBanner)
 	s.subListener = listener
 
 	log.Printf("SMTP Submission server listening on %s", addr)
@@ -111,22 +133,23 @@ func (s *Server) ListenAndServeSubmission() error {
 
 // ListenAndServeTLS starts the SMTPS server (implicit TLS)
 func (s *Server) ListenAndServeTLS() error {
-	if s.submissionServer.TLSConfig == nil {
+	if s.tlsConfig == nil {
 		return nil // No TLS configured
 	}
 
 	addr := fmt.Sprintf(":%d", s.config.Server.SMTPSPort)
 
-	listener, err := tls.Listen("tcp", addr, s.submissionServer.TLSConfig)
+	listener, err := net.Listen("tcp", addr)
 	if err != nil {
 		return fmt.Errorf("failed to listen on %s: %w", addr, err)
 	}
+	listener = newBannerListener(newImplicitTLSListener(listener, s.tlsConfig), s.config.Server.Hostname, s.config.Security.SMTPBanner)
 	s.tlsListener = listener
 
 	log.Printf("SMTPS server listening on %s", addr)
 
 	go func() {
-		if err := s.submissionServer.Serve(listener); err != nil {
+		if err := s.smtpsServer.Serve(listener); err != nil {
 			log.Printf("SMTPS server error: %v", err)
 		}
 	}()
@@ -134,6 +157,48 @@ func (s *Server) ListenAndServeTLS() error {
 	return nil
 }
 
+// implicitTLSListener terminates TLS itself rather than leaving it to
+// go-smtp, so the greeting can be rewritten like on the cleartext ports
+type implicitTLSListener struct {
+	net.Listener
+	config *tls.Config
+}
+
+func newImplicitTLSListener(l net.Listener, config *tls.Config) net.Listener {
+	return &implicitTLSListener{Listener: l, config: config}
+}
+
+func (l *implicitTLSListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	// The handshake runs on the first write, the greeting; a client that
+	// stalls in it is dropped
+	c.SetDeadline(time.Now().Add(60 * time.Second))
+	return tls.Server(c, l.config), nil
+}
+
+// connTLSState returns the TLS state of a connection, whether go-smtp ran
+// STARTTLS on it or it came through an implicitTLSListener
+func connTLSState(c *smtp.Conn) (tls.ConnectionState, bool) {
+	if state, ok := c.TLSConnectionState(); ok {
+		return state, true
+	}
+	nc := c.Conn()
+	for nc != nil {
+		switch conn := nc.(type) {
+		case *tls.Conn:
+			return conn.ConnectionState(), true
+		case interface{ Unwrap() net.Conn }:
+			nc = conn.Unwrap()
+		default:
+			nc = nil
+		}
+	}
+	return tls.ConnectionState{}, false
+}
+
 // Close stops all servers
 func (s *Server) Close() error {
 	if s.mxListener != nil {
@@ -151,5 +216,8 @@ func (s *Server) Close() error {
 	if s.submissionServer != nil {
 		s.submissionServer.Close()
 	}
+	if s.smtpsServer != nil {
+		s.smtpsServer.Close()
+	}
 	return nil
 }
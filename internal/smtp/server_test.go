@@ -0,0 +1,1139 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/fenilsonani/email-server/internal/auth"
+	"github.com/fenilsonani/email-server/internal/config"
+	"github.com/fenilsonani/email-server/internal/logging"
+	"github.com/fenilsonani/email-server/internal/queue"
+	"github.com/fenilsonani/email-server/internal/sieve"
+	"github.com/fenilsonani/email-server/internal/smtp/delivery"
+	"github.com/fenilsonani/email-server/internal/storage"
+	"github.com/fenilsonani/email-server/internal/storage/maildir"
+	"github.com/fenilsonani/email-server/internal/storage/metadata"
+)
+
+// testEnv is a backend wired to a real database and maildir store
+type testEnv struct {
+	backend *Backend
+	auth    *auth.Authenticator
+	store   *maildir.Store
+	db      *metadata.DB
+}
+
+func setupTestBackend(t *testing.T) *testEnv {
+	t.Helper()
+	dir := t.TempDir()
+
+	db, err := metadata.Open(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := db.Migrate(context.Background()); err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+
+	cfg := config.DefaultConfig()
+	cfg.Server.Hostname = "mx.example.com"
+	cfg.Server.Domain = "example.com"
+	cfg.Storage.DataDir = dir
+	cfg.Storage.MaildirPath = filepath.Join(dir, "maildir")
+	cfg.Security.MaxMessageSize = 64 * 1024
+
+	authenticator := auth.NewAuthenticator(db.DB)
+	store, err := maildir.NewStore(db.DB, cfg.Storage.MaildirPath)
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+
+	backend, err := NewBackend(cfg, authenticator, store, nil, logging.Default())
+	if err != nil {
+		t.Fatalf("NewBackend() error = %v", err)
+	}
+
+	return &testEnv{backend: backend, auth: authenticator, store: store, db: db}
+}
+
+// addUser creates a user with default mailboxes in the given domain
+func (e *testEnv) addUser(t *testing.T, username, domain string) *auth.User {
+	t.Helper()
+	ctx := context.Background()
+
+	var domainID int64
+	err := e.db.QueryRowContext(ctx, "SELECT id FROM domains WHERE name = ?", domain).Scan(&domainID)
+	if err != nil {
+		res, err := e.db.ExecContext(ctx, "INSERT INTO domains (name) VALUES (?)", domain)
+		if err != nil {
+			t.Fatalf("Failed to insert domain: %v", err)
+		}
+		domainID, _ = res.LastInsertId()
+	}
+
+	user, err := e.auth.CreateUser(ctx, username, "password123", domainID)
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	if err := e.store.InitializeUserMailboxes(ctx, user.ID); err != nil {
+		t.Fatalf("InitializeUserMailboxes() error = %v", err)
+	}
+	return user
+}
+
+// inboxMessages returns the raw bodies of every message in a user's INBOX
+func (e *testEnv) inboxMessages(t *testing.T, userID int64) []string {
+	t.Helper()
+	ctx := context.Background()
+
+	mb, err := e.store.GetMailbox(ctx, userID, "INBOX")
+	if err != nil {
+		t.Fatalf("GetMailbox() error = %v", err)
+	}
+	msgs, err := e.store.ListMessages(ctx, mb.ID, 0, 0)
+	if err != nil {
+		t.Fatalf("ListMessages() error = %v", err)
+	}
+
+	var bodies []string
+	for _, msg := range msgs {
+		rc, err := e.store.GetMessageBody(ctx, msg)
+		if err != nil {
+			t.Fatalf("GetMessageBody() error = %v", err)
+		}
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		bodies = append(bodies, string(data))
+	}
+	return bodies
+}
+
+// startTestServer serves the backend's MX side on a loopback listener
+func startTestServer(t *testing.T, backend *Backend) string {
+	t.Helper()
+
+	srv := smtp.NewServer(backend)
+	srv.Domain = backend.config.Server.Hostname
+	srv.MaxMessageBytes = int64(backend.config.Security.MaxMessageSize)
+	srv.AllowInsecureAuth = true
+	srv.EnableSMTPUTF8 = true
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+
+	return ln.Addr().String()
+}
+
+// rawClient speaks SMTP line by line so tests can exercise BDAT and pipelining
+type rawClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialRaw(t *testing.T, addr string) *rawClient {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	t.Cleanup(func() { conn.Close() })
+
+	c := &rawClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+	c.expect(220)
+	return c
+}
+
+func (c *rawClient) send(format string, args ...any) {
+	c.t.Helper()
+	if _, err := fmt.Fprintf(c.conn, format, args...); err != nil {
+		c.t.Fatalf("write error: %v", err)
+	}
+}
+
+// reply reads a (possibly multi-line) reply and returns its code and text
+func (c *rawClient) reply() (int, string) {
+	c.t.Helper()
+	var lines []string
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			c.t.Fatalf("read error: %v", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		lines = append(lines, line)
+		if len(line) < 4 || line[3] != '-' {
+			var code int
+			fmt.Sscanf(line, "%d", &code)
+			return code, strings.Join(lines, "\n")
+		}
+	}
+}
+
+func (c *rawClient) expect(code int) string {
+	c.t.Helper()
+	got, text := c.reply()
+	if got != code {
+		c.t.Fatalf("reply = %q, want code %d", text, code)
+	}
+	return text
+}
+
+func TestEHLOAdvertisesExtensions(t *testing.T) {
+	env := setupTestBackend(t)
+	c := dialRaw(t, startTestServer(t, env.backend))
+
+	c.send("EHLO client.example.net\r\n")
+	caps := c.expect(250)
+
+	for _, ext := range []string{"PIPELINING", "CHUNKING", "SMTPUTF8"} {
+		if !strings.Contains(caps, ext) {
+			t.Errorf("EHLO response missing %s:\n%s", ext, caps)
+		}
+	}
+}
+
+func TestBDATMultiChunkAssembles(t *testing.T) {
+	env := setupTestBackend(t)
+	user := env.addUser(t, "alice", "example.com")
+	c := dialRaw(t, startTestServer(t, env.backend))
+
+	chunks := []string{
+		"From: bob@example.net\r\nTo: alice@example.com\r\n",
+		"Subject: chunked\r\n\r\n",
+		"Hello in three chunks.\r\n",
+	}
+
+	c.send("EHLO client.example.net\r\n")
+	c.expect(250)
+	c.send("MAIL FROM:<bob@example.net>\r\n")
+	c.expect(250)
+	c.send("RCPT TO:<alice@example.com>\r\n")
+	c.expect(250)
+
+	for i, chunk := range chunks {
+		if i == len(chunks)-1 {
+			c.send("BDAT %d LAST\r\n%s", len(chunk), chunk)
+		} else {
+			c.send("BDAT %d\r\n%s", len(chunk), chunk)
+		}
+		c.expect(250)
+	}
+
+	bodies := env.inboxMessages(t, user.ID)
+	if len(bodies) != 1 {
+		t.Fatalf("INBOX has %d messages, want 1", len(bodies))
+	}
+	if !strings.HasSuffix(bodies[0], strings.Join(chunks, "")) {
+		t.Errorf("assembled message = %q, want it to end with %q", bodies[0], strings.Join(chunks, ""))
+	}
+}
+
+func TestBDATLastCompletesTransaction(t *testing.T) {
+	env := setupTestBackend(t)
+	user := env.addUser(t, "alice", "example.com")
+	c := dialRaw(t, startTestServer(t, env.backend))
+
+	c.send("EHLO client.example.net\r\n")
+	c.expect(250)
+
+	// Pipeline the whole first transaction
+	msg := "Subject: one\r\n\r\nfirst\r\n"
+	c.send("MAIL FROM:<bob@example.net>\r\nRCPT TO:<alice@example.com>\r\nBDAT %d LAST\r\n%s", len(msg), msg)
+	c.expect(250)
+	c.expect(250)
+	c.expect(250)
+
+	// BDAT LAST ends the transaction, so a new one can start straight away
+	msg = "Subject: two\r\n\r\nsecond\r\n"
+	c.send("MAIL FROM:<bob@example.net>\r\n")
+	c.expect(250)
+	c.send("RCPT TO:<alice@example.com>\r\n")
+	c.expect(250)
+	c.send("DATA\r\n")
+	c.expect(354)
+	c.send("%s.\r\n", msg)
+	c.expect(250)
+
+	if got := len(env.inboxMessages(t, user.ID)); got != 2 {
+		t.Errorf("INBOX has %d messages, want 2", got)
+	}
+}
+
+func TestDataRejectsOversizedMessage(t *testing.T) {
+	env := setupTestBackend(t)
+	env.addUser(t, "alice", "example.com")
+
+	session := &Session{backend: env.backend, ctx: context.Background(), rcpts: []string{"alice@example.com"}}
+	big := strings.Repeat("x", env.backend.config.Security.MaxMessageSize+1)
+
+	err := session.Data(strings.NewReader(big))
+	smtpErr, ok := err.(*smtp.SMTPError)
+	if !ok || smtpErr.Code != 552 {
+		t.Fatalf("Data() error = %v, want 552", err)
+	}
+
+	// The spool file must not be left behind
+	matches, _ := filepath.Glob(filepath.Join(env.backend.queuePath, "spool-*"))
+	if len(matches) != 0 {
+		t.Errorf("spool files left behind: %v", matches)
+	}
+}
+
+func TestSMTPUTF8RecipientRoutesToUser(t *testing.T) {
+	env := setupTestBackend(t)
+	// Domains are stored as A-labels; exämple.de is xn--exmple-cua.de
+	user := env.addUser(t, "müller", "xn--exmple-cua.de")
+	c := dialRaw(t, startTestServer(t, env.backend))
+
+	c.send("EHLO client.example.net\r\n")
+	c.expect(250)
+
+	// U-label domain, mixed case and a decomposed ü all resolve to the same user
+	for _, rcpt := range []string{"Müller@exämple.de", "mu\u0308ller@xn--exmple-cua.de"} {
+		msg := "From: Jörg <jörg@example.net>\r\nTo: Müller <" + rcpt + ">\r\nSubject: Grüße\r\n\r\nHallo\r\n"
+		c.send("MAIL FROM:<jörg@example.net> SMTPUTF8\r\n")
+		c.expect(250)
+		c.send("RCPT TO:<%s>\r\n", rcpt)
+		c.expect(250)
+		c.send("DATA\r\n")
+		c.expect(354)
+		c.send("%s.\r\n", msg)
+		c.expect(250)
+	}
+
+	bodies := env.inboxMessages(t, user.ID)
+	if len(bodies) != 2 {
+		t.Fatalf("INBOX has %d messages, want 2", len(bodies))
+	}
+	if !strings.Contains(bodies[0], "From: Jörg <jörg@example.net>") || !strings.Contains(bodies[0], "Subject: Grüße") {
+		t.Errorf("stored message lost UTF-8 headers:\n%s", bodies[0])
+	}
+}
+
+func TestNonASCIIAddressRequiresSMTPUTF8(t *testing.T) {
+	env := setupTestBackend(t)
+	env.addUser(t, "müller", "xn--exmple-cua.de")
+	c := dialRaw(t, startTestServer(t, env.backend))
+
+	c.send("EHLO client.example.net\r\n")
+	c.expect(250)
+
+	c.send("MAIL FROM:<jörg@example.net>\r\n")
+	c.expect(553)
+
+	c.send("MAIL FROM:<bob@example.net>\r\n")
+	c.expect(250)
+	c.send("RCPT TO:<müller@exämple.de>\r\n")
+	c.expect(553)
+}
+
+func TestReceivedHeaderStamped(t *testing.T) {
+	env := setupTestBackend(t)
+	user := env.addUser(t, "alice", "example.com")
+	c := dialRaw(t, startTestServer(t, env.backend))
+
+	c.send("EHLO client.example.net\r\n")
+	c.expect(250)
+	c.send("MAIL FROM:<bob@example.net>\r\n")
+	c.expect(250)
+	c.send("RCPT TO:<alice@example.com>\r\n")
+	c.expect(250)
+	c.send("DATA\r\n")
+	c.expect(354)
+	c.send("Subject: traced\r\n\r\nhello\r\n.\r\n")
+	c.expect(250)
+
+	bodies := env.inboxMessages(t, user.ID)
+	if len(bodies) != 1 {
+		t.Fatalf("INBOX has %d messages, want 1", len(bodies))
+	}
+	if !strings.HasPrefix(bodies[0], "Received: from client.example.net ([127.0.0.1])\r\n\tby mx.example.com with ESMTP\r\n\tid ") {
+		t.Errorf("message does not start with our Received header:\n%s", bodies[0])
+	}
+	header, _, _ := strings.Cut(bodies[0], "\r\nSubject:")
+	if !strings.Contains(header, "\tfor <alice@example.com>; ") {
+		t.Errorf("Received header missing recipient clause:\n%s", header)
+	}
+	if _, err := mail.ParseDate(header[strings.LastIndex(header, "; ")+2:]); err != nil {
+		t.Errorf("Received header date is not RFC 5322: %v", err)
+	}
+}
+
+func TestTooManyReceivedHeadersRejected(t *testing.T) {
+	env := setupTestBackend(t)
+	user := env.addUser(t, "alice", "example.com")
+	c := dialRaw(t, startTestServer(t, env.backend))
+
+	// Our own header makes this one hop over the limit
+	hops := strings.Repeat("Received: from a.example by b.example; Mon, 2 Jan 2006 15:04:05 -0700\r\n", env.backend.config.Security.MaxReceivedHeaders)
+
+	c.send("EHLO client.example.net\r\n")
+	c.expect(250)
+	c.send("MAIL FROM:<bob@example.net>\r\n")
+	c.expect(250)
+	c.send("RCPT TO:<alice@example.com>\r\n")
+	c.expect(250)
+	c.send("DATA\r\n")
+	c.expect(354)
+	c.send("%sSubject: loop\r\n\r\nhello\r\n.\r\n", hops)
+	c.expect(554)
+
+	if got := len(env.inboxMessages(t, user.ID)); got != 0 {
+		t.Errorf("INBOX has %d messages, want 0", got)
+	}
+}
+
+func TestAutoSubmittedSuppressesVacation(t *testing.T) {
+	env := setupTestBackend(t)
+	user := env.addUser(t, "alice", "example.com")
+	ctx := context.Background()
+
+	store := sieve.NewStore(env.db.DB)
+	if _, err := store.CreateScript(ctx, user.ID, "away", `require ["vacation"]; if true { vacation :days 7 "I'm away"; }`); err != nil {
+		t.Fatalf("CreateScript() error = %v", err)
+	}
+	if err := store.SetActiveScript(ctx, user.ID, "away"); err != nil {
+		t.Fatalf("SetActiveScript() error = %v", err)
+	}
+	env.backend.SetSieveExecutor(sieve.NewExecutor(env.db.DB))
+
+	c := dialRaw(t, startTestServer(t, env.backend))
+	c.send("EHLO client.example.net\r\n")
+	c.expect(250)
+	c.send("MAIL FROM:<bob@example.net>\r\n")
+	c.expect(250)
+	c.send("RCPT TO:<alice@example.com>\r\n")
+	c.expect(250)
+	c.send("DATA\r\n")
+	c.expect(354)
+	c.send("From: bob@example.net\r\nAuto-Submitted: auto-replied\r\nSubject: Out of office\r\n\r\nI'm away too\r\n.\r\n")
+	c.expect(250)
+
+	if got := len(env.inboxMessages(t, user.ID)); got != 1 {
+		t.Fatalf("INBOX has %d messages, want 1", got)
+	}
+
+	var responses int
+	if err := env.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM vacation_responses").Scan(&responses); err != nil {
+		t.Fatalf("count vacation responses: %v", err)
+	}
+	if responses != 0 {
+		t.Errorf("vacation responded %d times to an Auto-Submitted message", responses)
+	}
+}
+
+func TestSuppressAutoReply(t *testing.T) {
+	tests := []struct {
+		name     string
+		from     string
+		headers  map[string][]string
+		suppress bool
+	}{
+		{"ordinary message", "bob@example.net", nil, false},
+		{"null sender", "", nil, true},
+		{"mailer-daemon", "MAILER-DAEMON@example.net", nil, true},
+		{"bare mailer-daemon", "MAILER-DAEMON", nil, true},
+		{"auto-replied", "bob@example.net", map[string][]string{"Auto-Submitted": {"auto-replied"}}, true},
+		{"auto-generated with params", "bob@example.net", map[string][]string{"Auto-Submitted": {"auto-generated; owner-email=x@example.net"}}, true},
+		{"explicit no", "bob@example.net", map[string][]string{"Auto-Submitted": {"no"}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := suppressAutoReply(tt.from, &sieve.Message{Headers: tt.headers}); got != tt.suppress {
+				t.Errorf("suppressAutoReply() = %v, want %v", got, tt.suppress)
+			}
+		})
+	}
+}
+
+func TestBounceToMailerDaemonDropped(t *testing.T) {
+	env := setupTestBackend(t)
+	daemon := env.addUser(t, "mailer-daemon", "example.com")
+	c := dialRaw(t, startTestServer(t, env.backend))
+
+	c.send("EHLO client.example.net\r\n")
+	c.expect(250)
+	c.send("MAIL FROM:<>\r\n")
+	c.expect(250)
+	c.send("RCPT TO:<MAILER-DAEMON@example.com>\r\n")
+	c.expect(250)
+	c.send("DATA\r\n")
+	c.expect(354)
+	c.send("Subject: Undelivered Mail Returned to Sender\r\n\r\nbounce\r\n.\r\n")
+	c.expect(250)
+
+	if got := len(env.inboxMessages(t, daemon.ID)); got != 0 {
+		t.Errorf("MAILER-DAEMON INBOX has %d messages, want the bounce dropped", got)
+	}
+}
+
+func TestBounceToVERPAddressMatched(t *testing.T) {
+	env := setupTestBackend(t)
+	news := env.addUser(t, "news", "example.com")
+	env.backend.config.Delivery.VERP = true
+	sentLog := delivery.NewSentLog(env.db.DB)
+	env.backend.SetSentLog(sentLog)
+
+	ctx := context.Background()
+	returnPath := delivery.EncodeVERP("news@example.com", "bob@example.org")
+	if err := sentLog.Record(ctx, &delivery.SentEmail{
+		MessageID: "q1", Sender: "news@example.com", Recipient: "bob@example.org",
+		ReturnPath: returnPath, OriginalMessageID: "1@example.com",
+	}); err != nil {
+		t.Fatalf("Record() error = %v", err)
+	}
+	addr := startTestServer(t, env.backend)
+
+	// A bounce that doesn't return the message matches nothing
+	sendBounce(t, addr, returnPath,
+		"Subject: Undelivered Mail Returned to Sender\r\n\r\n"+
+			"Status: 5.1.1\r\nDiagnostic-Code: smtp; 550 5.1.1 No such user")
+	if reasons := env.bounceReasons(t); len(reasons) != 0 {
+		t.Errorf("bounced sent emails = %q, want none", reasons)
+	}
+
+	sendBounce(t, addr, returnPath,
+		"Subject: Undelivered Mail Returned to Sender\r\n\r\n"+
+			"Status: 5.1.1\r\nDiagnostic-Code: smtp; 550 5.1.1 No such user\r\n\r\n"+
+			"Message-ID: <1@example.com>\r\nSubject: News\r\n")
+
+	if got := len(env.inboxMessages(t, news.ID)); got != 2 {
+		t.Errorf("news INBOX has %d messages, want both bounces", got)
+	}
+	var reason string
+	if err := env.db.QueryRowContext(ctx,
+		"SELECT bounce_reason FROM sent_emails WHERE message_id = 'q1' AND bounced_at IS NOT NULL",
+	).Scan(&reason); err != nil {
+		t.Fatalf("sent email not marked bounced: %v", err)
+	}
+	if reason != "550 5.1.1 No such user" {
+		t.Errorf("bounce_reason = %q", reason)
+	}
+}
+
+// testDSN is a bounce from example.org reporting that delivery to bob of
+// the message 1@example.com failed
+const testDSN = "Subject: Undelivered Mail Returned to Sender\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/report; report-type=delivery-status; boundary=\"b1\"\r\n" +
+	"\r\n" +
+	"--b1\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Your message could not be delivered.\r\n" +
+	"--b1\r\n" +
+	"Content-Type: message/delivery-status\r\n" +
+	"\r\n" +
+	"Reporting-MTA: dns; mx.example.org\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; bob@example.org\r\n" +
+	"Action: failed\r\n" +
+	"Status: 5.1.1\r\n" +
+	"Diagnostic-Code: smtp; 550 5.1.1 <bob@example.org>: Recipient address rejected\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; carol@example.org\r\n" +
+	"Action: delayed\r\n" +
+	"Status: 4.4.1\r\n" +
+	"\r\n" +
+	"--b1\r\n" +
+	"Content-Type: text/rfc822-headers\r\n" +
+	"\r\n" +
+	"Message-ID: <1@example.com>\r\n" +
+	"From: news@example.com\r\n" +
+	"Subject: News\r\n" +
+	"\r\n" +
+	"--b1--\r\n"
+
+// sendBounce sends data from the null sender to rcpt
+func sendBounce(t *testing.T, addr, rcpt, data string) {
+	t.Helper()
+	c := dialRaw(t, addr)
+	c.send("EHLO mx.example.org\r\n")
+	c.expect(250)
+	c.send("MAIL FROM:<>\r\n")
+	c.expect(250)
+	c.send("RCPT TO:<%s>\r\n", rcpt)
+	c.expect(250)
+	c.send("DATA\r\n")
+	c.expect(354)
+	c.send("%s\r\n.\r\n", data)
+	c.expect(250)
+}
+
+// bounceReasons returns the bounce reason of each bounced sent email by
+// recipient
+func (e *testEnv) bounceReasons(t *testing.T) map[string]string {
+	t.Helper()
+	rows, err := e.db.QueryContext(context.Background(),
+		"SELECT recipient, bounce_reason FROM sent_emails WHERE bounced_at IS NOT NULL")
+	if err != nil {
+		t.Fatalf("Failed to query sent emails: %v", err)
+	}
+	defer rows.Close()
+	reasons := make(map[string]string)
+	for rows.Next() {
+		var rcpt, reason string
+		if err := rows.Scan(&rcpt, &reason); err != nil {
+			t.Fatalf("Failed to scan sent email: %v", err)
+		}
+		reasons[rcpt] = reason
+	}
+	return reasons
+}
+
+// sinkBackend is a remote server that accepts and discards all mail
+type sinkBackend struct{}
+
+func (sinkBackend) NewSession(*smtp.Conn) (smtp.Session, error) { return sinkSession{}, nil }
+
+type sinkSession struct{}
+
+func (sinkSession) Reset()                               {}
+func (sinkSession) Logout() error                        { return nil }
+func (sinkSession) Mail(string, *smtp.MailOptions) error { return nil }
+func (sinkSession) Rcpt(string, *smtp.RcptOptions) error { return nil }
+func (sinkSession) Data(r io.Reader) error               { _, err := io.Copy(io.Discard, r); return err }
+
+// sendOut delivers a message with Message-ID 1@example.com from sender to
+// rcpts through a delivery engine without VERP, recording the sends in
+// sentLog
+func sendOut(t *testing.T, sentLog *delivery.SentLog, sender string, rcpts []string) {
+	t.Helper()
+	relay := smtp.NewServer(sinkBackend{})
+	relay.Domain = "mx.example.org"
+	relayAddr := serveTestServer(t, relay)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "msg.eml")
+	if err := os.WriteFile(path, []byte("Message-ID: <1@example.com>\r\nFrom: "+sender+"\r\nSubject: News\r\n\r\nHello\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := delivery.DefaultConfig()
+	cfg.Workers = 1
+	cfg.Hostname = "mx.example.com"
+	cfg.QueuePath = dir
+	cfg.RelayHost = relayAddr
+	cfg.ConnectTimeout = 5 * time.Second
+	cfg.CommandTimeout = 5 * time.Second
+	q := queue.NewMemoryQueue(queue.DefaultConfig())
+	defer q.Close()
+	e := delivery.NewEngine(cfg, q, nil, logging.Default())
+	e.SetSentLog(sentLog)
+	if err := e.Enqueue(context.Background(), sender, rcpts, path); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+
+	e.Start()
+	defer e.Stop(context.Background())
+	deadline := time.Now().Add(5 * time.Second)
+	for e.Stats().TotalSent == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("message not delivered, queue stats %+v", e.Stats().QueueStats)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestDSNMarksSentEmailBounced(t *testing.T) {
+	env := setupTestBackend(t)
+	news := env.addUser(t, "news", "example.com")
+	sentLog := delivery.NewSentLog(env.db.DB)
+	env.backend.SetSentLog(sentLog)
+
+	sendOut(t, sentLog, "news@example.com", []string{"bob@example.org", "carol@example.org", "dave@example.org"})
+
+	sendBounce(t, startTestServer(t, env.backend), "news@example.com", testDSN)
+
+	reasons := env.bounceReasons(t)
+	want := map[string]string{"bob@example.org": "550 5.1.1 <bob@example.org>: Recipient address rejected"}
+	if len(reasons) != 1 || reasons["bob@example.org"] != want["bob@example.org"] {
+		t.Errorf("bounced sent emails = %q, want %q", reasons, want)
+	}
+	if got := len(env.inboxMessages(t, news.ID)); got != 1 {
+		t.Errorf("news INBOX has %d messages, want the bounce", got)
+	}
+}
+
+func TestDSNFiledToBounceMailbox(t *testing.T) {
+	env := setupTestBackend(t)
+	news := env.addUser(t, "news", "example.com")
+	bounces := env.addUser(t, "bounces", "example.com")
+	env.backend.config.Delivery.BounceMailbox = "bounces@example.com"
+	sentLog := delivery.NewSentLog(env.db.DB)
+	env.backend.SetSentLog(sentLog)
+	addr := startTestServer(t, env.backend)
+
+	// A DSN matching nothing we sent reaches its recipient
+	sendBounce(t, addr, "news@example.com", testDSN)
+	if got := len(env.inboxMessages(t, news.ID)); got != 1 {
+		t.Errorf("news INBOX has %d messages, want the unmatched DSN", got)
+	}
+
+	sendOut(t, sentLog, "news@example.com", []string{"bob@example.org"})
+	sendBounce(t, addr, "news@example.com", testDSN)
+	if got := len(env.inboxMessages(t, bounces.ID)); got != 1 {
+		t.Errorf("bounces INBOX has %d messages, want the DSN", got)
+	}
+	if got := len(env.inboxMessages(t, news.ID)); got != 1 {
+		t.Errorf("news INBOX has %d messages, want only the unmatched DSN", got)
+	}
+
+	// Other mail from the null sender still reaches its recipient
+	sendBounce(t, addr, "news@example.com", "Subject: Out of office\r\n\r\naway")
+	if got := len(env.inboxMessages(t, news.ID)); got != 2 {
+		t.Errorf("news INBOX has %d messages, want the auto-reply", got)
+	}
+}
+
+func TestPostmasterRoutesToRoleDestination(t *testing.T) {
+	env := setupTestBackend(t)
+	admin := env.addUser(t, "admin", "example.com")
+	env.auth.SetRoleRoutes(auth.RoleRoutes{
+		Default: map[string]string{auth.RolePostmaster: "admin@example.com"},
+	})
+	c := dialRaw(t, startTestServer(t, env.backend))
+
+	c.send("EHLO client.example.net\r\n")
+	c.expect(250)
+	c.send("MAIL FROM:<reporter@example.net>\r\n")
+	c.expect(250)
+	c.send("RCPT TO:<PostMaster@example.com>\r\n")
+	c.expect(250)
+	c.send("DATA\r\n")
+	c.expect(354)
+	c.send("Subject: Your server\r\n\r\nhello postmaster\r\n.\r\n")
+	c.expect(250)
+
+	bodies := env.inboxMessages(t, admin.ID)
+	if len(bodies) != 1 || !strings.Contains(bodies[0], "hello postmaster") {
+		t.Fatalf("admin INBOX = %q, want the postmaster message", bodies)
+	}
+
+	// abuse@ has no destination here, so it is still unknown
+	c.send("MAIL FROM:<reporter@example.net>\r\n")
+	c.expect(250)
+	c.send("RCPT TO:<abuse@example.com>\r\n")
+	c.expect(550)
+}
+
+func TestSendDisabledUserSubmissionRefused(t *testing.T) {
+	env := setupTestBackend(t)
+	user := env.addUser(t, "shared", "example.com")
+	if err := env.auth.SetPermissions(context.Background(), user.ID, false, true); err != nil {
+		t.Fatalf("SetPermissions() error = %v", err)
+	}
+
+	// Authentication still works, so the user can read mail over IMAP
+	if _, err := env.auth.Authenticate(context.Background(), "shared@example.com", "password123"); err != nil {
+		t.Fatalf("Authenticate() error = %v, want send-disabled users to log in", err)
+	}
+
+	session := &Session{backend: env.backend, isSubmission: true, ctx: context.Background()}
+	server, err := session.Auth("PLAIN")
+	if err != nil {
+		t.Fatalf("Auth() error = %v", err)
+	}
+	if _, _, err := server.Next([]byte("\x00shared@example.com\x00password123")); err != nil {
+		t.Fatalf("AUTH PLAIN error = %v", err)
+	}
+
+	err = session.Mail("shared@example.com", nil)
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 550 {
+		t.Fatalf("Mail() error = %v, want 550", err)
+	}
+}
+
+func TestReceiveDisabledUserRejectedAtRcpt(t *testing.T) {
+	env := setupTestBackend(t)
+	user := env.addUser(t, "suspended", "example.com")
+	if err := env.auth.SetPermissions(context.Background(), user.ID, true, false); err != nil {
+		t.Fatalf("SetPermissions() error = %v", err)
+	}
+	c := dialRaw(t, startTestServer(t, env.backend))
+
+	c.send("EHLO client.example.net\r\n")
+	c.expect(250)
+	c.send("MAIL FROM:<sender@example.net>\r\n")
+	c.expect(250)
+	c.send("RCPT TO:<suspended@example.com>\r\n")
+	if msg := c.expect(550); !strings.Contains(msg, "5.2.1") {
+		t.Errorf("RCPT reply = %q, want 5.2.1", msg)
+	}
+}
+
+// sentMessages returns the messages in a user's Sent mailbox
+func (e *testEnv) sentMessages(t *testing.T, userID int64) []*storage.Message {
+	t.Helper()
+	ctx := context.Background()
+
+	mb, err := e.store.GetMailbox(ctx, userID, "Sent")
+	if err != nil {
+		t.Fatalf("GetMailbox() error = %v", err)
+	}
+	msgs, err := e.store.ListMessages(ctx, mb.ID, 0, 0)
+	if err != nil {
+		t.Fatalf("ListMessages() error = %v", err)
+	}
+	return msgs
+}
+
+// submit sends msg from user to rcpt through an authenticated submission session
+func (e *testEnv) submit(t *testing.T, user *auth.User, rcpt, msg string) {
+	t.Helper()
+	session := &Session{backend: e.backend, user: user, isSubmission: true, ctx: context.Background()}
+	if err := session.Mail(user.Email, nil); err != nil {
+		t.Fatalf("Mail() error = %v", err)
+	}
+	if err := session.Rcpt(rcpt, nil); err != nil {
+		t.Fatalf("Rcpt() error = %v", err)
+	}
+	if err := session.Data(strings.NewReader(msg)); err != nil {
+		t.Fatalf("Data() error = %v", err)
+	}
+}
+
+func TestSubmissionSavesToSent(t *testing.T) {
+	env := setupTestBackend(t)
+	alice := env.addUser(t, "alice", "example.com")
+	env.addUser(t, "bob", "example.com")
+
+	env.submit(t, alice, "bob@example.com", "Message-ID: <one@example.com>\r\nSubject: hi\r\n\r\nhello\r\n")
+
+	sent := env.sentMessages(t, alice.ID)
+	if len(sent) != 1 {
+		t.Fatalf("Sent has %d messages, want 1", len(sent))
+	}
+	if sent[0].MessageID != "one@example.com" || !slices.Contains(sent[0].Flags, storage.FlagSeen) {
+		t.Errorf("Sent message = %+v, want one@example.com marked \\Seen", sent[0])
+	}
+}
+
+func TestSubmissionSkipsSentCopyAlreadyAppended(t *testing.T) {
+	env := setupTestBackend(t)
+	alice := env.addUser(t, "alice", "example.com")
+	env.addUser(t, "bob", "example.com")
+	ctx := context.Background()
+
+	// The client APPENDed its own copy before submitting
+	msg := "Message-ID: <two@example.com>\r\nSubject: hi\r\n\r\nhello\r\n"
+	mb, err := env.store.GetMailbox(ctx, alice.ID, "Sent")
+	if err != nil {
+		t.Fatalf("GetMailbox() error = %v", err)
+	}
+	if _, err := env.store.AppendMessage(ctx, mb.ID, []storage.Flag{storage.FlagSeen}, time.Now(), strings.NewReader(msg)); err != nil {
+		t.Fatalf("AppendMessage() error = %v", err)
+	}
+
+	env.submit(t, alice, "bob@example.com", msg)
+
+	if sent := env.sentMessages(t, alice.ID); len(sent) != 1 {
+		t.Errorf("Sent has %d messages, want the client's copy only", len(sent))
+	}
+}
+
+func TestSubmissionSaveToSentDisabled(t *testing.T) {
+	env := setupTestBackend(t)
+	env.backend.config.Submission.SaveToSent = false
+	alice := env.addUser(t, "alice", "example.com")
+	env.addUser(t, "bob", "example.com")
+
+	env.submit(t, alice, "bob@example.com", "Subject: hi\r\n\r\nhello\r\n")
+
+	if sent := env.sentMessages(t, alice.ID); len(sent) != 0 {
+		t.Errorf("Sent has %d messages, want none with save_to_sent off", len(sent))
+	}
+}
+
+func TestSubmissionAddsMissingMessageIDAndDate(t *testing.T) {
+	env := setupTestBackend(t)
+	alice := env.addUser(t, "alice", "example.com")
+	bob := env.addUser(t, "bob", "example.com")
+
+	env.submit(t, alice, "bob@example.com", "Subject: hi\r\n\r\nhello\r\n")
+
+	bodies := env.inboxMessages(t, bob.ID)
+	if len(bodies) != 1 {
+		t.Fatalf("bob INBOX has %d messages, want 1", len(bodies))
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(bodies[0]))
+	if err != nil {
+		t.Fatalf("ReadMessage() error = %v", err)
+	}
+	id := msg.Header.Get("Message-ID")
+	if !strings.HasPrefix(id, "<") || !strings.HasSuffix(id, "@example.com>") {
+		t.Errorf("Message-ID = %q, want <...@example.com>", id)
+	}
+	if _, err := msg.Header.Date(); err != nil {
+		t.Errorf("Date header = %q: %v", msg.Header.Get("Date"), err)
+	}
+	if !strings.HasPrefix(bodies[0], "Received: ") {
+		t.Errorf("message starts %q, want the Received header first", bodies[0][:20])
+	}
+}
+
+func TestSubmissionKeepsExistingMessageIDAndDate(t *testing.T) {
+	env := setupTestBackend(t)
+	alice := env.addUser(t, "alice", "example.com")
+	bob := env.addUser(t, "bob", "example.com")
+
+	env.submit(t, alice, "bob@example.com", "Message-ID: <mine@client.example>\r\n"+
+		"Date: Mon, 02 Jan 2006 15:04:05 -0700\r\nSubject: hi\r\n\r\nhello\r\n")
+
+	bodies := env.inboxMessages(t, bob.ID)
+	if len(bodies) != 1 {
+		t.Fatalf("bob INBOX has %d messages, want 1", len(bodies))
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(bodies[0]))
+	if err != nil {
+		t.Fatalf("ReadMessage() error = %v", err)
+	}
+	if ids := msg.Header["Message-Id"]; len(ids) != 1 || ids[0] != "<mine@client.example>" {
+		t.Errorf("Message-ID = %q, want only the client's", ids)
+	}
+	if dates := msg.Header["Date"]; len(dates) != 1 || dates[0] != "Mon, 02 Jan 2006 15:04:05 -0700" {
+		t.Errorf("Date = %q, want only the client's", dates)
+	}
+}
+
+func TestSubmissionHeaderCompletionDisabled(t *testing.T) {
+	env := setupTestBackend(t)
+	env.backend.config.Submission.AddMessageID = false
+	env.backend.config.Submission.AddDate = false
+	alice := env.addUser(t, "alice", "example.com")
+	bob := env.addUser(t, "bob", "example.com")
+
+	env.submit(t, alice, "bob@example.com", "Subject: hi\r\n\r\nhello\r\n")
+
+	bodies := env.inboxMessages(t, bob.ID)
+	if len(bodies) != 1 {
+		t.Fatalf("bob INBOX has %d messages, want 1", len(bodies))
+	}
+	if strings.Contains(bodies[0], "Message-ID:") || strings.Contains(bodies[0], "\r\nDate:") {
+		t.Errorf("message = %q, want no added headers", bodies[0])
+	}
+}
+
+func TestSubmissionHeadersStrippedBeforeSigning(t *testing.T) {
+	env := setupTestBackend(t)
+	q := env.withRelayQueue(t)
+	env.backend.config.SMTP.Headers.Submission = config.HeaderRewriteConfig{
+		Remove: []string{"X-Originating-IP", "x-mailer"},
+		Add:    []config.HeaderField{{Name: "X-Policy", Value: "outbound"}},
+	}
+	alice := env.addUser(t, "alice", "example.com")
+
+	env.submit(t, alice, "carol@example.org", "X-Originating-IP: [10.1.2.3]\r\n"+
+		"X-Mailer: Internal\r\n\tClient 1.0\r\n"+
+		"Subject: hi\r\n\r\nX-Mailer: stays in the body\r\n")
+
+	pending, _ := q.ListPending(context.Background(), 10)
+	if len(pending) != 1 {
+		t.Fatalf("queued %d messages, want 1", len(pending))
+	}
+	// The queued file is what the delivery engine signs
+	data, err := os.ReadFile(pending[0].MessagePath)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	msg := string(data)
+	if strings.Contains(msg, "10.1.2.3") || strings.Contains(msg, "Client 1.0") {
+		t.Errorf("queued message still has stripped headers:\n%s", msg)
+	}
+	if !strings.HasPrefix(msg, "Received: ") || !strings.Contains(msg, "\r\nX-Policy: outbound\r\n") {
+		t.Errorf("queued message = %q, want our Received header first and X-Policy added", msg)
+	}
+	if !strings.Contains(msg, "X-Mailer: stays in the body") {
+		t.Errorf("queued message body was rewritten:\n%s", msg)
+	}
+}
+
+func TestInboundHeadersAdded(t *testing.T) {
+	env := setupTestBackend(t)
+	env.backend.config.SMTP.Headers.Inbound = config.HeaderRewriteConfig{
+		Remove: []string{"X-Spam-Status"},
+		Add:    []config.HeaderField{{Name: "X-Scanned-By", Value: "mx.example.com"}},
+	}
+	bob := env.addUser(t, "bob", "example.com")
+
+	if code, text := sendMX(t, startTestServer(t, env.backend), "bob@example.com",
+		"X-Spam-Status: No, forged\r\nSubject: hi\r\n\r\nhello"); code != 250 {
+		t.Fatalf("DATA reply = %q", text)
+	}
+
+	bodies := env.inboxMessages(t, bob.ID)
+	if len(bodies) != 1 {
+		t.Fatalf("bob INBOX has %d messages, want 1", len(bodies))
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(bodies[0]))
+	if err != nil {
+		t.Fatalf("ReadMessage() error = %v", err)
+	}
+	if got := msg.Header.Get("X-Scanned-By"); got != "mx.example.com" {
+		t.Errorf("X-Scanned-By = %q, want mx.example.com", got)
+	}
+	if got := msg.Header.Get("X-Spam-Status"); got != "" {
+		t.Errorf("X-Spam-Status = %q, want it removed", got)
+	}
+	if !strings.HasPrefix(bodies[0], "Received: ") {
+		t.Errorf("message does not start with our Received header:\n%s", bodies[0])
+	}
+}
+
+// sendMX delivers msg from sender@example.net to rcpt over the MX side and
+// returns the reply code to the end of data
+func sendMX(t *testing.T, addr, rcpt, msg string) (int, string) {
+	t.Helper()
+	c := dialRaw(t, addr)
+	c.send("EHLO client.example.net\r\n")
+	c.expect(250)
+	c.send("MAIL FROM:<sender@example.net>\r\n")
+	c.expect(250)
+	c.send("RCPT TO:<%s>\r\n", rcpt)
+	c.expect(250)
+	c.send("DATA\r\n")
+	c.expect(354)
+	c.send("%s\r\n.\r\n", msg)
+	return c.reply()
+}
+
+func TestAliasDeliveryRecordsOriginalRecipient(t *testing.T) {
+	env := setupTestBackend(t)
+	bob := env.addUser(t, "bob", "example.com")
+	if _, err := env.db.ExecContext(context.Background(),
+		"INSERT INTO aliases (domain_id, source_address, destination_user_id) VALUES (?, 'sales', ?)",
+		bob.DomainID, bob.ID); err != nil {
+		t.Fatalf("Failed to insert alias: %v", err)
+	}
+	addr := startTestServer(t, env.backend)
+
+	if code, text := sendMX(t, addr, "sales@example.com", "Subject: order\r\n\r\nhello"); code != 250 {
+		t.Fatalf("DATA reply = %q", text)
+	}
+
+	bodies := env.inboxMessages(t, bob.ID)
+	if len(bodies) != 1 {
+		t.Fatalf("bob INBOX has %d messages, want 1", len(bodies))
+	}
+	if !strings.HasPrefix(bodies[0], "Received: ") {
+		t.Errorf("message does not start with our Received header:\n%s", bodies[0])
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(bodies[0]))
+	if err != nil {
+		t.Fatalf("ReadMessage() error = %v", err)
+	}
+	if got := msg.Header.Get("Delivered-To"); got != "bob@example.com" {
+		t.Errorf("Delivered-To = %q, want bob@example.com", got)
+	}
+	if got := msg.Header.Get("X-Original-To"); got != "sales@example.com" {
+		t.Errorf("X-Original-To = %q, want sales@example.com", got)
+	}
+}
+
+func TestRepeatedDeliveredToRejected(t *testing.T) {
+	env := setupTestBackend(t)
+	bob := env.addUser(t, "bob", "example.com")
+	addr := startTestServer(t, env.backend)
+
+	code, text := sendMX(t, addr, "bob@example.com", "Delivered-To: Bob@example.com\r\nSubject: again\r\n\r\nhello")
+	if code != 554 || !strings.Contains(text, "5.4.6") {
+		t.Errorf("DATA reply = %q, want 554 5.4.6", text)
+	}
+	if bodies := env.inboxMessages(t, bob.ID); len(bodies) != 0 {
+		t.Errorf("bob INBOX has %d messages, want the looping message refused", len(bodies))
+	}
+
+	// Another system's Delivered-To is not a loop
+	if code, text := sendMX(t, addr, "bob@example.com", "Delivered-To: bob@elsewhere.example\r\nSubject: fwd\r\n\r\nhello"); code != 250 {
+		t.Errorf("DATA reply = %q, want 250", text)
+	}
+}
+
+// activateScript installs script as the user's active Sieve script
+func (e *testEnv) activateScript(t *testing.T, userID int64, script string) {
+	t.Helper()
+	ctx := context.Background()
+	store := sieve.NewStore(e.db.DB)
+	if _, err := store.CreateScript(ctx, userID, "main", script); err != nil {
+		t.Fatalf("CreateScript() error = %v", err)
+	}
+	if err := store.SetActiveScript(ctx, userID, "main"); err != nil {
+		t.Fatalf("SetActiveScript() error = %v", err)
+	}
+	e.backend.SetSieveExecutor(sieve.NewExecutor(e.db.DB))
+}
+
+func TestSieveRedirectCopyKeepsLocalCopy(t *testing.T) {
+	env := setupTestBackend(t)
+	q := env.withRelayQueue(t)
+	alice := env.addUser(t, "alice", "example.com")
+	env.activateScript(t, alice.ID, `require ["copy"]; if true { redirect :copy "carol@example.org"; }`)
+	addr := startTestServer(t, env.backend)
+
+	if code, text := sendMX(t, addr, "alice@example.com", "Return-Path: <forged@example.net>\r\nSubject: hi\r\n\r\nhello"); code != 250 {
+		t.Fatalf("DATA reply = %q", text)
+	}
+
+	if got := len(env.inboxMessages(t, alice.ID)); got != 1 {
+		t.Errorf("INBOX has %d messages, want the local copy kept", got)
+	}
+	pending, _ := q.ListPending(context.Background(), 10)
+	if len(pending) != 1 || pending[0].Sender != "sender@example.net" || !slices.Equal(pending[0].Recipients, []string{"carol@example.org"}) {
+		t.Fatalf("queued messages = %+v, want one to carol@example.org from the original sender", pending)
+	}
+	data, err := os.ReadFile(pending[0].MessagePath)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("ReadMessage() error = %v", err)
+	}
+	if got := msg.Header.Get("Return-Path"); got != "" {
+		t.Errorf("redirected Return-Path = %q, want it removed", got)
+	}
+	if got := msg.Header.Get("Delivered-To"); got != "alice@example.com" {
+		t.Errorf("redirected Delivered-To = %q, want alice@example.com", got)
+	}
+}
+
+func TestSieveRedirectDoesNotKeep(t *testing.T) {
+	env := setupTestBackend(t)
+	q := env.withRelayQueue(t)
+	alice := env.addUser(t, "alice", "example.com")
+	env.activateScript(t, alice.ID, `if true { redirect "carol@example.org"; }`)
+	addr := startTestServer(t, env.backend)
+
+	if code, text := sendMX(t, addr, "alice@example.com", "Subject: hi\r\n\r\nhello"); code != 250 {
+		t.Fatalf("DATA reply = %q", text)
+	}
+
+	if got := len(env.inboxMessages(t, alice.ID)); got != 0 {
+		t.Errorf("INBOX has %d messages, want none after a plain redirect", got)
+	}
+	if pending, _ := q.ListPending(context.Background(), 10); len(pending) != 1 {
+		t.Errorf("queued %d messages, want the redirect", len(pending))
+	}
+}
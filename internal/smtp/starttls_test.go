@@ -0,0 +1,158 @@
+package smtp
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// testTLSConfig returns a server TLS config with a self-signed certificate
+func testTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+// serveTestServer serves one of srv's SMTP servers on a loopback listener
+func serveTestServer(t *testing.T, srv *smtp.Server) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return ln.Addr().String()
+}
+
+// startTLS runs STARTTLS and switches the client to the TLS connection
+func (c *rawClient) startTLS() {
+	c.t.Helper()
+	c.send("STARTTLS\r\n")
+	c.expect(220)
+	tlsConn := tls.Client(c.conn, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		c.t.Fatalf("TLS handshake error: %v", err)
+	}
+	c.conn = tlsConn
+	c.r = bufio.NewReader(tlsConn)
+}
+
+// authPlain is AUTH PLAIN for alice@example.com with password123
+const authPlain = "AUTH PLAIN AGFsaWNlQGV4YW1wbGUuY29tAHBhc3N3b3JkMTIz\r\n"
+
+func TestSubmissionAuthRequiresTLS(t *testing.T) {
+	env := setupTestBackend(t)
+	env.addUser(t, "alice", "example.com")
+	env.backend.config.Security.RequireTLS = false
+	env.backend.config.SMTP.RequireTLSForAuth = true
+	srv := NewServer(env.backend, env.backend.config, testTLSConfig(t))
+	c := dialRaw(t, serveTestServer(t, srv.submissionServer))
+
+	c.send("EHLO client.example.net\r\n")
+	if caps := c.expect(250); strings.Contains(caps, "AUTH") || !strings.Contains(caps, "STARTTLS") {
+		t.Errorf("EHLO before STARTTLS offers AUTH or lacks STARTTLS:\n%s", caps)
+	}
+	c.send(authPlain)
+	if msg := c.expect(538); !strings.Contains(msg, "5.7.11") {
+		t.Errorf("AUTH before STARTTLS = %q, want 5.7.11", msg)
+	}
+
+	c.startTLS()
+	c.send("EHLO client.example.net\r\n")
+	if caps := c.expect(250); !strings.Contains(caps, "AUTH PLAIN") {
+		t.Errorf("EHLO after STARTTLS lacks AUTH PLAIN:\n%s", caps)
+	}
+	c.send(authPlain)
+	c.expect(235)
+}
+
+func TestSubmissionAuthAllowedWithoutTLSWhenNotRequired(t *testing.T) {
+	env := setupTestBackend(t)
+	env.addUser(t, "alice", "example.com")
+	env.backend.config.Security.RequireTLS = false
+	srv := NewServer(env.backend, env.backend.config, testTLSConfig(t))
+	c := dialRaw(t, serveTestServer(t, srv.submissionServer))
+
+	c.send("EHLO client.example.net\r\n")
+	if caps := c.expect(250); !strings.Contains(caps, "AUTH PLAIN") {
+		t.Errorf("EHLO lacks AUTH PLAIN:\n%s", caps)
+	}
+	c.send(authPlain)
+	c.expect(235)
+}
+
+func TestMXAcceptsMailWithoutAuthWhenTLSRequiredForAuth(t *testing.T) {
+	env := setupTestBackend(t)
+	user := env.addUser(t, "bob", "example.com")
+	env.backend.config.SMTP.RequireTLSForAuth = true
+	srv := NewServer(env.backend, env.backend.config, testTLSConfig(t))
+	c := dialRaw(t, serveTestServer(t, srv.mxServer))
+
+	c.send("EHLO client.example.net\r\n")
+	c.expect(250)
+	c.send("MAIL FROM:<sender@example.net>\r\n")
+	c.expect(250)
+	c.send("RCPT TO:<bob@example.com>\r\n")
+	c.expect(250)
+	c.send("DATA\r\n")
+	c.expect(354)
+	c.send("Subject: hi\r\n\r\nhello\r\n.\r\n")
+	c.expect(250)
+
+	if msgs := env.inboxMessages(t, user.ID); len(msgs) != 1 {
+		t.Errorf("INBOX has %d messages, want 1", len(msgs))
+	}
+}
+
+func TestReceivedHeaderRecordsTLS(t *testing.T) {
+	env := setupTestBackend(t)
+	user := env.addUser(t, "bob", "example.com")
+	srv := NewServer(env.backend, env.backend.config, testTLSConfig(t))
+	c := dialRaw(t, serveTestServer(t, srv.mxServer))
+
+	c.send("EHLO client.example.net\r\n")
+	c.expect(250)
+	c.startTLS()
+	c.send("EHLO client.example.net\r\n")
+	c.expect(250)
+	c.send("MAIL FROM:<sender@example.net>\r\n")
+	c.expect(250)
+	c.send("RCPT TO:<bob@example.com>\r\n")
+	c.expect(250)
+	c.send("DATA\r\n")
+	c.expect(354)
+	c.send("Subject: hi\r\n\r\nhello\r\n.\r\n")
+	c.expect(250)
+
+	msgs := env.inboxMessages(t, user.ID)
+	if len(msgs) != 1 {
+		t.Fatalf("INBOX has %d messages, want 1", len(msgs))
+	}
+	if !strings.Contains(msgs[0], "with ESMTPS (version=TLS1.3 cipher=TLS_") {
+		t.Errorf("message = %q, want a Received header with the TLS version and cipher", msgs[0])
+	}
+}
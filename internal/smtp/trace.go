@@ -0,0 +1,184 @@
+package smtp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"github.com/fenilsonani/email-server/internal/logging"
+)
+
+// SMTP traces are taken at the session layer rather than on the
+// connection: go-smtp upgrades connections to TLS itself, so their bytes
+// can't be read after STARTTLS, while the session sees every transaction
+// in the clear, on every port. Each command the session handles is logged
+// with credentials and message data left out, followed by the reply
+// go-smtp makes of the session's answer. The session never sees that
+// reply, so it is rebuilt from go-smtp's texts and logged as synthesized.
+// Commands go-smtp answers itself, such as NOOP and STARTTLS, don't appear.
+
+// SetTracer logs the SMTP exchange of the sessions tracer selects. It must
+// be called before the servers start.
+func (b *Backend) SetTracer(tracer *logging.Tracer) {
+	b.tracer = tracer
+}
+
+// smtpSession returns s for go-smtp, recording its exchange when the
+// tracer selects its client. go-smtp starts a session on HELO or EHLO and
+// again after STARTTLS, so each is traced on its own.
+func (s *Session) smtpSession() smtp.Session {
+	if s.conn == nil || s.conn.Conn() == nil {
+		return s
+	}
+	s.trace = s.backend.tracer.Start("smtp", s.conn.Conn().RemoteAddr(), nil)
+	if s.trace == nil {
+		return s
+	}
+	// go-smtp doesn't say which of the two the client sent
+	s.traceCommand("HELO/EHLO %s", s.conn.Hostname())
+	return &tracedSession{Session: s}
+}
+
+// traceCommand records a command the client sent
+func (s *Session) traceCommand(format string, args ...any) {
+	if s.trace != nil {
+		s.trace.Client([]byte(fmt.Sprintf(format, args...) + "\r\n"))
+	}
+}
+
+// traceReply records the reply go-smtp sends for err, the session's answer
+// to a command, as it is expected to read: ok when it is nil, the error's
+// own reply for an SMTP error, and otherwise code with the error's text
+func (s *Session) traceReply(err error, code int, ok string) {
+	if s.trace == nil {
+		return
+	}
+	reply := ok
+	var smtpErr *smtp.SMTPError
+	switch {
+	case errors.As(err, &smtpErr):
+		reply = fmt.Sprintf("%d %s", smtpErr.Code, smtpErr.Message)
+	case err != nil:
+		reply = fmt.Sprintf("%d %s", code, err)
+	}
+	s.trace.SynthesizedServer([]byte(reply + "\r\n"))
+}
+
+// tracedSession records the commands and replies of a traced session
+type tracedSession struct {
+	*Session
+}
+
+func (s *tracedSession) Auth(mech string) (sasl.Server, error) {
+	s.traceCommand("AUTH %s", mech)
+	server, err := s.Session.Auth(mech)
+	if err != nil {
+		s.traceReply(err, 454, "")
+		return nil, err
+	}
+	return &tracedSASL{Server: server, session: s.Session}, nil
+}
+
+func (s *tracedSession) Mail(from string, opts *smtp.MailOptions) error {
+	s.traceCommand("MAIL FROM:<%s>%s", from, mailParams(opts))
+	err := s.Session.Mail(from, opts)
+	s.traceReply(err, 451, fmt.Sprintf("250 Roger, accepting mail from <%s>", from))
+	return err
+}
+
+func (s *tracedSession) Rcpt(to string, opts *smtp.RcptOptions) error {
+	params := ""
+	if opts != nil && len(opts.Notify) > 0 {
+		notify := make([]string, len(opts.Notify))
+		for i, n := range opts.Notify {
+			notify[i] = string(n)
+		}
+		params = " NOTIFY=" + strings.Join(notify, ",")
+	}
+	s.traceCommand("RCPT TO:<%s>%s", to, params)
+	err := s.Session.Rcpt(to, opts)
+	s.traceReply(err, 451, fmt.Sprintf("250 I'll make sure <%s> gets this", to))
+	return err
+}
+
+// Data logs the message as its size. BDAT chunks reach the session as one
+// message too, so they are logged as DATA.
+func (s *tracedSession) Data(r io.Reader) error {
+	s.traceCommand("DATA")
+	counter := &countingReader{Reader: r}
+	err := s.Session.Data(counter)
+	s.traceCommand("[%d bytes of message data]", counter.n)
+	s.traceReply(err, 554, "250 OK: queued")
+	return err
+}
+
+// mailParams returns the MAIL FROM parameters of opts as the client sent them
+func mailParams(opts *smtp.MailOptions) string {
+	if opts == nil {
+		return ""
+	}
+	var b strings.Builder
+	if opts.Size > 0 {
+		fmt.Fprintf(&b, " SIZE=%d", opts.Size)
+	}
+	if opts.Body != "" {
+		fmt.Fprintf(&b, " BODY=%s", opts.Body)
+	}
+	if opts.UTF8 {
+		b.WriteString(" SMTPUTF8")
+	}
+	if opts.RequireTLS {
+		b.WriteString(" REQUIRETLS")
+	}
+	if opts.Return != "" {
+		fmt.Fprintf(&b, " RET=%s", opts.Return)
+	}
+	if opts.EnvelopeID != "" {
+		fmt.Fprintf(&b, " ENVID=%s", opts.EnvelopeID)
+	}
+	if opts.Auth != nil {
+		fmt.Fprintf(&b, " AUTH=<%s>", *opts.Auth)
+	}
+	return b.String()
+}
+
+// tracedSASL records an AUTH exchange with the client's responses redacted
+type tracedSASL struct {
+	sasl.Server
+	session *Session
+}
+
+func (t *tracedSASL) Next(response []byte) ([]byte, bool, error) {
+	if response != nil {
+		t.session.traceCommand("[redacted]")
+	}
+	challenge, done, err := t.Server.Next(response)
+	switch {
+	case err != nil:
+		t.session.traceReply(err, 454, "")
+	case done:
+		// A traced user is followed from here on
+		if t.session.user != nil {
+			t.session.trace.SetUser(t.session.user.Email)
+		}
+		t.session.traceReply(nil, 0, "235 Authentication succeeded")
+	default:
+		t.session.traceReply(nil, 0, "334 [challenge]")
+	}
+	return challenge, done, err
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
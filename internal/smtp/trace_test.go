@@ -0,0 +1,128 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fenilsonani/email-server/internal/logging"
+)
+
+// lockedBuffer is a log destination the server and the test share
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// tracedSubmission runs a submission session with STARTTLS, AUTH and a
+// message on a server tracing ips, and returns what was logged. With
+// implicitTLS it runs on the SMTPS server instead, without STARTTLS.
+func tracedSubmission(t *testing.T, implicitTLS bool, ips ...string) string {
+	t.Helper()
+	env := setupTestBackend(t)
+	env.addUser(t, "alice", "example.com")
+	env.addUser(t, "bob", "example.com")
+	env.backend.config.Security.RequireTLS = false
+
+	var logs lockedBuffer
+	logger := &logging.Logger{Logger: slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))}
+	tracer, err := logging.NewTracer(logger, ips, nil, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("NewTracer() error = %v", err)
+	}
+	env.backend.SetTracer(tracer)
+	srv := NewServer(env.backend, env.backend.config, testTLSConfig(t))
+
+	var c *rawClient
+	if implicitTLS {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		go srv.smtpsServer.Serve(newImplicitTLSListener(ln, srv.tlsConfig))
+		t.Cleanup(func() { srv.smtpsServer.Close() })
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		t.Cleanup(func() { conn.Close() })
+		c = &rawClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+		c.expect(220)
+	} else {
+		c = dialRaw(t, serveTestServer(t, srv.submissionServer))
+		c.send("EHLO client.example.net\r\n")
+		c.expect(250)
+		c.startTLS()
+	}
+
+	c.send("EHLO client.example.net\r\n")
+	c.expect(250)
+	c.send(authPlain)
+	c.expect(235)
+	c.send("MAIL FROM:<alice@example.com>\r\n")
+	c.expect(250)
+	c.send("RCPT TO:<bob@example.com>\r\n")
+	c.expect(250)
+	c.send("DATA\r\n")
+	c.expect(354)
+	c.send("Subject: secret plans\r\n\r\nhello\r\n.\r\n")
+	c.expect(250)
+	c.send("QUIT\r\n")
+	c.expect(221)
+	// The session logs each reply before go-smtp writes it, so the trace is
+	// complete once the server has answered QUIT
+	return logs.String()
+}
+
+func TestTraceLogsTracedClient(t *testing.T) {
+	for _, implicitTLS := range []bool{false, true} {
+		out := tracedSubmission(t, implicitTLS, "127.0.0.0/8")
+
+		for _, want := range []string{
+			`line="HELO/EHLO client.example.net"`,
+			`line="AUTH PLAIN"`,
+			`line=[redacted]`,
+			`line="235 Authentication succeeded" synthesized=true`,
+			`line="MAIL FROM:<alice@example.com>"`,
+			`line="250 Roger, accepting mail from <alice@example.com>" synthesized=true`,
+			`line="RCPT TO:<bob@example.com>"`,
+			`line="[32 bytes of message data]"`,
+			`line="250 OK: queued" synthesized=true`,
+		} {
+			if !strings.Contains(out, want) {
+				t.Errorf("trace with implicit TLS %v is missing %s:\n%s", implicitTLS, want, out)
+			}
+		}
+		if strings.Contains(out, strings.TrimSpace(strings.TrimPrefix(authPlain, "AUTH PLAIN "))) {
+			t.Errorf("trace logged the AUTH credentials:\n%s", out)
+		}
+		if strings.Contains(out, "secret plans") {
+			t.Errorf("trace logged the message:\n%s", out)
+		}
+	}
+}
+
+func TestTraceIgnoresOtherClients(t *testing.T) {
+	if out := tracedSubmission(t, false, "192.0.2.0/24"); strings.Contains(out, "Protocol trace") {
+		t.Errorf("client outside 192.0.2.0/24 was traced:\n%s", out)
+	}
+}
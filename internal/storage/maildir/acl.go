@@ -0,0 +1,102 @@
+package maildir
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/fenilsonani/email-server/internal/storage"
+)
+
+// MailboxACL returns the rights other users have on a mailbox, sorted by
+// address. The owner isn't listed: they always have every right.
+func (s *Store) MailboxACL(ctx context.Context, mailboxID int64) ([]storage.ACLEntry, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT a.user_id, u.username || '@' || d.name, a.rights
+		FROM mailbox_acls a
+		JOIN users u ON u.id = a.user_id
+		JOIN domains d ON d.id = u.domain_id
+		WHERE a.mailbox_id = ?
+		ORDER BY d.name, u.username`, mailboxID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list mailbox ACL: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []storage.ACLEntry
+	for rows.Next() {
+		var e storage.ACLEntry
+		if err := rows.Scan(&e.UserID, &e.Email, &e.Rights); err != nil {
+			return nil, fmt.Errorf("failed to scan mailbox ACL: %w", err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// MailboxRights returns the rights userID has been granted on a mailbox,
+// "" when none
+func (s *Store) MailboxRights(ctx context.Context, mailboxID, userID int64) (string, error) {
+	var rights string
+	err := s.db.QueryRowContext(ctx,
+		"SELECT rights FROM mailbox_acls WHERE mailbox_id = ? AND user_id = ?", mailboxID, userID,
+	).Scan(&rights)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to query mailbox rights: %w", err)
+	}
+	return rights, nil
+}
+
+// SetMailboxRights grants userID rights on a mailbox, replacing what they
+// had. Empty rights remove the user from the mailbox's ACL.
+func (s *Store) SetMailboxRights(ctx context.Context, mailboxID, userID int64, rights string) error {
+	var err error
+	if rights == "" {
+		_, err = s.db.ExecContext(ctx,
+			"DELETE FROM mailbox_acls WHERE mailbox_id = ? AND user_id = ?", mailboxID, userID)
+	} else {
+		_, err = s.db.ExecContext(ctx, `
+			INSERT INTO mailbox_acls (mailbox_id, user_id, rights, updated_at) VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+			ON CONFLICT(mailbox_id, user_id) DO UPDATE SET rights = excluded.rights, updated_at = CURRENT_TIMESTAMP
+		`, mailboxID, userID, rights)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set mailbox rights: %w", err)
+	}
+	return nil
+}
+
+// SharedMailboxes returns the mailboxes of other users that userID has
+// been granted rights on, sorted by owner and name
+func (s *Store) SharedMailboxes(ctx context.Context, userID int64) ([]*storage.SharedMailbox, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT m.id, m.user_id, m.name, m.uidvalidity, m.uidnext, m.special_use, m.subscribed, m.created_at,
+		       u.username || '@' || d.name, a.rights
+		FROM mailbox_acls a
+		JOIN mailboxes m ON m.id = a.mailbox_id
+		JOIN users u ON u.id = m.user_id
+		JOIN domains d ON d.id = u.domain_id
+		WHERE a.user_id = ?
+		ORDER BY d.name, u.username, m.name`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list shared mailboxes: %w", err)
+	}
+	defer rows.Close()
+
+	var shared []*storage.SharedMailbox
+	for rows.Next() {
+		var mb storage.SharedMailbox
+		var specialUse sql.NullString
+		if err := rows.Scan(&mb.ID, &mb.UserID, &mb.Name, &mb.UIDValidity, &mb.UIDNext,
+			&specialUse, &mb.Subscribed, &mb.CreatedAt, &mb.OwnerEmail, &mb.Rights); err != nil {
+			return nil, fmt.Errorf("failed to scan shared mailbox: %w", err)
+		}
+		mb.SpecialUse = storage.SpecialUse(specialUse.String)
+		shared = append(shared, &mb)
+	}
+	return shared, rows.Err()
+}
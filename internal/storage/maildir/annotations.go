@@ -0,0 +1,83 @@
+package maildir
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/fenilsonani/email-server/internal/storage"
+)
+
+// ListMetadata returns the annotations on one of the user's mailboxes, or the
+// user's server annotations when mailboxID is 0. Entries are sorted by name.
+func (s *Store) ListMetadata(ctx context.Context, userID, mailboxID int64) ([]storage.MetadataEntry, error) {
+	query := `SELECT name, value FROM server_metadata WHERE user_id = ? ORDER BY name`
+	args := []interface{}{userID}
+	if mailboxID != 0 {
+		query = `SELECT mm.name, mm.value FROM mailbox_metadata mm
+			JOIN mailboxes m ON m.id = mm.mailbox_id
+			WHERE m.user_id = ? AND mm.mailbox_id = ? ORDER BY mm.name`
+		args = append(args, mailboxID)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list metadata: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []storage.MetadataEntry
+	for rows.Next() {
+		var e storage.MetadataEntry
+		if err := rows.Scan(&e.Name, &e.Value); err != nil {
+			return nil, fmt.Errorf("failed to scan metadata: %w", err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// SetMetadata applies a batch of annotations to one of the user's mailboxes
+// (or to the user's server annotations when mailboxID is 0) in a single
+// transaction. An entry with a nil Value is removed.
+func (s *Store) SetMetadata(ctx context.Context, userID, mailboxID int64, entries []storage.MetadataEntry) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if mailboxID != 0 {
+		// Only the owner may annotate a mailbox
+		var owner int64
+		err := tx.QueryRowContext(ctx, "SELECT user_id FROM mailboxes WHERE id = ?", mailboxID).Scan(&owner)
+		if err != nil || owner != userID {
+			return fmt.Errorf("%w: id=%d", storage.ErrMailboxNotFound, mailboxID)
+		}
+	}
+
+	for _, e := range entries {
+		name := strings.ToLower(e.Name)
+		switch {
+		case mailboxID == 0 && e.Value == nil:
+			_, err = tx.ExecContext(ctx, "DELETE FROM server_metadata WHERE user_id = ? AND name = ?", userID, name)
+		case mailboxID == 0:
+			_, err = tx.ExecContext(ctx, `
+				INSERT INTO server_metadata (user_id, name, value, updated_at) VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+				ON CONFLICT(user_id, name) DO UPDATE SET value = excluded.value, updated_at = CURRENT_TIMESTAMP
+			`, userID, name, e.Value)
+		case e.Value == nil:
+			_, err = tx.ExecContext(ctx, "DELETE FROM mailbox_metadata WHERE mailbox_id = ? AND name = ?", mailboxID, name)
+		default:
+			_, err = tx.ExecContext(ctx, `
+				INSERT INTO mailbox_metadata (mailbox_id, name, value, updated_at) VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+				ON CONFLICT(mailbox_id, name) DO UPDATE SET value = excluded.value, updated_at = CURRENT_TIMESTAMP
+			`, mailboxID, name, e.Value)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to set metadata %s: %w", name, err)
+		}
+	}
+
+	return tx.Commit()
+}
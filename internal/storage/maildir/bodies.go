@@ -0,0 +1,239 @@
+package maildir
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fenilsonani/email-server/internal/storage"
+)
+
+// bodyReleaseTimeout bounds the deletion of the bodies one change released
+const bodyReleaseTimeout = 5 * time.Minute
+
+// putBody uploads the message written to tmpPath to bodies as key and
+// empties the file, which stays behind as the message's maildir entry. The
+// caller must hold the body's lock.
+func putBody(ctx context.Context, bodies storage.BodyStore, tmpPath, key string, size int64) error {
+	f, err := os.Open(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to reopen message: %w", err)
+	}
+	defer f.Close()
+
+	if err := bodies.Put(ctx, key, f, size); err != nil {
+		return fmt.Errorf("failed to store message body: %w", err)
+	}
+	if err := os.Truncate(tmpPath, 0); err != nil {
+		return fmt.Errorf("failed to truncate message file: %w", err)
+	}
+	return nil
+}
+
+// releaseBodies deletes, in the background, the stored bodies no message
+// refers to any more. Copies of a message share its body, so one is only
+// deleted with the last copy. Deletion is best effort: a body left behind
+// only takes up space. The caller must hold s.mu.
+func (s *Store) releaseBodies(keys []string) {
+	if s.bodies == nil || len(keys) == 0 {
+		return
+	}
+	bodies := s.bodies
+	s.releasing.Add(1)
+	go func() {
+		defer s.releasing.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), bodyReleaseTimeout)
+		defer cancel()
+
+		seen := make(map[string]bool, len(keys))
+		for _, key := range keys {
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			s.releaseBody(ctx, bodies, key)
+		}
+	}()
+}
+
+// releaseBody deletes the body key unless a message refers to it. It holds
+// the body's lock, so an append can't upload the body again and refer to
+// it in between.
+func (s *Store) releaseBody(ctx context.Context, bodies storage.BodyStore, key string) {
+	defer s.bodyLocks.lock(key)()
+
+	var used bool
+	if err := s.db.QueryRowContext(ctx,
+		"SELECT EXISTS(SELECT 1 FROM messages WHERE body_key = ?)", key,
+	).Scan(&used); err != nil || used {
+		return
+	}
+	bodies.Delete(ctx, key)
+}
+
+// Close waits for the deletion of released bodies to finish
+func (s *Store) Close() error {
+	s.releasing.Wait()
+	return nil
+}
+
+// keyLocks is a mutex per key, for the keys in use
+type keyLocks struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lock locks key and returns the function that unlocks it
+func (l *keyLocks) lock(key string) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*keyLock)
+	}
+	kl := l.locks[key]
+	if kl == nil {
+		kl = &keyLock{}
+		l.locks[key] = kl
+	}
+	kl.refs++
+	l.mu.Unlock()
+
+	kl.Lock()
+	return func() {
+		kl.Unlock()
+		l.mu.Lock()
+		if kl.refs--; kl.refs == 0 {
+			delete(l.locks, key)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// copyStoredMessage copies src, whose body is in the body store, to the
+// mailbox destMailboxID with flags. The copy gets its own empty maildir
+// entry and refers to the same body, so nothing is downloaded or uploaded.
+func (s *Store) copyStoredMessage(ctx context.Context, src *storage.Message, destMailboxID int64, flags []storage.Flag) (*storage.Message, error) {
+	defer s.mailboxChanged(destMailboxID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mb, err := s.GetMailboxByID(ctx, destMailboxID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get mailbox %d: %w", destMailboxID, err)
+	}
+	if s.enforceQuota {
+		if err := s.checkQuota(ctx, mb.UserID, src.Size); err != nil {
+			return nil, err
+		}
+	}
+
+	path := s.getUserMaildirPath(mb.UserID, mb.Name)
+	if _, err := s.ensureMaildir(path); err != nil {
+		return nil, fmt.Errorf("failed to ensure maildir: %w", err)
+	}
+	destDir := "new"
+	if hasSeenFlag(flags) {
+		destDir = "cur"
+	}
+	key := generateMaildirKey()
+	if suffix := buildMaildirFlags(flags); suffix != "" {
+		key += ":2," + suffix
+	}
+	destPath := filepath.Join(path, destDir, key)
+	f, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create message file: %w", err)
+	}
+	f.Close()
+
+	uid := mb.UIDNext
+	result, err := s.db.ExecContext(ctx, "UPDATE mailboxes SET uidnext = uidnext + 1 WHERE id = ?", destMailboxID)
+	if err != nil {
+		os.Remove(destPath)
+		return nil, fmt.Errorf("failed to update mailbox uidnext: %w", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		os.Remove(destPath)
+		return nil, fmt.Errorf("%w: id=%d", storage.ErrMailboxNotFound, destMailboxID)
+	}
+
+	// The source row is read under s.mu, so its body can't be released
+	// before the copy refers to it
+	result, err = s.db.ExecContext(ctx,
+		`INSERT INTO messages (mailbox_id, uid, maildir_key, size, internal_date, flags, seen,
+		                       message_id, subject, from_address, to_addresses, in_reply_to, references_header, email_id, body_key)
+		 SELECT ?, ?, ?, size, internal_date, ?, ?,
+		        message_id, subject, from_address, to_addresses, in_reply_to, references_header, email_id, body_key
+		 FROM messages WHERE mailbox_id = ? AND uid = ?`,
+		destMailboxID, uid, key, flagsToString(flags), hasSeenFlag(flags), src.MailboxID, src.UID,
+	)
+	if err == nil {
+		if n, _ := result.RowsAffected(); n == 0 {
+			err = fmt.Errorf("%w: mailbox=%d uid=%d", storage.ErrMessageNotFound, src.MailboxID, src.UID)
+		}
+	}
+	if err != nil {
+		os.Remove(destPath)
+		return nil, fmt.Errorf("failed to copy message metadata: %w", err)
+	}
+	msgID, _ := result.LastInsertId()
+	s.UpdateUserQuota(ctx, mb.UserID, src.Size)
+
+	msg := *src
+	msg.ID = msgID
+	msg.MailboxID = destMailboxID
+	msg.UID = uid
+	msg.MaildirKey = key
+	msg.Flags = flags
+	msg.CreatedAt = time.Now()
+	return &msg, nil
+}
+
+// mailboxBodyKeys returns the stored bodies of the messages in a mailbox
+func (s *Store) mailboxBodyKeys(ctx context.Context, mailboxID int64) ([]string, error) {
+	return s.bodyKeys(ctx,
+		"SELECT DISTINCT body_key FROM messages WHERE mailbox_id = ? AND body_key IS NOT NULL", mailboxID)
+}
+
+// userBodyKeys returns the stored bodies of the messages in all of a
+// user's mailboxes
+func (s *Store) userBodyKeys(ctx context.Context, userID int64) ([]string, error) {
+	return s.bodyKeys(ctx, `
+		SELECT DISTINCT m.body_key FROM messages m JOIN mailboxes mb ON mb.id = m.mailbox_id
+		WHERE mb.user_id = ? AND m.body_key IS NOT NULL`, userID)
+}
+
+// bodyKeys returns the body keys query selects
+func (s *Store) bodyKeys(ctx context.Context, query string, args ...any) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list message bodies: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// nullStrings returns the value of a nullable column as zero or one keys
+func nullStrings(v sql.NullString) []string {
+	if !v.Valid {
+		return nil
+	}
+	return []string{v.String}
+}
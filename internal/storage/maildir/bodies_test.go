@@ -0,0 +1,233 @@
+package maildir
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fenilsonani/email-server/internal/storage"
+)
+
+// memBodies is an in-memory storage.BodyStore
+type memBodies struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	puts    int
+	gets    int
+}
+
+func newMemBodies() *memBodies {
+	return &memBodies{objects: make(map[string][]byte)}
+}
+
+func (m *memBodies) Put(ctx context.Context, key string, body io.Reader, size int64) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) != size {
+		return fmt.Errorf("read %d bytes, want %d", len(data), size)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[key] = data
+	m.puts++
+	return nil
+}
+
+func (m *memBodies) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gets++
+	data, ok := m.objects[key]
+	if !ok {
+		return nil, fmt.Errorf("no object %s", key)
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (m *memBodies) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.objects, key)
+	return nil
+}
+
+// transfers returns the number of uploads and downloads so far
+func (m *memBodies) transfers() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.puts + m.gets
+}
+
+func (m *memBodies) count() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.objects)
+}
+
+func readBody(t *testing.T, store *Store, msg *storage.Message) string {
+	t.Helper()
+	body, err := store.GetMessageBody(context.Background(), msg)
+	if err != nil {
+		t.Fatalf("GetMessageBody() error = %v", err)
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatalf("reading body: %v", err)
+	}
+	return string(data)
+}
+
+func TestStore_BodyStoreAppendAndFetch(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	inbox, _ := store.CreateMailbox(ctx, 1, "INBOX", "")
+
+	// A message appended before the body store is set stays in the maildir
+	content := "Subject: hi\r\n\r\nhello\r\n"
+	local, err := store.AppendMessage(ctx, inbox.ID, nil, time.Now(), strings.NewReader("Subject: old\r\n\r\nold\r\n"))
+	if err != nil {
+		t.Fatalf("AppendMessage() error = %v", err)
+	}
+
+	bodies := newMemBodies()
+	store.SetBodyStore(bodies)
+	msg, err := store.AppendMessage(ctx, inbox.ID, nil, time.Now(), strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("AppendMessage() error = %v", err)
+	}
+
+	if bodies.count() != 1 {
+		t.Fatalf("bucket holds %d objects, want 1", bodies.count())
+	}
+	if msg.Size != int64(len(content)) || msg.Subject != "hi" {
+		t.Errorf("message size = %d, subject = %q, want %d and hi", msg.Size, msg.Subject, len(content))
+	}
+	info, err := os.Stat(filepath.Join(store.getUserMaildirPath(1, "INBOX"), "new", msg.MaildirKey))
+	if err != nil {
+		t.Fatalf("maildir entry missing: %v", err)
+	}
+	if info.Size() != 0 {
+		t.Errorf("maildir entry holds %d bytes, want an empty file", info.Size())
+	}
+
+	if got := readBody(t, store, msg); got != content {
+		t.Errorf("body = %q, want %q", got, content)
+	}
+	if got := readBody(t, store, local); got != "Subject: old\r\n\r\nold\r\n" {
+		t.Errorf("maildir body = %q", got)
+	}
+
+	// \Recent and flags still work through the empty file
+	if uids, err := store.ClearRecent(ctx, inbox.ID); err != nil || len(uids) != 2 {
+		t.Errorf("ClearRecent() = %v, %v, want both messages", uids, err)
+	}
+	if err := store.SetFlags(ctx, inbox.ID, msg.UID, []storage.Flag{storage.FlagSeen}); err != nil {
+		t.Fatalf("SetFlags() error = %v", err)
+	}
+	msg, _ = store.GetMessage(ctx, inbox.ID, msg.UID)
+	if got := readBody(t, store, msg); got != content {
+		t.Errorf("body after SetFlags = %q, want %q", got, content)
+	}
+}
+
+func TestStore_BodyStoreDeletesLastCopy(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	bodies := newMemBodies()
+	store.SetBodyStore(bodies)
+	inbox, _ := store.CreateMailbox(ctx, 1, "INBOX", "")
+	archive, _ := store.CreateMailbox(ctx, 1, "Archive", "")
+
+	msg, err := store.AppendMessage(ctx, inbox.ID, nil, time.Now(), strings.NewReader("Subject: hi\r\n\r\nhello\r\n"))
+	if err != nil {
+		t.Fatalf("AppendMessage() error = %v", err)
+	}
+	transfers := bodies.transfers()
+	copied, err := store.CopyMessage(ctx, inbox.ID, msg.UID, archive.ID)
+	if err != nil {
+		t.Fatalf("CopyMessage() error = %v", err)
+	}
+	if bodies.count() != 1 {
+		t.Fatalf("bucket holds %d objects after copy, want the copies to share 1", bodies.count())
+	}
+	if got := bodies.transfers() - transfers; got != 0 {
+		t.Errorf("CopyMessage() made %d bucket transfers, want none", got)
+	}
+	if copied.Subject != "hi" || copied.MailboxID != archive.ID {
+		t.Errorf("copy = %+v, want the subject hi in Archive", copied)
+	}
+
+	store.SetFlags(ctx, inbox.ID, msg.UID, []storage.Flag{storage.FlagDeleted})
+	if _, err := store.ExpungeMailbox(ctx, inbox.ID); err != nil {
+		t.Fatalf("ExpungeMailbox() error = %v", err)
+	}
+	store.Close()
+	if bodies.count() != 1 {
+		t.Fatalf("bucket holds %d objects, want the copy's body kept", bodies.count())
+	}
+	if got := readBody(t, store, copied); got != "Subject: hi\r\n\r\nhello\r\n" {
+		t.Errorf("copy's body = %q", got)
+	}
+
+	if err := store.DeleteMailbox(ctx, 1, "Archive"); err != nil {
+		t.Fatalf("DeleteMailbox() error = %v", err)
+	}
+	store.Close()
+	if bodies.count() != 0 {
+		t.Errorf("bucket holds %d objects, want the body deleted with the last copy", bodies.count())
+	}
+}
+
+func TestStore_DeleteUserReleasesBodies(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	if _, err := store.db.Exec("INSERT INTO users (id, domain_id, username, password_hash) VALUES (2, 1, 'other', 'hash')"); err != nil {
+		t.Fatalf("adding user: %v", err)
+	}
+	bodies := newMemBodies()
+	store.SetBodyStore(bodies)
+	inbox, _ := store.CreateMailbox(ctx, 1, "INBOX", "")
+	otherInbox, _ := store.CreateMailbox(ctx, 2, "INBOX", "")
+
+	// One body only the user has, one shared with the other user
+	for _, content := range []string{"Subject: own\r\n\r\nown\r\n", "Subject: shared\r\n\r\nshared\r\n"} {
+		if _, err := store.AppendMessage(ctx, inbox.ID, nil, time.Now(), strings.NewReader(content)); err != nil {
+			t.Fatalf("AppendMessage() error = %v", err)
+		}
+	}
+	if _, err := store.AppendMessage(ctx, otherInbox.ID, nil, time.Now(), strings.NewReader("Subject: shared\r\n\r\nshared\r\n")); err != nil {
+		t.Fatalf("AppendMessage() error = %v", err)
+	}
+
+	if err := store.DeleteUser(ctx, 1); err != nil {
+		t.Fatalf("DeleteUser() error = %v", err)
+	}
+	store.Close()
+	if bodies.count() != 1 {
+		t.Errorf("bucket holds %d objects, want only the shared body", bodies.count())
+	}
+	if _, err := os.Stat(filepath.Join(store.basePath, "user_1")); !os.IsNotExist(err) {
+		t.Errorf("user maildir still exists: %v", err)
+	}
+	var mailboxes int
+	store.db.QueryRow("SELECT COUNT(*) FROM mailboxes WHERE user_id = 1").Scan(&mailboxes)
+	if mailboxes != 0 {
+		t.Errorf("user has %d mailboxes left, want none", mailboxes)
+	}
+}
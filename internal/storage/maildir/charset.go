@@ -0,0 +1,95 @@
+package maildir
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+)
+
+// legacyCharsets are the charsets decoded besides US-ASCII and UTF-8: the
+// ones real-world mailers still label headers and bodies with
+var legacyCharsets = map[string]encoding.Encoding{
+	"ISO-8859-1":   charmap.ISO8859_1,
+	"ISO-8859-2":   charmap.ISO8859_2,
+	"ISO-8859-15":  charmap.ISO8859_15,
+	"WINDOWS-1252": charmap.Windows1252,
+	"KOI8-R":       charmap.KOI8R,
+	"GBK":          simplifiedchinese.GBK,
+	"SHIFT_JIS":    japanese.ShiftJIS,
+	"BIG5":         traditionalchinese.Big5,
+}
+
+// charsetAliases maps other common names to legacyCharsets keys
+var charsetAliases = map[string]string{
+	"LATIN1":      "ISO-8859-1",
+	"LATIN-1":     "ISO-8859-1",
+	"LATIN2":      "ISO-8859-2",
+	"LATIN9":      "ISO-8859-15",
+	"CP1252":      "WINDOWS-1252",
+	"GB2312":      "GBK", // GBK is a superset, and mailers often mislabel it
+	"CP936":       "GBK",
+	"SJIS":        "SHIFT_JIS",
+	"SHIFT-JIS":   "SHIFT_JIS",
+	"WINDOWS-31J": "SHIFT_JIS",
+	"CP932":       "SHIFT_JIS",
+	"BIG-5":       "BIG5",
+	"CP950":       "BIG5",
+}
+
+// Charsets lists the charsets DecodeCharset understands, by their
+// preferred names
+func Charsets() []string {
+	return []string{"US-ASCII", "UTF-8", "ISO-8859-1", "ISO-8859-2", "ISO-8859-15",
+		"WINDOWS-1252", "KOI8-R", "GBK", "SHIFT_JIS", "BIG5"}
+}
+
+// lookupCharset returns the decoder for charset, or nil for US-ASCII and
+// UTF-8, which need no decoding
+func lookupCharset(charset string) (encoding.Encoding, error) {
+	name := strings.ToUpper(strings.TrimSpace(charset))
+	if alias, ok := charsetAliases[name]; ok {
+		name = alias
+	}
+	switch name {
+	case "US-ASCII", "UTF-8":
+		return nil, nil
+	}
+	if enc, ok := legacyCharsets[name]; ok {
+		return enc, nil
+	}
+	return nil, fmt.Errorf("unsupported charset %q", charset)
+}
+
+// DecodeCharset converts b from charset to UTF-8
+func DecodeCharset(charset string, b []byte) (string, error) {
+	enc, err := lookupCharset(charset)
+	if err != nil {
+		return "", err
+	}
+	if enc == nil {
+		return string(b), nil
+	}
+	out, err := enc.NewDecoder().Bytes(b)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+// charsetReader lets mime.WordDecoder decode the legacy charsets too
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	enc, err := lookupCharset(charset)
+	if err != nil {
+		return nil, err
+	}
+	if enc == nil {
+		return input, nil
+	}
+	return enc.NewDecoder().Reader(input), nil
+}
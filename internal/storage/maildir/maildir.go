@@ -1,8 +1,10 @@
 package maildir
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
 	"encoding/json"
@@ -11,12 +13,15 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/emersion/go-maildir"
 	"github.com/fenilsonani/email-server/internal/storage"
+	"github.com/fenilsonani/email-server/internal/storage/metadata"
 )
 
 // Store implements storage.MessageStore using Maildir format
@@ -25,6 +30,16 @@ type Store struct {
 	basePath    string
 	mu          sync.RWMutex
 	maildirDirs map[int64]*maildir.Dir // userID -> maildir.Dir
+	stats       *statsCache
+	usage       *usageTracker
+	bodies      storage.BodyStore // Where bodies are kept; nil = in the maildir files
+	bodyLocks   keyLocks          // Held on a body while it is uploaded or deleted
+	releasing   sync.WaitGroup    // Body deletions in progress
+
+	defaultMailboxes []storage.DefaultMailbox
+	maxMailboxes     int // Per user; 0 = unlimited
+	maxMailboxDepth  int // Hierarchy levels; 0 = unlimited
+	enforceQuota     bool
 }
 
 // NewStore creates a new Maildir-based message store
@@ -34,12 +49,61 @@ func NewStore(db *sql.DB, basePath string) (*Store, error) {
 	}
 
 	return &Store{
-		db:          db,
-		basePath:    basePath,
-		maildirDirs: make(map[int64]*maildir.Dir),
+		db:               db,
+		basePath:         basePath,
+		maildirDirs:      make(map[int64]*maildir.Dir),
+		stats:            newStatsCache(statsCacheTTL),
+		usage:            newUsageTracker(),
+		defaultMailboxes: storage.DefaultMailboxes,
 	}, nil
 }
 
+// SetDefaultMailboxes replaces the mailbox set InitializeUserMailboxes
+// creates. INBOX is always created even if missing from mailboxes.
+func (s *Store) SetDefaultMailboxes(mailboxes []storage.DefaultMailbox) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.defaultMailboxes = mailboxes
+}
+
+// SetMailboxLimits caps how many mailboxes a user can have and how many
+// levels deep their hierarchy can go, so a runaway client can't create
+// thousands of folders. Zero leaves a limit off.
+func (s *Store) SetMailboxLimits(maxMailboxes, maxDepth int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxMailboxes = maxMailboxes
+	s.maxMailboxDepth = maxDepth
+}
+
+// SetQuotaEnforcement makes AppendMessage refuse a message that would take
+// its user over quota with ErrOverQuota. Off by default, since SMTP already
+// checks quota before accepting mail.
+func (s *Store) SetQuotaEnforcement(enforce bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.enforceQuota = enforce
+}
+
+// SetBodyStore keeps the bodies of messages appended from now on in bodies
+// instead of the maildir. Each message still gets an empty maildir file, so
+// \Recent and flags are tracked as before. Messages already in the maildir
+// stay there.
+func (s *Store) SetBodyStore(bodies storage.BodyStore) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bodies = bodies
+}
+
+// checkMailboxDepth returns ErrMailboxLimit when name has more hierarchy
+// levels than allowed. The caller must hold s.mu.
+func (s *Store) checkMailboxDepth(name string) error {
+	if depth := strings.Count(name, "/") + 1; s.maxMailboxDepth > 0 && depth > s.maxMailboxDepth {
+		return fmt.Errorf("%w: %s is %d levels deep, limit is %d", storage.ErrMailboxLimit, name, depth, s.maxMailboxDepth)
+	}
+	return nil
+}
+
 // getUserMaildirPath returns the path for a user's maildir
 func (s *Store) getUserMaildirPath(userID int64, mailboxName string) string {
 	// Convert mailbox name to safe filesystem path
@@ -66,6 +130,109 @@ func (s *Store) CreateMailbox(ctx context.Context, userID int64, name string, sp
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if err := s.checkMailboxDepth(name); err != nil {
+		return nil, err
+	}
+	if exists, err := s.mailboxExists(ctx, userID, name); err != nil {
+		return nil, err
+	} else if exists {
+		return nil, fmt.Errorf("%w: %s", storage.ErrMailboxExists, name)
+	}
+
+	// Missing parents are created too, as Projects for Projects/2026
+	parents, err := s.missingParents(ctx, userID, name)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkMailboxCount(ctx, userID, len(parents)+1); err != nil {
+		return nil, err
+	}
+	created, err := s.insertParents(ctx, userID, parents)
+	if err != nil {
+		return nil, err
+	}
+	mb, err := s.insertMailbox(ctx, userID, name, specialUse)
+	if err != nil {
+		s.removeParents(ctx, userID, created)
+		return nil, err
+	}
+	return mb, nil
+}
+
+// insertParents creates the mailboxes parents, outermost first, returning
+// the ones it made. On failure none is left behind. The caller must hold
+// s.mu.
+func (s *Store) insertParents(ctx context.Context, userID int64, parents []string) ([]string, error) {
+	for i, parent := range parents {
+		if _, err := s.insertMailbox(ctx, userID, parent, ""); err != nil {
+			s.removeParents(ctx, userID, parents[:i])
+			return nil, err
+		}
+	}
+	return parents, nil
+}
+
+// removeParents deletes the empty mailboxes insertParents made for a
+// CREATE or RENAME that then failed, innermost first. The caller must
+// hold s.mu.
+func (s *Store) removeParents(ctx context.Context, userID int64, parents []string) {
+	for i := len(parents) - 1; i >= 0; i-- {
+		if _, err := s.db.ExecContext(ctx, "DELETE FROM mailboxes WHERE user_id = ? AND name = ?", userID, parents[i]); err != nil {
+			continue
+		}
+		os.RemoveAll(s.getUserMaildirPath(userID, parents[i]))
+	}
+}
+
+// mailboxExists reports whether the user has a mailbox called name. The
+// caller must hold s.mu.
+func (s *Store) mailboxExists(ctx context.Context, userID int64, name string) (bool, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM mailboxes WHERE user_id = ? AND name = ?", userID, name).Scan(&n)
+	if err != nil {
+		return false, fmt.Errorf("failed to look up mailbox %s for user %d: %w", name, userID, err)
+	}
+	return n > 0, nil
+}
+
+// missingParents returns the ancestors of name the user has no mailbox
+// for, outermost first. The caller must hold s.mu.
+func (s *Store) missingParents(ctx context.Context, userID int64, name string) ([]string, error) {
+	var missing []string
+	for i := 0; i < len(name); i++ {
+		if name[i] != '/' || i == 0 {
+			continue
+		}
+		exists, err := s.mailboxExists(ctx, userID, name[:i])
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			missing = append(missing, name[:i])
+		}
+	}
+	return missing, nil
+}
+
+// checkMailboxCount returns ErrMailboxLimit when n more mailboxes would
+// take the user over the limit. The caller must hold s.mu.
+func (s *Store) checkMailboxCount(ctx context.Context, userID int64, n int) error {
+	if s.maxMailboxes <= 0 || n == 0 {
+		return nil
+	}
+	var count int
+	if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM mailboxes WHERE user_id = ?", userID).Scan(&count); err != nil {
+		return fmt.Errorf("failed to count mailboxes for user %d: %w", userID, err)
+	}
+	if count+n > s.maxMailboxes {
+		return fmt.Errorf("%w: user %d has %d mailboxes, limit is %d", storage.ErrMailboxLimit, userID, count, s.maxMailboxes)
+	}
+	return nil
+}
+
+// insertMailbox adds a mailbox row and its maildir. The caller must hold
+// s.mu.
+func (s *Store) insertMailbox(ctx context.Context, userID int64, name string, specialUse storage.SpecialUse) (*storage.Mailbox, error) {
 	// Generate UID validity
 	uidValidity := uint32(time.Now().Unix())
 
@@ -75,6 +242,9 @@ func (s *Store) CreateMailbox(ctx context.Context, userID int64, name string, sp
 		 VALUES (?, ?, ?, 1, ?, TRUE)`,
 		userID, name, uidValidity, string(specialUse),
 	)
+	if metadata.IsUniqueViolation(err) {
+		return nil, fmt.Errorf("%w: %s", storage.ErrMailboxExists, name)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to create mailbox %s for user %d: %w", name, userID, err)
 	}
@@ -108,23 +278,28 @@ func (s *Store) CreateMailbox(ctx context.Context, userID int64, name string, sp
 
 // InitializeUserMailboxes creates the default mailboxes for a new user
 func (s *Store) InitializeUserMailboxes(ctx context.Context, userID int64) error {
-	// Create default mailboxes with their special uses
-	defaultMailboxes := []struct {
-		name       string
-		specialUse storage.SpecialUse
-	}{
-		{"INBOX", ""},
-		{"Drafts", storage.SpecialUseDrafts},
-		{"Sent", storage.SpecialUseSent},
-		{"Junk", storage.SpecialUseJunk},
-		{"Trash", storage.SpecialUseTrash},
-		{"Archive", storage.SpecialUseArchive},
+	s.mu.RLock()
+	defaultMailboxes := s.defaultMailboxes
+	s.mu.RUnlock()
+
+	hasInbox := false
+	for _, mb := range defaultMailboxes {
+		if strings.EqualFold(mb.Name, "INBOX") {
+			hasInbox = true
+		}
+	}
+	if !hasInbox {
+		defaultMailboxes = append([]storage.DefaultMailbox{{Name: "INBOX"}}, defaultMailboxes...)
 	}
 
 	for _, mb := range defaultMailboxes {
-		_, err := s.CreateMailbox(ctx, userID, mb.name, mb.specialUse)
+		name := mb.Name
+		if strings.EqualFold(name, "INBOX") {
+			name = "INBOX"
+		}
+		_, err := s.CreateMailbox(ctx, userID, name, mb.SpecialUse)
 		if err != nil {
-			return fmt.Errorf("failed to create %s mailbox: %w", mb.name, err)
+			return fmt.Errorf("failed to create %s mailbox: %w", name, err)
 		}
 	}
 
@@ -145,7 +320,7 @@ func (s *Store) GetMailbox(ctx context.Context, userID int64, name string) (*sto
 
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return nil, fmt.Errorf("mailbox not found: user=%d name=%s", userID, name)
+			return nil, fmt.Errorf("%w: user=%d name=%s", storage.ErrMailboxNotFound, userID, name)
 		}
 		return nil, fmt.Errorf("failed to query mailbox user=%d name=%s: %w", userID, name, err)
 	}
@@ -168,7 +343,7 @@ func (s *Store) GetMailboxByID(ctx context.Context, id int64) (*storage.Mailbox,
 
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return nil, fmt.Errorf("mailbox not found: id=%d", id)
+			return nil, fmt.Errorf("%w: id=%d", storage.ErrMailboxNotFound, id)
 		}
 		return nil, fmt.Errorf("failed to query mailbox id=%d: %w", id, err)
 	}
@@ -206,37 +381,120 @@ func (s *Store) ListMailboxes(ctx context.Context, userID int64) ([]*storage.Mai
 	return mailboxes, rows.Err()
 }
 
-// RenameMailbox renames a mailbox
-func (s *Store) RenameMailbox(ctx context.Context, userID int64, oldName, newName string) error {
+// RenameMailbox renames a mailbox and the mailboxes below it, as RFC 3501
+// requires of RENAME
+func (s *Store) RenameMailbox(ctx context.Context, userID int64, oldName, newName string) (err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	// Update database
+	// The deepest mailbox moved must still fit within the depth limit
+	descendants, err := s.descendants(ctx, userID, oldName)
+	if err != nil {
+		return err
+	}
+	deepest := newName
+	for _, name := range descendants {
+		if moved := newName + name[len(oldName):]; strings.Count(moved, "/") > strings.Count(deepest, "/") {
+			deepest = moved
+		}
+	}
+	if err := s.checkMailboxDepth(deepest); err != nil {
+		return err
+	}
+
+	// Missing parents of the new name are created first, once the rename
+	// is known to be possible
+	parents, err := s.missingParents(ctx, userID, newName)
+	if err != nil {
+		return err
+	}
+	if len(parents) > 0 {
+		if exists, err := s.mailboxExists(ctx, userID, oldName); err != nil {
+			return err
+		} else if !exists {
+			return fmt.Errorf("%w: %s", storage.ErrMailboxNotFound, oldName)
+		}
+		if exists, err := s.mailboxExists(ctx, userID, newName); err != nil {
+			return err
+		} else if exists {
+			return fmt.Errorf("%w: %s", storage.ErrMailboxExists, newName)
+		}
+		if err := s.checkMailboxCount(ctx, userID, len(parents)); err != nil {
+			return err
+		}
+		created, insertErr := s.insertParents(ctx, userID, parents)
+		if insertErr != nil {
+			return insertErr
+		}
+		// A rename that fails from here leaves no new parents behind
+		defer func() {
+			if err != nil {
+				s.removeParents(ctx, userID, created)
+			}
+		}()
+	}
+
+	// Update database; SQLite counts characters, not bytes
+	oldLen := utf8.RuneCountInString(oldName)
 	result, err := s.db.ExecContext(ctx,
-		"UPDATE mailboxes SET name = ? WHERE user_id = ? AND name = ?",
-		newName, userID, oldName,
+		"UPDATE mailboxes SET name = ? || substr(name, ?) WHERE user_id = ? AND (name = ? OR substr(name, 1, ?) = ?)",
+		newName, oldLen+1, userID, oldName, oldLen+1, oldName+"/",
 	)
+	if metadata.IsUniqueViolation(err) {
+		return fmt.Errorf("%w: %s", storage.ErrMailboxExists, newName)
+	}
 	if err != nil {
 		return err
 	}
 
 	affected, _ := result.RowsAffected()
 	if affected == 0 {
-		return fmt.Errorf("mailbox not found: %s", oldName)
+		return fmt.Errorf("%w: %s", storage.ErrMailboxNotFound, oldName)
+	}
+
+	// Rename on filesystem; each mailbox has a maildir of its own
+	newLen := utf8.RuneCountInString(newName)
+	names := append([]string{oldName}, descendants...)
+	for i, name := range names {
+		oldPath := s.getUserMaildirPath(userID, name)
+		newPath := s.getUserMaildirPath(userID, newName+name[len(oldName):])
+		if err := os.Rename(oldPath, newPath); err != nil && !os.IsNotExist(err) {
+			// Rollback the maildirs already moved and the database change
+			for _, done := range names[:i] {
+				os.Rename(s.getUserMaildirPath(userID, newName+done[len(oldName):]), s.getUserMaildirPath(userID, done))
+			}
+			s.db.ExecContext(ctx,
+				"UPDATE mailboxes SET name = ? || substr(name, ?) WHERE user_id = ? AND (name = ? OR substr(name, 1, ?) = ?)",
+				oldName, newLen+1, userID, newName, newLen+1, newName+"/")
+			return fmt.Errorf("failed to rename maildir: %w", err)
+		}
 	}
 
-	// Rename on filesystem
-	oldPath := s.getUserMaildirPath(userID, oldName)
-	newPath := s.getUserMaildirPath(userID, newName)
+	return nil
+}
 
-	if err := os.Rename(oldPath, newPath); err != nil && !os.IsNotExist(err) {
-		// Rollback database change
-		s.db.ExecContext(ctx, "UPDATE mailboxes SET name = ? WHERE user_id = ? AND name = ?",
-			oldName, userID, newName)
-		return fmt.Errorf("failed to rename maildir: %w", err)
+// descendants returns the names of the mailboxes below name. The caller
+// must hold s.mu.
+func (s *Store) descendants(ctx context.Context, userID int64, name string) ([]string, error) {
+	prefix := name + "/"
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT name FROM mailboxes WHERE user_id = ? AND substr(name, 1, ?) = ? ORDER BY name",
+		userID, utf8.RuneCountInString(prefix), prefix,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list mailboxes below %s: %w", name, err)
 	}
+	defer rows.Close()
 
-	return nil
+	var names []string
+	for rows.Next() {
+		var child string
+		if err := rows.Scan(&child); err != nil {
+			return nil, err
+		}
+		names = append(names, child)
+	}
+	return names, rows.Err()
 }
 
 // DeleteMailbox removes a mailbox and all its messages
@@ -250,14 +508,25 @@ func (s *Store) DeleteMailbox(ctx context.Context, userID int64, name string) er
 		"SELECT id FROM mailboxes WHERE user_id = ? AND name = ?",
 		userID, name,
 	).Scan(&mailboxID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: %s", storage.ErrMailboxNotFound, name)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to query mailbox %s: %w", name, err)
+	}
+	defer s.mailboxChanged(mailboxID)
+	defer s.usage.touchUser(userID) // The mailbox row is gone by the recompute
+
+	bodyKeys, err := s.mailboxBodyKeys(ctx, mailboxID)
 	if err != nil {
-		return fmt.Errorf("mailbox not found: %s", name)
+		return err
 	}
 
 	// Delete messages from database (cascade should handle this)
 	if _, err := s.db.ExecContext(ctx, "DELETE FROM mailboxes WHERE id = ?", mailboxID); err != nil {
 		return err
 	}
+	s.releaseBodies(bodyKeys)
 
 	// Remove from filesystem
 	path := s.getUserMaildirPath(userID, name)
@@ -268,6 +537,30 @@ func (s *Store) DeleteMailbox(ctx context.Context, userID int64, name string) er
 	return nil
 }
 
+// DeleteUser removes a user with their mailboxes and messages, including
+// the stored bodies no other user's messages share
+func (s *Store) DeleteUser(ctx context.Context, userID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bodyKeys, err := s.userBodyKeys(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	// Mailboxes and messages go with the user by cascade
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM users WHERE id = ?", userID); err != nil {
+		return fmt.Errorf("failed to delete user %d: %w", userID, err)
+	}
+	s.releaseBodies(bodyKeys)
+
+	path := filepath.Join(s.basePath, fmt.Sprintf("user_%d", userID))
+	if err := os.RemoveAll(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove maildir: %w", err)
+	}
+	return nil
+}
+
 // SubscribeMailbox updates mailbox subscription status
 func (s *Store) SubscribeMailbox(ctx context.Context, userID int64, name string, subscribed bool) error {
 	_, err := s.db.ExecContext(ctx,
@@ -279,8 +572,8 @@ func (s *Store) SubscribeMailbox(ctx context.Context, userID int64, name string,
 
 // AppendMessage stores a new message in the mailbox with atomic file operations
 func (s *Store) AppendMessage(ctx context.Context, mailboxID int64, flags []storage.Flag, date time.Time, body io.Reader) (*storage.Message, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	defer s.mailboxChanged(mailboxID)
+	flags = normalizeFlags(flags)
 
 	// Get mailbox info
 	mb, err := s.GetMailboxByID(ctx, mailboxID)
@@ -293,12 +586,13 @@ func (s *Store) AppendMessage(ctx context.Context, mailboxID int64, flags []stor
 
 	// Get maildir path
 	path := s.getUserMaildirPath(mb.UserID, mb.Name)
-	dir, err := s.ensureMaildir(path)
-	if err != nil {
+	if _, err := s.ensureMaildir(path); err != nil {
 		return nil, fmt.Errorf("failed to ensure maildir: %w", err)
 	}
 
-	// Write to tmp first (atomic write pattern)
+	// Write to tmp first (atomic write pattern). The message is written and
+	// its body uploaded before taking s.mu, so a slow disk or bucket
+	// doesn't hold up the rest of the store.
 	tmpPath := filepath.Join(path, "tmp", key)
 	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
 	if err != nil {
@@ -307,10 +601,12 @@ func (s *Store) AppendMessage(ctx context.Context, mailboxID int64, flags []stor
 
 	// Ensure file is closed and cleaned up on error
 	var size int64
+	head := &headerCapture{}
+	hash := sha256.New()
 	writeErr := func() error {
 		defer f.Close()
 
-		written, err := io.Copy(f, body)
+		written, err := io.Copy(f, io.TeeReader(body, io.MultiWriter(head, hash)))
 		if err != nil {
 			return fmt.Errorf("failed to write message: %w", err)
 		}
@@ -329,6 +625,45 @@ func (s *Store) AppendMessage(ctx context.Context, mailboxID int64, flags []stor
 		return nil, writeErr
 	}
 
+	// A body store keeps the body under its hash, leaving the file empty.
+	// The body stays locked until the message refers to it, so releasing
+	// another copy can't delete it in between.
+	s.mu.RLock()
+	bodies := s.bodies
+	s.mu.RUnlock()
+	var bodyKey sql.NullString
+	if bodies != nil {
+		key := hex.EncodeToString(hash.Sum(nil))
+		defer s.bodyLocks.lock(key)()
+		if err := putBody(ctx, bodies, tmpPath, key, size); err != nil {
+			os.Remove(tmpPath)
+			return nil, err
+		}
+		bodyKey = sql.NullString{String: key, Valid: true}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The mailbox may have been renamed meanwhile, taking the tmp file
+	// along, or deleted with it
+	mb, err = s.GetMailboxByID(ctx, mailboxID)
+	if err != nil {
+		os.Remove(tmpPath)
+		s.releaseBodies(nullStrings(bodyKey))
+		return nil, fmt.Errorf("failed to get mailbox %d: %w", mailboxID, err)
+	}
+	path = s.getUserMaildirPath(mb.UserID, mb.Name)
+	tmpPath = filepath.Join(path, "tmp", key)
+
+	if s.enforceQuota {
+		if err := s.checkQuota(ctx, mb.UserID, size); err != nil {
+			os.Remove(tmpPath)
+			s.releaseBodies(nullStrings(bodyKey))
+			return nil, err
+		}
+	}
+
 	// Determine destination (new or cur based on \Seen flag)
 	destDir := "new"
 	for _, flag := range flags {
@@ -349,9 +684,16 @@ func (s *Store) AppendMessage(ctx context.Context, mailboxID int64, flags []stor
 	destPath := filepath.Join(path, destDir, finalKey)
 	if err := os.Rename(tmpPath, destPath); err != nil {
 		os.Remove(tmpPath) // Clean up temp file
+		s.releaseBodies(nullStrings(bodyKey))
 		return nil, fmt.Errorf("failed to move message to destination: %w", err)
 	}
 
+	// discard undoes the append when indexing the message fails
+	discard := func() {
+		os.Remove(destPath)
+		s.releaseBodies(nullStrings(bodyKey))
+	}
+
 	// Get next UID
 	uid := mb.UIDNext
 
@@ -362,29 +704,39 @@ func (s *Store) AppendMessage(ctx context.Context, mailboxID int64, flags []stor
 	)
 	if err != nil {
 		// Try to clean up file
-		os.Remove(destPath)
+		discard()
 		return nil, fmt.Errorf("failed to update mailbox uidnext: %w", err)
 	}
 
 	affected, _ := result.RowsAffected()
 	if affected == 0 {
-		os.Remove(destPath)
-		return nil, fmt.Errorf("mailbox %d not found or deleted", mailboxID)
+		discard()
+		return nil, fmt.Errorf("%w: id=%d", storage.ErrMailboxNotFound, mailboxID)
 	}
 
-	// Parse message headers for metadata (simplified)
-	// In production, you'd parse the message properly
+	// Index the headers clients and search need without opening the file
 	flagsStr := flagsToString(flags)
+	meta, err := ParseMessageHeaders(bytes.NewReader(head.Bytes()))
+	if err != nil {
+		meta = &MessageMetadata{}
+	}
+	var toJSON sql.NullString
+	if len(meta.To) > 0 {
+		data, _ := json.Marshal(meta.To)
+		toJSON = sql.NullString{String: string(data), Valid: true}
+	}
 
 	// Insert message metadata
 	dbResult, err := s.db.ExecContext(ctx,
-		`INSERT INTO messages (mailbox_id, uid, maildir_key, size, internal_date, flags)
-		 VALUES (?, ?, ?, ?, ?, ?)`,
-		mailboxID, uid, finalKey, size, date, flagsStr,
+		`INSERT INTO messages (mailbox_id, uid, maildir_key, size, internal_date, flags, seen,
+		                       message_id, subject, from_address, to_addresses, in_reply_to, references_header, email_id, body_key)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		mailboxID, uid, finalKey, size, date, flagsStr, hasSeenFlag(flags),
+		meta.MessageID, meta.Subject, meta.From, toJSON, meta.InReplyTo, meta.References, emailObjectID(hash.Sum(nil)), bodyKey,
 	)
 	if err != nil {
 		// Clean up file on database error
-		os.Remove(destPath)
+		discard()
 		return nil, fmt.Errorf("failed to insert message metadata: %w", err)
 	}
 
@@ -400,9 +752,6 @@ func (s *Store) AppendMessage(ctx context.Context, mailboxID int64, flags []stor
 		// In production, implement proper logging here
 	}
 
-	// Notify IDLE listeners via the maildir
-	dir.Unseen()
-
 	return &storage.Message{
 		ID:           msgID,
 		MailboxID:    mailboxID,
@@ -411,10 +760,31 @@ func (s *Store) AppendMessage(ctx context.Context, mailboxID int64, flags []stor
 		Size:         size,
 		InternalDate: date,
 		Flags:        flags,
+		MessageID:    meta.MessageID,
+		Subject:      meta.Subject,
+		From:         meta.From,
+		To:           meta.To,
+		InReplyTo:    meta.InReplyTo,
+		References:   meta.References,
 		CreatedAt:    time.Now(),
 	}, nil
 }
 
+// headerCapture keeps the start of a message, enough for ParseMessageHeaders
+type headerCapture struct {
+	bytes.Buffer
+}
+
+func (h *headerCapture) Write(p []byte) (int, error) {
+	if room := 64*1024 - h.Len(); room > 0 {
+		if len(p) < room {
+			room = len(p)
+		}
+		h.Buffer.Write(p[:room])
+	}
+	return len(p), nil
+}
+
 // GetMessage retrieves message metadata by UID
 func (s *Store) GetMessage(ctx context.Context, mailboxID int64, uid uint32) (*storage.Message, error) {
 	var msg storage.Message
@@ -432,7 +802,7 @@ func (s *Store) GetMessage(ctx context.Context, mailboxID int64, uid uint32) (*s
 
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return nil, fmt.Errorf("message not found: mailbox=%d uid=%d", mailboxID, uid)
+			return nil, fmt.Errorf("%w: mailbox=%d uid=%d", storage.ErrMessageNotFound, mailboxID, uid)
 		}
 		return nil, fmt.Errorf("failed to query message mailbox=%d uid=%d: %w", mailboxID, uid, err)
 	}
@@ -450,8 +820,49 @@ func (s *Store) GetMessage(ctx context.Context, mailboxID int64, uid uint32) (*s
 	return &msg, nil
 }
 
-// GetMessageBody retrieves the message content from the filesystem
+// FindRecentMessage returns the newest message in the mailbox with the given
+// Message-ID that was stored within the last window, or nil if there is none
+func (s *Store) FindRecentMessage(ctx context.Context, mailboxID int64, messageID string, window time.Duration) (*storage.Message, error) {
+	if messageID == "" || window <= 0 {
+		return nil, nil
+	}
+
+	var uid uint32
+	err := s.db.QueryRowContext(ctx,
+		`SELECT uid FROM messages
+		 WHERE mailbox_id = ? AND message_id = ? AND created_at >= datetime('now', ?)
+		 ORDER BY uid DESC LIMIT 1`,
+		mailboxID, messageID, fmt.Sprintf("-%d seconds", int64(window.Seconds())),
+	).Scan(&uid)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query message-id %q: %w", messageID, err)
+	}
+	return s.GetMessage(ctx, mailboxID, uid)
+}
+
+// GetMessageBody retrieves the message content from the filesystem, or from
+// the body store for messages kept there
 func (s *Store) GetMessageBody(ctx context.Context, msg *storage.Message) (io.ReadCloser, error) {
+	var bodyKey sql.NullString
+	err := s.db.QueryRowContext(ctx,
+		"SELECT body_key FROM messages WHERE mailbox_id = ? AND uid = ?", msg.MailboxID, msg.UID,
+	).Scan(&bodyKey)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("failed to query message mailbox=%d uid=%d: %w", msg.MailboxID, msg.UID, err)
+	}
+	if bodyKey.Valid {
+		s.mu.RLock()
+		bodies := s.bodies
+		s.mu.RUnlock()
+		if bodies == nil {
+			return nil, fmt.Errorf("message %s is in object storage, which isn't configured", msg.MaildirKey)
+		}
+		return bodies.Get(ctx, bodyKey.String)
+	}
+
 	// Get mailbox to find path
 	mb, err := s.GetMailboxByID(ctx, msg.MailboxID)
 	if err != nil {
@@ -559,7 +970,8 @@ func (s *Store) ListMessages(ctx context.Context, mailboxID int64, start, end ui
 	return messages, rows.Err()
 }
 
-// UpdateFlags adds or removes flags from a message
+// UpdateFlags adds or removes flags from a message. Flags, including
+// keywords, match case-insensitively as in IMAP.
 func (s *Store) UpdateFlags(ctx context.Context, mailboxID int64, uid uint32, flags []storage.Flag, add bool) error {
 	msg, err := s.GetMessage(ctx, mailboxID, uid)
 	if err != nil {
@@ -568,25 +980,12 @@ func (s *Store) UpdateFlags(ctx context.Context, mailboxID int64, uid uint32, fl
 
 	var newFlags []storage.Flag
 	if add {
-		// Add flags (avoiding duplicates)
-		flagSet := make(map[storage.Flag]bool)
-		for _, f := range msg.Flags {
-			flagSet[f] = true
-		}
-		for _, f := range flags {
-			flagSet[f] = true
-		}
-		for f := range flagSet {
-			newFlags = append(newFlags, f)
-		}
+		// Existing flags first, so their spelling wins over the new ones
+		newFlags = append(append(newFlags, msg.Flags...), flags...)
 	} else {
 		// Remove flags
-		removeSet := make(map[storage.Flag]bool)
-		for _, f := range flags {
-			removeSet[f] = true
-		}
 		for _, f := range msg.Flags {
-			if !removeSet[f] {
+			if !slices.ContainsFunc(flags, func(r storage.Flag) bool { return strings.EqualFold(string(r), string(f)) }) {
 				newFlags = append(newFlags, f)
 			}
 		}
@@ -597,6 +996,7 @@ func (s *Store) UpdateFlags(ctx context.Context, mailboxID int64, uid uint32, fl
 
 // SetFlags sets the exact flags for a message
 func (s *Store) SetFlags(ctx context.Context, mailboxID int64, uid uint32, flags []storage.Flag) error {
+	defer s.mailboxChanged(mailboxID)
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -605,11 +1005,13 @@ func (s *Store) SetFlags(ctx context.Context, mailboxID int64, uid uint32, flags
 		return err
 	}
 
+	flags = normalizeFlags(flags)
+
 	// Update database
 	flagsStr := flagsToString(flags)
 	_, err = s.db.ExecContext(ctx,
-		"UPDATE messages SET flags = ? WHERE mailbox_id = ? AND uid = ?",
-		flagsStr, mailboxID, uid,
+		"UPDATE messages SET flags = ?, seen = ? WHERE mailbox_id = ? AND uid = ?",
+		flagsStr, hasSeenFlag(flags), mailboxID, uid,
 	)
 	if err != nil {
 		return err
@@ -649,16 +1051,9 @@ func (s *Store) SetFlags(ctx context.Context, mailboxID int64, uid uint32, flags
 		newKey = baseKey + ":2," + flagSuffix
 	}
 
-	// Determine destination directory
-	destDir := "new"
-	for _, f := range flags {
-		if f == storage.FlagSeen {
-			destDir = "cur"
-			break
-		}
-	}
-
-	newPath := filepath.Join(path, destDir, newKey)
+	// A message whose flags are known has been seen by a client, so it
+	// belongs in "cur" even when \Seen is cleared
+	newPath := filepath.Join(path, "cur", newKey)
 
 	if oldPath != newPath {
 		if err := os.Rename(oldPath, newPath); err != nil {
@@ -696,13 +1091,6 @@ func (s *Store) CopyMessage(ctx context.Context, srcMailboxID int64, uid uint32,
 		return nil, err
 	}
 
-	// Get message body
-	body, err := s.GetMessageBody(ctx, srcMsg)
-	if err != nil {
-		return nil, err
-	}
-	defer body.Close()
-
 	// Remove \Recent flag for copy
 	flags := make([]storage.Flag, 0, len(srcMsg.Flags))
 	for _, f := range srcMsg.Flags {
@@ -711,6 +1099,24 @@ func (s *Store) CopyMessage(ctx context.Context, srcMailboxID int64, uid uint32,
 		}
 	}
 
+	// A body in the body store is shared with the copy rather than copied
+	var bodyKey sql.NullString
+	if err := s.db.QueryRowContext(ctx,
+		"SELECT body_key FROM messages WHERE mailbox_id = ? AND uid = ?", srcMailboxID, uid,
+	).Scan(&bodyKey); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("failed to query message mailbox=%d uid=%d: %w", srcMailboxID, uid, err)
+	}
+	if bodyKey.Valid {
+		return s.copyStoredMessage(ctx, srcMsg, destMailboxID, flags)
+	}
+
+	// Get message body
+	body, err := s.GetMessageBody(ctx, srcMsg)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
 	// Append to destination
 	return s.AppendMessage(ctx, destMailboxID, flags, srcMsg.InternalDate, body)
 }
@@ -732,12 +1138,13 @@ func (s *Store) MoveMessage(ctx context.Context, srcMailboxID int64, uid uint32,
 
 // ExpungeMailbox permanently removes messages marked \Deleted
 func (s *Store) ExpungeMailbox(ctx context.Context, mailboxID int64) ([]uint32, error) {
+	defer s.mailboxChanged(mailboxID)
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	// Find messages with \Deleted flag
 	rows, err := s.db.QueryContext(ctx,
-		"SELECT uid, maildir_key FROM messages WHERE mailbox_id = ? AND flags LIKE '%\\Deleted%'",
+		"SELECT uid, maildir_key, body_key FROM messages WHERE mailbox_id = ? AND flags LIKE '%\\Deleted%'",
 		mailboxID,
 	)
 	if err != nil {
@@ -753,12 +1160,15 @@ func (s *Store) ExpungeMailbox(ctx context.Context, mailboxID int64) ([]uint32,
 	path := s.getUserMaildirPath(mb.UserID, mb.Name)
 
 	var expunged []uint32
+	var bodyKeys []string
 	for rows.Next() {
 		var uid uint32
 		var key string
-		if err := rows.Scan(&uid, &key); err != nil {
+		var bodyKey sql.NullString
+		if err := rows.Scan(&uid, &key, &bodyKey); err != nil {
 			continue
 		}
+		bodyKeys = append(bodyKeys, nullStrings(bodyKey)...)
 
 		// Remove file
 		for _, subdir := range []string{"cur", "new"} {
@@ -775,17 +1185,100 @@ func (s *Store) ExpungeMailbox(ctx context.Context, mailboxID int64) ([]uint32,
 			"DELETE FROM messages WHERE mailbox_id = ? AND flags LIKE '%\\Deleted%'",
 			mailboxID,
 		)
+		if err == nil {
+			s.releaseBodies(bodyKeys)
+		}
 	}
 
 	return expunged, err
 }
 
+// ExpungeUIDs permanently removes the messages in uids that are marked
+// \Deleted. Other \Deleted messages in the mailbox are left in place, as
+// UID EXPUNGE (RFC 4315) requires.
+func (s *Store) ExpungeUIDs(ctx context.Context, mailboxID int64, uids []uint32) ([]uint32, error) {
+	defer s.mailboxChanged(mailboxID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mb, err := s.GetMailboxByID(ctx, mailboxID)
+	if err != nil {
+		return nil, err
+	}
+	path := s.getUserMaildirPath(mb.UserID, mb.Name)
+
+	var expunged []uint32
+	for len(uids) > 0 {
+		batch := uids[:min(len(uids), 500)]
+		uids = uids[len(batch):]
+
+		args := []any{mailboxID}
+		for _, uid := range batch {
+			args = append(args, uid)
+		}
+		in := "(?" + strings.Repeat(", ?", len(batch)-1) + ")"
+
+		rows, err := s.db.QueryContext(ctx,
+			"SELECT uid, maildir_key, body_key FROM messages WHERE mailbox_id = ? AND uid IN "+in+" AND flags LIKE '%\\Deleted%' ORDER BY uid",
+			args...,
+		)
+		if err != nil {
+			return expunged, err
+		}
+		var found []any
+		var bodyKeys []string
+		for rows.Next() {
+			var uid uint32
+			var key string
+			var bodyKey sql.NullString
+			if err := rows.Scan(&uid, &key, &bodyKey); err != nil {
+				rows.Close()
+				return expunged, err
+			}
+			bodyKeys = append(bodyKeys, nullStrings(bodyKey)...)
+			for _, subdir := range []string{"cur", "new"} {
+				os.Remove(filepath.Join(path, subdir, key))
+			}
+			found = append(found, uid)
+			expunged = append(expunged, uid)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return expunged, err
+		}
+		if len(found) == 0 {
+			continue
+		}
+
+		_, err = s.db.ExecContext(ctx,
+			"DELETE FROM messages WHERE mailbox_id = ? AND uid IN (?"+strings.Repeat(", ?", len(found)-1)+")",
+			append([]any{mailboxID}, found...)...,
+		)
+		if err != nil {
+			return expunged, err
+		}
+		s.releaseBodies(bodyKeys)
+	}
+
+	return expunged, nil
+}
+
 // expungeMessage permanently removes a single message
 func (s *Store) expungeMessage(ctx context.Context, mailboxID int64, uid uint32) error {
+	defer s.mailboxChanged(mailboxID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	msg, err := s.GetMessage(ctx, mailboxID, uid)
 	if err != nil {
 		return err
 	}
+	var bodyKey sql.NullString
+	if err := s.db.QueryRowContext(ctx,
+		"SELECT body_key FROM messages WHERE mailbox_id = ? AND uid = ?", mailboxID, uid,
+	).Scan(&bodyKey); err != nil {
+		return err
+	}
 
 	mb, err := s.GetMailboxByID(ctx, msg.MailboxID)
 	if err != nil {
@@ -801,9 +1294,12 @@ func (s *Store) expungeMessage(ctx context.Context, mailboxID int64, uid uint32)
 	}
 
 	// Delete from database
-	_, err = s.db.ExecContext(ctx, "DELETE FROM messages WHERE mailbox_id = ? AND uid = ?",
-		mailboxID, uid)
-	return err
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM messages WHERE mailbox_id = ? AND uid = ?",
+		mailboxID, uid); err != nil {
+		return err
+	}
+	s.releaseBodies(nullStrings(bodyKey))
+	return nil
 }
 
 // SearchMessages searches for messages matching criteria
@@ -841,10 +1337,18 @@ func (s *Store) SearchMessages(ctx context.Context, mailboxID int64, criteria *s
 			args = append(args, criteria.Smaller)
 		}
 		for _, flag := range criteria.Flags {
+			if strings.EqualFold(string(flag), string(storage.FlagSeen)) {
+				query += " AND seen = TRUE"
+				continue
+			}
 			query += " AND flags LIKE ?"
 			args = append(args, "%"+string(flag)+"%")
 		}
 		for _, flag := range criteria.NotFlags {
+			if strings.EqualFold(string(flag), string(storage.FlagSeen)) {
+				query += " AND seen = FALSE"
+				continue
+			}
 			query += " AND flags NOT LIKE ?"
 			args = append(args, "%"+string(flag)+"%")
 		}
@@ -872,6 +1376,11 @@ func (s *Store) SearchMessages(ctx context.Context, mailboxID int64, criteria *s
 
 // GetMailboxStats returns statistics for a mailbox
 func (s *Store) GetMailboxStats(ctx context.Context, mailboxID int64) (*storage.MailboxStats, error) {
+	cached, gen := s.stats.get(mailboxID)
+	if cached != nil {
+		return cached, nil
+	}
+
 	mb, err := s.GetMailboxByID(ctx, mailboxID)
 	if err != nil {
 		return nil, err
@@ -891,21 +1400,123 @@ func (s *Store) GetMailboxStats(ctx context.Context, mailboxID int64) (*storage.
 	}
 
 	// Count unseen
-	err = s.db.QueryRowContext(ctx,
-		"SELECT COUNT(*) FROM messages WHERE mailbox_id = ? AND flags NOT LIKE '%\\Seen%'",
-		mailboxID,
-	).Scan(&stats.Unseen)
+	err = s.db.QueryRowContext(ctx, unseenCountQuery, mailboxID).Scan(&stats.Unseen)
 	if err != nil {
 		return nil, err
 	}
 
-	// Recent is typically messages in "new" directory
-	// For simplicity, we count messages without \Seen flag
-	stats.Recent = stats.Unseen
+	// Recent messages are the ones no client has seen yet, still in "new"
+	stats.Recent, err = maildir.Dir(s.getUserMaildirPath(mb.UserID, mb.Name)).UnseenCount()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to count new messages: %w", err)
+	}
 
+	s.stats.put(mailboxID, gen, &stats)
 	return &stats, nil
 }
 
+// ClearRecent moves every message in the mailbox's "new" directory to "cur",
+// since the client selecting the mailbox has now seen them, and returns the
+// UIDs that were recent. Only the first session to select a mailbox after a
+// delivery sees a message as \Recent.
+func (s *Store) ClearRecent(ctx context.Context, mailboxID int64) ([]uint32, error) {
+	defer s.mailboxChanged(mailboxID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mb, err := s.GetMailboxByID(ctx, mailboxID)
+	if err != nil {
+		return nil, err
+	}
+
+	path := s.getUserMaildirPath(mb.UserID, mb.Name)
+	entries, err := os.ReadDir(filepath.Join(path, "new"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read new directory: %w", err)
+	}
+
+	// Files in "cur" carry the :2, info suffix, even with no flags set
+	var keys []any
+	renamed := make(map[string]string)
+	for _, entry := range entries {
+		name := entry.Name()
+		curName := name
+		if !strings.Contains(name, ":2,") {
+			curName = name + ":2,"
+		}
+		if err := os.Rename(filepath.Join(path, "new", name), filepath.Join(path, "cur", curName)); err != nil {
+			return nil, fmt.Errorf("failed to move message to cur: %w", err)
+		}
+		keys = append(keys, name)
+		renamed[name] = curName
+	}
+
+	var uids []uint32
+	for len(keys) > 0 {
+		batch := keys[:min(len(keys), 500)]
+		keys = keys[len(batch):]
+
+		args := append([]any{mailboxID}, batch...)
+		rows, err := s.db.QueryContext(ctx,
+			"SELECT uid, maildir_key FROM messages WHERE mailbox_id = ? AND maildir_key IN (?"+strings.Repeat(", ?", len(batch)-1)+") ORDER BY uid",
+			args...,
+		)
+		if err != nil {
+			return nil, err
+		}
+		var moved []uint32
+		var oldKeys []string
+		for rows.Next() {
+			var uid uint32
+			var key string
+			if err := rows.Scan(&uid, &key); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			moved = append(moved, uid)
+			oldKeys = append(oldKeys, key)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+
+		for i, uid := range moved {
+			if renamed[oldKeys[i]] == oldKeys[i] {
+				continue
+			}
+			if _, err := s.db.ExecContext(ctx,
+				"UPDATE messages SET maildir_key = ? WHERE mailbox_id = ? AND uid = ?",
+				renamed[oldKeys[i]], mailboxID, uid,
+			); err != nil {
+				return nil, fmt.Errorf("failed to update maildir_key in database: %w", err)
+			}
+		}
+		uids = append(uids, moved...)
+	}
+
+	return uids, nil
+}
+
+// checkQuota returns ErrOverQuota if size more bytes would take the user
+// over their quota. A quota of 0 is unlimited.
+func (s *Store) checkQuota(ctx context.Context, userID int64, size int64) error {
+	var quota, used int64
+	err := s.db.QueryRowContext(ctx,
+		"SELECT quota_bytes, used_bytes FROM users WHERE id = ?", userID,
+	).Scan(&quota, &used)
+	if err != nil {
+		return fmt.Errorf("failed to get quota for user %d: %w", userID, err)
+	}
+	if quota > 0 && used+size > quota {
+		return fmt.Errorf("%w: user=%d used=%d size=%d quota=%d", storage.ErrOverQuota, userID, used, size, quota)
+	}
+	return nil
+}
+
 // UpdateUserQuota updates the used quota for a user
 func (s *Store) UpdateUserQuota(ctx context.Context, userID int64, deltaBytes int64) error {
 	_, err := s.db.ExecContext(ctx,
@@ -942,6 +1553,66 @@ func buildMaildirFlags(flags []storage.Flag) string {
 	return result.String()
 }
 
+// unseenCountQuery counts a mailbox's unseen messages. The seen column
+// mirrors \Seen in flags so that idx_messages_unseen can answer it.
+const unseenCountQuery = "SELECT COUNT(*) FROM messages WHERE mailbox_id = ? AND seen = FALSE"
+
+// hasSeenFlag reports whether flags include \Seen, for the seen column
+func hasSeenFlag(flags []storage.Flag) bool {
+	return slices.ContainsFunc(flags, func(f storage.Flag) bool {
+		return strings.EqualFold(string(f), string(storage.FlagSeen))
+	})
+}
+
+// normalizeFlags drops \Recent, which is never stored, and duplicates
+// that differ only in case. Flags containing a comma are dropped as well
+// since the flags column is comma-separated.
+func normalizeFlags(flags []storage.Flag) []storage.Flag {
+	var result []storage.Flag
+	for _, f := range flags {
+		if f == "" || strings.EqualFold(string(f), string(storage.FlagRecent)) || strings.Contains(string(f), ",") {
+			continue
+		}
+		if slices.ContainsFunc(result, func(r storage.Flag) bool { return strings.EqualFold(string(r), string(f)) }) {
+			continue
+		}
+		result = append(result, f)
+	}
+	return result
+}
+
+// MailboxKeywords returns the keywords (flags other than system flags) set
+// on any message in the mailbox, sorted, with one spelling of each
+func (s *Store) MailboxKeywords(ctx context.Context, mailboxID int64) ([]storage.Flag, error) {
+	// Split each message's flags and keep one spelling of each keyword,
+	// since keywords differing only in case are the same keyword
+	rows, err := s.db.QueryContext(ctx, `
+		WITH RECURSIVE split(flag, rest) AS (
+			SELECT '', flags || ',' FROM messages WHERE mailbox_id = ? AND flags != ''
+			UNION ALL
+			SELECT substr(rest, 1, instr(rest, ',') - 1), substr(rest, instr(rest, ',') + 1)
+			FROM split WHERE rest != ''
+		)
+		SELECT MIN(flag) FROM split
+		WHERE flag != '' AND substr(flag, 1, 1) != '\'
+		GROUP BY lower(flag)
+		ORDER BY MIN(flag)`, mailboxID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keywords []storage.Flag
+	for rows.Next() {
+		var keyword string
+		if err := rows.Scan(&keyword); err != nil {
+			return nil, err
+		}
+		keywords = append(keywords, storage.Flag(keyword))
+	}
+	return keywords, rows.Err()
+}
+
 func flagsToString(flags []storage.Flag) string {
 	strs := make([]string, len(flags))
 	for i, f := range flags {
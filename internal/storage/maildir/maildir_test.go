@@ -3,12 +3,16 @@ package maildir
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/fenilsonani/email-server/internal/storage"
+	"github.com/fenilsonani/email-server/internal/storage/metadata"
 	_ "github.com/mattn/go-sqlite3"
 )
 
@@ -66,12 +70,15 @@ func setupTestStore(t *testing.T) (*Store, func()) {
 			size INTEGER NOT NULL,
 			internal_date DATETIME NOT NULL,
 			flags TEXT DEFAULT '',
+			seen BOOLEAN NOT NULL DEFAULT FALSE,
 			message_id TEXT,
 			subject TEXT,
 			from_address TEXT,
 			to_addresses TEXT,
 			in_reply_to TEXT,
 			references_header TEXT,
+			email_id TEXT,
+			body_key TEXT,
 			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 			UNIQUE(mailbox_id, uid)
 		);
@@ -96,6 +103,7 @@ func setupTestStore(t *testing.T) (*Store, func()) {
 	}
 
 	cleanup := func() {
+		store.Close()
 		db.Close()
 		os.RemoveAll(tmpDir)
 	}
@@ -139,6 +147,170 @@ func TestStore_CreateMailbox(t *testing.T) {
 	}
 }
 
+func TestStore_CreateMailboxCountLimit(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	store.SetMailboxLimits(3, 0)
+	for _, name := range []string{"INBOX", "Sent", "Trash"} {
+		if _, err := store.CreateMailbox(ctx, 1, name, ""); err != nil {
+			t.Fatalf("CreateMailbox(%s) failed: %v", name, err)
+		}
+	}
+
+	_, err := store.CreateMailbox(ctx, 1, "Projects", "")
+	if !errors.Is(err, storage.ErrMailboxLimit) {
+		t.Fatalf("CreateMailbox past the count limit = %v, want ErrMailboxLimit", err)
+	}
+	if _, err := store.GetMailbox(ctx, 1, "Projects"); err == nil {
+		t.Error("Mailbox over the limit was created")
+	}
+
+	// Deleting one makes room again
+	if err := store.DeleteMailbox(ctx, 1, "Trash"); err != nil {
+		t.Fatalf("DeleteMailbox failed: %v", err)
+	}
+	if _, err := store.CreateMailbox(ctx, 1, "Projects", ""); err != nil {
+		t.Errorf("CreateMailbox after freeing a slot failed: %v", err)
+	}
+}
+
+func TestStore_CreateMailboxDepthLimit(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	store.SetMailboxLimits(0, 2)
+	if _, err := store.CreateMailbox(ctx, 1, "Work/Clients", ""); err != nil {
+		t.Fatalf("CreateMailbox at the depth limit failed: %v", err)
+	}
+
+	_, err := store.CreateMailbox(ctx, 1, "Work/Clients/Acme", "")
+	if !errors.Is(err, storage.ErrMailboxLimit) {
+		t.Fatalf("CreateMailbox past the depth limit = %v, want ErrMailboxLimit", err)
+	}
+	err = store.RenameMailbox(ctx, 1, "Work/Clients", "Work/Clients/Old")
+	if !errors.Is(err, storage.ErrMailboxLimit) {
+		t.Errorf("RenameMailbox past the depth limit = %v, want ErrMailboxLimit", err)
+	}
+}
+
+func TestStore_RenameMailboxMovesChildren(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	store.SetMailboxLimits(0, 3)
+	for _, name := range []string{"Work/Clients/Acme", "Workshop"} {
+		if _, err := store.CreateMailbox(ctx, 1, name, ""); err != nil {
+			t.Fatalf("CreateMailbox(%s) failed: %v", name, err)
+		}
+	}
+
+	// Work/Clients/Acme would become Old/Work/Clients/Acme
+	if err := store.RenameMailbox(ctx, 1, "Work", "Old/Work"); !errors.Is(err, storage.ErrMailboxLimit) {
+		t.Errorf("RenameMailbox taking a child past the depth limit = %v, want ErrMailboxLimit", err)
+	}
+
+	if err := store.RenameMailbox(ctx, 1, "Work", "Jobs"); err != nil {
+		t.Fatalf("RenameMailbox failed: %v", err)
+	}
+	for _, name := range []string{"Jobs", "Jobs/Clients", "Jobs/Clients/Acme", "Workshop"} {
+		if _, err := store.GetMailbox(ctx, 1, name); err != nil {
+			t.Errorf("GetMailbox(%s) after rename failed: %v", name, err)
+		}
+		if _, err := os.Stat(filepath.Join(store.getUserMaildirPath(1, name), "cur")); err != nil {
+			t.Errorf("maildir of %s missing: %v", name, err)
+		}
+	}
+	if _, err := store.GetMailbox(ctx, 1, "Work/Clients"); err == nil {
+		t.Error("Work/Clients still exists after renaming Work")
+	}
+}
+
+func TestStore_CreateMailboxMakesParents(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	if _, err := store.CreateMailbox(ctx, 1, "Projects/2026/Q1", ""); err != nil {
+		t.Fatalf("CreateMailbox failed: %v", err)
+	}
+	for _, name := range []string{"Projects", "Projects/2026", "Projects/2026/Q1"} {
+		if _, err := store.GetMailbox(ctx, 1, name); err != nil {
+			t.Errorf("GetMailbox(%s) failed: %v", name, err)
+		}
+		if _, err := os.Stat(filepath.Join(store.getUserMaildirPath(1, name), "cur")); err != nil {
+			t.Errorf("maildir of %s missing: %v", name, err)
+		}
+	}
+	if _, err := store.CreateMailbox(ctx, 1, "Projects/2026", ""); !errors.Is(err, storage.ErrMailboxExists) {
+		t.Errorf("CreateMailbox of a created parent = %v, want ErrMailboxExists", err)
+	}
+
+	// Renaming into a new parent creates it, within the count limit
+	store.SetMailboxLimits(4, 0)
+	if err := store.RenameMailbox(ctx, 1, "Projects/2026/Q1", "Done/2026/Q1"); !errors.Is(err, storage.ErrMailboxLimit) {
+		t.Errorf("RenameMailbox needing two parents with room for one = %v, want ErrMailboxLimit", err)
+	}
+	store.SetMailboxLimits(0, 0)
+	if err := store.RenameMailbox(ctx, 1, "Projects/2026/Q1", "Done/2026/Q1"); err != nil {
+		t.Fatalf("RenameMailbox failed: %v", err)
+	}
+	for _, name := range []string{"Done", "Done/2026", "Done/2026/Q1"} {
+		if _, err := store.GetMailbox(ctx, 1, name); err != nil {
+			t.Errorf("GetMailbox(%s) after rename failed: %v", name, err)
+		}
+	}
+}
+
+func TestStore_FailedCreateOrRenameLeavesNoParents(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	if _, err := store.CreateMailbox(ctx, 1, "Projects", ""); err != nil {
+		t.Fatalf("CreateMailbox failed: %v", err)
+	}
+	// A file where a maildir must go makes creating or moving there fail
+	for _, name := range []string{"New/2026/Q1", "Done/2026"} {
+		if err := os.MkdirAll(filepath.Dir(store.getUserMaildirPath(1, name)), 0750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(store.getUserMaildirPath(1, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := store.CreateMailbox(ctx, 1, "New/2026/Q1", ""); err == nil {
+		t.Fatal("CreateMailbox over a file succeeded")
+	}
+	if err := store.RenameMailbox(ctx, 1, "Projects", "Done/2026"); err == nil {
+		t.Fatal("RenameMailbox onto a file succeeded")
+	}
+
+	mailboxes, err := store.ListMailboxes(ctx, 1)
+	if err != nil {
+		t.Fatalf("ListMailboxes failed: %v", err)
+	}
+	if len(mailboxes) != 1 || mailboxes[0].Name != "Projects" {
+		names := make([]string, len(mailboxes))
+		for i, mb := range mailboxes {
+			names[i] = mb.Name
+		}
+		t.Errorf("mailboxes after failures = %q, want only Projects", names)
+	}
+	for _, name := range []string{"New", "New/2026", "Done"} {
+		if _, err := os.Stat(store.getUserMaildirPath(1, name)); !os.IsNotExist(err) {
+			t.Errorf("maildir of %s left behind: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(store.getUserMaildirPath(1, "Projects"), "cur")); err != nil {
+		t.Errorf("maildir of Projects missing after the failed rename: %v", err)
+	}
+}
+
 func TestStore_GetMailbox(t *testing.T) {
 	store, cleanup := setupTestStore(t)
 	defer cleanup()
@@ -196,6 +368,50 @@ func TestStore_ListMailboxes(t *testing.T) {
 	}
 }
 
+func TestStore_InitializeUserMailboxesCustomSet(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	userID := int64(1)
+
+	// INBOX is left out on purpose; it must still be created
+	store.SetDefaultMailboxes([]storage.DefaultMailbox{
+		{Name: "Entwürfe", SpecialUse: storage.SpecialUseDrafts},
+		{Name: "Gesendet", SpecialUse: storage.SpecialUseSent},
+		{Name: "Papierkorb", SpecialUse: storage.SpecialUseTrash},
+		{Name: "Vorlagen"},
+	})
+	if err := store.InitializeUserMailboxes(ctx, userID); err != nil {
+		t.Fatalf("InitializeUserMailboxes failed: %v", err)
+	}
+
+	want := map[string]storage.SpecialUse{
+		"INBOX":      "",
+		"Entwürfe":   storage.SpecialUseDrafts,
+		"Gesendet":   storage.SpecialUseSent,
+		"Papierkorb": storage.SpecialUseTrash,
+		"Vorlagen":   "",
+	}
+	result, err := store.ListMailboxes(ctx, userID)
+	if err != nil {
+		t.Fatalf("ListMailboxes failed: %v", err)
+	}
+	if len(result) != len(want) {
+		t.Fatalf("Expected %d mailboxes, got %d", len(want), len(result))
+	}
+	for _, mb := range result {
+		use, ok := want[mb.Name]
+		if !ok {
+			t.Errorf("Unexpected mailbox %q", mb.Name)
+			continue
+		}
+		if mb.SpecialUse != use {
+			t.Errorf("Mailbox %q special use = %q, want %q", mb.Name, mb.SpecialUse, use)
+		}
+	}
+}
+
 func TestStore_RenameMailbox(t *testing.T) {
 	store, cleanup := setupTestStore(t)
 	defer cleanup()
@@ -470,6 +686,38 @@ func TestStore_SetFlags(t *testing.T) {
 	}
 }
 
+func TestStore_Keywords(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	mb, _ := store.CreateMailbox(ctx, 1, "INBOX", "")
+	store.AppendMessage(ctx, mb.ID, []storage.Flag{"$Forwarded"}, time.Now(), strings.NewReader("Message"))
+	store.AppendMessage(ctx, mb.ID, nil, time.Now(), strings.NewReader("Message"))
+	store.AppendMessage(ctx, mb.ID, []storage.Flag{"$forwarded", storage.FlagSeen}, time.Now(), strings.NewReader("Message"))
+
+	flags := []storage.Flag{storage.FlagSeen, "$Label1", "$label1", storage.FlagRecent, "bad,keyword"}
+	if err := store.UpdateFlags(ctx, mb.ID, 2, flags, true); err != nil {
+		t.Fatalf("UpdateFlags failed: %v", err)
+	}
+	msg, _ := store.GetMessage(ctx, mb.ID, 2)
+	if want := []storage.Flag{storage.FlagSeen, "$Label1"}; !slices.Equal(msg.Flags, want) {
+		t.Errorf("Flags = %v, want %v", msg.Flags, want)
+	}
+	// Only system flags go in the maildir filename
+	if !strings.HasSuffix(msg.MaildirKey, ":2,S") {
+		t.Errorf("MaildirKey = %q, want the :2,S suffix", msg.MaildirKey)
+	}
+
+	keywords, err := store.MailboxKeywords(ctx, mb.ID)
+	if err != nil {
+		t.Fatalf("MailboxKeywords failed: %v", err)
+	}
+	if want := []storage.Flag{"$Forwarded", "$Label1"}; !slices.Equal(keywords, want) {
+		t.Errorf("MailboxKeywords() = %v, want %v", keywords, want)
+	}
+}
+
 func TestStore_CopyMessage(t *testing.T) {
 	store, cleanup := setupTestStore(t)
 	defer cleanup()
@@ -577,6 +825,75 @@ func TestStore_ExpungeMailbox(t *testing.T) {
 	}
 }
 
+func TestStore_ExpungeUIDs(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	userID := int64(1)
+
+	mb, _ := store.CreateMailbox(ctx, userID, "INBOX", "")
+	deleted := []storage.Flag{storage.FlagDeleted}
+	store.AppendMessage(ctx, mb.ID, deleted, time.Now(), strings.NewReader("Message 1"))
+	store.AppendMessage(ctx, mb.ID, deleted, time.Now(), strings.NewReader("Message 2"))
+	store.AppendMessage(ctx, mb.ID, nil, time.Now(), strings.NewReader("Message 3"))
+
+	// UID 3 is in the set but not \Deleted, UID 1 is \Deleted but not in the set
+	expunged, err := store.ExpungeUIDs(ctx, mb.ID, []uint32{2, 3})
+	if err != nil {
+		t.Fatalf("ExpungeUIDs failed: %v", err)
+	}
+	if len(expunged) != 1 || expunged[0] != 2 {
+		t.Errorf("Expected UID 2 expunged, got %v", expunged)
+	}
+
+	messages, _ := store.ListMessages(ctx, mb.ID, 0, 0)
+	if len(messages) != 2 || messages[0].UID != 1 || messages[1].UID != 3 {
+		t.Errorf("Expected UIDs 1 and 3 to remain, got %d messages", len(messages))
+	}
+}
+
+func TestStore_MessageObjectIDs(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	inbox, _ := store.CreateMailbox(ctx, 1, "INBOX", "")
+	archive, _ := store.CreateMailbox(ctx, 1, "Archive", "")
+	store.AppendMessage(ctx, inbox.ID, nil, time.Now(), strings.NewReader("Message-ID: <a@test.com>\r\n\r\nBody"))
+
+	emailID, threadID, err := store.MessageObjectIDs(ctx, inbox.ID, 1)
+	if err != nil {
+		t.Fatalf("MessageObjectIDs failed: %v", err)
+	}
+	if _, err := store.CopyMessage(ctx, inbox.ID, 1, archive.ID); err != nil {
+		t.Fatalf("CopyMessage failed: %v", err)
+	}
+	copyEmailID, copyThreadID, err := store.MessageObjectIDs(ctx, archive.ID, 1)
+	if err != nil {
+		t.Fatalf("MessageObjectIDs failed: %v", err)
+	}
+	if copyEmailID != emailID || copyThreadID != threadID {
+		t.Errorf("copy's IDs = %s, %s; want %s, %s", copyEmailID, copyThreadID, emailID, threadID)
+	}
+
+	// Messages stored before object IDs existed get theirs from the file
+	store.db.Exec("UPDATE messages SET email_id = NULL")
+	if legacy, _, err := store.MessageObjectIDs(ctx, inbox.ID, 1); err != nil || legacy != emailID {
+		t.Errorf("MessageObjectIDs() without a stored id = %s, %v; want %s", legacy, err, emailID)
+	}
+
+	// In bulk, UIDs without a message are left out
+	store.db.Exec("UPDATE messages SET email_id = NULL")
+	ids, err := store.MessagesObjectIDs(ctx, archive.ID, []uint32{1, 7})
+	if err != nil {
+		t.Fatalf("MessagesObjectIDs failed: %v", err)
+	}
+	if len(ids) != 1 || ids[1].EmailID != emailID || ids[1].ThreadID != threadID {
+		t.Errorf("MessagesObjectIDs() = %+v, want UID 1 with %s, %s", ids, emailID, threadID)
+	}
+}
+
 func TestStore_SearchMessages(t *testing.T) {
 	store, cleanup := setupTestStore(t)
 	defer cleanup()
@@ -644,3 +961,258 @@ func TestStore_GetMailboxStats(t *testing.T) {
 		t.Errorf("Expected UIDNext 4, got %d", stats.UIDNext)
 	}
 }
+
+func TestStore_SentinelErrors(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	mb, err := store.CreateMailbox(ctx, 1, "INBOX", "")
+	if err != nil {
+		t.Fatalf("CreateMailbox failed: %v", err)
+	}
+	if _, err := store.CreateMailbox(ctx, 1, "Work", ""); err != nil {
+		t.Fatalf("CreateMailbox failed: %v", err)
+	}
+
+	if _, err := store.CreateMailbox(ctx, 1, "INBOX", ""); !errors.Is(err, storage.ErrMailboxExists) {
+		t.Errorf("CreateMailbox(duplicate) error = %v, want ErrMailboxExists", err)
+	}
+	if err := store.RenameMailbox(ctx, 1, "Work", "INBOX"); !errors.Is(err, storage.ErrMailboxExists) {
+		t.Errorf("RenameMailbox(onto INBOX) error = %v, want ErrMailboxExists", err)
+	}
+	if _, err := store.GetMailbox(ctx, 1, "Missing"); !errors.Is(err, storage.ErrMailboxNotFound) {
+		t.Errorf("GetMailbox(missing) error = %v, want ErrMailboxNotFound", err)
+	}
+	if err := store.DeleteMailbox(ctx, 1, "Missing"); !errors.Is(err, storage.ErrMailboxNotFound) {
+		t.Errorf("DeleteMailbox(missing) error = %v, want ErrMailboxNotFound", err)
+	}
+	if _, err := store.GetMessage(ctx, mb.ID, 42); !errors.Is(err, storage.ErrMessageNotFound) {
+		t.Errorf("GetMessage(missing) error = %v, want ErrMessageNotFound", err)
+	}
+
+	// With quota enforced, a message that doesn't fit isn't stored
+	store.SetQuotaEnforcement(true)
+	if _, err := store.db.ExecContext(ctx, "UPDATE users SET quota_bytes = 10 WHERE id = 1"); err != nil {
+		t.Fatalf("Failed to set quota: %v", err)
+	}
+	if _, err := store.AppendMessage(ctx, mb.ID, nil, time.Now(), strings.NewReader("Subject: too big\r\n\r\n")); !errors.Is(err, storage.ErrOverQuota) {
+		t.Errorf("AppendMessage(over quota) error = %v, want ErrOverQuota", err)
+	}
+	if stats, _ := store.GetMailboxStats(ctx, mb.ID); stats.Messages != 0 {
+		t.Errorf("Messages after refused append = %d, want 0", stats.Messages)
+	}
+}
+
+func TestStore_ClearRecent(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	mb, _ := store.CreateMailbox(ctx, 1, "INBOX", "")
+	store.AppendMessage(ctx, mb.ID, []storage.Flag{storage.FlagSeen}, time.Now(), strings.NewReader("Seen"))
+	store.AppendMessage(ctx, mb.ID, nil, time.Now(), strings.NewReader("New 1"))
+	store.AppendMessage(ctx, mb.ID, nil, time.Now(), strings.NewReader("New 2"))
+
+	stats, _ := store.GetMailboxStats(ctx, mb.ID)
+	if stats.Recent != 2 {
+		t.Fatalf("Recent before select = %d, want 2", stats.Recent)
+	}
+
+	uids, err := store.ClearRecent(ctx, mb.ID)
+	if err != nil {
+		t.Fatalf("ClearRecent failed: %v", err)
+	}
+	if len(uids) != 2 || uids[0] != 2 || uids[1] != 3 {
+		t.Errorf("ClearRecent = %v, want [2 3]", uids)
+	}
+
+	stats, _ = store.GetMailboxStats(ctx, mb.ID)
+	if stats.Recent != 0 || stats.Unseen != 2 {
+		t.Errorf("after select Recent = %d, Unseen = %d, want 0 and 2", stats.Recent, stats.Unseen)
+	}
+	if uids, _ := store.ClearRecent(ctx, mb.ID); len(uids) != 0 {
+		t.Errorf("second ClearRecent = %v, want none", uids)
+	}
+
+	// Bodies are still readable from cur, and clearing \Seen doesn't make a
+	// message recent again
+	msg, _ := store.GetMessage(ctx, mb.ID, 2)
+	rc, err := store.GetMessageBody(ctx, msg)
+	if err != nil {
+		t.Fatalf("GetMessageBody after move failed: %v", err)
+	}
+	rc.Close()
+	if !strings.HasSuffix(msg.MaildirKey, ":2,") {
+		t.Errorf("MaildirKey after move = %q, want the :2, info suffix", msg.MaildirKey)
+	}
+	if _, err := os.Stat(filepath.Join(store.getUserMaildirPath(1, "INBOX"), "cur", msg.MaildirKey)); err != nil {
+		t.Errorf("message not in cur under its key: %v", err)
+	}
+	store.UpdateFlags(ctx, mb.ID, 1, []storage.Flag{storage.FlagSeen}, false)
+	if stats, _ := store.GetMailboxStats(ctx, mb.ID); stats.Recent != 0 || stats.Unseen != 3 {
+		t.Errorf("after clearing \\Seen Recent = %d, Unseen = %d, want 0 and 3", stats.Recent, stats.Unseen)
+	}
+}
+
+func TestUnseenCountUsesIndex(t *testing.T) {
+	db, err := metadata.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	if err := db.Migrate(context.Background()); err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+
+	rows, err := db.Query("EXPLAIN QUERY PLAN "+unseenCountQuery, 1)
+	if err != nil {
+		t.Fatalf("EXPLAIN QUERY PLAN failed: %v", err)
+	}
+	defer rows.Close()
+	var plan []string
+	for rows.Next() {
+		var id, parent, notUsed int
+		var detail string
+		if err := rows.Scan(&id, &parent, &notUsed, &detail); err != nil {
+			t.Fatalf("Scan failed: %v", err)
+		}
+		plan = append(plan, detail)
+	}
+	if len(plan) != 1 || !strings.Contains(plan[0], "idx_messages_unseen (mailbox_id=? AND seen=?)") {
+		t.Errorf("query plan = %q, want a search of idx_messages_unseen", plan)
+	}
+}
+
+func TestStore_GetMailboxStatsCached(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	mb, _ := store.CreateMailbox(ctx, 1, "INBOX", "")
+	store.AppendMessage(ctx, mb.ID, nil, time.Now(), strings.NewReader("One"))
+
+	if stats, _ := store.GetMailboxStats(ctx, mb.ID); stats.Messages != 1 {
+		t.Fatalf("first stats Messages = %d, want 1", stats.Messages)
+	}
+
+	// A row written behind the store's back is not seen while cached
+	if _, err := store.db.ExecContext(ctx,
+		"INSERT INTO messages (mailbox_id, uid, maildir_key, size, internal_date) VALUES (?, 99, 'x', 1, ?)",
+		mb.ID, time.Now()); err != nil {
+		t.Fatalf("insert failed: %v", err)
+	}
+	if stats, _ := store.GetMailboxStats(ctx, mb.ID); stats.Messages != 1 {
+		t.Errorf("second stats Messages = %d, want cached 1", stats.Messages)
+	}
+
+	// An append through the store invalidates the cache
+	store.AppendMessage(ctx, mb.ID, nil, time.Now(), strings.NewReader("Two"))
+	if stats, _ := store.GetMailboxStats(ctx, mb.ID); stats.Messages != 3 {
+		t.Errorf("stats after append Messages = %d, want 3", stats.Messages)
+	}
+}
+
+func TestStatsCacheDropsStaleResult(t *testing.T) {
+	c := newStatsCache(time.Minute)
+
+	// A count started before a write must not be cached after it
+	_, gen := c.get(1)
+	c.invalidate(1)
+	c.put(1, gen, &storage.MailboxStats{Messages: 1})
+	if cached, _ := c.get(1); cached != nil {
+		t.Errorf("get() = %+v, want stale stats dropped", cached)
+	}
+
+	_, gen = c.get(1)
+	c.put(1, gen, &storage.MailboxStats{Messages: 2})
+	if cached, _ := c.get(1); cached == nil || cached.Messages != 2 {
+		t.Errorf("get() = %+v, want Messages 2", cached)
+	}
+}
+
+// usedBytes returns a user's used_bytes
+func usedBytes(t *testing.T, store *Store, userID int64) int64 {
+	t.Helper()
+	var used int64
+	if err := store.db.QueryRow("SELECT used_bytes FROM users WHERE id = ?", userID).Scan(&used); err != nil {
+		t.Fatalf("Failed to read used_bytes: %v", err)
+	}
+	return used
+}
+
+func TestStore_RecomputeUsage(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	if _, err := store.db.Exec("INSERT INTO users (id, domain_id, username, password_hash, used_bytes) VALUES (2, 1, 'idle', 'hash', 777)"); err != nil {
+		t.Fatal(err)
+	}
+	mb, _ := store.CreateMailbox(ctx, 1, "INBOX", "")
+	store.AppendMessage(ctx, mb.ID, nil, time.Now(), strings.NewReader("Message 1"))
+	store.AppendMessage(ctx, mb.ID, nil, time.Now(), strings.NewReader("Message 22"))
+	want := int64(len("Message 1") + len("Message 22"))
+
+	if _, err := store.db.Exec("UPDATE users SET used_bytes = 999999 WHERE id = 1"); err != nil {
+		t.Fatal(err)
+	}
+	corrected, err := store.RecomputeUsage(ctx, false)
+	if err != nil {
+		t.Fatalf("RecomputeUsage() error = %v", err)
+	}
+	if corrected != 1 || usedBytes(t, store, 1) != want {
+		t.Errorf("RecomputeUsage() corrected %d, used_bytes = %d; want 1 and %d", corrected, usedBytes(t, store, 1), want)
+	}
+	if got := usedBytes(t, store, 2); got != 777 {
+		t.Errorf("idle user used_bytes = %d, want it skipped", got)
+	}
+
+	// Expunging is activity too; the running count never subtracted it
+	store.UpdateFlags(ctx, mb.ID, 1, []storage.Flag{storage.FlagDeleted}, true)
+	store.ExpungeMailbox(ctx, mb.ID)
+	if _, err := store.RecomputeUsage(ctx, false); err != nil {
+		t.Fatalf("RecomputeUsage() error = %v", err)
+	}
+	if got := usedBytes(t, store, 1); got != int64(len("Message 22")) {
+		t.Errorf("used_bytes after expunge = %d, want %d", got, len("Message 22"))
+	}
+
+	if corrected, _ := store.RecomputeUsage(ctx, true); corrected != 1 || usedBytes(t, store, 2) != 0 {
+		t.Errorf("full RecomputeUsage() corrected %d, idle used_bytes = %d; want 1 and 0", corrected, usedBytes(t, store, 2))
+	}
+}
+
+func TestUsageRecomputerCorrectsUsedBytes(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	mb, _ := store.CreateMailbox(ctx, 1, "INBOX", "")
+	store.AppendMessage(ctx, mb.ID, nil, time.Now(), strings.NewReader("Message 1"))
+	if _, err := store.db.Exec("UPDATE users SET used_bytes = 123456 WHERE id = 1"); err != nil {
+		t.Fatal(err)
+	}
+
+	runs := make(chan int, 10)
+	r := NewUsageRecomputer(store, time.Hour, func(corrected int, err error) {
+		if err != nil {
+			t.Errorf("recompute error = %v", err)
+		}
+		runs <- corrected
+	})
+	r.Start()
+	defer r.Stop()
+
+	select {
+	case corrected := <-runs:
+		if corrected != 1 {
+			t.Errorf("first run corrected %d users, want 1", corrected)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("recomputer did not run at startup")
+	}
+	if got := usedBytes(t, store, 1); got != int64(len("Message 1")) {
+		t.Errorf("used_bytes = %d, want %d", got, len("Message 1"))
+	}
+}
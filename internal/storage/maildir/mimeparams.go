@@ -0,0 +1,163 @@
+package maildir
+
+import (
+	"mime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ParseMediaType parses a Content-Type or Content-Disposition value like
+// mime.ParseMediaType, but decodes RFC 2231 parameters in every charset
+// DecodeCharset knows. The standard library only decodes UTF-8 and
+// US-ASCII ones, dropping or mangling filename*=windows-1252'en'... into
+// the wrong name.
+func ParseMediaType(v string) (string, map[string]string, error) {
+	mediatype, params, err := mime.ParseMediaType(v)
+	if err != nil {
+		return mediatype, params, err
+	}
+	for name, value := range decodeExtendedParams(v) {
+		params[name] = value
+	}
+	return mediatype, params, nil
+}
+
+// extendedSegment is one piece of an RFC 2231 parameter: name*N, name*N*
+// or, unsplit, name*
+type extendedSegment struct {
+	index   int
+	encoded bool
+	value   string
+}
+
+// decodeExtendedParams reassembles and decodes the RFC 2231 parameters in
+// a header value. Parameters whose charset isn't known are left out, so
+// the caller keeps what mime.ParseMediaType made of them.
+func decodeExtendedParams(v string) map[string]string {
+	segments := make(map[string][]extendedSegment)
+	for _, param := range splitParams(v) {
+		key, value, ok := strings.Cut(param, "=")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		name, rest, ok := strings.Cut(key, "*")
+		if !ok {
+			continue
+		}
+		seg := extendedSegment{value: unquoteParam(strings.TrimSpace(value))}
+		if seg.encoded = strings.HasSuffix(rest, "*") || rest == ""; seg.encoded {
+			rest = strings.TrimSuffix(rest, "*")
+		}
+		if rest != "" {
+			n, err := strconv.Atoi(rest)
+			if err != nil || n < 0 {
+				continue
+			}
+			seg.index = n
+		}
+		segments[name] = append(segments[name], seg)
+	}
+
+	decoded := make(map[string]string)
+	for name, segs := range segments {
+		sort.Slice(segs, func(i, j int) bool { return segs[i].index < segs[j].index })
+		if segs[0].index != 0 {
+			continue
+		}
+
+		// The charset is named once, at the start of the first segment,
+		// and applies to every encoded segment after it
+		charset := "us-ascii"
+		var raw []byte
+		valid := true
+		for i, seg := range segs {
+			if i != seg.index {
+				break // A gap ends the value
+			}
+			value := seg.value
+			if !seg.encoded {
+				raw = append(raw, value...)
+				continue
+			}
+			if i == 0 {
+				parts := strings.SplitN(value, "'", 3)
+				if len(parts) != 3 {
+					valid = false
+					break
+				}
+				if parts[0] != "" {
+					charset = parts[0]
+				}
+				value = parts[2]
+			}
+			raw = append(raw, percentDecode(value)...)
+		}
+		if !valid {
+			continue
+		}
+		if s, err := DecodeCharset(charset, raw); err == nil {
+			decoded[name] = s
+		}
+	}
+	return decoded
+}
+
+// splitParams splits the parameters of a header value at the semicolons
+// outside quoted strings, dropping the media type before the first one
+func splitParams(v string) []string {
+	var params []string
+	inQuote, escaped := false, false
+	start := -1
+	for i := 0; i < len(v); i++ {
+		switch c := v[i]; {
+		case escaped:
+			escaped = false
+		case c == '\\' && inQuote:
+			escaped = true
+		case c == '"':
+			inQuote = !inQuote
+		case c == ';' && !inQuote:
+			if start >= 0 {
+				params = append(params, v[start:i])
+			}
+			start = i + 1
+		}
+	}
+	if start >= 0 && start < len(v) {
+		params = append(params, v[start:])
+	}
+	return params
+}
+
+// unquoteParam removes the quotes and backslash escapes of a quoted string
+func unquoteParam(v string) string {
+	if len(v) < 2 || v[0] != '"' || v[len(v)-1] != '"' {
+		return v
+	}
+	var b strings.Builder
+	for i := 1; i < len(v)-1; i++ {
+		if v[i] == '\\' && i+1 < len(v)-1 {
+			i++
+		}
+		b.WriteByte(v[i])
+	}
+	return b.String()
+}
+
+// percentDecode decodes %XX escapes, keeping malformed ones as they are
+func percentDecode(v string) []byte {
+	out := make([]byte, 0, len(v))
+	for i := 0; i < len(v); i++ {
+		if v[i] == '%' && i+2 < len(v) {
+			if b, err := strconv.ParseUint(v[i+1:i+3], 16, 8); err == nil {
+				out = append(out, byte(b))
+				i += 2
+				continue
+			}
+		}
+		out = append(out, v[i])
+	}
+	return out
+}
@@ -0,0 +1,145 @@
+package maildir
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/fenilsonani/email-server/internal/storage"
+)
+
+// Object IDs (RFC 8474) let clients recognise a message they already
+// have. A message's EMAILID is a hash of its content, so a copy or move
+// into another mailbox keeps it. Its THREADID is derived from the first
+// Message-ID of the thread it belongs to.
+
+// MessageObjectIDs returns the EMAILID and THREADID of a message. The
+// EMAILID of a message stored before object IDs existed is computed from
+// its file and saved.
+func (s *Store) MessageObjectIDs(ctx context.Context, mailboxID int64, uid uint32) (emailID, threadID string, err error) {
+	r := objectIDRow{mailboxID: mailboxID, uid: uid}
+	err = s.db.QueryRowContext(ctx,
+		`SELECT id, maildir_key, email_id, message_id, in_reply_to, references_header
+		 FROM messages WHERE mailbox_id = ? AND uid = ?`,
+		mailboxID, uid,
+	).Scan(&r.id, &r.maildirKey, &r.storedID, &r.messageID, &r.inReplyTo, &r.references)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", "", fmt.Errorf("%w: mailbox=%d uid=%d", storage.ErrMessageNotFound, mailboxID, uid)
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("failed to query message mailbox=%d uid=%d: %w", mailboxID, uid, err)
+	}
+
+	ids, err := s.objectIDs(ctx, r)
+	return ids.EmailID, ids.ThreadID, err
+}
+
+// MessagesObjectIDs returns the object IDs of the messages with the given
+// UIDs in a mailbox, keyed by UID, reading them in one query. UIDs with no
+// message are left out.
+func (s *Store) MessagesObjectIDs(ctx context.Context, mailboxID int64, uids []uint32) (map[uint32]storage.ObjectIDs, error) {
+	ids := make(map[uint32]storage.ObjectIDs, len(uids))
+	if len(uids) == 0 {
+		return ids, nil
+	}
+	want := make(map[uint32]bool, len(uids))
+	for _, uid := range uids {
+		want[uid] = true
+	}
+
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT id, uid, maildir_key, email_id, message_id, in_reply_to, references_header
+		 FROM messages WHERE mailbox_id = ? AND uid BETWEEN ? AND ?`,
+		mailboxID, slices.Min(uids), slices.Max(uids))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query messages of mailbox %d: %w", mailboxID, err)
+	}
+	var found []objectIDRow
+	for rows.Next() {
+		r := objectIDRow{mailboxID: mailboxID}
+		if err := rows.Scan(&r.id, &r.uid, &r.maildirKey, &r.storedID, &r.messageID, &r.inReplyTo, &r.references); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan message: %w", err)
+		}
+		if want[r.uid] {
+			found = append(found, r)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query messages of mailbox %d: %w", mailboxID, err)
+	}
+
+	// Rows are closed first: an ID computed for an old message is saved
+	for _, r := range found {
+		if ids[r.uid], err = s.objectIDs(ctx, r); err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
+
+// objectIDRow is the part of a message row its object IDs come from
+type objectIDRow struct {
+	id                                         int64
+	mailboxID                                  int64
+	uid                                        uint32
+	maildirKey                                 string
+	storedID, messageID, inReplyTo, references sql.NullString
+}
+
+// objectIDs returns the object IDs of a message, computing and saving the
+// EMAILID of one stored before object IDs existed
+func (s *Store) objectIDs(ctx context.Context, r objectIDRow) (storage.ObjectIDs, error) {
+	emailID := r.storedID.String
+	if emailID == "" {
+		body, err := s.GetMessageBody(ctx, &storage.Message{MailboxID: r.mailboxID, UID: r.uid, MaildirKey: r.maildirKey})
+		if err != nil {
+			return storage.ObjectIDs{}, err
+		}
+		hash := sha256.New()
+		_, err = io.Copy(hash, body)
+		body.Close()
+		if err != nil {
+			return storage.ObjectIDs{}, fmt.Errorf("failed to read message: %w", err)
+		}
+		emailID = emailObjectID(hash.Sum(nil))
+		if _, err := s.db.ExecContext(ctx, "UPDATE messages SET email_id = ? WHERE id = ?", emailID, r.id); err != nil {
+			return storage.ObjectIDs{}, fmt.Errorf("failed to save email id: %w", err)
+		}
+	}
+
+	return storage.ObjectIDs{
+		EmailID:  emailID,
+		ThreadID: threadObjectID(emailID, r.messageID.String, r.inReplyTo.String, r.references.String),
+	}, nil
+}
+
+// emailObjectID returns the EMAILID for a message's SHA-256 content hash
+func emailObjectID(sum []byte) string {
+	return "M" + hex.EncodeToString(sum[:12])
+}
+
+// threadObjectID returns the THREADID for a message: the first message
+// in its References, else the one it replies to, else itself
+func threadObjectID(emailID, messageID, inReplyTo, references string) string {
+	root := messageID
+	if refs := strings.Fields(references); len(refs) > 0 {
+		root = refs[0]
+	} else if inReplyTo != "" {
+		root = inReplyTo
+	}
+	root = strings.Trim(root, "<>")
+	if root == "" {
+		// Without a Message-ID the message is a thread of its own
+		return "T" + emailID[1:]
+	}
+	sum := sha256.Sum256([]byte(root))
+	return "T" + hex.EncodeToString(sum[:12])
+}
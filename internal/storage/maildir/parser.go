@@ -7,6 +7,7 @@ import (
 	"io"
 	"mime"
 	"net/mail"
+	"regexp"
 	"strings"
 )
 
@@ -121,14 +122,25 @@ func decodeHeader(s string) string {
 		return s
 	}
 
-	dec := new(mime.WordDecoder)
+	dec := &mime.WordDecoder{CharsetReader: charsetReader}
 	decoded, err := dec.DecodeHeader(s)
-	if err != nil {
-		return s // Return original on decode failure
+	if err == nil {
+		return decoded
 	}
-	return decoded
+
+	// One word in an unknown charset shouldn't hide the rest: decode the
+	// words that can be and leave the others as they are
+	return encodedWordRE.ReplaceAllStringFunc(s, func(word string) string {
+		if decoded, err := dec.Decode(word); err == nil {
+			return decoded
+		}
+		return word
+	})
 }
 
+// encodedWordRE matches an RFC 2047 encoded-word
+var encodedWordRE = regexp.MustCompile(`=\?[^?\s]+\?[bBqQ]\?[^?\s]*\?=`)
+
 // cleanHeader removes angle brackets and whitespace from header values
 func cleanHeader(s string) string {
 	s = strings.TrimSpace(s)
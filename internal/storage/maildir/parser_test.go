@@ -832,9 +832,49 @@ func TestDecodeHeader(t *testing.T) {
 			want:  "Hello",
 		},
 		{
-			name:  "Windows-1252 encoding (unsupported, returned as-is)",
-			input: "=?windows-1252?Q?Test?=",
-			want:  "=?windows-1252?Q?Test?=",
+			name:  "ISO-8859-15 encoding",
+			input: "=?ISO-8859-15?Q?=A4uro?=",
+			want:  "€uro",
+		},
+		{
+			name:  "Windows-1252 encoding",
+			input: "=?windows-1252?Q?=80100_=96_=93Test=94?=",
+			want:  "€100 – “Test”",
+		},
+		{
+			name:  "ISO-8859-2 encoding",
+			input: "=?ISO-8859-2?Q?Za=BF=F3=B3=E6?=",
+			want:  "Zażółć",
+		},
+		{
+			name:  "KOI8-R encoding",
+			input: "=?KOI8-R?B?8NLJ18XU?=",
+			want:  "Привет",
+		},
+		{
+			name:  "Shift_JIS encoding",
+			input: "=?Shift_JIS?B?grGC8YLJgr+CzQ==?=",
+			want:  "こんにちは",
+		},
+		{
+			name:  "GB2312 label decoded as GBK",
+			input: "=?gb2312?B?xOO6ww==?=",
+			want:  "你好",
+		},
+		{
+			name:  "Big5 encoding",
+			input: "=?Big5?B?p0Gmbg==?=",
+			want:  "你好",
+		},
+		{
+			name:  "unknown charset (returned as-is)",
+			input: "=?x-unknown?Q?Test?=",
+			want:  "=?x-unknown?Q?Test?=",
+		},
+		{
+			name:  "unknown charset leaves other words decoded",
+			input: "=?UTF-8?Q?caf=C3=A9?= and =?x-unknown?Q?Test?=",
+			want:  "café and =?x-unknown?Q?Test?=",
 		},
 	}
 
@@ -934,6 +974,11 @@ func TestExtractEmailAddress(t *testing.T) {
 			input: "first.last@example.com",
 			want:  "first.last@example.com",
 		},
+		{
+			name:  "UTF-8 local part and domain",
+			input: "Jörg Müller <müller@exämple.de>",
+			want:  "müller@exämple.de",
+		},
 	}
 
 	for _, tt := range tests {
@@ -1137,6 +1182,23 @@ func TestParseMessageHeaders_EdgeCases(t *testing.T) {
 		}
 	})
 
+	t.Run("raw UTF-8 headers (RFC 6532)", func(t *testing.T) {
+		input := "From: Jörg Müller <müller@exämple.de>\r\nTo: 田中 <田中@例え.jp>\r\nSubject: Grüße\r\n\r\n"
+		got, err := ParseMessageHeaders(strings.NewReader(input))
+		if err != nil {
+			t.Fatalf("ParseMessageHeaders() error: %v", err)
+		}
+		if got.From != "müller@exämple.de" {
+			t.Errorf("From = %q, want müller@exämple.de", got.From)
+		}
+		if len(got.To) != 1 || got.To[0] != "田中@例え.jp" {
+			t.Errorf("To = %v, want [田中@例え.jp]", got.To)
+		}
+		if got.Subject != "Grüße" {
+			t.Errorf("Subject = %q, want Grüße", got.Subject)
+		}
+	})
+
 	t.Run("headers with no colon", func(t *testing.T) {
 		input := "From: sender@example.com\r\nInvalidHeaderLine\r\nSubject: Test\r\n\r\n"
 		got, err := ParseMessageHeaders(strings.NewReader(input))
@@ -1279,3 +1341,57 @@ func BenchmarkParseAddressList(b *testing.B) {
 		})
 	}
 }
+
+func TestParseMediaTypeRFC2231(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "continued and percent-encoded UTF-8",
+			input: "attachment; filename*0*=UTF-8''R%C3%A9sum%C3%A9%20f%C3%BCr; filename*1*=%20J%C3%BCrgen.pdf",
+			want:  "Résumé für Jürgen.pdf",
+		},
+		{
+			name:  "continuation mixing encoded and quoted segments",
+			input: "attachment; filename*1=\" final.pdf\"; filename*0*=utf-8''%E6%8A%A5%E5%91%8A",
+			want:  "报告 final.pdf",
+		},
+		{
+			name:  "legacy charset",
+			input: "attachment; filename*=windows-1252''Caf%E9%20%80.txt",
+			want:  "Café €.txt",
+		},
+		{
+			name:  "continued legacy charset",
+			input: "attachment;\r\n filename*0*=iso-8859-1'fr'r%E9sum; filename*1*=%E9.pdf",
+			want:  "résumé.pdf",
+		},
+		{
+			name:  "plain parameter",
+			input: "attachment; filename=\"report;final.pdf\"",
+			want:  "report;final.pdf",
+		},
+		{
+			name:  "unknown charset falls back to the plain parameter",
+			input: "attachment; filename=fallback.pdf; filename*=x-unknown''%01%02",
+			want:  "fallback.pdf",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			disp, params, err := ParseMediaType(tt.input)
+			if err != nil {
+				t.Fatalf("ParseMediaType(%q) error = %v", tt.input, err)
+			}
+			if disp != "attachment" {
+				t.Errorf("disposition = %q, want attachment", disp)
+			}
+			if got := params["filename"]; got != tt.want {
+				t.Errorf("filename = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package maildir
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// PruneTmp removes files older than olderThan from the tmp directory of
+// every maildir. AppendMessage writes there before moving a message into
+// new or cur, so anything left behind is from an append that crashed
+// halfway. The store lock is taken for one directory at a time, so appends
+// wait at most for a single directory to be cleaned. It returns how many
+// files were removed and their total size.
+func (s *Store) PruneTmp(ctx context.Context, olderThan time.Duration) (int, int64, error) {
+	cutoff := time.Now().Add(-olderThan)
+
+	var tmpDirs []string
+	err := filepath.WalkDir(s.basePath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() || d.Name() != "tmp" {
+			return nil
+		}
+		// A mailbox may itself be named tmp; only a sibling of cur is a
+		// maildir's tmp directory
+		if info, err := os.Stat(filepath.Join(filepath.Dir(path), "cur")); err == nil && info.IsDir() {
+			tmpDirs = append(tmpDirs, path)
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var files int
+	var size int64
+	for _, dir := range tmpDirs {
+		if err := ctx.Err(); err != nil {
+			return files, size, err
+		}
+		n, bytes, err := s.pruneTmpDir(dir, cutoff)
+		files += n
+		size += bytes
+		if err != nil {
+			return files, size, err
+		}
+	}
+	return files, size, nil
+}
+
+// pruneTmpDir removes the files in dir last modified before cutoff
+func (s *Store) pruneTmpDir(dir string, cutoff time.Time) (int, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, 0, nil
+		}
+		return 0, 0, err
+	}
+
+	var files int
+	var size int64
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || !info.ModTime().Before(cutoff) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil && !os.IsNotExist(err) {
+			return files, size, err
+		}
+		files++
+		size += info.Size()
+	}
+	return files, size, nil
+}
@@ -0,0 +1,116 @@
+package maildir
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/fenilsonani/email-server/internal/storage"
+)
+
+// reindexBatchSize is how many rows ReindexMetadata reads and updates at once
+const reindexBatchSize = 500
+
+// ReindexReport summarizes a ReindexMetadata run
+type ReindexReport struct {
+	Checked int      // Rows with empty metadata
+	Updated int      // Rows filled in from their message file
+	Missing []string // Rows whose message couldn't be read, as mailbox/uid
+}
+
+// ReindexMetadata fills in the search and display columns of the user's
+// messages that have none, such as those appended before headers were
+// parsed, by parsing the headers of each message file again. Rows whose
+// file can't be read are reported and left as they are.
+func (s *Store) ReindexMetadata(ctx context.Context, userID int64) (*ReindexReport, error) {
+	report := &ReindexReport{}
+	var lastID int64
+	for {
+		n, next, err := s.reindexBatch(ctx, userID, lastID, report)
+		if err != nil {
+			return report, err
+		}
+		if n < reindexBatchSize {
+			return report, nil
+		}
+		lastID = next
+	}
+}
+
+// reindexBatch reindexes up to reindexBatchSize rows with ids after lastID,
+// returning how many it read and the last id among them
+func (s *Store) reindexBatch(ctx context.Context, userID, lastID int64, report *ReindexReport) (int, int64, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT m.id, m.mailbox_id, m.uid, m.maildir_key, mb.name
+		FROM messages m
+		JOIN mailboxes mb ON m.mailbox_id = mb.id
+		WHERE mb.user_id = ? AND m.id > ?
+		  AND COALESCE(m.message_id, '') = '' AND COALESCE(m.subject, '') = ''
+		  AND COALESCE(m.from_address, '') = '' AND COALESCE(m.to_addresses, '') = ''
+		ORDER BY m.id
+		LIMIT ?`, userID, lastID, reindexBatchSize)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to query messages: %w", err)
+	}
+	type row struct {
+		id      int64
+		msg     storage.Message
+		mailbox string
+	}
+	var batch []row
+	for rows.Next() {
+		var r row
+		if err := rows.Scan(&r.id, &r.msg.MailboxID, &r.msg.UID, &r.msg.MaildirKey, &r.mailbox); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		batch = append(batch, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+	if len(batch) == 0 {
+		return 0, lastID, nil
+	}
+
+	for _, r := range batch {
+		report.Checked++
+		meta, err := s.readMetadata(ctx, &r.msg)
+		if err != nil {
+			report.Missing = append(report.Missing, fmt.Sprintf("%s/%d", r.mailbox, r.msg.UID))
+			continue
+		}
+		if meta.MessageID == "" && meta.Subject == "" && meta.From == "" && len(meta.To) == 0 {
+			continue
+		}
+
+		var toJSON sql.NullString
+		if len(meta.To) > 0 {
+			data, _ := json.Marshal(meta.To)
+			toJSON = sql.NullString{String: string(data), Valid: true}
+		}
+		if _, err := s.db.ExecContext(ctx,
+			`UPDATE messages SET message_id = ?, subject = ?, from_address = ?, to_addresses = ?,
+			                     in_reply_to = COALESCE(NULLIF(in_reply_to, ''), ?),
+			                     references_header = COALESCE(NULLIF(references_header, ''), ?)
+			 WHERE id = ?`,
+			meta.MessageID, meta.Subject, meta.From, toJSON, meta.InReplyTo, meta.References, r.id,
+		); err != nil {
+			return 0, 0, fmt.Errorf("failed to update %s/%d: %w", r.mailbox, r.msg.UID, err)
+		}
+		report.Updated++
+	}
+	return len(batch), batch[len(batch)-1].id, nil
+}
+
+// readMetadata parses the headers of a stored message
+func (s *Store) readMetadata(ctx context.Context, msg *storage.Message) (*MessageMetadata, error) {
+	body, err := s.GetMessageBody(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return ParseMessageHeaders(body)
+}
@@ -0,0 +1,57 @@
+package maildir
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStore_ReindexMetadata(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	mb, _ := store.CreateMailbox(ctx, 1, "INBOX", "")
+	body := "Message-ID: <legacy@example.com>\r\nFrom: Alice <alice@example.com>\r\nTo: bob@test.com, carol@test.com\r\nSubject: =?UTF-8?Q?caf=C3=A9?=\r\n\r\nhello\r\n"
+	legacy, _ := store.AppendMessage(ctx, mb.ID, nil, time.Now(), strings.NewReader(body))
+	lost, _ := store.AppendMessage(ctx, mb.ID, nil, time.Now(), strings.NewReader("Subject: lost\r\n\r\nhello\r\n"))
+
+	// Rows as they were stored before headers were parsed
+	if _, err := store.db.ExecContext(ctx,
+		"UPDATE messages SET message_id = NULL, subject = NULL, from_address = NULL, to_addresses = NULL"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(store.getUserMaildirPath(1, "INBOX"), "new", lost.MaildirKey)); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := store.ReindexMetadata(ctx, 1)
+	if err != nil {
+		t.Fatalf("ReindexMetadata() error = %v", err)
+	}
+	if report.Checked != 2 || report.Updated != 1 {
+		t.Errorf("report = %+v, want 2 checked and 1 updated", report)
+	}
+	if len(report.Missing) != 1 || report.Missing[0] != "INBOX/2" {
+		t.Errorf("Missing = %v, want [INBOX/2]", report.Missing)
+	}
+
+	msg, err := store.GetMessage(ctx, mb.ID, legacy.UID)
+	if err != nil {
+		t.Fatalf("GetMessage() error = %v", err)
+	}
+	if msg.MessageID != "legacy@example.com" || msg.Subject != "café" || msg.From != "alice@example.com" {
+		t.Errorf("reindexed message = %+v", msg)
+	}
+	if len(msg.To) != 2 || msg.To[0] != "bob@test.com" || msg.To[1] != "carol@test.com" {
+		t.Errorf("To = %v, want bob and carol", msg.To)
+	}
+
+	// Filled rows aren't read again
+	if report, _ = store.ReindexMetadata(ctx, 1); report.Checked != 1 || report.Updated != 0 {
+		t.Errorf("second ReindexMetadata() = %+v, want only the missing row checked", report)
+	}
+}
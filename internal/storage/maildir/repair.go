@@ -0,0 +1,219 @@
+package maildir
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/fenilsonani/email-server/internal/storage"
+)
+
+// RepairReport summarizes a Repair run
+type RepairReport struct {
+	Mailboxes int      // Mailboxes checked
+	Orphans   []string // Files with no database row, as mailbox/key
+	Dangling  []string // Rows whose file is missing, as mailbox/uid
+	Applied   bool     // Whether the differences were fixed or only reported
+}
+
+// Repair reconciles the database with the maildir directories of every
+// mailbox the user has. Files without a row are indexed from their headers
+// and given a new UID, and rows whose file is gone are deleted. Unless apply
+// is set nothing is changed and the report only lists what would be.
+func (s *Store) Repair(ctx context.Context, userID int64, apply bool) (*RepairReport, error) {
+	mailboxes, err := s.ListMailboxes(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list mailboxes: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	report := &RepairReport{Applied: apply}
+	for _, mb := range mailboxes {
+		if err := s.repairMailbox(ctx, mb, report, apply); err != nil {
+			return report, fmt.Errorf("mailbox %s: %w", mb.Name, err)
+		}
+		report.Mailboxes++
+	}
+	return report, nil
+}
+
+// repairMailbox reconciles one mailbox, adding what it finds to report
+func (s *Store) repairMailbox(ctx context.Context, mb *storage.Mailbox, report *RepairReport, apply bool) error {
+	path := s.getUserMaildirPath(mb.UserID, mb.Name)
+
+	// Files on disk, by key without the flags suffix
+	files := make(map[string]string) // base key -> path
+	for _, subdir := range []string{"cur", "new"} {
+		entries, err := os.ReadDir(filepath.Join(path, subdir))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			files[baseMaildirKey(entry.Name())] = filepath.Join(path, subdir, entry.Name())
+		}
+	}
+
+	type row struct {
+		uid     uint32
+		size    int64
+		bodyKey sql.NullString
+	}
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT uid, maildir_key, size, body_key FROM messages WHERE mailbox_id = ? ORDER BY uid", mb.ID)
+	if err != nil {
+		return err
+	}
+	var dangling []row
+	indexed := make(map[string]bool)
+	for rows.Next() {
+		var r row
+		var key string
+		if err := rows.Scan(&r.uid, &key, &r.size, &r.bodyKey); err != nil {
+			rows.Close()
+			return err
+		}
+		base := baseMaildirKey(key)
+		indexed[base] = true
+		if _, ok := files[base]; !ok {
+			dangling = append(dangling, r)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var orphans []string
+	for base, file := range files {
+		if !indexed[base] {
+			orphans = append(orphans, file)
+		}
+	}
+	sort.Strings(orphans)
+
+	for _, r := range dangling {
+		report.Dangling = append(report.Dangling, fmt.Sprintf("%s/%d", mb.Name, r.uid))
+	}
+	for _, file := range orphans {
+		report.Orphans = append(report.Orphans, mb.Name+"/"+filepath.Base(file))
+	}
+	if !apply || (len(dangling) == 0 && len(orphans) == 0) {
+		return nil
+	}
+	defer s.mailboxChanged(mb.ID)
+
+	for _, r := range dangling {
+		if _, err := s.db.ExecContext(ctx,
+			"DELETE FROM messages WHERE mailbox_id = ? AND uid = ?", mb.ID, r.uid); err != nil {
+			return fmt.Errorf("failed to remove uid %d: %w", r.uid, err)
+		}
+		s.UpdateUserQuota(ctx, mb.UserID, -r.size)
+		s.releaseBodies(nullStrings(r.bodyKey))
+	}
+	for _, file := range orphans {
+		size, err := s.indexFile(ctx, mb.ID, file)
+		if err != nil {
+			return fmt.Errorf("failed to index %s: %w", filepath.Base(file), err)
+		}
+		s.UpdateUserQuota(ctx, mb.UserID, size)
+	}
+	return nil
+}
+
+// indexFile inserts a row for a message file already in the mailbox's
+// maildir, taking flags from its name and metadata from its headers
+func (s *Store) indexFile(ctx context.Context, mailboxID int64, path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	meta, err := ParseMessageHeaders(f)
+	if err != nil {
+		meta = &MessageMetadata{}
+	}
+
+	date := info.ModTime()
+	if t, err := mail.ParseDate(meta.Date); err == nil {
+		date = t
+	}
+	var toJSON sql.NullString
+	if len(meta.To) > 0 {
+		data, _ := json.Marshal(meta.To)
+		toJSON = sql.NullString{String: string(data), Valid: true}
+	}
+	key := filepath.Base(path)
+	flags := parseMaildirFlags(key)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var uid uint32
+	if err := tx.QueryRowContext(ctx, "SELECT uidnext FROM mailboxes WHERE id = ?", mailboxID).Scan(&uid); err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE mailboxes SET uidnext = uidnext + 1 WHERE id = ?", mailboxID); err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO messages (mailbox_id, uid, maildir_key, size, internal_date, flags, seen,
+		                       message_id, subject, from_address, to_addresses, in_reply_to, references_header)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		mailboxID, uid, key, info.Size(), date, flagsToString(flags), hasSeenFlag(flags),
+		meta.MessageID, meta.Subject, meta.From, toJSON, meta.InReplyTo, meta.References,
+	); err != nil {
+		return 0, err
+	}
+	return info.Size(), tx.Commit()
+}
+
+// baseMaildirKey strips the :2,FLAGS info suffix from a maildir filename
+func baseMaildirKey(name string) string {
+	if idx := strings.Index(name, ":2,"); idx >= 0 {
+		return name[:idx]
+	}
+	return name
+}
+
+// parseMaildirFlags reads the flags in a maildir filename's info suffix,
+// the reverse of buildMaildirFlags
+func parseMaildirFlags(name string) []storage.Flag {
+	idx := strings.Index(name, ":2,")
+	if idx < 0 {
+		return nil
+	}
+	var flags []storage.Flag
+	for _, c := range name[idx+3:] {
+		switch c {
+		case 'S':
+			flags = append(flags, storage.FlagSeen)
+		case 'R':
+			flags = append(flags, storage.FlagAnswered)
+		case 'F':
+			flags = append(flags, storage.FlagFlagged)
+		case 'T':
+			flags = append(flags, storage.FlagDeleted)
+		case 'D':
+			flags = append(flags, storage.FlagDraft)
+		}
+	}
+	return flags
+}
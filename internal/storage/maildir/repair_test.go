@@ -0,0 +1,74 @@
+package maildir
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fenilsonani/email-server/internal/storage"
+)
+
+func TestStore_Repair(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	mb, _ := store.CreateMailbox(ctx, 1, "INBOX", "")
+	store.AppendMessage(ctx, mb.ID, nil, time.Now(), strings.NewReader("Subject: kept\r\n\r\nhello\r\n"))
+	lost, _ := store.AppendMessage(ctx, mb.ID, nil, time.Now(), strings.NewReader("Subject: lost\r\n\r\nhello\r\n"))
+
+	// A file whose row is gone, and a row whose file is gone
+	path := store.getUserMaildirPath(1, "INBOX")
+	orphan := "1700000000.restored:2,FS"
+	body := "From: Alice <alice@example.com>\r\nTo: bob@test.com\r\nSubject: restored\r\nDate: Tue, 14 Nov 2023 22:13:20 +0000\r\n\r\nhello\r\n"
+	if err := os.WriteFile(filepath.Join(path, "cur", orphan), []byte(body), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(path, "new", lost.MaildirKey)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Dry run reports without changing anything
+	report, err := store.Repair(ctx, 1, false)
+	if err != nil {
+		t.Fatalf("Repair() error = %v", err)
+	}
+	if len(report.Orphans) != 1 || report.Orphans[0] != "INBOX/"+orphan {
+		t.Errorf("Orphans = %v, want [INBOX/%s]", report.Orphans, orphan)
+	}
+	if len(report.Dangling) != 1 || report.Dangling[0] != "INBOX/2" {
+		t.Errorf("Dangling = %v, want [INBOX/2]", report.Dangling)
+	}
+	if messages, _ := store.ListMessages(ctx, mb.ID, 0, 0); len(messages) != 2 {
+		t.Fatalf("dry run changed the mailbox to %d messages", len(messages))
+	}
+
+	if _, err := store.Repair(ctx, 1, true); err != nil {
+		t.Fatalf("Repair(apply) error = %v", err)
+	}
+	messages, _ := store.ListMessages(ctx, mb.ID, 0, 0)
+	if len(messages) != 2 || messages[0].Subject != "kept" || messages[1].UID != 3 {
+		t.Fatalf("messages after repair = %+v, want uid 1 and a new uid 3", messages)
+	}
+	restored := messages[1]
+	if restored.Subject != "restored" || restored.From != "alice@example.com" || restored.MaildirKey != orphan {
+		t.Errorf("restored message = %+v", restored)
+	}
+	if len(restored.Flags) != 2 || restored.Flags[0] != storage.FlagFlagged || restored.Flags[1] != storage.FlagSeen {
+		t.Errorf("restored flags = %v, want [\\Flagged \\Seen]", restored.Flags)
+	}
+	if rc, err := store.GetMessageBody(ctx, restored); err != nil {
+		t.Errorf("GetMessageBody(restored) error = %v", err)
+	} else {
+		rc.Close()
+	}
+
+	// Nothing left to fix
+	report, _ = store.Repair(ctx, 1, true)
+	if len(report.Orphans) != 0 || len(report.Dangling) != 0 || report.Mailboxes != 1 {
+		t.Errorf("second Repair() = %+v, want a clean mailbox", report)
+	}
+}
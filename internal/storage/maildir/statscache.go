@@ -0,0 +1,72 @@
+package maildir
+
+import (
+	"sync"
+	"time"
+
+	"github.com/fenilsonani/email-server/internal/storage"
+)
+
+// statsCacheTTL bounds how long mailbox stats are reused. Clients STATUS
+// every mailbox in a burst when they connect; this spans the burst.
+const statsCacheTTL = 5 * time.Second
+
+// statsCache holds recently computed mailbox stats. Every write to a
+// mailbox invalidates its entry and bumps its generation, so a count that
+// was started before the write can never be cached after it.
+type statsCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[int64]statsEntry
+	gens    map[int64]uint64
+}
+
+type statsEntry struct {
+	stats   storage.MailboxStats
+	expires time.Time
+}
+
+func newStatsCache(ttl time.Duration) *statsCache {
+	return &statsCache{
+		ttl:     ttl,
+		entries: make(map[int64]statsEntry),
+		gens:    make(map[int64]uint64),
+	}
+}
+
+// get returns a copy of the cached stats for a mailbox and its current
+// generation, to be passed to put once fresh stats have been computed
+func (c *statsCache) get(mailboxID int64) (*storage.MailboxStats, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[mailboxID]; ok {
+		if time.Now().Before(e.expires) {
+			stats := e.stats
+			return &stats, c.gens[mailboxID]
+		}
+		delete(c.entries, mailboxID)
+	}
+	return nil, c.gens[mailboxID]
+}
+
+// put caches stats computed at generation gen, unless the mailbox has been
+// written to since
+func (c *statsCache) put(mailboxID int64, gen uint64, stats *storage.MailboxStats) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.gens[mailboxID] != gen {
+		return
+	}
+	c.entries[mailboxID] = statsEntry{stats: *stats, expires: time.Now().Add(c.ttl)}
+}
+
+// invalidate drops the cached stats for a mailbox after a write
+func (c *statsCache) invalidate(mailboxID int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, mailboxID)
+	c.gens[mailboxID]++
+}
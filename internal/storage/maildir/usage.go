@@ -0,0 +1,178 @@
+package maildir
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// usedBytesQuery recomputes a user's used_bytes as the total size of their
+// messages, from the users row it is run against
+const usedBytesQuery = `(SELECT COALESCE(SUM(m.size), 0) FROM messages m
+	JOIN mailboxes b ON b.id = m.mailbox_id WHERE b.user_id = users.id)`
+
+// usageTracker remembers the users and mailboxes written to since the last
+// usage recompute, so users with no activity can be skipped
+type usageTracker struct {
+	mu        sync.Mutex
+	users     map[int64]struct{}
+	mailboxes map[int64]struct{}
+}
+
+func newUsageTracker() *usageTracker {
+	return &usageTracker{
+		users:     make(map[int64]struct{}),
+		mailboxes: make(map[int64]struct{}),
+	}
+}
+
+func (t *usageTracker) touchUser(userID int64) {
+	t.mu.Lock()
+	t.users[userID] = struct{}{}
+	t.mu.Unlock()
+}
+
+func (t *usageTracker) touchMailbox(mailboxID int64) {
+	t.mu.Lock()
+	t.mailboxes[mailboxID] = struct{}{}
+	t.mu.Unlock()
+}
+
+// take returns the users and mailboxes touched so far and forgets them
+func (t *usageTracker) take() (users, mailboxes []int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for id := range t.users {
+		users = append(users, id)
+	}
+	for id := range t.mailboxes {
+		mailboxes = append(mailboxes, id)
+	}
+	clear(t.users)
+	clear(t.mailboxes)
+	return users, mailboxes
+}
+
+// mailboxChanged drops a mailbox's cached stats after a write and marks its
+// owner's usage for recomputation
+func (s *Store) mailboxChanged(mailboxID int64) {
+	s.stats.invalidate(mailboxID)
+	s.usage.touchMailbox(mailboxID)
+}
+
+// RecomputeUsage sets used_bytes to the total size of the user's messages,
+// correcting drift in the running count. With all unset only users whose
+// mailboxes were written to since the previous call are recomputed. It
+// returns how many users had a wrong used_bytes.
+func (s *Store) RecomputeUsage(ctx context.Context, all bool) (int, error) {
+	users, mailboxes := s.usage.take()
+	if all {
+		res, err := s.db.ExecContext(ctx,
+			"UPDATE users SET used_bytes = "+usedBytesQuery+" WHERE used_bytes IS NOT "+usedBytesQuery)
+		if err != nil {
+			return 0, fmt.Errorf("failed to recompute used bytes: %w", err)
+		}
+		n, _ := res.RowsAffected()
+		return int(n), nil
+	}
+
+	if len(mailboxes) > 0 {
+		args := make([]any, len(mailboxes))
+		for i, id := range mailboxes {
+			args[i] = id
+		}
+		rows, err := s.db.QueryContext(ctx,
+			"SELECT DISTINCT user_id FROM mailboxes WHERE id IN (?"+strings.Repeat(", ?", len(mailboxes)-1)+")", args...)
+		if err != nil {
+			return 0, fmt.Errorf("failed to find mailbox owners: %w", err)
+		}
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return 0, err
+			}
+			users = append(users, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+	}
+
+	corrected := 0
+	for _, id := range users {
+		res, err := s.db.ExecContext(ctx,
+			"UPDATE users SET used_bytes = "+usedBytesQuery+" WHERE id = ? AND used_bytes IS NOT "+usedBytesQuery, id)
+		if err != nil {
+			return corrected, fmt.Errorf("failed to recompute used bytes for user %d: %w", id, err)
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			corrected++
+		}
+	}
+	return corrected, nil
+}
+
+// UsageRecomputer periodically corrects users' used_bytes from their
+// messages' sizes, off the delivery path, so quota checks and the IMAP
+// QUOTA response don't drift
+type UsageRecomputer struct {
+	store    *Store
+	interval time.Duration
+	onRun    func(corrected int, err error)
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewUsageRecomputer creates a recomputer that runs every interval and
+// passes each result to onRun
+func NewUsageRecomputer(store *Store, interval time.Duration, onRun func(corrected int, err error)) *UsageRecomputer {
+	return &UsageRecomputer{
+		store:    store,
+		interval: interval,
+		onRun:    onRun,
+	}
+}
+
+// Start recomputes every user at once, then the users with activity every
+// interval, until Stop is called
+func (r *UsageRecomputer) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+
+		r.run(ctx, true)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				r.run(ctx, false)
+			}
+		}
+	}()
+}
+
+func (r *UsageRecomputer) run(ctx context.Context, all bool) {
+	corrected, err := r.store.RecomputeUsage(ctx, all)
+	if r.onRun != nil && ctx.Err() == nil {
+		r.onRun(corrected, err)
+	}
+}
+
+// Stop stops the recomputer, interrupting a run in progress
+func (r *UsageRecomputer) Stop() {
+	if r.cancel != nil {
+		r.cancel()
+	}
+	r.wg.Wait()
+}
@@ -0,0 +1,20 @@
+-- Migration 004: Per-message delivery attempt history
+-- Records every connection attempt the delivery engine makes so operators
+-- can see why a message keeps deferring
+
+CREATE TABLE IF NOT EXISTS delivery_attempts (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    message_id TEXT NOT NULL,
+    attempt INTEGER NOT NULL DEFAULT 0,
+    host TEXT NOT NULL,      -- MX hostname or relay host
+    address TEXT,            -- IP address actually dialed
+    smtp_code INTEGER,       -- Reply code, NULL if no SMTP response
+    latency_ms INTEGER NOT NULL DEFAULT 0,
+    error_message TEXT,      -- NULL on success
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_delivery_attempts_message ON delivery_attempts(message_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_delivery_attempts_time ON delivery_attempts(created_at);
+
+INSERT INTO schema_migrations (version) VALUES (4);
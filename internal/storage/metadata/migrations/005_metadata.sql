@@ -0,0 +1,21 @@
+-- Migration 005: IMAP METADATA (RFC 5464) annotations
+-- Entry names keep their /private or /shared prefix. Mailbox entries belong
+-- to the mailbox owner; server entries are scoped to the user that set them.
+
+CREATE TABLE IF NOT EXISTS mailbox_metadata (
+    mailbox_id INTEGER NOT NULL REFERENCES mailboxes(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,                        -- e.g. "/private/comment"
+    value BLOB NOT NULL,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (mailbox_id, name)
+);
+
+CREATE TABLE IF NOT EXISTS server_metadata (
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    value BLOB NOT NULL,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, name)
+);
+
+INSERT INTO schema_migrations (version) VALUES (5);
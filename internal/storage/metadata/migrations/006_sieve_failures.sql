@@ -0,0 +1,8 @@
+-- Migration 006: Sieve execution failure tracking
+-- Scripts that fail on every message are disabled after repeated failures
+
+ALTER TABLE sieve_scripts ADD COLUMN failure_count INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE sieve_scripts ADD COLUMN last_error TEXT;
+ALTER TABLE sieve_scripts ADD COLUMN disabled_at DATETIME;
+
+INSERT INTO schema_migrations (version) VALUES (6);
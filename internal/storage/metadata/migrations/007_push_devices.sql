@@ -0,0 +1,19 @@
+-- Migration 007: Push notification device registrations
+-- Devices register over IMAP (XAPPLEPUSHSERVICE) and get a silent APNs push
+-- when new mail arrives in one of their mailboxes.
+
+CREATE TABLE IF NOT EXISTS push_devices (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    device_token TEXT NOT NULL,                -- hex APNs device token
+    account_id TEXT NOT NULL,                  -- aps-account-id, echoed in the payload
+    subtopic TEXT NOT NULL DEFAULT '',
+    mailboxes TEXT NOT NULL DEFAULT 'INBOX',   -- newline-separated mailbox names
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (user_id, device_token, account_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_push_devices_user ON push_devices(user_id);
+
+INSERT INTO schema_migrations (version) VALUES (7);
@@ -0,0 +1,8 @@
+-- Migration 008: Per-user send and receive permissions
+-- Lets an account receive without sending (or vice versa), e.g. a shared
+-- role address or an account suspended for spam
+
+ALTER TABLE users ADD COLUMN can_send BOOLEAN NOT NULL DEFAULT TRUE;
+ALTER TABLE users ADD COLUMN can_receive BOOLEAN NOT NULL DEFAULT TRUE;
+
+INSERT INTO schema_migrations (version) VALUES (8);
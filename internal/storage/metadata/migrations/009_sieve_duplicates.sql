@@ -0,0 +1,15 @@
+-- Migration 009: Sieve duplicate tracking (RFC 7352)
+-- Remembers the unique IDs the "duplicate" test has seen, per user, until
+-- they expire
+
+CREATE TABLE IF NOT EXISTS sieve_duplicates (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    tracking_key TEXT NOT NULL,                -- SHA-256 of handle and unique ID
+    expires_at INTEGER NOT NULL,               -- Unix seconds
+    UNIQUE(user_id, tracking_key)
+);
+
+CREATE INDEX IF NOT EXISTS idx_sieve_duplicates_expiry ON sieve_duplicates(user_id, expires_at);
+
+INSERT INTO schema_migrations (version) VALUES (9);
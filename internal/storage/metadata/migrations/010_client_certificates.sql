@@ -0,0 +1,15 @@
+-- Migration 010: Client certificates for SASL EXTERNAL
+-- Maps a TLS client certificate, by fingerprint, to the user it logs in as
+
+CREATE TABLE IF NOT EXISTS client_certificates (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    fingerprint TEXT NOT NULL UNIQUE,          -- Hex SHA-256 of the DER certificate
+    subject TEXT,                              -- For display only
+    not_after DATETIME,                        -- For display only
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_client_certificates_user ON client_certificates(user_id);
+
+INSERT INTO schema_migrations (version) VALUES (10);
@@ -0,0 +1,16 @@
+-- Migration 011: Application passwords
+-- Per-device passwords for mail clients; they log in to IMAP, SMTP and DAV
+-- but never to the admin panel
+
+CREATE TABLE IF NOT EXISTS app_passwords (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,                        -- Device or client label
+    password_hash TEXT NOT NULL UNIQUE,        -- Hex SHA-256 of the generated password
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    last_used_at DATETIME
+);
+
+CREATE INDEX IF NOT EXISTS idx_app_passwords_user ON app_passwords(user_id);
+
+INSERT INTO schema_migrations (version) VALUES (11);
@@ -0,0 +1,7 @@
+-- Migration 012: IMAP OBJECTID (RFC 8474)
+-- EMAILID is a hash of the message content, so copies and moves keep it.
+-- Rows stored before this migration get theirs the first time it's asked for.
+
+ALTER TABLE messages ADD COLUMN email_id TEXT;
+
+INSERT INTO schema_migrations (version) VALUES (12);
@@ -0,0 +1,11 @@
+-- Migration 014: Index-friendly unseen counts and searches
+-- seen mirrors whether flags holds \Seen, so counting a mailbox's unseen
+-- messages is an index lookup rather than a LIKE over each of its rows.
+
+ALTER TABLE messages ADD COLUMN seen BOOLEAN NOT NULL DEFAULT FALSE;
+UPDATE messages SET seen = TRUE WHERE ',' || flags || ',' LIKE '%,\Seen,%';
+
+CREATE INDEX IF NOT EXISTS idx_messages_unseen ON messages(mailbox_id, seen);
+CREATE INDEX IF NOT EXISTS idx_messages_size ON messages(mailbox_id, size);
+
+INSERT INTO schema_migrations (version) VALUES (14);
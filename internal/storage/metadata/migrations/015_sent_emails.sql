@@ -0,0 +1,20 @@
+-- Migration 015: Outbound sends, for correlating bounces
+-- One row per recipient a message was handed to. return_path is the
+-- envelope sender used, the VERP address when VERP is enabled, so a bounce
+-- sent back to it finds the row it belongs to.
+
+CREATE TABLE IF NOT EXISTS sent_emails (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    message_id TEXT NOT NULL,    -- Queue message ID
+    sender TEXT NOT NULL,
+    recipient TEXT NOT NULL,
+    return_path TEXT NOT NULL,
+    sent_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    bounced_at DATETIME,         -- NULL until a bounce is matched
+    bounce_reason TEXT
+);
+
+CREATE INDEX IF NOT EXISTS idx_sent_emails_return_path ON sent_emails(return_path);
+CREATE INDEX IF NOT EXISTS idx_sent_emails_message ON sent_emails(message_id);
+
+INSERT INTO schema_migrations (version) VALUES (15);
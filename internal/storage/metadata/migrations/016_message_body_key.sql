@@ -0,0 +1,10 @@
+-- Migration 016: Message bodies kept in object storage
+-- body_key names the object holding the body when it is stored outside the
+-- maildir; NULL means the maildir file is the body. Copies of a message
+-- share one object, so it is only deleted with the last row naming it.
+
+ALTER TABLE messages ADD COLUMN body_key TEXT;
+
+CREATE INDEX IF NOT EXISTS idx_messages_body_key ON messages(body_key) WHERE body_key IS NOT NULL;
+
+INSERT INTO schema_migrations (version) VALUES (16);
@@ -0,0 +1,15 @@
+-- Migration 017: IMAP ACL (RFC 4314) for shared mailboxes
+-- Rights another user has on a mailbox, as RFC 4314 right letters. The
+-- owner always has every right and has no row.
+
+CREATE TABLE IF NOT EXISTS mailbox_acls (
+    mailbox_id INTEGER NOT NULL REFERENCES mailboxes(id) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    rights TEXT NOT NULL,                      -- e.g. "lrs"
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (mailbox_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_mailbox_acls_user ON mailbox_acls(user_id);
+
+INSERT INTO schema_migrations (version) VALUES (17);
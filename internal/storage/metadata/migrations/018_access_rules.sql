@@ -0,0 +1,21 @@
+-- Migration 018: Allowlist and denylist of inbound senders and client IPs
+-- A sender pattern is an address, a domain, or *.domain for its subdomains.
+-- An IP rule is a CIDR; single addresses are stored as /32 or /128.
+
+CREATE TABLE IF NOT EXISTS sender_rules (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    pattern TEXT NOT NULL UNIQUE,   -- Lowercase
+    action TEXT NOT NULL CHECK (action IN ('allow', 'deny')),
+    comment TEXT NOT NULL DEFAULT '',
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS ip_rules (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    cidr TEXT NOT NULL UNIQUE,
+    action TEXT NOT NULL CHECK (action IN ('allow', 'deny')),
+    comment TEXT NOT NULL DEFAULT '',
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT INTO schema_migrations (version) VALUES (18);
@@ -0,0 +1,11 @@
+-- Migration 019: Client IP reputation scores kept across restarts
+-- A score is as of updated_at (Unix seconds) and decays from there.
+
+CREATE TABLE IF NOT EXISTS ip_reputation (
+    ip TEXT PRIMARY KEY,
+    score REAL NOT NULL,
+    reason TEXT NOT NULL,
+    updated_at INTEGER NOT NULL
+);
+
+INSERT INTO schema_migrations (version) VALUES (19);
@@ -0,0 +1,12 @@
+-- Migration 021: Match bounces to sent emails by the original message
+-- A bounce must name the message it returns, by the Message-ID in its
+-- returned headers or by the ENVID the sender gave, before its send is
+-- marked. return_path is now stored lowercased, so the index on it is
+-- used when bounces are matched.
+
+ALTER TABLE sent_emails ADD COLUMN original_message_id TEXT; -- Message-ID header, without <>
+ALTER TABLE sent_emails ADD COLUMN envelope_id TEXT;         -- ENVID= given at MAIL FROM
+
+UPDATE sent_emails SET return_path = lower(return_path);
+
+INSERT INTO schema_migrations (version) VALUES (21);
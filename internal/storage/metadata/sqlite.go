@@ -4,13 +4,14 @@ import (
 	"context"
 	"database/sql"
 	"embed"
+	"errors"
 	"fmt"
 	"io/fs"
 	"sort"
 	"strconv"
 	"strings"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 )
 
 //go:embed migrations/*.sql
@@ -44,6 +45,17 @@ func Open(path string) (*DB, error) {
 	return &DB{DB: db}, nil
 }
 
+// IsUniqueViolation reports whether err is a SQLite UNIQUE or PRIMARY KEY
+// constraint failure, i.e. the row being inserted already exists
+func IsUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique ||
+		sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
+}
+
 // Migrate runs all pending database migrations
 func (db *DB) Migrate(ctx context.Context) error {
 	// Get current schema version
@@ -165,3 +177,43 @@ func (db *DB) applyMigration(ctx context.Context, m migration) error {
 func (db *DB) Close() error {
 	return db.DB.Close()
 }
+
+// Vacuum refreshes the query planner's statistics with ANALYZE and
+// rebuilds the database file with VACUUM, returning how many bytes it
+// shrank by. VACUUM holds the write lock until it finishes, so writers
+// wait for it; run it when the server is quiet.
+func (db *DB) Vacuum(ctx context.Context) (int64, error) {
+	before, err := db.size(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := db.ExecContext(ctx, "ANALYZE"); err != nil {
+		return 0, fmt.Errorf("failed to analyze database: %w", err)
+	}
+	if _, err := db.ExecContext(ctx, "VACUUM"); err != nil {
+		return 0, fmt.Errorf("failed to vacuum database: %w", err)
+	}
+	// In WAL mode the rebuilt pages reach the main file at a checkpoint
+	if _, err := db.ExecContext(ctx, "PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+		return 0, fmt.Errorf("failed to checkpoint database: %w", err)
+	}
+
+	after, err := db.size(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return before - after, nil
+}
+
+// size returns the size of the database in bytes
+func (db *DB) size(ctx context.Context) (int64, error) {
+	var pages, pageSize int64
+	if err := db.QueryRowContext(ctx, "PRAGMA page_count").Scan(&pages); err != nil {
+		return 0, fmt.Errorf("failed to get page count: %w", err)
+	}
+	if err := db.QueryRowContext(ctx, "PRAGMA page_size").Scan(&pageSize); err != nil {
+		return 0, fmt.Errorf("failed to get page size: %w", err)
+	}
+	return pages * pageSize, nil
+}
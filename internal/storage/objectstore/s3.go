@@ -0,0 +1,252 @@
+// Package objectstore stores message bodies in an S3-compatible bucket,
+// such as Amazon S3, MinIO or Ceph RGW
+package objectstore
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned when the bucket has no object with the key
+var ErrNotFound = errors.New("object not found")
+
+// emptyPayloadHash is the SHA-256 of an empty request body
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+const (
+	// requestTimeout bounds a request that transfers no body
+	requestTimeout = 30 * time.Second
+	// transferTimeout bounds a request that uploads or downloads a body,
+	// which can be tens of megabytes
+	transferTimeout = 5 * time.Minute
+)
+
+// Config describes the bucket bodies are stored in
+type Config struct {
+	Endpoint        string // e.g. https://s3.eu-central-1.amazonaws.com or http://minio:9000
+	Region          string // Signing region, e.g. eu-central-1
+	Bucket          string
+	Prefix          string // Prepended to every key, e.g. "messages/"
+	AccessKeyID     string
+	SecretAccessKey string
+	PathStyle       bool // Address the bucket as endpoint/bucket rather than bucket.endpoint
+}
+
+// Client reads and writes objects with AWS Signature Version 4 requests
+type Client struct {
+	config   Config
+	endpoint *url.URL
+	client   *http.Client
+}
+
+// New creates a client for the bucket in cfg
+func New(cfg Config) (*Client, error) {
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid object storage endpoint %q", cfg.Endpoint)
+	}
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("object storage bucket is required")
+	}
+	return &Client{
+		config:   cfg,
+		endpoint: u,
+		// Each request is bounded by its own context instead, so a download
+		// is cut off by its timeout rather than a client wide one
+		client: &http.Client{},
+	}, nil
+}
+
+// Put uploads size bytes from body as the object key
+func (c *Client) Put(ctx context.Context, key string, body io.Reader, size int64) error {
+	ctx, cancel := context.WithTimeout(ctx, transferTimeout)
+	defer cancel()
+	req, err := c.newRequest(ctx, http.MethodPut, key, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "message/rfc822")
+	// The payload is streamed, so it is sent unsigned rather than read
+	// twice to hash it
+	c.sign(req, "UNSIGNED-PAYLOAD", time.Now())
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to put object %s: %w", key, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return responseError("put", key, resp)
+	}
+	return nil
+}
+
+// Get streams the object key. It returns ErrNotFound if there is none.
+// The download is bounded by transferTimeout until the body is closed.
+func (c *Client) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	ctx, cancel := context.WithTimeout(ctx, transferTimeout)
+	req, err := c.newRequest(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	c.sign(req, emptyPayloadHash, time.Now())
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to get object %s: %w", key, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer cancel()
+		defer resp.Body.Close()
+		return nil, responseError("get", key, resp)
+	}
+	return &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}, nil
+}
+
+// cancelOnClose is a response body that ends its request's context when
+// closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// Delete removes the object key. Deleting a missing object succeeds.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	req, err := c.newRequest(ctx, http.MethodDelete, key, nil)
+	if err != nil {
+		return err
+	}
+	c.sign(req, emptyPayloadHash, time.Now())
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to delete object %s: %w", key, err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	}
+	return responseError("delete", key, resp)
+}
+
+// newRequest creates a request for the object key in the bucket
+func (c *Client) newRequest(ctx context.Context, method, key string, body io.Reader) (*http.Request, error) {
+	if key == "" {
+		return nil, fmt.Errorf("object key is required")
+	}
+	objectPath := "/" + c.config.Prefix + key
+	host := c.endpoint.Host
+	if c.config.PathStyle {
+		objectPath = "/" + c.config.Bucket + objectPath
+	} else {
+		host = c.config.Bucket + "." + host
+	}
+
+	u := &url.URL{
+		Scheme:  c.endpoint.Scheme,
+		Host:    host,
+		Path:    strings.TrimSuffix(c.endpoint.Path, "/") + objectPath,
+		RawPath: strings.TrimSuffix(c.endpoint.EscapedPath(), "/") + escapePath(objectPath),
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// sign adds the Signature Version 4 Authorization header to req
+func (c *Client) sign(req *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + c.config.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.config.SecretAccessKey), day)
+	key = hmacSHA256(key, c.config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.config.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// escapePath percent-encodes everything in p but unreserved characters and
+// slashes, the encoding Signature Version 4 expects for S3 object paths
+func escapePath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if c == '/' || c == '-' || c == '_' || c == '.' || c == '~' ||
+			('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// responseError describes a failed request from the S3 error document
+func responseError(op, key string, resp *http.Response) error {
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	var body struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	xml.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&body)
+	if body.Code == "" {
+		return fmt.Errorf("object storage %s %s failed: %s", op, key, resp.Status)
+	}
+	return fmt.Errorf("object storage %s %s failed: %s %s: %s", op, key, resp.Status, body.Code, body.Message)
+}
@@ -0,0 +1,125 @@
+package objectstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeS3 is an in-memory bucket speaking enough of the S3 API for Client
+type fakeS3 struct {
+	t       *testing.T
+	mu      sync.Mutex
+	objects map[string][]byte // path -> content
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/") ||
+		!strings.Contains(auth, "/us-east-1/s3/aws4_request, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=") {
+		f.t.Errorf("%s %s Authorization = %q", r.Method, r.URL.Path, auth)
+		http.Error(w, "", http.StatusForbidden)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		f.objects[r.URL.Path] = data
+	case http.MethodGet:
+		data, ok := f.objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, "<Error><Code>NoSuchKey</Code></Error>")
+			return
+		}
+		w.Write(data)
+	case http.MethodDelete:
+		delete(f.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func newTestClient(t *testing.T) (*Client, *fakeS3) {
+	t.Helper()
+	bucket := &fakeS3{t: t, objects: make(map[string][]byte)}
+	srv := httptest.NewServer(bucket)
+	t.Cleanup(srv.Close)
+
+	c, err := New(Config{
+		Endpoint:        srv.URL,
+		Region:          "us-east-1",
+		Bucket:          "mail",
+		Prefix:          "messages/",
+		AccessKeyID:     "AKID",
+		SecretAccessKey: "secret",
+		PathStyle:       true,
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	return c, bucket
+}
+
+func TestClientRoundTrip(t *testing.T) {
+	c, bucket := newTestClient(t)
+	ctx := context.Background()
+	body := "Subject: hi\r\n\r\nhello\r\n"
+
+	if err := c.Put(ctx, "abc123", strings.NewReader(body), int64(len(body))); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	if got := string(bucket.objects["/mail/messages/abc123"]); got != body {
+		t.Fatalf("stored object = %q, want %q", got, body)
+	}
+
+	r, err := c.Get(ctx, "abc123")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	data, _ := io.ReadAll(r)
+	r.Close()
+	if string(data) != body {
+		t.Errorf("Get() = %q, want %q", data, body)
+	}
+
+	if err := c.Delete(ctx, "abc123"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, err := c.Get(ctx, "abc123"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get() after Delete error = %v, want ErrNotFound", err)
+	}
+	// Deleting again is not an error
+	if err := c.Delete(ctx, "abc123"); err != nil {
+		t.Errorf("second Delete() error = %v", err)
+	}
+}
+
+func TestClientVirtualHostedURL(t *testing.T) {
+	c, err := New(Config{Endpoint: "https://s3.eu-central-1.amazonaws.com", Region: "eu-central-1", Bucket: "mail"})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	req, err := c.newRequest(context.Background(), http.MethodGet, "a b", nil)
+	if err != nil {
+		t.Fatalf("newRequest() error = %v", err)
+	}
+	if got, want := req.URL.String(), "https://mail.s3.eu-central-1.amazonaws.com/a%20b"; got != want {
+		t.Errorf("URL = %q, want %q", got, want)
+	}
+}
+
+func TestNewRejectsBadEndpoint(t *testing.T) {
+	for _, endpoint := range []string{"", "s3.amazonaws.com", "ftp://example.com"} {
+		if _, err := New(Config{Endpoint: endpoint, Bucket: "mail"}); err == nil {
+			t.Errorf("New(%q) succeeded, want error", endpoint)
+		}
+	}
+}
@@ -2,10 +2,25 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"io"
 	"time"
 )
 
+var (
+	// ErrMailboxNotFound is returned when a mailbox doesn't exist
+	ErrMailboxNotFound = errors.New("mailbox not found")
+	// ErrMessageNotFound is returned when a message doesn't exist
+	ErrMessageNotFound = errors.New("message not found")
+	// ErrMailboxExists is returned when creating or renaming to a taken name
+	ErrMailboxExists = errors.New("mailbox already exists")
+	// ErrOverQuota is returned when a message would take its owner over quota
+	ErrOverQuota = errors.New("quota exceeded")
+	// ErrMailboxLimit is returned when a mailbox would exceed the per-user
+	// mailbox count or hierarchy depth
+	ErrMailboxLimit = errors.New("mailbox limit exceeded")
+)
+
 // Flag represents an IMAP message flag
 type Flag string
 
@@ -30,6 +45,22 @@ const (
 	SpecialUseAll     SpecialUse = `\All`
 )
 
+// DefaultMailbox is a mailbox created for every new user
+type DefaultMailbox struct {
+	Name       string
+	SpecialUse SpecialUse
+}
+
+// DefaultMailboxes is the mailbox set used when none is configured
+var DefaultMailboxes = []DefaultMailbox{
+	{"INBOX", ""},
+	{"Drafts", SpecialUseDrafts},
+	{"Sent", SpecialUseSent},
+	{"Junk", SpecialUseJunk},
+	{"Trash", SpecialUseTrash},
+	{"Archive", SpecialUseArchive},
+}
+
 // Mailbox represents an IMAP mailbox/folder
 type Mailbox struct {
 	ID          int64
@@ -82,15 +113,26 @@ type MessageStore interface {
 	CopyMessage(ctx context.Context, srcMailboxID int64, uid uint32, destMailboxID int64) (*Message, error)
 	MoveMessage(ctx context.Context, srcMailboxID int64, uid uint32, destMailboxID int64) (*Message, error)
 	ExpungeMailbox(ctx context.Context, mailboxID int64) ([]uint32, error)
+	ExpungeUIDs(ctx context.Context, mailboxID int64, uids []uint32) ([]uint32, error)
 
 	// Search operations
 	SearchMessages(ctx context.Context, mailboxID int64, criteria *SearchCriteria) ([]uint32, error)
 
 	// Stats
 	GetMailboxStats(ctx context.Context, mailboxID int64) (*MailboxStats, error)
+	ClearRecent(ctx context.Context, mailboxID int64) ([]uint32, error)
 	UpdateUserQuota(ctx context.Context, userID int64, deltaBytes int64) error
 }
 
+// BodyStore keeps message bodies outside the maildir, such as in an object
+// storage bucket. Keys are derived from a body's content, so storing the
+// same body twice writes the same object.
+type BodyStore interface {
+	Put(ctx context.Context, key string, body io.Reader, size int64) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
 // SearchCriteria defines email search parameters
 type SearchCriteria struct {
 	Since    *time.Time
@@ -115,6 +157,33 @@ type MailboxStats struct {
 	UIDValidity uint32
 }
 
+// MetadataEntry is an IMAP METADATA (RFC 5464) annotation
+type MetadataEntry struct {
+	Name  string // e.g. "/private/comment", stored lowercase
+	Value []byte
+}
+
+// ObjectIDs are a message's RFC 8474 object IDs
+type ObjectIDs struct {
+	EmailID  string
+	ThreadID string
+}
+
+// ACLEntry is the set of RFC 4314 rights a user other than the owner has
+// on a mailbox
+type ACLEntry struct {
+	UserID int64
+	Email  string
+	Rights string // Right letters, e.g. "lrs"
+}
+
+// SharedMailbox is a mailbox of another user the user has rights on
+type SharedMailbox struct {
+	Mailbox
+	OwnerEmail string
+	Rights     string
+}
+
 // Calendar represents a CalDAV calendar
 type Calendar struct {
 	ID          int64
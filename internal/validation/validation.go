@@ -5,6 +5,7 @@ import (
 	"errors"
 	"regexp"
 	"strings"
+	"unicode/utf8"
 )
 
 var (
@@ -30,10 +31,10 @@ const (
 )
 
 var (
-	// RFC 5321 compliant local-part pattern (simplified for common use cases)
-	// Allows: alphanumeric, dot, hyphen, underscore, plus
+	// RFC 5321/6531 compliant local-part pattern (simplified for common use cases)
+	// Allows: letters and digits in any script, combining marks, dot, hyphen, underscore, plus
 	// Does not allow: leading/trailing dots, consecutive dots
-	usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9._+-]*[a-zA-Z0-9])?$`)
+	usernamePattern = regexp.MustCompile(`^[\p{L}\p{N}]([\p{L}\p{N}\p{M}._+-]*[\p{L}\p{N}\p{M}])?$`)
 
 	// RFC 1035 compliant domain name pattern
 	// Labels: 1-63 chars, alphanumeric and hyphen, not starting/ending with hyphen
@@ -90,3 +91,30 @@ func Domain(domain string) error {
 
 	return nil
 }
+
+// MaxExternalStringLength bounds strings that originate outside the server
+// (remote SMTP replies, hostnames, headers) before they are stored or rendered
+const MaxExternalStringLength = 1024
+
+// Truncate shortens s to at most max bytes without splitting a UTF-8 sequence
+func Truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	// Back up to the start of the rune that straddles the cut
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+	return s[:max]
+}
+
+// IsASCII reports whether s is all 7-bit ASCII, as an address must be for a
+// peer without SMTPUTF8
+func IsASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
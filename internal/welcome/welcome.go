@@ -0,0 +1,144 @@
+// Package welcome builds the message delivered to the INBOX of new users,
+// explaining how to set up their mail client.
+package welcome
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/fenilsonani/email-server/internal/config"
+	"github.com/fenilsonani/email-server/internal/msgid"
+	"github.com/fenilsonani/email-server/internal/storage"
+)
+
+// defaultBody is used when welcome.template_file is not set
+const defaultBody = `Welcome to {{.Domain}}, {{.Email}}!
+
+Your mailbox is ready. To read and send mail from a mail client, use
+these settings:
+
+Incoming mail (IMAP)
+  Server:   {{.Hostname}}
+  Port:     {{.IMAPSPort}} (SSL/TLS) or {{.IMAPPort}} (STARTTLS)
+  Username: {{.Email}}
+
+Outgoing mail (SMTP)
+  Server:   {{.Hostname}}
+  Port:     {{.SubmissionPort}} (STARTTLS) or {{.SMTPSPort}} (SSL/TLS)
+  Username: {{.Email}}
+
+Both require your full email address and password.
+`
+
+// Fields are the values a welcome template can refer to
+type Fields struct {
+	Email          string
+	Domain         string
+	Hostname       string
+	IMAPPort       int
+	IMAPSPort      int
+	SubmissionPort int
+	SMTPSPort      int
+}
+
+// Store is the part of the mail store the welcome message is delivered to
+type Store interface {
+	GetMailbox(ctx context.Context, userID int64, name string) (*storage.Mailbox, error)
+	AppendMessage(ctx context.Context, mailboxID int64, flags []storage.Flag, date time.Time, body io.Reader) (*storage.Message, error)
+}
+
+// Message renders the welcome message for email from cfg.Welcome, filling
+// in the client settings from cfg.Server
+func Message(cfg *config.Config, email string, now time.Time) ([]byte, error) {
+	_, domain, _ := strings.Cut(email, "@")
+	fields := Fields{
+		Email:          email,
+		Domain:         domain,
+		Hostname:       cfg.Server.Hostname,
+		IMAPPort:       cfg.Server.IMAPPort,
+		IMAPSPort:      cfg.Server.IMAPSPort,
+		SubmissionPort: cfg.Server.SubmissionPort,
+		SMTPSPort:      cfg.Server.SMTPSPort,
+	}
+
+	body := defaultBody
+	if cfg.Welcome.TemplateFile != "" {
+		data, err := os.ReadFile(cfg.Welcome.TemplateFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read welcome template: %w", err)
+		}
+		body = string(data)
+	}
+
+	subject, err := render("subject", cfg.Welcome.Subject, fields)
+	if err != nil {
+		return nil, err
+	}
+	text, err := render("body", body, fields)
+	if err != nil {
+		return nil, err
+	}
+
+	from := cfg.Welcome.From
+	if from == "" {
+		from = "postmaster@" + domain
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", email)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", strings.TrimSpace(subject)))
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s>\r\n", msgid.New(domain))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	b.WriteString("\r\n")
+	for _, line := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+		b.WriteString(strings.TrimRight(line, "\r"))
+		b.WriteString("\r\n")
+	}
+	return b.Bytes(), nil
+}
+
+// render executes the text/template src with fields
+func render(name, src string, fields Fields) (string, error) {
+	tmpl, err := template.New(name).Parse(src)
+	if err != nil {
+		return "", fmt.Errorf("invalid welcome %s template: %w", name, err)
+	}
+	var out strings.Builder
+	if err := tmpl.Execute(&out, fields); err != nil {
+		return "", fmt.Errorf("failed to render welcome %s: %w", name, err)
+	}
+	return out.String(), nil
+}
+
+// Deliver appends the welcome message to the INBOX of the user with
+// userID and address email. It does nothing unless welcome.enabled is set.
+func Deliver(ctx context.Context, cfg *config.Config, store Store, userID int64, email string) error {
+	if !cfg.Welcome.Enabled {
+		return nil
+	}
+
+	now := time.Now()
+	msg, err := Message(cfg, email, now)
+	if err != nil {
+		return err
+	}
+	inbox, err := store.GetMailbox(ctx, userID, "INBOX")
+	if err != nil {
+		return fmt.Errorf("failed to find INBOX: %w", err)
+	}
+	if _, err := store.AppendMessage(ctx, inbox.ID, nil, now, bytes.NewReader(msg)); err != nil {
+		return fmt.Errorf("failed to deliver welcome message: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package welcome
+
+import (
+	"mime"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fenilsonani/email-server/internal/config"
+)
+
+func TestMessageFillsInSettings(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.Server.Hostname = "mail.example.com"
+
+	data, err := Message(cfg, "alice@example.com", time.Now())
+	if err != nil {
+		t.Fatalf("Message() error = %v", err)
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(string(data)))
+	if err != nil {
+		t.Fatalf("ReadMessage() error = %v", err)
+	}
+	if got := msg.Header.Get("From"); got != "postmaster@example.com" {
+		t.Errorf("From = %q, want postmaster@example.com", got)
+	}
+	if got := msg.Header.Get("Subject"); got != "Welcome to example.com" {
+		t.Errorf("Subject = %q", got)
+	}
+	body := string(data)
+	for _, want := range []string{"Server:   mail.example.com", "993 (SSL/TLS) or 143 (STARTTLS)", "587 (STARTTLS) or 465 (SSL/TLS)"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("body does not contain %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestMessageUsesTemplateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "welcome.txt")
+	os.WriteFile(path, []byte("Hi {{.Email}}, connect to {{.Hostname}}:{{.IMAPSPort}}.\n"), 0600)
+
+	cfg := config.DefaultConfig()
+	cfg.Server.Hostname = "mail.example.com"
+	cfg.Welcome.TemplateFile = path
+	cfg.Welcome.From = "help@example.com"
+	cfg.Welcome.Subject = "Grüße, {{.Email}}"
+
+	data, err := Message(cfg, "bob@example.com", time.Now())
+	if err != nil {
+		t.Fatalf("Message() error = %v", err)
+	}
+	msg, _ := mail.ReadMessage(strings.NewReader(string(data)))
+	if got, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject")); got != "Grüße, bob@example.com" {
+		t.Errorf("Subject = %q", got)
+	}
+	if got := msg.Header.Get("From"); got != "help@example.com" {
+		t.Errorf("From = %q", got)
+	}
+	if !strings.HasSuffix(string(data), "\r\n\r\nHi bob@example.com, connect to mail.example.com:993.\r\n") {
+		t.Errorf("message = %q", data)
+	}
+
+	cfg.Welcome.Subject = "{{.Nope}}"
+	if _, err := Message(cfg, "bob@example.com", time.Now()); err == nil {
+		t.Error("Message() with an unknown template field succeeded")
+	}
+}